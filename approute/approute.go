@@ -0,0 +1,166 @@
+// Package approute implements per-application routing on Linux: packets of
+// processes in selected cgroups (v2) are marked using nftables and policy
+// routing rules select the routing table based on the mark.
+//
+// Tunnel routes are installed in a separate table. In the exclude mode,
+// unmarked packets use it and marked ones bypass the tunnel, in the include
+// mode only marked packets use it.
+package approute
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+const (
+	ModeExclude = "exclude"
+	ModeInclude = "include"
+
+	DefaultFwMark = 0x7762
+	DefaultTable  = 7762
+
+	// rulePriority is below the main table rule (32766) and leaves room for
+	// rules added by the administrator before it.
+	rulePriority = 31000
+
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+type Config struct {
+	// "exclude" keeps traffic of listed applications off the tunnel,
+	// "include" sends only their traffic through it. Disabled if empty.
+	Mode string `toml:"mode"`
+	// systemd units and cgroup paths relative to the cgroup v2 root.
+	Units   []string `toml:"units"`
+	Cgroups []string `toml:"cgroups"`
+
+	// Firewall mark for packets of listed applications and the routing
+	// table for tunnel routes.
+	FwMark uint32 `toml:"fwmark"`
+	Table  int    `toml:"table"`
+}
+
+func (c Config) Enabled() bool {
+	return c.Mode != ""
+}
+
+// Rules returns policy routing rules for the configuration.
+func Rules(cfg Config) []linkmgr.Rule {
+	var rules []linkmgr.Rule
+	for _, v6 := range []bool{false, true} {
+		switch cfg.Mode {
+		case ModeExclude:
+			rules = append(rules,
+				// Routes more specific than the default route in the main
+				// table (e.g. LAN) take precedence over the tunnel.
+				linkmgr.Rule{IPv6: v6, Priority: rulePriority, Table: 254, SuppressDefault: true},
+				linkmgr.Rule{IPv6: v6, Priority: rulePriority + 1, Mark: cfg.FwMark, Invert: true, Table: cfg.Table},
+			)
+		case ModeInclude:
+			rules = append(rules,
+				linkmgr.Rule{IPv6: v6, Priority: rulePriority + 1, Mark: cfg.FwMark, Table: cfg.Table},
+			)
+		}
+	}
+	return rules
+}
+
+// unitCgroup returns the cgroup of the running systemd unit, empty string if
+// it is not running.
+func unitCgroup(unit string) (string, error) {
+	out, err := exec.Command("systemctl", "show", "-p", "ControlGroup", unit).Output()
+	if err != nil {
+		return "", fmt.Errorf("approute: systemctl show %s: %w", unit, err)
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(out)), "ControlGroup="), nil
+}
+
+// Cgroups returns paths of existing cgroups for units and cgroups listed in
+// cfg, sorted. Units that are not running are skipped.
+func Cgroups(cfg Config) ([]string, error) {
+	paths := make(map[string]bool)
+	for _, unit := range cfg.Units {
+		cg, err := unitCgroup(unit)
+		if err != nil {
+			return nil, err
+		}
+		if cg != "" {
+			paths[strings.Trim(cg, "/")] = true
+		}
+	}
+	for _, cg := range cfg.Cgroups {
+		cg = strings.Trim(filepath.Clean("/"+cg), "/")
+		if _, err := os.Stat(filepath.Join(cgroupRoot, cg)); err != nil {
+			continue
+		}
+		paths[cg] = true
+	}
+
+	res := make([]string, 0, len(paths))
+	for cg := range paths {
+		if cg != "" {
+			res = append(res, cg)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func tableName(link string) string {
+	return "wirebox_" + strings.NewReplacer("-", "_", ".", "_").Replace(link)
+}
+
+// ruleset returns the nft script replacing the table for link with the one
+// marking packets from cgroups.
+func ruleset(link string, mark uint32, cgroups []string) string {
+	name := tableName(link)
+	var b strings.Builder
+	// Declaring the table first makes the deletion succeed if it does not
+	// exist yet, the script is applied atomically.
+	fmt.Fprintf(&b, "table inet %s {}\n", name)
+	fmt.Fprintf(&b, "delete table inet %s\n", name)
+	fmt.Fprintf(&b, "table inet %s {\n", name)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype route hook output priority mangle; policy accept;\n")
+	for _, cg := range cgroups {
+		level := strings.Count(cg, "/") + 1
+		fmt.Fprintf(&b, "\t\tsocket cgroupv2 level %d %s meta mark set %#x\n", level, strconv.Quote(cg), mark)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	// Records are single lines, the script is flattened.
+	audit.Record("exec", "nft -f - (stdin: %s)", strings.Join(strings.Fields(script), " "))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("approute: nft: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// Apply replaces nftables rules marking packets for link.
+func Apply(link string, mark uint32, cgroups []string) error {
+	return nft(ruleset(link, mark, cgroups))
+}
+
+// Remove deletes nftables rules for link.
+func Remove(link string) error {
+	name := tableName(link)
+	return nft(fmt.Sprintf("table inet %s {}\ndelete table inet %s\n", name, name))
+}
@@ -0,0 +1,116 @@
+// Package audit records changes wirebox makes to the system.
+//
+// Each record is written before the change is made so the audit stream
+// also contains operations that failed or were interrupted. Records are
+// plain text lines: timestamp, program name and PID, operation kind and its
+// arguments. Private and preshared keys are never recorded.
+package audit
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Config struct {
+	// File to append audit records to, "-" for stderr. Audit mode is
+	// disabled if empty.
+	File string `toml:"file"`
+}
+
+func (c Config) Enabled() bool {
+	return c.File != ""
+}
+
+var (
+	lock   sync.RWMutex
+	logger *log.Logger
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Setup enables audit mode if it is enabled in the configuration. ident is
+// the program name to use for the records.
+func Setup(cfg Config, ident string) (io.Closer, error) {
+	if !cfg.Enabled() {
+		return nopCloser{}, nil
+	}
+
+	var w io.WriteCloser
+	if cfg.File == "-" {
+		w = nopCloser{os.Stderr}
+	} else {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("audit: %w", err)
+		}
+		w = f
+	}
+
+	SetOutput(w, ident)
+	return w, nil
+}
+
+// SetOutput directs audit records to w, nil disables audit mode.
+func SetOutput(w io.Writer, ident string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if w == nil {
+		logger = nil
+		return
+	}
+	prefix := ident + "[" + strconv.Itoa(os.Getpid()) + "]: "
+	logger = log.New(w, prefix, log.LstdFlags|log.Lmicroseconds|log.Lmsgprefix)
+}
+
+// Enabled reports whether audit records are written. It can be used to skip
+// formatting expensive records.
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return logger != nil
+}
+
+// Record writes the audit record for the operation of the specified kind
+// (e.g. "netlink", "exec", "wg").
+func Record(kind string, format string, args ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if logger == nil {
+		return
+	}
+	if err := logger.Output(2, kind+": "+fmt.Sprintf(format, args...)); err != nil {
+		log.Println("error: audit:", err)
+	}
+}
+
+// Command records the command about to be executed. Only the command line
+// is recorded, environment and stdin may contain secrets.
+func Command(cmd *exec.Cmd) {
+	if !Enabled() {
+		return
+	}
+	args := make([]string, len(cmd.Args))
+	for i, a := range cmd.Args {
+		args[i] = quoteArg(a)
+	}
+	Record("exec", "%s", strings.Join(args, " "))
+}
+
+func quoteArg(a string) string {
+	if a != "" && !strings.ContainsAny(a, " \t\n\"'\\$`") {
+		return a
+	}
+	return strconv.Quote(a)
+}
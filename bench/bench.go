@@ -0,0 +1,266 @@
+// Package bench implements the in-tunnel throughput and latency test run
+// between the client and the server.
+//
+// Throughput is measured over TCP: the client sends the mode byte ('u' for
+// upload, 'd' for download) and then either writes data until the test
+// duration elapses and half-closes the connection, after which the server
+// replies with the number of bytes it received, or reads data sent by the
+// server until the test duration elapses. Latency, jitter and loss are
+// measured by UDP datagrams echoed back by the server.
+package bench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DefaultPort is the TCP and UDP port used if not configured otherwise.
+const DefaultPort = 22435
+
+const (
+	modeUpload   = 'u'
+	modeDownload = 'd'
+
+	bufSize = 64 * 1024
+	// probeSize is the size of the echo datagram: magic, sequence number
+	// and the send time.
+	probeSize = 16
+)
+
+var probeMagic = []byte("WBXB")
+
+// DialFunc creates connections to the server, e.g. in a specific network
+// namespace.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+type Options struct {
+	// In-tunnel server address and port.
+	Addr net.IP
+	Port int
+
+	// Duration of each throughput direction.
+	Duration time.Duration
+
+	// Number of echo datagrams, the interval between them and the time to
+	// wait for the last reply.
+	Probes   int
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// net.Dial is used if nil.
+	Dial DialFunc
+}
+
+type Result struct {
+	Target string `json:"target"`
+
+	// Bits per second in each direction.
+	Upload   float64 `json:"upload-bps"`
+	Download float64 `json:"download-bps"`
+
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Loss     float64       `json:"loss"`
+	MinRTT   time.Duration `json:"min-rtt"`
+	AvgRTT   time.Duration `json:"avg-rtt"`
+	MaxRTT   time.Duration `json:"max-rtt"`
+	// Mean difference between consecutive RTTs.
+	Jitter time.Duration `json:"jitter"`
+
+	Time time.Time `json:"time"`
+}
+
+// Run measures throughput in both directions and then the latency.
+func Run(opts Options) (Result, error) {
+	if opts.Dial == nil {
+		opts.Dial = net.Dial
+	}
+	if opts.Port == 0 {
+		opts.Port = DefaultPort
+	}
+	addr := net.JoinHostPort(opts.Addr.String(), strconv.Itoa(opts.Port))
+	res := Result{Target: opts.Addr.String(), Time: time.Now()}
+
+	var err error
+	res.Upload, err = upload(opts.Dial, addr, opts.Duration)
+	if err != nil {
+		return res, fmt.Errorf("bench: upload: %w", err)
+	}
+	res.Download, err = download(opts.Dial, addr, opts.Duration)
+	if err != nil {
+		return res, fmt.Errorf("bench: download: %w", err)
+	}
+	if err := echo(opts, addr, &res); err != nil {
+		return res, fmt.Errorf("bench: latency: %w", err)
+	}
+	return res, nil
+}
+
+func upload(dial DialFunc, addr string, d time.Duration) (float64, error) {
+	c, err := dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte{modeUpload}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, bufSize)
+	start := time.Now()
+	c.SetWriteDeadline(start.Add(d))
+	for {
+		if _, err := c.Write(buf); err != nil {
+			if isTimeout(err) {
+				break
+			}
+			return 0, err
+		}
+	}
+	c.SetWriteDeadline(time.Time{})
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Count bytes the server actually received, the write buffer is not
+	// drained yet.
+	c.SetReadDeadline(time.Now().Add(d + 10*time.Second))
+	var received uint64
+	if err := binary.Read(c, binary.BigEndian, &received); err != nil {
+		return 0, fmt.Errorf("server did not report received bytes: %w", err)
+	}
+	return float64(received*8) / time.Since(start).Seconds(), nil
+}
+
+func download(dial DialFunc, addr string, d time.Duration) (float64, error) {
+	c, err := dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte{modeDownload}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, bufSize)
+	start := time.Now()
+	c.SetReadDeadline(start.Add(d))
+	var received uint64
+	for {
+		n, err := c.Read(buf)
+		received += uint64(n)
+		if err != nil {
+			if isTimeout(err) {
+				break
+			}
+			if err == io.EOF {
+				return 0, errors.New("server closed the connection early")
+			}
+			return 0, err
+		}
+	}
+	return float64(received*8) / time.Since(start).Seconds(), nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func echo(opts Options, addr string, res *Result) error {
+	if opts.Probes <= 0 {
+		return nil
+	}
+	c, err := opts.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	rtts := make([]time.Duration, opts.Probes)
+	for i := range rtts {
+		rtts[i] = -1
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		buf := make([]byte, probeSize)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+			if n != probeSize || !bytes.Equal(buf[:4], probeMagic) {
+				continue
+			}
+			seq := binary.BigEndian.Uint32(buf[4:])
+			sent := int64(binary.BigEndian.Uint64(buf[8:]))
+			if int(seq) < len(rtts) && rtts[seq] < 0 {
+				rtts[seq] = time.Since(time.Unix(0, sent))
+			}
+		}
+	}()
+
+	buf := make([]byte, probeSize)
+	copy(buf, probeMagic)
+	for i := 0; i < opts.Probes; i++ {
+		if i != 0 {
+			time.Sleep(opts.Interval)
+		}
+		binary.BigEndian.PutUint32(buf[4:], uint32(i))
+		binary.BigEndian.PutUint64(buf[8:], uint64(time.Now().UnixNano()))
+		if _, err := c.Write(buf); err != nil {
+			return err
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(opts.Timeout))
+	<-readDone
+
+	res.Sent = opts.Probes
+	res.MinRTT = math.MaxInt64
+	var (
+		sum, jitter time.Duration
+		prev        time.Duration = -1
+	)
+	for _, rtt := range rtts {
+		if rtt < 0 {
+			continue
+		}
+		res.Received++
+		sum += rtt
+		if rtt < res.MinRTT {
+			res.MinRTT = rtt
+		}
+		if rtt > res.MaxRTT {
+			res.MaxRTT = rtt
+		}
+		if prev >= 0 {
+			diff := rtt - prev
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+		prev = rtt
+	}
+	res.Loss = 1 - float64(res.Received)/float64(res.Sent)
+	if res.Received == 0 {
+		res.MinRTT = 0
+		return nil
+	}
+	res.AvgRTT = sum / time.Duration(res.Received)
+	if res.Received > 1 {
+		res.Jitter = jitter / time.Duration(res.Received-1)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDuration limits how long a single connection is served so a stuck or
+// malicious client does not keep the server busy.
+const maxDuration = 2 * time.Minute
+
+// Server answers throughput and latency tests.
+type Server struct {
+	tcp   net.Listener
+	udp   net.PacketConn
+	allow func(net.IP) bool
+	wg    sync.WaitGroup
+}
+
+// Listen starts serving tests on all addresses of the host. Tests are
+// answered only for peers allow returns true for, e.g. addresses assigned
+// to clients, so the server is not reachable from outside the tunnel.
+func Listen(port int, allow func(net.IP) bool) (*Server, error) {
+	addr := ":" + strconv.Itoa(port)
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bench: %w", err)
+	}
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("bench: %w", err)
+	}
+
+	s := &Server{tcp: tcp, udp: udp, allow: allow}
+	s.wg.Add(2)
+	go s.serveTCP()
+	go s.serveUDP()
+	log.Println("bench server listening on port", port)
+	return s, nil
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		if !s.allow(c.RemoteAddr().(*net.TCPAddr).IP) {
+			c.Close()
+			continue
+		}
+		go s.handleConn(c)
+	}
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(maxDuration))
+
+	mode := make([]byte, 1)
+	if _, err := io.ReadFull(c, mode); err != nil {
+		return
+	}
+	switch mode[0] {
+	case modeUpload:
+		n, err := io.Copy(ioutil.Discard, c)
+		if err != nil {
+			return
+		}
+		binary.Write(c, binary.BigEndian, uint64(n))
+	case modeDownload:
+		buf := make([]byte, bufSize)
+		for {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, probeSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n != probeSize || !bytes.Equal(buf[:4], probeMagic) {
+			continue
+		}
+		if !s.allow(addr.(*net.UDPAddr).IP) {
+			continue
+		}
+		s.udp.WriteTo(buf, addr)
+	}
+}
+
+// Close stops accepting tests. Connections being served are closed once the
+// client disconnects or maxDuration passes.
+func (s *Server) Close() error {
+	s.tcp.Close()
+	s.udp.Close()
+	s.wg.Wait()
+	return nil
+}
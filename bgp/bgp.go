@@ -0,0 +1,308 @@
+// Package bgp implements a minimal BGP-4 speaker (RFC 4271) that announces
+// routes to configured neighbors and learns routes from them.
+//
+// IPv4 and IPv6 unicast (RFC 4760) and four-octet AS numbers (RFC 6793) are
+// supported. The speaker only connects to neighbors, it does not accept
+// connections, and it does not select best paths: a route is imported while
+// at least one neighbor announces it. AS_PATH is only checked for the local
+// AS, routes looped back are not imported.
+//
+// The speaker stands in for gobgp (github.com/osrg/gobgp/v3/pkg/server),
+// which is meant to replace it. Until then it should stay this small: no
+// route reflection, no policies and no other address families or path
+// attributes.
+package bgp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Local AS number.
+	ASN uint32 `toml:"asn"`
+	// BGP identifier, an IPv4 address. Set by the caller if empty.
+	RouterID net.IP `toml:"router-id"`
+	// Hold time proposed to neighbors in seconds, 90 by default.
+	HoldTime int `toml:"hold-time"`
+
+	Neighbors []Neighbor `toml:"neighbors"`
+
+	// Next hops announced for IPv4 and IPv6 routes, the local address of
+	// the session is used by default. Routes of the other address family are
+	// not announced over the session unless the next hop is set.
+	NextHop4 net.IP `toml:"next-hop4"`
+	NextHop6 net.IP `toml:"next-hop6"`
+
+	// Learned routes within these networks are imported, nothing is
+	// imported by default.
+	Import []string `toml:"import"`
+}
+
+type Neighbor struct {
+	// Address of the neighbor, the port is 179 unless specified
+	// ("host:port").
+	Address string `toml:"address"`
+	ASN     uint32 `toml:"asn"`
+}
+
+func (c Config) Enabled() bool {
+	return len(c.Neighbors) != 0
+}
+
+func (c Config) imports() ([]net.IPNet, error) {
+	res := make([]net.IPNet, 0, len(c.Import))
+	for _, s := range c.Import {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bgp: import: %w", err)
+		}
+		res = append(res, *n)
+	}
+	return res, nil
+}
+
+// Validate checks the configuration, field names in errors are relative to
+// the configuration section.
+func (c Config) Validate() error {
+	if c.ASN == 0 {
+		return errors.New("asn is required")
+	}
+	if c.RouterID != nil && c.RouterID.To4() == nil {
+		return errors.New("router-id should be an IPv4 address")
+	}
+	if c.HoldTime != 0 && (c.HoldTime < 3 || c.HoldTime > 0xffff) {
+		return errors.New("hold-time should be between 3 and 65535")
+	}
+	if c.NextHop4 != nil && c.NextHop4.To4() == nil {
+		return errors.New("next-hop4 should be an IPv4 address")
+	}
+	if c.NextHop6 != nil && c.NextHop6.To4() != nil {
+		return errors.New("next-hop6 should be an IPv6 address")
+	}
+	for i, nb := range c.Neighbors {
+		if _, err := neighborAddr(nb.Address); err != nil {
+			return fmt.Errorf("neighbors[%d]: %w", i, err)
+		}
+		if nb.ASN == 0 {
+			return fmt.Errorf("neighbors[%d]: asn is required", i)
+		}
+	}
+	if _, err := c.imports(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func neighborAddr(addr string) (string, error) {
+	if net.ParseIP(addr) != nil {
+		return net.JoinHostPort(addr, "179"), nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) == nil {
+		return "", errors.New("malformed IP")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.New("malformed port")
+	}
+	return addr, nil
+}
+
+const (
+	defaultHoldTime = 90
+	connectTimeout  = 10 * time.Second
+	// connectRetry is how long to wait before connecting again after the
+	// session fails.
+	connectRetry = 30 * time.Second
+)
+
+// Speaker maintains sessions with all configured neighbors.
+type Speaker struct {
+	cfg      Config
+	imports  []net.IPNet
+	onImport func()
+
+	lock sync.Mutex
+	// Routes announced to neighbors.
+	routes []net.IPNet
+	// Routes learned from each neighbor by prefix.
+	learned  map[string]map[string]net.IPNet
+	triggers []chan struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start connects to neighbors. onImport is called (from another goroutine)
+// when the set of imported routes changes.
+func Start(cfg Config, onImport func()) (*Speaker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("bgp: %w", err)
+	}
+	if cfg.RouterID == nil {
+		return nil, errors.New("bgp: router-id is required")
+	}
+	if cfg.HoldTime == 0 {
+		cfg.HoldTime = defaultHoldTime
+	}
+	imports, _ := cfg.imports()
+
+	sp := &Speaker{
+		cfg:      cfg,
+		imports:  imports,
+		onImport: onImport,
+		learned:  map[string]map[string]net.IPNet{},
+		stop:     make(chan struct{}),
+	}
+	for _, nb := range cfg.Neighbors {
+		trigger := make(chan struct{}, 1)
+		sp.triggers = append(sp.triggers, trigger)
+		sp.wg.Add(1)
+		go sp.run(nb, trigger)
+	}
+	return sp, nil
+}
+
+// Announce replaces the set of routes announced to neighbors.
+func (sp *Speaker) Announce(routes []net.IPNet) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.routes = append([]net.IPNet(nil), routes...)
+	for _, t := range sp.triggers {
+		select {
+		case t <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (sp *Speaker) announced() []net.IPNet {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	return sp.routes
+}
+
+// Imported returns routes learned from neighbors within the import networks,
+// sorted by address.
+func (sp *Speaker) Imported() []net.IPNet {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	seen := map[string]bool{}
+	var res []net.IPNet
+	for _, rib := range sp.learned {
+		for key, n := range rib {
+			if !seen[key] {
+				seen[key] = true
+				res = append(res, n)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if c := bytes.Compare(res[i].IP, res[j].IP); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(res[i].Mask, res[j].Mask) < 0
+	})
+	return res
+}
+
+func (sp *Speaker) importable(n net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	for _, imp := range sp.imports {
+		impOnes, impBits := imp.Mask.Size()
+		if bits == impBits && ones >= impOnes && imp.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// learn applies the update received from the neighbor. Routes with the local
+// AS in the path are looped back and not imported, they replace the route
+// previously learned from the neighbor, so it is removed (RFC 4271, section
+// 9.1.2).
+func (sp *Speaker) learn(neighbor string, u update) {
+	loop := u.hasAS(sp.cfg.ASN)
+	changed := false
+	sp.lock.Lock()
+	rib := sp.learned[neighbor]
+	if rib == nil {
+		rib = map[string]net.IPNet{}
+		sp.learned[neighbor] = rib
+	}
+	for _, n := range u.withdrawn {
+		if _, ok := rib[n.String()]; ok {
+			delete(rib, n.String())
+			changed = true
+		}
+	}
+	for _, n := range u.announced {
+		if loop {
+			if _, ok := rib[n.String()]; ok {
+				delete(rib, n.String())
+				changed = true
+			}
+			continue
+		}
+		if !sp.importable(n) {
+			continue
+		}
+		if _, ok := rib[n.String()]; !ok {
+			rib[n.String()] = n
+			changed = true
+		}
+	}
+	sp.lock.Unlock()
+
+	if changed && sp.onImport != nil {
+		sp.onImport()
+	}
+}
+
+// forget drops routes learned from the neighbor after the session is closed.
+func (sp *Speaker) forget(neighbor string) {
+	sp.lock.Lock()
+	changed := len(sp.learned[neighbor]) != 0
+	delete(sp.learned, neighbor)
+	sp.lock.Unlock()
+
+	if changed && sp.onImport != nil {
+		sp.onImport()
+	}
+}
+
+func (sp *Speaker) run(nb Neighbor, trigger chan struct{}) {
+	defer sp.wg.Done()
+	for {
+		err := sp.session(nb, trigger)
+		sp.forget(nb.Address)
+		select {
+		case <-sp.stop:
+			return
+		default:
+		}
+		log.Printf("error: bgp: neighbor %v: %v, reconnecting in %v", nb.Address, err, connectRetry)
+
+		select {
+		case <-sp.stop:
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+// Close closes sessions with neighbors.
+func (sp *Speaker) Close() {
+	close(sp.stop)
+	sp.wg.Wait()
+}
@@ -0,0 +1,352 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	headerLen = 19
+	maxMsgLen = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	// asTrans is announced instead of AS numbers that do not fit in two
+	// octets (RFC 6793).
+	asTrans = 23456
+
+	optCapabilities  = 2
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	attrOrigin       = 1
+	attrASPath       = 2
+	attrNextHop      = 3
+	attrLocalPref    = 5
+	attrMPReach      = 14
+	attrMPUnreach    = 15
+	attrAS4Path      = 17
+	flagOptional     = 0x80
+	flagTransitive   = 0x40
+	flagExtendedLen  = 0x10
+	originIGP        = 0
+	asPathSequence   = 2
+	defaultLocalPref = 100
+
+	// Error codes for NOTIFICATION (RFC 4271, section 4.5).
+	errHeader      = 1
+	errOpen        = 2
+	errUpdate      = 3
+	errHoldExpired = 4
+	errCease       = 6
+
+	errOpenBadPeerAS = 2
+)
+
+type message struct {
+	typ  byte
+	body []byte
+}
+
+func readMsg(r io.Reader) (message, error) {
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return message{}, err
+	}
+	for _, b := range hdr[:16] {
+		if b != 0xff {
+			return message{}, errors.New("bgp: malformed message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if length < headerLen || length > maxMsgLen {
+		return message{}, fmt.Errorf("bgp: bad message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return message{}, err
+	}
+	return message{typ: hdr[18], body: body}, nil
+}
+
+func packMsg(typ byte, body []byte) []byte {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:18], uint16(headerLen+len(body)))
+	msg[18] = typ
+	return append(msg, body...)
+}
+
+type openMsg struct {
+	asn      uint32
+	holdTime uint16
+	routerID net.IP
+
+	fourOctetAS bool
+	// Address families announced with the multiprotocol capability, by
+	// AFI. Without capabilities only IPv4 unicast is assumed.
+	families map[uint16]bool
+}
+
+func (o openMsg) pack() []byte {
+	var caps []byte
+	for _, afi := range []uint16{afiIPv4, afiIPv6} {
+		caps = append(caps, capMultiprotocol, 4, byte(afi>>8), byte(afi), 0, safiUnicast)
+	}
+	caps = append(caps, capFourOctetAS, 4)
+	caps = append(caps, uint32Bytes(o.asn)...)
+
+	myAS := uint16(asTrans)
+	if o.asn <= 0xffff {
+		myAS = uint16(o.asn)
+	}
+	body := []byte{4, byte(myAS >> 8), byte(myAS), byte(o.holdTime >> 8), byte(o.holdTime)}
+	body = append(body, o.routerID.To4()...)
+	body = append(body, byte(2+len(caps)), optCapabilities, byte(len(caps)))
+	body = append(body, caps...)
+	return packMsg(msgOpen, body)
+}
+
+func parseOpen(body []byte) (openMsg, error) {
+	if len(body) < 10 {
+		return openMsg{}, errors.New("bgp: malformed OPEN")
+	}
+	if body[0] != 4 {
+		return openMsg{}, fmt.Errorf("bgp: unsupported version %d", body[0])
+	}
+	o := openMsg{
+		asn:      uint32(binary.BigEndian.Uint16(body[1:3])),
+		holdTime: binary.BigEndian.Uint16(body[3:5]),
+		routerID: net.IP(append([]byte(nil), body[5:9]...)),
+		families: map[uint16]bool{},
+	}
+	optLen := int(body[9])
+	opts := body[10:]
+	if len(opts) < optLen {
+		return openMsg{}, errors.New("bgp: malformed OPEN parameters")
+	}
+	opts = opts[:optLen]
+
+	haveCaps := false
+	for len(opts) >= 2 {
+		typ, l := opts[0], int(opts[1])
+		if len(opts) < 2+l {
+			return openMsg{}, errors.New("bgp: malformed OPEN parameters")
+		}
+		val := opts[2 : 2+l]
+		opts = opts[2+l:]
+		if typ != optCapabilities {
+			continue
+		}
+		for len(val) >= 2 {
+			code, cl := val[0], int(val[1])
+			if len(val) < 2+cl {
+				return openMsg{}, errors.New("bgp: malformed capability")
+			}
+			cv := val[2 : 2+cl]
+			val = val[2+cl:]
+			haveCaps = true
+			switch {
+			case code == capMultiprotocol && cl == 4 && cv[3] == safiUnicast:
+				o.families[binary.BigEndian.Uint16(cv[0:2])] = true
+			case code == capFourOctetAS && cl == 4:
+				o.fourOctetAS = true
+				o.asn = binary.BigEndian.Uint32(cv)
+			}
+		}
+	}
+	if !haveCaps || len(o.families) == 0 {
+		o.families[afiIPv4] = true
+	}
+	return o, nil
+}
+
+func packNotification(code, subcode byte) []byte {
+	return packMsg(msgNotification, []byte{code, subcode})
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func packPrefix(n net.IPNet) []byte {
+	ones, _ := n.Mask.Size()
+	ip := n.IP.To4()
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+	return append([]byte{byte(ones)}, ip[:(ones+7)/8]...)
+}
+
+// parsePrefixes parses the list of NLRI prefixes of the address family.
+func parsePrefixes(b []byte, afi uint16) ([]net.IPNet, error) {
+	bits := 32
+	if afi == afiIPv6 {
+		bits = 128
+	}
+	var res []net.IPNet
+	for len(b) > 0 {
+		ones := int(b[0])
+		if ones > bits || len(b) < 1+(ones+7)/8 {
+			return nil, errors.New("bgp: malformed prefix")
+		}
+		ip := make(net.IP, bits/8)
+		copy(ip, b[1:1+(ones+7)/8])
+		mask := net.CIDRMask(ones, bits)
+		res = append(res, net.IPNet{IP: ip.Mask(mask), Mask: mask})
+		b = b[1+(ones+7)/8:]
+	}
+	return res, nil
+}
+
+func packAttr(flags, typ byte, val []byte) []byte {
+	if len(val) > 255 {
+		return append([]byte{flags | flagExtendedLen, typ, byte(len(val) >> 8), byte(len(val))}, val...)
+	}
+	return append([]byte{flags, typ, byte(len(val))}, val...)
+}
+
+// update is the decoded UPDATE message, only reachability information and
+// AS numbers of the path are kept.
+type update struct {
+	withdrawn []net.IPNet
+	announced []net.IPNet
+	// AS numbers in AS_PATH and AS4_PATH, in any order.
+	asPath []uint32
+}
+
+// hasAS reports whether the path of announced routes contains asn.
+func (u update) hasAS(asn uint32) bool {
+	for _, as := range u.asPath {
+		if as == asn {
+			return true
+		}
+	}
+	return false
+}
+
+// parseASPath parses AS_PATH segments with AS numbers of asLen octets.
+func parseASPath(b []byte, asLen int) ([]uint32, error) {
+	var res []uint32
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1])*asLen {
+			return nil, errors.New("bgp: malformed AS_PATH")
+		}
+		count := int(b[1])
+		for i := 0; i < count; i++ {
+			as := b[2+i*asLen : 2+(i+1)*asLen]
+			if asLen == 4 {
+				res = append(res, binary.BigEndian.Uint32(as))
+			} else {
+				res = append(res, uint32(binary.BigEndian.Uint16(as)))
+			}
+		}
+		b = b[2+count*asLen:]
+	}
+	return res, nil
+}
+
+// parseUpdate decodes the UPDATE. fourOctetAS is whether both speakers
+// announced the capability, AS_PATH carries four-octet AS numbers then.
+func parseUpdate(body []byte, fourOctetAS bool) (update, error) {
+	var u update
+	if len(body) < 4 {
+		return u, errors.New("bgp: malformed UPDATE")
+	}
+	wLen := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 2+wLen+2 {
+		return u, errors.New("bgp: malformed UPDATE")
+	}
+	withdrawn, err := parsePrefixes(body[2:2+wLen], afiIPv4)
+	if err != nil {
+		return u, err
+	}
+	u.withdrawn = withdrawn
+
+	rest := body[2+wLen:]
+	aLen := int(binary.BigEndian.Uint16(rest[0:2]))
+	if len(rest) < 2+aLen {
+		return u, errors.New("bgp: malformed UPDATE")
+	}
+	attrs, nlri := rest[2:2+aLen], rest[2+aLen:]
+	announced, err := parsePrefixes(nlri, afiIPv4)
+	if err != nil {
+		return u, err
+	}
+	u.announced = announced
+
+	for len(attrs) >= 3 {
+		flags, typ := attrs[0], attrs[1]
+		var l, off int
+		if flags&flagExtendedLen != 0 {
+			if len(attrs) < 4 {
+				return u, errors.New("bgp: malformed attribute")
+			}
+			l, off = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		} else {
+			l, off = int(attrs[2]), 3
+		}
+		if len(attrs) < off+l {
+			return u, errors.New("bgp: malformed attribute")
+		}
+		val := attrs[off : off+l]
+		attrs = attrs[off+l:]
+
+		switch typ {
+		case attrASPath, attrAS4Path:
+			asLen := 2
+			if typ == attrAS4Path || fourOctetAS {
+				asLen = 4
+			}
+			path, err := parseASPath(val, asLen)
+			if err != nil {
+				return u, err
+			}
+			u.asPath = append(u.asPath, path...)
+		case attrMPReach:
+			if len(val) < 5 {
+				return u, errors.New("bgp: malformed MP_REACH_NLRI")
+			}
+			afi, safi, nhLen := binary.BigEndian.Uint16(val[0:2]), val[2], int(val[3])
+			if len(val) < 4+nhLen+1 {
+				return u, errors.New("bgp: malformed MP_REACH_NLRI")
+			}
+			if safi != safiUnicast || (afi != afiIPv4 && afi != afiIPv6) {
+				continue
+			}
+			nets, err := parsePrefixes(val[4+nhLen+1:], afi)
+			if err != nil {
+				return u, err
+			}
+			u.announced = append(u.announced, nets...)
+		case attrMPUnreach:
+			if len(val) < 3 {
+				return u, errors.New("bgp: malformed MP_UNREACH_NLRI")
+			}
+			afi, safi := binary.BigEndian.Uint16(val[0:2]), val[2]
+			if safi != safiUnicast || (afi != afiIPv4 && afi != afiIPv6) {
+				continue
+			}
+			nets, err := parsePrefixes(val[3:], afi)
+			if err != nil {
+				return u, err
+			}
+			u.withdrawn = append(u.withdrawn, nets...)
+		}
+	}
+	return u, nil
+}
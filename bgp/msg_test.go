@@ -0,0 +1,200 @@
+package bgp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func netStrings(nets []net.IPNet) []string {
+	res := make([]string, 0, len(nets))
+	for _, n := range nets {
+		res = append(res, n.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	for _, asn := range []uint32{65001, 4200000001} {
+		own := openMsg{asn: asn, holdTime: 90, routerID: net.IPv4(192, 0, 2, 1)}
+		msg, err := readMsg(bytes.NewReader(own.pack()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.typ != msgOpen {
+			t.Fatalf("message type %d, want OPEN", msg.typ)
+		}
+		got, err := parseOpen(msg.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.asn != asn || got.holdTime != 90 || !got.routerID.Equal(own.routerID) || !got.fourOctetAS {
+			t.Errorf("AS %d: parsed %+v", asn, got)
+		}
+		if !got.families[afiIPv4] || !got.families[afiIPv6] {
+			t.Errorf("AS %d: families %v", asn, got.families)
+		}
+	}
+}
+
+func TestOpenWithoutCapabilities(t *testing.T) {
+	body := []byte{4, 0xfd, 0xe9, 0, 90, 192, 0, 2, 2, 0}
+	got, err := parseOpen(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.asn != 65001 || got.fourOctetAS || !reflect.DeepEqual(got.families, map[uint16]bool{afiIPv4: true}) {
+		t.Errorf("parsed %+v", got)
+	}
+}
+
+// syncUpdates runs s.sync and returns UPDATEs it sent, decoded as the
+// neighbor would.
+func syncUpdates(t *testing.T, s *session) []update {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s.conn = local
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.sync()
+		local.Close()
+	}()
+
+	var res []update
+	for {
+		msg, err := readMsg(remote)
+		if err != nil {
+			break
+		}
+		if msg.typ != msgUpdate {
+			t.Fatalf("message type %d, want UPDATE", msg.typ)
+		}
+		u, err := parseUpdate(msg.body, s.peer.fourOctetAS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, u)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	cases := []struct {
+		name        string
+		asn         uint32
+		peerASN     uint32
+		fourOctetAS bool
+		path        []uint32
+	}{
+		{"external", 65001, 65002, true, []uint32{65001}},
+		{"external 2-octet", 65001, 65002, false, []uint32{65001}},
+		{"external 2-octet AS_TRANS", 4200000001, 65002, false, []uint32{asTrans, 4200000001}},
+		{"internal", 65001, 65001, true, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			routes := []net.IPNet{
+				mustCIDR(t, "10.1.0.0/16"),
+				mustCIDR(t, "10.2.3.0/24"),
+				mustCIDR(t, "fd00:1::/48"),
+			}
+			sp := &Speaker{cfg: Config{ASN: c.asn}, routes: routes}
+			s := &session{
+				sp: sp,
+				peer: openMsg{
+					asn:         c.peerASN,
+					fourOctetAS: c.fourOctetAS,
+					families:    map[uint16]bool{afiIPv4: true, afiIPv6: true},
+				},
+				nextHop4: net.IPv4(192, 0, 2, 1).To4(),
+				nextHop6: net.ParseIP("2001:db8::1"),
+				sent:     map[string]net.IPNet{},
+			}
+
+			var announced []net.IPNet
+			for _, u := range syncUpdates(t, s) {
+				announced = append(announced, u.announced...)
+				if len(u.withdrawn) != 0 {
+					t.Errorf("unexpected withdrawals %v", u.withdrawn)
+				}
+				if !reflect.DeepEqual(u.asPath, c.path) {
+					t.Errorf("AS path %v, want %v", u.asPath, c.path)
+				}
+			}
+			if got, want := netStrings(announced), netStrings(routes); !reflect.DeepEqual(got, want) {
+				t.Errorf("announced %v, want %v", got, want)
+			}
+
+			sp.routes = routes[1:2]
+			var withdrawn []net.IPNet
+			for _, u := range syncUpdates(t, s) {
+				withdrawn = append(withdrawn, u.withdrawn...)
+				if len(u.announced) != 0 {
+					t.Errorf("unexpected announcements %v", u.announced)
+				}
+			}
+			want := []string{routes[0].String(), routes[2].String()}
+			if got := netStrings(withdrawn); !reflect.DeepEqual(got, want) {
+				t.Errorf("withdrawn %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseUpdateMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"short":          {0, 0, 0},
+		"withdrawn":      {0, 5, 8, 10, 0, 0},
+		"prefix length":  {0, 2, 33, 10, 0, 0},
+		"attributes":     {0, 0, 0, 4, 0x40, 1, 1},
+		"AS_PATH":        {0, 0, 0, 7, 0x40, attrASPath, 4, asPathSequence, 2, 0xfd, 0xe9},
+		"AS_PATH header": {0, 0, 0, 4, 0x40, attrASPath, 1, asPathSequence},
+	}
+	for name, body := range cases {
+		if _, err := parseUpdate(body, false); err == nil {
+			t.Errorf("%v: no error", name)
+		}
+	}
+}
+
+func TestLearnRejectsLocalAS(t *testing.T) {
+	sp := &Speaker{
+		cfg:     Config{ASN: 65001},
+		imports: []net.IPNet{mustCIDR(t, "10.0.0.0/8")},
+		learned: map[string]map[string]net.IPNet{},
+	}
+	route := mustCIDR(t, "10.1.0.0/16")
+
+	sp.learn("n1", update{announced: []net.IPNet{route}, asPath: []uint32{65002, 65001}})
+	if got := sp.Imported(); len(got) != 0 {
+		t.Fatalf("looped route imported: %v", got)
+	}
+
+	sp.learn("n1", update{announced: []net.IPNet{route}, asPath: []uint32{65002}})
+	if got := netStrings(sp.Imported()); !reflect.DeepEqual(got, []string{route.String()}) {
+		t.Fatalf("imported %v", got)
+	}
+
+	// The looped announcement replaces the route learned before.
+	sp.learn("n1", update{announced: []net.IPNet{route}, asPath: []uint32{65003, 65001, 65002}})
+	if got := sp.Imported(); len(got) != 0 {
+		t.Fatalf("looped route kept: %v", got)
+	}
+}
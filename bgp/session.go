@@ -0,0 +1,345 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// openTimeout limits the time to complete the session setup.
+	openTimeout  = 30 * time.Second
+	writeTimeout = 10 * time.Second
+
+	// maxNLRI limits the size of prefixes in a single UPDATE so it fits in
+	// the maximum message size together with attributes.
+	maxNLRI = 3500
+)
+
+type session struct {
+	sp   *Speaker
+	nb   Neighbor
+	conn net.Conn
+	peer openMsg
+
+	nextHop4 net.IP
+	nextHop6 net.IP
+
+	// Routes announced to the neighbor by prefix.
+	sent map[string]net.IPNet
+}
+
+func (s *session) write(msg []byte) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// notify sends the NOTIFICATION and returns err.
+func (s *session) notify(code, subcode byte, err error) error {
+	s.write(packNotification(code, subcode))
+	return err
+}
+
+func notificationErr(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("NOTIFICATION received")
+	}
+	return fmt.Errorf("NOTIFICATION received, code %d subcode %d", body[0], body[1])
+}
+
+func (sp *Speaker) session(nb Neighbor, trigger <-chan struct{}) error {
+	addr, _ := neighborAddr(nb.Address)
+	d := net.Dialer{Timeout: connectTimeout}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s := &session{sp: sp, nb: nb, conn: conn, sent: map[string]net.IPNet{}}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	holdTime := time.Duration(s.peer.holdTime) * time.Second
+	if s.peer.holdTime > uint16(sp.cfg.HoldTime) {
+		holdTime = time.Duration(sp.cfg.HoldTime) * time.Second
+	}
+	log.Printf("bgp: session with %v (AS %d) established, hold time %v", nb.Address, s.peer.asn, holdTime)
+
+	msgs := make(chan message)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := readMsg(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var keepalive, hold <-chan time.Time
+	var holdTimer *time.Timer
+	if holdTime != 0 {
+		t := time.NewTicker(holdTime / 3)
+		defer t.Stop()
+		keepalive = t.C
+		holdTimer = time.NewTimer(holdTime)
+		defer holdTimer.Stop()
+		hold = holdTimer.C
+	}
+
+	if err := s.sync(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-sp.stop:
+			s.write(packNotification(errCease, 0))
+			return nil
+		case <-trigger:
+			if err := s.sync(); err != nil {
+				return err
+			}
+		case <-keepalive:
+			if err := s.write(packMsg(msgKeepalive, nil)); err != nil {
+				return err
+			}
+		case <-hold:
+			return s.notify(errHoldExpired, 0, errors.New("hold timer expired"))
+		case err := <-readErr:
+			return err
+		case msg := <-msgs:
+			if holdTimer != nil {
+				if !holdTimer.Stop() {
+					<-holdTimer.C
+				}
+				holdTimer.Reset(holdTime)
+			}
+			switch msg.typ {
+			case msgKeepalive:
+			case msgUpdate:
+				u, err := parseUpdate(msg.body, s.peer.fourOctetAS)
+				if err != nil {
+					return s.notify(errUpdate, 0, err)
+				}
+				sp.learn(nb.Address, u)
+			case msgNotification:
+				return notificationErr(msg.body)
+			default:
+				return s.notify(errHeader, 3, fmt.Errorf("unexpected message type %d", msg.typ))
+			}
+		}
+	}
+}
+
+// open exchanges OPEN and KEEPALIVE messages.
+func (s *session) open() error {
+	cfg := s.sp.cfg
+	if err := s.conn.SetReadDeadline(time.Now().Add(openTimeout)); err != nil {
+		return err
+	}
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	own := openMsg{asn: cfg.ASN, holdTime: uint16(cfg.HoldTime), routerID: cfg.RouterID}
+	if err := s.write(own.pack()); err != nil {
+		return err
+	}
+
+	msg, err := readMsg(s.conn)
+	if err != nil {
+		return err
+	}
+	switch msg.typ {
+	case msgOpen:
+	case msgNotification:
+		return notificationErr(msg.body)
+	default:
+		return s.notify(errHeader, 3, fmt.Errorf("expected OPEN, got message type %d", msg.typ))
+	}
+	s.peer, err = parseOpen(msg.body)
+	if err != nil {
+		return s.notify(errOpen, 0, err)
+	}
+	if s.peer.asn != s.nb.ASN {
+		return s.notify(errOpen, errOpenBadPeerAS, fmt.Errorf("neighbor AS %d, expected %d", s.peer.asn, s.nb.ASN))
+	}
+	if s.peer.holdTime == 1 || s.peer.holdTime == 2 {
+		return s.notify(errOpen, 6, fmt.Errorf("unacceptable hold time %d", s.peer.holdTime))
+	}
+	if err := s.write(packMsg(msgKeepalive, nil)); err != nil {
+		return err
+	}
+
+	msg, err = readMsg(s.conn)
+	if err != nil {
+		return err
+	}
+	switch msg.typ {
+	case msgKeepalive:
+	case msgNotification:
+		return notificationErr(msg.body)
+	default:
+		return s.notify(errHeader, 3, fmt.Errorf("expected KEEPALIVE, got message type %d", msg.typ))
+	}
+
+	s.nextHop4, s.nextHop6 = cfg.NextHop4, cfg.NextHop6
+	if local, ok := s.conn.LocalAddr().(*net.TCPAddr); ok {
+		if v4 := local.IP.To4(); v4 != nil {
+			if s.nextHop4 == nil {
+				s.nextHop4 = v4
+			}
+		} else if s.nextHop6 == nil {
+			s.nextHop6 = local.IP
+		}
+	}
+	return nil
+}
+
+func (s *session) external() bool {
+	return s.peer.asn != s.sp.cfg.ASN
+}
+
+// announceable reports whether routes to n can be sent over the session.
+func (s *session) announceable(n net.IPNet) bool {
+	if n.IP.To4() != nil {
+		return s.nextHop4 != nil && s.peer.families[afiIPv4]
+	}
+	return s.nextHop6 != nil && s.peer.families[afiIPv6]
+}
+
+// sync sends updates for changes in announced routes since the last call.
+func (s *session) sync() error {
+	wanted := map[string]net.IPNet{}
+	for _, n := range s.sp.announced() {
+		if s.announceable(n) {
+			wanted[n.String()] = n
+		}
+	}
+
+	var add4, add6, del4, del6 []net.IPNet
+	for key, n := range s.sent {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		if n.IP.To4() != nil {
+			del4 = append(del4, n)
+		} else {
+			del6 = append(del6, n)
+		}
+	}
+	for key, n := range wanted {
+		if _, ok := s.sent[key]; ok {
+			continue
+		}
+		if n.IP.To4() != nil {
+			add4 = append(add4, n)
+		} else {
+			add6 = append(add6, n)
+		}
+	}
+
+	for _, chunk := range chunkPrefixes(del4) {
+		body := make([]byte, 2, 4+len(chunk))
+		binary.BigEndian.PutUint16(body, uint16(len(chunk)))
+		body = append(body, chunk...)
+		body = append(body, 0, 0)
+		if err := s.write(packMsg(msgUpdate, body)); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range chunkPrefixes(del6) {
+		val := append([]byte{0, afiIPv6, safiUnicast}, chunk...)
+		if err := s.writeUpdate(packAttr(flagOptional, attrMPUnreach, val), nil); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range chunkPrefixes(add4) {
+		attrs := s.pathAttrs()
+		attrs = append(attrs, packAttr(flagTransitive, attrNextHop, s.nextHop4.To4())...)
+		if err := s.writeUpdate(attrs, chunk); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range chunkPrefixes(add6) {
+		val := []byte{0, afiIPv6, safiUnicast, 16}
+		val = append(val, s.nextHop6.To16()...)
+		val = append(val, 0)
+		val = append(val, chunk...)
+		attrs := append(s.pathAttrs(), packAttr(flagOptional, attrMPReach, val)...)
+		if err := s.writeUpdate(attrs, nil); err != nil {
+			return err
+		}
+	}
+
+	s.sent = wanted
+	return nil
+}
+
+// writeUpdate sends the UPDATE without withdrawn IPv4 routes.
+func (s *session) writeUpdate(attrs, nlri []byte) error {
+	body := make([]byte, 4, 4+len(attrs)+len(nlri))
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(attrs)))
+	body = append(body, attrs...)
+	body = append(body, nlri...)
+	return s.write(packMsg(msgUpdate, body))
+}
+
+// pathAttrs returns ORIGIN, AS_PATH and, for internal neighbors, LOCAL_PREF
+// attributes.
+func (s *session) pathAttrs() []byte {
+	asn := s.sp.cfg.ASN
+	attrs := packAttr(flagTransitive, attrOrigin, []byte{originIGP})
+	if !s.external() {
+		attrs = append(attrs, packAttr(flagTransitive, attrASPath, nil)...)
+		return append(attrs, packAttr(flagTransitive, attrLocalPref, uint32Bytes(defaultLocalPref))...)
+	}
+
+	if s.peer.fourOctetAS {
+		path := append([]byte{asPathSequence, 1}, uint32Bytes(asn)...)
+		return append(attrs, packAttr(flagTransitive, attrASPath, path)...)
+	}
+	myAS := uint16(asTrans)
+	if asn <= 0xffff {
+		myAS = uint16(asn)
+	}
+	attrs = append(attrs, packAttr(flagTransitive, attrASPath, []byte{asPathSequence, 1, byte(myAS >> 8), byte(myAS)})...)
+	if asn > 0xffff {
+		path := append([]byte{asPathSequence, 1}, uint32Bytes(asn)...)
+		attrs = append(attrs, packAttr(flagOptional|flagTransitive, attrAS4Path, path)...)
+	}
+	return attrs
+}
+
+// chunkPrefixes encodes prefixes, splitting them so each part fits in a
+// single message.
+func chunkPrefixes(nets []net.IPNet) [][]byte {
+	var res [][]byte
+	var cur []byte
+	for _, n := range nets {
+		p := packPrefix(n)
+		if len(cur)+len(p) > maxNLRI {
+			res = append(res, cur)
+			cur = nil
+		}
+		cur = append(cur, p...)
+	}
+	if len(cur) != 0 {
+		res = append(res, cur)
+	}
+	return res
+}
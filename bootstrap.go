@@ -0,0 +1,61 @@
+package wirebox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// BootstrapPath is the HTTPS endpoint clients enroll at using a token.
+const BootstrapPath = "/wirebox/v1/enroll"
+
+// BootstrapChallenge is returned for GET requests to BootstrapPath with a
+// valid token. The nonce should be used in the following BootstrapRequest.
+type BootstrapChallenge struct {
+	ServerKey string `json:"server-key"`
+	Nonce     string `json:"nonce"`
+}
+
+// BootstrapRequest is sent by the client in the JSON body. The token is passed
+// in the Authorization header as a bearer token.
+//
+// Proof is computed using EnrollProof, it shows that the client has the
+// private key for PublicKey.
+type BootstrapRequest struct {
+	PublicKey string `json:"public-key"`
+	Nonce     string `json:"nonce"`
+	Proof     []byte `json:"proof"`
+}
+
+// BootstrapInfo is everything the client needs to solict the configuration
+// over the WireGuard tunnel. Field names match the client configuration.
+type BootstrapInfo struct {
+	ServerKey      string `json:"server-key"`
+	ConfigEndpoint string `json:"config-endpoint"`
+	AddrScheme     string `json:"config-addr-scheme,omitempty"`
+	AddrSalt       string `json:"config-addr-salt,omitempty"`
+}
+
+// EnrollProof computes the proof of possession of the private key for the
+// enrollment request. The HMAC key is the X25519 shared secret of priv and
+// peer, so the client computes it using its private key and the server
+// public key and the server does the same using its private key and the
+// client public key.
+func EnrollProof(priv, peer wgtypes.Key, token, publicKey, nonce string) ([]byte, error) {
+	shared, err := curve25519.X25519(priv[:], peer[:])
+	if err != nil {
+		return nil, fmt.Errorf("enroll proof: %w", err)
+	}
+	mac := hmac.New(sha256.New, shared)
+	for i := range shared {
+		shared[i] = 0
+	}
+	for _, part := range []string{"wirebox-enroll-v1", token, publicKey, nonce} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,299 @@
+// Package cfgfile decodes configuration files rejecting unknown keys, so
+// misspelled options are reported instead of being silently ignored.
+//
+// Files are TOML unless they have .yaml, .yml or .json extension. Option
+// names and structure are the same in all formats.
+package cfgfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Lax disables the check for unknown keys, set by the -lax command line
+// option.
+var Lax bool
+
+// UnknownKeysError is returned if the file contains keys that do not
+// correspond to any option.
+type UnknownKeysError struct {
+	File string
+	Keys []Position
+}
+
+// Position is the location of the key in the file, Line and Col are
+// 1-based, zero if not known.
+type Position struct {
+	Key  string
+	Line int
+	Col  int
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return strconv.Quote(p.Key)
+	}
+	return fmt.Sprintf("%q at %d:%d", p.Key, p.Line, p.Col)
+}
+
+func (e UnknownKeysError) Error() string {
+	keys := make([]string, len(e.Keys))
+	for i, k := range e.Keys {
+		keys[i] = k.String()
+	}
+	return fmt.Sprintf("%s: unknown options: %s (use -lax to ignore)", e.File, strings.Join(keys, ", "))
+}
+
+// MetaData describes keys defined in the configuration file and files it
+// includes.
+type MetaData struct {
+	files []fileMeta
+}
+
+type fileMeta struct {
+	path string
+	md   toml.MetaData
+}
+
+// DefinedIn returns the path of the file that defines the key, the last one
+// if several files do. Empty string is returned if the key is not defined.
+func (m MetaData) DefinedIn(key ...string) string {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		if m.files[i].md.IsDefined(key...) {
+			return m.files[i].path
+		}
+	}
+	return ""
+}
+
+// IsDefined reports whether the key is defined in any of the files.
+func (m MetaData) IsDefined(key ...string) bool {
+	return m.DefinedIn(key...) != ""
+}
+
+// Files returns paths of all decoded files in the order they were applied.
+func (m MetaData) Files() []string {
+	paths := make([]string, len(m.files))
+	for i, f := range m.files {
+		paths[i] = f.path
+	}
+	return paths
+}
+
+// DecodeFile decodes the file at path into v. Unknown keys are reported
+// using UnknownKeysError unless Lax is set.
+func DecodeFile(path string, v interface{}) (MetaData, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return MetaData{}, err
+	}
+	return Decode(path, blob, v)
+}
+
+// nearLineRe matches the location in parse errors of the toml package.
+var nearLineRe = regexp.MustCompile(`^Near line (\d+) \(last key parsed '([^']*)'\): `)
+
+// Decode decodes blob read from the file named name into v, followed by the
+// files it includes.
+//
+// The top-level include key lists paths relative to the directory of the
+// including file. Paths can be glob patterns, directories stand for all
+// configuration files in them. Files are applied in the listed order with
+// glob matches and directory entries sorted, values from later files
+// replace values from earlier ones, tables are merged.
+func Decode(name string, blob []byte, v interface{}) (MetaData, error) {
+	var md MetaData
+	err := decodeInto(&md, name, blob, v, map[string]bool{})
+	return md, err
+}
+
+// decodeInto decodes the file and its includes. Including the same file
+// twice is rejected, which also prevents include cycles.
+func decodeInto(md *MetaData, name string, blob []byte, v interface{}, seen map[string]bool) error {
+	if abs, err := filepath.Abs(name); err == nil {
+		if seen[abs] {
+			return fmt.Errorf("%s: included more than once", name)
+		}
+		seen[abs] = true
+	}
+
+	// Key locations are known only for TOML files.
+	source := blob
+	if !isTOML(name) {
+		var err error
+		if blob, err = toTOML(name, blob); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		source = nil
+	}
+
+	fmd, err := toml.Decode(string(blob), v)
+	if err != nil {
+		if m := nearLineRe.FindStringSubmatch(err.Error()); m != nil && source != nil {
+			return fmt.Errorf("%s:%s: %s (after %q)", name, m[1], err.Error()[len(m[0]):], m[2])
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	md.files = append(md.files, fileMeta{path: name, md: fmd})
+	if err := checkUndecoded(name, source, fmd); err != nil {
+		return err
+	}
+
+	var directives struct {
+		Include []string `toml:"include"`
+	}
+	if _, err := toml.Decode(string(blob), &directives); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if len(directives.Include) == 0 {
+		return nil
+	}
+	paths, err := expandIncludes(filepath.Dir(name), directives.Include)
+	if err != nil {
+		return fmt.Errorf("%s: include: %v", name, err)
+	}
+	for _, path := range paths {
+		incBlob, err := ioutil.ReadFile(path)
+		if err != nil {
+			// Not wrapped so a missing included file is not confused with
+			// the missing main file.
+			return fmt.Errorf("%s: include: %v", name, err)
+		}
+		if err := decodeInto(md, path, incBlob, v, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandIncludes resolves include entries relative to dir.
+func expandIncludes(dir string, include []string) ([]string, error) {
+	var paths []string
+	for _, inc := range include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(dir, inc)
+		}
+
+		if strings.ContainsAny(inc, "*?[") {
+			matches, err := filepath.Glob(inc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inc, err)
+			}
+			paths = append(paths, matches...)
+			continue
+		}
+
+		info, err := os.Stat(inc)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, inc)
+			continue
+		}
+		var files []string
+		for _, ext := range extensions {
+			matches, err := filepath.Glob(filepath.Join(inc, "*"+ext))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inc, err)
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+		paths = append(paths, files...)
+	}
+	return paths, nil
+}
+
+func checkUndecoded(name string, blob []byte, md toml.MetaData) error {
+	if Lax {
+		return nil
+	}
+
+	undecoded := md.Undecoded()
+	isUndecoded := make(map[string]bool, len(undecoded))
+	for _, k := range undecoded {
+		isUndecoded[k.String()] = true
+	}
+
+	lines := strings.Split(string(blob), "\n")
+	unkErr := UnknownKeysError{File: name}
+	for _, k := range undecoded {
+		// The directive is handled by decodeInto.
+		if k.String() == "include" {
+			continue
+		}
+		// Report only the unknown table, not all keys in it.
+		if len(k) > 1 && isUndecoded[k[:len(k)-1].String()] {
+			continue
+		}
+		line, col := locate(lines, k)
+		unkErr.Keys = append(unkErr.Keys, Position{Key: k.String(), Line: line, Col: col})
+	}
+	if len(unkErr.Keys) == 0 {
+		return nil
+	}
+	return unkErr
+}
+
+func splitKey(s string) []string {
+	parts := strings.Split(s, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	return parts
+}
+
+func equalKeys(a []string, b toml.Key) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// locate finds the line and column where the key is defined. The lookup is
+// approximate (e.g. keys in inline tables are not found), zeros are
+// returned if it fails.
+func locate(lines []string, key toml.Key) (line, col int) {
+	var table []string
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		indent := len(l) - len(strings.TrimLeft(l, " \t"))
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+		case strings.HasPrefix(trimmed, "["):
+			end := strings.LastIndex(trimmed, "]")
+			if end < 0 {
+				continue
+			}
+			table = splitKey(strings.Trim(trimmed[:end+1], "[]"))
+			if equalKeys(table, key) {
+				return i + 1, indent + 1
+			}
+		default:
+			eq := strings.Index(trimmed, "=")
+			if eq < 0 {
+				continue
+			}
+			full := append(append([]string(nil), table...), splitKey(trimmed[:eq])...)
+			if equalKeys(full, key) {
+				return i + 1, indent + 1
+			}
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,95 @@
+package cfgfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Extensions of supported configuration file formats, files with any other
+// extension are read as TOML.
+var extensions = []string{".toml", ".yaml", ".yml", ".json"}
+
+func isTOML(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return false
+	}
+	return true
+}
+
+// toTOML converts the YAML or JSON document to TOML so it can be decoded
+// into the same structures using the same rules. Option names are the same
+// in all formats.
+func toTOML(name string, blob []byte) ([]byte, error) {
+	var doc interface{}
+	if strings.ToLower(filepath.Ext(name)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(blob))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(blob, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil
+	}
+
+	table, ok := normalize(doc).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("top-level value must be a mapping")
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(table); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// normalize converts values produced by YAML and JSON decoders to types
+// understood by the TOML encoder. Null values are removed.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			if val != nil {
+				m[fmt.Sprint(k)] = normalize(val)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			if val != nil {
+				m[k] = normalize(val)
+			}
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, 0, len(v))
+		for _, val := range v {
+			if val != nil {
+				s = append(s, normalize(val))
+			}
+		}
+		return s
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case int:
+		return int64(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,114 @@
+package cfgfile
+
+import (
+	"encoding"
+	"reflect"
+	"strings"
+)
+
+// Schemer is implemented by option types that describe their values
+// themselves, e.g. strings following a pattern.
+type Schemer interface {
+	JSONSchema() map[string]interface{}
+}
+
+var (
+	schemerType = reflect.TypeOf((*Schemer)(nil)).Elem()
+	textType    = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Schema returns the JSON Schema of configuration files decoded into v,
+// suitable for JSON and YAML files and for TOML files converted to JSON.
+//
+// The schema is derived from toml tags of the structure: tables do not
+// permit unknown keys (unless Lax is used), types decoded from text are
+// strings. Constraints checked by Validate methods are not included.
+func Schema(v interface{}, title string) map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(v), map[reflect.Type]bool{})
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = title
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		props["include"] = map[string]interface{}{
+			"description": "files to read after this one",
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string"},
+		}
+	}
+	return s
+}
+
+func typeSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	if t.Implements(schemerType) {
+		return reflect.Zero(t).Interface().(Schemer).JSONSchema()
+	}
+	if reflect.PtrTo(t).Implements(schemerType) {
+		return reflect.New(t).Interface().(Schemer).JSONSchema()
+	}
+	if reflect.PtrTo(t).Implements(textType) {
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), seen)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			// Recursive types are not used by configurations, do not loop
+			// if one appears.
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		props := make(map[string]interface{})
+		structProps(t, props, seen)
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	}
+	// Interfaces and anything else accept any value.
+	return map[string]interface{}{}
+}
+
+// structProps adds options of the structure to props, fields of embedded
+// structures are inlined as by the toml decoder.
+func structProps(t reflect.Type, props map[string]interface{}, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct && !reflect.PtrTo(ft).Implements(textType) {
+			structProps(ft, props, seen)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = typeSchema(f.Type, seen)
+	}
+}
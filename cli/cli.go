@@ -0,0 +1,76 @@
+// Package cli implements subcommand dispatch for wirebox binaries.
+//
+// Options common for all commands (e.g. -config) are parsed before the
+// command name, each command parses the remaining arguments itself.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+type Command struct {
+	Name string
+	// One-line description for the usage message.
+	Help string
+	// Run is called with the arguments following the command name and
+	// returns the exit code.
+	Run func(args []string) int
+}
+
+// Find returns the command with the specified name or nil.
+func Find(cmds []Command, name string) *Command {
+	for i := range cmds {
+		if cmds[i].Name == name {
+			return &cmds[i]
+		}
+	}
+	return nil
+}
+
+// Usage sets the usage message of fs to list cmds and options of fs.
+func Usage(fs *flag.FlagSet, prog string, cmds []Command) {
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [options] <command> [arguments]\n\nCommands:\n", prog)
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, c := range cmds {
+			fmt.Fprintf(tw, "  %s\t%s\n", c.Name, c.Help)
+		}
+		tw.Flush()
+		fmt.Fprintln(out, "\nOptions:")
+		fs.PrintDefaults()
+	}
+}
+
+// Dispatch parses global options from args using fs and runs the command
+// named by the first remaining argument. def is used if no command is
+// specified, empty def makes the command required.
+func Dispatch(fs *flag.FlagSet, cmds []Command, def string, args []string) int {
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	name := fs.Arg(0)
+	rest := fs.Args()
+	if name == "" {
+		name = def
+	} else {
+		rest = rest[1:]
+	}
+	if name == "help" {
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+		return 0
+	}
+	c := Find(cmds, name)
+	if c == nil {
+		if name != "" {
+			fmt.Fprintf(fs.Output(), "unknown command: %s\n", name)
+		}
+		fs.Usage()
+		return 2
+	}
+	return c.Run(rest)
+}
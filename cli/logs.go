@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/logging"
+)
+
+// Logs implements the logs command printing messages of the daemon
+// listening on the control socket.
+func Logs(socket string, args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "keep printing new messages")
+	lines := fs.Int("n", 100, "number of recent messages to print")
+	level := fs.String("level", "info", "minimal level of messages: debug, info, warning or error")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: logs [options]")
+		fmt.Fprintln(fs.Output(), "Prints log messages of the running daemon.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	req := logging.StreamArgs{Lines: *lines, Follow: *follow}
+	if err := req.Level.UnmarshalText([]byte(*level)); err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+
+	err := ctlsock.Stream(socket, "logs", req, func(raw json.RawMessage) error {
+		var e logging.Entry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		fmt.Println(e.Time.Format("2006/01/02 15:04:05"), e.Message)
+		return nil
+	})
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
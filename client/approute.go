@@ -0,0 +1,89 @@
+package wboxclient
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/wirebox/approute"
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+// appRefresh is how often cgroups of listed units are resolved again, so
+// applications started later are matched.
+const appRefresh = 10 * time.Second
+
+// routeTable returns the routing table for tunnel routes.
+func (c Config) routeTable() int {
+	if !c.AppRouting.Enabled() {
+		return 0
+	}
+	return c.AppRouting.Table
+}
+
+// runAppRouting maintains policy routing rules and nftables rules marking
+// packets of listed applications until stop is closed.
+func runAppRouting(m linkmgr.Manager, cfg Config, stop <-chan struct{}) {
+	if tunNS != nil {
+		log.Println("error: app-routing: not supported with -netns")
+		return
+	}
+	rm, ok := m.(linkmgr.RuleManager)
+	if !ok {
+		log.Println("error: app-routing: policy routing is not supported")
+		return
+	}
+
+	rules := approute.Rules(cfg.AppRouting)
+	for _, r := range rules {
+		if err := rm.AddRule(r); err != nil && !errors.Is(err, syscall.EEXIST) {
+			log.Println("error: app-routing:", err)
+		}
+	}
+	defer func() {
+		for _, r := range rules {
+			if err := rm.DelRule(r); err != nil {
+				log.Println("error: app-routing:", err)
+			}
+		}
+	}()
+
+	var applied []string
+	first := true
+	refresh := func() {
+		cgroups, err := approute.Cgroups(cfg.AppRouting)
+		if err != nil {
+			log.Println("error: app-routing:", err)
+			return
+		}
+		if !first && strings.Join(cgroups, "\n") == strings.Join(applied, "\n") {
+			return
+		}
+		if err := approute.Apply(cfg.If, cfg.AppRouting.FwMark, cgroups); err != nil {
+			log.Println("error: app-routing:", err)
+			return
+		}
+		first = false
+		applied = cgroups
+		log.Printf("app-routing: %s %d cgroups", cfg.AppRouting.Mode, len(cgroups))
+	}
+	refresh()
+	defer func() {
+		if err := approute.Remove(cfg.If); err != nil {
+			log.Println("error: app-routing:", err)
+		}
+	}()
+
+	t := time.NewTicker(appRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			refresh()
+		}
+	}
+}
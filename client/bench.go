@@ -0,0 +1,198 @@
+package wboxclient
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/foxcpp/wirebox/bench"
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/debugsrv"
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+// maxBenchDuration keeps the test within the control socket call timeout.
+const maxBenchDuration = 30 * time.Second
+
+type benchArgs struct {
+	Target   string        `json:"target,omitempty"`
+	Port     int           `json:"port"`
+	Duration time.Duration `json:"duration"`
+	Probes   int           `json:"probes"`
+	Record   bool          `json:"record"`
+}
+
+func (args benchArgs) options(target net.IP) bench.Options {
+	return bench.Options{
+		Addr:     target,
+		Port:     args.Port,
+		Duration: args.Duration,
+		Probes:   args.Probes,
+		Interval: 100 * time.Millisecond,
+		Timeout:  2 * time.Second,
+		Dial:     dialTunnel,
+	}
+}
+
+// dialTunnel creates the connection in the namespace of the tunnel. The
+// socket stays there after InNetNS returns.
+func dialTunnel(network, addr string) (c net.Conn, err error) {
+	err = linkmgr.InNetNS(tunNS, func() error {
+		c, err = net.Dial(network, addr)
+		return err
+	})
+	return c, err
+}
+
+func (c *controller) bench(raw json.RawMessage) (interface{}, error) {
+	var args benchArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Duration <= 0 || args.Duration > maxBenchDuration {
+		return nil, fmt.Errorf("duration should be between 0 and %v", maxBenchDuration)
+	}
+
+	stateLock.Lock()
+	clCfg := state.cfg
+	stateLock.Unlock()
+
+	target := net.ParseIP(args.Target)
+	if target == nil {
+		if args.Target != "" {
+			return nil, fmt.Errorf("malformed target address: %v", args.Target)
+		}
+		// IPv4 address is preferred if the server has both.
+		addrs, err := resolvePeer(clCfg, "server")
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, errors.New("no in-tunnel server address to test against")
+		}
+		target = addrs[0]
+	}
+
+	log.Printf("bench: testing %v for %v", target, args.Duration)
+	res, err := bench.Run(args.options(target))
+	if err != nil {
+		return nil, err
+	}
+	if args.Record {
+		updateState(func(s *clientState) { s.Bench = &res })
+	}
+	return res, nil
+}
+
+func benchMetrics(res *bench.Result) []debugsrv.Metric {
+	labels := map[string]string{"target": res.Target}
+	return []debugsrv.Metric{
+		{
+			Name:   "wirebox_bench_upload_bits_per_second",
+			Help:   "Throughput to the server measured by the last recorded bench.",
+			Labels: labels,
+			Value:  res.Upload,
+		},
+		{
+			Name:   "wirebox_bench_download_bits_per_second",
+			Help:   "Throughput from the server measured by the last recorded bench.",
+			Labels: labels,
+			Value:  res.Download,
+		},
+		{
+			Name:   "wirebox_bench_rtt_seconds",
+			Help:   "Average round-trip time measured by the last recorded bench.",
+			Labels: labels,
+			Value:  res.AvgRTT.Seconds(),
+		},
+		{
+			Name:   "wirebox_bench_jitter_seconds",
+			Help:   "Jitter measured by the last recorded bench.",
+			Labels: labels,
+			Value:  res.Jitter.Seconds(),
+		},
+		{
+			Name:   "wirebox_bench_loss_ratio",
+			Help:   "Ratio of lost datagrams in the last recorded bench.",
+			Labels: labels,
+			Value:  res.Loss,
+		},
+		{
+			Name:   "wirebox_bench_timestamp_seconds",
+			Help:   "Time of the last recorded bench.",
+			Labels: labels,
+			Value:  float64(res.Time.Unix()),
+		},
+	}
+}
+
+func benchMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "", "in-tunnel address to test against (the server address by default)")
+	port := fs.Int("port", bench.DefaultPort, "bench-port of the server")
+	duration := fs.Duration("duration", 5*time.Second, "duration of the upload and the download test each")
+	probes := fs.Int("probes", 50, "number of datagrams sent to measure latency, 100ms apart")
+	record := fs.Bool("record", false, "expose results in metrics of the running client")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wbox bench [options]")
+		fmt.Fprintln(fs.Output(), "Measures throughput, latency and loss through the tunnel. The server")
+		fmt.Fprintln(fs.Output(), "should have bench-port set. The test is run by the running client so it")
+		fmt.Fprintln(fs.Output(), "uses the tunnel namespace, -target is required if the client is not")
+		fmt.Fprintln(fs.Output(), "running.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || *duration <= 0 || *duration > maxBenchDuration || *probes < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return 2
+	}
+
+	bargs := benchArgs{Target: *target, Port: *port, Duration: *duration, Probes: *probes, Record: *record}
+	var res bench.Result
+	err := ctlsock.Call(cfg.controlSocket(), "bench", bargs, &res)
+	if errors.Is(err, ctlsock.ErrNotRunning) && *target != "" && !*record {
+		ip := net.ParseIP(*target)
+		if ip == nil {
+			log.Println("error: malformed target address:", *target)
+			return 2
+		}
+		res, err = bench.Run(bargs.options(ip))
+	}
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	fmt.Printf("target:   %v\n", res.Target)
+	fmt.Printf("upload:   %s\n", formatBits(res.Upload))
+	fmt.Printf("download: %s\n", formatBits(res.Download))
+	if res.Sent != 0 {
+		fmt.Printf("latency:  min %v, avg %v, max %v, jitter %v\n", res.MinRTT, res.AvgRTT, res.MaxRTT, res.Jitter)
+		fmt.Printf("loss:     %.1f%% (%d of %d)\n", 100*res.Loss, res.Sent-res.Received, res.Sent)
+	}
+	return 0
+}
+
+func formatBits(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	default:
+		return fmt.Sprintf("%.2f kbit/s", bps/1e3)
+	}
+}
@@ -0,0 +1,127 @@
+package wboxclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+)
+
+// bootstrapTimeout limits the enrollment request.
+const bootstrapTimeout = 15 * time.Second
+
+func bootstrapClient(caFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		blob, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, errors.New("no certificates in bootstrap-ca")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: bootstrapTimeout}, nil
+}
+
+// bootstrap enrolls the client key using the token and fills options needed
+// to reach the server that are not set yet.
+func bootstrap(cfg *Config) error {
+	if !strings.HasPrefix(cfg.BootstrapURL, "https://") {
+		return errors.New("bootstrap: only https:// URLs are allowed")
+	}
+	client, err := bootstrapClient(cfg.BootstrapCA)
+	if err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+
+	url := strings.TrimSuffix(cfg.BootstrapURL, "/") + wirebox.BootstrapPath
+	var challenge wirebox.BootstrapChallenge
+	if err := bootstrapDo(client, cfg, http.MethodGet, url, nil, &challenge); err != nil {
+		return fmt.Errorf("bootstrap: challenge: %w", err)
+	}
+	serverKey, err := wirebox.NewPeerKey(challenge.ServerKey)
+	if err != nil {
+		return fmt.Errorf("bootstrap: malformed response: %w", err)
+	}
+	if cfg.ServerKey.Encoded != "" && cfg.ServerKey.Bytes != serverKey.Bytes {
+		return fmt.Errorf("bootstrap: server key %v does not match server-key", serverKey)
+	}
+
+	pubKey := cfg.PrivateKey.PublicFromPrivate().Encoded
+	proof, err := wirebox.EnrollProof(cfg.PrivateKey.Bytes, serverKey.Bytes, cfg.BootstrapToken, pubKey, challenge.Nonce)
+	if err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+	body, err := json.Marshal(wirebox.BootstrapRequest{
+		PublicKey: pubKey,
+		Nonce:     challenge.Nonce,
+		Proof:     proof,
+	})
+	if err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+
+	var info wirebox.BootstrapInfo
+	if err := bootstrapDo(client, cfg, http.MethodPost, url, body, &info); err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+
+	// Only fill missing options so the local configuration can still
+	// override e.g. the endpoint.
+	overrides := map[string]string{}
+	if cfg.ServerKey.Encoded == "" {
+		overrides["server-key"] = info.ServerKey
+	}
+	if cfg.ConfigEndpoint.IP == nil {
+		overrides["config-endpoint"] = info.ConfigEndpoint
+	}
+	if cfg.AddrScheme == "" && info.AddrScheme != "" {
+		overrides["config-addr-scheme"] = info.AddrScheme
+	}
+	if cfg.AddrSalt == "" && info.AddrSalt != "" {
+		overrides["config-addr-salt"] = info.AddrSalt
+	}
+	if err := applyOverrides(cfg, overrides); err != nil {
+		return fmt.Errorf("bootstrap: malformed response: %w", err)
+	}
+	return nil
+}
+
+// bootstrapDo sends the request with the token to the bootstrap server and
+// decodes the JSON response into out.
+func bootstrapDo(client *http.Client, cfg *Config, method, url string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.BootstrapToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%v: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package wboxclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+type CaptivePortalConfig struct {
+	Enable bool `toml:"enable"`
+
+	// URL fetched to detect the portal. The response should have status 204
+	// or, if expect is set, contain it in the body. Redirects and other
+	// responses indicate the portal.
+	URL    string `toml:"url"`
+	Expect string `toml:"expect"`
+
+	// How often the tunnel is checked.
+	Interval Duration `toml:"interval"`
+}
+
+const (
+	// captiveStale is the age of the last handshake with the server after
+	// which the network is checked for the captive portal.
+	captiveStale = 3 * time.Minute
+
+	// captiveRecheck is how often the probe is repeated while the tunnel is
+	// paused, so it resumes soon after the user authenticates.
+	captiveRecheck = 5 * time.Second
+
+	captiveTimeout = 5 * time.Second
+
+	// captiveBodyLimit limits the probe response body that is read.
+	captiveBodyLimit = 64 * 1024
+)
+
+type portalResult int
+
+const (
+	portalNone portalResult = iota
+	portalDetected
+	portalUnreachable
+)
+
+type captiveState struct {
+	cfg    Config
+	link   linkmgr.Link
+	clCfg  *wboxproto.Cfg
+	events *wirebox.EventBus
+	client *http.Client
+
+	paused bool
+}
+
+// probe fetches the probe URL and reports whether the response indicates
+// the captive portal. The portal URL is returned if the probe was
+// redirected.
+func (cs *captiveState) probe() (portalResult, string, error) {
+	resp, err := cs.client.Get(cs.cfg.CaptivePortal.URL)
+	if err != nil {
+		return portalUnreachable, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, captiveBodyLimit))
+	if err != nil {
+		return portalUnreachable, "", err
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return portalDetected, loc, nil
+	}
+	if cs.cfg.CaptivePortal.Expect != "" {
+		if resp.StatusCode == http.StatusOK && strings.Contains(string(body), cs.cfg.CaptivePortal.Expect) {
+			return portalNone, "", nil
+		}
+		return portalDetected, "", nil
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return portalNone, "", nil
+	}
+	return portalDetected, "", nil
+}
+
+// handshakeStale reports whether the tunnel to the server looks broken.
+func (cs *captiveState) handshakeStale() (bool, error) {
+	dev, err := cs.link.WGConfig()
+	if err != nil {
+		return false, err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey == cs.cfg.ServerKey.Bytes {
+			return time.Since(p.LastHandshakeTime) > captiveStale, nil
+		}
+	}
+	return false, errors.New("server peer is not configured")
+}
+
+func (cs *captiveState) delRoutes() {
+	for _, r := range tunnelRoutes(cs.cfg, cs.clCfg) {
+		if err := cs.link.DelRoute(r); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Println("error: captive-portal: route del:", err)
+		}
+	}
+}
+
+func (cs *captiveState) addRoutes() {
+	routes := tunnelRoutes(cs.cfg, cs.clCfg)
+	for i, err := range linkmgr.AddRoutes(cs.link, routes, routeWorkers) {
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			log.Printf("error: captive-portal: route add %v: %v", routes[i].Dest, err)
+		}
+	}
+}
+
+func (cs *captiveState) pause(portal string) {
+	cs.paused = true
+	msg := "captive portal detected, tunnel routes removed until it is passed"
+	if portal != "" {
+		msg += fmt.Sprintf(", open %s to authenticate", portal)
+	}
+	log.Println("WARNING:", msg)
+	updateState(func(s *clientState) {
+		s.Phase = "captive-portal"
+		s.CaptivePortal = portal
+	})
+	cs.events.Emit(wirebox.TunnelPaused{Link: cs.link.Name(), Portal: portal})
+}
+
+func (cs *captiveState) resume() {
+	cs.addRoutes()
+	cs.paused = false
+	log.Println("captive portal passed, tunnel routes restored")
+	updateState(func(s *clientState) {
+		s.Phase = "up"
+		s.CaptivePortal = ""
+	})
+	cs.events.Emit(wirebox.TunnelResumed{Link: cs.link.Name()})
+}
+
+// check runs a single detection round.
+func (cs *captiveState) check() {
+	if cs.paused {
+		res, _, err := cs.probe()
+		if res == portalNone {
+			cs.resume()
+		} else if err != nil {
+			log.Println("captive-portal: probe:", err)
+		}
+		return
+	}
+
+	stale, err := cs.handshakeStale()
+	if err != nil {
+		log.Println("error: captive-portal:", err)
+		return
+	}
+	if !stale {
+		return
+	}
+
+	res, portal, err := cs.probe()
+	switch res {
+	case portalNone:
+		// The network works, the problem is elsewhere.
+		return
+	case portalDetected:
+		cs.delRoutes()
+		cs.pause(portal)
+		return
+	}
+
+	// The probe may be routed into the broken tunnel, retry without tunnel
+	// routes. They are restored unless the portal is found.
+	log.Println("captive-portal: probe failed, retrying without tunnel routes:", err)
+	cs.delRoutes()
+	res, portal, err = cs.probe()
+	if res == portalDetected {
+		cs.pause(portal)
+		return
+	}
+	if err != nil {
+		log.Println("captive-portal: probe:", err)
+	}
+	cs.addRoutes()
+}
+
+// runCaptivePortal checks for captive portals while the tunnel is broken
+// and pauses it until the portal is passed or stop is closed.
+func runCaptivePortal(m linkmgr.Manager, cfg Config, clCfg *wboxproto.Cfg, events *wirebox.EventBus, stop <-chan struct{}) {
+	if tunNS != nil {
+		m = tunNS
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: captive-portal:", err)
+		return
+	}
+
+	cs := &captiveState{
+		cfg:    cfg,
+		link:   tunLink,
+		clCfg:  clCfg,
+		events: events,
+		client: &http.Client{
+			Timeout: captiveTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	defer func() {
+		if cs.paused {
+			cs.addRoutes()
+			updateState(func(s *clientState) { s.CaptivePortal = "" })
+		}
+	}()
+
+	t := time.NewTimer(cfg.CaptivePortal.Interval.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			cs.check()
+			if cs.paused {
+				t.Reset(captiveRecheck)
+			} else {
+				t.Reset(cfg.CaptivePortal.Interval.Duration)
+			}
+		}
+	}
+}
@@ -3,20 +3,293 @@ package wboxclient
 import (
 	"errors"
 	"net"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/approute"
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/errreport"
+	"github.com/foxcpp/wirebox/hostsfile"
+	"github.com/foxcpp/wirebox/keys"
+	"github.com/foxcpp/wirebox/logging"
+	"github.com/foxcpp/wirebox/nm"
+	"github.com/foxcpp/wirebox/notify"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/sysctl"
+	"github.com/foxcpp/wirebox/tracing"
+	"github.com/foxcpp/wirebox/validate"
 )
 
 type Config struct {
 	If         string          `toml:"if"`
 	PrivateKey wirebox.PeerKey `toml:"private-key"`
+	// File to read the private key from if private-key is not set. The key is
+	// generated if the file does not exist.
+	PrivateKeyFile string `toml:"private-key-file"`
+	// Where private-key-file is stored: "file" (default), "tpm2" seals it
+	// to the TPM (private-key-file.pub and .priv are created), "keychain"
+	// uses the macOS keychain item with private-key-file as the account.
+	PrivateKeyBackend string `toml:"private-key-backend"`
+	// What to do if the private key is stored in a file accessible by other
+	// users: "strict" (default) refuses to use it, "warn" logs a warning.
+	KeyPerms string `toml:"key-permissions"`
 
 	ServerKey      wirebox.PeerKey `toml:"server-key"`
 	ConfigEndpoint UDPAddr         `toml:"config-endpoint"`
 
 	ConfigTimeout Duration `toml:"config-timeout"`
+
+	// Domain to discover config-endpoint (SRV record) and other options (TXT
+	// record) under if they are not set. With discovery-dnssec, responses
+	// should be validated by discovery-resolver (or the system resolver).
+	DiscoveryDomain   string `toml:"discovery-domain"`
+	DiscoveryDNSSEC   bool   `toml:"discovery-dnssec"`
+	DiscoveryResolver string `toml:"discovery-resolver"`
+
+	// HTTPS server to enroll at using the token. The server authorizes the
+	// client key and returns server-key, config-endpoint and address scheme
+	// options that are not set locally.
+	BootstrapURL   string `toml:"bootstrap-url"`
+	BootstrapToken string `toml:"bootstrap-token"`
+	// PEM file with CA certificates to verify the bootstrap server, system
+	// roots are used if not set.
+	BootstrapCA string `toml:"bootstrap-ca"`
+
+	// Scheme used to derive the link-local address for the configuration
+	// tunnel. Should be one of the schemes accepted by the server.
+	AddrScheme string `toml:"config-addr-scheme"`
+	AddrSalt   string `toml:"config-addr-salt"`
+	// Address family for the configuration tunnel: "auto" (default) uses
+	// IPv4 link-local addresses only if IPv6 is disabled, "ipv6" or "ipv4".
+	// IPv4 should be enabled at the server (config-ipv4).
+	ConfigFamily string `toml:"config-family"`
+
+	// Local networks routed by this client (site-to-site). They are reported
+	// to the server which routes them via the client if permitted.
+	Subnets []IPNet `toml:"subnets"`
+
+	// How the tunnel interface is configured: "netlink" (default) talks to
+	// the kernel directly, "networkd" writes systemd-networkd files to
+	// NetworkdDir and lets networkd create the interface.
+	Mode        string `toml:"mode"`
+	NetworkdDir string `toml:"networkd-dir"`
+
+	// Unix socket for commands such as "status" talking to the running
+	// client, /run/wirebox/wbox.sock by default.
+	ControlSocket string `toml:"control-socket"`
+
+	Log            logging.Config   `toml:"log"`
+	Audit          audit.Config     `toml:"audit"`
+	Tracing        tracing.Config   `toml:"tracing"`
+	ErrorReporting errreport.Config `toml:"error-reporting"`
+	Notify         notify.Config    `toml:"notify"`
+
+	SelfTest SelfTestConfig `toml:"self-test"`
+	Monitor  MonitorConfig  `toml:"monitor"`
+	Mesh     MeshConfig     `toml:"mesh"`
+	SplitDNS SplitDNSConfig `toml:"split-dns"`
+
+	AppRouting approute.Config `toml:"app-routing"`
+
+	CaptivePortal CaptivePortalConfig `toml:"captive-portal"`
+	Revalidate    RevalidateConfig    `toml:"revalidate"`
+	Metered       MeteredConfig       `toml:"metered"`
+	OnDemand      OnDemandConfig      `toml:"on-demand"`
+	Endpoints     EndpointsConfig     `toml:"endpoints"`
+	Daemon        DaemonConfig        `toml:"daemon"`
+
+	NetworkManager nm.Config `toml:"networkmanager"`
+
+	// Add names of peers pushed by the server to the hosts file.
+	Hosts hostsfile.Config `toml:"hosts"`
+
+	// Kernel parameters set for the tunnel interface.
+	Sysctl sysctl.Config `toml:"sysctl"`
+}
+
+func (c Config) addrScheme() wboxproto.AddrScheme {
+	scheme, _ := wirebox.ParseAddrScheme(c.AddrScheme)
+	return scheme
+}
+
+func (c Config) Validate() error {
+	var errs validate.Errors
+
+	errs.Check("if", validate.IfName(c.If, 15))
+	errs.Check("private-key", validate.Key(c.PrivateKey.Encoded))
+	errs.Check("server-key", validate.Key(c.ServerKey.Encoded))
+	if c.ConfigEndpoint.IP == nil {
+		errs.Add("config-endpoint", "is required")
+	} else {
+		errs.Check("config-endpoint", validate.Port(c.ConfigEndpoint.Port))
+	}
+	if c.ConfigTimeout.Duration < 0 {
+		errs.Add("config-timeout", "should be positive")
+	}
+	scheme, err := wirebox.ParseAddrScheme(c.AddrScheme)
+	errs.Check("config-addr-scheme", err)
+	if scheme == wboxproto.AddrScheme_SALTED_SHA256 && c.AddrSalt == "" {
+		errs.Add("config-addr-salt", "is required for salted scheme")
+	}
+	switch c.ConfigFamily {
+	case "", "auto", "ipv6", "ipv4":
+	default:
+		errs.Add("config-family", "should be one of: auto, ipv6, ipv4")
+	}
+
+	if !keys.ValidKind(c.PrivateKeyBackend) {
+		errs.Add("private-key-backend", "should be one of file, tpm2, keychain")
+	}
+	if !wirebox.ValidKeyPerms(c.KeyPerms) {
+		errs.Add("key-permissions", "should be either strict or warn")
+	}
+
+	for i, n := range c.Subnets {
+		errs.Check(validate.Field("subnets", strconv.Itoa(i)), validate.CIDR(n.IPNet))
+	}
+
+	switch c.Mode {
+	case "", "netlink", "networkd":
+	default:
+		errs.Add("mode", "should be either netlink or networkd")
+	}
+
+	if len(c.Notify.Exec) != 0 && c.Notify.Exec[0] == "" {
+		errs.Add(validate.Field("notify", "exec"), "command should not be empty")
+	}
+
+	if c.SelfTest.Timeout.Duration < 0 {
+		errs.Add(validate.Field("self-test", "timeout"), "should be positive")
+	}
+	if c.SelfTest.Attempts < 0 {
+		errs.Add(validate.Field("self-test", "attempts"), "should be positive")
+	}
+	if c.SelfTest.Recover < 0 {
+		errs.Add(validate.Field("self-test", "recover"), "should be positive")
+	}
+	for i, dns := range c.NetworkManager.DNS {
+		if net.ParseIP(dns) == nil {
+			errs.Add(validate.Field("networkmanager", "dns", strconv.Itoa(i)), "malformed IP")
+		}
+	}
+	if c.Mesh.Enable && c.Mode == "networkd" {
+		errs.Add(validate.Field("mesh", "enable"), "direct tunnels are not supported in networkd mode")
+	}
+	if c.Mesh.Interval.Duration < 0 {
+		errs.Add(validate.Field("mesh", "interval"), "should be positive")
+	}
+	if c.Mesh.Timeout.Duration < 0 {
+		errs.Add(validate.Field("mesh", "timeout"), "should be positive")
+	}
+	if c.SplitDNS.Enable {
+		if c.Mode == "networkd" {
+			errs.Add(validate.Field("split-dns", "enable"), "not supported in networkd mode")
+		}
+		if len(c.SplitDNS.Domains) == 0 {
+			errs.Add(validate.Field("split-dns", "domains"), "is required")
+		}
+		if _, _, err := net.SplitHostPort(c.SplitDNS.Listen); c.SplitDNS.Listen != "" && err != nil {
+			errs.Add(validate.Field("split-dns", "listen"), "should be host:port")
+		}
+		if c.SplitDNS.TunnelResolver == "" {
+			errs.Add(validate.Field("split-dns", "tunnel-resolver"), "is required")
+		} else {
+			errs.Check(validate.Field("split-dns", "tunnel-resolver"), validateResolver(c.SplitDNS.TunnelResolver))
+		}
+		if c.SplitDNS.Upstream == "" {
+			errs.Add(validate.Field("split-dns", "upstream"), "is required")
+		} else {
+			errs.Check(validate.Field("split-dns", "upstream"), validateResolver(c.SplitDNS.Upstream))
+		}
+	}
+	if c.SplitDNS.MinTTL.Duration < 0 {
+		errs.Add(validate.Field("split-dns", "min-ttl"), "should be positive")
+	}
+	switch c.AppRouting.Mode {
+	case "":
+	case approute.ModeExclude, approute.ModeInclude:
+		if c.Mode == "networkd" {
+			errs.Add(validate.Field("app-routing", "mode"), "not supported in networkd mode")
+		}
+		if len(c.AppRouting.Units) == 0 && len(c.AppRouting.Cgroups) == 0 {
+			errs.Add(validate.Field("app-routing", "units"), "units or cgroups are required")
+		}
+	default:
+		errs.Add(validate.Field("app-routing", "mode"), "should be either exclude or include")
+	}
+	// 253-255 are default, main and local tables.
+	if t := c.AppRouting.Table; t < 0 || (t >= 253 && t <= 255) {
+		errs.Add(validate.Field("app-routing", "table"), "should not be a reserved table")
+	}
+	if c.CaptivePortal.Enable && c.Mode == "networkd" {
+		errs.Add(validate.Field("captive-portal", "enable"), "not supported in networkd mode")
+	}
+	if c.CaptivePortal.URL != "" {
+		if u, err := url.Parse(c.CaptivePortal.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs.Add(validate.Field("captive-portal", "url"), "should be an HTTP URL")
+		}
+	}
+	if c.CaptivePortal.Interval.Duration < 0 {
+		errs.Add(validate.Field("captive-portal", "interval"), "should be positive")
+	}
+	if c.Metered.DisableFullTunnel && c.Mode == "networkd" {
+		errs.Add(validate.Field("metered", "disable-full-tunnel"), "not supported in networkd mode")
+	}
+	if c.Endpoints.Interval.Duration < 0 {
+		errs.Add(validate.Field("endpoints", "interval"), "should be positive")
+	}
+	if c.Metered.Interval.Duration < 0 {
+		errs.Add(validate.Field("metered", "interval"), "should be positive")
+	}
+	if c.Metered.Keepalive.Duration < 0 {
+		errs.Add(validate.Field("metered", "keepalive"), "should be positive")
+	}
+	if c.OnDemand.Enable {
+		// These send traffic via the tunnel and would keep it active.
+		for _, f := range []struct {
+			name    string
+			enabled bool
+		}{
+			{"monitor", c.Monitor.Enable},
+			{"mesh", c.Mesh.Enable},
+			{"captive-portal", c.CaptivePortal.Enable},
+			{"revalidate", c.Revalidate.Enable},
+			{"daemon", c.Daemon.Enable},
+		} {
+			if f.enabled {
+				errs.Add(validate.Field("on-demand", "enable"), "cannot be used together with "+f.name)
+			}
+		}
+	}
+	errs.Check("sysctl", c.Sysctl.Validate())
+	if c.OnDemand.IdleTimeout.Duration < 0 {
+		errs.Add(validate.Field("on-demand", "idle-timeout"), "should be positive")
+	}
+	if c.Revalidate.Timeout.Duration < 0 {
+		errs.Add(validate.Field("revalidate", "timeout"), "should be positive")
+	}
+	if c.Daemon.Interval.Duration < 0 {
+		errs.Add(validate.Field("daemon", "interval"), "should be positive")
+	}
+	if c.Daemon.CheckInterval.Duration < 0 {
+		errs.Add(validate.Field("daemon", "check-interval"), "should be positive")
+	}
+	if c.Daemon.Retry.Duration < 0 {
+		errs.Add(validate.Field("daemon", "retry"), "should be positive")
+	}
+	if c.Monitor.Interval.Duration < 0 {
+		errs.Add(validate.Field("monitor", "interval"), "should be positive")
+	}
+	if c.Monitor.Window < 0 {
+		errs.Add(validate.Field("monitor", "window"), "should be positive")
+	}
+	if c.Monitor.MaxLoss < 0 || c.Monitor.MaxLoss > 100 {
+		errs.Add(validate.Field("monitor", "max-loss"), "should be a percentage")
+	}
+
+	return errs.Err()
 }
 
 type Duration struct {
@@ -50,6 +323,19 @@ func (a *UDPAddr) UnmarshalText(text []byte) error {
 	return nil
 }
 
+type IPNet struct {
+	net.IPNet
+}
+
+func (a *IPNet) UnmarshalText(text []byte) error {
+	_, network, err := net.ParseCIDR(string(text))
+	if err != nil {
+		return err
+	}
+	a.IPNet = *network
+	return nil
+}
+
 type IPAddr struct {
 	net.IP
 }
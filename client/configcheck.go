@@ -0,0 +1,97 @@
+package wboxclient
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/cfgfile"
+)
+
+// placeholderKey stands for keys obtained at run time when the
+// configuration file is checked.
+var placeholderKey = wirebox.PeerKey{Encoded: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+
+// ConfigSchema returns the JSON Schema of the client configuration file.
+func ConfigSchema() map[string]interface{} {
+	return cfgfile.Schema(Config{}, "wbox configuration")
+}
+
+// CheckConfigFile validates the configuration file without loading the
+// private key, contacting the server or applying overrides from the kernel
+// command line and the environment. Options filled at run time by
+// private-key-file, discovery-domain and bootstrap-url are not required.
+func CheckConfigFile(path string) error {
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(path, &cfg); err != nil {
+		return err
+	}
+	if err := checkConfig(cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// checkConfig validates the configuration as decoded from the file, options
+// filled at run time are replaced with placeholders in the copy.
+func checkConfig(cfg Config) error {
+	if cfg.PrivateKey.Encoded == "" && cfg.PrivateKeyFile != "" {
+		cfg.PrivateKey = placeholderKey
+	}
+	if cfg.DiscoveryDomain != "" || cfg.BootstrapURL != "" {
+		if cfg.ServerKey.Encoded == "" {
+			cfg.ServerKey = placeholderKey
+		}
+		if cfg.ConfigEndpoint.IP == nil {
+			cfg.ConfigEndpoint.UDPAddr = net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+		}
+	}
+	return cfg.Validate()
+}
+
+func configMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wbox config schema")
+		fmt.Fprintln(fs.Output(), "       wbox config validate [FILE...]")
+		fmt.Fprintln(fs.Output(), "Prints the JSON Schema of the configuration file or validates files")
+		fmt.Fprintln(fs.Output(), "(the -config file by default) without using the network. Exits with")
+		fmt.Fprintln(fs.Output(), "status 2 if any file is invalid.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitConfig
+	}
+
+	switch cmd, args := fs.Arg(0), fs.Args(); {
+	case cmd == "schema" && len(args) == 1:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ConfigSchema()); err != nil {
+			log.Println("error:", err)
+			return ExitFailure
+		}
+		return ExitOK
+	case cmd == "validate":
+		paths := args[1:]
+		if len(paths) == 0 {
+			paths = []string{cfgPath}
+		}
+		code := ExitOK
+		for _, path := range paths {
+			if err := CheckConfigFile(path); err != nil {
+				fmt.Println(err)
+				code = ExitConfig
+				continue
+			}
+			fmt.Printf("%s: OK\n", path)
+		}
+		return code
+	}
+	fs.Usage()
+	return ExitConfig
+}
@@ -0,0 +1,174 @@
+package wboxclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/cli"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/top"
+	"github.com/foxcpp/wirebox/wgfmt"
+)
+
+// DefaultControlSocket is used if control-socket is not set.
+const DefaultControlSocket = "/run/wirebox/wbox.sock"
+
+// eventLogSize is the number of recent events shown by the top command.
+const eventLogSize = 50
+
+func (cfg Config) controlSocket() string {
+	if cfg.ControlSocket == "" {
+		return DefaultControlSocket
+	}
+	return cfg.ControlSocket
+}
+
+type statusArgs struct {
+	Format string `json:"format"`
+	// Include private and preshared keys in wg-dump output.
+	ShowKeys bool `json:"show-keys"`
+}
+
+// controller serves control socket requests of the running client.
+type controller struct {
+	m      linkmgr.Manager
+	events *wirebox.EventLog
+
+	// reconfigure passes reconfiguration requests to the main loop, which
+	// sends the result back.
+	reconfigure chan chan error
+	// done is closed when the main loop exits.
+	done chan struct{}
+}
+
+func newController(m linkmgr.Manager) *controller {
+	return &controller{
+		m:           m,
+		events:      wirebox.NewEventLog(eventLogSize),
+		reconfigure: make(chan chan error),
+		done:        make(chan struct{}),
+	}
+}
+
+func (c *controller) handlers() map[string]ctlsock.Handler {
+	return map[string]ctlsock.Handler{
+		"state": func(json.RawMessage) (interface{}, error) {
+			return debugState(), nil
+		},
+		"status": c.status,
+		"bench":  c.bench,
+		"top": func(json.RawMessage) (interface{}, error) {
+			stateLock.Lock()
+			name := state.Link
+			stateLock.Unlock()
+			var names []string
+			if name != "" {
+				names = []string{name}
+			}
+			return top.Collect(c.linkMngr(), names, c.events), nil
+		},
+		"reconfigure": func(json.RawMessage) (interface{}, error) {
+			res := make(chan error, 1)
+			select {
+			case c.reconfigure <- res:
+			case <-c.done:
+				return nil, errExiting
+			}
+			select {
+			case err := <-res:
+				return nil, err
+			case <-c.done:
+				return nil, errExiting
+			}
+		},
+	}
+}
+
+// linkMngr returns the manager of the namespace the tunnel is in.
+func (c *controller) linkMngr() linkmgr.Manager {
+	if tunNS != nil {
+		return tunNS
+	}
+	return c.m
+}
+
+var errExiting = errors.New("client is exiting (no background features are enabled)")
+
+func (c *controller) status(raw json.RawMessage) (interface{}, error) {
+	args := statusArgs{Format: "wg-show"}
+	if len(raw) != 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	stateLock.Lock()
+	name := state.Link
+	stateLock.Unlock()
+	if name == "" {
+		return nil, errors.New("tunnel is not created yet")
+	}
+
+	l, err := c.linkMngr().GetLink(name)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := l.WGConfig()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := wgfmt.WriteStatus(&buf, args.Format, l.Name(), dev, args.ShowKeys); err != nil {
+		return nil, err
+	}
+	return buf.String(), nil
+}
+
+func reconfigureMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("reconfigure", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wbox reconfigure")
+		fmt.Fprintln(fs.Output(), "Makes the running client request the configuration again and apply")
+		fmt.Fprintln(fs.Output(), "changes without recreating the interface.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return 2
+	}
+	if err := ctlsock.Call(cfg.controlSocket(), "reconfigure", nil, nil); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
+
+func logsMain(cfgPath string, args []string) int {
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return 2
+	}
+	return cli.Logs(cfg.controlSocket(), args)
+}
+
+func topMain(cfgPath string, args []string) int {
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return 2
+	}
+	return top.Run(cfg.controlSocket(), "wbox", args)
+}
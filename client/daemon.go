@@ -0,0 +1,84 @@
+package wboxclient
+
+import (
+	"log"
+	"time"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+type DaemonConfig struct {
+	// Keep running after the tunnel is configured (also enabled by -daemon).
+	Enable bool `toml:"enable"`
+
+	// How often to request the configuration again. Changes are applied
+	// to the existing tunnel without recreating it.
+	Interval Duration `toml:"interval"`
+
+	// How often to check that the tunnel exists and the server responds
+	// through it. The configuration is requested again if it does not.
+	CheckInterval Duration `toml:"check-interval"`
+
+	// Delay before the next attempt if the configuration failed.
+	Retry Duration `toml:"retry"`
+}
+
+// runDaemon requests the configuration periodically and when the tunnel
+// breaks until stop is closed.
+func runDaemon(m linkmgr.Manager, cfg Config, clCfg *wboxproto.Cfg, reconfigure chan<- chan error, stop <-chan struct{}) {
+	if tunNS != nil {
+		m = tunNS
+	}
+
+	stateLock.Lock()
+	failed := state.Phase == "failed" || state.Phase == "degraded"
+	stateLock.Unlock()
+	refreshIn := cfg.Daemon.Interval.Duration
+	if failed {
+		refreshIn = cfg.Daemon.Retry.Duration
+	}
+	refresh := time.NewTimer(refreshIn)
+	defer refresh.Stop()
+	check := time.NewTicker(cfg.Daemon.CheckInterval.Duration)
+	defer check.Stop()
+
+	targets := monitorTargets(cfg, clCfg)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-refresh.C:
+			log.Println("daemon: refreshing the configuration")
+		case <-check.C:
+			stateLock.Lock()
+			phase := state.Phase
+			stateLock.Unlock()
+			if phase == "captive-portal" {
+				// The captive portal detection restores the tunnel.
+				continue
+			}
+
+			tunLink, err := m.GetLink(cfg.If)
+			if err != nil {
+				log.Println("WARNING: daemon: tunnel is gone, requesting the configuration:", err)
+			} else if !revalidate(tunLink, cfg, targets, stop) {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				log.Println("WARNING: daemon: tunnel does not work, requesting the configuration")
+			} else {
+				continue
+			}
+		}
+
+		select {
+		case reconfigure <- make(chan error, 1):
+		case <-stop:
+		}
+		// Workers are restarted after the reconfiguration.
+		return
+	}
+}
@@ -0,0 +1,367 @@
+package wboxclient
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/hostsfile"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/probe"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type diagArgs struct {
+	// Address, "server", host name pushed by the server or the public key
+	// of a mesh peer.
+	Target string `json:"target"`
+	// 4 or 6 to use only addresses of this family, 0 for any.
+	Family int `json:"family,omitempty"`
+
+	Count    int           `json:"count,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Timeout  time.Duration `json:"timeout"`
+	MaxHops  int           `json:"max-hops,omitempty"`
+}
+
+type pingReply struct {
+	Seq    int           `json:"seq"`
+	Source string        `json:"source"`
+	Target string        `json:"target"`
+	RTT    time.Duration `json:"rtt,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type traceHop struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	probe.Hop
+}
+
+// resolvePeer returns in-tunnel addresses of the target (see
+// diagArgs.Target) using the last received configuration.
+func resolvePeer(clCfg *wboxproto.Cfg, target string) ([]net.IP, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if clCfg == nil {
+		return nil, errors.New("tunnel is not configured yet")
+	}
+
+	if target == "server" {
+		var res []net.IP
+		if clCfg.GetServer4() != 0 && len(clCfg.Net4) != 0 {
+			res = append(res, wboxproto.IPv4(clCfg.GetServer4()))
+		}
+		if clCfg.GetServer6() != nil && len(clCfg.Net6) != 0 {
+			res = append(res, clCfg.GetServer6().AsIP())
+		}
+		return res, nil
+	}
+
+	name := strings.TrimSuffix(target, ".")
+	for _, e := range hostsfile.Entries(clCfg) {
+		if strings.EqualFold(e.Name, name) {
+			return e.Addrs, nil
+		}
+	}
+
+	if key, err := wgtypes.ParseKey(target); err == nil {
+		for _, p := range clCfg.GetPeers() {
+			if string(p.GetPubkey()) != string(key[:]) {
+				continue
+			}
+			var res []net.IP
+			for _, a := range p.GetAddrs4() {
+				res = append(res, wboxproto.IPv4(a))
+			}
+			for _, a := range p.GetAddrs6() {
+				res = append(res, a.AsIP())
+			}
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown peer: %v", target)
+}
+
+// diagSource picks the tunnel address to send probes to dst from.
+func diagSource(l linkmgr.Link, dst net.IP) (probe.Source, error) {
+	addrs, err := l.Addrs()
+	if err != nil {
+		return probe.Source{}, err
+	}
+	v4 := dst.To4() != nil
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) != v4 {
+			continue
+		}
+		// Configuration addresses are link-local and not routed by the
+		// server.
+		if a.IP.IsLinkLocalUnicast() && !dst.IsLinkLocalUnicast() {
+			continue
+		}
+		return probe.Source{Addr: a.IP, Dev: l.Name()}, nil
+	}
+	return probe.Source{}, fmt.Errorf("no tunnel address to reach %v from", dst)
+}
+
+// diagTarget resolves the target and the source for ping and trace.
+func (c *controller) diagTarget(args diagArgs) (probe.Source, net.IP, error) {
+	stateLock.Lock()
+	clCfg := state.cfg
+	name := state.Link
+	stateLock.Unlock()
+	if name == "" {
+		return probe.Source{}, nil, errors.New("tunnel is not created yet")
+	}
+	l, err := c.linkMngr().GetLink(name)
+	if err != nil {
+		return probe.Source{}, nil, err
+	}
+
+	addrs, err := resolvePeer(clCfg, args.Target)
+	if err != nil {
+		return probe.Source{}, nil, err
+	}
+	var lastErr error = fmt.Errorf("%v has no IPv%d addresses", args.Target, args.Family)
+	for _, ip := range addrs {
+		if args.Family == 4 && ip.To4() == nil || args.Family == 6 && ip.To4() != nil {
+			continue
+		}
+		src, err := diagSource(l, ip)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return src, ip, nil
+	}
+	return probe.Source{}, nil, lastErr
+}
+
+func (c *controller) ping(raw json.RawMessage, send func(v interface{}) error, done <-chan struct{}) error {
+	var args diagArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	src, dst, err := c.diagTarget(args)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; args.Count == 0 || i <= args.Count; i++ {
+		if i != 1 {
+			select {
+			case <-done:
+				return nil
+			case <-time.After(args.Interval):
+			}
+		}
+		reply := pingReply{Seq: i, Source: src.Addr.String(), Target: dst.String()}
+		err := linkmgr.InNetNS(tunNS, func() error {
+			var err error
+			reply.RTT, err = probe.PingFrom(src, dst, args.Timeout)
+			return err
+		})
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		if err := send(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *controller) trace(raw json.RawMessage, send func(v interface{}) error, done <-chan struct{}) error {
+	var args diagArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	src, dst, err := c.diagTarget(args)
+	if err != nil {
+		return err
+	}
+
+	errStopped := errors.New("stopped")
+	err = linkmgr.InNetNS(tunNS, func() error {
+		return probe.Trace(src, dst, args.MaxHops, args.Timeout, func(hop probe.Hop) error {
+			select {
+			case <-done:
+				return errStopped
+			default:
+			}
+			return send(traceHop{Source: src.Addr.String(), Target: dst.String(), Hop: hop})
+		})
+	})
+	if errors.Is(err, errStopped) {
+		return nil
+	}
+	return err
+}
+
+// diagFlags adds options shared by ping and trace.
+func diagFlags(fs *flag.FlagSet) (family func() int) {
+	v4 := fs.Bool("4", false, "use only IPv4 addresses of the target")
+	v6 := fs.Bool("6", false, "use only IPv6 addresses of the target")
+	return func() int {
+		switch {
+		case *v4:
+			return 4
+		case *v6:
+			return 6
+		}
+		return 0
+	}
+}
+
+func diagUsage(fs *flag.FlagSet, usage, help string) {
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage:", usage)
+		fmt.Fprintln(fs.Output(), help)
+		fmt.Fprintln(fs.Output(), "TARGET is an address, \"server\" (the default), the host name pushed by")
+		fmt.Fprintln(fs.Output(), "the server or the public key of a mesh peer. Probes are sent by the")
+		fmt.Fprintln(fs.Output(), "running client from its tunnel address and interface.")
+		fs.PrintDefaults()
+	}
+}
+
+func diagConfig(cfgPath string) (Config, bool) {
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return cfg, false
+	}
+	return cfg, true
+}
+
+func pingMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	family := diagFlags(fs)
+	count := fs.Int("c", 4, "number of echo requests to send, 0 to ping until interrupted")
+	interval := fs.Duration("i", time.Second, "delay between echo requests")
+	timeout := fs.Duration("W", 2*time.Second, "time to wait for each reply")
+	diagUsage(fs, "wbox ping [options] [TARGET]", "Sends ICMP echo requests through the tunnel.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 || *count < 0 || *interval <= 0 || *timeout <= 0 {
+		fs.Usage()
+		return 2
+	}
+	target := "server"
+	if fs.NArg() == 1 {
+		target = fs.Arg(0)
+	}
+	cfg, ok := diagConfig(cfgPath)
+	if !ok {
+		return 2
+	}
+
+	req := diagArgs{Target: target, Family: family(), Count: *count, Interval: *interval, Timeout: *timeout}
+	var (
+		sent, received  int
+		total, min, max time.Duration
+	)
+	err := ctlsock.Stream(cfg.controlSocket(), "ping", req, func(raw json.RawMessage) error {
+		var r pingReply
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		if sent == 0 {
+			fmt.Printf("PING %s (%s) from %s\n", target, r.Target, r.Source)
+		}
+		sent++
+		if r.Error != "" {
+			fmt.Printf("seq=%d %s\n", r.Seq, r.Error)
+			return nil
+		}
+		received++
+		total += r.RTT
+		if min == 0 || r.RTT < min {
+			min = r.RTT
+		}
+		if r.RTT > max {
+			max = r.RTT
+		}
+		fmt.Printf("reply from %s: seq=%d time=%v\n", r.Target, r.Seq, r.RTT)
+		return nil
+	})
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if sent == 0 {
+		return 1
+	}
+	fmt.Printf("%d sent, %d received, %.0f%% loss", sent, received, 100*float64(sent-received)/float64(sent))
+	if received != 0 {
+		fmt.Printf(", rtt min/avg/max %v/%v/%v", min, total/time.Duration(received), max)
+	}
+	fmt.Println()
+	if received == 0 {
+		return 1
+	}
+	return 0
+}
+
+func traceMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	family := diagFlags(fs)
+	maxHops := fs.Int("m", 30, "maximum number of hops")
+	timeout := fs.Duration("w", 2*time.Second, "time to wait for the answer of each hop")
+	diagUsage(fs, "wbox trace [options] [TARGET]", "Shows routers on the path through the tunnel.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 || *maxHops <= 0 || *timeout <= 0 {
+		fs.Usage()
+		return 2
+	}
+	target := "server"
+	if fs.NArg() == 1 {
+		target = fs.Arg(0)
+	}
+	cfg, ok := diagConfig(cfgPath)
+	if !ok {
+		return 2
+	}
+
+	req := diagArgs{Target: target, Family: family(), MaxHops: *maxHops, Timeout: *timeout}
+	first, reached := true, false
+	err := ctlsock.Stream(cfg.controlSocket(), "trace", req, func(raw json.RawMessage) error {
+		var h traceHop
+		if err := json.Unmarshal(raw, &h); err != nil {
+			return err
+		}
+		if first {
+			fmt.Printf("trace to %s (%s) from %s, %d hops max\n", target, h.Target, h.Source, *maxHops)
+			first = false
+		}
+		switch {
+		case h.Addr == nil:
+			fmt.Printf("%2d  *\n", h.TTL)
+		case h.Error != "":
+			fmt.Printf("%2d  %v  %v  %s\n", h.TTL, h.Addr, h.RTT, h.Error)
+		default:
+			fmt.Printf("%2d  %v  %v\n", h.TTL, h.Addr, h.RTT)
+			reached = h.Addr.Equal(net.ParseIP(h.Target))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if !reached {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package wboxclient
+
+import (
+	"net"
+	"os"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/doctor"
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+// Doctor checks prerequisites and common causes of configuration failures.
+func Doctor(cfgPath string) doctor.Report {
+	var r doctor.Report
+
+	var cfg Config
+	md, err := cfgfile.DecodeFile(cfgPath, &cfg)
+	if err != nil {
+		r.Fail("config", "fix the configuration file", "%v", err)
+	} else if err := checkConfig(cfg); err != nil {
+		r.Fail("config", "fix the configuration file", "%v", err)
+	} else {
+		r.OK("config", "%v is valid", cfgPath)
+	}
+	if keyFile := md.DefinedIn("private-key"); keyFile != "" {
+		checkKeyPerms(&r, keyFile)
+	}
+	if cfg.PrivateKeyFile != "" {
+		if _, err := os.Stat(cfg.PrivateKeyFile); err == nil {
+			checkKeyPerms(&r, cfg.PrivateKeyFile)
+		}
+	}
+
+	doctor.CheckWireGuard(&r)
+	doctor.CheckPrivileges(&r)
+	doctor.CheckClock(&r)
+
+	if cfg.ConfigEndpoint.IP != nil {
+		doctor.CheckUDP(&r, "endpoint", &cfg.ConfigEndpoint.UDPAddr)
+	}
+	if len(cfg.Subnets) != 0 {
+		// Traffic to local subnets arrives via the tunnel.
+		var v4, v6 bool
+		for _, n := range cfg.Subnets {
+			if n.IP.To4() != nil {
+				v4 = true
+			} else {
+				v6 = true
+			}
+		}
+		doctor.CheckForwarding(&r, v4, v6)
+	}
+
+	m, err := linkmgr.NewManager()
+	if err != nil {
+		r.Fail("links", "", "cannot access network interfaces: %v", err)
+		return r
+	}
+	defer m.Close()
+	checkLinks(&r, m, cfg)
+
+	return r
+}
+
+func checkLinks(r *doctor.Report, m linkmgr.Manager, cfg Config) {
+	if cfg.If != "" {
+		if _, err := net.InterfaceByName(cfg.If); err != nil {
+			r.OK("interface", "%v does not exist and will be created", cfg.If)
+		} else if l, err := m.GetLink(cfg.If); err != nil {
+			r.Warn("interface", "", "cannot check %v: %v", cfg.If, err)
+		} else if _, err := l.WGConfig(); err != nil {
+			r.Fail("interface", "remove the interface or change 'if' in the configuration",
+				"%v exists and is not a WireGuard interface", cfg.If)
+		} else {
+			r.OK("interface", "%v exists and will be reused", cfg.If)
+		}
+	}
+
+	if cfg.ServerKey.Encoded == "" {
+		return
+	}
+	links, err := m.Links()
+	if err != nil {
+		r.Warn("conflicts", "", "cannot list interfaces: %v", err)
+		return
+	}
+	conflicts := false
+	for _, l := range links {
+		if l.Name() == cfg.If {
+			continue
+		}
+		dev, err := l.WGConfig()
+		if err != nil {
+			continue
+		}
+		for _, p := range dev.Peers {
+			if p.PublicKey == cfg.ServerKey.Bytes {
+				conflicts = true
+				r.Warn("conflicts", "remove the interface if it is not used anymore",
+					"%v is another tunnel to the same server", l.Name())
+			}
+		}
+	}
+	if !conflicts {
+		r.OK("conflicts", "no other tunnels to the server")
+	}
+}
+
+func checkKeyPerms(r *doctor.Report, path string) {
+	if err := wirebox.CheckKeyPerms(path, wirebox.KeyPermsStrict); err != nil {
+		r.Fail("key-permissions", "chmod 600 "+path, "%v", err)
+		return
+	}
+	r.OK("key-permissions", "%v is accessible only by the owner", path)
+}
@@ -0,0 +1,63 @@
+package wboxclient
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/networkd"
+)
+
+func downMain(cfgPath, netns string, args []string) int {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wirebox down")
+		fmt.Fprintln(fs.Output(), "Removes the tunnel interface created by wirebox up.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitConfig
+	}
+
+	// The private key is not needed, so the configuration is not fully
+	// loaded.
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return ExitConfig
+	}
+	if cfg.NetworkdDir == "" {
+		cfg.NetworkdDir = networkd.DefaultDir
+	}
+
+	var (
+		m   linkmgr.Manager
+		err error
+	)
+	if netns != "" {
+		m, err = linkmgr.NewManagerNetNS(linkmgr.NetNSPath(netns))
+	} else {
+		m, err = linkmgr.NewManager()
+	}
+	if err != nil {
+		log.Println("error: link mngr init:", err)
+		return exitCode(err)
+	}
+	defer m.Close()
+
+	l, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error:", err)
+		return ExitFailure
+	}
+
+	events, closeEvents := newEventBus(cfg)
+	defer closeEvents()
+	if err := delLink(m, cfg, l, events); err != nil {
+		log.Println("error: failed to delete link:", err)
+		return exitCode(err)
+	}
+	return ExitOK
+}
@@ -0,0 +1,134 @@
+package wboxclient
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+// serverEndpoints returns addresses of the config endpoint and the tunnel
+// endpoint if it differs.
+func serverEndpoints(cfg Config, tunEndpoint *net.UDPAddr) []net.IP {
+	endpoints := []net.IP{cfg.ConfigEndpoint.IP}
+	if tunEndpoint != nil && !tunEndpoint.IP.Equal(cfg.ConfigEndpoint.IP) {
+		endpoints = append(endpoints, tunEndpoint.IP)
+	}
+	return endpoints
+}
+
+// protectEndpoints keeps server endpoints reachable outside of the tunnel
+// after spec routes are installed. If a route covers the endpoint and is
+// more specific than the route currently used for it, the host route via the
+// current path is added. The error is returned if it cannot be done, unless
+// -force is set.
+func protectEndpoints(m linkmgr.Manager, cfg Config, tunLink linkmgr.Link, spec tunnelSpec) error {
+	if spec.WG.FirewallMark != nil {
+		// Marked packets bypass tunnel routes.
+		return nil
+	}
+	for _, ip := range serverEndpoints(cfg, spec.WG.Peers[0].Endpoint) {
+		if err := protectEndpoint(m, tunLink, spec.Routes, ip); err != nil {
+			if !forceRoutes {
+				return fmt.Errorf("%w (use -force to install routes anyway)", err)
+			}
+			log.Println("WARNING:", err)
+		}
+	}
+	return nil
+}
+
+func protectEndpoint(m linkmgr.Manager, tunLink linkmgr.Link, routes []linkmgr.Route, ip net.IP) error {
+	cur, err := m.RouteGet(ip)
+	if err != nil {
+		return fmt.Errorf("endpoint %v: %w", ip, err)
+	}
+	if cur.LinkIndex == tunLink.Index() {
+		return fmt.Errorf("endpoint %v is routed via the tunnel (%v)", ip, cur.Dest.String())
+	}
+
+	curLen, _ := cur.Dest.Mask.Size()
+	var conflict *linkmgr.Route
+	for i, r := range routes {
+		if l, _ := r.Dest.Mask.Size(); r.Type == linkmgr.RouteUnicast && r.Dest.Contains(ip) && l >= curLen {
+			conflict = &routes[i]
+			break
+		}
+	}
+	if conflict == nil {
+		return nil
+	}
+
+	uplink, err := linkByIndex(m, cur.LinkIndex)
+	if err != nil {
+		return fmt.Errorf("route %v would send packets to the endpoint %v into the tunnel: %w", conflict.Dest.String(), ip, err)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	host := linkmgr.Route{
+		Dest:    net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+		Gateway: cur.Gateway,
+		Table:   cur.Table,
+	}
+	if err := uplink.AddRoute(host); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("route %v would send packets to the endpoint %v into the tunnel: %w", conflict.Dest.String(), ip, err)
+	}
+	log.Printf("added route to the endpoint %v via %v, %v would send its packets into the tunnel", ip, uplink.Name(), conflict.Dest.String())
+	return nil
+}
+
+// removeEndpointRoutes removes host routes to server endpoints added by
+// protectEndpoints for the tunnel link l.
+func removeEndpointRoutes(m linkmgr.Manager, cfg Config, l linkmgr.Link) {
+	var tunEndpoint *net.UDPAddr
+	if dev, err := l.WGConfig(); err == nil {
+		for _, p := range dev.Peers {
+			if p.PublicKey == cfg.ServerKey.Bytes {
+				tunEndpoint = p.Endpoint
+			}
+		}
+	}
+	removeHostRoutes(m, serverEndpoints(cfg, tunEndpoint), l.Index())
+}
+
+// removeHostRoutes removes host routes to endpoints installed by wirebox on
+// links other than the tunnel with index tunIndex.
+func removeHostRoutes(m linkmgr.Manager, endpoints []net.IP, tunIndex int) {
+	for _, ip := range endpoints {
+		cur, err := m.RouteGet(ip)
+		if err != nil {
+			continue
+		}
+		ones, bits := cur.Dest.Mask.Size()
+		if ones != bits || !cur.Owned() || cur.LinkIndex == 0 || cur.LinkIndex == tunIndex {
+			continue
+		}
+		uplink, err := linkByIndex(m, cur.LinkIndex)
+		if err != nil {
+			continue
+		}
+		if err := uplink.DelRoute(cur.Route); err != nil {
+			log.Println("error: endpoint route:", err)
+			continue
+		}
+		log.Printf("removed route to the endpoint %v via %v", ip, uplink.Name())
+	}
+}
+
+func linkByIndex(m linkmgr.Manager, indx int) (linkmgr.Link, error) {
+	links, err := m.Links()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		if l.Index() == indx {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no link with index %d", indx)
+}
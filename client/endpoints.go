@@ -0,0 +1,212 @@
+package wboxclient
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/probe"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type EndpointsConfig struct {
+	// Prefer tunnel endpoints of this region among candidates sent by the
+	// server.
+	Region string `toml:"region"`
+	// Measure the latency to candidates using ICMP echo and prefer the
+	// nearest one.
+	Probe bool `toml:"probe"`
+	// How often the choice is re-evaluated, only once on configuration if
+	// zero.
+	Interval Duration `toml:"interval"`
+}
+
+const (
+	endpointProbeTimeout = 2 * time.Second
+
+	// Switch to another endpoint only if its latency is lower by this
+	// fraction, so the tunnel does not flap between similar ones.
+	endpointSwitchGain = 0.2
+)
+
+type endpointCandidate struct {
+	addr     *net.UDPAddr
+	region   string
+	priority uint32
+
+	// Set if probed.
+	rtt       time.Duration
+	reachable bool
+}
+
+// endpointCandidates returns tunnel endpoints suggested by the server, IPv6
+// ones are skipped if IPv6 is disabled.
+func endpointCandidates(clCfg *wboxproto.Cfg, port int) []endpointCandidate {
+	var res []endpointCandidate
+	for _, h := range clCfg.GetTunEndpoints() {
+		if h.GetEndpoint() == nil {
+			continue
+		}
+		addr := h.GetEndpoint().AsUDPAddr()
+		if addr.IP.To4() == nil && !ipv6Enabled() {
+			continue
+		}
+		if addr.Port == 0 {
+			addr.Port = port
+		}
+		res = append(res, endpointCandidate{
+			addr:     addr,
+			region:   h.GetRegion(),
+			priority: h.GetPriority(),
+		})
+	}
+	return res
+}
+
+// rankEndpoints probes candidates if enabled and sorts them by preference:
+// the configured region first, then reachable ones by latency, then by the
+// priority set by the server.
+func rankEndpoints(cfg EndpointsConfig, cands []endpointCandidate) {
+	if cfg.Probe {
+		var wg sync.WaitGroup
+		for i := range cands {
+			wg.Add(1)
+			go func(c *endpointCandidate) {
+				defer wg.Done()
+				// The WireGuard socket stays in the namespace of the
+				// process, so are probes.
+				rtt, err := probe.Ping(c.addr.IP, endpointProbeTimeout)
+				c.rtt, c.reachable = rtt, err == nil
+			}(&cands[i])
+		}
+		wg.Wait()
+	}
+
+	sort.SliceStable(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if cfg.Region != "" && (a.region == cfg.Region) != (b.region == cfg.Region) {
+			return a.region == cfg.Region
+		}
+		if cfg.Probe {
+			if a.reachable != b.reachable {
+				return a.reachable
+			}
+			if a.reachable && a.rtt != b.rtt {
+				return a.rtt < b.rtt
+			}
+		}
+		return a.priority < b.priority
+	})
+}
+
+func (c endpointCandidate) String() string {
+	s := c.addr.String()
+	if c.region != "" {
+		s += " (" + c.region + ")"
+	}
+	if c.reachable {
+		s += " rtt " + c.rtt.Round(time.Millisecond/10).String()
+	}
+	return s
+}
+
+// chooseEndpoint returns the preferred tunnel endpoint suggested by the
+// server, nil if there are no candidates.
+func chooseEndpoint(cfg Config, clCfg *wboxproto.Cfg, port int) *net.UDPAddr {
+	cands := endpointCandidates(clCfg, port)
+	if len(cands) == 0 {
+		return nil
+	}
+	rankEndpoints(cfg.Endpoints, cands)
+	log.Println("endpoint candidates:", cands)
+	return cands[0].addr
+}
+
+// runEndpoints periodically re-evaluates the tunnel endpoint choice and
+// switches to a better candidate.
+func runEndpoints(m linkmgr.Manager, cfg Config, clCfg *wboxproto.Cfg, events *wirebox.EventBus, stop <-chan struct{}) {
+	if tunNS != nil {
+		m = tunNS
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: endpoints:", err)
+		return
+	}
+
+	t := time.NewTicker(cfg.Endpoints.Interval.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if probesPaused(cfg) {
+			continue
+		}
+		if err := reevaluateEndpoint(cfg, tunLink, clCfg, events); err != nil {
+			log.Println("error: endpoints:", err)
+		}
+	}
+}
+
+func reevaluateEndpoint(cfg Config, tunLink linkmgr.Link, clCfg *wboxproto.Cfg, events *wirebox.EventBus) error {
+	dev, err := tunLink.WGConfig()
+	if err != nil {
+		return err
+	}
+	var current *net.UDPAddr
+	for _, p := range dev.Peers {
+		if p.PublicKey == cfg.ServerKey.Bytes {
+			current = p.Endpoint
+		}
+	}
+	if current == nil {
+		// Removed by the on-demand worker while idle.
+		return nil
+	}
+
+	cands := endpointCandidates(clCfg, current.Port)
+	if len(cands) < 2 {
+		return nil
+	}
+	rankEndpoints(cfg.Endpoints, cands)
+	best := cands[0]
+	if best.addr.IP.Equal(current.IP) && best.addr.Port == current.Port {
+		return nil
+	}
+	for _, c := range cands {
+		if !c.addr.IP.Equal(current.IP) || c.addr.Port != current.Port {
+			continue
+		}
+		sameTier := cfg.Endpoints.Region == "" || (c.region == cfg.Endpoints.Region) == (best.region == cfg.Endpoints.Region)
+		if sameTier && c.reachable && best.reachable &&
+			float64(best.rtt) > float64(c.rtt)*(1-endpointSwitchGain) {
+			return nil
+		}
+	}
+
+	log.Printf("endpoints: switching from %v to %v", current, best)
+	err = tunLink.ConfigureWG(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:  cfg.ServerKey.Bytes,
+			UpdateOnly: true,
+			Endpoint:   best.addr,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	events.Emit(wirebox.EndpointChanged{
+		Link:     tunLink.Name(),
+		Endpoint: best.addr.String(),
+		Region:   best.region,
+	})
+	return nil
+}
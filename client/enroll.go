@@ -0,0 +1,224 @@
+package wboxclient
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/dnsdisc"
+	"github.com/foxcpp/wirebox/keys"
+)
+
+// overrideKeys are the configuration options that can be set using
+// environment variables (WIREBOX_SERVER_KEY) and the kernel command line
+// (wirebox.server-key=), so first boot of a VM image needs no config file.
+var overrideKeys = []string{
+	"if",
+	"private-key",
+	"private-key-file",
+	"private-key-backend",
+	"key-permissions",
+	"server-key",
+	"config-endpoint",
+	"config-timeout",
+	"config-addr-scheme",
+	"config-addr-salt",
+	"mode",
+	"bootstrap-url",
+	"bootstrap-token",
+	"bootstrap-ca",
+	"discovery-domain",
+	"discovery-dnssec",
+	"discovery-resolver",
+}
+
+// boolKeys are overrideKeys that are not strings in the configuration file.
+var boolKeys = map[string]bool{
+	"discovery-dnssec": true,
+}
+
+func envName(key string) string {
+	return "WIREBOX_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+func envOverrides() map[string]string {
+	res := make(map[string]string)
+	for _, key := range overrideKeys {
+		if val, ok := os.LookupEnv(envName(key)); ok {
+			res[key] = val
+		}
+	}
+	return res
+}
+
+func cmdlineOverrides(path string) (map[string]string, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(overrideKeys))
+	for _, key := range overrideKeys {
+		known[key] = true
+	}
+	res := make(map[string]string)
+	for _, field := range strings.Fields(string(blob)) {
+		if !strings.HasPrefix(field, "wirebox.") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(field, "wirebox."), "=", 2)
+		if len(parts) != 2 || !known[parts[0]] {
+			continue
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// applyOverrides sets options from overrides, values are parsed the same way
+// as in the configuration file.
+func applyOverrides(cfg *Config, overrides map[string]string) error {
+	var b strings.Builder
+	for key, val := range overrides {
+		if boolKeys[key] {
+			v, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			fmt.Fprintf(&b, "%s = %v\n", key, v)
+			continue
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, strconv.Quote(val))
+	}
+	if _, err := toml.Decode(b.String(), cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadPrivateKey reads the private key from cfg.PrivateKeyFile using the
+// configured backend, generating it on the first run.
+func loadPrivateKey(cfg *Config) error {
+	if cfg.PrivateKey.Encoded != "" || cfg.PrivateKeyFile == "" {
+		return nil
+	}
+
+	backend, err := keys.Open(cfg.PrivateKeyBackend, cfg.PrivateKeyFile, cfg.KeyPerms)
+	if err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	key, generated, err := keys.LoadOrGenerate(backend)
+	if err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+
+	cfg.PrivateKey = wirebox.PeerKey{Encoded: key.String(), Bytes: key}
+	if generated {
+		log.Println("generated private key, public key to authorize on the server:", key.PublicKey())
+	}
+	return nil
+}
+
+// discoveryOptions can be set by the TXT record.
+var discoveryOptions = []string{
+	"server-key",
+	"config-addr-scheme",
+	"config-addr-salt",
+	"bootstrap-url",
+}
+
+// discover fills options that are not set yet using DNS records under
+// cfg.DiscoveryDomain.
+func discover(cfg *Config) error {
+	res, err := dnsdisc.Lookup(cfg.DiscoveryDomain, cfg.DiscoveryDNSSEC, cfg.DiscoveryResolver)
+	if err != nil {
+		return err
+	}
+	log.Println("discovered configuration endpoint", res.Endpoint, "via", cfg.DiscoveryDomain)
+
+	// Only options that are not set in the configuration are used, same as
+	// for bootstrap.
+	set := map[string]bool{
+		"server-key":         cfg.ServerKey.Encoded != "",
+		"config-addr-scheme": cfg.AddrScheme != "",
+		"config-addr-salt":   cfg.AddrSalt != "",
+		"bootstrap-url":      cfg.BootstrapURL != "",
+	}
+	overrides := map[string]string{}
+	if cfg.ConfigEndpoint.IP == nil {
+		overrides["config-endpoint"] = res.Endpoint.String()
+	}
+	for _, key := range discoveryOptions {
+		if val, ok := res.Options[key]; ok && !set[key] {
+			overrides[key] = val
+		}
+	}
+	if err := applyOverrides(cfg, overrides); err != nil {
+		return fmt.Errorf("dnsdisc: malformed TXT record: %w", err)
+	}
+	return nil
+}
+
+// loadConfig reads the configuration file and applies overrides from the
+// kernel command line and the environment, in that order. The file is
+// optional if all required options are provided using overrides.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	md, err := cfgfile.DecodeFile(path, &cfg)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return Config{}, fmt.Errorf("config load: %w", err)
+		}
+		log.Println("WARNING: config load:", err)
+	}
+
+	cmdline, err := cmdlineOverrides("/proc/cmdline")
+	if err != nil {
+		return Config{}, fmt.Errorf("config load: %w", err)
+	}
+	if err := applyOverrides(&cfg, cmdline); err != nil {
+		return Config{}, fmt.Errorf("config load: kernel command line: %w", err)
+	}
+	if err := applyOverrides(&cfg, envOverrides()); err != nil {
+		return Config{}, fmt.Errorf("config load: environment: %w", err)
+	}
+
+	if keyFile := md.DefinedIn("private-key"); keyFile != "" {
+		if err := wirebox.CheckKeyPerms(keyFile, cfg.KeyPerms); err != nil {
+			return Config{}, fmt.Errorf("config load: %w", err)
+		}
+	}
+	if err := loadPrivateKey(&cfg); err != nil {
+		return Config{}, fmt.Errorf("config load: %w", err)
+	}
+	// Server is not known yet, find it using DNS and enroll if configured.
+	if cfg.ServerKey.Encoded == "" || cfg.ConfigEndpoint.IP == nil {
+		if cfg.DiscoveryDomain != "" {
+			if err := discover(&cfg); err != nil {
+				return Config{}, fmt.Errorf("config load: %w", err)
+			}
+		}
+		if cfg.BootstrapURL != "" {
+			if err := bootstrap(&cfg); err != nil {
+				return Config{}, fmt.Errorf("config load: %w", err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("config load: %w", err)
+	}
+	// PeerKey.String returns the encoded form, drop it so the private key
+	// cannot end up in the log.
+	cfg.PrivateKey.Encoded = ""
+	return cfg, nil
+}
@@ -0,0 +1,81 @@
+package wboxclient
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/foxcpp/wirebox"
+)
+
+// Exit codes of the client commands. Automation can use them to decide
+// whether to retry: unreachable servers are worth retrying, configuration and
+// permission errors are not.
+const (
+	ExitOK = 0
+	// Any failure not covered by other codes.
+	ExitFailure = 1
+	// Invalid configuration file or command line.
+	ExitConfig = 2
+	// Insufficient privileges, e.g. to create the interface.
+	ExitPermission = 3
+	// The server or the enrollment endpoint cannot be reached.
+	ExitUnreachable = 4
+	// The server refused to give the configuration (NACK).
+	ExitRefused = 5
+	// The configuration was received but the tunnel is only partially
+	// configured or does not pass the self-test.
+	ExitPartialApply = 6
+)
+
+// applyError marks failures that happen after some of the received
+// configuration is applied to the tunnel.
+type applyError struct {
+	err error
+}
+
+func (e applyError) Error() string {
+	return e.err.Error()
+}
+
+func (e applyError) Unwrap() error {
+	return e.err
+}
+
+// unreachableErrnos are errors of sockets talking to an unreachable host.
+var unreachableErrnos = []error{
+	syscall.ECONNREFUSED,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+	syscall.EHOSTDOWN,
+	syscall.ENETDOWN,
+}
+
+// exitCode returns the exit code for the configuration failure.
+func exitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return ExitPermission
+	}
+	var nack wirebox.ErrNackRefused
+	if errors.As(err, &nack) {
+		return ExitRefused
+	}
+	var applyErr applyError
+	if errors.As(err, &applyErr) || errors.Is(err, wirebox.ErrSelfTestFailed) {
+		return ExitPartialApply
+	}
+	for _, errno := range unreachableErrnos {
+		if errors.Is(err, errno) {
+			return ExitUnreachable
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ExitUnreachable
+	}
+	return ExitFailure
+}
@@ -0,0 +1,45 @@
+package wboxclient
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/foxcpp/wirebox"
+)
+
+// ipv6Enabled reports whether IPv6 is enabled for new interfaces in the
+// current network namespace.
+func ipv6Enabled() bool {
+	for _, conf := range []string{"all", "default"} {
+		// The file does not exist if IPv6 is disabled at boot
+		// (ipv6.disable=1).
+		val, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/" + conf + "/disable_ipv6")
+		if err != nil || strings.TrimSpace(string(val)) == "1" {
+			return false
+		}
+	}
+	return true
+}
+
+// configAddr returns the address of the configuration tunnel. The IPv4
+// link-local address is used if configured or if IPv6 is disabled.
+func (c Config) configAddr(pubKey wirebox.PeerKey) net.IP {
+	useIPv4 := c.ConfigFamily == "ipv4"
+	if c.ConfigFamily == "" || c.ConfigFamily == "auto" {
+		useIPv4 = !ipv6Enabled()
+	}
+	if useIPv4 {
+		return wirebox.ConfigAddr4(pubKey, []byte(c.AddrSalt))
+	}
+	return wirebox.ConfigAddr(pubKey, c.addrScheme(), []byte(c.AddrSalt))
+}
+
+// solictAddr returns the server address for the configuration tunnel
+// address.
+func solictAddr(configIP net.IP) net.IP {
+	if configIP.To4() != nil {
+		return wirebox.SolictIPv4
+	}
+	return wirebox.SolictIPv6
+}
@@ -0,0 +1,37 @@
+package wboxclient
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/wirebox"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func genkeyMain([]string) int {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	fmt.Println(key.String())
+	return 0
+}
+
+func pubkeyMain([]string) int {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Println("error: no private key on stdin")
+		return 1
+	}
+	key, err := wirebox.NewPeerKey(strings.TrimSpace(line))
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	fmt.Println(key.PublicFromPrivate().Encoded)
+	return 0
+}
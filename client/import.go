@@ -0,0 +1,158 @@
+package wboxclient
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxcpp/wirebox/wgquick"
+)
+
+// ImportWGQuick converts wg-quick configuration into the client
+// configuration written to clientOut and the server-side client entry written
+// to serverOut.
+//
+// The first peer is assumed to be the server. Settings that have no
+// equivalent are preserved as comments.
+func ImportWGQuick(wgCfg *wgquick.Config, ifName string, clientOut, serverOut io.Writer) error {
+	if len(wgCfg.Peers) == 0 {
+		return fmt.Errorf("import: no peers")
+	}
+	srv := wgCfg.Peers[0]
+	iface := wgCfg.Interface
+
+	endpoint, err := net.ResolveUDPAddr("udp", srv.Endpoint)
+	if err != nil {
+		return fmt.Errorf("import: server endpoint: %w", err)
+	}
+
+	fmt.Fprintf(clientOut, "# Imported from wg-quick configuration for %v.\n", ifName)
+	fmt.Fprintf(clientOut, "if = %q\n", ifName)
+	fmt.Fprintf(clientOut, "private-key = %q\n", iface.PrivateKey.String())
+	fmt.Fprintf(clientOut, "server-key = %q\n", srv.PublicKey.String())
+	if endpoint.String() != srv.Endpoint {
+		fmt.Fprintf(clientOut, "# Resolved from %v.\n", srv.Endpoint)
+	}
+	fmt.Fprintf(clientOut, "config-endpoint = %q\n", endpoint.String())
+
+	var unsupported []string
+	for _, dns := range iface.DNS {
+		unsupported = append(unsupported, "DNS = "+dns)
+	}
+	if iface.MTU != 0 {
+		unsupported = append(unsupported, fmt.Sprintf("MTU = %d", iface.MTU))
+	}
+	if iface.Table != "" {
+		unsupported = append(unsupported, "Table = "+iface.Table)
+	}
+	for _, cmd := range iface.PreUp {
+		unsupported = append(unsupported, "PreUp = "+cmd)
+	}
+	for _, cmd := range iface.PostUp {
+		unsupported = append(unsupported, "PostUp = "+cmd)
+	}
+	for _, cmd := range iface.PreDown {
+		unsupported = append(unsupported, "PreDown = "+cmd)
+	}
+	for _, cmd := range iface.PostDown {
+		unsupported = append(unsupported, "PostDown = "+cmd)
+	}
+	if srv.PresharedKey != nil {
+		unsupported = append(unsupported, "PresharedKey = (omitted)")
+	}
+	if srv.PersistentKeepalive != 0 {
+		unsupported = append(unsupported, fmt.Sprintf("PersistentKeepalive = %d", srv.PersistentKeepalive))
+	}
+	for _, p := range wgCfg.Peers[1:] {
+		unsupported = append(unsupported, "[Peer] PublicKey = "+p.PublicKey.String())
+	}
+	if len(unsupported) != 0 {
+		fmt.Fprintln(clientOut)
+		fmt.Fprintln(clientOut, "# The following settings have no wirebox equivalent and were not imported:")
+		for _, u := range unsupported {
+			fmt.Fprintln(clientOut, "#  ", u)
+		}
+	}
+
+	// Addresses and routes are assigned by the server, so they go into
+	// per-client overrides.
+	pubKey := iface.PrivateKey.PublicKey()
+	fmt.Fprintf(serverOut, "# Client imported from wg-quick configuration for %v.\n", ifName)
+	fmt.Fprintf(serverOut, "[clients.%q]\n", pubKey.String())
+	if len(iface.Addresses) != 0 {
+		addrs := make([]string, 0, len(iface.Addresses))
+		for _, a := range iface.Addresses {
+			addrs = append(addrs, fmt.Sprintf("%q", a.IP.String()))
+		}
+		fmt.Fprintf(serverOut, "addrs = [ %s ]\n", strings.Join(addrs, ", "))
+	}
+	if len(srv.AllowedIPs) != 0 {
+		routes := make([]string, 0, len(srv.AllowedIPs))
+		for _, n := range srv.AllowedIPs {
+			routes = append(routes, fmt.Sprintf("{ dest = %q }", n.String()))
+		}
+		fmt.Fprintf(serverOut, "client_routes = [ %s ]\n", strings.Join(routes, ", "))
+	}
+	return nil
+}
+
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("import-wg-quick", flag.ExitOnError)
+	clientPath := fs.String("o", "", "write client configuration to this file instead of stdout")
+	serverPath := fs.String("server-out", "", "write server-side client entry to this file instead of stderr")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wbox import-wg-quick [options] wg0.conf")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	defer f.Close()
+	wgCfg, err := wgquick.Parse(f)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	var clientOut, serverOut io.Writer = os.Stdout, os.Stderr
+	if *clientPath != "" {
+		out, err := os.OpenFile(*clientPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer out.Close()
+		clientOut = out
+	}
+	if *serverPath != "" {
+		out, err := os.OpenFile(*serverPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer out.Close()
+		serverOut = out
+	}
+
+	ifName := strings.TrimSuffix(filepath.Base(fs.Arg(0)), ".conf")
+	if err := ImportWGQuick(wgCfg, ifName, clientOut, serverOut); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
@@ -7,64 +7,349 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/approute"
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/cli"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/debugsrv"
+	"github.com/foxcpp/wirebox/errreport"
+	"github.com/foxcpp/wirebox/eventstream"
+	"github.com/foxcpp/wirebox/hostsfile"
+	"github.com/foxcpp/wirebox/keys"
 	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/logging"
+	"github.com/foxcpp/wirebox/networkd"
+	"github.com/foxcpp/wirebox/nm"
+	"github.com/foxcpp/wirebox/notify"
+	"github.com/foxcpp/wirebox/probe"
 	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/tracing"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func configureTunnel(m linkmgr.Manager, cfg Config) error {
+var (
+	reporter *errreport.Reporter
+
+	// Manager for the network namespace the tunnel is moved to, nil if the
+	// tunnel stays in the namespace of the process.
+	tunNS linkmgr.Manager
+
+	// Install routes even if the tunnel endpoint cannot be kept reachable
+	// outside of the tunnel.
+	forceRoutes bool
+)
+
+// ping sends the probe from the namespace of the tunnel.
+func ping(dst net.IP, timeout time.Duration) (rtt time.Duration, err error) {
+	err = linkmgr.InNetNS(tunNS, func() error {
+		rtt, err = probe.Ping(dst, timeout)
+		return err
+	})
+	return rtt, err
+}
+
+// ConfigureTunnel requests the configuration from the server and applies it
+// to the tunnel interface.
+//
+// Lifecycle events are delivered to the events bus, spans of configuration
+// steps are recorded by tracer. Both can be nil.
+func ConfigureTunnel(m linkmgr.Manager, cfg Config, events *wirebox.EventBus, tracer *tracing.Tracer) (err error) {
+	cfg = withReferral(cfg)
+	span := tracer.Start("configure-tunnel", nil)
+	span.SetAttr("link", cfg.If)
+	defer func() {
+		span.Finish(err)
+		if err != nil {
+			updateState(func(s *clientState) {
+				s.Phase = "failed"
+				if errors.Is(err, wirebox.ErrSelfTestFailed) {
+					s.Phase = "degraded"
+				}
+				s.LastError = err.Error()
+			})
+			events.Emit(wirebox.ConfigFailed{Link: cfg.If, Error: err.Error()})
+		}
+	}()
+
 	log.Println("configuring tunnel")
+	if tunNS != nil {
+		// Configuration is requested from the current namespace, bring the
+		// tunnel back if it was configured before.
+		if l, err := tunNS.GetLink(cfg.If); err == nil {
+			log.Println("moving link", l.Name(), "from the target namespace")
+			if err := linkmgr.MoveLink(tunNS, l.Index(), m); err != nil {
+				return fmt.Errorf("configure tun: %w", err)
+			}
+		}
+	}
+
 	pubKey := cfg.PrivateKey.PublicFromPrivate()
-	configIPv6 := wirebox.IPv6LLForClient(pubKey)
+	configIP := cfg.configAddr(pubKey)
 
-	tunLink, created, err := createConfigTun(m, cfg, configIPv6)
+	updateState(func(s *clientState) { s.Phase = "create-tun" })
+	createSpan := tracer.Start("create-config-tun", span)
+	tunLink, created, err := createConfigTun(m, cfg, configIP)
+	createSpan.SetAttr("created", created)
+	createSpan.Finish(err)
 	if err != nil {
 		return fmt.Errorf("configure tun: %w", err)
 	}
+	if created {
+		events.Emit(wirebox.LinkCreated{Link: tunLink.Name()})
+	}
 
-	clCfg, err := solictCfg(cfg, configIPv6, pubKey, tunLink)
+	updateState(func(s *clientState) {
+		s.Link = tunLink.Name()
+		s.Phase = "solict"
+	})
+	solictSpan := tracer.Start("solict-cfg", span)
+	clCfg, err := solictCfg(cfg, configIP, pubKey, tunLink, events, solictSpan)
+	solictSpan.Finish(err)
 	if err != nil {
 		if created {
-			if err := m.DelLink(tunLink.Index()); err != nil {
+			if err := delLink(m, cfg, tunLink, events); err != nil {
 				log.Println("error: failed to delete link:", err)
 			}
 		}
 		return fmt.Errorf("configure tun: %w", err)
 	}
+	events.Emit(wirebox.CfgReceived{Link: tunLink.Name(), Cfg: clCfg})
+	showMotd(tunLink.Name(), clCfg, events)
 
-	if err := setTunnelCfg(m, cfg, configIPv6, clCfg); err != nil {
+	updateState(func(s *clientState) { s.Phase = "apply" })
+	applySpan := tracer.Start("apply-cfg", span)
+	err = setTunnelCfg(m, cfg, configIP, clCfg, events)
+	applySpan.Finish(err)
+	if err != nil {
 		if created {
-			if err := m.DelLink(tunLink.Index()); err != nil {
+			if err := delLink(m, cfg, tunLink, events); err != nil {
 				log.Println("error: failed to delete link:", err)
+				return fmt.Errorf("configure tun: %w", applyError{err})
 			}
+			return fmt.Errorf("configure tun: %w", err)
 		}
-		return fmt.Errorf("configure tun: %w", err)
+		// The existing tunnel is left with the configuration applied only
+		// in part.
+		return fmt.Errorf("configure tun: %w", applyError{err})
+	}
+	events.Emit(wirebox.CfgApplied{Link: tunLink.Name(), Serial: clCfg.GetSerial()})
+
+	if cfg.SelfTest.Enable {
+		testSpan := tracer.Start("self-test", span)
+		err = selfTest(cfg, clCfg)
+		testSpan.Finish(err)
+		if err != nil {
+			events.Emit(wirebox.TunnelDegraded{Link: tunLink.Name(), Reason: err.Error()})
+			return fmt.Errorf("configure tun: %w", err)
+		}
+	}
+
+	updateState(func(s *clientState) {
+		s.Phase = "up"
+		s.ConfiguredAt = time.Now()
+		s.cfg = clCfg
+	})
+	if created {
+		events.Emit(wirebox.TunnelUp{Link: tunLink.Name()})
+	} else {
+		events.Emit(wirebox.Reconfigured{Link: tunLink.Name()})
+	}
+	return nil
+}
+
+func delLink(m linkmgr.Manager, cfg Config, l linkmgr.Link, events *wirebox.EventBus) error {
+	if cfg.Mode == "networkd" {
+		// networkd would recreate the link if only the interface is
+		// deleted.
+		if err := networkd.Remove(cfg.NetworkdDir, l.Name()); err != nil {
+			return err
+		}
+		if err := networkd.Reload(l.Name(), false); err != nil {
+			return err
+		}
+	}
+	if err := restoreSysctl(m, l.Name()); err != nil {
+		log.Println("error:", err)
+	}
+	removeEndpointRoutes(m, cfg, l)
+	if err := m.DelLink(l.Index()); err != nil {
+		return err
+	}
+	events.Emit(wirebox.Teardown{Link: l.Name()})
+	return nil
+}
+
+// newEventBus creates the event bus with integrations enabled in the
+// configuration subscribed. The returned function should be called once
+// no more events will be emitted.
+func newEventBus(cfg Config) (*wirebox.EventBus, func()) {
+	events := &wirebox.EventBus{}
+	closeFn := func() {}
+	if cfg.Notify.Enabled() {
+		n := notify.New(cfg.Notify)
+		closeFn = func() { n.Close() }
+		events.Subscribe(n)
+	}
+	if cfg.NetworkManager.Enable {
+		events.Subscribe(nm.New(cfg.NetworkManager))
+	}
+	if cfg.Hosts.Enable {
+		events.Subscribe(hostsfile.New(cfg.Hosts))
+	}
+	return events, closeFn
+}
+
+// routeWorkers is the maximum number of concurrent route installation
+// requests, only used for large route sets.
+const routeWorkers = 8
+
+// networkdTimeout is how long to wait for systemd-networkd to create the
+// interface.
+const networkdTimeout = 10 * time.Second
+
+// tunnelSpec is the desired state of the tunnel interface.
+type tunnelSpec struct {
+	WG     wgtypes.Config
+	Addrs  []linkmgr.Address
+	Routes []linkmgr.Route
+}
+
+func setTunnelCfg(m linkmgr.Manager, cfg Config, configIP net.IP, clCfg *wboxproto.Cfg, events *wirebox.EventBus) error {
+	spec := buildTunnelSpec(cfg, configIP, clCfg)
+
+	if cfg.Mode == "networkd" {
+		tunLink, _, err := applyNetworkd(m, cfg, spec)
+		if err != nil {
+			return fmt.Errorf("set config: %w", err)
+		}
+		log.Println("tunnel reconfigured via systemd-networkd")
+		if err := applySysctl(m, cfg, tunLink.Name()); err != nil {
+			return fmt.Errorf("set config: %w", err)
+		}
+		for _, route := range spec.Routes {
+			events.Emit(wirebox.RouteInstalled{Link: tunLink.Name(), Route: route})
+		}
+		return nil
+	}
+
+	if tunNS != nil {
+		l, err := m.GetLink(cfg.If)
+		if err != nil {
+			return fmt.Errorf("set config: %w", err)
+		}
+		// WireGuard socket stays in the current namespace, only the
+		// interface is visible in the target one.
+		if err := linkmgr.MoveLink(m, l.Index(), tunNS); err != nil {
+			return fmt.Errorf("set config: %w", err)
+		}
+		log.Println("moved link", l.Name(), "to the target namespace")
+		m = tunNS
+	}
+
+	tunLink, _, err := wirebox.CreateWG(m, cfg.If, spec.WG, spec.Addrs, wirebox.CreateOpts{})
+	if err != nil {
+		return fmt.Errorf("set config: %w", err)
+	}
+	stateLock.Lock()
+	prev := state.cfg
+	stateLock.Unlock()
+	if prev != nil {
+		if err := pruneTunnel(tunLink, cfg, prev, spec); err != nil {
+			return fmt.Errorf("set config: %w", err)
+		}
+	}
+	log.Println("tunnel reconfigured")
+	if err := applySysctl(m, cfg, tunLink.Name()); err != nil {
+		return fmt.Errorf("set config: %w", err)
+	}
+
+	if tunNS == nil {
+		// WireGuard packets stay in the current namespace otherwise and
+		// are not affected by tunnel routes.
+		if err := protectEndpoints(m, cfg, tunLink, spec); err != nil {
+			return fmt.Errorf("set config: %w", err)
+		}
+	}
+
+	var firstErr error
+	for i, err := range linkmgr.AddRoutes(tunLink, spec.Routes, routeWorkers) {
+		if err != nil {
+			if errors.Is(err, syscall.EEXIST) {
+				continue
+			}
+			err = fmt.Errorf("set config: route add %v: %w", i, err)
+			if firstErr == nil {
+				firstErr = err
+			} else {
+				log.Println("error:", err)
+			}
+			continue
+		}
+		events.Emit(wirebox.RouteInstalled{Link: tunLink.Name(), Route: spec.Routes[i]})
+	}
+	if firstErr != nil {
+		return firstErr
 	}
+	log.Println("installed routes")
+
 	return nil
 }
 
-func setTunnelCfg(m linkmgr.Manager, cfg Config, configIPv6 net.IP, clCfg *wboxproto.Cfg) error {
+// pruneTunnel removes addresses and routes of the previous configuration
+// that are not in spec, so the tunnel is updated without recreating it.
+// Link-scoped addresses, including the config tunnel one, are kept.
+func pruneTunnel(l linkmgr.Link, cfg Config, prev *wboxproto.Cfg, spec tunnelSpec) error {
+	current, err := l.Addrs()
+	if err != nil {
+		return err
+	}
+	wantAddrs := make(map[string]bool, len(spec.Addrs))
+	for _, a := range spec.Addrs {
+		wantAddrs[a.IPNet.String()] = true
+	}
+	for _, a := range current {
+		if a.Scope != linkmgr.ScopeGlobal || wantAddrs[a.IPNet.String()] {
+			continue
+		}
+		log.Println("removing addr", a.IPNet.String())
+		if err := l.DelAddr(a); err != nil {
+			return fmt.Errorf("del addr %v: %w", a.IPNet.String(), err)
+		}
+	}
+
+	wantRoutes := make(map[string]bool, len(spec.Routes))
+	for _, r := range spec.Routes {
+		wantRoutes[r.Dest.String()+" table "+strconv.Itoa(r.Table)] = true
+	}
+	for _, r := range tunnelRoutes(cfg, prev) {
+		if wantRoutes[r.Dest.String()+" table "+strconv.Itoa(r.Table)] {
+			continue
+		}
+		log.Println("removing route", r.Dest.String())
+		if err := l.DelRoute(r); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("del route %v: %w", r.Dest.String(), err)
+		}
+	}
+	return nil
+}
+
+func buildTunnelSpec(cfg Config, configIP net.IP, clCfg *wboxproto.Cfg) tunnelSpec {
 	wgCfg := wgtypes.Config{
 		PrivateKey: &cfg.PrivateKey.Bytes,
 		Peers: []wgtypes.PeerConfig{
 			{
 				PublicKey:         cfg.ServerKey.Bytes,
 				ReplaceAllowedIPs: true,
-				AllowedIPs: []net.IPNet{
-					{
-						IP:   wirebox.SolictIPv6,
-						Mask: net.CIDRMask(128, 128),
-					},
-					{
-						IP:   configIPv6,
-						Mask: net.CIDRMask(128, 128),
-					},
-				},
+				AllowedIPs:        []net.IPNet{hostNet(solictAddr(configIP)), hostNet(configIP)},
 			},
 		},
 	}
@@ -79,6 +364,9 @@ func setTunnelCfg(m linkmgr.Manager, cfg Config, configIPv6 net.IP, clCfg *wboxp
 	if endp := clCfg.GetTun6Endpoint(); endp != nil {
 		srvEndpoint.IP = clCfg.GetTun6Endpoint().AsIP()
 	}
+	if endp := chooseEndpoint(cfg, clCfg, srvEndpoint.Port); endp != nil {
+		srvEndpoint.UDPAddr = *endp
+	}
 	// TODO: Test IPv6 connectivity and do not attempt to use it?
 	log.Printf("tunnel via %v:%v", srvEndpoint.IP, srvEndpoint.Port)
 	wgCfg.Peers[0].Endpoint = &srvEndpoint.UDPAddr
@@ -90,8 +378,14 @@ func setTunnelCfg(m linkmgr.Manager, cfg Config, configIPv6 net.IP, clCfg *wboxp
 		log.Println("server6:", clCfg.GetServer6().AsIP())
 	}
 
-	addrs := make([]linkmgr.Address, 0, len(clCfg.Net6)+len(clCfg.Net4))
-	for _, net6 := range clCfg.Net6 {
+	net6s, routes6 := clCfg.Net6, clCfg.Routes6
+	if (len(net6s) != 0 || len(routes6) != 0) && !ipv6Enabled() {
+		log.Println("WARNING: IPv6 is disabled, IPv6 addresses and routes are not used")
+		net6s, routes6 = nil, nil
+	}
+
+	addrs := make([]linkmgr.Address, 0, len(net6s)+len(clCfg.Net4))
+	for _, net6 := range net6s {
 		wgCfg.Peers[0].AllowedIPs = append(wgCfg.Peers[0].AllowedIPs, net.IPNet{
 			IP:   net6.GetAddr().AsIP(),
 			Mask: net.CIDRMask(int(net6.GetPrefixLen()), 128),
@@ -147,7 +441,7 @@ func setTunnelCfg(m linkmgr.Manager, cfg Config, configIPv6 net.IP, clCfg *wboxp
 			Mask: net.CIDRMask(int(route4.GetDest().GetPrefixLen()), 32),
 		})
 	}
-	for _, route6 := range clCfg.Routes6 {
+	for _, route6 := range routes6 {
 		log.Printf("using route %v/%v src %v",
 			route6.Dest.Addr.AsIP(), route6.Dest.PrefixLen,
 			route6.Src.AsIP())
@@ -157,88 +451,99 @@ func setTunnelCfg(m linkmgr.Manager, cfg Config, configIPv6 net.IP, clCfg *wboxp
 		})
 	}
 
-	tunLink, _, err := wirebox.CreateWG(m, cfg.If, wgCfg, addrs)
-	if err != nil {
-		return fmt.Errorf("set config: %w", err)
+	// Packets of applications excluded from the tunnel are marked, the mark
+	// on WireGuard packets makes them bypass the tunnel too.
+	if cfg.AppRouting.Mode == approute.ModeExclude {
+		mark := int(cfg.AppRouting.FwMark)
+		wgCfg.FirewallMark = &mark
 	}
-	log.Println("tunnel reconfigured")
 
-	for i, route4 := range clCfg.Routes4 {
+	return tunnelSpec{WG: wgCfg, Addrs: addrs, Routes: tunnelRoutes(cfg, clCfg)}
+}
+
+// tunnelRoutes returns routes pushed by the server.
+func tunnelRoutes(cfg Config, clCfg *wboxproto.Cfg) []linkmgr.Route {
+	routes := make([]linkmgr.Route, 0, len(clCfg.Routes4)+len(clCfg.Routes6))
+	for _, route4 := range clCfg.Routes4 {
 		route := linkmgr.Route{
 			Dest: net.IPNet{
 				IP:   wboxproto.IPv4(route4.GetDest().Addr),
 				Mask: net.CIDRMask(int(route4.GetDest().GetPrefixLen()), 32),
 			},
+			Table: cfg.routeTable(),
 		}
 		if route4.GetSrc() != 0 {
 			route.Src = wboxproto.IPv4(route4.GetSrc())
 		}
-		if err := tunLink.AddRoute(route); err != nil {
-			if errors.Is(err, syscall.EEXIST) {
-				continue
-			}
-			return fmt.Errorf("set config: route4 add %v: %w", i, err)
-		}
+		routes = append(routes, route)
 	}
-	log.Println("installed IPv4 routes")
-
-	for i, route6 := range clCfg.Routes6 {
+	routes6 := clCfg.Routes6
+	if !ipv6Enabled() {
+		routes6 = nil
+	}
+	for _, route6 := range routes6 {
 		route := linkmgr.Route{
 			Dest: net.IPNet{
 				IP:   route6.GetDest().Addr.AsIP(),
 				Mask: net.CIDRMask(int(route6.GetDest().GetPrefixLen()), 128),
 			},
+			Table: cfg.routeTable(),
 		}
 		if route6.GetSrc() != nil {
 			route.Src = route6.GetSrc().AsIP()
 		}
-		if err := tunLink.AddRoute(route); err != nil {
-			if errors.Is(err, syscall.EEXIST) {
-				continue
-			}
-			return fmt.Errorf("set config: route6 add %v: %w", i, err)
-		}
+		routes = append(routes, route)
 	}
-	log.Println("installed IPv6 routes")
-
-	return nil
+	return withoutDefault(cfg, routes)
 }
 
-func createConfigTun(m linkmgr.Manager, cfg Config, configIPv6 net.IP) (linkmgr.Link, bool, error) {
-	tunLink, created, err := wirebox.CreateWG(m, cfg.If, wgtypes.Config{
-		PrivateKey: &cfg.PrivateKey.Bytes,
-		Peers: []wgtypes.PeerConfig{
-			{
-				PublicKey: cfg.ServerKey.Bytes,
-				Endpoint:  &cfg.ConfigEndpoint.UDPAddr,
-				// ReplaceAllowedIPs: false
-				//  We want to permit regular traffic while we attempt tunnel
-				//  reconfiguration.
-				AllowedIPs: []net.IPNet{
-					{
-						IP:   wirebox.SolictIPv6,
-						Mask: net.CIDRMask(128, 128),
-					},
-					{
-						IP:   configIPv6,
-						Mask: net.CIDRMask(128, 128),
-					},
+func configTunSpec(cfg Config, configIP net.IP) tunnelSpec {
+	return tunnelSpec{
+		WG: wgtypes.Config{
+			PrivateKey: &cfg.PrivateKey.Bytes,
+			Peers: []wgtypes.PeerConfig{
+				{
+					PublicKey: cfg.ServerKey.Bytes,
+					Endpoint:  &cfg.ConfigEndpoint.UDPAddr,
+					// ReplaceAllowedIPs: false
+					//  We want to permit regular traffic while we attempt tunnel
+					//  reconfiguration.
+					AllowedIPs: []net.IPNet{hostNet(solictAddr(configIP)), hostNet(configIP)},
 				},
 			},
 		},
-	}, []linkmgr.Address{
-		{
-			IPNet: net.IPNet{
-				IP:   configIPv6,
-				Mask: net.CIDRMask(128, 128),
-			},
-			Peer: &net.IPNet{
-				IP:   wirebox.SolictIPv6,
-				Mask: net.CIDRMask(128, 128),
+		Addrs: []linkmgr.Address{
+			{
+				IPNet: hostNet(configIP),
+				Peer: &net.IPNet{
+					IP:   solictAddr(configIP),
+					Mask: hostNet(solictAddr(configIP)).Mask,
+				},
+				Scope: linkmgr.ScopeLink,
 			},
-			Scope: linkmgr.ScopeLink,
 		},
-	})
+	}
+}
+
+func createConfigTun(m linkmgr.Manager, cfg Config, configIP net.IP) (linkmgr.Link, bool, error) {
+	spec := configTunSpec(cfg, configIP)
+
+	var (
+		tunLink linkmgr.Link
+		created bool
+		err     error
+	)
+	if cfg.Mode == "networkd" {
+		// Keep the complete configuration if the interface already exists,
+		// the config tunnel addresses are part of it anyway.
+		if existing, err := m.GetLink(cfg.If); err == nil {
+			log.Println("using existing link", existing.Name())
+			return existing, false, nil
+		}
+		tunLink, created, err = applyNetworkd(m, cfg, spec)
+	} else {
+		tunLink, created, err = wirebox.CreateWG(m, cfg.If, spec.WG, spec.Addrs, wirebox.CreateOpts{})
+	}
 	if err != nil {
 		return nil, false, fmt.Errorf("create config tun: %w", err)
 	}
@@ -250,11 +555,56 @@ func createConfigTun(m linkmgr.Manager, cfg Config, configIPv6 net.IP) (linkmgr.
 	return tunLink, created, nil
 }
 
-func solictCfg(cfg Config, configIPv6 net.IP, pubKey wirebox.PeerKey, tunLink linkmgr.Link) (*wboxproto.Cfg, error) {
+// applyNetworkd writes the interface configuration for systemd-networkd and
+// waits for the interface to be created.
+func applyNetworkd(m linkmgr.Manager, cfg Config, spec tunnelSpec) (linkmgr.Link, bool, error) {
+	created, err := networkd.Write(cfg.NetworkdDir, cfg.If, spec.WG, spec.Addrs, spec.Routes)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := networkd.Reload(cfg.If, !created); err != nil {
+		return nil, false, err
+	}
+
+	deadline := time.Now().Add(networkdTimeout)
+	for {
+		l, err := m.GetLink(cfg.If)
+		if err == nil {
+			return l, created, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, fmt.Errorf("networkd did not create the link: %w", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func solictMsg(cfg Config, pubKey wirebox.PeerKey, span *tracing.Span, endpoints []*wboxproto.Endpoint, relayPeers [][]byte) ([]byte, error) {
+	msg := &wboxproto.CfgSolict{
+		PeerPubkey:   pubKey.Bytes[:],
+		AddrScheme:   cfg.addrScheme(),
+		TraceParent:  span.TraceParent(),
+		Mesh:         cfg.Mesh.Enable,
+		Endpoints:    endpoints,
+		Version:      wirebox.Version,
+		Capabilities: wirebox.Capabilities,
+		RelayPeers:   relayPeers,
+	}
+	for _, n := range cfg.Subnets {
+		if n.IP.To4() != nil {
+			msg.Subnets4 = append(msg.Subnets4, wboxproto.NewNet4(n.IPNet))
+		} else {
+			msg.Subnets6 = append(msg.Subnets6, wboxproto.NewNet6(n.IPNet))
+		}
+	}
+	return wboxproto.Pack(msg)
+}
+
+func solictCfg(cfg Config, configIP net.IP, pubKey wirebox.PeerKey, tunLink linkmgr.Link, events *wirebox.EventBus, span *tracing.Span) (*wboxproto.Cfg, error) {
 	c, err := tunLink.DialUDP(net.UDPAddr{
-		IP: configIPv6,
+		IP: configIP,
 	}, net.UDPAddr{
-		IP:   wirebox.SolictIPv6,
+		IP:   solictAddr(configIP),
 		Port: wirebox.SolictPort,
 	})
 	if err != nil {
@@ -262,11 +612,14 @@ func solictCfg(cfg Config, configIPv6 net.IP, pubKey wirebox.PeerKey, tunLink li
 	}
 	defer c.Close()
 
-	for {
+	for attempt := 1; ; attempt++ {
 		log.Println("solicting configuration")
-		solictMsg, err := wboxproto.Pack(&wboxproto.CfgSolict{
-			PeerPubkey: pubKey.Bytes[:],
+		span.SetAttr("attempts", attempt)
+		updateState(func(s *clientState) {
+			s.SolictAttempts = attempt
+			s.NextRetry = time.Now().Add(cfg.ConfigTimeout.Duration)
 		})
+		solictMsg, err := solictMsg(cfg, pubKey, span, nil, nil)
 		if err != nil {
 			return nil, fmt.Errorf("solict cfg: %w", err)
 		}
@@ -286,12 +639,13 @@ func solictCfg(cfg Config, configIPv6 net.IP, pubKey wirebox.PeerKey, tunLink li
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Temporary() {
 				log.Println("timed out waiting for response, retrying")
+				updateState(func(s *clientState) { s.LastError = "timed out" })
 				continue
 			}
 			return nil, fmt.Errorf("solict cfg: %w", err)
 		}
 
-		if !sender.IP.Equal(wirebox.SolictIPv6) {
+		if !sender.IP.Equal(solictAddr(configIP)) {
 			return nil, fmt.Errorf("solict cfg: unexpected response sender %v", sender.IP)
 		}
 		if sender.Port != wirebox.SolictPort {
@@ -301,49 +655,458 @@ func solictCfg(cfg Config, configIPv6 net.IP, pubKey wirebox.PeerKey, tunLink li
 		resp, err := wboxproto.Unpack(buffer[:readBytes])
 		if err != nil {
 			log.Println("malformed response, retrying:", err)
+			updateState(func(s *clientState) { s.LastError = err.Error() })
 			continue
 		}
 		switch resp := resp.(type) {
 		case *wboxproto.Cfg:
+			events.Emit(wirebox.HandshakeEstablished{Link: tunLink.Name(), Peer: cfg.ServerKey})
 			return resp, nil
 		case *wboxproto.Nack:
-			return nil, fmt.Errorf("solict cfg: server refused to give us config: %v", resp.GetDescription())
+			if resp.GetCode() == wboxproto.Nack_REDIRECT {
+				if err := followReferral(cfg, tunLink, resp); err != nil {
+					return nil, fmt.Errorf("solict cfg: %w", err)
+				}
+			}
+			return nil, fmt.Errorf("solict cfg: %w", wirebox.NackError(resp))
 		default:
 			return nil, fmt.Errorf("solict cfg: unexpected reply: %T", resp)
 		}
 	}
 }
 
+// maxBackoff is the longest delay between configuration attempts with -wait.
+const maxBackoff = time.Minute
+
+// configure runs ConfigureTunnel following redirects, repeating it if the
+// self-test fails.
+func configure(m linkmgr.Manager, cfg Config, events *wirebox.EventBus, tracer *tracing.Tracer) error {
+	err := configureRedirected(m, cfg, events, tracer)
+	for i := 0; i < cfg.SelfTest.Recover && errors.Is(err, wirebox.ErrSelfTestFailed); i++ {
+		log.Println("self-test failed, reconfiguring tunnel:", err)
+		err = configureRedirected(m, cfg, events, tracer)
+	}
+	return err
+}
+
 func Main() int {
-	// Read configuration and command line flags.
-	cfgPath := flag.String("config", "wbox.toml", "path to configuration file")
-	flag.Parse()
-	cfgF, err := os.Open(*cfgPath)
+	return Run("wbox", os.Args[1:])
+}
+
+// Run executes the client command line, prog is the program name for usage
+// messages. The tunnel is configured if no command is specified. extra
+// commands are added to the command list.
+func Run(prog string, args []string, extra ...cli.Command) int {
+	fs := flag.NewFlagSet(prog, flag.ExitOnError)
+	cfgPath := fs.String("config", "wbox.toml", "path to configuration file")
+	debugAddr := fs.String("debug-addr", "", "serve pprof and state dump on this loopback address (e.g. 127.0.0.1:6060)")
+	wait := fs.Bool("wait", false, "retry until the configuration is received (e.g. the key is not authorized yet)")
+	netns := fs.String("netns", "", "move the tunnel to the network namespace of this process ID or path (e.g. /run/netns/NAME)")
+	daemon := fs.Bool("daemon", false, "keep running, request the configuration periodically and restore the tunnel if it breaks")
+	eventsOut := fs.String("events", "", "write events as newline-delimited JSON to stdout (-) or to clients of the socket (unix:PATH)")
+	fs.BoolVar(&forceRoutes, "force", false, "install routes even if they would send packets to the tunnel endpoint into the tunnel")
+	fs.BoolVar(&cfgfile.Lax, "lax", false, "ignore unknown options in the configuration file")
+
+	cmds := []cli.Command{
+		{Name: "up", Help: "configure the tunnel (default)", Run: func(args []string) int {
+			// Options are also accepted after the command name.
+			if err := fs.Parse(args); err != nil {
+				return ExitConfig
+			}
+			if fs.NArg() != 0 {
+				fs.Usage()
+				return ExitConfig
+			}
+			return up(*cfgPath, *debugAddr, *wait, *daemon, *netns, *eventsOut)
+		}},
+		{Name: "down", Help: "remove the tunnel", Run: func(args []string) int {
+			return downMain(*cfgPath, *netns, args)
+		}},
+		{Name: "status", Help: "show the tunnel state", Run: func(args []string) int {
+			return statusMain(*cfgPath, args)
+		}},
+		{Name: "logs", Help: "print log messages of the running client", Run: func(args []string) int {
+			return logsMain(*cfgPath, args)
+		}},
+		{Name: "top", Help: "show live dashboard of the running client", Run: func(args []string) int {
+			return topMain(*cfgPath, args)
+		}},
+		{Name: "reconfigure", Help: "make the running client request the configuration again", Run: func(args []string) int {
+			return reconfigureMain(*cfgPath, args)
+		}},
+		{Name: "bench", Help: "measure throughput and latency through the tunnel", Run: func(args []string) int {
+			return benchMain(*cfgPath, args)
+		}},
+		{Name: "ping", Help: "send echo requests to a peer through the tunnel", Run: func(args []string) int {
+			return pingMain(*cfgPath, args)
+		}},
+		{Name: "trace", Help: "show the path to a peer through the tunnel", Run: func(args []string) int {
+			return traceMain(*cfgPath, args)
+		}},
+		{Name: "doctor", Help: "check the configuration and the system", Run: func(args []string) int {
+			return doctorMain(*cfgPath, args)
+		}},
+		{Name: "config", Help: "print the configuration schema or validate configuration files", Run: func(args []string) int {
+			return configMain(*cfgPath, args)
+		}},
+		{Name: "genkey", Help: "print a new private key", Run: genkeyMain},
+		{Name: "pubkey", Help: "print the public key for the private key read from stdin", Run: pubkeyMain},
+		{Name: "import-wg-quick", Help: "convert wg-quick configuration", Run: importMain},
+		{Name: "prototest", Help: "check the protocol implementation against test vectors", Run: prototestMain},
+	}
+	cmds = append(cmds, extra...)
+	cli.Usage(fs, prog, cmds)
+	return cli.Dispatch(fs, cmds, "up", args)
+}
+
+func doctorMain(cfgPath string, _ []string) int {
+	r := Doctor(cfgPath)
+	r.Print(os.Stdout)
+	if r.Failed() {
+		return 1
+	}
+	return 0
+}
+
+func up(cfgPath, debugAddr string, wait, daemon bool, netns, eventsOut string) int {
+	cfg, err := loadConfig(cfgPath)
 	if err != nil {
 		log.Println("error:", err)
-		return 2
+		// The configuration is not available, SENTRY_DSN is still used
+		// if set.
+		if r, _ := errreport.New(errreport.Config{}, "wbox", wirebox.Version); r != nil {
+			r.Error(err)
+		}
+		// Enrollment can fail because of the network too.
+		if code := exitCode(err); code != ExitFailure {
+			return code
+		}
+		return ExitConfig
+	}
+	defer keys.Zero(&cfg.PrivateKey.Bytes)
+	if err := keys.LockMemory(&cfg.PrivateKey.Bytes); err != nil {
+		log.Println("WARNING:", err)
 	}
-	var cfg Config
-	if _, err := toml.DecodeReader(cfgF, &cfg); err != nil {
+
+	reporter, err = errreport.New(cfg.ErrorReporting, "wbox", wirebox.Version)
+	if err != nil {
 		log.Println("error: config load:", err)
-		return 2
+		return ExitConfig
+	}
+	defer reporter.Recover()
+	if netns != "" && cfg.Mode == "networkd" {
+		log.Println("error: -netns cannot be used with networkd mode")
+		return ExitConfig
 	}
 	if cfg.ConfigTimeout.Duration == 0 {
 		cfg.ConfigTimeout.Duration = 5 * time.Second
 	}
+	if cfg.NetworkdDir == "" {
+		cfg.NetworkdDir = networkd.DefaultDir
+	}
+	if cfg.SelfTest.Timeout.Duration == 0 {
+		cfg.SelfTest.Timeout.Duration = 2 * time.Second
+	}
+	if cfg.SelfTest.Attempts == 0 {
+		cfg.SelfTest.Attempts = 3
+	}
+	if cfg.Monitor.Interval.Duration == 0 {
+		cfg.Monitor.Interval.Duration = 10 * time.Second
+	}
+	if cfg.Monitor.Timeout.Duration == 0 {
+		cfg.Monitor.Timeout.Duration = 2 * time.Second
+	}
+	if cfg.Monitor.Window == 0 {
+		cfg.Monitor.Window = 30
+	}
+	if cfg.Mesh.Interval.Duration == 0 {
+		cfg.Mesh.Interval.Duration = 30 * time.Second
+	}
+	if cfg.Mesh.Timeout.Duration == 0 {
+		cfg.Mesh.Timeout.Duration = 15 * time.Second
+	}
+	if cfg.Mesh.RetryAfter.Duration == 0 {
+		cfg.Mesh.RetryAfter.Duration = 5 * time.Minute
+	}
+	if cfg.SplitDNS.Listen == "" {
+		cfg.SplitDNS.Listen = "127.0.0.1:53"
+	}
+	if cfg.SplitDNS.MinTTL.Duration == 0 {
+		cfg.SplitDNS.MinTTL.Duration = 5 * time.Minute
+	}
+	if cfg.CaptivePortal.URL == "" {
+		cfg.CaptivePortal.URL = "http://connectivitycheck.gstatic.com/generate_204"
+	}
+	if cfg.CaptivePortal.Interval.Duration == 0 {
+		cfg.CaptivePortal.Interval.Duration = 30 * time.Second
+	}
+	if cfg.Revalidate.Timeout.Duration == 0 {
+		cfg.Revalidate.Timeout.Duration = 15 * time.Second
+	}
+	if cfg.Metered.Interval.Duration == 0 {
+		cfg.Metered.Interval.Duration = 30 * time.Second
+	}
+	// On Windows WireGuard runs in this process and the tunnel is removed
+	// once it exits, so keep running (on-demand mode does so too).
+	if daemon || (runtime.GOOS == "windows" && !cfg.OnDemand.Enable) {
+		cfg.Daemon.Enable = true
+	}
+	if cfg.Daemon.Interval.Duration == 0 {
+		cfg.Daemon.Interval.Duration = 5 * time.Minute
+	}
+	if cfg.Daemon.CheckInterval.Duration == 0 {
+		cfg.Daemon.CheckInterval.Duration = time.Minute
+	}
+	if cfg.Daemon.Retry.Duration == 0 {
+		cfg.Daemon.Retry.Duration = 30 * time.Second
+	}
+	if cfg.OnDemand.IdleTimeout.Duration == 0 {
+		cfg.OnDemand.IdleTimeout.Duration = 10 * time.Minute
+	}
+	if cfg.AppRouting.FwMark == 0 {
+		cfg.AppRouting.FwMark = approute.DefaultFwMark
+	}
+	if cfg.AppRouting.Table == 0 {
+		cfg.AppRouting.Table = approute.DefaultTable
+	}
+
+	logSink, err := logging.Setup(cfg.Log, "wbox")
+	if err != nil {
+		log.Println("error: config load:", err)
+		reporter.Error(err)
+		return ExitConfig
+	}
+	defer logSink.Close()
+
+	auditSink, err := audit.Setup(cfg.Audit, "wbox")
+	if err != nil {
+		log.Println("error: config load:", err)
+		reporter.Error(err)
+		return ExitConfig
+	}
+	defer auditSink.Close()
+
+	tracer, err := tracing.New(cfg.Tracing, "wbox")
+	if err != nil {
+		log.Println("error: config load:", err)
+		reporter.Error(err)
+		return ExitConfig
+	}
+	defer tracer.Close()
 
 	m, err := linkmgr.NewManager()
 	if err != nil {
 		log.Println("error: link mngr init:", err)
-		return 1
+		return exitCode(err)
+	}
+	if netns != "" {
+		tunNS, err = linkmgr.NewManagerNetNS(linkmgr.NetNSPath(netns))
+		if err != nil {
+			log.Println("error: link mngr init:", err)
+			return exitCode(err)
+		}
+		defer tunNS.Close()
 	}
 
 	log.Println("client public key:", cfg.PrivateKey.PublicFromPrivate())
 
-	if err := configureTunnel(m, cfg); err != nil {
+	if debugAddr != "" {
+		dbgSrv, err := debugsrv.Listen(debugAddr, debugState, metrics)
+		if err != nil {
+			log.Println("error:", err)
+			return ExitFailure
+		}
+		defer dbgSrv.Close()
+	}
+
+	events, closeEvents := newEventBus(cfg)
+	defer closeEvents()
+	if eventsOut != "" {
+		stream, err := eventstream.Open(eventsOut)
+		if err != nil {
+			log.Println("error:", err)
+			return ExitConfig
+		}
+		defer stream.Close()
+		events.Subscribe(stream)
+	}
+
+	ctl := newController(m)
+	events.Subscribe(ctl.events)
+	ctlSrv, err := ctlsock.Listen(cfg.controlSocket(), ctl.handlers(), map[string]ctlsock.StreamHandler{
+		"logs":  logging.Logs.Stream,
+		"ping":  ctl.ping,
+		"trace": ctl.trace,
+	})
+	if err != nil {
+		log.Println("WARNING:", err)
+	} else {
+		defer ctlSrv.Close()
+		// Another client with the same control socket would fail to listen
+		// on it, the leftovers are not in use.
+		collectOrphans(m, cfg)
+	}
+	// Before ctlSrv.Close so pending requests are not waiting for the main
+	// loop.
+	defer close(ctl.done)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	// The daemon should not give up if the server is not reachable yet.
+	wait = wait || cfg.Daemon.Enable
+	err = configure(m, cfg, events, tracer)
+	// Waiting does not help if the client itself should be upgraded.
+	for backoff := 5 * time.Second; wait && err != nil && !errors.Is(err, wirebox.ErrUpgradeRequired); {
 		log.Println("error:", err)
-		return 1
+		log.Println("retrying in", backoff)
+		select {
+		case s := <-sig:
+			log.Println("received signal:", s)
+			return exitCode(err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		err = configure(m, cfg, events, tracer)
+	}
+	if err != nil {
+		log.Println("error:", err)
+		return exitCode(err)
 	}
 
-	return 0
+	if !cfg.hasWorkers() {
+		return ExitOK
+	}
+
+	stopWorkers, done := startWorkers(m, cfg, events, ctl.reconfigure)
+	for {
+		select {
+		case s := <-sig:
+			log.Println("received signal:", s)
+			stopWorkers()
+			return ExitOK
+		case <-done:
+			return ExitOK
+		case res := <-ctl.reconfigure:
+			log.Println("reconfiguration requested")
+			// Workers use the received configuration, restart them so they
+			// pick up the new one.
+			stopWorkers()
+			err := configure(m, cfg, events, tracer)
+			if err != nil {
+				log.Println("error:", err)
+			}
+			res <- err
+			stopWorkers, done = startWorkers(m, cfg, events, ctl.reconfigure)
+		}
+	}
+}
+
+// hasWorkers reports whether any feature running in the background is
+// enabled, the client exits after configuring the tunnel otherwise.
+func (c Config) hasWorkers() bool {
+	return c.Monitor.Enable || c.Mesh.Enable || c.SplitDNS.Enable ||
+		c.AppRouting.Enabled() || c.CaptivePortal.Enable || c.Revalidate.Enable ||
+		c.Metered.Enable || c.OnDemand.Enable || c.Endpoints.Interval.Duration != 0 ||
+		c.Daemon.Enable
+}
+
+// startWorkers starts background goroutines for enabled features (monitor,
+// mesh, split DNS, app routing, captive portal detection, revalidation,
+// metered uplink policy, on-demand activation, daemon mode) using the last
+// received configuration. done is closed once all of them stop.
+//
+// Workers request the reconfiguration via reconfigure and should not wait
+// for the result, they are stopped before it is done.
+func startWorkers(m linkmgr.Manager, cfg Config, events *wirebox.EventBus, reconfigure chan<- chan error) (stopWorkers func(), done <-chan struct{}) {
+	// Workers talk to the server the client was redirected to.
+	cfg = withReferral(cfg)
+	stateLock.Lock()
+	clCfg := state.cfg
+	stateLock.Unlock()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if cfg.Monitor.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMonitor(cfg, cfg.If, clCfg, events, stop)
+		}()
+	}
+	if cfg.Mesh.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMesh(m, cfg, clCfg, events, stop)
+		}()
+	}
+	if cfg.SplitDNS.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSplitDNS(m, cfg, events, stop)
+		}()
+	}
+	if cfg.AppRouting.Enabled() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runAppRouting(m, cfg, stop)
+		}()
+	}
+	if cfg.CaptivePortal.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCaptivePortal(m, cfg, clCfg, events, stop)
+		}()
+	}
+	if cfg.Metered.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMetered(m, cfg, clCfg, events, stop)
+		}()
+	}
+	if cfg.OnDemand.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runOnDemand(m, cfg, events, stop)
+		}()
+	}
+	if cfg.Endpoints.Interval.Duration != 0 && len(clCfg.GetTunEndpoints()) > 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runEndpoints(m, cfg, clCfg, events, stop)
+		}()
+	}
+	if cfg.Revalidate.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runRevalidate(m, cfg, clCfg, reconfigure, stop)
+		}()
+	}
+	if cfg.Daemon.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runDaemon(m, cfg, clCfg, reconfigure, stop)
+		}()
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	return func() {
+		close(stop)
+		<-doneCh
+	}, doneCh
 }
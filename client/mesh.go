@@ -0,0 +1,468 @@
+package wboxclient
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/stun"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type MeshConfig struct {
+	Enable bool `toml:"enable"`
+
+	// How often the list of peers is requested from the server.
+	Interval Duration `toml:"interval"`
+	// How long to wait for the handshake with each endpoint of the peer
+	// before trying the relay or falling back to the path via server.
+	Timeout Duration `toml:"timeout"`
+	// Delay before the direct tunnel is attempted again for peers reached via
+	// the relay or the server. It doubles after each failed attempt up to
+	// maxHubBackoff.
+	RetryAfter Duration `toml:"retry-after"`
+
+	// STUN servers (host:port) used to discover the public address reported
+	// to other peers in addition to the one observed by the server.
+	STUNServers []string `toml:"stun-servers"`
+}
+
+const (
+	// meshCheck is how often handshakes of direct peers are checked.
+	meshCheck = time.Second
+
+	// meshKeepalive keeps NAT mappings for direct tunnels open.
+	meshKeepalive = 10 * time.Second
+
+	// stunTimeout limits public address discovery using each STUN server.
+	stunTimeout = 3 * time.Second
+
+	// meshStale is the age of the last handshake after which the direct
+	// tunnel is considered broken. WireGuard does a handshake at least every
+	// 2 minutes while keepalives are sent.
+	meshStale = 3 * time.Minute
+
+	// maxHubBackoff limits the delay between attempts to move peers reached
+	// via the relay or the server to direct tunnels.
+	maxHubBackoff = time.Hour
+)
+
+type meshPeer struct {
+	Key       string    `json:"key"`
+	State     string    `json:"state"` // "punching", "direct", "relayed" or "hub"
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last-error,omitempty"`
+	RetryAt   time.Time `json:"retry-at,omitempty"`
+
+	key       wgtypes.Key
+	endpoints []*net.UDPAddr
+	// Relay for the peer on the server, nil if none was opened, and whether
+	// the current attempt or tunnel uses it.
+	relay    *net.UDPAddr
+	viaRelay bool
+	attempt  int
+	allowed  []net.IPNet
+
+	// Endpoints tried during the last attempt and the current delay before
+	// the next one.
+	tried   string
+	backoff time.Duration
+}
+
+func endpointsKey(endpoints []*net.UDPAddr) string {
+	parts := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		parts = append(parts, e.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func meshPeers(clCfg *wboxproto.Cfg) map[wgtypes.Key]*meshPeer {
+	res := make(map[wgtypes.Key]*meshPeer, len(clCfg.GetPeers()))
+	for _, p := range clCfg.GetPeers() {
+		key, err := wgtypes.NewKey(p.GetPubkey())
+		if err != nil {
+			log.Println("WARNING: mesh: malformed peer key:", err)
+			continue
+		}
+		mp := &meshPeer{Key: key.String(), key: key}
+		for _, e := range p.GetEndpoints() {
+			mp.endpoints = append(mp.endpoints, e.AsUDPAddr())
+		}
+		for _, a := range p.GetAddrs4() {
+			mp.allowed = append(mp.allowed, net.IPNet{IP: wboxproto.IPv4(a).To4(), Mask: net.CIDRMask(32, 32)})
+		}
+		for _, a := range p.GetAddrs6() {
+			mp.allowed = append(mp.allowed, net.IPNet{IP: a.AsIP(), Mask: net.CIDRMask(128, 128)})
+		}
+		if p.GetRelay() != nil {
+			mp.relay = p.GetRelay().AsUDPAddr()
+		}
+		if (len(mp.endpoints) == 0 && mp.relay == nil) || len(mp.allowed) == 0 {
+			continue
+		}
+		res[key] = mp
+	}
+	return res
+}
+
+// requestPeers solicts the configuration over the running tunnel once to
+// refresh the list of mesh peers and asks for relays to relayPeers.
+func requestPeers(cfg Config, tunLink linkmgr.Link, endpoints []*wboxproto.Endpoint, relayPeers [][]byte) (*wboxproto.Cfg, error) {
+	pubKey := cfg.PrivateKey.PublicFromPrivate()
+	configIP := cfg.configAddr(pubKey)
+
+	c, err := tunLink.DialUDP(net.UDPAddr{
+		IP: configIP,
+	}, net.UDPAddr{
+		IP:   solictAddr(configIP),
+		Port: wirebox.SolictPort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	msg, err := solictMsg(cfg, pubKey, nil, endpoints, relayPeers)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Now().Add(cfg.ConfigTimeout.Duration)); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 1420)
+	readBytes, err := c.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := wboxproto.Unpack(buffer[:readBytes])
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *wboxproto.Cfg:
+		return resp, nil
+	case *wboxproto.Nack:
+		return nil, wirebox.NackError(resp)
+	default:
+		return nil, fmt.Errorf("unexpected reply: %T", resp)
+	}
+}
+
+// localEndpoints discovers the public address using STUN. The query is sent
+// from a different socket than the one used by WireGuard, so the candidate
+// only works if NAT preserves the source port or it is forwarded.
+func localEndpoints(cfg Config, tunLink linkmgr.Link) []*wboxproto.Endpoint {
+	if len(cfg.Mesh.STUNServers) == 0 {
+		return nil
+	}
+	dev, err := tunLink.WGConfig()
+	if err != nil {
+		log.Println("error: mesh:", err)
+		return nil
+	}
+	addr, err := stun.Discover(cfg.Mesh.STUNServers, stunTimeout)
+	if err != nil {
+		log.Println("WARNING: mesh: public address discovery failed:", err)
+		return nil
+	}
+	addr.Port = dev.ListenPort
+	return []*wboxproto.Endpoint{wboxproto.NewEndpoint(addr)}
+}
+
+// candidate returns the endpoint for the current attempt, the relay goes
+// after all endpoints of the peer.
+func (p *meshPeer) candidate() (endpoint *net.UDPAddr, relayed bool) {
+	if p.attempt < len(p.endpoints) {
+		return p.endpoints[p.attempt], false
+	}
+	return p.relay, true
+}
+
+// meshState holds tunnels to other clients. Peers are added to the interface
+// without allowed IPs first so traffic keeps going via the server until the
+// handshake succeeds. Endpoints of the peer are tried first, then the relay
+// on the server that forwards WireGuard packets without decrypting them. The
+// server routes traffic between clients as in the hub topology, so peers
+// without either tunnel fall back to it.
+type meshState struct {
+	cfg    Config
+	link   linkmgr.Link
+	events *wirebox.EventBus
+	peers  map[wgtypes.Key]*meshPeer
+}
+
+func (ms *meshState) configure(peer wgtypes.PeerConfig) error {
+	return ms.link.ConfigureWG(wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}})
+}
+
+func (ms *meshState) punch(p *meshPeer) {
+	endpoint, relayed := p.candidate()
+	keepalive := meshPeerKeepalive(ms.cfg)
+	err := ms.configure(wgtypes.PeerConfig{
+		PublicKey:                   p.key,
+		Endpoint:                    endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+	})
+	if err != nil {
+		ms.fail(p, err.Error())
+		return
+	}
+	if relayed {
+		log.Println("mesh: probing", p.Key, "via relay", endpoint)
+	} else {
+		log.Println("mesh: probing", p.Key, "via", endpoint)
+	}
+	p.State = "punching"
+	p.Endpoint = endpoint.String()
+	p.Since = time.Now()
+	p.viaRelay = relayed
+}
+
+// retryLater schedules the next attempt of the direct tunnel.
+func (ms *meshState) retryLater(p *meshPeer) {
+	p.backoff *= 2
+	if p.backoff < ms.cfg.Mesh.RetryAfter.Duration {
+		p.backoff = ms.cfg.Mesh.RetryAfter.Duration
+	}
+	if p.backoff > maxHubBackoff {
+		p.backoff = maxHubBackoff
+	}
+	p.RetryAt = time.Now().Add(p.backoff)
+}
+
+func (ms *meshState) fail(p *meshPeer, reason string) {
+	if err := ms.configure(wgtypes.PeerConfig{PublicKey: p.key, Remove: true}); err != nil {
+		log.Println("error: mesh:", err)
+	}
+	wasUp := p.State == "direct" || p.State == "relayed"
+
+	log.Println("mesh: no tunnel to", p.Key+", using the path via server:", reason)
+	ms.retryLater(p)
+	p.State = "hub"
+	p.Since = time.Now()
+	p.LastError = reason
+	p.viaRelay = false
+
+	if wasUp {
+		ms.events.Emit(wirebox.PeerPathChanged{Link: ms.link.Name(), Peer: p.Key, Reason: reason})
+	}
+}
+
+// relayPeers returns keys of peers the relay is requested for: ones reached
+// via the server and ones using the relay, so it is kept open.
+func (ms *meshState) relayPeers() [][]byte {
+	var res [][]byte
+	for _, p := range ms.peers {
+		if p.State == "hub" || p.viaRelay {
+			key := p.key
+			res = append(res, key[:])
+		}
+	}
+	return res
+}
+
+// update merges the list of peers received from the server, punchAt is the
+// time probing of new peers should start.
+func (ms *meshState) update(peers map[wgtypes.Key]*meshPeer, punchAt time.Time) {
+	for key, p := range ms.peers {
+		if _, ok := peers[key]; ok {
+			continue
+		}
+		if p.State != "hub" {
+			if err := ms.configure(wgtypes.PeerConfig{PublicKey: key, Remove: true}); err != nil {
+				log.Println("error: mesh:", err)
+				continue
+			}
+			log.Println("mesh: removed peer", p.Key)
+		}
+		delete(ms.peers, key)
+	}
+
+	var start []*meshPeer
+	for key, p := range peers {
+		old, ok := ms.peers[key]
+		switch {
+		case !ok:
+		case (old.State == "hub" || old.State == "relayed") && !time.Now().Before(old.RetryAt),
+			old.State == "hub" && old.tried != endpointsKey(p.endpoints):
+			// Retry once the backoff expires or immediately if the peer
+			// moved, e.g. to a network without symmetric NAT.
+			p.backoff = old.backoff
+		case old.State == "hub" && old.relay == nil && p.relay != nil:
+			// The relay was opened on request of either side, endpoints
+			// of the peer were already tried.
+			p.backoff = old.backoff
+			p.attempt = len(p.endpoints)
+		default:
+			// Keep the state, the endpoint can change if the peer roams but
+			// WireGuard follows it once the tunnel is established.
+			old.endpoints = p.endpoints
+			old.allowed = p.allowed
+			old.relay = p.relay
+			continue
+		}
+		ms.peers[key] = p
+		start = append(start, p)
+	}
+	if len(start) == 0 {
+		return
+	}
+
+	// The other side receives the same punch time if it polls within the
+	// same slot, otherwise keepalives sent by both sides eventually open
+	// the mappings anyway.
+	if d := time.Until(punchAt); d > 0 && d < ms.cfg.Mesh.Interval.Duration {
+		time.Sleep(d)
+	}
+	for _, p := range start {
+		p.tried = endpointsKey(p.endpoints)
+		ms.punch(p)
+	}
+}
+
+// check promotes peers with completed handshake to direct or relayed tunnels
+// and falls back to the server for peers that did not respond.
+func (ms *meshState) check() {
+	dev, err := ms.link.WGConfig()
+	if err != nil {
+		log.Println("error: mesh:", err)
+		return
+	}
+	lastHandshake := make(map[wgtypes.Key]time.Time, len(dev.Peers))
+	for _, p := range dev.Peers {
+		lastHandshake[p.PublicKey] = p.LastHandshakeTime
+	}
+
+	for _, p := range ms.peers {
+		switch p.State {
+		case "punching":
+			if lastHandshake[p.key].After(p.Since) {
+				err := ms.configure(wgtypes.PeerConfig{
+					PublicKey:         p.key,
+					UpdateOnly:        true,
+					ReplaceAllowedIPs: true,
+					AllowedIPs:        p.allowed,
+				})
+				if err != nil {
+					ms.fail(p, err.Error())
+					continue
+				}
+				if p.viaRelay {
+					log.Println("mesh: relayed tunnel to", p.Key, "via", p.Endpoint)
+					p.State = "relayed"
+					// Keep trying to move it to the direct tunnel.
+					ms.retryLater(p)
+				} else {
+					log.Println("mesh: direct tunnel to", p.Key, "via", p.Endpoint)
+					p.State = "direct"
+					p.RetryAt = time.Time{}
+					p.backoff = 0
+				}
+				p.Since = time.Now()
+				p.LastError = ""
+				ms.events.Emit(wirebox.PeerPathChanged{Link: ms.link.Name(), Peer: p.Key, Direct: !p.viaRelay, Relayed: p.viaRelay, Endpoint: p.Endpoint})
+				continue
+			}
+			timeout := ms.cfg.Mesh.Timeout.Duration
+			if p.viaRelay {
+				// The peer starts using the relay after its next poll.
+				timeout += ms.cfg.Mesh.Interval.Duration
+			}
+			if time.Since(p.Since) < timeout {
+				continue
+			}
+			p.attempt++
+			if p.attempt < len(p.endpoints) || (p.attempt == len(p.endpoints) && p.relay != nil) {
+				ms.punch(p)
+				continue
+			}
+			ms.fail(p, "handshake timed out")
+		case "direct", "relayed":
+			if time.Since(lastHandshake[p.key]) > meshStale {
+				ms.fail(p, "handshake is stale")
+			}
+		}
+	}
+}
+
+func (ms *meshState) removeAll() {
+	for key, p := range ms.peers {
+		if p.State == "hub" {
+			continue
+		}
+		if err := ms.configure(wgtypes.PeerConfig{PublicKey: key, Remove: true}); err != nil {
+			log.Println("error: mesh:", err)
+		}
+	}
+}
+
+func (ms *meshState) snapshot() []meshPeer {
+	res := make([]meshPeer, 0, len(ms.peers))
+	for _, p := range ms.peers {
+		res = append(res, *p)
+	}
+	return res
+}
+
+// runMesh maintains direct and relayed tunnels to other clients until stop is
+// closed. The peers are removed on stop so traffic goes via the server again.
+func runMesh(m linkmgr.Manager, cfg Config, initial *wboxproto.Cfg, events *wirebox.EventBus, stop <-chan struct{}) {
+	if tunNS != nil {
+		m = tunNS
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: mesh:", err)
+		return
+	}
+
+	ms := &meshState{cfg: cfg, link: tunLink, events: events, peers: map[wgtypes.Key]*meshPeer{}}
+	defer ms.removeAll()
+
+	apply := func(clCfg *wboxproto.Cfg) {
+		punchAt := time.Unix(0, int64(clCfg.GetPunchAt())*int64(time.Millisecond))
+		ms.update(meshPeers(clCfg), punchAt)
+		updateState(func(s *clientState) { s.Mesh = ms.snapshot() })
+	}
+	apply(initial)
+
+	poll := time.NewTicker(cfg.Mesh.Interval.Duration)
+	defer poll.Stop()
+	check := time.NewTicker(meshCheck)
+	defer check.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-poll.C:
+			if probesPaused(cfg) {
+				continue
+			}
+			clCfg, err := requestPeers(cfg, tunLink, localEndpoints(cfg, tunLink), ms.relayPeers())
+			if err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					log.Println("error: mesh: request peers:", err)
+				}
+				continue
+			}
+			apply(clCfg)
+		case <-check.C:
+			ms.check()
+			updateState(func(s *clientState) { s.Mesh = ms.snapshot() })
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package wboxclient
+
+import (
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/approute"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/metered"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type MeteredConfig struct {
+	Enable bool `toml:"enable"`
+
+	// Interfaces always considered metered, in addition to detected ones.
+	Interfaces []string `toml:"interfaces"`
+	// How often the uplink is checked.
+	Interval Duration `toml:"interval"`
+
+	// Policy while the uplink is metered: default routes (0.0.0.0/0, ::/0)
+	// are removed from the tunnel, direct peers use the longer keepalive
+	// interval, the monitor and mesh peer updates are paused.
+	DisableFullTunnel bool     `toml:"disable-full-tunnel"`
+	Keepalive         Duration `toml:"keepalive"`
+	PauseProbes       bool     `toml:"pause-probes"`
+}
+
+func isMetered() bool {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return state.Metered
+}
+
+// probesPaused reports whether non-essential probing should be skipped.
+func probesPaused(cfg Config) bool {
+	return cfg.Metered.PauseProbes && isMetered()
+}
+
+// meshPeerKeepalive returns the keepalive interval for direct peers.
+func meshPeerKeepalive(cfg Config) time.Duration {
+	if cfg.Metered.Keepalive.Duration != 0 && isMetered() {
+		return cfg.Metered.Keepalive.Duration
+	}
+	return meshKeepalive
+}
+
+func isDefaultRoute(r linkmgr.Route) bool {
+	ones, _ := r.Dest.Mask.Size()
+	return ones == 0
+}
+
+// withoutDefault removes default routes from routes if the full tunnel is
+// disabled on the metered uplink.
+func withoutDefault(cfg Config, routes []linkmgr.Route) []linkmgr.Route {
+	if !cfg.Metered.DisableFullTunnel || !isMetered() {
+		return routes
+	}
+	res := routes[:0]
+	for _, r := range routes {
+		if !isDefaultRoute(r) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+type meteredState struct {
+	cfg    Config
+	link   linkmgr.Link
+	clCfg  *wboxproto.Cfg
+	events *wirebox.EventBus
+}
+
+// uplink returns the interface used to reach the server, empty string if
+// the server endpoint is not set (e.g. while the on-demand tunnel is idle).
+func (ms *meteredState) uplink() (string, error) {
+	peer, err := serverPeer(ms.link, ms.cfg)
+	if err != nil {
+		return "", err
+	}
+	if peer.Endpoint == nil {
+		return "", nil
+	}
+	var mark uint32
+	if ms.cfg.AppRouting.Mode == approute.ModeExclude {
+		// The WireGuard socket uses the mark to bypass the tunnel.
+		mark = ms.cfg.AppRouting.FwMark
+	}
+	return metered.Uplink(peer.Endpoint.IP, mark)
+}
+
+func (ms *meteredState) detect(uplink string) (bool, error) {
+	for _, iface := range ms.cfg.Metered.Interfaces {
+		if iface == uplink {
+			return true, nil
+		}
+	}
+	return metered.Detect(uplink)
+}
+
+// defaultRoutes returns default routes of the tunnel that are currently
+// expected to be installed.
+func (ms *meteredState) defaultRoutes() []linkmgr.Route {
+	var res []linkmgr.Route
+	for _, r := range tunnelRoutes(ms.cfg, ms.clCfg) {
+		if isDefaultRoute(r) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// updateKeepalive sets the keepalive interval of direct peers.
+func (ms *meteredState) updateKeepalive() {
+	dev, err := ms.link.WGConfig()
+	if err != nil {
+		log.Println("error: metered:", err)
+		return
+	}
+	keepalive := meshPeerKeepalive(ms.cfg)
+	var peers []wgtypes.PeerConfig
+	for _, p := range dev.Peers {
+		if p.PublicKey == ms.cfg.ServerKey.Bytes || p.PersistentKeepaliveInterval == 0 {
+			continue
+		}
+		peers = append(peers, wgtypes.PeerConfig{
+			PublicKey:                   p.PublicKey,
+			UpdateOnly:                  true,
+			PersistentKeepaliveInterval: &keepalive,
+		})
+	}
+	if len(peers) == 0 {
+		return
+	}
+	if err := ms.link.ConfigureWG(wgtypes.Config{Peers: peers}); err != nil {
+		log.Println("error: metered:", err)
+	}
+}
+
+// set applies the policy for the uplink.
+func (ms *meteredState) set(nowMetered bool, uplink string) {
+	stateLock.Lock()
+	paused := state.Phase == "captive-portal"
+	stateLock.Unlock()
+
+	// Default routes are collected while the full tunnel is enabled.
+	var defaults []linkmgr.Route
+	if nowMetered {
+		defaults = ms.defaultRoutes()
+	}
+	updateState(func(s *clientState) { s.Metered = nowMetered })
+	if !nowMetered {
+		defaults = ms.defaultRoutes()
+	}
+
+	if nowMetered {
+		log.Println("metered: uplink", uplink, "is metered")
+	} else {
+		log.Println("metered: uplink", uplink, "is not metered")
+	}
+
+	// Captive portal detection restores routes when the pause ends.
+	if ms.cfg.Metered.DisableFullTunnel && !paused {
+		for _, r := range defaults {
+			var err error
+			if nowMetered {
+				err = ms.link.DelRoute(r)
+				if errors.Is(err, syscall.ESRCH) {
+					err = nil
+				}
+			} else {
+				err = ms.link.AddRoute(r)
+				if errors.Is(err, syscall.EEXIST) {
+					err = nil
+				}
+			}
+			if err != nil {
+				log.Printf("error: metered: route %v: %v", r.Dest, err)
+			}
+		}
+	}
+	if ms.cfg.Metered.Keepalive.Duration != 0 {
+		ms.updateKeepalive()
+	}
+	ms.events.Emit(wirebox.MeteredChanged{Link: ms.link.Name(), Uplink: uplink, Metered: nowMetered})
+}
+
+// check detects whether the uplink is metered and applies the policy if it
+// changed.
+func (ms *meteredState) check() {
+	uplink, err := ms.uplink()
+	if err != nil {
+		log.Println("error: metered:", err)
+		return
+	}
+	if uplink == "" || (uplink == ms.cfg.If && tunNS == nil) {
+		// No endpoint or the server is routed via the tunnel, the uplink is
+		// unknown.
+		return
+	}
+	nowMetered, err := ms.detect(uplink)
+	if err != nil {
+		log.Println("error: metered:", err)
+		return
+	}
+
+	stateLock.Lock()
+	changed := state.Metered != nowMetered
+	stateLock.Unlock()
+	if changed {
+		ms.set(nowMetered, uplink)
+	}
+}
+
+// runMetered checks the uplink until stop is closed and applies the policy
+// for metered connections.
+func runMetered(m linkmgr.Manager, cfg Config, clCfg *wboxproto.Cfg, events *wirebox.EventBus, stop <-chan struct{}) {
+	if tunNS != nil {
+		m = tunNS
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: metered:", err)
+		return
+	}
+
+	ms := &meteredState{cfg: cfg, link: tunLink, clCfg: clCfg, events: events}
+	ms.check()
+
+	t := time.NewTicker(cfg.Metered.Interval.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			ms.check()
+		}
+	}
+}
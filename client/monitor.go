@@ -0,0 +1,137 @@
+package wboxclient
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/debugsrv"
+	"github.com/foxcpp/wirebox/probe"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+type MonitorConfig struct {
+	Enable bool `toml:"enable"`
+
+	// Addresses to probe. In-tunnel server addresses are used if empty.
+	Targets []IPAddr `toml:"targets"`
+
+	Interval Duration `toml:"interval"`
+	Timeout  Duration `toml:"timeout"`
+	// Number of last probes used to calculate loss and average RTT.
+	Window int `toml:"window"`
+
+	// The tunnel is considered degraded if the average RTT or loss (in
+	// percents) for any target exceeds these values.
+	MaxRTT  Duration `toml:"max-rtt"`
+	MaxLoss float64  `toml:"max-loss"`
+}
+
+func monitorTargets(cfg Config, clCfg *wboxproto.Cfg) []net.IP {
+	if len(cfg.Monitor.Targets) != 0 {
+		targets := make([]net.IP, 0, len(cfg.Monitor.Targets))
+		for _, t := range cfg.Monitor.Targets {
+			targets = append(targets, t.IP)
+		}
+		return targets
+	}
+	var targets []net.IP
+	if clCfg.GetServer4() != 0 && len(clCfg.Net4) != 0 {
+		targets = append(targets, wboxproto.IPv4(clCfg.GetServer4()))
+	}
+	if clCfg.GetServer6() != nil && len(clCfg.Net6) != 0 {
+		targets = append(targets, clCfg.GetServer6().AsIP())
+	}
+	return targets
+}
+
+// runMonitor probes the tunnel until stop is closed, marking it degraded if
+// thresholds are exceeded.
+func runMonitor(cfg Config, link string, clCfg *wboxproto.Cfg, events *wirebox.EventBus, stop <-chan struct{}) {
+	targets := monitorTargets(cfg, clCfg)
+	if len(targets) == 0 {
+		log.Println("WARNING: monitor: nothing to probe")
+		return
+	}
+
+	mon := probe.NewMonitor(probe.MonitorConfig{
+		Interval: cfg.Monitor.Interval.Duration,
+		Timeout:  cfg.Monitor.Timeout.Duration,
+		Window:   cfg.Monitor.Window,
+		MaxRTT:   cfg.Monitor.MaxRTT.Duration,
+		MaxLoss:  cfg.Monitor.MaxLoss / 100,
+	}, targets)
+	mon.Ping = ping
+	mon.Paused = func() bool { return probesPaused(cfg) }
+
+	degraded := false
+	mon.OnUpdate = func(stats []probe.TargetStats) {
+		var reasons []string
+		for _, s := range stats {
+			if s.Degraded != "" {
+				reasons = append(reasons, s.Target+": "+s.Degraded)
+			}
+		}
+
+		updateState(func(s *clientState) {
+			s.Monitor = stats
+			if len(reasons) != 0 {
+				s.Phase = "degraded"
+			} else {
+				s.Phase = "up"
+			}
+		})
+
+		switch {
+		case len(reasons) != 0 && !degraded:
+			reason := strings.Join(reasons, ", ")
+			log.Println("WARNING: tunnel degraded:", reason)
+			events.Emit(wirebox.TunnelDegraded{Link: link, Reason: reason})
+		case len(reasons) == 0 && degraded:
+			log.Println("tunnel recovered")
+			events.Emit(wirebox.TunnelUp{Link: link})
+		}
+		degraded = len(reasons) != 0
+	}
+
+	log.Println("monitoring tunnel via", targets)
+	mon.Run(stop)
+}
+
+func metrics() []debugsrv.Metric {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	degraded := 0.0
+	if state.Phase == "degraded" {
+		degraded = 1
+	}
+	res := []debugsrv.Metric{
+		{
+			Name:  "wirebox_tunnel_degraded",
+			Help:  "Whether the tunnel is considered degraded.",
+			Value: degraded,
+		},
+	}
+	for _, s := range state.Monitor {
+		res = append(res, debugsrv.Metric{
+			Name:   "wirebox_probe_rtt_seconds",
+			Help:   "Average in-tunnel round-trip time.",
+			Labels: map[string]string{"target": s.Target},
+			Value:  s.AvgRTT.Seconds(),
+		})
+	}
+	for _, s := range state.Monitor {
+		res = append(res, debugsrv.Metric{
+			Name:   "wirebox_probe_loss_ratio",
+			Help:   "Ratio of lost probes.",
+			Labels: map[string]string{"target": s.Target},
+			Value:  s.Loss,
+		})
+	}
+	if state.Bench != nil {
+		res = append(res, benchMetrics(state.Bench)...)
+	}
+	return res
+}
@@ -0,0 +1,25 @@
+package wboxclient
+
+import (
+	"log"
+
+	"github.com/foxcpp/wirebox"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+// showMotd logs the message from the server operator and passes it to
+// notification hooks. The same message is shown once, not on each
+// reconfiguration.
+func showMotd(link string, clCfg *wboxproto.Cfg, events *wirebox.EventBus) {
+	motd := clCfg.GetMotd()
+	changed := false
+	updateState(func(s *clientState) {
+		changed = s.Motd != motd
+		s.Motd = motd
+	})
+	if !changed || motd == "" {
+		return
+	}
+	log.Println("message from the server:", motd)
+	events.Emit(wirebox.ServerMessage{Link: link, Message: motd})
+}
@@ -0,0 +1,219 @@
+package wboxclient
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/ondemand"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type OnDemandConfig struct {
+	Enable bool `toml:"enable"`
+
+	// The session is stopped if no traffic passes the tunnel for this long.
+	IdleTimeout Duration `toml:"idle-timeout"`
+}
+
+// onDemandCheck is how often the interface is watched for packets while the
+// tunnel is active, so the busy tunnel does not wake the client up for each
+// packet.
+const onDemandCheck = 10 * time.Second
+
+type onDemandState struct {
+	cfg    Config
+	link   linkmgr.Link
+	events *wirebox.EventBus
+
+	// Endpoint of the server, removed while the tunnel is idle.
+	endpoint *net.UDPAddr
+	idle     bool
+}
+
+// replacePeer removes the server peer, dropping its session, and adds it
+// again with endpoint. Without endpoint, packets sent to the peer are
+// queued and no handshakes are attempted.
+func (od *onDemandState) replacePeer(endpoint *net.UDPAddr) error {
+	peer, err := serverPeer(od.link, od.cfg)
+	if err != nil {
+		return err
+	}
+	pc := wgtypes.PeerConfig{
+		PublicKey:         peer.PublicKey,
+		Endpoint:          endpoint,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        peer.AllowedIPs,
+	}
+	if peer.PresharedKey != (wgtypes.Key{}) {
+		pc.PresharedKey = &peer.PresharedKey
+	}
+	if peer.PersistentKeepaliveInterval != 0 {
+		pc.PersistentKeepaliveInterval = &peer.PersistentKeepaliveInterval
+	}
+	if err := od.link.ConfigureWG(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: peer.PublicKey, Remove: true}},
+	}); err != nil {
+		return err
+	}
+	return od.link.ConfigureWG(wgtypes.Config{Peers: []wgtypes.PeerConfig{pc}})
+}
+
+func (od *onDemandState) sleep() error {
+	peer, err := serverPeer(od.link, od.cfg)
+	if err != nil {
+		return err
+	}
+	if peer.Endpoint == nil {
+		return errors.New("server endpoint is not known")
+	}
+	od.endpoint = peer.Endpoint
+	if err := od.replacePeer(nil); err != nil {
+		return err
+	}
+	od.idle = true
+	updateState(func(s *clientState) { s.Phase = "idle" })
+	od.events.Emit(wirebox.TunnelIdle{Link: od.link.Name()})
+	return nil
+}
+
+func (od *onDemandState) wake() error {
+	if err := od.replacePeer(od.endpoint); err != nil {
+		return err
+	}
+	od.idle = false
+	updateState(func(s *clientState) { s.Phase = "up" })
+	od.events.Emit(wirebox.TunnelUp{Link: od.link.Name()})
+	return nil
+}
+
+// listen starts watching packets passing the tunnel interface.
+func (od *onDemandState) listen() (*ondemand.Trigger, error) {
+	var trig *ondemand.Trigger
+	err := linkmgr.InNetNS(tunNS, func() error {
+		var err error
+		trig, err = ondemand.Listen(od.link.Index())
+		return err
+	})
+	return trig, err
+}
+
+// waitPacket blocks until a packet passes the interface, the deadline passes
+// (unless it is zero) or stop is closed, returning nil, ondemand.ErrTimeout
+// or ondemand.ErrClosed respectively. trig is closed afterwards.
+func waitPacket(trig *ondemand.Trigger, deadline time.Time, stop <-chan struct{}) error {
+	defer trig.Close()
+	if err := trig.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		res <- trig.Wait()
+	}()
+	select {
+	case <-stop:
+		trig.Close()
+		<-res
+		return ondemand.ErrClosed
+	case err := <-res:
+		return err
+	}
+}
+
+// waitIdle returns true once no packets pass the tunnel interface for the
+// idle timeout, false if stop is closed. WireGuard transfer counters are not
+// used, keepalives and handshakes change them too.
+func (od *onDemandState) waitIdle(stop <-chan struct{}) (bool, error) {
+	lastActive := time.Now()
+	for {
+		trig, err := od.listen()
+		if err != nil {
+			return false, err
+		}
+		err = waitPacket(trig, lastActive.Add(od.cfg.OnDemand.IdleTimeout.Duration), stop)
+		switch {
+		case errors.Is(err, ondemand.ErrTimeout):
+			return true, nil
+		case errors.Is(err, ondemand.ErrClosed):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		lastActive = time.Now()
+
+		select {
+		case <-stop:
+			return false, nil
+		case <-time.After(onDemandCheck):
+		}
+	}
+}
+
+// runOnDemand keeps the session with the server stopped until traffic is
+// sent to the tunnel and stops it again once the tunnel is idle, until stop
+// is closed. Routes via the tunnel interface stay installed, without the
+// server endpoint they only trigger the session.
+func runOnDemand(m linkmgr.Manager, cfg Config, events *wirebox.EventBus, stop <-chan struct{}) {
+	if tunNS != nil {
+		m = tunNS
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: on-demand:", err)
+		return
+	}
+
+	od := &onDemandState{cfg: cfg, link: tunLink, events: events}
+	defer func() {
+		// Leave the tunnel usable without the client.
+		if od.idle {
+			if err := od.wake(); err != nil {
+				log.Println("error: on-demand:", err)
+			}
+		}
+	}()
+
+	log.Println("on-demand: configuration received, stopping the session until traffic is sent to the tunnel")
+	for {
+		// The trigger is started before the session is stopped so the
+		// first packet is not missed.
+		trig, err := od.listen()
+		if err != nil {
+			// Without the trigger, the tunnel is kept active.
+			log.Println("error: on-demand:", err)
+			return
+		}
+		if err := od.sleep(); err != nil {
+			trig.Close()
+			log.Println("error: on-demand:", err)
+			return
+		}
+
+		err = waitPacket(trig, time.Time{}, stop)
+		switch {
+		case errors.Is(err, ondemand.ErrClosed):
+			return
+		case err != nil:
+			log.Println("error: on-demand:", err)
+		default:
+			log.Println("on-demand: traffic to the tunnel, starting the session")
+		}
+		if err := od.wake(); err != nil {
+			log.Println("error: on-demand:", err)
+		}
+
+		idle, err := od.waitIdle(stop)
+		if err != nil {
+			log.Println("error: on-demand:", err)
+			return
+		}
+		if !idle {
+			return
+		}
+		log.Println("on-demand: no traffic for", od.cfg.OnDemand.IdleTimeout.Duration, "stopping the session")
+	}
+}
@@ -0,0 +1,45 @@
+package wboxclient
+
+import (
+	"log"
+
+	"github.com/foxcpp/wirebox/hostsfile"
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+// collectOrphans cleans up after the previous run that crashed or was killed
+// before the tunnel was removed. It should be called only if no other
+// client uses the same configuration, i.e. the control socket is ours.
+//
+// The tunnel link tagged as created by wirebox is adopted and reconfigured
+// as usual. If the link is gone, state kept for it outside of the link is
+// removed: saved sysctl values are restored, host routes to server endpoints
+// and the hosts file block are deleted.
+func collectOrphans(m linkmgr.Manager, cfg Config) {
+	l, err := m.GetLink(cfg.If)
+	if err != nil && tunNS != nil {
+		l, err = tunNS.GetLink(cfg.If)
+	}
+	if err == nil {
+		if ol, ok := l.(linkmgr.OwnedLink); ok {
+			if owned, err := ol.Owned(); err == nil && owned {
+				log.Println("adopting link", l.Name(), "left by the previous run")
+			}
+		}
+		return
+	}
+
+	if err := restoreSysctl(m, cfg.If); err != nil {
+		log.Println("error:", err)
+	}
+	removeHostRoutes(m, serverEndpoints(cfg, nil), 0)
+	if cfg.Hosts.Enable {
+		path := cfg.Hosts.Path
+		if path == "" {
+			path = hostsfile.DefaultPath
+		}
+		if err := hostsfile.Remove(path, cfg.If); err != nil {
+			log.Println("error:", err)
+		}
+	}
+}
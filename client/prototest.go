@@ -0,0 +1,105 @@
+package wboxclient
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/wirebox/proto/prototest"
+)
+
+func prototestMain(args []string) int {
+	fs := flag.NewFlagSet("prototest", flag.ExitOnError)
+	dump := fs.Bool("dump", false, "print test vectors as 'name hex' lines and exit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wbox prototest [options] [file]")
+		fmt.Fprintln(fs.Output(), "\nChecks the protocol implementation against test vectors. If the file is")
+		fmt.Fprintln(fs.Output(), "specified, datagrams in it ('name hex' lines, e.g. produced by another")
+		fmt.Fprintln(fs.Output(), "implementation) are checked to carry messages of the named vectors.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if *dump {
+		for _, v := range prototest.Vectors {
+			fmt.Println(v.Name, v.Hex)
+		}
+		return 0
+	}
+
+	var results []prototest.Result
+	if fs.NArg() == 1 {
+		var err error
+		results, err = checkDatagrams(fs.Arg(0))
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+	} else {
+		results = prototest.Suite()
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("FAIL %s: %v\n", r.Name, r.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", r.Name)
+	}
+	if failed != 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(results))
+		return 1
+	}
+	return 0
+}
+
+// checkDatagrams decodes 'name hex' lines from the file at path and checks
+// them against vectors with the same names.
+func checkDatagrams(path string) ([]prototest.Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []prototest.Result
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: malformed line: %s", path, line)
+		}
+		r := prototest.Result{Name: "decode/" + fields[0]}
+		v := prototest.Find(fields[0])
+		b, err := hex.DecodeString(fields[1])
+		switch {
+		case v == nil:
+			r.Err = fmt.Errorf("unknown vector")
+		case err != nil:
+			r.Err = err
+		default:
+			r.Err = prototest.CheckDecode(*v, b)
+		}
+		results = append(results, r)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
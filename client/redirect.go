@@ -0,0 +1,85 @@
+package wboxclient
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/tracing"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// maxRedirects limits the chain of servers referring the client to each
+// other.
+const maxRedirects = 3
+
+// referral is the server the client was redirected to. It replaces
+// config-endpoint and server-key until the client exits.
+type referral struct {
+	Endpoint string `json:"endpoint"`
+	Key      string `json:"key"`
+
+	endpoint net.UDPAddr
+	key      wirebox.PeerKey
+}
+
+// withReferral returns cfg with the server replaced by the one the client
+// was redirected to, if any.
+func withReferral(cfg Config) Config {
+	stateLock.Lock()
+	ref := state.Redirect
+	stateLock.Unlock()
+	if ref == nil {
+		return cfg
+	}
+	cfg.ConfigEndpoint.UDPAddr = ref.endpoint
+	cfg.ServerKey = ref.key
+	return cfg
+}
+
+// followReferral remembers the server from the REDIRECT NACK and removes the
+// current one from the configuration tunnel so the solictation address is
+// routed to the new peer.
+func followReferral(cfg Config, tunLink linkmgr.Link, nack *wboxproto.Nack) error {
+	endpoint := nack.GetReferralEndpoint().AsUDPAddr()
+	key, err := wgtypes.NewKey(nack.GetReferralKey())
+	if endpoint.IP.IsUnspecified() || endpoint.Port == 0 || err != nil {
+		return errors.New("malformed redirect")
+	}
+	if cfg.Mode == "networkd" {
+		return fmt.Errorf("redirect to %v is not followed with mode = networkd, update config-endpoint and server-key", endpoint)
+	}
+	log.Printf("WARNING: server redirected us to %v (key %v), update config-endpoint and server-key", endpoint, key)
+
+	err = tunLink.ConfigureWG(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: cfg.ServerKey.Bytes, Remove: true}},
+	})
+	if err != nil {
+		return fmt.Errorf("redirect: %w", err)
+	}
+	updateState(func(s *clientState) {
+		s.Redirect = &referral{
+			Endpoint: endpoint.String(),
+			Key:      key.String(),
+			endpoint: *endpoint,
+			key:      wirebox.PeerKey{Encoded: key.String(), Bytes: key},
+		}
+	})
+	return nil
+}
+
+// configureRedirected runs ConfigureTunnel following redirects of servers.
+func configureRedirected(m linkmgr.Manager, cfg Config, events *wirebox.EventBus, tracer *tracing.Tracer) error {
+	err := ConfigureTunnel(m, cfg, events, tracer)
+	for i := 0; errors.Is(err, wirebox.ErrRedirected); i++ {
+		if i == maxRedirects {
+			return fmt.Errorf("too many redirects: %w", err)
+		}
+		err = ConfigureTunnel(m, cfg, events, tracer)
+	}
+	return err
+}
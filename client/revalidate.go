@@ -0,0 +1,156 @@
+package wboxclient
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/netwatch"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type RevalidateConfig struct {
+	// Check the tunnel after the system wakes up and after network
+	// interfaces or addresses change.
+	Enable bool `toml:"enable"`
+
+	// How long to wait for the tunnel to work before requesting the
+	// configuration again.
+	Timeout Duration `toml:"timeout"`
+}
+
+const (
+	revalidatePing  = 2 * time.Second
+	revalidateRetry = time.Second
+)
+
+// serverPeer returns the server peer of the tunnel.
+func serverPeer(link linkmgr.Link, cfg Config) (wgtypes.Peer, error) {
+	dev, err := link.WGConfig()
+	if err != nil {
+		return wgtypes.Peer{}, err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey == cfg.ServerKey.Bytes {
+			return p, nil
+		}
+	}
+	return wgtypes.Peer{}, errors.New("server peer is not configured")
+}
+
+// revalidate checks whether the tunnel works, starting a new handshake if
+// needed. It returns false if the tunnel did not work before the timeout or
+// stop is closed.
+func revalidate(link linkmgr.Link, cfg Config, targets []net.IP, stop <-chan struct{}) bool {
+	start := time.Now()
+	peer, err := serverPeer(link, cfg)
+	if err != nil {
+		log.Println("error: revalidate:", err)
+		return false
+	}
+
+	// Setting the endpoint again drops the cached source address, so packets
+	// take the path via the new network.
+	if peer.Endpoint != nil {
+		err := link.ConfigureWG(wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:  peer.PublicKey,
+				UpdateOnly: true,
+				Endpoint:   peer.Endpoint,
+			}},
+		})
+		if err != nil {
+			log.Println("error: revalidate:", err)
+		}
+	}
+
+	deadline := start.Add(cfg.Revalidate.Timeout.Duration)
+	for time.Now().Before(deadline) {
+		// Traffic triggers the handshake if the session expired.
+		for _, t := range targets {
+			if _, err := ping(t, revalidatePing); err == nil {
+				return true
+			}
+		}
+		if peer, err := serverPeer(link, cfg); err == nil && peer.LastHandshakeTime.After(start) {
+			return true
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(revalidateRetry):
+		}
+	}
+	return false
+}
+
+// runRevalidate checks the tunnel after wake-up and network changes until
+// stop is closed and requests the reconfiguration if it does not work.
+func runRevalidate(m linkmgr.Manager, cfg Config, clCfg *wboxproto.Cfg, reconfigure chan<- chan error, stop <-chan struct{}) {
+	// Changes of the tunnel itself are ignored, it is not visible if moved
+	// to another namespace.
+	ignore := 0
+	if tunNS != nil {
+		m = tunNS
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: revalidate:", err)
+		return
+	}
+	if tunNS == nil {
+		ignore = tunLink.Index()
+	}
+
+	events, err := netwatch.Watch(ignore, stop)
+	if err != nil {
+		log.Println("error: revalidate:", err)
+		return
+	}
+
+	targets := monitorTargets(cfg, clCfg)
+	for {
+		var ev netwatch.Event
+		select {
+		case <-stop:
+			return
+		case ev = <-events:
+		}
+
+		stateLock.Lock()
+		phase := state.Phase
+		stateLock.Unlock()
+		if phase == "captive-portal" {
+			// The tunnel is known to be broken, the captive portal detection
+			// restores it.
+			continue
+		}
+
+		if ev.Kind == netwatch.Wake {
+			log.Printf("revalidate: woke up after %v, checking the tunnel", ev.Slept.Round(time.Second))
+		} else {
+			log.Println("revalidate: network changed, checking the tunnel")
+		}
+		if revalidate(tunLink, cfg, targets, stop) {
+			log.Println("revalidate: tunnel works")
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Println("WARNING: revalidate: tunnel does not work, requesting the configuration")
+		select {
+		case reconfigure <- make(chan error, 1):
+		case <-stop:
+		}
+		// Workers are restarted after the reconfiguration.
+		return
+	}
+}
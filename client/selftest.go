@@ -0,0 +1,90 @@
+package wboxclient
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+type SelfTestConfig struct {
+	Enable bool `toml:"enable"`
+
+	// Additional addresses to probe, e.g. hosts in the routed networks.
+	Targets []IPAddr `toml:"targets"`
+
+	// Timeout for the single echo request.
+	Timeout Duration `toml:"timeout"`
+	// Number of echo requests to send before considering the target
+	// unreachable.
+	Attempts int `toml:"attempts"`
+
+	// How many times to reconfigure the tunnel if the self-test fails.
+	Recover int `toml:"recover"`
+}
+
+type probeResult struct {
+	Target string        `json:"target"`
+	RTT    time.Duration `json:"rtt,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+func selfTestTargets(cfg Config, clCfg *wboxproto.Cfg) []net.IP {
+	var targets []net.IP
+	if clCfg.GetServer4() != 0 && len(clCfg.Net4) != 0 {
+		targets = append(targets, wboxproto.IPv4(clCfg.GetServer4()))
+	}
+	if clCfg.GetServer6() != nil && len(clCfg.Net6) != 0 {
+		targets = append(targets, clCfg.GetServer6().AsIP())
+	}
+	for _, t := range cfg.SelfTest.Targets {
+		targets = append(targets, t.IP)
+	}
+	return targets
+}
+
+func pingTarget(target net.IP, cfg SelfTestConfig) probeResult {
+	res := probeResult{Target: target.String()}
+	for i := 0; i < cfg.Attempts; i++ {
+		rtt, err := ping(target, cfg.Timeout.Duration)
+		if err == nil {
+			res.RTT = rtt
+			res.Error = ""
+			return res
+		}
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// selfTest verifies that the in-tunnel server addresses and configured
+// targets respond to ICMP echo requests.
+func selfTest(cfg Config, clCfg *wboxproto.Cfg) error {
+	targets := selfTestTargets(cfg, clCfg)
+	if len(targets) == 0 {
+		log.Println("self-test: nothing to probe")
+		return nil
+	}
+
+	results := make([]probeResult, 0, len(targets))
+	failed := 0
+	for _, target := range targets {
+		res := pingTarget(target, cfg.SelfTest)
+		if res.Error != "" {
+			log.Printf("self-test: %v is unreachable: %v", target, res.Error)
+			failed++
+		} else {
+			log.Printf("self-test: %v is reachable, rtt %v", target, res.RTT)
+		}
+		results = append(results, res)
+	}
+	updateState(func(s *clientState) { s.SelfTest = results })
+
+	if failed != 0 {
+		return fmt.Errorf("%w: %v of %v targets unreachable", wirebox.ErrSelfTestFailed, failed, len(targets))
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package wboxclient
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/splitdns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type SplitDNSConfig struct {
+	Enable bool `toml:"enable"`
+
+	// Address the DNS forwarder listens on, the system resolver should be
+	// configured to use it.
+	Listen string `toml:"listen"`
+	// Names under these domains are resolved via tunnel-resolver and routes
+	// to returned addresses are added to the tunnel. "*.example.org"
+	// excludes example.org itself.
+	Domains []string `toml:"domains"`
+	// Resolver reachable via the tunnel and the resolver for all other
+	// names, IP or IP:port.
+	TunnelResolver string `toml:"tunnel-resolver"`
+	Upstream       string `toml:"upstream"`
+	// Routes are kept for the record TTL but not less than min-ttl, so
+	// connections survive short TTLs.
+	MinTTL Duration `toml:"min-ttl"`
+}
+
+const (
+	// splitExpiryCheck is how often expired routes are removed.
+	splitExpiryCheck = 10 * time.Second
+
+	// splitTimeout limits each forwarded DNS query.
+	splitTimeout = 5 * time.Second
+)
+
+type splitRoute struct {
+	IP      string    `json:"ip"`
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+
+	ip        net.IP
+	installed bool
+}
+
+// splitRoutes is kept across worker restarts so reconfiguration does not
+// drop routes for names applications already resolved.
+var (
+	splitLock   sync.Mutex
+	splitRoutes = map[string]*splitRoute{}
+)
+
+// resolverAddr adds the default DNS port to addr if it has none.
+func resolverAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "53")
+}
+
+func hostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+type splitRouter struct {
+	cfg    Config
+	link   linkmgr.Link
+	events *wirebox.EventBus
+}
+
+// serverAllowedIPs returns allowed IPs of the server peer.
+func (sr *splitRouter) serverAllowedIPs() ([]net.IPNet, error) {
+	dev, err := sr.link.WGConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey == sr.cfg.ServerKey.Bytes {
+			return p.AllowedIPs, nil
+		}
+	}
+	return nil, errors.New("server peer is not configured")
+}
+
+// covered reports whether traffic to ip already goes via the tunnel without
+// routes added for resolved names.
+func (sr *splitRouter) covered(allowed []net.IPNet, ip net.IP) bool {
+	for _, n := range allowed {
+		ones, bits := n.Mask.Size()
+		if ones == bits && splitRoutes[n.IP.String()] != nil {
+			continue
+		}
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sr *splitRouter) install(r *splitRoute) error {
+	hn := hostNet(r.ip)
+	err := sr.link.ConfigureWG(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:  sr.cfg.ServerKey.Bytes,
+			UpdateOnly: true,
+			AllowedIPs: []net.IPNet{hn},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	route := linkmgr.Route{Dest: hn, Table: sr.cfg.routeTable()}
+	if err := sr.link.AddRoute(route); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	r.installed = true
+	sr.events.Emit(wirebox.RouteInstalled{Link: sr.link.Name(), Route: route})
+	return nil
+}
+
+// uninstall removes routes and allowed IPs for the routes.
+func (sr *splitRouter) uninstall(routes []*splitRoute) error {
+	remove := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		if !r.installed {
+			continue
+		}
+		if err := sr.link.DelRoute(linkmgr.Route{Dest: hostNet(r.ip), Table: sr.cfg.routeTable()}); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Println("error: split-dns: route del", r.IP+":", err)
+		}
+		r.installed = false
+		remove[r.IP] = true
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+
+	// Allowed IPs cannot be removed one by one, so the whole list is
+	// replaced.
+	allowed, err := sr.serverAllowedIPs()
+	if err != nil {
+		return err
+	}
+	keep := make([]net.IPNet, 0, len(allowed))
+	for _, n := range allowed {
+		ones, bits := n.Mask.Size()
+		if ones == bits && remove[n.IP.String()] {
+			continue
+		}
+		keep = append(keep, n)
+	}
+	return sr.link.ConfigureWG(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         sr.cfg.ServerKey.Bytes,
+			UpdateOnly:        true,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        keep,
+		}},
+	})
+}
+
+// resolved is called by the forwarder before the response is returned to
+// the application.
+func (sr *splitRouter) resolved(name string, addrs []net.IP, ttl time.Duration) {
+	if ttl < sr.cfg.SplitDNS.MinTTL.Duration {
+		ttl = sr.cfg.SplitDNS.MinTTL.Duration
+	}
+	expires := time.Now().Add(ttl)
+
+	splitLock.Lock()
+	defer splitLock.Unlock()
+	defer sr.updateState()
+
+	var allowed []net.IPNet
+	for _, ip := range addrs {
+		key := ip.String()
+		if r := splitRoutes[key]; r != nil {
+			if expires.After(r.Expires) {
+				r.Expires = expires
+			}
+			continue
+		}
+
+		if allowed == nil {
+			var err error
+			allowed, err = sr.serverAllowedIPs()
+			if err != nil {
+				log.Println("error: split-dns:", err)
+				return
+			}
+		}
+		if sr.covered(allowed, ip) {
+			continue
+		}
+
+		r := &splitRoute{IP: key, Name: name, Expires: expires, ip: ip}
+		if err := sr.install(r); err != nil {
+			log.Printf("error: split-dns: route add %v (%s): %v", ip, name, err)
+			continue
+		}
+		splitRoutes[key] = r
+		log.Printf("split-dns: routing %v (%s) via tunnel for %v", ip, name, ttl)
+	}
+}
+
+// expire removes routes with the expiry time before now.
+func (sr *splitRouter) expire(now time.Time) {
+	splitLock.Lock()
+	defer splitLock.Unlock()
+
+	var expired []*splitRoute
+	for key, r := range splitRoutes {
+		if r.Expires.Before(now) {
+			expired = append(expired, r)
+			delete(splitRoutes, key)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	if err := sr.uninstall(expired); err != nil {
+		log.Println("error: split-dns:", err)
+	}
+	log.Println("split-dns: expired", len(expired), "routes")
+	sr.updateState()
+}
+
+// reinstall adds routes kept from the previous run of the worker.
+func (sr *splitRouter) reinstall() {
+	splitLock.Lock()
+	defer splitLock.Unlock()
+	for _, r := range splitRoutes {
+		if err := sr.install(r); err != nil {
+			log.Printf("error: split-dns: route add %v (%s): %v", r.IP, r.Name, err)
+		}
+	}
+	sr.updateState()
+}
+
+// removeAll removes all routes from the interface, they are kept in
+// splitRoutes to be added again by reinstall.
+func (sr *splitRouter) removeAll() {
+	splitLock.Lock()
+	defer splitLock.Unlock()
+	routes := make([]*splitRoute, 0, len(splitRoutes))
+	for _, r := range splitRoutes {
+		routes = append(routes, r)
+	}
+	if err := sr.uninstall(routes); err != nil {
+		log.Println("error: split-dns:", err)
+	}
+}
+
+// updateState should be called with splitLock held.
+func (sr *splitRouter) updateState() {
+	routes := make([]splitRoute, 0, len(splitRoutes))
+	for _, r := range splitRoutes {
+		routes = append(routes, *r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].IP < routes[j].IP
+	})
+	updateState(func(s *clientState) { s.SplitDNS = routes })
+}
+
+// runSplitDNS serves DNS queries and maintains routes for names under
+// configured domains until stop is closed.
+func runSplitDNS(m linkmgr.Manager, cfg Config, events *wirebox.EventBus, stop <-chan struct{}) {
+	if tunNS != nil {
+		// Applications in the namespace cannot reach the forwarder.
+		log.Println("error: split-dns: not supported with -netns")
+		return
+	}
+	tunLink, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error: split-dns:", err)
+		return
+	}
+
+	sr := &splitRouter{cfg: cfg, link: tunLink, events: events}
+	sr.reinstall()
+	defer sr.removeAll()
+
+	fwd := &splitdns.Forwarder{
+		Domains:  cfg.SplitDNS.Domains,
+		Tunnel:   resolverAddr(cfg.SplitDNS.TunnelResolver),
+		Upstream: resolverAddr(cfg.SplitDNS.Upstream),
+		Timeout:  splitTimeout,
+		Resolved: sr.resolved,
+	}
+	if err := fwd.Listen(cfg.SplitDNS.Listen); err != nil {
+		log.Println("error: split-dns:", err)
+		return
+	}
+	defer fwd.Close()
+	log.Println("split-dns: listening on", cfg.SplitDNS.Listen)
+
+	t := time.NewTicker(splitExpiryCheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			sr.expire(now)
+		}
+	}
+}
+
+func validateResolver(addr string) error {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("malformed address: %s", addr)
+	}
+	return nil
+}
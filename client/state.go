@@ -0,0 +1,56 @@
+package wboxclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox/bench"
+	"github.com/foxcpp/wirebox/probe"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+// clientState is the snapshot of the configuration progress exposed via the
+// debug server.
+type clientState struct {
+	Link           string    `json:"link,omitempty"`
+	Phase          string    `json:"phase"`
+	SolictAttempts int       `json:"solict-attempts"`
+	NextRetry      time.Time `json:"next-retry"`
+	LastError      string    `json:"last-error,omitempty"`
+	ConfiguredAt   time.Time `json:"configured-at"`
+
+	SelfTest []probeResult       `json:"self-test,omitempty"`
+	Monitor  []probe.TargetStats `json:"monitor,omitempty"`
+	Mesh     []meshPeer          `json:"mesh,omitempty"`
+	SplitDNS []splitRoute        `json:"split-dns,omitempty"`
+	// Result of the last bench run with -record.
+	Bench *bench.Result `json:"bench,omitempty"`
+
+	// Portal URL (if known) while the tunnel is paused.
+	CaptivePortal string `json:"captive-portal,omitempty"`
+	// Whether the uplink is metered, kept across reconfigurations.
+	Metered bool `json:"metered,omitempty"`
+	// Last message from the server operator.
+	Motd string `json:"motd,omitempty"`
+	// Server the client was redirected to.
+	Redirect *referral `json:"redirect,omitempty"`
+
+	cfg *wboxproto.Cfg
+}
+
+var (
+	stateLock sync.Mutex
+	state     = clientState{Phase: "init"}
+)
+
+func updateState(f func(s *clientState)) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	f(&state)
+}
+
+func debugState() interface{} {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return state
+}
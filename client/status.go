@@ -0,0 +1,82 @@
+package wboxclient
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/wgfmt"
+)
+
+func statusMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	format := fs.String("format", "wg-show", "output format: wg-show, wg-dump or json (client state, requires running client)")
+	showKeys := fs.Bool("show-keys", false, "include private and preshared keys in wg-dump output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wbox status [options]")
+		fmt.Fprintln(fs.Output(), "The running client is asked via the control socket, the interface is")
+		fmt.Fprintln(fs.Output(), "read directly if it is not running.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var cfg Config
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return 2
+	}
+
+	if *format == "json" {
+		var state json.RawMessage
+		if err := ctlsock.Call(cfg.controlSocket(), "state", nil, &state); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(state)
+		return 0
+	}
+
+	var out string
+	err := ctlsock.Call(cfg.controlSocket(), "status", statusArgs{Format: *format, ShowKeys: *showKeys}, &out)
+	if err == nil {
+		fmt.Print(out)
+		return 0
+	}
+	if !errors.Is(err, ctlsock.ErrNotRunning) {
+		log.Println("error:", err)
+		return 1
+	}
+
+	m, err := linkmgr.NewManager()
+	if err != nil {
+		log.Println("error: link mngr init:", err)
+		return 1
+	}
+	defer m.Close()
+
+	l, err := m.GetLink(cfg.If)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	dev, err := l.WGConfig()
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if err := wgfmt.WriteStatus(os.Stdout, *format, l.Name(), dev, *showKeys); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package wboxclient
+
+import (
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/sysctl"
+)
+
+// applySysctl sets kernel parameters of the tunnel interface in the network
+// namespace of m.
+func applySysctl(m linkmgr.Manager, cfg Config, link string) error {
+	if !cfg.Sysctl.Enabled() {
+		return nil
+	}
+	return linkmgr.InNetNS(m, func() error {
+		return sysctl.Apply(sysctl.StatePath(link), cfg.Sysctl.Settings(link))
+	})
+}
+
+// restoreSysctl restores parameters changed by applySysctl, even if they are
+// no longer set in the configuration.
+func restoreSysctl(m linkmgr.Manager, link string) error {
+	return linkmgr.InNetNS(m, func() error {
+		return sysctl.Restore(sysctl.StatePath(link))
+	})
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+// Command wbox-e2e runs the server and the client built into the wirebox
+// binary in separate network namespaces and checks the tunnel between them.
+//
+// Usage: wbox-e2e [options] [scenario...]
+//
+// All scenarios are executed if none are specified. It needs root and the
+// WireGuard kernel module. The exit code is 1 if any scenario fails.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/wirebox/e2e"
+)
+
+func main() {
+	bin := flag.String("bin", "wirebox", "path to the wirebox binary")
+	dir := flag.String("dir", "", "directory for configuration files and logs (temporary one if empty)")
+	timeout := flag.Duration("timeout", 30*time.Second, "time to wait for the server to start and the client to be configured")
+	list := flag.Bool("list", false, "list scenarios and exit")
+	flag.Parse()
+
+	if *list {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, sc := range e2e.Scenarios {
+			fmt.Fprintf(tw, "%s\t%s\n", sc.Name, sc.Help)
+		}
+		tw.Flush()
+		return
+	}
+
+	scenarios := e2e.Scenarios
+	if flag.NArg() != 0 {
+		scenarios = nil
+		for _, name := range flag.Args() {
+			sc := e2e.Find(name)
+			if sc == nil {
+				log.Println("unknown scenario:", name)
+				os.Exit(2)
+			}
+			scenarios = append(scenarios, *sc)
+		}
+	}
+
+	binPath, err := exec.LookPath(*bin)
+	if err != nil {
+		log.Println("error:", err)
+		os.Exit(2)
+	}
+	if *dir == "" {
+		*dir, err = ioutil.TempDir("", "wbox-e2e-")
+		if err != nil {
+			log.Println("error:", err)
+			os.Exit(2)
+		}
+	}
+
+	opts := e2e.Options{
+		Binary:  binPath,
+		Dir:     *dir,
+		Timeout: *timeout,
+	}
+	failed := 0
+	for _, sc := range scenarios {
+		start := time.Now()
+		if err := e2e.Run(sc, opts); err != nil {
+			fmt.Printf("FAIL %s (%v): %v\n", sc.Name, time.Since(start).Round(time.Millisecond), err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s (%v)\n", sc.Name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed != 0 {
+		fmt.Printf("%d of %d scenarios failed, logs are in %s\n", failed, len(scenarios), *dir)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,21 @@
+// Command wirebox combines the client (wbox) and the server (wboxd) in a
+// single binary. Server commands are available under "wirebox server".
+package main
+
+import (
+	"os"
+
+	"github.com/foxcpp/wirebox/cli"
+	wboxclient "github.com/foxcpp/wirebox/client"
+	wboxserver "github.com/foxcpp/wirebox/server"
+)
+
+func main() {
+	os.Exit(wboxclient.Run("wirebox", os.Args[1:], cli.Command{
+		Name: "server",
+		Help: "server commands, see 'wirebox server help'",
+		Run: func(args []string) int {
+			return wboxserver.Run("wirebox server", args)
+		},
+	}))
+}
@@ -8,6 +8,9 @@ import (
 
 var SolictIPv6 net.IP = net.ParseIP("fe80:5747:4443:5000::1")
 
+// SolictIPv4 is used instead of SolictIPv6 by clients with IPv6 disabled.
+var SolictIPv4 net.IP = net.IPv4(169, 254, 87, 66).To4()
+
 const (
 	SolictPort = 22434
 
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package ctlsock
+
+import (
+	"errors"
+	"net"
+)
+
+func checkPeer(*net.UnixConn) error {
+	return errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,65 @@
+package ctlsock
+
+import (
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// sioAFUnixGetPeerPID is SIO_AF_UNIX_GETPEERPID from afunix.h.
+const sioAFUnixGetPeerPID = windows.IOC_OUT | windows.IOC_VENDOR | 256
+
+// checkPeer permits connections from elevated processes (the equivalent of
+// root) and processes of the user the daemon runs as. Windows has no peer
+// credentials for AF_UNIX sockets, the token of the peer process is checked
+// instead.
+func checkPeer(c *net.UnixConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		pid    uint32
+		pidErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		var n uint32
+		pidErr = windows.WSAIoctl(windows.Handle(fd), sioAFUnixGetPeerPID, nil, 0,
+			(*byte)(unsafe.Pointer(&pid)), uint32(unsafe.Sizeof(pid)), &n, nil, 0)
+	})
+	if err != nil {
+		return err
+	}
+	if pidErr != nil {
+		return fmt.Errorf("peer pid: %w", pidErr)
+	}
+
+	proc, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return fmt.Errorf("peer process %d: %w", pid, err)
+	}
+	defer windows.CloseHandle(proc)
+	var token windows.Token
+	if err := windows.OpenProcessToken(proc, windows.TOKEN_QUERY, &token); err != nil {
+		return fmt.Errorf("peer process %d: %w", pid, err)
+	}
+	defer token.Close()
+	if token.IsElevated() {
+		return nil
+	}
+
+	peer, err := token.GetTokenUser()
+	if err != nil {
+		return fmt.Errorf("peer process %d: %w", pid, err)
+	}
+	self, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return fmt.Errorf("own token: %w", err)
+	}
+	if !windows.EqualSid(peer.User.Sid, self.User.Sid) {
+		return fmt.Errorf("rejected connection from %v (pid %d)", peer.User.Sid, pid)
+	}
+	return nil
+}
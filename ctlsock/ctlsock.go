@@ -0,0 +1,278 @@
+// Package ctlsock implements the control socket used by the command line
+// to talk to running wirebox daemons.
+//
+// Each connection carries a single JSON request followed by a single JSON
+// response or, for streaming commands, a sequence of responses. Connections
+// are accepted only from root and the user the daemon runs as, checked using
+// peer credentials of the socket. On Windows elevated processes count as
+// root and the token of the peer process is checked.
+package ctlsock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ioTimeout limits the time to read the request and write the response.
+	ioTimeout = 10 * time.Second
+	// callTimeout limits the time to wait for the response, commands such as
+	// reconfigure may take a while.
+	callTimeout = 2 * time.Minute
+)
+
+var (
+	// ErrNotRunning is returned by Call if there is no daemon listening on
+	// the socket.
+	ErrNotRunning = errors.New("control socket: daemon is not running")
+
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+type Request struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+type Response struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Handler executes the command. args is the raw JSON value sent by the
+// caller (may be empty), the returned value is serialized using
+// encoding/json.
+type Handler func(args json.RawMessage) (interface{}, error)
+
+// StreamHandler executes the command producing a sequence of results, each
+// value passed to send is delivered to the caller immediately. The handler
+// should return once done is closed, which happens when the caller
+// disconnects or the server is closed.
+type StreamHandler func(args json.RawMessage, send func(v interface{}) error, done <-chan struct{}) error
+
+type Server struct {
+	l        *net.UnixListener
+	handlers map[string]Handler
+	streams  map[string]StreamHandler
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Listen creates the socket at path and starts serving requests using
+// handlers and streams. The stale socket left by a crashed daemon is
+// replaced.
+func Listen(path string, handlers map[string]Handler, streams map[string]StreamHandler) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("control socket: %s is used by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("control socket: %w", err)
+		}
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+
+	s := &Server{l: l, handlers: handlers, streams: streams, quit: make(chan struct{})}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.AcceptUnix()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer c.Close()
+			s.handle(c)
+		}()
+	}
+}
+
+func (s *Server) handle(c *net.UnixConn) {
+	if err := checkPeer(c); err != nil {
+		log.Println("WARNING: control socket:", err)
+		json.NewEncoder(c).Encode(Response{Error: "permission denied"})
+		return
+	}
+
+	c.SetReadDeadline(time.Now().Add(ioTimeout))
+
+	var req Request
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		return
+	}
+
+	if h, ok := s.streams[req.Command]; ok {
+		s.handleStream(c, h, req.Args)
+		return
+	}
+
+	var resp Response
+	h, ok := s.handlers[req.Command]
+	if !ok {
+		resp.Error = ErrUnknownCommand.Error()
+	} else {
+		res, err := h(req.Args)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if resp.Result, err = json.Marshal(res); err != nil {
+			resp.Error = err.Error()
+		}
+	}
+
+	c.SetWriteDeadline(time.Now().Add(ioTimeout))
+	if err := json.NewEncoder(c).Encode(resp); err != nil {
+		log.Println("error: control socket:", err)
+	}
+}
+
+func (s *Server) handleStream(c *net.UnixConn, h StreamHandler, args json.RawMessage) {
+	// The caller sends nothing after the request, so the read returns only
+	// once it disconnects.
+	c.SetReadDeadline(time.Time{})
+	gone := make(chan struct{})
+	go func() {
+		c.Read(make([]byte, 1))
+		close(gone)
+	}()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-gone:
+		case <-s.quit:
+		}
+		close(done)
+	}()
+
+	enc := json.NewEncoder(c)
+	send := func(v interface{}) error {
+		res, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		c.SetWriteDeadline(time.Now().Add(ioTimeout))
+		return enc.Encode(Response{Result: res})
+	}
+	if err := h(args, send, done); err != nil {
+		c.SetWriteDeadline(time.Now().Add(ioTimeout))
+		enc.Encode(Response{Error: err.Error()})
+	}
+}
+
+// Close stops accepting connections, waits for requests in progress and
+// removes the socket.
+func (s *Server) Close() error {
+	err := s.l.Close()
+	close(s.quit)
+	s.wg.Wait()
+	return err
+}
+
+func dial(path, command string, args interface{}) (net.Conn, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrNotRunning
+		}
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	c.SetWriteDeadline(time.Now().Add(ioTimeout))
+
+	req := Request{Command: command}
+	if args != nil {
+		if req.Args, err = json.Marshal(args); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("control socket: %w", err)
+		}
+	}
+	if err := json.NewEncoder(c).Encode(req); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	return c, nil
+}
+
+// Call sends the command to the daemon listening on path and decodes the
+// result into result (if not nil). args are serialized using encoding/json
+// and can be nil.
+func Call(path, command string, args, result interface{}) error {
+	c, err := dial(path, command, args)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(callTimeout))
+
+	var resp Response
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return fmt.Errorf("control socket: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("control socket: %s: %s", command, resp.Error)
+	}
+	if result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("control socket: malformed response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Stream sends the streaming command to the daemon listening on path and
+// calls f for each result until the daemon ends the stream or f returns an
+// error.
+func Stream(path, command string, args interface{}, f func(result json.RawMessage) error) error {
+	c, err := dial(path, command, args)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	dec := json.NewDecoder(c)
+	for {
+		var resp Response
+		if err := dec.Decode(&resp); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("control socket: %w", err)
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("control socket: %s: %s", command, resp.Error)
+		}
+		if err := f(resp.Result); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package debugsrv implements the HTTP server exposing pprof profiles and the
+// dump of the internal state for troubleshooting.
+//
+// The server is restricted to loopback addresses since it exposes
+// information that can be used to attack the tunnel.
+package debugsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+)
+
+// Metric is a single gauge value exposed in Prometheus text format.
+type Metric struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// MetricsFunc returns current values of all metrics.
+type MetricsFunc func() []Metric
+
+// StateFunc returns the snapshot of the internal state. The value is
+// serialized using encoding/json.
+type StateFunc func() interface{}
+
+type Server struct {
+	l   net.Listener
+	srv *http.Server
+}
+
+// Listen starts the debug server on the specified address. The address should
+// be a loopback one. metrics can be nil.
+func Listen(addr string, state StateFunc, metrics MetricsFunc) (*Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("debug server: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("debug server: refusing to listen on non-loopback address %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state()); err != nil {
+			log.Println("error: debug server:", err)
+		}
+	})
+
+	if metrics != nil {
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writeMetrics(w, metrics())
+		})
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("debug server: %w", err)
+	}
+	s := &Server{
+		l:   l,
+		srv: &http.Server{Handler: mux},
+	}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("error: debug server:", err)
+		}
+	}()
+	log.Println("debug server listening on", l.Addr())
+	return s, nil
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+func writeMetrics(w io.Writer, metrics []Metric) {
+	described := make(map[string]bool)
+	for _, m := range metrics {
+		if !described[m.Name] {
+			if m.Help != "" {
+				fmt.Fprintf(w, "# HELP %s %s\n", m.Name, m.Help)
+			}
+			fmt.Fprintf(w, "# TYPE %s gauge\n", m.Name)
+			described[m.Name] = true
+		}
+
+		keys := make([]string, 0, len(m.Labels))
+		for k := range m.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		labels := make([]string, 0, len(keys))
+		for _, k := range keys {
+			labels = append(labels, fmt.Sprintf("%s=%q", k, m.Labels[k]))
+		}
+
+		if len(labels) == 0 {
+			fmt.Fprintf(w, "%s %v\n", m.Name, m.Value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", m.Name, strings.Join(labels, ","), m.Value)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package dnsdisc discovers the configuration endpoint and the server key
+// using DNS records under the deployment domain:
+//
+//	_wirebox._udp.DOMAIN SRV  0 0 12000 vpn.DOMAIN.
+//	_wirebox.DOMAIN      TXT  "v=wirebox1 server-key=... config-addr-scheme=salted"
+//
+// The TXT record contains client configuration options as key=value pairs.
+package dnsdisc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+const txtVersion = "v=wirebox1"
+
+type Result struct {
+	Endpoint *net.UDPAddr
+	// Options from the TXT record, "v" is not included.
+	Options map[string]string
+}
+
+// Lookup queries records for domain. If dnssec is set, queries are sent to
+// the resolver (host:port, the first nameserver from /etc/resolv.conf if
+// empty) and responses without the Authenticated Data flag are rejected, so
+// the resolver must be validating and trusted (e.g. running locally).
+func Lookup(domain string, dnssec bool, resolver string) (Result, error) {
+	domain = strings.TrimSuffix(domain, ".")
+
+	var (
+		r   lookuper = stdLookuper{}
+		err error
+	)
+	if dnssec {
+		if resolver == "" {
+			resolver, err = systemResolver("/etc/resolv.conf")
+			if err != nil {
+				return Result{}, fmt.Errorf("dnsdisc: %w", err)
+			}
+		}
+		r = &secureLookuper{server: resolver}
+	}
+
+	srvs, err := r.lookupSRV("_wirebox._udp." + domain)
+	if err != nil {
+		return Result{}, fmt.Errorf("dnsdisc: SRV: %w", err)
+	}
+	if len(srvs) == 0 {
+		return Result{}, errors.New("dnsdisc: SRV: no records")
+	}
+	sort.Slice(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	srv := srvs[0]
+	ips, err := r.lookupIP(strings.TrimSuffix(srv.Target, "."))
+	if err != nil {
+		return Result{}, fmt.Errorf("dnsdisc: %v: %w", srv.Target, err)
+	}
+	if len(ips) == 0 {
+		return Result{}, fmt.Errorf("dnsdisc: %v: no addresses", srv.Target)
+	}
+
+	txts, err := r.lookupTXT("_wirebox." + domain)
+	if err != nil {
+		return Result{}, fmt.Errorf("dnsdisc: TXT: %w", err)
+	}
+	opts, err := parseTXT(txts)
+	if err != nil {
+		return Result{}, fmt.Errorf("dnsdisc: TXT: %w", err)
+	}
+
+	return Result{
+		Endpoint: &net.UDPAddr{IP: ips[0], Port: int(srv.Port)},
+		Options:  opts,
+	}, nil
+}
+
+// parseTXT returns options from the first record with the wirebox version
+// tag.
+func parseTXT(txts []string) (map[string]string, error) {
+	for _, txt := range txts {
+		fields := strings.Fields(txt)
+		if len(fields) == 0 || fields[0] != txtVersion {
+			continue
+		}
+		opts := make(map[string]string, len(fields)-1)
+		for _, f := range fields[1:] {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("malformed option: %v", f)
+			}
+			opts[parts[0]] = parts[1]
+		}
+		return opts, nil
+	}
+	return nil, errors.New("no " + txtVersion + " record")
+}
+
+func systemResolver(path string) (string, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(blob), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in " + path)
+}
+
+type lookuper interface {
+	lookupSRV(name string) ([]*net.SRV, error)
+	lookupIP(name string) ([]net.IP, error)
+	lookupTXT(name string) ([]string, error)
+}
+
+type stdLookuper struct{}
+
+func (stdLookuper) lookupSRV(name string) ([]*net.SRV, error) {
+	_, srvs, err := net.LookupSRV("", "", name)
+	return srvs, err
+}
+
+func (stdLookuper) lookupIP(name string) ([]net.IP, error) {
+	return net.LookupIP(name)
+}
+
+func (stdLookuper) lookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+// secureLookuper sends queries to the validating resolver directly since the
+// standard resolver does not expose the Authenticated Data flag.
+type secureLookuper struct {
+	server string
+}
+
+func (l *secureLookuper) lookupSRV(name string) ([]*net.SRV, error) {
+	rrs, err := exchange(l.server, name, typeSRV)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*net.SRV, 0, len(rrs))
+	for _, rr := range rrs {
+		if len(rr.data) < 7 {
+			return nil, errors.New("malformed SRV record")
+		}
+		target, _, err := readName(rr.msg, rr.offset+6)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &net.SRV{
+			Priority: uint16(rr.data[0])<<8 | uint16(rr.data[1]),
+			Weight:   uint16(rr.data[2])<<8 | uint16(rr.data[3]),
+			Port:     uint16(rr.data[4])<<8 | uint16(rr.data[5]),
+			Target:   target,
+		})
+	}
+	return res, nil
+}
+
+func (l *secureLookuper) lookupIP(name string) ([]net.IP, error) {
+	var res []net.IP
+	for _, typ := range []uint16{typeA, typeAAAA} {
+		rrs, err := exchange(l.server, name, typ)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range rrs {
+			if len(rr.data) != 4 && len(rr.data) != 16 {
+				return nil, errors.New("malformed address record")
+			}
+			res = append(res, net.IP(rr.data))
+		}
+	}
+	return res, nil
+}
+
+func (l *secureLookuper) lookupTXT(name string) ([]string, error) {
+	rrs, err := exchange(l.server, name, typeTXT)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		// TXT record consists of length-prefixed strings joined together.
+		var b strings.Builder
+		for data := rr.data; len(data) != 0; {
+			l := int(data[0])
+			if len(data) < 1+l {
+				return nil, errors.New("malformed TXT record")
+			}
+			b.Write(data[1 : 1+l])
+			data = data[1+l:]
+		}
+		res = append(res, b.String())
+	}
+	return res, nil
+}
@@ -0,0 +1,191 @@
+package dnsdisc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeOPT  = 41
+
+	classIN = 1
+
+	flagRD = 0x0100
+	flagAD = 0x0020
+	flagTC = 0x0200
+
+	// DNSSEC OK bit in the OPT record TTL field.
+	flagDO = 0x8000
+
+	queryTimeout = 5 * time.Second
+)
+
+var ErrNotAuthenticated = errors.New("response is not DNSSEC-validated by the resolver")
+
+type rr struct {
+	typ  uint16
+	data []byte
+
+	// Message and offset of data, needed to decompress names in data.
+	msg    []byte
+	offset int
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func query(id uint16, name string, typ uint16) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flagRD|flagAD)
+	binary.BigEndian.PutUint16(msg[4:6], 1)   // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:12], 1) // ARCOUNT
+
+	msg = appendName(msg, name)
+	msg = append(msg, byte(typ>>8), byte(typ), 0, classIN)
+
+	// EDNS(0) OPT record with DO bit set.
+	msg = append(msg, 0)                  // root name
+	msg = append(msg, 0, typeOPT)         // type
+	msg = append(msg, 0x10, 0x00)         // UDP payload size 4096
+	msg = append(msg, 0, 0, flagDO>>8, 0) // extended rcode, version, flags
+	msg = append(msg, 0, 0)               // rdlength
+	return msg
+}
+
+// readName returns the (possibly compressed) name at off and the offset right
+// after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		end    = -1
+	)
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("malformed name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("malformed name")
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("name compression loop")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("malformed name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func parseResponse(msg []byte, id uint16, typ uint16) ([]rr, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short response")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != id {
+		return nil, errors.New("response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&flagTC != 0 {
+		return nil, errors.New("truncated response")
+	}
+	if rcode := flags & 0xF; rcode != 0 {
+		return nil, fmt.Errorf("query failed: rcode %d", rcode)
+	}
+	if flags&flagAD == 0 {
+		return nil, ErrNotAuthenticated
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(msg[4:6]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	var res []rr
+	for i := 0; i < anCount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errors.New("malformed record")
+		}
+		rrType := binary.BigEndian.Uint16(msg[off : off+2])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdLen > len(msg) {
+			return nil, errors.New("malformed record")
+		}
+		// CNAMEs and RRSIGs are skipped, the resolver follows the chain.
+		if rrType == typ {
+			res = append(res, rr{typ: rrType, data: msg[off : off+rdLen], msg: msg, offset: off})
+		}
+		off += rdLen
+	}
+	return res, nil
+}
+
+func exchange(server, name string, typ uint16) ([]rr, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	c, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(queryTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(query(id, name, typ)); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 4096)
+	n, err := c.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(buffer[:n], id, typ)
+}
@@ -0,0 +1,138 @@
+package dnspub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+type cloudflare struct {
+	zoneID string
+	token  string
+	client *http.Client
+}
+
+func newCloudflare(cfg Config) (Provider, error) {
+	if cfg.ZoneID == "" || cfg.APIToken == "" {
+		return nil, errors.New("dnspub: cloudflare: zone-id and api-token are required")
+	}
+	return &cloudflare{
+		zoneID: cfg.ZoneID,
+		token:  cfg.APIToken,
+		client: &http.Client{Timeout: ioTimeout},
+	}, nil
+}
+
+type cfRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+type cfResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (c *cloudflare) call(method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, cloudflareAPI+"/zones/"+c.zoneID+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var cfResp cfResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cfResp); err != nil {
+		return fmt.Errorf("%v: %w", resp.Status, err)
+	}
+	if !cfResp.Success {
+		msgs := make([]string, 0, len(cfResp.Errors))
+		for _, e := range cfResp.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("%v: %v", resp.Status, strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(cfResp.Result, result)
+	}
+	return nil
+}
+
+func (c *cloudflare) list(name string) ([]cfRecord, error) {
+	var records []cfRecord
+	if err := c.call("GET", "/dns_records?name="+url.QueryEscape(name), nil, &records); err != nil {
+		return nil, err
+	}
+	res := records[:0]
+	for _, r := range records {
+		if r.Type == "A" || r.Type == "AAAA" {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+func (c *cloudflare) Set(r Record, ttl time.Duration) error {
+	existing, err := c.list(r.Name)
+	if err != nil {
+		return fmt.Errorf("cloudflare: %w", err)
+	}
+	have := make(map[string]cfRecord, len(existing))
+	for _, rec := range existing {
+		have[rec.Content] = rec
+	}
+
+	want := make(map[string]bool, len(r.Addrs))
+	for _, a := range r.Addrs {
+		want[a.String()] = true
+		if _, ok := have[a.String()]; ok {
+			continue
+		}
+		typ := "AAAA"
+		if a.To4() != nil {
+			typ = "A"
+		}
+		rec := cfRecord{Type: typ, Name: r.Name, Content: a.String(), TTL: int(ttl.Seconds())}
+		if err := c.call("POST", "/dns_records", rec, nil); err != nil {
+			return fmt.Errorf("cloudflare: %w", err)
+		}
+	}
+	for content, rec := range have {
+		if want[content] {
+			continue
+		}
+		if err := c.call("DELETE", "/dns_records/"+rec.ID, nil, nil); err != nil {
+			return fmt.Errorf("cloudflare: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *cloudflare) Delete(name string) error {
+	return c.Set(Record{Name: name}, 0)
+}
@@ -0,0 +1,132 @@
+// Package dnspub publishes DNS records for clients in external DNS
+// providers.
+package dnspub
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// "rfc2136" or "cloudflare".
+	Provider string `toml:"provider"`
+
+	// Zone records are created in, client hostnames without the trailing dot
+	// are relative to it.
+	Zone string `toml:"zone"`
+	TTL  int    `toml:"ttl"`
+
+	// RFC 2136 server address (host:port) and TSIG key. The secret is
+	// base64-encoded, only hmac-sha256 is supported.
+	Server     string `toml:"server"`
+	TSIGKey    string `toml:"tsig-key"`
+	TSIGSecret string `toml:"tsig-secret"`
+
+	// Cloudflare zone ID and API token with DNS edit permission.
+	ZoneID   string `toml:"zone-id"`
+	APIToken string `toml:"api-token"`
+}
+
+func (c Config) Enabled() bool {
+	return c.Provider != ""
+}
+
+// Record is the set of addresses published for the name. Name is fully
+// qualified without the trailing dot.
+type Record struct {
+	Name  string
+	Addrs []net.IP
+}
+
+// Provider replaces and removes address records (A and AAAA) in the
+// external DNS.
+type Provider interface {
+	Set(r Record, ttl time.Duration) error
+	Delete(name string) error
+}
+
+func New(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case "rfc2136":
+		return newRFC2136(cfg)
+	case "cloudflare":
+		return newCloudflare(cfg)
+	default:
+		return nil, fmt.Errorf("dnspub: unknown provider: %v", cfg.Provider)
+	}
+}
+
+// FQDN returns the name for the hostname in the zone.
+func (c Config) FQDN(hostname string) string {
+	if strings.HasSuffix(hostname, ".") {
+		return strings.ToLower(strings.TrimSuffix(hostname, "."))
+	}
+	return strings.ToLower(hostname + "." + strings.Trim(c.Zone, "."))
+}
+
+func recordKey(r Record) string {
+	addrs := make([]string, 0, len(r.Addrs))
+	for _, a := range r.Addrs {
+		addrs = append(addrs, a.String())
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
+
+// Publisher keeps provider records in sync with the set of clients.
+type Publisher struct {
+	cfg Config
+	p   Provider
+
+	// Published records by name, used to skip unchanged records and to
+	// remove records of deleted clients.
+	published map[string]string
+}
+
+func NewPublisher(cfg Config) (*Publisher, error) {
+	p, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{cfg: cfg, p: p, published: map[string]string{}}, nil
+}
+
+// Sync publishes records and removes previously published ones that are
+// not in records anymore. Errors are logged, failed records are retried on
+// the next call.
+func (p *Publisher) Sync(records []Record) {
+	ttl := time.Duration(p.cfg.TTL) * time.Second
+	if ttl == 0 {
+		ttl = 5 * time.Minute
+	}
+
+	wanted := make(map[string]bool, len(records))
+	for _, r := range records {
+		wanted[r.Name] = true
+		key := recordKey(r)
+		if p.published[r.Name] == key {
+			continue
+		}
+		if err := p.p.Set(r, ttl); err != nil {
+			log.Printf("error: dnspub: %v: %v", r.Name, err)
+			continue
+		}
+		log.Printf("dnspub: published %v: %v", r.Name, key)
+		p.published[r.Name] = key
+	}
+	for name := range p.published {
+		if wanted[name] {
+			continue
+		}
+		if err := p.p.Delete(name); err != nil {
+			log.Printf("error: dnspub: %v: %v", name, err)
+			continue
+		}
+		log.Printf("dnspub: removed %v", name)
+		delete(p.published, name)
+	}
+}
@@ -0,0 +1,234 @@
+package dnspub
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typeSOA  = 6
+	typeAAAA = 28
+	typeTSIG = 250
+
+	classIN  = 1
+	classANY = 255
+
+	opcodeUpdate = 5
+
+	tsigAlgorithm = "hmac-sha256"
+	tsigFudge     = 300
+	ioTimeout     = 10 * time.Second
+)
+
+var rcodeNames = map[int]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+// rfc2136 sends DNS UPDATE messages over TCP signed using TSIG.
+type rfc2136 struct {
+	server  string
+	zone    string
+	keyName string
+	secret  []byte
+}
+
+func newRFC2136(cfg Config) (Provider, error) {
+	if cfg.Server == "" || cfg.Zone == "" {
+		return nil, errors.New("dnspub: rfc2136: server and zone are required")
+	}
+	p := &rfc2136{
+		server: cfg.Server,
+		zone:   strings.Trim(cfg.Zone, "."),
+	}
+	if cfg.TSIGKey != "" {
+		secret, err := base64.StdEncoding.DecodeString(cfg.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("dnspub: rfc2136: tsig-secret: %w", err)
+		}
+		p.keyName = strings.Trim(cfg.TSIGKey, ".")
+		p.secret = secret
+	}
+	return p, nil
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.ToLower(strings.Trim(name, ".")), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendRR(b []byte, name string, typ, class uint16, ttl uint32, rdata []byte) []byte {
+	b = appendName(b, name)
+	b = appendUint16(b, typ)
+	b = appendUint16(b, class)
+	b = appendUint32(b, ttl)
+	b = appendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+type update struct {
+	typ   uint16
+	class uint16
+	ttl   uint32
+	rdata []byte
+}
+
+func (p *rfc2136) message(id uint16, name string, updates []update) []byte {
+	msg := make([]byte, 0, 512)
+	msg = appendUint16(msg, id)
+	msg = appendUint16(msg, opcodeUpdate<<11)
+	msg = appendUint16(msg, 1)                    // ZOCOUNT
+	msg = appendUint16(msg, 0)                    // PRCOUNT
+	msg = appendUint16(msg, uint16(len(updates))) // UPCOUNT
+	msg = appendUint16(msg, 0)                    // ADCOUNT
+
+	msg = appendName(msg, p.zone)
+	msg = appendUint16(msg, typeSOA)
+	msg = appendUint16(msg, classIN)
+
+	for _, u := range updates {
+		msg = appendRR(msg, name, u.typ, u.class, u.ttl, u.rdata)
+	}
+	return msg
+}
+
+// sign appends the TSIG record (RFC 8945) to msg.
+func (p *rfc2136) sign(msg []byte, id uint16) []byte {
+	now := uint64(time.Now().Unix())
+	timeSigned := []byte{byte(now >> 40), byte(now >> 32), byte(now >> 24), byte(now >> 16), byte(now >> 8), byte(now)}
+
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(msg)
+	vars := appendName(nil, p.keyName)
+	vars = appendUint16(vars, classANY)
+	vars = appendUint32(vars, 0)
+	vars = appendName(vars, tsigAlgorithm)
+	vars = append(vars, timeSigned...)
+	vars = appendUint16(vars, tsigFudge)
+	vars = appendUint16(vars, 0) // Error
+	vars = appendUint16(vars, 0) // Other Len
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata := appendName(nil, tsigAlgorithm)
+	rdata = append(rdata, timeSigned...)
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = appendUint16(rdata, id)
+	rdata = appendUint16(rdata, 0) // Error
+	rdata = appendUint16(rdata, 0) // Other Len
+
+	signed := appendRR(msg, p.keyName, typeTSIG, classANY, 0, rdata)
+	binary.BigEndian.PutUint16(signed[10:12], 1) // ADCOUNT
+	return signed
+}
+
+func (p *rfc2136) exchange(name string, updates []update) error {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := p.message(id, name, updates)
+	if p.keyName != "" {
+		msg = p.sign(msg, id)
+	}
+
+	c, err := net.DialTimeout("tcp", p.server, ioTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(ioTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := c.Write(append(appendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return err
+	}
+
+	var lenBytes [2]byte
+	if _, err := io.ReadFull(c, lenBytes[:]); err != nil {
+		return err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(lenBytes[:]))
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if len(reply) < 12 {
+		return errors.New("short reply")
+	}
+	if binary.BigEndian.Uint16(reply[0:2]) != id {
+		return errors.New("reply ID mismatch")
+	}
+	if rcode := int(reply[3] & 0xF); rcode != 0 {
+		if name, ok := rcodeNames[rcode]; ok {
+			return fmt.Errorf("update refused: %v", name)
+		}
+		return fmt.Errorf("update refused: rcode %d", rcode)
+	}
+	return nil
+}
+
+func deleteAddrs() []update {
+	return []update{
+		{typ: typeA, class: classANY},
+		{typ: typeAAAA, class: classANY},
+	}
+}
+
+func (p *rfc2136) Set(r Record, ttl time.Duration) error {
+	updates := deleteAddrs()
+	for _, a := range r.Addrs {
+		if v4 := a.To4(); v4 != nil {
+			updates = append(updates, update{typ: typeA, class: classIN, ttl: uint32(ttl.Seconds()), rdata: v4})
+		} else {
+			updates = append(updates, update{typ: typeAAAA, class: classIN, ttl: uint32(ttl.Seconds()), rdata: a.To16()})
+		}
+	}
+	if err := p.exchange(r.Name, updates); err != nil {
+		return fmt.Errorf("rfc2136: %w", err)
+	}
+	return nil
+}
+
+func (p *rfc2136) Delete(name string) error {
+	if err := p.exchange(name, deleteAddrs()); err != nil {
+		return fmt.Errorf("rfc2136: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package doctor implements diagnostic checks for common misconfigurations
+// and missing prerequisites.
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusWarn
+	StatusFail
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusWarn:
+		return "warn"
+	case StatusFail:
+		return "FAIL"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
+type Finding struct {
+	Check   string
+	Status  Status
+	Message string
+	// Suggested action to resolve the problem. Empty for successful checks.
+	Hint string
+}
+
+type Report struct {
+	Findings []Finding
+}
+
+func (r *Report) Add(f Finding) {
+	r.Findings = append(r.Findings, f)
+}
+
+func (r *Report) OK(check, format string, args ...interface{}) {
+	r.Add(Finding{Check: check, Status: StatusOK, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) Warn(check, hint, format string, args ...interface{}) {
+	r.Add(Finding{Check: check, Status: StatusWarn, Message: fmt.Sprintf(format, args...), Hint: hint})
+}
+
+func (r *Report) Fail(check, hint, format string, args ...interface{}) {
+	r.Add(Finding{Check: check, Status: StatusFail, Message: fmt.Sprintf(format, args...), Hint: hint})
+}
+
+// Failed reports whether any of the checks failed.
+func (r Report) Failed() bool {
+	for _, f := range r.Findings {
+		if f.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Report) Print(w io.Writer) {
+	for _, f := range r.Findings {
+		fmt.Fprintf(w, "[%4s] %s: %s\n", f.Status, f.Check, f.Message)
+		if f.Hint != "" {
+			fmt.Fprintf(w, "       -> %s\n", f.Hint)
+		}
+	}
+}
+
+// CheckWireGuard verifies that WireGuard interfaces can be created either
+// using the kernel module or the userspace implementation.
+func CheckWireGuard(r *Report) {
+	if kernelWireGuard() {
+		r.OK("wireguard", "kernel module is available")
+		return
+	}
+	if path, err := exec.LookPath("wireguard-go"); err == nil {
+		r.OK("wireguard", "using userspace implementation at %v", path)
+		return
+	}
+	r.Fail("wireguard", wireGuardHint, "neither kernel module nor wireguard-go is available")
+}
+
+// CheckPrivileges verifies that the process is permitted to manage network
+// interfaces.
+func CheckPrivileges(r *Report) {
+	ok, err := canManageLinks()
+	if err != nil {
+		r.Warn("privileges", "", "cannot determine privileges: %v", err)
+		return
+	}
+	if !ok {
+		r.Fail("privileges", privilegesHint, "process is not permitted to manage network interfaces")
+		return
+	}
+	r.OK("privileges", "permitted to manage network interfaces")
+}
+
+// CheckClock verifies the system clock is plausibly correct.
+func CheckClock(r *Report) {
+	// Release date of the oldest supported version. WireGuard handshakes
+	// rely on the monotonic timestamps so badly wrong clock breaks
+	// reconnection after a restart.
+	minTime := time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC)
+	if time.Now().Before(minTime) {
+		r.Fail("clock", "set the system time or enable NTP", "system time (%v) is in the past", time.Now().Format(time.RFC3339))
+		return
+	}
+
+	synced, err := clockSynced()
+	if err != nil {
+		r.OK("clock", "system time is %v (synchronization status unknown)", time.Now().Format(time.RFC3339))
+		return
+	}
+	if !synced {
+		r.Warn("clock", "enable NTP synchronization (e.g. systemd-timesyncd or chrony)", "system clock is not synchronized")
+		return
+	}
+	r.OK("clock", "system clock is synchronized")
+}
+
+// CheckUDP checks whether UDP datagrams can be sent to the endpoint.
+//
+// Since WireGuard does not reply to unauthenticated packets, the check can
+// only detect the absence of route or explicit rejection (ICMP port
+// unreachable).
+func CheckUDP(r *Report, check string, endpoint *net.UDPAddr) {
+	c, err := net.DialUDP("udp", nil, endpoint)
+	if err != nil {
+		r.Fail(check, "check the routing table and the endpoint address", "%v: %v", endpoint, err)
+		return
+	}
+	defer c.Close()
+
+	// Write twice, ICMP error for the first datagram is reported on the
+	// next socket operation.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte{0}); err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				r.Fail(check, "make sure the server is running and the firewall permits the port",
+					"%v: port unreachable", endpoint)
+				return
+			}
+			r.Fail(check, "check the routing table and the firewall", "%v: %v", endpoint, err)
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(time.Second)); err == nil {
+		_, err := c.Read(make([]byte, 1))
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			r.Fail(check, "make sure the server is running and the firewall permits the port",
+				"%v: port unreachable", endpoint)
+			return
+		}
+	}
+	r.OK(check, "%v: reachable via %v (no rejection received)", endpoint, c.LocalAddr())
+}
@@ -0,0 +1,93 @@
+package doctor
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	wireGuardHint  = "load the kernel module (modprobe wireguard) or install wireguard-go"
+	privilegesHint = "run as root or grant CAP_NET_ADMIN capability"
+
+	capNetAdmin = 12
+
+	// From linux/timex.h, not exported by x/sys/unix.
+	timeError = 5
+	staUnsync = 0x40
+)
+
+func kernelWireGuard() bool {
+	_, err := os.Stat("/sys/module/wireguard")
+	return err == nil
+}
+
+func canManageLinks() (bool, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := scnr.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return false, err
+		}
+		return caps&(1<<capNetAdmin) != 0, nil
+	}
+	if err := scnr.Err(); err != nil {
+		return false, err
+	}
+	return false, errors.New("no CapEff in /proc/self/status")
+}
+
+func clockSynced() (bool, error) {
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		return false, err
+	}
+	return state != timeError && tx.Status&staUnsync == 0, nil
+}
+
+func readSysctl(path string) (string, error) {
+	val, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(val)), nil
+}
+
+// CheckForwarding verifies that IP forwarding is enabled for the address
+// families in use.
+func CheckForwarding(r *Report, v4, v6 bool) {
+	check := func(family, path, hint string) {
+		val, err := readSysctl(path)
+		if err != nil {
+			r.Warn("forwarding", "", "cannot check %v forwarding: %v", family, err)
+			return
+		}
+		if val != "1" {
+			r.Fail("forwarding", hint, "%v forwarding is disabled", family)
+			return
+		}
+		r.OK("forwarding", "%v forwarding is enabled", family)
+	}
+	if v4 {
+		check("IPv4", "/proc/sys/net/ipv4/ip_forward", "sysctl -w net.ipv4.ip_forward=1")
+	}
+	if v6 {
+		check("IPv6", "/proc/sys/net/ipv6/conf/all/forwarding", "sysctl -w net.ipv6.conf.all.forwarding=1")
+	}
+}
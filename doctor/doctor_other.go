@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package doctor
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	wireGuardHint  = "install wireguard-go (e.g. brew install wireguard-go)"
+	privilegesHint = "run as root"
+)
+
+func kernelWireGuard() bool {
+	return false
+}
+
+func canManageLinks() (bool, error) {
+	return os.Geteuid() == 0, nil
+}
+
+func clockSynced() (bool, error) {
+	return false, errors.New("not supported")
+}
+
+func CheckForwarding(r *Report, v4, v6 bool) {
+	r.Warn("forwarding", "make sure IP forwarding is enabled", "cannot check forwarding status on this platform")
+}
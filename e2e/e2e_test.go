@@ -0,0 +1,57 @@
+//go:build linux && e2e
+// +build linux,e2e
+
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestScenarios runs all scenarios with the wirebox binary built from the
+// tree, or the one in WBOX_E2E_BIN if set. Logs are kept if any scenario
+// fails.
+func TestScenarios(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "wbox-e2e-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			t.Log("logs are in", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}()
+
+	bin := os.Getenv("WBOX_E2E_BIN")
+	if bin == "" {
+		bin = filepath.Join(dir, "wirebox")
+		build := exec.Command("go", "build", "-o", bin, "github.com/foxcpp/wirebox/cmd/wirebox")
+		if out, err := build.CombinedOutput(); err != nil {
+			t.Fatalf("go build: %v\n%s", err, out)
+		}
+	}
+
+	opts := Options{
+		Binary:  bin,
+		Dir:     dir,
+		Timeout: 30 * time.Second,
+	}
+	for _, sc := range Scenarios {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			if err := Run(sc, opts); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Package e2e runs the wirebox server and client in separate network
+// namespaces connected by a veth pair and checks the tunnel they set up
+// using kernel WireGuard.
+//
+// Root privileges, the WireGuard kernel module and the ip utility are
+// required. Scenarios are executed by the wbox-e2e command.
+package e2e
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+// NetNS is the named network namespace created by 'ip netns add'.
+type NetNS struct {
+	Name string
+}
+
+// Path returns the path of the namespace file.
+func (ns NetNS) Path() string {
+	return "/run/netns/" + ns.Name
+}
+
+// Command returns the command running name with args in the namespace.
+func (ns NetNS) Command(name string, args ...string) *exec.Cmd {
+	return exec.Command("ip", append([]string{"netns", "exec", ns.Name, name}, args...)...)
+}
+
+// Manager creates the link manager operating on the namespace.
+func (ns NetNS) Manager() (linkmgr.Manager, error) {
+	return linkmgr.NewManagerNetNS(ns.Path())
+}
+
+// Underlay addresses of the veth pair connecting the namespaces.
+var (
+	underlayNet = net.IPNet{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)}
+	ServerAddr  = net.IPv4(198, 51, 100, 1)
+	ClientAddr  = net.IPv4(198, 51, 100, 2)
+)
+
+// Env is the pair of namespaces for the server and the client and the
+// directory for their configuration files and logs.
+type Env struct {
+	Server NetNS
+	Client NetNS
+	Dir    string
+}
+
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// NewEnv creates namespaces named after prefix and the veth pair between
+// them. Env.Close should be called to remove them.
+func NewEnv(prefix, dir string) (*Env, error) {
+	e := &Env{
+		Server: NetNS{Name: prefix + "-srv"},
+		Client: NetNS{Name: prefix + "-cl"},
+		Dir:    dir,
+	}
+	if err := e.setup(); err != nil {
+		e.Close()
+		return nil, fmt.Errorf("e2e: %w", err)
+	}
+	return e, nil
+}
+
+func (e *Env) setup() error {
+	for _, ns := range []NetNS{e.Server, e.Client} {
+		if err := ip("netns", "add", ns.Name); err != nil {
+			return err
+		}
+		if err := ip("-n", ns.Name, "link", "set", "lo", "up"); err != nil {
+			return err
+		}
+	}
+	if err := ip("link", "add", "veth0", "netns", e.Server.Name,
+		"type", "veth", "peer", "name", "veth0", "netns", e.Client.Name); err != nil {
+		return err
+	}
+
+	prefixLen, _ := underlayNet.Mask.Size()
+	for _, side := range []struct {
+		ns   NetNS
+		addr net.IP
+	}{
+		{e.Server, ServerAddr},
+		{e.Client, ClientAddr},
+	} {
+		addr := side.addr.String() + "/" + strconv.Itoa(prefixLen)
+		if err := ip("-n", side.ns.Name, "addr", "add", addr, "dev", "veth0"); err != nil {
+			return err
+		}
+		if err := ip("-n", side.ns.Name, "link", "set", "veth0", "up"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close removes the namespaces, links in them are removed by the kernel.
+func (e *Env) Close() error {
+	var firstErr error
+	for _, ns := range []NetNS{e.Server, e.Client} {
+		if _, err := os.Stat(ns.Path()); err != nil {
+			continue
+		}
+		if err := ip("netns", "del", ns.Name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,317 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Tunnel addresses assigned by the server configuration of scenarios.
+var (
+	Server4 = net.IPv4(192, 0, 2, 1)
+	Client4 = net.IPv4(192, 0, 2, 2)
+	Server6 = net.ParseIP("fd00:e2e::1")
+	Client6 = net.ParseIP("fd00:e2e::2")
+)
+
+const (
+	serverIf = "wbe2e"
+	clientIf = "wbe2e0"
+	portLow  = 12000
+)
+
+// Scenario is the server and the client configuration checked by Run.
+type Scenario struct {
+	Name string
+	Help string
+	// Use the shared server interface for all clients.
+	PtMP bool
+	// Additional TOML appended to generated configuration files, must not
+	// contain top-level options if it starts with a table.
+	Server string
+	Client string
+}
+
+// Scenarios is the list of scenarios executed by default.
+var Scenarios = []Scenario{
+	{
+		Name: "ptp",
+		Help: "separate server interface for the client",
+	},
+	{
+		Name: "ptmp",
+		Help: "shared server interface",
+		PtMP: true,
+	},
+}
+
+// Find returns the scenario with the specified name or nil.
+func Find(name string) *Scenario {
+	for i := range Scenarios {
+		if Scenarios[i].Name == name {
+			return &Scenarios[i]
+		}
+	}
+	return nil
+}
+
+// Options control how scenarios are executed.
+type Options struct {
+	// Path to the wirebox binary.
+	Binary string
+	// Directory for configuration files and logs of each scenario.
+	Dir string
+	// Time to wait for the server to start and the client to be configured.
+	Timeout time.Duration
+}
+
+// Run executes the scenario in fresh namespaces and returns the first failed
+// check. Logs of the server and the client are left in the scenario
+// directory.
+func Run(sc Scenario, opts Options) error {
+	dir := filepath.Join(opts.Dir, sc.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("%s: %w", sc.Name, err)
+	}
+	env, err := NewEnv(fmt.Sprintf("wbox-e2e-%d-%s", os.Getpid(), sc.Name), dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", sc.Name, err)
+	}
+	defer env.Close()
+
+	if err := run(env, sc, opts); err != nil {
+		return fmt.Errorf("%s: %w (logs in %s)", sc.Name, err, dir)
+	}
+	return nil
+}
+
+func run(env *Env, sc Scenario, opts Options) error {
+	srvKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	clKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+
+	srvCfg := filepath.Join(env.Dir, "wboxd.toml")
+	if err := writeConfig(srvCfg, serverConfig(sc, env.Dir, srvKey, clKey.PublicKey())); err != nil {
+		return err
+	}
+	clCfg := filepath.Join(env.Dir, "wbox.toml")
+	if err := writeConfig(clCfg, clientConfig(sc, env.Dir, clKey, srvKey.PublicKey())); err != nil {
+		return err
+	}
+
+	srv, err := startServer(env, opts, srvCfg)
+	if err != nil {
+		return err
+	}
+	defer srv.stop()
+
+	up := env.Client.Command(opts.Binary, "-config", clCfg, "up")
+	if err := runLogged(up, filepath.Join(env.Dir, "wbox.log"), opts.Timeout); err != nil {
+		return fmt.Errorf("client up: %w", err)
+	}
+
+	if err := checkClient(env, srvKey.PublicKey()); err != nil {
+		return err
+	}
+	for _, dst := range []net.IP{Server4, Server6} {
+		if err := pingFrom(env.Client, dst); err != nil {
+			return err
+		}
+	}
+	for _, dst := range []net.IP{Client4, Client6} {
+		if err := pingFrom(env.Server, dst); err != nil {
+			return err
+		}
+	}
+
+	down := env.Client.Command(opts.Binary, "-config", clCfg, "down")
+	if err := runLogged(down, filepath.Join(env.Dir, "wbox-down.log"), opts.Timeout); err != nil {
+		return fmt.Errorf("client down: %w", err)
+	}
+	m, err := env.Client.Manager()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if _, err := m.GetLink(clientIf); err == nil {
+		return fmt.Errorf("client link %s is not removed by down", clientIf)
+	}
+	return nil
+}
+
+func writeConfig(path, text string) error {
+	// Configuration files with keys should not be readable by others.
+	return ioutil.WriteFile(path, []byte(text), 0600)
+}
+
+func serverConfig(sc Scenario, dir string, key wgtypes.Key, client wgtypes.Key) string {
+	portHigh := portLow + 10
+	if sc.PtMP {
+		portHigh = portLow
+	}
+	return fmt.Sprintf(`private-key = %q
+if = %q
+ptmp = %v
+port-low = %d
+port-high = %d
+server4 = %q
+server6 = %q
+control-socket = %q
+
+[clients.%q]
+addrs = [ %q, %q ]
+`, key, serverIf, sc.PtMP, portLow, portHigh, Server4, Server6,
+		filepath.Join(dir, "wboxd.sock"), client.String(), Client4, Client6) + sc.Server
+}
+
+func clientConfig(sc Scenario, dir string, key wgtypes.Key, server wgtypes.Key) string {
+	return fmt.Sprintf(`if = %q
+private-key = %q
+server-key = %q
+config-endpoint = %q
+control-socket = %q
+`, clientIf, key, server, net.JoinHostPort(ServerAddr.String(), fmt.Sprint(portLow)),
+		filepath.Join(dir, "wbox.sock")) + sc.Client
+}
+
+// server is the running server process.
+type server struct {
+	cmd    *exec.Cmd
+	exited chan error
+}
+
+// startServer runs the server in its namespace and waits until it creates
+// the control socket, which is done after it starts serving.
+func startServer(env *Env, opts Options, cfgPath string) (*server, error) {
+	logFile, err := os.Create(filepath.Join(env.Dir, "wboxd.log"))
+	if err != nil {
+		return nil, err
+	}
+	cmd := env.Server.Command(opts.Binary, "server", "-config", cfgPath, "-debug", "run")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	srv := &server{cmd: cmd, exited: make(chan error, 1)}
+	go func() {
+		srv.exited <- cmd.Wait()
+		logFile.Close()
+	}()
+
+	sock := filepath.Join(env.Dir, "wboxd.sock")
+	deadline := time.After(opts.Timeout)
+	for {
+		if _, err := os.Stat(sock); err == nil {
+			return srv, nil
+		}
+		select {
+		case err := <-srv.exited:
+			return nil, fmt.Errorf("server exited: %v", err)
+		case <-deadline:
+			cmd.Process.Kill()
+			<-srv.exited
+			return nil, fmt.Errorf("server is not ready in %v", opts.Timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// stop terminates the server so it removes its links.
+func (srv *server) stop() {
+	// 'ip netns exec' replaces itself with the server, so the signal is
+	// delivered to it.
+	srv.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-srv.exited:
+	case <-time.After(10 * time.Second):
+		srv.cmd.Process.Kill()
+		<-srv.exited
+	}
+}
+
+// runLogged runs cmd writing its output to logPath and kills it after
+// timeout.
+func runLogged(cmd *exec.Cmd, logPath string, timeout time.Duration) error {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(timeout, func() { cmd.Process.Kill() })
+	runErr := cmd.Wait()
+	timer.Stop()
+	if err := ioutil.WriteFile(logPath, out.Bytes(), 0600); err != nil {
+		return err
+	}
+	return runErr
+}
+
+// checkClient verifies addresses and the WireGuard peer of the client link.
+func checkClient(env *Env, srvPub wgtypes.Key) error {
+	m, err := env.Client.Manager()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	l, err := m.GetLink(clientIf)
+	if err != nil {
+		return fmt.Errorf("client link: %w", err)
+	}
+	addrs, err := l.Addrs()
+	if err != nil {
+		return fmt.Errorf("client link: %w", err)
+	}
+	for _, want := range []net.IP{Client4, Client6} {
+		if !hasAddr(addrs, want) {
+			return fmt.Errorf("client link: address %v is not assigned", want)
+		}
+	}
+
+	dev, err := l.WGConfig()
+	if err != nil {
+		return fmt.Errorf("client link: %w", err)
+	}
+	if len(dev.Peers) != 1 || dev.Peers[0].PublicKey != srvPub {
+		return fmt.Errorf("client link: expected the server as the only peer, got %d peers", len(dev.Peers))
+	}
+	if endp := dev.Peers[0].Endpoint; endp == nil || !endp.IP.Equal(ServerAddr) {
+		return fmt.Errorf("client link: peer endpoint is %v, expected %v", endp, ServerAddr)
+	}
+	return nil
+}
+
+func hasAddr(addrs []linkmgr.Address, ip net.IP) bool {
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pingFrom checks that dst answers ICMP echo requests sent from ns.
+func pingFrom(ns NetNS, dst net.IP) error {
+	out, err := ns.Command("ping", "-c", "3", "-W", "2", dst.String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ping %v from %s: %w: %s", dst, ns.Name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package wirebox
+
+import (
+	"errors"
+	"fmt"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+var (
+	// ErrNoConfig is returned when the server has no configuration for the
+	// client public key.
+	ErrNoConfig = errors.New("no configuration for the peer")
+
+	// ErrPoolExhausted is returned when there are no more addresses left in
+	// the dynamic allocation pool.
+	ErrPoolExhausted = errors.New("address pool exhausted")
+
+	// ErrUpgradeRequired is returned when the server refuses the client
+	// version or capabilities.
+	ErrUpgradeRequired = errors.New("client upgrade required")
+
+	// ErrSelfTestFailed is returned by the client if the tunnel is configured
+	// but does not pass traffic.
+	ErrSelfTestFailed = errors.New("self-test failed")
+
+	// ErrOutsideSchedule is returned when the client access is not permitted
+	// at this time.
+	ErrOutsideSchedule = errors.New("access outside of schedule")
+
+	// ErrQuotaExceeded is returned when the client is disconnected after
+	// exceeding its transfer quota.
+	ErrQuotaExceeded = errors.New("transfer quota exceeded")
+
+	// ErrRedirected is returned when the server refers the client to another
+	// server.
+	ErrRedirected = errors.New("redirected to another server")
+
+	// ErrConflict is returned when addresses of the client conflict with
+	// another client.
+	ErrConflict = errors.New("conflicting peer configuration")
+
+	// ErrPolicyDenied is returned when the configuration is refused by the
+	// server policy rules.
+	ErrPolicyDenied = errors.New("denied by server policy")
+)
+
+// ErrNackRefused is returned by the client if the server replied with NACK
+// to the configuration solictation.
+type ErrNackRefused struct {
+	Code        wboxproto.Nack_Code
+	Description string
+}
+
+func (err ErrNackRefused) Error() string {
+	return fmt.Sprintf("server refused to give us config: %v (%v)", err.Description, err.Code)
+}
+
+func (err ErrNackRefused) Is(target error) bool {
+	switch target {
+	case ErrNoConfig:
+		return err.Code == wboxproto.Nack_NO_CONFIG
+	case ErrUpgradeRequired:
+		return err.Code == wboxproto.Nack_UPGRADE_REQUIRED
+	case ErrOutsideSchedule:
+		return err.Code == wboxproto.Nack_OUTSIDE_SCHEDULE
+	case ErrQuotaExceeded:
+		return err.Code == wboxproto.Nack_QUOTA_EXCEEDED
+	case ErrRedirected:
+		return err.Code == wboxproto.Nack_REDIRECT
+	case ErrConflict:
+		return err.Code == wboxproto.Nack_CONFLICT
+	case ErrPolicyDenied:
+		return err.Code == wboxproto.Nack_POLICY_DENIED
+	}
+	return false
+}
+
+// NackError converts the received NACK message into ErrNackRefused.
+func NackError(nack *wboxproto.Nack) ErrNackRefused {
+	return ErrNackRefused{
+		Code:        nack.GetCode(),
+		Description: string(nack.GetDescription()),
+	}
+}
@@ -0,0 +1,262 @@
+// Package errreport implements opt-in reporting of panics and fatal errors to
+// a Sentry-compatible service.
+//
+// Events are sent to the store endpoint of the project described by the DSN.
+// Messages and stack traces are scrubbed of WireGuard keys before they leave
+// the host.
+package errreport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// Sentry DSN, e.g. https://PUBLIC-KEY@sentry.example.org/1. The
+	// SENTRY_DSN environment variable is used if empty, reporting is
+	// disabled if neither is set.
+	DSN string `toml:"dsn"`
+	// Environment name attached to events, e.g. "production".
+	Environment string `toml:"environment"`
+}
+
+// sendTimeout limits the time spent sending the event, the process is usually
+// about to exit.
+const sendTimeout = 5 * time.Second
+
+// Reporter sends events to the service.
+//
+// nil *Reporter is valid and discards events.
+type Reporter struct {
+	endpoint string
+	auth     string
+	service  string
+	release  string
+	env      string
+	client   *http.Client
+}
+
+// New creates the Reporter for the DSN in the configuration or in the
+// environment. release is the version of the reporting program.
+//
+// nil Reporter is returned if reporting is disabled.
+func New(cfg Config, service, release string) (*Reporter, error) {
+	dsn := cfg.DSN
+	if dsn == "" {
+		dsn = os.Getenv("SENTRY_DSN")
+	}
+	if dsn == "" {
+		return nil, nil
+	}
+
+	endpoint, auth, err := parseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error reporting: %w", err)
+	}
+	return &Reporter{
+		endpoint: endpoint,
+		auth:     auth + ", sentry_client=wirebox/" + release,
+		service:  service,
+		release:  release,
+		env:      cfg.Environment,
+		client:   &http.Client{Timeout: sendTimeout},
+	}, nil
+}
+
+// parseDSN returns the store endpoint and the X-Sentry-Auth header value
+// without the client name.
+func parseDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", "", errors.New("DSN should use http or https scheme")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("DSN has no public key")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if _, err := strconv.ParseUint(project, 10, 64); err != nil {
+		return "", "", errors.New("DSN has no project ID")
+	}
+
+	auth := "Sentry sentry_version=7, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	endpoint := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   u.Path[:i] + "/api/" + project + "/store/",
+	}
+	return endpoint.String(), auth, nil
+}
+
+// keyRe matches base64-encoded 32-byte keys.
+var keyRe = regexp.MustCompile(`[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=`)
+
+// Scrub replaces WireGuard keys in s.
+func Scrub(s string) string {
+	return keyRe.ReplaceAllString(s, "[key]")
+}
+
+type frame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+type stacktrace struct {
+	Frames []frame `json:"frames"`
+}
+
+type exception struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+}
+
+type message struct {
+	Formatted string `json:"formatted"`
+}
+
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	Message     *message          `json:"message,omitempty"`
+	Exception   *struct {
+		Values []exception `json:"values"`
+	} `json:"exception,omitempty"`
+}
+
+func (r *Reporter) newEvent(level string) event {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Println("error reporting: cannot generate event ID:", err)
+	}
+	return event{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       level,
+		Platform:    "go",
+		Logger:      r.service,
+		Release:     r.service + "@" + r.release,
+		Environment: r.env,
+		Tags: map[string]string{
+			"os":   runtime.GOOS,
+			"arch": runtime.GOARCH,
+			"go":   runtime.Version(),
+		},
+	}
+}
+
+// Error reports the error that makes the program exit, e.g. the configuration
+// failure.
+func (r *Reporter) Error(err error) {
+	if r == nil || err == nil {
+		return
+	}
+	ev := r.newEvent("error")
+	ev.Message = &message{Formatted: Scrub(err.Error())}
+	r.send(ev)
+}
+
+// Recover reports the panic and panics again so the program still crashes
+// with the usual trace. It should be deferred by the main function and
+// long-running goroutines:
+//
+//	defer reporter.Recover()
+func (r *Reporter) Recover() {
+	if r == nil {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+	ev := r.newEvent("fatal")
+	ev.Exception = &struct {
+		Values []exception `json:"values"`
+	}{Values: []exception{{
+		Type:       "panic",
+		Value:      Scrub(fmt.Sprint(v)),
+		Stacktrace: &stacktrace{Frames: parseStack(debug.Stack())},
+	}}}
+	r.send(ev)
+	panic(v)
+}
+
+// parseStack converts the goroutine trace into frames, the outermost call
+// first as Sentry expects. Arguments are dropped, they can contain secrets.
+func parseStack(stack []byte) []frame {
+	lines := strings.Split(string(stack), "\n")
+	var frames []frame
+	// The first line is the goroutine header, then function and location
+	// lines follow in pairs.
+	for i := 1; i+1 < len(lines); i += 2 {
+		fn := lines[i]
+		if paren := strings.LastIndex(fn, "("); paren > 0 {
+			fn = fn[:paren]
+		}
+		loc := strings.TrimSpace(lines[i+1])
+		if sp := strings.LastIndex(loc, " +0x"); sp > 0 {
+			loc = loc[:sp]
+		}
+		f := frame{Function: fn, Filename: loc}
+		if colon := strings.LastIndex(loc, ":"); colon > 0 {
+			f.Filename = loc[:colon]
+			f.Lineno, _ = strconv.Atoi(loc[colon+1:])
+		}
+		frames = append(frames, f)
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+func (r *Reporter) send(ev event) {
+	blob, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("error reporting:", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(blob))
+	if err != nil {
+		log.Println("error reporting:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		log.Println("error reporting:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("error reporting: unexpected status:", resp.Status)
+	}
+}
@@ -0,0 +1,314 @@
+package wirebox
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+// Event is implemented by all lifecycle events emitted by the client and the
+// server.
+type Event interface {
+	EventName() string
+}
+
+// LinkCreated is emitted when a new WireGuard interface is created.
+type LinkCreated struct {
+	Link string
+}
+
+func (LinkCreated) EventName() string { return "link-created" }
+
+// CfgReceived is emitted by the client when the server replies with
+// configuration.
+type CfgReceived struct {
+	Link string
+	Cfg  *wboxproto.Cfg
+}
+
+func (CfgReceived) EventName() string { return "cfg-received" }
+
+// RouteInstalled is emitted when a route is added to the WireGuard interface.
+type RouteInstalled struct {
+	Link  string
+	Route linkmgr.Route
+}
+
+func (RouteInstalled) EventName() string { return "route-installed" }
+
+// HandshakeEstablished is emitted once the communication with the peer over
+// the configuration tunnel is confirmed to work and the configuration is
+// sent (on the server) or received (on the client).
+type HandshakeEstablished struct {
+	Link string
+	Peer PeerKey
+}
+
+func (HandshakeEstablished) EventName() string { return "handshake-established" }
+
+// Teardown is emitted when the interface is removed.
+type Teardown struct {
+	Link string
+}
+
+func (Teardown) EventName() string { return "teardown" }
+
+// TunnelUp is emitted by the client when the tunnel is fully configured or
+// recovers from the degraded state.
+type TunnelUp struct {
+	Link string
+}
+
+func (TunnelUp) EventName() string { return "tunnel-up" }
+
+// TunnelDegraded is emitted when the tunnel is configured but does not work
+// as expected.
+type TunnelDegraded struct {
+	Link   string
+	Reason string
+}
+
+func (TunnelDegraded) EventName() string { return "tunnel-degraded" }
+
+// TunnelPaused is emitted by the client when tunnel routes are removed so
+// the captive portal of the local network can be reached.
+type TunnelPaused struct {
+	Link string
+	// Portal URL if the probe was redirected.
+	Portal string `json:",omitempty"`
+}
+
+func (TunnelPaused) EventName() string { return "tunnel-paused" }
+
+// TunnelResumed is emitted by the client when tunnel routes are restored
+// after the pause.
+type TunnelResumed struct {
+	Link string
+}
+
+func (TunnelResumed) EventName() string { return "tunnel-resumed" }
+
+// TunnelIdle is emitted by the client in the on-demand mode when the session
+// is stopped because no traffic passes the tunnel. TunnelUp is emitted once
+// it is started again.
+type TunnelIdle struct {
+	Link string
+}
+
+func (TunnelIdle) EventName() string { return "tunnel-idle" }
+
+// MeteredChanged is emitted by the client when the uplink used to reach the
+// server becomes metered or stops being metered.
+type MeteredChanged struct {
+	Link    string
+	Uplink  string
+	Metered bool
+}
+
+func (MeteredChanged) EventName() string { return "metered-changed" }
+
+// Reconfigured is emitted by the client when the new configuration is applied
+// to the already existing tunnel.
+type Reconfigured struct {
+	Link string
+}
+
+func (Reconfigured) EventName() string { return "reconfigured" }
+
+// CfgApplied is emitted by the client once the received configuration is
+// applied to the tunnel.
+type CfgApplied struct {
+	Link string
+	// Serial of the configuration, 0 if the server does not set it.
+	Serial uint64
+}
+
+func (CfgApplied) EventName() string { return "cfg-applied" }
+
+// ConfigFailed is emitted by the client when the tunnel cannot be
+// configured.
+type ConfigFailed struct {
+	Link  string
+	Error string
+}
+
+func (ConfigFailed) EventName() string { return "config-failed" }
+
+// ServerMessage is emitted by the client when the configuration carries a
+// new message from the server operator.
+type ServerMessage struct {
+	Link    string
+	Message string
+}
+
+func (ServerMessage) EventName() string { return "server-message" }
+
+type Listener interface {
+	HandleEvent(Event)
+}
+
+type ListenerFunc func(Event)
+
+func (f ListenerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// ChanListener returns the Listener that sends all events to the channel.
+// Events are dropped if the channel is not ready to accept them so slow
+// consumer cannot block the configuration process.
+func ChanListener(ch chan<- Event) Listener {
+	return ListenerFunc(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+}
+
+// EventBus delivers events to all subscribed listeners synchronously in the
+// subscription order.
+//
+// nil *EventBus is valid and discards all events.
+type EventBus struct {
+	lock      sync.RWMutex
+	listeners []Listener
+}
+
+func (b *EventBus) Subscribe(l Listener) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.listeners = append(b.listeners, l)
+}
+
+func (b *EventBus) Emit(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, l := range b.listeners {
+		l.HandleEvent(e)
+	}
+}
+
+// PeerPathChanged is emitted by the client when traffic to another client
+// switches between the direct tunnel, the relay on the server and the path
+// via server.
+type PeerPathChanged struct {
+	Link     string
+	Peer     string
+	Direct   bool
+	Relayed  bool   `json:",omitempty"`
+	Endpoint string `json:",omitempty"`
+	Reason   string `json:",omitempty"`
+}
+
+func (PeerPathChanged) EventName() string { return "peer-path-changed" }
+
+// PeerAccessChanged is emitted by the server when the client is blocked
+// outside of its access schedule or over its quota, or permitted again.
+type PeerAccessChanged struct {
+	Link      string
+	Peer      string
+	Permitted bool
+	// Reason the client is blocked: outside-schedule or quota-exceeded.
+	Reason string `json:",omitempty"`
+}
+
+func (PeerAccessChanged) EventName() string { return "peer-access-changed" }
+
+// QuotaExceeded is emitted by the server when the client transfers more than
+// its quota permits in the current period.
+type QuotaExceeded struct {
+	Link   string
+	Peer   string
+	Used   uint64
+	Limit  uint64
+	Action string
+}
+
+func (QuotaExceeded) EventName() string { return "quota-exceeded" }
+
+// PeerConflict is emitted by the server when it detects clients whose
+// configuration or behavior makes traffic to some of them go elsewhere, see
+// the Kind values in wboxserver.
+type PeerConflict struct {
+	Kind        string
+	Peers       []string
+	Addr        string `json:",omitempty"`
+	Description string
+}
+
+func (PeerConflict) EventName() string { return "peer-conflict" }
+
+// EndpointChanged is emitted by the client when it switches to another
+// tunnel endpoint suggested by the server.
+type EndpointChanged struct {
+	Link     string
+	Endpoint string
+	Region   string `json:",omitempty"`
+}
+
+func (EndpointChanged) EventName() string { return "endpoint-changed" }
+
+// RoleChanged is emitted by the server when the warm standby is promoted to
+// serve clients or demoted back.
+type RoleChanged struct {
+	Standby bool
+	// Why the role changed: manual or health-check.
+	Reason string
+}
+
+func (RoleChanged) EventName() string { return "role-changed" }
+
+// EventRecord is the event kept by EventLog.
+type EventRecord struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	// Event fields serialized as JSON.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// EventLog is the Listener that keeps recent events, e.g. for display in the
+// status dashboard.
+type EventLog struct {
+	lock sync.Mutex
+	ring []EventRecord
+	next int
+	full bool
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{ring: make([]EventRecord, size)}
+}
+
+func (l *EventLog) HandleEvent(e Event) {
+	rec := EventRecord{Time: time.Now(), Name: e.EventName()}
+	if data, err := json.Marshal(e); err == nil {
+		rec.Data = data
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.ring[l.next] = rec
+	l.next = (l.next + 1) % len(l.ring)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Recent returns kept events, oldest first.
+func (l *EventLog) Recent() []EventRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var res []EventRecord
+	if l.full {
+		res = append(res, l.ring[l.next:]...)
+	}
+	return append(res, l.ring[:l.next]...)
+}
@@ -0,0 +1,212 @@
+// Package eventstream writes lifecycle events as newline-delimited JSON for
+// consumption by supervisors and sidecars.
+//
+// Each line is the wirebox.EventRecord of one event:
+//
+//	{"time":"2021-03-01T12:00:00Z","name":"tunnel-up","data":{"Link":"wbox0"}}
+package eventstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+)
+
+const (
+	queueSize    = 64
+	writeTimeout = 5 * time.Second
+)
+
+// consumer receives encoded events in background so a slow reader cannot
+// block the configuration process. Events are dropped if it falls behind.
+type consumer struct {
+	queue   chan []byte
+	dropped bool
+}
+
+// Stream is the wirebox.Listener that writes events to stdout or to all
+// clients connected to the Unix socket.
+type Stream struct {
+	lock      sync.Mutex
+	consumers map[*consumer]struct{}
+	closed    bool
+
+	l  *net.UnixListener
+	wg sync.WaitGroup
+}
+
+// Open starts the stream described by target: "-" for stdout or
+// "unix:PATH" for the socket created at PATH.
+func Open(target string) (*Stream, error) {
+	s := &Stream{consumers: make(map[*consumer]struct{})}
+	switch {
+	case target == "-":
+		s.attach(nopCloser{os.Stdout})
+	case strings.HasPrefix(target, "unix:"):
+		l, err := listen(strings.TrimPrefix(target, "unix:"))
+		if err != nil {
+			return nil, fmt.Errorf("event stream: %w", err)
+		}
+		s.l = l
+		s.wg.Add(1)
+		go s.serve()
+	default:
+		return nil, fmt.Errorf("event stream: unknown target %v, expected - or unix:PATH", target)
+	}
+	return s, nil
+}
+
+// listen creates the socket replacing the stale one left by a crashed
+// process. The socket is accessible only to the owner.
+func listen(path string) (*net.UnixListener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is used by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *Stream) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.AcceptUnix()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		s.attach(c)
+	}
+}
+
+type deadlineWriter interface {
+	io.WriteCloser
+	SetWriteDeadline(time.Time) error
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (s *Stream) attach(w io.WriteCloser) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		w.Close()
+		return
+	}
+	c := &consumer{queue: make(chan []byte, queueSize)}
+	s.consumers[c] = struct{}{}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer w.Close()
+		for line := range c.queue {
+			if dw, ok := w.(deadlineWriter); ok {
+				dw.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if _, err := w.Write(line); err != nil {
+				// Disconnected socket clients are removed, stdout is kept
+				// so events are delivered once it is writable again.
+				if _, ok := w.(nopCloser); !ok {
+					s.detach(c)
+					// Drain so the emitter does not block on the queue.
+					for range c.queue {
+					}
+					return
+				}
+				log.Println("error: event stream:", err)
+			}
+		}
+	}()
+}
+
+func (s *Stream) detach(c *consumer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.consumers[c]; ok {
+		delete(s.consumers, c)
+		close(c.queue)
+	}
+}
+
+func (s *Stream) HandleEvent(e wirebox.Event) {
+	rec := wirebox.EventRecord{Time: time.Now(), Name: e.EventName()}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("error: event stream:", err)
+		return
+	}
+	rec.Data = data
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Println("error: event stream:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.consumers {
+		select {
+		case c.queue <- line:
+			c.dropped = false
+		default:
+			if !c.dropped {
+				log.Println("WARNING: event stream: consumer is too slow, dropping events")
+				c.dropped = true
+			}
+		}
+	}
+}
+
+// Close stops accepting connections, flushes queued events and removes the
+// socket.
+func (s *Stream) Close() error {
+	var err error
+	if s.l != nil {
+		err = s.l.Close()
+	}
+
+	s.lock.Lock()
+	s.closed = true
+	for c := range s.consumers {
+		delete(s.consumers, c)
+		close(c.queue)
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return err
+}
@@ -1,14 +1,31 @@
 module github.com/foxcpp/wirebox
 
-go 1.14
+go 1.19
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/golang/protobuf v1.4.1
+	github.com/golang/protobuf v1.5.3
+	github.com/google/cel-go v0.17.8
 	github.com/jsimonetti/rtnetlink v0.0.0-20200505065535-3ee32e7e21a4
-	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37 // indirect
-	golang.org/x/net v0.0.0-20200513185701-a91f0712d120 // indirect
-	golang.org/x/sys v0.0.0-20200513112337-417ce2331b5c
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/mdlayher/netlink v1.1.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.14.0
 	golang.zx2c4.com/wireguard v0.0.20200320
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200514021741-d71503c3ca55
+	google.golang.org/protobuf v1.30.0
+	gopkg.in/yaml.v2 v2.3.0
+)
+
+require (
+	github.com/antlr/antlr4/runtime/Go/antlr/v4 v4.0.0-20230305170008-8188dc5388df // indirect
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/mdlayher/genetlink v1.0.0 // indirect
+	github.com/stoewer/go-strcase v1.2.0 // indirect
+	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e // indirect
+	golang.org/x/term v0.14.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20230525234035-dd9d682886f9 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230525234030-28d5490b6b19 // indirect
 )
@@ -0,0 +1,200 @@
+// Package hostsfile maintains the block of entries managed by the client in
+// the hosts file.
+//
+// The block is delimited by marker comments that include the interface name
+// so several tunnels can share the file. Lines outside of the block are
+// never changed.
+package hostsfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/wirebox"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+const DefaultPath = "/etc/hosts"
+
+type Config struct {
+	Enable bool   `toml:"enable"`
+	Path   string `toml:"path"`
+}
+
+// Entry maps the name to addresses of the peer.
+type Entry struct {
+	Name  string
+	Addrs []net.IP
+}
+
+// Entries extracts host entries pushed by the server.
+func Entries(cfg *wboxproto.Cfg) []Entry {
+	res := make([]Entry, 0, len(cfg.GetHosts()))
+	for _, h := range cfg.GetHosts() {
+		if h.GetName() == "" {
+			continue
+		}
+		e := Entry{Name: h.GetName()}
+		for _, a := range h.GetAddrs4() {
+			e.Addrs = append(e.Addrs, wboxproto.IPv4(a))
+		}
+		for _, a := range h.GetAddrs6() {
+			e.Addrs = append(e.Addrs, a.AsIP())
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func markers(link string) (begin, end string) {
+	return "# BEGIN wirebox " + link, "# END wirebox " + link
+}
+
+// replaceBlock returns contents with the block for link replaced by lines.
+// The block is removed if lines is empty and appended if it does not exist
+// yet.
+func replaceBlock(contents []byte, link string, lines []string) ([]byte, error) {
+	begin, end := markers(link)
+
+	var (
+		out     bytes.Buffer
+		inBlock bool
+		written bool
+	)
+	writeBlock := func() {
+		written = true
+		if len(lines) == 0 {
+			return
+		}
+		out.WriteString(begin + "\n")
+		for _, l := range lines {
+			out.WriteString(l + "\n")
+		}
+		out.WriteString(end + "\n")
+	}
+
+	for _, l := range strings.SplitAfter(string(contents), "\n") {
+		if l == "" {
+			continue
+		}
+		trimmed := strings.TrimSpace(l)
+		switch {
+		case trimmed == begin:
+			inBlock = true
+		case inBlock && trimmed == end:
+			inBlock = false
+			if !written {
+				writeBlock()
+			}
+		case inBlock:
+		default:
+			out.WriteString(l)
+			if !strings.HasSuffix(l, "\n") {
+				out.WriteString("\n")
+			}
+		}
+	}
+	if inBlock {
+		// Do not drop the rest of the file edited by hand.
+		return nil, fmt.Errorf("%q without %q", begin, end)
+	}
+	if !written {
+		writeBlock()
+	}
+	return out.Bytes(), nil
+}
+
+func formatEntries(entries []Entry) []string {
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		for _, a := range e.Addrs {
+			lines = append(lines, a.String()+"\t"+e.Name)
+		}
+	}
+	return lines
+}
+
+// Update replaces the block for link with entries. An empty entries list
+// removes the block.
+func Update(path, link string, entries []Entry) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("hostsfile: %w", err)
+	}
+	updated, err := replaceBlock(contents, link, formatEntries(entries))
+	if err != nil {
+		return fmt.Errorf("hostsfile: %v: %w", path, err)
+	}
+	if bytes.Equal(updated, contents) {
+		return nil
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	// Write to the temporary file in the same directory and rename it so
+	// resolvers never see a partially written file.
+	tmp := path + ".wirebox-tmp"
+	if err := ioutil.WriteFile(tmp, updated, mode); err != nil {
+		return fmt.Errorf("hostsfile: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("hostsfile: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the block for link.
+func Remove(path, link string) error {
+	return Update(path, link, nil)
+}
+
+// Integration is the wirebox.Listener that keeps the hosts file block in
+// sync with the configuration received from the server.
+type Integration struct {
+	path string
+
+	lock    sync.Mutex
+	entries map[string][]Entry
+}
+
+func New(cfg Config) *Integration {
+	path := cfg.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	return &Integration{path: path, entries: map[string][]Entry{}}
+}
+
+func (i *Integration) HandleEvent(e wirebox.Event) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var err error
+	switch e := e.(type) {
+	case wirebox.CfgReceived:
+		// Applied only once the tunnel is up so names do not resolve to
+		// addresses that are not reachable yet.
+		i.entries[e.Link] = Entries(e.Cfg)
+	case wirebox.TunnelUp:
+		err = Update(i.path, e.Link, i.entries[e.Link])
+	case wirebox.Reconfigured:
+		err = Update(i.path, e.Link, i.entries[e.Link])
+	case wirebox.Teardown:
+		delete(i.entries, e.Link)
+		err = Remove(i.path, e.Link)
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
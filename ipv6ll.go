@@ -1,8 +1,12 @@
 package wirebox
 
 import (
+	"crypto/sha256"
+	"errors"
 	"math/big"
 	"net"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
 )
 
 // IPv6LLForClient generates the IPv6 link-local client will use for
@@ -33,3 +37,68 @@ func IPv6LLForClient(publicKey PeerKey) net.IP {
 	}
 	return res
 }
+
+// IPv6LLSalted is the alternative to IPv6LLForClient that hashes the public
+// key together with the deployment-specific salt.
+//
+// It is still not collision-safe, but salt can be changed to get a different
+// mapping if collision happens in the deployment.
+func IPv6LLSalted(publicKey PeerKey, salt []byte) net.IP {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(publicKey.Bytes[:])
+	sum := h.Sum(nil)
+
+	res := net.ParseIP("fe80::")
+	copy(res[2:], sum)
+	return res
+}
+
+// ConfigAddr returns the link-local address for the configuration tunnel
+// derived using the specified scheme.
+func ConfigAddr(publicKey PeerKey, scheme wboxproto.AddrScheme, salt []byte) net.IP {
+	switch scheme {
+	case wboxproto.AddrScheme_SALTED_SHA256:
+		return IPv6LLSalted(publicKey, salt)
+	default:
+		return IPv6LLForClient(publicKey)
+	}
+}
+
+// ConfigAddrs4 is the number of addresses ConfigAddr4 maps keys to.
+const ConfigAddrs4 = 254 * 256
+
+// ConfigAddr4 returns the IPv4 link-local address (169.254.0.0/16) for the
+// configuration tunnel, used by clients with IPv6 disabled instead of
+// ConfigAddr.
+//
+// Only ConfigAddrs4 addresses are available, so collisions are likely with
+// more than about a hundred clients (birthday bound). The salt can be changed
+// to get a different mapping, but not to avoid collisions for all clients.
+func ConfigAddr4(publicKey PeerKey, salt []byte) net.IP {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(publicKey.Bytes[:])
+	sum := h.Sum(nil)
+
+	// The first and the last /24 are reserved by RFC 3927. The cloud
+	// metadata service address is avoided too.
+	res := net.IPv4(169, 254, 1+sum[0]%254, sum[1]).To4()
+	if res.Equal(SolictIPv4) || res.Equal(net.IPv4(169, 254, 169, 254)) {
+		res[3] ^= 1
+	}
+	return res
+}
+
+// ParseAddrScheme converts the address scheme name used in the configuration
+// files into the protocol value.
+func ParseAddrScheme(name string) (wboxproto.AddrScheme, error) {
+	switch name {
+	case "", "truncated":
+		return wboxproto.AddrScheme_TRUNCATED, nil
+	case "salted":
+		return wboxproto.AddrScheme_SALTED_SHA256, nil
+	default:
+		return 0, errors.New("unknown address scheme: " + name)
+	}
+}
@@ -0,0 +1,52 @@
+package wirebox
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ErrKeyPerms is returned by CheckKeyPerms if the file with the private key
+// can be accessed by other users.
+var ErrKeyPerms = errors.New("private key file is accessible by other users")
+
+// Values for key-permissions options.
+const (
+	// KeyPermsStrict refuses to use keys from files accessible by other users,
+	// like ssh does.
+	KeyPermsStrict = "strict"
+	// KeyPermsWarn only logs a warning.
+	KeyPermsWarn = "warn"
+)
+
+// ValidKeyPerms reports whether the value of key-permissions option is
+// known, empty value means KeyPermsStrict.
+func ValidKeyPerms(policy string) bool {
+	switch policy {
+	case "", KeyPermsStrict, KeyPermsWarn:
+		return true
+	}
+	return false
+}
+
+// CheckKeyPerms checks that the file containing a private key is not
+// accessible by group or others. With KeyPermsWarn policy, the problem is
+// logged and nil is returned.
+func CheckKeyPerms(path, policy string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("key perms: %w", err)
+	}
+	perm := info.Mode().Perm()
+	if perm&0077 == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("key perms: %s has mode %#o, run 'chmod 600 %s': %w", path, perm, path, ErrKeyPerms)
+	if policy == KeyPermsWarn {
+		log.Println("WARNING:", err)
+		return nil
+	}
+	return err
+}
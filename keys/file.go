@@ -0,0 +1,54 @@
+package keys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/foxcpp/wirebox"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// File stores the base64-encoded key in a file only accessible by the
+// owner.
+type File struct {
+	Path string
+	// key-permissions policy, see wirebox.CheckKeyPerms.
+	Perms string
+}
+
+func (f File) Load() (wgtypes.Key, error) {
+	blob, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return wgtypes.Key{}, notExist(err)
+	}
+	defer zero(blob)
+	if err := wirebox.CheckKeyPerms(f.Path, f.Perms); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("keys: %w", err)
+	}
+	return parseKey(blob)
+}
+
+func (f File) Store(key wgtypes.Key) error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+		return fmt.Errorf("keys: %w", err)
+	}
+	out, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return ErrExists
+		}
+		return fmt.Errorf("keys: %w", err)
+	}
+	if _, err := fmt.Fprintln(out, key.String()); err != nil {
+		out.Close()
+		os.Remove(f.Path)
+		return fmt.Errorf("keys: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(f.Path)
+		return fmt.Errorf("keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/foxcpp/wirebox/audit"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keychainService is the service name of generic password items storing
+// keys.
+const keychainService = "wirebox"
+
+// Keychain stores the key as a generic password item in the macOS system
+// keychain using security(1).
+//
+// Secure Enclave keys cannot be used since it supports only P-256 and
+// WireGuard needs Curve25519.
+type Keychain struct {
+	Account string
+}
+
+func (k Keychain) Load() (wgtypes.Key, error) {
+	if runtime.GOOS != "darwin" {
+		return wgtypes.Key{}, errors.New("keys: keychain: only supported on macOS")
+	}
+
+	cmd := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", k.Account, "-w")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// errSecItemNotFound
+		if strings.Contains(stderr.String(), "could not be found") {
+			return wgtypes.Key{}, ErrNoKey
+		}
+		return wgtypes.Key{}, fmt.Errorf("keys: keychain: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	defer zero(out)
+	return parseKey(out)
+}
+
+func (k Keychain) Store(key wgtypes.Key) error {
+	if runtime.GOOS != "darwin" {
+		return errors.New("keys: keychain: only supported on macOS")
+	}
+
+	// Commands are passed via stdin of the interactive mode so the key does
+	// not appear in the process arguments.
+	cmd := exec.Command("security", "-i")
+	cmdline := fmt.Sprintf("add-generic-password -s %s -a %q -w %s\n", keychainService, k.Account, key.String())
+	cmd.Stdin = strings.NewReader(cmdline)
+	audit.Record("exec", "security -i (stdin: add-generic-password -s %s -a %q)", keychainService, k.Account)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("keys: keychain: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// security -i reports errors of commands but exits with 0.
+	if strings.Contains(string(out), "already exists") {
+		return ErrExists
+	}
+	if len(bytes.TrimSpace(out)) != 0 {
+		return fmt.Errorf("keys: keychain: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
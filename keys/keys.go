@@ -0,0 +1,115 @@
+// Package keys implements storage backends for the WireGuard private key.
+//
+// WireGuard needs the raw Curve25519 key to perform handshakes, so backends
+// protect the key at rest only: it is kept in memory while the tunnel is
+// configured and then handed to the kernel or wireguard-go.
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Backend kinds accepted by Open.
+const (
+	KindFile     = "file"
+	KindTPM2     = "tpm2"
+	KindKeychain = "keychain"
+)
+
+// ErrNoKey is returned by Backend.Load if no key is stored yet.
+var ErrNoKey = errors.New("keys: no key stored")
+
+// ErrExists is returned by Backend.Store if the key was stored concurrently.
+var ErrExists = errors.New("keys: key already exists")
+
+type Backend interface {
+	// Load returns the stored key or ErrNoKey.
+	Load() (wgtypes.Key, error)
+	// Store saves the key. It should not replace the existing key.
+	Store(wgtypes.Key) error
+}
+
+// Open returns the backend of the specified kind storing the key at
+// location. Meaning of location depends on the backend: the key file path
+// for "file", the path prefix of the sealed object files for "tpm2" and the
+// item account name for "keychain". perms is the key-permissions policy
+// used by the file backend.
+func Open(kind, location, perms string) (Backend, error) {
+	switch kind {
+	case "", KindFile:
+		return File{Path: location, Perms: perms}, nil
+	case KindTPM2:
+		return TPM2{Path: location}, nil
+	case KindKeychain:
+		return Keychain{Account: location}, nil
+	default:
+		return nil, fmt.Errorf("keys: unknown backend: %v", kind)
+	}
+}
+
+// ValidKind reports whether kind is accepted by Open.
+func ValidKind(kind string) bool {
+	switch kind {
+	case "", KindFile, KindTPM2, KindKeychain:
+		return true
+	}
+	return false
+}
+
+// LoadOrGenerate returns the key stored in b, generating and storing a new
+// one if there is none.
+func LoadOrGenerate(b Backend) (key wgtypes.Key, generated bool, err error) {
+	key, err = b.Load()
+	if err == nil {
+		return key, false, nil
+	}
+	if !errors.Is(err, ErrNoKey) {
+		return wgtypes.Key{}, false, err
+	}
+
+	key, err = wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, false, fmt.Errorf("keys: %w", err)
+	}
+	if err := b.Store(key); err != nil {
+		if errors.Is(err, ErrExists) {
+			// Concurrent first runs should agree on the key.
+			key, err = b.Load()
+			return key, false, err
+		}
+		return wgtypes.Key{}, false, err
+	}
+	return key, true, nil
+}
+
+func parseKey(blob []byte) (wgtypes.Key, error) {
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(blob)))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("keys: %w", err)
+	}
+	return key, nil
+}
+
+func notExist(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNoKey
+	}
+	return fmt.Errorf("keys: %w", err)
+}
+
+// Zero overwrites the key, it should be called once the key is no longer
+// needed.
+func Zero(key *wgtypes.Key) {
+	zero(key[:])
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
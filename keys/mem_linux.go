@@ -0,0 +1,22 @@
+package keys
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// LockMemory prevents the key from being swapped out and excludes the memory
+// of the process from core dumps. Only the pages holding the key are locked,
+// locking everything (mlockall) would run into RLIMIT_MEMLOCK as the daemon
+// keeps allocating.
+func LockMemory(key *wgtypes.Key) error {
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("keys: lock memory: %w", err)
+	}
+	if err := unix.Mlock(key[:]); err != nil {
+		return fmt.Errorf("keys: lock memory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package keys
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// LockMemory is not implemented on this platform.
+func LockMemory(key *wgtypes.Key) error {
+	return errors.New("keys: lock memory: not supported on this platform")
+}
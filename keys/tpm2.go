@@ -0,0 +1,119 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxcpp/wirebox/audit"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// TPM2 seals the key to the TPM using tpm2-tools. Only the sealed object
+// (Path.pub and Path.priv) is stored on disk, it can be unsealed only by the
+// same TPM.
+//
+// The object is created under the primary key of the owner hierarchy, which
+// is derived from the TPM seed, so the primary key does not need to be
+// persisted.
+type TPM2 struct {
+	Path string
+}
+
+func (t TPM2) Load() (wgtypes.Key, error) {
+	if _, err := os.Stat(t.Path + ".priv"); err != nil {
+		return wgtypes.Key{}, notExist(err)
+	}
+
+	dir, err := ioutil.TempDir("", "wirebox-tpm2-")
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("keys: tpm2: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := filepath.Join(dir, "primary.ctx")
+	if _, err := tpm2(nil, "tpm2_createprimary", "-Q", "-C", "o", "-c", primary); err != nil {
+		return wgtypes.Key{}, err
+	}
+	obj := filepath.Join(dir, "key.ctx")
+	if _, err := tpm2(nil, "tpm2_load", "-Q", "-C", primary, "-u", t.Path+".pub", "-r", t.Path+".priv", "-c", obj); err != nil {
+		return wgtypes.Key{}, err
+	}
+	raw, err := tpm2(nil, "tpm2_unseal", "-c", obj)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	defer zero(raw)
+
+	if len(raw) != wgtypes.KeyLen {
+		return wgtypes.Key{}, fmt.Errorf("keys: tpm2: unsealed %d bytes, want %d", len(raw), wgtypes.KeyLen)
+	}
+	var key wgtypes.Key
+	copy(key[:], raw)
+	return key, nil
+}
+
+func (t TPM2) Store(key wgtypes.Key) error {
+	if _, err := os.Stat(t.Path + ".priv"); err == nil {
+		return ErrExists
+	}
+	if err := os.MkdirAll(filepath.Dir(t.Path), 0700); err != nil {
+		return fmt.Errorf("keys: tpm2: %w", err)
+	}
+
+	// Create the object next to the destination so it can be moved into
+	// place without copying.
+	dir, err := ioutil.TempDir(filepath.Dir(t.Path), ".wirebox-tpm2-")
+	if err != nil {
+		return fmt.Errorf("keys: tpm2: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := filepath.Join(dir, "primary.ctx")
+	if _, err := tpm2(nil, "tpm2_createprimary", "-Q", "-C", "o", "-c", primary); err != nil {
+		return err
+	}
+	pub, priv := filepath.Join(dir, "key.pub"), filepath.Join(dir, "key.priv")
+	// The key is passed via stdin and never written to disk.
+	if _, err := tpm2(key[:], "tpm2_create", "-Q", "-C", primary, "-i", "-", "-u", pub, "-r", priv); err != nil {
+		return err
+	}
+
+	// .pub without .priv is left by the interrupted Store and does not match
+	// the new object, so it is replaced.
+	if err := os.Rename(pub, t.Path+".pub"); err != nil {
+		return fmt.Errorf("keys: tpm2: %w", err)
+	}
+	// .priv is linked last and is the marker of the complete object.
+	if err := os.Link(priv, t.Path+".priv"); err != nil {
+		if os.IsExist(err) {
+			return ErrExists
+		}
+		return fmt.Errorf("keys: tpm2: %w", err)
+	}
+	return nil
+}
+
+func tpm2(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	audit.Command(cmd)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("keys: tpm2: %s: %s", name, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("keys: tpm2: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package linkmgr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func auditAddr(a Address) string {
+	s := "addr " + a.IPNet.String()
+	if a.Peer != nil {
+		s += " peer " + a.Peer.String()
+	}
+	if a.Scope != 0 {
+		s += fmt.Sprintf(" scope %d", a.Scope)
+	}
+	if a.Flags != 0 {
+		s += fmt.Sprintf(" flags %#x", uint32(a.Flags))
+	}
+	return s
+}
+
+func auditNeigh(n Neighbor) string {
+	s := "to " + n.IP.String()
+	if n.Proxy {
+		return "proxy " + s
+	}
+	if n.HWAddr != nil {
+		s += " lladdr " + n.HWAddr.String()
+	}
+	if n.State != 0 {
+		s += fmt.Sprintf(" nud %#x", int(n.State))
+	}
+	return s
+}
+
+func auditRoute(r Route) string {
+	s := "dst " + r.Dest.String()
+	if r.Type != RouteUnicast {
+		s = r.Type.String() + " " + s
+	}
+	if r.Src != nil {
+		s += " src " + r.Src.String()
+	}
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Table != 0 {
+		s += " table " + strconv.Itoa(r.Table)
+	}
+	if r.Protocol != 0 {
+		s += " proto " + strconv.Itoa(r.Protocol)
+	}
+	if r.Scope != 0 {
+		s += " scope " + strconv.Itoa(int(r.Scope))
+	}
+	return s
+}
+
+func auditRule(r Rule) string {
+	s := "inet"
+	if r.IPv6 {
+		s = "inet6"
+	}
+	s += " priority " + strconv.Itoa(r.Priority)
+	if r.Mark != 0 {
+		if r.Invert {
+			s += " not"
+		}
+		s += fmt.Sprintf(" fwmark %#x", r.Mark)
+	}
+	s += " table " + strconv.Itoa(r.Table)
+	if r.SuppressDefault {
+		s += " suppress_prefixlength 0"
+	}
+	return s
+}
+
+// auditWG formats the WireGuard configuration change. Private and preshared
+// keys are replaced with "(set)" or "(cleared)".
+func auditWG(c wgtypes.Config) string {
+	var b strings.Builder
+	if c.PrivateKey != nil {
+		b.WriteString(" private-key (set)")
+	}
+	if c.ListenPort != nil {
+		fmt.Fprintf(&b, " listen-port %d", *c.ListenPort)
+	}
+	if c.FirewallMark != nil {
+		fmt.Fprintf(&b, " fwmark %d", *c.FirewallMark)
+	}
+	if c.ReplacePeers {
+		b.WriteString(" replace-peers")
+	}
+	for _, p := range c.Peers {
+		fmt.Fprintf(&b, " peer %v", p.PublicKey)
+		switch {
+		case p.Remove:
+			b.WriteString(" remove")
+			continue
+		case p.UpdateOnly:
+			b.WriteString(" update-only")
+		}
+		if p.PresharedKey != nil {
+			if *p.PresharedKey == (wgtypes.Key{}) {
+				b.WriteString(" preshared-key (cleared)")
+			} else {
+				b.WriteString(" preshared-key (set)")
+			}
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&b, " endpoint %v", p.Endpoint)
+		}
+		if p.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&b, " keepalive %v", *p.PersistentKeepaliveInterval)
+		}
+		if p.ReplaceAllowedIPs {
+			b.WriteString(" replace-allowed-ips")
+		}
+		if len(p.AllowedIPs) != 0 {
+			ips := make([]string, len(p.AllowedIPs))
+			for i, ip := range p.AllowedIPs {
+				ips[i] = ip.String()
+			}
+			fmt.Fprintf(&b, " allowed-ips %s", strings.Join(ips, ","))
+		}
+	}
+	return strings.TrimPrefix(b.String(), " ")
+}
@@ -0,0 +1,238 @@
+package linkmgr
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// IP Helper functions operating on MIB rows, see netioapi.h. Struct layouts
+// follow the C ones with explicit padding so they match on 386 too.
+
+var (
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procInitializeUnicastIpAddressEntry = modiphlpapi.NewProc("InitializeUnicastIpAddressEntry")
+	procCreateUnicastIpAddressEntry     = modiphlpapi.NewProc("CreateUnicastIpAddressEntry")
+	procDeleteUnicastIpAddressEntry     = modiphlpapi.NewProc("DeleteUnicastIpAddressEntry")
+	procGetUnicastIpAddressTable        = modiphlpapi.NewProc("GetUnicastIpAddressTable")
+	procInitializeIpForwardEntry        = modiphlpapi.NewProc("InitializeIpForwardEntry")
+	procCreateIpForwardEntry2           = modiphlpapi.NewProc("CreateIpForwardEntry2")
+	procDeleteIpForwardEntry2           = modiphlpapi.NewProc("DeleteIpForwardEntry2")
+	procGetIpForwardTable2              = modiphlpapi.NewProc("GetIpForwardTable2")
+	procGetBestRoute2                   = modiphlpapi.NewProc("GetBestRoute2")
+	procFreeMibTable                    = modiphlpapi.NewProc("FreeMibTable")
+	procConvertInterfaceIndexToLuid     = modiphlpapi.NewProc("ConvertInterfaceIndexToLuid")
+	procConvertInterfaceLuidToIndex     = modiphlpapi.NewProc("ConvertInterfaceLuidToIndex")
+)
+
+const (
+	errObjectExists = windows.Errno(5010) // ERROR_OBJECT_ALREADY_EXISTS
+	errNotFound     = windows.Errno(1168) // ERROR_NOT_FOUND
+)
+
+const (
+	// MIB_IPPROTO_NETMGMT, origin of routes added by management tools.
+	protoNetMgmt = 3
+
+	// NL_DAD_STATE values.
+	dadTentative  = 1
+	dadDeprecated = 3
+	dadPreferred  = 4
+)
+
+// netioErr converts NETIO_STATUS to the error. Codes checked by callers on
+// Linux are mapped to the same syscall errors.
+func netioErr(r uintptr) error {
+	switch err := windows.Errno(r); err {
+	case 0:
+		return nil
+	case errObjectExists:
+		return syscall.EEXIST
+	case errNotFound:
+		return syscall.ESRCH
+	default:
+		return err
+	}
+}
+
+// rawSockaddrInet is SOCKADDR_INET, the union of sockaddr_in and
+// sockaddr_in6.
+type rawSockaddrInet struct {
+	Family uint16
+	// sin_port, sin_addr for IPv4; sin6_port, sin6_flowinfo, sin6_addr,
+	// sin6_scope_id for IPv6.
+	data [26]byte
+}
+
+func sockaddrInet(ip net.IP) rawSockaddrInet {
+	var sa rawSockaddrInet
+	if ip4 := ip.To4(); ip4 != nil {
+		sa.Family = windows.AF_INET
+		copy(sa.data[2:6], ip4)
+		return sa
+	}
+	sa.Family = windows.AF_INET6
+	copy(sa.data[6:22], ip.To16())
+	return sa
+}
+
+func (sa *rawSockaddrInet) IP() net.IP {
+	switch sa.Family {
+	case windows.AF_INET:
+		return net.IPv4(sa.data[2], sa.data[3], sa.data[4], sa.data[5]).To4()
+	case windows.AF_INET6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.data[6:22])
+		return ip
+	}
+	return nil
+}
+
+// mibUnicastIPAddressRow is MIB_UNICASTIPADDRESS_ROW.
+type mibUnicastIPAddressRow struct {
+	Address            rawSockaddrInet
+	_                  [4]byte
+	InterfaceLUID      uint64
+	InterfaceIndex     uint32
+	PrefixOrigin       uint32
+	SuffixOrigin       uint32
+	ValidLifetime      uint32
+	PreferredLifetime  uint32
+	OnLinkPrefixLength uint8
+	SkipAsSource       uint8
+	_                  [2]byte
+	DadState           uint32
+	ScopeID            uint32
+	CreationTimeStamp  int64
+}
+
+type mibUnicastIPAddressTable struct {
+	NumEntries uint32
+	_          [4]byte
+	Table      [1]mibUnicastIPAddressRow
+}
+
+// ipAddressPrefix is IP_ADDRESS_PREFIX.
+type ipAddressPrefix struct {
+	Prefix       rawSockaddrInet
+	PrefixLength uint8
+	_            [3]byte
+}
+
+// mibIPforwardRow2 is MIB_IPFORWARD_ROW2.
+type mibIPforwardRow2 struct {
+	InterfaceLUID        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    ipAddressPrefix
+	NextHop              rawSockaddrInet
+	SitePrefixLength     uint8
+	_                    [3]byte
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             uint8
+	AutoconfigureAddress uint8
+	Publish              uint8
+	Immortal             uint8
+	Age                  uint32
+	Origin               uint32
+}
+
+type mibIPforwardTable2 struct {
+	NumEntries uint32
+	_          [4]byte
+	Table      [1]mibIPforwardRow2
+}
+
+func newUnicastIPAddressRow() *mibUnicastIPAddressRow {
+	row := &mibUnicastIPAddressRow{}
+	procInitializeUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(row)))
+	return row
+}
+
+func createUnicastIPAddressEntry(row *mibUnicastIPAddressRow) error {
+	r, _, _ := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(row)))
+	return netioErr(r)
+}
+
+func deleteUnicastIPAddressEntry(row *mibUnicastIPAddressRow) error {
+	r, _, _ := procDeleteUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(row)))
+	return netioErr(r)
+}
+
+// unicastIPAddresses returns addresses of all interfaces.
+func unicastIPAddresses() ([]mibUnicastIPAddressRow, error) {
+	var t *mibUnicastIPAddressTable
+	r, _, _ := procGetUnicastIpAddressTable.Call(windows.AF_UNSPEC, uintptr(unsafe.Pointer(&t)))
+	if err := netioErr(r); err != nil {
+		return nil, err
+	}
+	defer procFreeMibTable.Call(uintptr(unsafe.Pointer(t)))
+
+	rows := make([]mibUnicastIPAddressRow, t.NumEntries)
+	copy(rows, (*[1 << 20]mibUnicastIPAddressRow)(unsafe.Pointer(&t.Table[0]))[:t.NumEntries:t.NumEntries])
+	return rows, nil
+}
+
+func newIPforwardRow2() *mibIPforwardRow2 {
+	row := &mibIPforwardRow2{}
+	procInitializeIpForwardEntry.Call(uintptr(unsafe.Pointer(row)))
+	return row
+}
+
+func createIPforwardEntry2(row *mibIPforwardRow2) error {
+	r, _, _ := procCreateIpForwardEntry2.Call(uintptr(unsafe.Pointer(row)))
+	return netioErr(r)
+}
+
+func deleteIPforwardEntry2(row *mibIPforwardRow2) error {
+	r, _, _ := procDeleteIpForwardEntry2.Call(uintptr(unsafe.Pointer(row)))
+	return netioErr(r)
+}
+
+// ipForwardTable returns routes of all interfaces.
+func ipForwardTable() ([]mibIPforwardRow2, error) {
+	var t *mibIPforwardTable2
+	r, _, _ := procGetIpForwardTable2.Call(windows.AF_UNSPEC, uintptr(unsafe.Pointer(&t)))
+	if err := netioErr(r); err != nil {
+		return nil, err
+	}
+	defer procFreeMibTable.Call(uintptr(unsafe.Pointer(t)))
+
+	rows := make([]mibIPforwardRow2, t.NumEntries)
+	copy(rows, (*[1 << 20]mibIPforwardRow2)(unsafe.Pointer(&t.Table[0]))[:t.NumEntries:t.NumEntries])
+	return rows, nil
+}
+
+// bestRoute returns the route and the source address used for packets to
+// dst.
+func bestRoute(dst net.IP) (mibIPforwardRow2, net.IP, error) {
+	var (
+		row mibIPforwardRow2
+		src rawSockaddrInet
+	)
+	dstAddr := sockaddrInet(dst)
+	r, _, _ := procGetBestRoute2.Call(0, 0, 0,
+		uintptr(unsafe.Pointer(&dstAddr)), 0,
+		uintptr(unsafe.Pointer(&row)), uintptr(unsafe.Pointer(&src)))
+	if err := netioErr(r); err != nil {
+		return mibIPforwardRow2{}, nil, err
+	}
+	return row, src.IP(), nil
+}
+
+func indexToLUID(index int) (uint64, error) {
+	var luid uint64
+	r, _, _ := procConvertInterfaceIndexToLuid.Call(uintptr(index), uintptr(unsafe.Pointer(&luid)))
+	return luid, netioErr(r)
+}
+
+func luidToIndex(luid uint64) (int, error) {
+	var index uint32
+	r, _, _ := procConvertInterfaceLuidToIndex.Call(uintptr(unsafe.Pointer(&luid)), uintptr(unsafe.Pointer(&index)))
+	return int(index), netioErr(r)
+}
@@ -1,22 +1,141 @@
 package linkmgr
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type AddrScope int
 
+// AddrFlags are flags of the address, e.g. AddrNoDAD.
+type AddrFlags uint32
+
 type Address struct {
 	net.IPNet
+	// The other end of the point-to-point address. The prefix length applies
+	// to it, Addrs returns the host mask for IPNet in this case.
 	Peer  *net.IPNet
 	Scope AddrScope
+	// Flags set by AddAddr. Addrs also returns ones set by the kernel, e.g.
+	// AddrPermanent or AddrTentative.
+	Flags AddrFlags
+	// Set for addresses added by wirebox, reported only for IPv4 addresses
+	// and by Linux 6.1 and newer for IPv6 ones.
+	Owned bool
 }
 
 type Route struct {
 	Dest net.IPNet
 	Src  net.IP
+	// Next hop, the destination is on-link if nil.
+	Gateway net.IP
+	// Routing table, the main one if zero.
+	Table int
+	// Origin of the route (rtm_protocol on Linux), routes are installed with
+	// RouteProto if zero.
+	Protocol int
+	// ScopeGlobal if zero.
+	Scope AddrScope
+	// RouteUnicast if zero. Routes of other types do not go via the link,
+	// so they are not returned by GetRoutes and ListRoutes.
+	Type RouteType
+}
+
+// RouteType is the kind of the route, other types than RouteUnicast drop
+// matching packets.
+type RouteType int
+
+const (
+	RouteUnicast RouteType = iota
+	// Silently drop packets.
+	RouteBlackhole
+	// Drop packets and reply with ICMP host unreachable.
+	RouteUnreachable
+	// Drop packets and reply with ICMP administratively prohibited.
+	RouteProhibit
+)
+
+func (t RouteType) String() string {
+	switch t {
+	case RouteUnicast:
+		return "unicast"
+	case RouteBlackhole:
+		return "blackhole"
+	case RouteUnreachable:
+		return "unreachable"
+	case RouteProhibit:
+		return "prohibit"
+	}
+	return "RouteType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// AllTables makes RouteFilter match routes of any table.
+const AllTables = -1
+
+// RouteFilter selects routes returned by RouteLister.
+type RouteFilter struct {
+	// Routing table, the main one if zero or any if AllTables.
+	Table int
+	// Origin of routes, e.g. RouteProto for routes installed by wirebox, any
+	// if zero.
+	Protocol int
+	// Only routes with one of these scopes are returned, any if empty.
+	Scopes []AddrScope
+}
+
+// RouteLister is implemented by links that can report routes of other tables
+// and their origin.
+type RouteLister interface {
+	ListRoutes(RouteFilter) ([]Route, error)
+}
+
+// Rule is the policy routing rule directing packets to the routing table.
+type Rule struct {
+	IPv6     bool
+	Priority int
+	// Only packets with the firewall mark (or without it if Invert is set)
+	// match, all packets match if Mark is zero.
+	Mark   uint32
+	Invert bool
+	Table  int
+	// Ignore default routes in Table so more specific routes from it are
+	// used and other packets continue to the next rule.
+	SuppressDefault bool
+}
+
+// RuleManager is implemented by managers that support policy routing.
+type RuleManager interface {
+	AddRule(Rule) error
+	DelRule(Rule) error
+}
+
+// Neighbor is the entry of the neighbor (ARP or NDP) table of the link.
+type Neighbor struct {
+	IP net.IP
+	// Link-layer address, nil for proxy entries and unresolved neighbors.
+	HWAddr net.HardwareAddr
+	// NeighPermanent is used by AddNeighbor if zero.
+	State NeighState
+	// Proxy entries make the host answer ARP and NDP requests for IP on the
+	// link (proxy ARP/NDP), e.g. for clients bridged into the LAN segment.
+	Proxy bool
+}
+
+// NeighState is the bitmask of neighbor states, e.g. NeighReachable.
+type NeighState int
+
+// NeighborManager is implemented by links that support access to the
+// neighbor table.
+type NeighborManager interface {
+	Neighbors() ([]Neighbor, error)
+	// AddNeighbor adds the entry or replaces the existing one for the same
+	// address.
+	AddNeighbor(Neighbor) error
+	DelNeighbor(Neighbor) error
 }
 
 type Link interface {
@@ -41,15 +160,85 @@ type Link interface {
 	DelRoute(Route) error
 }
 
+// RouteAdder is implemented by links that can install many routes faster
+// than by separate AddRoute calls.
+type RouteAdder interface {
+	AddRoutes(routes []Route, workers int) []error
+}
+
+// AddRoutes installs routes using up to workers concurrent requests if l
+// supports it. The returned slice contains the error for each route in the
+// same order, nil for installed routes.
+func AddRoutes(l Link, routes []Route, workers int) []error {
+	if ra, ok := l.(RouteAdder); ok {
+		return ra.AddRoutes(routes, workers)
+	}
+	errs := make([]error, len(routes))
+	for i, r := range routes {
+		errs[i] = l.AddRoute(r)
+	}
+	return errs
+}
+
+// RouteResult is the route selected for the destination by RouteGet.
+type RouteResult struct {
+	// Matching route, Dest is the destination host if the kernel cannot
+	// report the matched prefix. Src is the source address that is used.
+	Route
+	// Index of the outgoing interface, zero for routes that drop packets.
+	LinkIndex int
+}
+
 type Manager interface {
 	Links() ([]Link, error)
 	CreateLink(name string) (Link, error)
 	DelLink(indx int) error
 	GetLink(name string) (Link, error)
+	// RouteGet returns the route packets to dst are sent by.
+	RouteGet(dst net.IP) (RouteResult, error)
 
 	Close() error
 }
 
+// OwnedLink is implemented by links that can report whether the interface
+// was created by wirebox, so it can be removed safely if left over.
+type OwnedLink interface {
+	Owned() (bool, error)
+}
+
+// Tags of the state installed by wirebox, used to find it even if it is
+// left over after a crash.
 const (
 	RouteProto = 157
+	AddrProto  = RouteProto
+	// Appended to the interface name to get labels of IPv4 addresses.
+	AddrLabelSuffix = ":wb"
+	// Alias of created interfaces.
+	LinkAlias = "wirebox"
+)
+
+// Owned reports whether the route was installed by wirebox.
+func (r Route) Owned() bool {
+	return r.Protocol == RouteProto
+}
+
+var (
+	// ErrLinkExists is returned by Manager.CreateLink if the interface with
+	// the same name already exists.
+	ErrLinkExists = errors.New("link already exists")
 )
+
+var ErrNotWireguard = errors.New("named link is not a wireguard tunnel")
+
+type LinkError struct {
+	LinkName string
+	E        error
+}
+
+func (err LinkError) Error() string {
+	return fmt.Sprintf("link manager %s: %v", err.LinkName, err.E)
+}
+
+func (err LinkError) Unwrap() error {
+	return err.E
+}
@@ -0,0 +1,131 @@
+package linkmgr
+
+import (
+	"errors"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	NeighIncomplete NeighState = unix.NUD_INCOMPLETE
+	NeighReachable  NeighState = unix.NUD_REACHABLE
+	NeighStale      NeighState = unix.NUD_STALE
+	NeighDelay      NeighState = unix.NUD_DELAY
+	NeighProbe      NeighState = unix.NUD_PROBE
+	NeighFailed     NeighState = unix.NUD_FAILED
+	NeighNoARP      NeighState = unix.NUD_NOARP
+	NeighPermanent  NeighState = unix.NUD_PERMANENT
+)
+
+// The rtnetlink package is not used for neighbors since it cannot encode
+// proxy entries and sends the wrong message on delete.
+
+// neighMsg returns struct ndmsg followed by attributes for n.
+func neighMsg(indx int, n Neighbor) ([]byte, error) {
+	family := byte(unix.AF_INET6)
+	ip := n.IP
+	if v4 := n.IP.To4(); v4 != nil {
+		family = unix.AF_INET
+		ip = v4
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.NDA_DST, ip)
+	if n.HWAddr != nil && !n.Proxy {
+		ae.Bytes(unix.NDA_LLADDR, n.HWAddr)
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	state := n.State
+	if state == 0 {
+		state = NeighPermanent
+	}
+	data := make([]byte, unix.SizeofNdMsg, unix.SizeofNdMsg+len(attrs))
+	data[0] = family
+	nlenc.PutInt32(data[4:8], int32(indx))
+	nlenc.PutUint16(data[8:10], uint16(state))
+	if n.Proxy {
+		data[10] = unix.NTF_PROXY
+	}
+	return append(data, attrs...), nil
+}
+
+// parseNeighMsg parses the RTM_NEWNEIGH message.
+func parseNeighMsg(data []byte) (indx int, n Neighbor, err error) {
+	if len(data) < unix.SizeofNdMsg {
+		return 0, Neighbor{}, errors.New("short neighbor message")
+	}
+	indx = int(nlenc.Int32(data[4:8]))
+	n.State = NeighState(nlenc.Uint16(data[8:10]))
+	n.Proxy = data[10]&unix.NTF_PROXY != 0
+
+	ad, err := netlink.NewAttributeDecoder(data[unix.SizeofNdMsg:])
+	if err != nil {
+		return 0, Neighbor{}, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NDA_DST:
+			n.IP = net.IP(ad.Bytes())
+		case unix.NDA_LLADDR:
+			n.HWAddr = net.HardwareAddr(ad.Bytes())
+		}
+	}
+	return indx, n, ad.Err()
+}
+
+func (l rtnLink) Neighbors() ([]Neighbor, error) {
+	var neighs []Neighbor
+	// Proxy entries are dumped only if requested explicitly.
+	for _, flags := range []byte{0, unix.NTF_PROXY} {
+		req := make([]byte, unix.SizeofNdMsg)
+		req[10] = flags
+		msgs, err := l.mngr.request(unix.RTM_GETNEIGH, netlink.Dump, req)
+		if err != nil {
+			return nil, LinkError{l.iface.Name, err}
+		}
+		for _, m := range msgs {
+			indx, n, err := parseNeighMsg(m.Data)
+			if err != nil {
+				return nil, LinkError{l.iface.Name, err}
+			}
+			if indx != l.iface.Index || n.IP == nil {
+				continue
+			}
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func (l rtnLink) AddNeighbor(n Neighbor) error {
+	l.mngr.record("netlink", "RTM_NEWNEIGH dev %s %s", l.iface.Name, auditNeigh(n))
+	data, err := neighMsg(l.iface.Index, n)
+	if err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	if _, err := l.mngr.request(unix.RTM_NEWNEIGH, netlink.Create|netlink.Replace|netlink.Acknowledge, data); err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	return nil
+}
+
+func (l rtnLink) DelNeighbor(n Neighbor) error {
+	l.mngr.record("netlink", "RTM_DELNEIGH dev %s %s", l.iface.Name, auditNeigh(n))
+	data, err := neighMsg(l.iface.Index, n)
+	if err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	if _, err := l.mngr.request(unix.RTM_DELNEIGH, netlink.Acknowledge, data); err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	return nil
+}
+
+var _ NeighborManager = rtnLink{}
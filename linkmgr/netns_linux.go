@@ -0,0 +1,158 @@
+package linkmgr
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// NetNSPath returns the path of the network namespace file for spec, which
+// is either a process ID or a path (e.g. /run/netns/NAME).
+func NetNSPath(spec string) string {
+	if _, err := strconv.Atoi(spec); err == nil {
+		return "/proc/" + spec + "/ns/net"
+	}
+	return spec
+}
+
+// inNetNS runs f with the current thread switched to the network namespace
+// ns. Sockets created by f stay in that namespace.
+func inNetNS(ns *os.File, f func() error) error {
+	if ns == nil {
+		return f()
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return fmt.Errorf("netns: %w", err)
+	}
+	defer orig.Close()
+
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("netns: setns: %w", err)
+	}
+	fErr := f()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		// The thread is in the wrong namespace, keep it locked to this
+		// goroutine so the runtime does not schedule others on it.
+		runtime.LockOSThread()
+		return fmt.Errorf("netns: restore: %w", err)
+	}
+	return fErr
+}
+
+// InNetNS runs f in the network namespace of the manager m.
+func InNetNS(m Manager, f func() error) error {
+	rtnM, ok := m.(*rtnMngr)
+	if !ok {
+		return f()
+	}
+	return inNetNS(rtnM.ns, f)
+}
+
+// NewManagerNetNS creates the Manager that operates on links in the network
+// namespace at path.
+func NewManagerNetNS(path string) (Manager, error) {
+	ns, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("link mngr: %w", err)
+	}
+
+	m := &rtnMngr{ns: ns}
+	err = inNetNS(ns, func() error {
+		var err error
+		m.wg, err = wgctrl.New()
+		if err != nil {
+			return err
+		}
+		m.rtn, err = rtnetlink.Dial(nil)
+		if err != nil {
+			m.wg.Close()
+		}
+		return err
+	})
+	if err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("link mngr: %w", err)
+	}
+	return m, nil
+}
+
+// MoveLink moves the link with index indx to the network namespace of the
+// manager to. Addresses and routes are lost in the process, WireGuard
+// configuration is kept and its UDP socket stays in the original namespace.
+func MoveLink(from Manager, indx int, to Manager) error {
+	fromM, ok := from.(*rtnMngr)
+	if !ok {
+		return fmt.Errorf("link mngr: move link: unsupported manager")
+	}
+	toM, ok := to.(*rtnMngr)
+	if !ok {
+		return fmt.Errorf("link mngr: move link: unsupported manager")
+	}
+
+	var (
+		nsFd uint32
+		err  error
+	)
+	if toM.ns != nil {
+		nsFd = uint32(toM.ns.Fd())
+	} else {
+		self, err := os.Open("/proc/self/ns/net")
+		if err != nil {
+			return LinkError{strconv.Itoa(indx), err}
+		}
+		defer self.Close()
+		nsFd = uint32(self.Fd())
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(unix.IFLA_NET_NS_FD, nsFd)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return LinkError{strconv.Itoa(indx), err}
+	}
+
+	// struct ifinfomsg followed by attributes, rtnetlink.LinkMessage does not
+	// support IFLA_NET_NS_FD.
+	data := make([]byte, unix.SizeofIfInfomsg, unix.SizeofIfInfomsg+len(attrs))
+	data[0] = unix.AF_UNSPEC
+	nlenc.PutUint32(data[4:8], uint32(indx))
+	data = append(data, attrs...)
+
+	dest := "self"
+	if toM.ns != nil {
+		dest = toM.ns.Name()
+	}
+	fromM.record("netlink", "RTM_NEWLINK index %d to netns %s", indx, dest)
+	err = inNetNS(fromM.ns, func() error {
+		c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		_, err = c.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  unix.RTM_NEWLINK,
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: data,
+		})
+		return err
+	})
+	if err != nil {
+		return LinkError{strconv.Itoa(indx), err}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package linkmgr
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errNoNetNS = errors.New("network namespaces are not supported on windows")
+
+func NetNSPath(spec string) string {
+	return spec
+}
+
+// InNetNS runs f, there are no namespaces on Windows.
+func InNetNS(m Manager, f func() error) error {
+	return f()
+}
+
+func NewManagerNetNS(path string) (Manager, error) {
+	return nil, fmt.Errorf("link mngr: %w", errNoNetNS)
+}
+
+func MoveLink(from Manager, indx int, to Manager) error {
+	return fmt.Errorf("link mngr: move link: %w", errNoNetNS)
+}
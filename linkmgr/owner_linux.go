@@ -0,0 +1,115 @@
+package linkmgr
+
+import (
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/if_addr.h and linux/if_link.h, not defined in
+// x/sys/unix.
+const (
+	// Origin of the address, stored by Linux 6.1 and newer and ignored by
+	// older kernels.
+	ifaProto = 11
+
+	sizeofIfInfomsg = 16
+)
+
+// request sends the raw rtnetlink request in the namespace of the manager,
+// for attributes the rtnetlink package does not know about.
+func (m *rtnMngr) request(typ netlink.HeaderType, flags netlink.HeaderFlags, data []byte) ([]netlink.Message, error) {
+	var msgs []netlink.Message
+	err := inNetNS(m.ns, func() error {
+		c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		msgs, err = c.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  typ,
+				Flags: netlink.Request | flags,
+			},
+			Data: data,
+		})
+		return err
+	})
+	return msgs, err
+}
+
+// addrLabel returns the label of IPv4 addresses added to the interface, empty
+// if the name is too long for it.
+func addrLabel(ifName string) string {
+	label := ifName + AddrLabelSuffix
+	if len(label) >= unix.IFNAMSIZ {
+		return ""
+	}
+	return label
+}
+
+// ownedAddrMsg returns the RTM_NEWADDR payload with the address tagged with
+// AddrProto and, for IPv4, the label.
+func ownedAddrMsg(iface string, ifaceIndx int, a Address) ([]byte, error) {
+	msg := asAddrMsg(ifaceIndx, a)
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	if label := addrLabel(iface); msg.Family == unix.AF_INET && label != "" {
+		ae.String(unix.IFA_LABEL, label)
+	}
+	ae.Uint8(ifaProto, AddrProto)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, attrs...), nil
+}
+
+// ifInfoMsg returns struct ifinfomsg selecting the interface by index.
+func ifInfoMsg(indx int) []byte {
+	b := make([]byte, sizeofIfInfomsg)
+	nlenc.PutInt32(b[4:8], int32(indx))
+	return b
+}
+
+// tagLink sets the alias of the interface to LinkAlias.
+func (m *rtnMngr) tagLink(indx int) error {
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFALIAS, LinkAlias)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+	m.record("netlink", "RTM_NEWLINK index %d alias %s", indx, LinkAlias)
+	_, err = m.request(unix.RTM_NEWLINK, netlink.Acknowledge, append(ifInfoMsg(indx), attrs...))
+	return err
+}
+
+func (l rtnLink) Owned() (bool, error) {
+	msgs, err := l.mngr.request(unix.RTM_GETLINK, 0, ifInfoMsg(l.iface.Index))
+	if err != nil {
+		return false, LinkError{l.iface.Name, err}
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWLINK || len(msg.Data) < sizeofIfInfomsg {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(msg.Data[sizeofIfInfomsg:])
+		if err != nil {
+			return false, LinkError{l.iface.Name, err}
+		}
+		for ad.Next() {
+			if ad.Type() == unix.IFLA_IFALIAS {
+				return ad.String() == LinkAlias, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+var _ OwnedLink = rtnLink{}
@@ -0,0 +1,73 @@
+package linkmgr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+)
+
+// routeGet sends the RTM_GETROUTE request for dst with rtm_flags set to
+// flags.
+func (m *rtnMngr) routeGet(dst net.IP, flags uint32) (rtnetlink.RouteMessage, error) {
+	req := rtnetlink.RouteMessage{
+		Family:    unix.AF_INET6,
+		DstLength: 128,
+		Flags:     flags,
+		Attributes: rtnetlink.RouteAttributes{
+			Dst: dst,
+		},
+	}
+	if dst.To4() != nil {
+		req.Family = unix.AF_INET
+		req.DstLength = 32
+	}
+	data, err := req.MarshalBinary()
+	if err != nil {
+		return rtnetlink.RouteMessage{}, err
+	}
+
+	msgs, err := m.request(unix.RTM_GETROUTE, 0, data)
+	if err != nil {
+		return rtnetlink.RouteMessage{}, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWROUTE {
+			continue
+		}
+		var res rtnetlink.RouteMessage
+		if err := res.UnmarshalBinary(msg.Data); err != nil {
+			return rtnetlink.RouteMessage{}, err
+		}
+		return res, nil
+	}
+	return rtnetlink.RouteMessage{}, errors.New("no route in reply")
+}
+
+func (m *rtnMngr) RouteGet(dst net.IP) (RouteResult, error) {
+	msg, err := m.routeGet(dst, 0)
+	if err != nil {
+		return RouteResult{}, fmt.Errorf("route get %v: %w", dst, err)
+	}
+	r, ok := fromRouteMsg(msg)
+	if !ok {
+		return RouteResult{}, fmt.Errorf("route get %v: unexpected route type %d", dst, msg.Type)
+	}
+	res := RouteResult{
+		Route:     r,
+		LinkIndex: int(msg.Attributes.OutIface),
+	}
+
+	// The reply describes the route to the host, ask for the matched entry
+	// to get its prefix and origin (Linux 4.13+).
+	if match, err := m.routeGet(dst, unix.RTM_F_FIB_MATCH); err == nil {
+		if r, ok := fromRouteMsg(match); ok {
+			res.Dest = r.Dest
+			res.Protocol = r.Protocol
+			res.Scope = r.Scope
+		}
+	}
+	return res, nil
+}
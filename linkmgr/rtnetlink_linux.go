@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
-	"strings"
+	"sync"
 
+	"github.com/foxcpp/wirebox/audit"
 	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -17,22 +21,17 @@ import (
 const (
 	ScopeGlobal AddrScope = unix.RT_SCOPE_UNIVERSE
 	ScopeLink   AddrScope = unix.RT_SCOPE_LINK
+	ScopeHost   AddrScope = unix.RT_SCOPE_HOST
 )
 
-var ErrNotWireguard = errors.New("named link is not a wireguard tunnel")
-
-type LinkError struct {
-	LinkName string
-	E        error
-}
-
-func (err LinkError) Error() string {
-	return fmt.Sprintf("link manager %s: %v", err.LinkName, err.E)
-}
-
-func (err LinkError) Unwrap() error {
-	return err.E
-}
+const (
+	AddrNoDAD         AddrFlags = unix.IFA_F_NODAD
+	AddrDADFailed     AddrFlags = unix.IFA_F_DADFAILED
+	AddrDeprecated    AddrFlags = unix.IFA_F_DEPRECATED
+	AddrTentative     AddrFlags = unix.IFA_F_TENTATIVE
+	AddrPermanent     AddrFlags = unix.IFA_F_PERMANENT
+	AddrNoPrefixRoute AddrFlags = unix.IFA_F_NOPREFIXROUTE
+)
 
 type rtnLink struct {
 	mngr  *rtnMngr
@@ -55,7 +54,14 @@ func (l rtnLink) ListenUDP(local net.UDPAddr) (*net.UDPConn, error) {
 	// Apparentlty there is a weird race condition between link configuration
 	// and binding that seems to disappear if index-based address zone is used.
 	local.Zone = strconv.Itoa(l.iface.Index)
-	return net.ListenUDP("udp", &local)
+
+	var c *net.UDPConn
+	err := inNetNS(l.mngr.ns, func() error {
+		var err error
+		c, err = net.ListenUDP("udp", &local)
+		return err
+	})
+	return c, err
 }
 
 func (l rtnLink) DialUDP(local, remote net.UDPAddr) (*net.UDPConn, error) {
@@ -69,7 +75,13 @@ func (l rtnLink) DialUDP(local, remote net.UDPAddr) (*net.UDPConn, error) {
 		localPtr = nil
 	}
 
-	return net.DialUDP("udp", localPtr, &remote)
+	var c *net.UDPConn
+	err := inNetNS(l.mngr.ns, func() error {
+		var err error
+		c, err = net.DialUDP("udp", localPtr, &remote)
+		return err
+	})
+	return c, err
 }
 
 func (l rtnLink) SetUp(status bool) error {
@@ -78,6 +90,11 @@ func (l rtnLink) SetUp(status bool) error {
 		flag = unix.IFF_UP
 	}
 
+	state := "down"
+	if status {
+		state = "up"
+	}
+	l.mngr.record("netlink", "RTM_NEWLINK dev %s %s", l.iface.Name, state)
 	err := l.mngr.rtn.Link.Set(&rtnetlink.LinkMessage{
 		Index:  uint32(l.iface.Index),
 		Flags:  flag,
@@ -129,34 +146,76 @@ func asAddrMsg(ifaceIndx int, a Address) *rtnetlink.AddressMessage {
 			Address:   iface,
 			Local:     local,
 			Broadcast: brd,
+			Flags:     uint32(a.Flags),
 		},
 	}
 }
 
-func fromAddrMsg(m rtnetlink.AddressMessage) Address {
-	cidrLen := 128
-	if m.Family == unix.AF_INET {
-		cidrLen = 32
+// parseAddrMsg parses the RTM_NEWADDR message. rtnetlink.AddressMessage is
+// not used since it does not accept IPv6 addresses with IFA_LOCAL, set for
+// point-to-point ones.
+func parseAddrMsg(ifName string, data []byte) (indx int, a Address, err error) {
+	if len(data) < unix.SizeofIfAddrmsg {
+		return 0, Address{}, errors.New("short address message")
 	}
+	family := data[0]
+	prefixLen := int(data[1])
+	a.Flags = AddrFlags(data[2])
+	a.Scope = AddrScope(data[3])
+	indx = int(nlenc.Uint32(data[4:8]))
 
-	a := Address{
-		IPNet: net.IPNet{
-			IP:   m.Attributes.Address,
-			Mask: net.CIDRMask(int(m.PrefixLength), cidrLen),
-		},
-	}
-	if !m.Attributes.Local.Equal(m.Attributes.Address) {
-		a.Peer = &net.IPNet{
-			IP:   m.Attributes.Local,
-			Mask: net.CIDRMask(int(m.PrefixLength), cidrLen),
+	ad, err := netlink.NewAttributeDecoder(data[unix.SizeofIfAddrmsg:])
+	if err != nil {
+		return 0, Address{}, err
+	}
+	var addr, local net.IP
+	var label string
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.IFA_ADDRESS:
+			addr = net.IP(ad.Bytes())
+		case unix.IFA_LOCAL:
+			local = net.IP(ad.Bytes())
+		case unix.IFA_LABEL:
+			label = ad.String()
+		case unix.IFA_FLAGS:
+			// Supersedes the 8-bit ifa_flags.
+			a.Flags = AddrFlags(ad.Uint32())
+		case ifaProto:
+			a.Owned = a.Owned || len(ad.Bytes()) == 1 && ad.Uint8() == AddrProto
 		}
 	}
+	if err := ad.Err(); err != nil {
+		return 0, Address{}, err
+	}
+	if l := addrLabel(ifName); l != "" && label == l {
+		a.Owned = true
+	}
 
-	return a
+	bits := 128
+	if family == unix.AF_INET {
+		bits = 32
+	}
+	// IFA_ADDRESS is the peer address for point-to-point addresses, the
+	// prefix length belongs to it then.
+	a.IPNet = net.IPNet{IP: addr, Mask: net.CIDRMask(prefixLen, bits)}
+	if local != nil && !local.Equal(addr) {
+		a.IPNet = net.IPNet{IP: local, Mask: net.CIDRMask(bits, bits)}
+		a.Peer = &net.IPNet{IP: addr, Mask: net.CIDRMask(prefixLen, bits)}
+	}
+	if a.IP == nil {
+		return 0, Address{}, errors.New("address message without address")
+	}
+	return indx, a, nil
 }
 
 func (l rtnLink) AddAddr(a Address) error {
-	err := l.mngr.rtn.Address.New(asAddrMsg(l.iface.Index, a))
+	l.mngr.record("netlink", "RTM_NEWADDR dev %s %s", l.iface.Name, auditAddr(a))
+	data, err := ownedAddrMsg(l.iface.Name, l.iface.Index, a)
+	if err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	_, err = l.mngr.request(unix.RTM_NEWADDR, netlink.Create|netlink.Excl|netlink.Acknowledge, data)
 	if err != nil {
 		return LinkError{l.iface.Name, err}
 	}
@@ -164,6 +223,7 @@ func (l rtnLink) AddAddr(a Address) error {
 }
 
 func (l rtnLink) DelAddr(a Address) error {
+	l.mngr.record("netlink", "RTM_DELADDR dev %s %s", l.iface.Name, auditAddr(a))
 	err := l.mngr.rtn.Address.Delete(asAddrMsg(l.iface.Index, a))
 	if err != nil {
 		return LinkError{l.iface.Name, err}
@@ -172,22 +232,31 @@ func (l rtnLink) DelAddr(a Address) error {
 }
 
 func (l rtnLink) Addrs() ([]Address, error) {
-	msgs, err := l.mngr.rtn.Address.List()
+	req := make([]byte, unix.SizeofIfAddrmsg)
+	nlenc.PutUint32(req[4:8], uint32(l.iface.Index))
+	msgs, err := l.mngr.request(unix.RTM_GETADDR, netlink.Dump, req)
 	if err != nil {
 		return nil, LinkError{l.iface.Name, err}
 	}
 
 	addrs := make([]Address, 0, len(msgs))
 	for _, m := range msgs {
-		if m.Index != uint32(l.iface.Index) {
+		indx, a, err := parseAddrMsg(l.iface.Name, m.Data)
+		if err != nil {
+			return nil, LinkError{l.iface.Name, err}
+		}
+		if indx != l.iface.Index {
 			continue
 		}
-		addrs = append(addrs, fromAddrMsg(m))
+		addrs = append(addrs, a)
 	}
 	return addrs, nil
 }
 
 func (l rtnLink) ConfigureWG(c wgtypes.Config) error {
+	if audit.Enabled() {
+		l.mngr.record("wg", "dev %s %s", l.iface.Name, auditWG(c))
+	}
 	if err := l.mngr.wg.ConfigureDevice(l.iface.Name, c); err != nil {
 		return LinkError{l.iface.Name, err}
 	}
@@ -202,9 +271,16 @@ func (l rtnLink) WGConfig() (*wgtypes.Device, error) {
 	return dev, nil
 }
 
+var rtnTypes = map[RouteType]uint8{
+	RouteUnicast:     unix.RTN_UNICAST,
+	RouteBlackhole:   unix.RTN_BLACKHOLE,
+	RouteUnreachable: unix.RTN_UNREACHABLE,
+	RouteProhibit:    unix.RTN_PROHIBIT,
+}
+
 func asRouteMsg(ifaceIndx int, r Route) *rtnetlink.RouteMessage {
 	family := unix.AF_INET6
-	if v4 := r.Dest.IP; v4 != nil {
+	if v4 := r.Dest.IP.To4(); v4 != nil {
 		family = unix.AF_INET
 		r.Dest.IP = v4
 		if r.Src != nil {
@@ -225,45 +301,131 @@ func asRouteMsg(ifaceIndx int, r Route) *rtnetlink.RouteMessage {
 
 	dstLen, _ := r.Dest.Mask.Size()
 
-	return &rtnetlink.RouteMessage{
+	msg := &rtnetlink.RouteMessage{
 		Family:    uint8(family),
 		DstLength: uint8(dstLen),
 		SrcLength: srcLen,
 		Protocol:  RouteProto,
-		Type:      unix.RTN_UNICAST,
+		Scope:     uint8(r.Scope),
+		Type:      rtnTypes[r.Type],
 		Attributes: rtnetlink.RouteAttributes{
-			Dst:      r.Dest.IP,
-			Src:      r.Src,
-			OutIface: uint32(ifaceIndx),
+			Dst:     r.Dest.IP,
+			Src:     r.Src,
+			Gateway: r.Gateway,
 		},
 	}
+	if r.Type == RouteUnicast {
+		// The kernel refuses the device for other types.
+		msg.Attributes.OutIface = uint32(ifaceIndx)
+	}
+	if r.Protocol != 0 {
+		msg.Protocol = uint8(r.Protocol)
+	}
+	if r.Table != 0 {
+		// The header field is too small for IDs above 255, RTA_TABLE
+		// takes precedence.
+		if r.Table < 256 {
+			msg.Table = uint8(r.Table)
+		}
+		msg.Attributes.Table = uint32(r.Table)
+	}
+	return msg
 }
 
+// GetRoutes returns routes via the link in the main table.
 func (l rtnLink) GetRoutes() ([]Route, error) {
-	routes := []Route{}
+	return l.ListRoutes(RouteFilter{})
+}
 
-	// get IPv4 routes
-	routeMsgsInet, err := l.mngr.rtn.Route.List()
+// ListRoutes returns routes via the link matching f.
+func (l rtnLink) ListRoutes(f RouteFilter) ([]Route, error) {
+	msgs, err := l.mngr.rtn.Route.List()
 	if err != nil {
-		return routes, LinkError{l.iface.Name, err}
-	}
-	for _, routeMsg := range routeMsgsInet {
-		if routeMsg.Attributes.OutIface == uint32(l.iface.Index) && routeMsg.Attributes.Table == uint32(unix.RT_TABLE_MAIN) {
-			maskLength := 32
-			// if ip contains ":", it's IPv6
-			if strings.Contains(routeMsg.Attributes.Dst.String(), ":") {
-				maskLength = 128
-			}
-			routes = append(routes, Route{
-				Dest: net.IPNet{IP: routeMsg.Attributes.Dst, Mask: net.CIDRMask(int(routeMsg.DstLength), maskLength)},
-				Src:  routeMsg.Attributes.Src})
-		}
+		return nil, LinkError{l.iface.Name, err}
 	}
 
+	table := f.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+
+	routes := []Route{}
+	for _, msg := range msgs {
+		if msg.Attributes.OutIface != uint32(l.iface.Index) {
+			continue
+		}
+		r, ok := fromRouteMsg(msg)
+		if !ok {
+			continue
+		}
+		if table != AllTables && r.Table != table {
+			continue
+		}
+		if f.Protocol != 0 && r.Protocol != f.Protocol {
+			continue
+		}
+		if len(f.Scopes) != 0 && !hasScope(f.Scopes, r.Scope) {
+			continue
+		}
+		routes = append(routes, r)
+	}
 	return routes, nil
 }
 
+func hasScope(scopes []AddrScope, scope AddrScope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// fromRouteMsg converts the route received from the kernel, ok is false for
+// routes of other address families and types managed by the kernel (e.g.
+// local and broadcast ones).
+func fromRouteMsg(msg rtnetlink.RouteMessage) (r Route, ok bool) {
+	typ := RouteType(-1)
+	for t, rtn := range rtnTypes {
+		if rtn == msg.Type {
+			typ = t
+		}
+	}
+	if typ == -1 {
+		return Route{}, false
+	}
+
+	bits := 32
+	switch msg.Family {
+	case unix.AF_INET:
+	case unix.AF_INET6:
+		bits = 128
+	default:
+		return Route{}, false
+	}
+
+	dst := msg.Attributes.Dst
+	if dst == nil {
+		// Default route.
+		dst = make(net.IP, bits/8)
+	}
+	table := int(msg.Table)
+	if msg.Attributes.Table != 0 {
+		table = int(msg.Attributes.Table)
+	}
+	return Route{
+		Dest:     net.IPNet{IP: dst, Mask: net.CIDRMask(int(msg.DstLength), bits)},
+		Src:      msg.Attributes.Src,
+		Gateway:  msg.Attributes.Gateway,
+		Table:    table,
+		Protocol: int(msg.Protocol),
+		Scope:    AddrScope(msg.Scope),
+		Type:     typ,
+	}, true
+}
+
 func (l rtnLink) AddRoute(r Route) error {
+	l.mngr.record("netlink", "RTM_NEWROUTE dev %s %s", l.iface.Name, auditRoute(r))
 	err := l.mngr.rtn.Route.Add(asRouteMsg(l.iface.Index, r))
 	if err != nil {
 		return LinkError{l.iface.Name, err}
@@ -272,6 +434,7 @@ func (l rtnLink) AddRoute(r Route) error {
 }
 
 func (l rtnLink) DelRoute(r Route) error {
+	l.mngr.record("netlink", "RTM_DELROUTE dev %s %s", l.iface.Name, auditRoute(r))
 	err := l.mngr.rtn.Route.Delete(asRouteMsg(l.iface.Index, r))
 	if err != nil {
 		return LinkError{l.iface.Name, err}
@@ -279,11 +442,78 @@ func (l rtnLink) DelRoute(r Route) error {
 	return nil
 }
 
+// minRoutesPerWorker is the number of routes that makes it worth to open a
+// separate netlink connection.
+const minRoutesPerWorker = 32
+
+// AddRoutes installs routes concurrently, each worker uses a separate
+// netlink connection since requests on the same connection are serialized.
+func (l rtnLink) AddRoutes(routes []Route, workers int) []error {
+	errs := make([]error, len(routes))
+	if n := len(routes) / minRoutesPerWorker; n < workers {
+		workers = n
+	}
+	if workers <= 1 {
+		for i, r := range routes {
+			errs[i] = l.AddRoute(r)
+		}
+		return errs
+	}
+
+	if audit.Enabled() {
+		for _, r := range routes {
+			l.mngr.record("netlink", "RTM_NEWROUTE dev %s %s", l.iface.Name, auditRoute(r))
+		}
+	}
+
+	indx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		var rtn *rtnetlink.Conn
+		err := inNetNS(l.mngr.ns, func() error {
+			var err error
+			rtn, err = rtnetlink.Dial(nil)
+			return err
+		})
+		if err != nil {
+			// Fallback to the shared connection, still correct, just
+			// slower.
+			rtn = l.mngr.rtn
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rtn != l.mngr.rtn {
+				defer rtn.Close()
+			}
+			for i := range indx {
+				if err := rtn.Route.Add(asRouteMsg(l.iface.Index, routes[i])); err != nil {
+					errs[i] = LinkError{l.iface.Name, err}
+				}
+			}
+		}()
+	}
+	for i := range routes {
+		indx <- i
+	}
+	close(indx)
+	wg.Wait()
+
+	return errs
+}
+
 var _ Link = rtnLink{}
+var _ RouteAdder = rtnLink{}
+var _ RouteLister = rtnLink{}
 
 type rtnMngr struct {
 	rtn *rtnetlink.Conn
 	wg  *wgctrl.Client
+
+	// Network namespace links are managed in, nil for the namespace of the
+	// process.
+	ns *os.File
 }
 
 func fromLinkMsg(mngr *rtnMngr, m rtnetlink.LinkMessage) rtnLink {
@@ -335,7 +565,12 @@ func (m *rtnMngr) Links() ([]Link, error) {
 }
 
 func (m *rtnMngr) GetLink(name string) (Link, error) {
-	iface, err := net.InterfaceByName(name)
+	var iface *net.Interface
+	err := inNetNS(m.ns, func() error {
+		var err error
+		iface, err = net.InterfaceByName(name)
+		return err
+	})
 	if err != nil {
 		return nil, LinkError{name, err}
 	}
@@ -344,6 +579,7 @@ func (m *rtnMngr) GetLink(name string) (Link, error) {
 }
 
 func (m *rtnMngr) DelLink(indx int) error {
+	m.record("netlink", "RTM_DELLINK index %d", indx)
 	if err := m.rtn.Link.Delete(uint32(indx)); err != nil {
 		return LinkError{strconv.Itoa(indx), err}
 	}
@@ -351,6 +587,7 @@ func (m *rtnMngr) DelLink(indx int) error {
 }
 
 func (m *rtnMngr) CreateLink(name string) (Link, error) {
+	m.record("netlink", "RTM_NEWLINK name %s kind wireguard", name)
 	err := m.rtn.Link.New(&rtnetlink.LinkMessage{
 		Type:  65534, // Seems to be set by 'ip link add' TODO: Why?
 		Flags: unix.IFF_NOARP,
@@ -362,14 +599,41 @@ func (m *rtnMngr) CreateLink(name string) (Link, error) {
 		},
 	})
 	if err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			return nil, LinkError{name, ErrLinkExists}
+		}
+		return nil, LinkError{name, err}
+	}
+	l, err := m.GetLink(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.tagLink(l.Index()); err != nil {
+		m.DelLink(l.Index())
 		return nil, LinkError{name, err}
 	}
-	return m.GetLink(name)
+	return l, nil
+}
+
+// record writes the audit record noting the network namespace the manager
+// operates in.
+func (m *rtnMngr) record(kind, format string, args ...interface{}) {
+	if !audit.Enabled() {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if m.ns != nil {
+		msg += " netns " + m.ns.Name()
+	}
+	audit.Record(kind, "%s", msg)
 }
 
 func (m *rtnMngr) Close() error {
 	m.rtn.Close()
 	m.wg.Close()
+	if m.ns != nil {
+		m.ns.Close()
+	}
 	return nil
 }
 
@@ -0,0 +1,78 @@
+package linkmgr
+
+import (
+	"fmt"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/fib_rules.h, not defined in x/sys/unix.
+const (
+	fraPriority          = 6
+	fraFwMark            = 10
+	fraSuppressPrefixLen = 14
+	fraTable             = 15
+	fraFwMask            = 16
+
+	frActToTbl    = 1
+	fibRuleInvert = 0x2
+
+	sizeofFibRuleHdr = 12
+)
+
+func ruleMsg(r Rule) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(fraPriority, uint32(r.Priority))
+	ae.Uint32(fraTable, uint32(r.Table))
+	if r.Mark != 0 {
+		ae.Uint32(fraFwMark, r.Mark)
+		ae.Uint32(fraFwMask, 0xffffffff)
+	}
+	if r.SuppressDefault {
+		ae.Uint32(fraSuppressPrefixLen, 0)
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// struct fib_rule_hdr followed by attributes.
+	data := make([]byte, sizeofFibRuleHdr, sizeofFibRuleHdr+len(attrs))
+	data[0] = unix.AF_INET
+	if r.IPv6 {
+		data[0] = unix.AF_INET6
+	}
+	if r.Table < 256 {
+		data[4] = uint8(r.Table)
+	}
+	data[7] = frActToTbl
+	if r.Invert {
+		data[8] = fibRuleInvert
+	}
+	return append(data, attrs...), nil
+}
+
+func (m *rtnMngr) ruleRequest(typ netlink.HeaderType, flags netlink.HeaderFlags, r Rule) error {
+	data, err := ruleMsg(r)
+	if err != nil {
+		return fmt.Errorf("rule: %w", err)
+	}
+	_, err = m.request(typ, netlink.Acknowledge|flags, data)
+	if err != nil {
+		return fmt.Errorf("rule: %w", err)
+	}
+	return nil
+}
+
+func (m *rtnMngr) AddRule(r Rule) error {
+	m.record("netlink", "RTM_NEWRULE %s", auditRule(r))
+	return m.ruleRequest(unix.RTM_NEWRULE, netlink.Create|netlink.Excl, r)
+}
+
+func (m *rtnMngr) DelRule(r Rule) error {
+	m.record("netlink", "RTM_DELRULE %s", auditRule(r))
+	return m.ruleRequest(unix.RTM_DELRULE, 0, r)
+}
+
+var _ RuleManager = &rtnMngr{}
@@ -0,0 +1,161 @@
+package linkmgr
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WireGuard devices running in the process are configured using the
+// cross-platform userspace API (the same as "wg set" uses), see
+// https://www.wireguard.com/xplatform/.
+
+// uapiConfig formats the configuration change as the UAPI set operation.
+func uapiConfig(c wgtypes.Config) string {
+	var b strings.Builder
+	if c.PrivateKey != nil {
+		fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(c.PrivateKey[:]))
+	}
+	if c.ListenPort != nil {
+		fmt.Fprintf(&b, "listen_port=%d\n", *c.ListenPort)
+	}
+	if c.FirewallMark != nil {
+		fmt.Fprintf(&b, "fwmark=%d\n", *c.FirewallMark)
+	}
+	if c.ReplacePeers {
+		b.WriteString("replace_peers=true\n")
+	}
+	for _, p := range c.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(p.PublicKey[:]))
+		if p.Remove {
+			b.WriteString("remove=true\n")
+			continue
+		}
+		if p.UpdateOnly {
+			b.WriteString("update_only=true\n")
+		}
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(p.PresharedKey[:]))
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&b, "endpoint=%s\n", p.Endpoint.String())
+		}
+		if p.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(p.PersistentKeepaliveInterval.Seconds()))
+		}
+		if p.ReplaceAllowedIPs {
+			b.WriteString("replace_allowed_ips=true\n")
+		}
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip.String())
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func uapiKey(value string) (wgtypes.Key, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	return wgtypes.NewKey(b)
+}
+
+// parseUAPIDevice parses the output of the UAPI get operation.
+func parseUAPIDevice(name string, r io.Reader) (*wgtypes.Device, error) {
+	dev := &wgtypes.Device{Name: name, Type: wgtypes.Userspace}
+	var (
+		peer          *wgtypes.Peer
+		handshakeSec  int64
+		handshakeNsec int64
+	)
+	flushPeer := func() {
+		if peer == nil {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			peer.LastHandshakeTime = time.Unix(handshakeSec, handshakeNsec)
+		}
+		dev.Peers = append(dev.Peers, *peer)
+		peer, handshakeSec, handshakeNsec = nil, 0, 0
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("uapi: malformed line %q", line)
+		}
+		key, value := kv[0], kv[1]
+
+		var err error
+		switch key {
+		case "private_key":
+			dev.PrivateKey, err = uapiKey(value)
+			dev.PublicKey = dev.PrivateKey.PublicKey()
+		case "listen_port":
+			dev.ListenPort, err = strconv.Atoi(value)
+		case "fwmark":
+			dev.FirewallMark, err = strconv.Atoi(value)
+		case "public_key":
+			flushPeer()
+			peer = &wgtypes.Peer{}
+			peer.PublicKey, err = uapiKey(value)
+		case "errno":
+			if value != "0" {
+				return nil, fmt.Errorf("uapi: errno %s", value)
+			}
+		default:
+			if peer == nil {
+				// Unknown device keys are added by newer versions.
+				continue
+			}
+			switch key {
+			case "preshared_key":
+				peer.PresharedKey, err = uapiKey(value)
+			case "endpoint":
+				peer.Endpoint, err = net.ResolveUDPAddr("udp", value)
+			case "persistent_keepalive_interval":
+				var secs int
+				secs, err = strconv.Atoi(value)
+				peer.PersistentKeepaliveInterval = time.Duration(secs) * time.Second
+			case "last_handshake_time_sec":
+				handshakeSec, err = strconv.ParseInt(value, 10, 64)
+			case "last_handshake_time_nsec":
+				handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+			case "rx_bytes":
+				peer.ReceiveBytes, err = strconv.ParseInt(value, 10, 64)
+			case "tx_bytes":
+				peer.TransmitBytes, err = strconv.ParseInt(value, 10, 64)
+			case "allowed_ip":
+				var n *net.IPNet
+				_, n, err = net.ParseCIDR(value)
+				if err == nil {
+					peer.AllowedIPs = append(peer.AllowedIPs, *n)
+				}
+			case "protocol_version":
+				peer.ProtocolVersion, err = strconv.Atoi(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("uapi: %s: %w", key, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("uapi: %w", err)
+	}
+	flushPeer()
+	return dev, nil
+}
@@ -0,0 +1,454 @@
+package linkmgr
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/foxcpp/wirebox/audit"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// On Windows, WireGuard runs in the process (wireguard-go) on top of the
+// Wintun adapter, so tunnels exist only while the process that created them
+// runs. The Wintun driver should be installed, e.g. by WireGuard for Windows.
+
+// Windows has no address scopes, the values are the Linux ones so both
+// backends report the same.
+const (
+	ScopeGlobal AddrScope = 0
+	ScopeLink   AddrScope = 253
+	ScopeHost   AddrScope = 254
+)
+
+// Only the DAD state is reported, other flags are Linux-specific and never
+// set.
+const (
+	AddrNoDAD AddrFlags = 1 << iota
+	AddrDADFailed
+	AddrDeprecated
+	AddrTentative
+	AddrPermanent
+	AddrNoPrefixRoute
+)
+
+// tunMTU is the MTU of created interfaces, the default of the Linux module.
+const tunMTU = 1420
+
+// winDevice is the WireGuard device running in this process.
+type winDevice struct {
+	dev *device.Device
+	// Named pipe for "wg" and other UAPI clients.
+	uapi net.Listener
+}
+
+type winMngr struct {
+	lock sync.Mutex
+	// Devices created by CreateLink, by interface index.
+	devs map[int]*winDevice
+}
+
+type winLink struct {
+	mngr  *winMngr
+	iface net.Interface
+	luid  uint64
+}
+
+func (l winLink) Interface() net.Interface {
+	return l.iface
+}
+
+func (l winLink) Name() string {
+	return l.iface.Name
+}
+
+func (l winLink) Index() int {
+	return l.iface.Index
+}
+
+// device returns the WireGuard device of the link, ErrNotWireguard if it
+// was not created by this process.
+func (l winLink) device() (*winDevice, error) {
+	l.mngr.lock.Lock()
+	defer l.mngr.lock.Unlock()
+	d, ok := l.mngr.devs[l.iface.Index]
+	if !ok {
+		return nil, LinkError{l.iface.Name, ErrNotWireguard}
+	}
+	return d, nil
+}
+
+// Owned reports whether the link was created by this process, links of
+// other processes cannot be configured.
+func (l winLink) Owned() (bool, error) {
+	_, err := l.device()
+	return err == nil, nil
+}
+
+func (l winLink) IsUp() bool {
+	iface, err := net.InterfaceByIndex(l.iface.Index)
+	if err != nil {
+		return false
+	}
+	return iface.Flags&net.FlagUp != 0
+}
+
+func (l winLink) SetUp(status bool) error {
+	d, err := l.device()
+	if err != nil {
+		return err
+	}
+	state := "down"
+	if status {
+		state = "up"
+	}
+	audit.Record("wg", "dev %s %s", l.iface.Name, state)
+	if status {
+		d.dev.Up()
+	} else {
+		d.dev.Down()
+	}
+	return nil
+}
+
+func (l winLink) Addrs() ([]Address, error) {
+	rows, err := unicastIPAddresses()
+	if err != nil {
+		return nil, LinkError{l.iface.Name, err}
+	}
+	var addrs []Address
+	for _, r := range rows {
+		if r.InterfaceLUID != l.luid {
+			continue
+		}
+		ip := r.Address.IP()
+		bits := 8 * len(ip)
+		a := Address{
+			IPNet: net.IPNet{IP: ip, Mask: net.CIDRMask(int(r.OnLinkPrefixLength), bits)},
+			Scope: ScopeGlobal,
+		}
+		if ip.IsLinkLocalUnicast() {
+			a.Scope = ScopeLink
+		}
+		switch r.DadState {
+		case dadTentative:
+			a.Flags |= AddrTentative
+		case dadDeprecated:
+			a.Flags |= AddrDeprecated
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+func (l winLink) addrRow(a Address) *mibUnicastIPAddressRow {
+	row := newUnicastIPAddressRow()
+	row.InterfaceLUID = l.luid
+	row.Address = sockaddrInet(a.IP)
+	ones, _ := a.Mask.Size()
+	row.OnLinkPrefixLength = uint8(ones)
+	// There is no one to conflict with on the tunnel.
+	row.DadState = dadPreferred
+	return row
+}
+
+// AddAddr adds the address. Point-to-point addresses are not supported, the
+// route to the peer is added instead.
+func (l winLink) AddAddr(a Address) error {
+	audit.Record("iphlpapi", "CreateUnicastIpAddressEntry dev %s %s", l.iface.Name, auditAddr(a))
+	if err := createUnicastIPAddressEntry(l.addrRow(a)); err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	if a.Peer != nil {
+		if err := l.AddRoute(Route{Dest: *a.Peer}); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l winLink) DelAddr(a Address) error {
+	audit.Record("iphlpapi", "DeleteUnicastIpAddressEntry dev %s %s", l.iface.Name, auditAddr(a))
+	if err := deleteUnicastIPAddressEntry(l.addrRow(a)); err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	if a.Peer != nil {
+		if err := l.DelRoute(Route{Dest: *a.Peer}); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l winLink) ConfigureWG(c wgtypes.Config) error {
+	d, err := l.device()
+	if err != nil {
+		return err
+	}
+	if audit.Enabled() {
+		audit.Record("wg", "dev %s %s", l.iface.Name, auditWG(c))
+	}
+	if ipcErr := d.dev.IpcSetOperation(bufio.NewReader(strings.NewReader(uapiConfig(c)))); ipcErr != nil {
+		return LinkError{l.iface.Name, ipcErr}
+	}
+	return nil
+}
+
+func (l winLink) WGConfig() (*wgtypes.Device, error) {
+	d, err := l.device()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if ipcErr := d.dev.IpcGetOperation(w); ipcErr != nil {
+		return nil, LinkError{l.iface.Name, ipcErr}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, LinkError{l.iface.Name, err}
+	}
+	dev, err := parseUAPIDevice(l.iface.Name, &buf)
+	if err != nil {
+		return nil, LinkError{l.iface.Name, err}
+	}
+	return dev, nil
+}
+
+func (l winLink) ListenUDP(local net.UDPAddr) (*net.UDPConn, error) {
+	// The zone binds link-local addresses to the interface.
+	local.Zone = strconv.Itoa(l.iface.Index)
+	return net.ListenUDP("udp", &local)
+}
+
+func (l winLink) DialUDP(local, remote net.UDPAddr) (*net.UDPConn, error) {
+	local.Zone = strconv.Itoa(l.iface.Index)
+	remote.Zone = strconv.Itoa(l.iface.Index)
+
+	localPtr := &local
+	if localPtr.IP == nil {
+		localPtr = nil
+	}
+	return net.DialUDP("udp", localPtr, &remote)
+}
+
+// routeRow converts the route, only unicast routes of the main table are
+// supported. Src is not used, Windows selects the source among addresses of
+// the interface.
+func (l winLink) routeRow(r Route) (*mibIPforwardRow2, error) {
+	if r.Table != 0 {
+		return nil, errors.New("routing tables are not supported")
+	}
+	if r.Type != RouteUnicast {
+		return nil, fmt.Errorf("%v routes are not supported", r.Type)
+	}
+	row := newIPforwardRow2()
+	row.InterfaceLUID = l.luid
+	row.DestinationPrefix.Prefix = sockaddrInet(r.Dest.IP)
+	ones, _ := r.Dest.Mask.Size()
+	row.DestinationPrefix.PrefixLength = uint8(ones)
+	gw := r.Gateway
+	if gw == nil {
+		// On-link routes have the unspecified next hop.
+		gw = net.IPv6unspecified
+		if r.Dest.IP.To4() != nil {
+			gw = net.IPv4zero
+		}
+	}
+	row.NextHop = sockaddrInet(gw)
+	row.Metric = 0
+	row.Protocol = protoNetMgmt
+	return row, nil
+}
+
+func (l winLink) AddRoute(r Route) error {
+	row, err := l.routeRow(r)
+	if err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	audit.Record("iphlpapi", "CreateIpForwardEntry2 dev %s %s", l.iface.Name, auditRoute(r))
+	if err := createIPforwardEntry2(row); err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	return nil
+}
+
+func (l winLink) DelRoute(r Route) error {
+	row, err := l.routeRow(r)
+	if err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	audit.Record("iphlpapi", "DeleteIpForwardEntry2 dev %s %s", l.iface.Name, auditRoute(r))
+	if err := deleteIPforwardEntry2(row); err != nil {
+		return LinkError{l.iface.Name, err}
+	}
+	return nil
+}
+
+// routeFromRow converts the route, routes added by management tools to
+// links created by wirebox are reported with RouteProto.
+func routeFromRow(row *mibIPforwardRow2, owned bool) Route {
+	dst := row.DestinationPrefix.Prefix.IP()
+	r := Route{
+		Dest:     net.IPNet{IP: dst, Mask: net.CIDRMask(int(row.DestinationPrefix.PrefixLength), 8*len(dst))},
+		Protocol: int(row.Protocol),
+	}
+	if gw := row.NextHop.IP(); gw != nil && !gw.IsUnspecified() {
+		r.Gateway = gw
+	}
+	if owned && row.Protocol == protoNetMgmt {
+		r.Protocol = RouteProto
+	}
+	return r
+}
+
+func (l winLink) GetRoutes() ([]Route, error) {
+	rows, err := ipForwardTable()
+	if err != nil {
+		return nil, LinkError{l.iface.Name, err}
+	}
+	owned, _ := l.Owned()
+	var routes []Route
+	for i := range rows {
+		if rows[i].InterfaceLUID != l.luid {
+			continue
+		}
+		routes = append(routes, routeFromRow(&rows[i], owned))
+	}
+	return routes, nil
+}
+
+var _ Link = winLink{}
+
+func (m *winMngr) link(iface net.Interface) (Link, error) {
+	luid, err := indexToLUID(iface.Index)
+	if err != nil {
+		return nil, LinkError{iface.Name, err}
+	}
+	return winLink{m, iface, luid}, nil
+}
+
+// Links returns links created by this process.
+func (m *winMngr) Links() ([]Link, error) {
+	m.lock.Lock()
+	indexes := make([]int, 0, len(m.devs))
+	for indx := range m.devs {
+		indexes = append(indexes, indx)
+	}
+	m.lock.Unlock()
+
+	links := make([]Link, 0, len(indexes))
+	for _, indx := range indexes {
+		iface, err := net.InterfaceByIndex(indx)
+		if err != nil {
+			return nil, LinkError{strconv.Itoa(indx), err}
+		}
+		l, err := m.link(*iface)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (m *winMngr) GetLink(name string) (Link, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, LinkError{name, err}
+	}
+	return m.link(*iface)
+}
+
+func (m *winMngr) CreateLink(name string) (Link, error) {
+	if _, err := net.InterfaceByName(name); err == nil {
+		return nil, LinkError{name, ErrLinkExists}
+	}
+
+	audit.Record("wintun", "create %s mtu %d", name, tunMTU)
+	tunDev, err := tun.CreateTUN(name, tunMTU)
+	if err != nil {
+		return nil, LinkError{name, err}
+	}
+	indx, err := luidToIndex(tunDev.(*tun.NativeTun).LUID())
+	if err != nil {
+		tunDev.Close()
+		return nil, LinkError{name, err}
+	}
+	// The device takes over tunDev and brings the link up.
+	dev := device.NewDevice(tunDev, device.NewLogger(device.LogLevelError, "("+name+") "))
+	uapi, err := ipc.UAPIListen(name)
+	if err != nil {
+		dev.Close()
+		return nil, LinkError{name, err}
+	}
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+
+	m.lock.Lock()
+	m.devs[indx] = &winDevice{dev: dev, uapi: uapi}
+	m.lock.Unlock()
+
+	iface, err := net.InterfaceByIndex(indx)
+	if err != nil {
+		m.DelLink(indx)
+		return nil, LinkError{name, err}
+	}
+	return m.link(*iface)
+}
+
+func (m *winMngr) DelLink(indx int) error {
+	m.lock.Lock()
+	d, ok := m.devs[indx]
+	delete(m.devs, indx)
+	m.lock.Unlock()
+	if !ok {
+		return LinkError{strconv.Itoa(indx), errors.New("not created by this process, the link is removed once the process that created it exits")}
+	}
+
+	audit.Record("wintun", "delete index %d", indx)
+	d.uapi.Close()
+	// Closes the Wintun adapter too.
+	d.dev.Close()
+	return nil
+}
+
+func (m *winMngr) RouteGet(dst net.IP) (RouteResult, error) {
+	row, src, err := bestRoute(dst)
+	if err != nil {
+		return RouteResult{}, LinkError{"", err}
+	}
+	m.lock.Lock()
+	_, owned := m.devs[int(row.InterfaceIndex)]
+	m.lock.Unlock()
+
+	res := RouteResult{Route: routeFromRow(&row, owned), LinkIndex: int(row.InterfaceIndex)}
+	res.Src = src
+	return res, nil
+}
+
+// Close does not remove links, they are removed when the process exits.
+func (m *winMngr) Close() error {
+	return nil
+}
+
+var _ Manager = &winMngr{}
+
+func NewManager() (Manager, error) {
+	return &winMngr{devs: make(map[int]*winDevice)}, nil
+}
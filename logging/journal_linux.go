@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends messages to systemd-journald using its native
+// protocol.
+//
+// Severity prefixes are mapped to PRIORITY field, the prefix itself is kept
+// in MESSAGE for consistency with other sinks and is also available as
+// WIREBOX_LEVEL.
+type journalWriter struct {
+	conn  *net.UnixConn
+	ident string
+}
+
+func openJournal(ident string) (io.WriteCloser, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("logging: journald: %w", err)
+	}
+	return journalWriter{conn: conn, ident: ident}, nil
+}
+
+// Syslog priorities used by journald.
+var journalPriority = map[Level]int{
+	LevelDebug:   7,
+	LevelInfo:    6,
+	LevelWarning: 4,
+	LevelError:   3,
+}
+
+func appendJournalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if !strings.ContainsRune(value, '\n') {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	// Multi-line values use the binary-safe encoding.
+	buf.WriteByte('\n')
+	if err := binary.Write(buf, binary.LittleEndian, uint64(len(value))); err != nil {
+		panic(err)
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (j journalWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	lvl := ParseLevel(msg)
+
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", msg)
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(journalPriority[lvl]))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", j.ident)
+	appendJournalField(&buf, "SYSLOG_PID", strconv.Itoa(os.Getpid()))
+	appendJournalField(&buf, "WIREBOX_LEVEL", lvl.String())
+
+	if _, err := j.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (j journalWriter) Close() error {
+	return j.conn.Close()
+}
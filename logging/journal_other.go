@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package logging
+
+import (
+	"errors"
+	"io"
+)
+
+func openJournal(ident string) (io.WriteCloser, error) {
+	return nil, errors.New("logging: journald is not supported on this platform")
+}
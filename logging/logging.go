@@ -0,0 +1,119 @@
+// Package logging implements log sinks for the standard log package.
+//
+// wirebox uses message prefixes to indicate the severity ("error:",
+// "WARNING:", "debug:"), sinks that support structured messages map them to
+// the corresponding severity levels.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+type Config struct {
+	// Where to send the log, "stderr" (default), "syslog" or "journald".
+	Target string `toml:"target"`
+
+	// Syslog server address in form "udp://host:514" or "tcp://host:514".
+	// Local syslog daemon is used if empty.
+	SyslogAddr string `toml:"syslog-addr"`
+}
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "debug":
+		*l = LevelDebug
+	case "info":
+		*l = LevelInfo
+	case "warning":
+		*l = LevelWarning
+	case "error":
+		*l = LevelError
+	default:
+		return fmt.Errorf("logging: unknown level: %s", text)
+	}
+	return nil
+}
+
+// ParseLevel determines the message severity from its prefix.
+func ParseLevel(msg string) Level {
+	switch {
+	case strings.HasPrefix(msg, "debug:"):
+		return LevelDebug
+	case strings.HasPrefix(msg, "error:"):
+		return LevelError
+	case strings.HasPrefix(msg, "WARNING:"), strings.HasPrefix(msg, "warning:"):
+		return LevelWarning
+	default:
+		return LevelInfo
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Open creates the sink specified by the configuration. ident is the program
+// name to use for the messages.
+func Open(cfg Config, ident string) (io.WriteCloser, error) {
+	switch cfg.Target {
+	case "", "stderr":
+		return nopCloser{os.Stderr}, nil
+	case "syslog":
+		return openSyslog(cfg.SyslogAddr, ident)
+	case "journald":
+		return openJournal(ident)
+	default:
+		return nil, fmt.Errorf("logging: unknown target: %v", cfg.Target)
+	}
+}
+
+// Setup redirects the standard logger to the sink specified by the
+// configuration. Timestamps are not added if sink records them itself.
+// Messages are also kept in Logs.
+func Setup(cfg Config, ident string) (io.Closer, error) {
+	w, err := Open(cfg, ident)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Target != "" && cfg.Target != "stderr" {
+		log.SetFlags(0)
+	}
+	log.SetOutput(io.MultiWriter(w, Logs))
+	return w, nil
+}
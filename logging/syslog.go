@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func openSyslog(addr, ident string) (io.WriteCloser, error) {
+	var (
+		w   *syslog.Writer
+		err error
+	)
+	if addr == "" {
+		w, err = syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, ident)
+	} else {
+		u, perr := url.Parse(addr)
+		if perr != nil {
+			return nil, fmt.Errorf("logging: syslog-addr: %w", perr)
+		}
+		w, err = syslog.Dial(u.Scheme, u.Host, syslog.LOG_DAEMON|syslog.LOG_INFO, ident)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("logging: syslog: %w", err)
+	}
+	return syslogWriter{w}, nil
+}
+
+func (s syslogWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+
+	var err error
+	switch ParseLevel(msg) {
+	case LevelDebug:
+		err = s.w.Debug(msg)
+	case LevelWarning:
+		err = s.w.Warning(msg)
+	case LevelError:
+		err = s.w.Err(msg)
+	default:
+		err = s.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s syslogWriter) Close() error {
+	return s.w.Close()
+}
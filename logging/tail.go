@@ -0,0 +1,169 @@
+package logging
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a single log message kept by Tail.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   Level     `json:"level"`
+	Message string    `json:"message"`
+}
+
+// Tail keeps recent log messages and passes new ones to subscribers. It is
+// an io.Writer to be used as an additional log output.
+type Tail struct {
+	lock sync.Mutex
+	ring []Entry
+	next int
+	full bool
+	subs map[chan Entry]struct{}
+}
+
+// Logs is the Tail of the standard logger, set up by Setup.
+var Logs = NewTail(1000)
+
+// NewTail creates the Tail that keeps up to size recent messages.
+func NewTail(size int) *Tail {
+	return &Tail{
+		ring: make([]Entry, size),
+		subs: map[chan Entry]struct{}{},
+	}
+}
+
+// timestampRe matches the date and time added by the log package.
+var timestampRe = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+func (t *Tail) Write(b []byte) (int, error) {
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		line = timestampRe.ReplaceAllString(line, "")
+		e := Entry{Time: now, Level: ParseLevel(line), Message: line}
+
+		t.ring[t.next] = e
+		t.next = (t.next + 1) % len(t.ring)
+		if t.next == 0 {
+			t.full = true
+		}
+		for ch := range t.subs {
+			select {
+			case ch <- e:
+			default:
+				// Subscriber is too slow, drop the message rather than
+				// blocking the logger.
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// Recent returns up to n last messages with level at least min, oldest
+// first.
+func (t *Tail) Recent(n int, min Level) []Entry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.recent(n, min)
+}
+
+func (t *Tail) recent(n int, min Level) []Entry {
+	var all []Entry
+	if t.full {
+		all = append(all, t.ring[t.next:]...)
+	}
+	all = append(all, t.ring[:t.next]...)
+
+	var res []Entry
+	for i := len(all) - 1; i >= 0 && len(res) < n; i-- {
+		if all[i].Level >= min {
+			res = append(res, all[i])
+		}
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// Subscribe returns the channel receiving new messages. cancel should be
+// called once the subscriber is no longer interested.
+func (t *Tail) Subscribe() (ch <-chan Entry, cancel func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.subscribe()
+}
+
+func (t *Tail) subscribe() (ch <-chan Entry, cancel func()) {
+	c := make(chan Entry, 64)
+	t.subs[c] = struct{}{}
+	return c, func() {
+		t.lock.Lock()
+		delete(t.subs, c)
+		t.lock.Unlock()
+	}
+}
+
+// StreamArgs are arguments of the Stream request.
+type StreamArgs struct {
+	// Minimal level of messages to send.
+	Level Level `json:"level"`
+	// Number of recent messages to send first.
+	Lines int `json:"lines"`
+	// Keep sending new messages.
+	Follow bool `json:"follow"`
+}
+
+// Stream sends recent and, if requested, new messages. It is a control
+// socket stream handler (ctlsock.StreamHandler).
+func (t *Tail) Stream(raw json.RawMessage, send func(v interface{}) error, done <-chan struct{}) error {
+	args := StreamArgs{Level: LevelInfo, Lines: 100}
+	if len(raw) != 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return err
+		}
+	}
+
+	// Subscribe together with taking recent messages so none are lost or
+	// sent twice.
+	var (
+		ch     <-chan Entry
+		cancel = func() {}
+	)
+	t.lock.Lock()
+	recent := t.recent(args.Lines, args.Level)
+	if args.Follow {
+		ch, cancel = t.subscribe()
+	}
+	t.lock.Unlock()
+	defer cancel()
+
+	for _, e := range recent {
+		if err := send(e); err != nil {
+			return nil
+		}
+	}
+	if !args.Follow {
+		return nil
+	}
+
+	for {
+		select {
+		case e := <-ch:
+			if e.Level < args.Level {
+				continue
+			}
+			if err := send(e); err != nil {
+				return nil
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Package metered detects whether the network uplink is metered, e.g. a
+// cellular modem or a phone hotspot.
+//
+// On Linux, the metered flag of NetworkManager is used if it is available.
+// Otherwise, and on other platforms, interfaces are classified by their
+// names.
+package metered
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cellularPrefixes are names of interfaces for cellular modems (pdp_ip on
+// macOS, wwan and wwp on Linux) and PPP links, commonly used for them.
+var cellularPrefixes = []string{"pdp_ip", "wwan", "wwp", "ppp"}
+
+// byName reports whether iface looks like a cellular interface.
+func byName(iface string) bool {
+	for _, p := range cellularPrefixes {
+		if strings.HasPrefix(iface, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect reports whether the interface is metered.
+func Detect(iface string) (bool, error) {
+	metered, known, err := detectSystem(iface)
+	if err != nil {
+		return false, err
+	}
+	if known {
+		return metered, nil
+	}
+	return byName(iface), nil
+}
+
+// Uplink returns the name of the interface used to reach dst. On Linux,
+// mark is set on the socket used for the lookup so policy routing for
+// packets with the mark applies, 0 disables it.
+func Uplink(dst net.IP, mark uint32) (string, error) {
+	d := net.Dialer{Control: markControl(mark)}
+	// No packets are sent, connecting the UDP socket only selects the
+	// route.
+	conn, err := d.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return "", fmt.Errorf("metered: uplink: %w", err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("metered: uplink: %w", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("metered: uplink: no interface with address %v", local)
+}
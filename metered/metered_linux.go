@@ -0,0 +1,49 @@
+package metered
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// detectSystem queries NetworkManager, known is false if it is not running
+// or does not know whether the device is metered.
+func detectSystem(iface string) (metered, known bool, err error) {
+	out, err := exec.Command("nmcli", "-g", "GENERAL.METERED", "device", "show", iface).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.Is(err, exec.ErrNotFound) || errors.As(err, &exitErr) {
+			// Not installed, not running or the device is not managed.
+			return false, false, nil
+		}
+		return false, false, fmt.Errorf("metered: nmcli: %w", err)
+	}
+	// "yes", "no", "yes (guessed)", "no (guessed)" or "unknown".
+	switch v := strings.TrimSpace(string(out)); {
+	case strings.HasPrefix(v, "yes"):
+		return true, true, nil
+	case strings.HasPrefix(v, "no"):
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+func markControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,106 @@
+// Package netwatch reports events after which network tunnels may be broken:
+// system wake-up after sleep and changes of network interfaces and
+// addresses.
+//
+// Wake-up is detected by comparing the wall clock with the monotonic clock,
+// which does not advance while the system is suspended. Interface changes
+// are received from the kernel (rtnetlink on Linux, the routing socket on
+// macOS and BSDs) and are not reported on other platforms.
+package netwatch
+
+import (
+	"time"
+)
+
+type Kind int
+
+const (
+	Wake Kind = iota
+	NetworkChange
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Wake:
+		return "wake"
+	case NetworkChange:
+		return "network-change"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Kind Kind
+	// Time spent suspended for Wake.
+	Slept time.Duration
+}
+
+const (
+	// clockCheck is how often clocks are compared.
+	clockCheck = 5 * time.Second
+	// minSleep is the difference between clocks reported as wake-up, it
+	// tolerates small wall clock adjustments.
+	minSleep = 10 * time.Second
+
+	// settle is how long interface changes are collected before the event
+	// is sent. Changes come in bursts when the network is switched.
+	settle = 2 * time.Second
+)
+
+// Watch sends events to the returned channel until stop is closed. Changes
+// of the interface with index ignore (e.g. the tunnel itself) are not
+// reported.
+//
+// Events are dropped if the receiver is not ready.
+func Watch(ignore int, stop <-chan struct{}) (<-chan Event, error) {
+	changes := make(chan struct{}, 1)
+	if err := watchLinks(ignore, changes, stop); err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event, 1)
+	send := func(ev Event) {
+		select {
+		case events <- ev:
+		default:
+		}
+	}
+	go func() {
+		clock := time.NewTicker(clockCheck)
+		defer clock.Stop()
+		// Round(0) strips the monotonic reading so Sub uses the wall clock.
+		last := time.Now()
+		lastWall := last.Round(0)
+
+		var settleC <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-clock.C:
+				wall := now.Round(0)
+				if slept := wall.Sub(lastWall) - now.Sub(last); slept > minSleep {
+					send(Event{Kind: Wake, Slept: slept})
+				}
+				last, lastWall = now, wall
+			case <-changes:
+				if settleC == nil {
+					settleC = time.After(settle)
+				}
+			case <-settleC:
+				settleC = nil
+				send(Event{Kind: NetworkChange})
+			}
+		}
+	}()
+	return events, nil
+}
+
+// notify sends to changes without blocking, it is used by watchLinks
+// implementations.
+func notify(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,67 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netwatch
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offsets in struct if_msghdr and struct ifa_msghdr, the same for all
+// supported systems.
+const (
+	rtmTypeOff  = 3
+	rtmIndexOff = 12
+)
+
+func watchLinks(ignore int, changes chan<- struct{}, stop <-chan struct{}) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("netwatch: %w", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("netwatch: %w", err)
+	}
+	// os.File uses the runtime poller, so Close interrupts the blocked Read.
+	sock := os.NewFile(uintptr(fd), "route")
+	go func() {
+		<-stop
+		sock.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := sock.Read(buf)
+			if err != nil {
+				select {
+				case <-stop:
+				default:
+					log.Println("error: netwatch:", err)
+				}
+				return
+			}
+			if n < rtmIndexOff+2 {
+				continue
+			}
+			switch buf[rtmTypeOff] {
+			case unix.RTM_IFINFO, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+			default:
+				continue
+			}
+			// u_short in host byte order.
+			index := int(*(*uint16)(unsafe.Pointer(&buf[rtmIndexOff])))
+			if index == ignore {
+				continue
+			}
+			notify(changes)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,51 @@
+package netwatch
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+func watchLinks(ignore int, changes chan<- struct{}, stop <-chan struct{}) error {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	})
+	if err != nil {
+		return fmt.Errorf("netwatch: %w", err)
+	}
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+
+	go func() {
+		for {
+			msgs, err := conn.Receive()
+			if err != nil {
+				select {
+				case <-stop:
+				default:
+					log.Println("error: netwatch:", err)
+				}
+				return
+			}
+			for _, msg := range msgs {
+				switch msg.Header.Type {
+				case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+				default:
+					continue
+				}
+				// Both struct ifinfomsg and struct ifaddrmsg have the
+				// interface index at offset 4.
+				if len(msg.Data) < 8 || int(nlenc.Uint32(msg.Data[4:8])) == ignore {
+					continue
+				}
+				notify(changes)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package netwatch
+
+// watchLinks does nothing, only wake-up is detected.
+func watchLinks(int, chan<- struct{}, <-chan struct{}) error {
+	return nil
+}
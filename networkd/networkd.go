@@ -0,0 +1,177 @@
+// Package networkd renders WireGuard interface configuration as
+// systemd-networkd .netdev and .network files.
+package networkd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultDir is the runtime configuration directory. Files there do not
+// survive reboot which matches the lifetime of the received configuration.
+const DefaultDir = "/run/systemd/network"
+
+func addrString(a linkmgr.Address) string {
+	ones, _ := a.Mask.Size()
+	return fmt.Sprintf("%v/%d", a.IP, ones)
+}
+
+// NetDev renders the .netdev file contents.
+func NetDev(name string, wg wgtypes.Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[NetDev]\nName=%s\nKind=wireguard\n", name)
+
+	b.WriteString("\n[WireGuard]\n")
+	if wg.PrivateKey != nil {
+		fmt.Fprintf(&b, "PrivateKey=%s\n", wg.PrivateKey)
+	}
+	if wg.ListenPort != nil && *wg.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort=%d\n", *wg.ListenPort)
+	}
+	if wg.FirewallMark != nil && *wg.FirewallMark != 0 {
+		fmt.Fprintf(&b, "FirewallMark=%d\n", *wg.FirewallMark)
+	}
+
+	for _, p := range wg.Peers {
+		fmt.Fprintf(&b, "\n[WireGuardPeer]\nPublicKey=%s\n", p.PublicKey)
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&b, "PresharedKey=%s\n", p.PresharedKey)
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&b, "Endpoint=%s\n", p.Endpoint)
+		}
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&b, "AllowedIPs=%s\n", ip.String())
+		}
+		if p.PersistentKeepaliveInterval != nil && *p.PersistentKeepaliveInterval != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive=%d\n", int(p.PersistentKeepaliveInterval.Seconds()))
+		}
+	}
+	return b.String()
+}
+
+// Network renders the .network file contents.
+func Network(name string, addrs []linkmgr.Address, routes []linkmgr.Route) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Match]\nName=%s\n", name)
+
+	// Addresses are managed by wirebox, do not let networkd add anything
+	// else.
+	b.WriteString("\n[Network]\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n")
+
+	for _, a := range addrs {
+		fmt.Fprintf(&b, "\n[Address]\nAddress=%s\n", addrString(a))
+		if a.Peer != nil {
+			ones, _ := a.Peer.Mask.Size()
+			fmt.Fprintf(&b, "Peer=%v/%d\n", a.Peer.IP, ones)
+		}
+		if a.Scope == linkmgr.ScopeLink {
+			b.WriteString("Scope=link\n")
+		}
+	}
+
+	for _, r := range routes {
+		fmt.Fprintf(&b, "\n[Route]\nDestination=%s\n", r.Dest.String())
+		if r.Src != nil {
+			fmt.Fprintf(&b, "PreferredSource=%v\n", r.Src)
+		}
+		if r.Type != linkmgr.RouteUnicast {
+			fmt.Fprintf(&b, "Type=%v\n", r.Type)
+		}
+		fmt.Fprintf(&b, "Protocol=%d\n", linkmgr.RouteProto)
+	}
+	return b.String()
+}
+
+func paths(dir, name string) (netdev, network string) {
+	base := filepath.Join(dir, "50-wirebox-"+name)
+	return base + ".netdev", base + ".network"
+}
+
+// Write stores the interface configuration in dir. created is true if the
+// interface was not configured before.
+func Write(dir, name string, wg wgtypes.Config, addrs []linkmgr.Address, routes []linkmgr.Route) (created bool, err error) {
+	netdevPath, networkPath := paths(dir, name)
+
+	if _, err := os.Stat(netdevPath); os.IsNotExist(err) {
+		created = true
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("networkd: %w", err)
+	}
+	// .netdev contains the private key, permit only networkd to read it.
+	if err := writeFile(netdevPath, NetDev(name, wg), 0640); err != nil {
+		return false, err
+	}
+	if grp, err := user.LookupGroup("systemd-network"); err == nil {
+		if gid, err := strconv.Atoi(grp.Gid); err == nil {
+			if err := os.Chown(netdevPath, 0, gid); err != nil {
+				return false, fmt.Errorf("networkd: %w", err)
+			}
+		}
+	}
+	if err := writeFile(networkPath, Network(name, addrs, routes), 0644); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+func writeFile(path, contents string, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(contents), mode); err != nil {
+		return fmt.Errorf("networkd: %w", err)
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("networkd: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("networkd: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the interface configuration files from dir.
+func Remove(dir, name string) error {
+	netdevPath, networkPath := paths(dir, name)
+	for _, p := range []string{netdevPath, networkPath} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("networkd: %w", err)
+		}
+	}
+	return nil
+}
+
+func networkctl(args ...string) error {
+	cmd := exec.Command("networkctl", args...)
+	audit.Command(cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("networkd: networkctl %v: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Reload makes networkd pick up changed files. Existing interface is
+// reconfigured since reload alone does not update already created netdevs.
+func Reload(name string, existing bool) error {
+	if err := networkctl("reload"); err != nil {
+		return err
+	}
+	if existing {
+		return networkctl("reconfigure", name)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Package nm integrates the client with NetworkManager using nmcli.
+//
+// The tunnel interface is handed to NetworkManager as externally configured
+// device so the desktop network indicator shows it and DNS servers are
+// registered through NetworkManager instead of rewriting resolv.conf.
+package nm
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/audit"
+)
+
+type Config struct {
+	Enable bool `toml:"enable"`
+
+	// DNS servers to use while the tunnel is up.
+	DNS []string `toml:"dns"`
+	// Search domains to register together with DNS servers.
+	DNSSearch []string `toml:"dns-search"`
+}
+
+// Integration is the wirebox.Listener that updates NetworkManager state on
+// tunnel lifecycle events.
+type Integration struct {
+	cfg Config
+
+	// Path to nmcli binary.
+	NMCLI string
+}
+
+func New(cfg Config) *Integration {
+	return &Integration{cfg: cfg, NMCLI: "nmcli"}
+}
+
+func (i *Integration) run(args ...string) error {
+	cmd := exec.Command(i.NMCLI, args...)
+	audit.Command(cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nm: nmcli %v: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (i *Integration) dnsArgs() []string {
+	var dns4, dns6 []string
+	for _, s := range i.cfg.DNS {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			dns4 = append(dns4, s)
+		} else {
+			dns6 = append(dns6, s)
+		}
+	}
+	search := strings.Join(i.cfg.DNSSearch, ",")
+
+	var args []string
+	if len(dns4) != 0 {
+		args = append(args, "ipv4.dns", strings.Join(dns4, ","), "ipv4.dns-search", search)
+	}
+	if len(dns6) != 0 {
+		args = append(args, "ipv6.dns", strings.Join(dns6, ","), "ipv6.dns-search", search)
+	}
+	return args
+}
+
+// Register hands the interface to NetworkManager and configures DNS.
+func (i *Integration) Register(link string) error {
+	if err := i.run("device", "set", link, "managed", "yes"); err != nil {
+		return err
+	}
+	if args := i.dnsArgs(); len(args) != 0 {
+		if err := i.run(append([]string{"device", "modify", link}, args...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unregister makes NetworkManager ignore the interface.
+func (i *Integration) Unregister(link string) error {
+	return i.run("device", "set", link, "managed", "no")
+}
+
+func (i *Integration) HandleEvent(e wirebox.Event) {
+	var err error
+	switch e := e.(type) {
+	case wirebox.TunnelUp:
+		err = i.Register(e.Link)
+	case wirebox.Reconfigured:
+		err = i.Register(e.Link)
+	case wirebox.Teardown:
+		err = i.Unregister(e.Link)
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
@@ -0,0 +1,163 @@
+// Package notify delivers lifecycle events to external programs using
+// webhooks or by executing a notifier command.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/audit"
+)
+
+type Config struct {
+	// URL to POST events to as JSON.
+	Webhook string `toml:"webhook"`
+
+	// Command to execute for each event. Event is passed as JSON via stdin
+	// and as WIREBOX_EVENT, WIREBOX_LINK environment variables.
+	Exec []string `toml:"exec"`
+
+	// Names of events to deliver. All events are delivered if empty.
+	Events []string `toml:"events"`
+}
+
+func (c Config) Enabled() bool {
+	return c.Webhook != "" || len(c.Exec) != 0
+}
+
+type payload struct {
+	Event string        `json:"event"`
+	Time  time.Time     `json:"time"`
+	Data  wirebox.Event `json:"data"`
+}
+
+const (
+	queueSize = 32
+	timeout   = 10 * time.Second
+)
+
+// Notifier is the wirebox.Listener that delivers events in background.
+//
+// Events are dropped if delivery falls too much behind.
+type Notifier struct {
+	cfg    Config
+	filter map[string]bool
+	client *http.Client
+
+	queue chan payload
+	wg    sync.WaitGroup
+}
+
+func New(cfg Config) *Notifier {
+	n := &Notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan payload, queueSize),
+	}
+	if len(cfg.Events) != 0 {
+		n.filter = make(map[string]bool, len(cfg.Events))
+		for _, e := range cfg.Events {
+			n.filter[e] = true
+		}
+	}
+
+	n.wg.Add(1)
+	go n.deliverLoop()
+	return n
+}
+
+func (n *Notifier) HandleEvent(e wirebox.Event) {
+	if n.filter != nil && !n.filter[e.EventName()] {
+		return
+	}
+
+	select {
+	case n.queue <- payload{Event: e.EventName(), Time: time.Now(), Data: e}:
+	default:
+		log.Println("WARNING: notify: queue is full, dropping", e.EventName())
+	}
+}
+
+func (n *Notifier) deliverLoop() {
+	defer n.wg.Done()
+	for p := range n.queue {
+		body, err := json.Marshal(p)
+		if err != nil {
+			log.Println("error: notify:", err)
+			continue
+		}
+
+		if n.cfg.Webhook != "" {
+			if err := n.post(body); err != nil {
+				log.Println("error: notify:", err)
+			}
+		}
+		if len(n.cfg.Exec) != 0 {
+			if err := n.exec(p, body); err != nil {
+				log.Println("error: notify:", err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) post(body []byte) error {
+	resp, err := n.client.Post(n.cfg.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: unexpected response status: %v", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) exec(p payload, body []byte) error {
+	var link struct {
+		Link string
+	}
+	data, _ := json.Marshal(p.Data)
+	_ = json.Unmarshal(data, &link)
+
+	cmd := exec.Command(n.cfg.Exec[0], n.cfg.Exec[1:]...)
+	cmd.Env = append(os.Environ(),
+		"WIREBOX_EVENT="+p.Event,
+		"WIREBOX_LINK="+link.Link,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	audit.Command(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("exec: %w", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("exec: %v: timed out", n.cfg.Exec[0])
+	}
+}
+
+// Close waits for all queued events to be delivered.
+func (n *Notifier) Close() error {
+	close(n.queue)
+	n.wg.Wait()
+	return nil
+}
@@ -0,0 +1,12 @@
+// Package ondemand detects traffic sent to the inactive tunnel interface so
+// the session can be started only when it is needed.
+package ondemand
+
+import (
+	"errors"
+)
+
+var (
+	ErrClosed  = errors.New("ondemand: trigger closed")
+	ErrTimeout = errors.New("ondemand: no packets before the deadline")
+)
@@ -0,0 +1,62 @@
+package ondemand
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Trigger receives packets passing the interface using the packet socket.
+type Trigger struct {
+	sock *os.File
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// Listen starts watching the interface. It should be called in the network
+// namespace of the interface.
+func Listen(ifindex int) (*Trigger, error) {
+	proto := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("ondemand: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifindex}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("ondemand: %w", err)
+	}
+	// os.File uses the runtime poller, so Close interrupts the blocked Read.
+	return &Trigger{sock: os.NewFile(uintptr(fd), "packet")}, nil
+}
+
+// SetDeadline limits the time Wait blocks for, zero value removes the limit.
+func (t *Trigger) SetDeadline(deadline time.Time) error {
+	return t.sock.SetReadDeadline(deadline)
+}
+
+// Wait blocks until a packet passes the interface, Close is called or the
+// deadline passes, in which case ErrClosed or ErrTimeout is returned.
+func (t *Trigger) Wait() error {
+	// Only the fact of the packet matters, it is truncated.
+	var buf [1]byte
+	_, err := t.sock.Read(buf[:])
+	if err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return ErrClosed
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ErrTimeout
+		}
+		return fmt.Errorf("ondemand: %w", err)
+	}
+	return nil
+}
+
+func (t *Trigger) Close() error {
+	return t.sock.Close()
+}
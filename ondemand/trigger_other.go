@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package ondemand
+
+import (
+	"errors"
+	"time"
+)
+
+type Trigger struct{}
+
+func Listen(int) (*Trigger, error) {
+	return nil, errors.New("ondemand: not supported on this platform")
+}
+
+func (*Trigger) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (*Trigger) Wait() error {
+	return ErrClosed
+}
+
+func (*Trigger) Close() error {
+	return nil
+}
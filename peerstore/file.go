@@ -0,0 +1,230 @@
+package peerstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+func init() {
+	Register("file", OpenFile)
+}
+
+// fileData is the contents of the store file.
+type fileData struct {
+	// Incremented by each update, used by Watch.
+	Version uint64 `json:"version"`
+	Peers   []Peer `json:"peers"`
+	// Slots by key, by pool name.
+	Leases map[string]map[string]uint64 `json:"leases,omitempty"`
+}
+
+// fileStore keeps peers in a JSON file replaced atomically on each update.
+// Updates by several processes are serialized by locking the lock file next
+// to it (flock(2), LockFileEx on Windows).
+type fileStore struct {
+	path string
+	// Serializes transactions within the process, file locks are per open
+	// file description.
+	lock sync.RWMutex
+}
+
+// OpenFile opens the file store, the file is created by the first update.
+func OpenFile(path string) (Store, error) {
+	if path == "" {
+		return nil, errors.New("file path is required")
+	}
+	return &fileStore{path: path}, nil
+}
+
+func (s *fileStore) withLock(exclusive bool, f func() error) error {
+	lf, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	if err := lockFile(lf, exclusive); err != nil {
+		return err
+	}
+	// Closing the file releases the lock.
+	return f()
+}
+
+func (s *fileStore) read() (*fileData, error) {
+	blob, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &fileData{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data fileData
+	if err := json.Unmarshal(blob, &data); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return &data, nil
+}
+
+func (s *fileStore) write(data *fileData) error {
+	blob, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) View(f func(Tx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.withLock(false, func() error {
+		data, err := s.read()
+		if err != nil {
+			return err
+		}
+		return f(&fileTx{data: data})
+	})
+}
+
+func (s *fileStore) Update(f func(Tx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.withLock(true, func() error {
+		data, err := s.read()
+		if err != nil {
+			return err
+		}
+		tx := &fileTx{data: data, writable: true}
+		if err := f(tx); err != nil {
+			return err
+		}
+		if !tx.changed {
+			return nil
+		}
+		data.Version++
+		return s.write(data)
+	})
+}
+
+func (s *fileStore) Watch(f func()) (func(), error) {
+	return pollWatch(func() (uint64, error) {
+		data, err := s.read()
+		if err != nil {
+			return 0, err
+		}
+		return data.Version, nil
+	}, f)
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+type fileTx struct {
+	data     *fileData
+	writable bool
+	changed  bool
+}
+
+var errReadOnly = errors.New("peerstore: read-only transaction")
+
+func (tx *fileTx) modify() error {
+	if !tx.writable {
+		return errReadOnly
+	}
+	tx.changed = true
+	return nil
+}
+
+func (tx *fileTx) Get(key string) (Peer, error) {
+	for _, p := range tx.data.Peers {
+		if p.Key == key {
+			return p, nil
+		}
+	}
+	return Peer{}, ErrNotFound
+}
+
+func (tx *fileTx) List() ([]Peer, error) {
+	return append([]Peer(nil), tx.data.Peers...), nil
+}
+
+func (tx *fileTx) Put(p Peer) error {
+	if err := tx.modify(); err != nil {
+		return err
+	}
+	for i := range tx.data.Peers {
+		if tx.data.Peers[i].Key == p.Key {
+			tx.data.Peers[i] = p
+			return nil
+		}
+	}
+	tx.data.Peers = append(tx.data.Peers, p)
+	return nil
+}
+
+func (tx *fileTx) Delete(key string) error {
+	if err := tx.modify(); err != nil {
+		return err
+	}
+	peers := tx.data.Peers[:0]
+	for _, p := range tx.data.Peers {
+		if p.Key != key {
+			peers = append(peers, p)
+		}
+	}
+	tx.data.Peers = peers
+	for _, leases := range tx.data.Leases {
+		delete(leases, key)
+	}
+	return nil
+}
+
+func (tx *fileTx) Lease(pool, key string) (uint64, error) {
+	if slot, ok := tx.data.Leases[pool][key]; ok {
+		return slot, nil
+	}
+	if err := tx.modify(); err != nil {
+		return 0, err
+	}
+	if tx.data.Leases == nil {
+		tx.data.Leases = make(map[string]map[string]uint64)
+	}
+	leases := tx.data.Leases[pool]
+	if leases == nil {
+		leases = make(map[string]uint64)
+		tx.data.Leases[pool] = leases
+	}
+	slot := freeSlot(leases)
+	leases[key] = slot
+	return slot, nil
+}
+
+func (tx *fileTx) Leases(pool string) (map[string]uint64, error) {
+	res := make(map[string]uint64, len(tx.data.Leases[pool]))
+	for key, slot := range tx.data.Leases[pool] {
+		res[key] = slot
+	}
+	return res, nil
+}
+
+func (tx *fileTx) Release(pool, key string) error {
+	if _, ok := tx.data.Leases[pool][key]; !ok {
+		return nil
+	}
+	if err := tx.modify(); err != nil {
+		return err
+	}
+	delete(tx.data.Leases[pool], key)
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package peerstore
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile locks f using flock(2), shared unless exclusive is set. The lock
+// is released once f is closed.
+func lockFile(f *os.File, exclusive bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		return fmt.Errorf("flock: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package peerstore
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile locks the first byte of f using LockFileEx, shared unless
+// exclusive is set. The lock is released once f is closed.
+func lockFile(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, new(windows.Overlapped)); err != nil {
+		return fmt.Errorf("LockFileEx: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package peerstore
+
+import (
+	"fmt"
+	"log"
+)
+
+// Migration is a step upgrading the store schema to Version.
+type Migration struct {
+	Version     int
+	Description string
+	// Statements executed by the migration, in the backend query language.
+	// Shown by dry runs.
+	Statements []string
+}
+
+// Migrator is implemented by backends with a versioned schema (e.g. SQL
+// databases). Open applies pending migrations automatically.
+type Migrator interface {
+	// SchemaVersion returns the version of the schema in the store, 0 if it
+	// is empty, and the latest version supported by the backend.
+	SchemaVersion() (current, latest int, err error)
+	// Pending returns migrations not applied to the store yet, in order.
+	Pending() ([]Migration, error)
+	// Migrate applies pending migrations in a single transaction, so the
+	// schema is either fully upgraded or left as is.
+	Migrate() error
+}
+
+// SchemaTooNewError is returned if the store was upgraded by a newer
+// version of wirebox, it cannot be used by older ones.
+type SchemaTooNewError struct {
+	Current, Latest int
+}
+
+func (e SchemaTooNewError) Error() string {
+	return fmt.Sprintf("schema version %d is newer than the supported %d, upgrade wirebox", e.Current, e.Latest)
+}
+
+// pendingMigrations returns migrations after version current.
+func pendingMigrations(all []Migration, current int) ([]Migration, error) {
+	latest := all[len(all)-1].Version
+	if current > latest {
+		return nil, SchemaTooNewError{Current: current, Latest: latest}
+	}
+	for i, m := range all {
+		if m.Version > current {
+			return all[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// migrate upgrades the schema of s if it is a Migrator.
+func migrate(s Store) error {
+	m, ok := s.(Migrator)
+	if !ok {
+		return nil
+	}
+	current, latest, err := m.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case current == latest:
+		return nil
+	case current > latest:
+		return SchemaTooNewError{Current: current, Latest: latest}
+	}
+	if err := m.Migrate(); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if current != 0 {
+		log.Printf("peerstore: upgraded schema from version %d to %d", current, latest)
+	}
+	return nil
+}
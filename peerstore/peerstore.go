@@ -0,0 +1,175 @@
+// Package peerstore defines the storage of clients known to the server and of
+// pool slots leased to them. Backends are registered by name, "file" and
+// "sqlite" are built in. Other backends (e.g. Redis or PostgreSQL) can be
+// added by a package calling Register from its init function and imported by
+// a custom build of the server.
+package peerstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Tx.Get if there is no peer with the key.
+var ErrNotFound = errors.New("peerstore: peer not found")
+
+// Peer is the client stored in the store.
+type Peer struct {
+	// Public key of the client, base64-encoded.
+	Key string `json:"key"`
+	// Client settings in the format of peers file entries (YAML), empty
+	// to use defaults.
+	Settings []byte    `json:"settings,omitempty"`
+	Added    time.Time `json:"added"`
+}
+
+// Tx is the transaction started by Store.View or Store.Update. It should not
+// be used after the function it is passed to returns.
+type Tx interface {
+	// Get returns the peer with the key or ErrNotFound.
+	Get(key string) (Peer, error)
+	// List returns all peers in the order they were added.
+	List() ([]Peer, error)
+	// Put adds the peer or replaces the one with the same key, keeping its
+	// position in List.
+	Put(p Peer) error
+	// Delete removes the peer and its leases. Deleting a missing peer is not
+	// an error.
+	Delete(key string) error
+
+	// Lease returns the slot of the pool allocated to the key, allocating
+	// the lowest free slot starting from 1 if there is none.
+	Lease(pool, key string) (uint64, error)
+	// Leases returns slots allocated in the pool by key.
+	Leases(pool string) (map[string]uint64, error)
+	// Release frees the slot allocated to the key.
+	Release(pool, key string) error
+}
+
+// Store is the peer store backend. Implementations should be safe for
+// concurrent use and should serialize Update calls with other processes
+// using the same store.
+type Store interface {
+	// View runs f in a read-only transaction. Write methods of Tx fail.
+	View(f func(Tx) error) error
+	// Update runs f in a read-write transaction. Changes are discarded if
+	// f returns an error.
+	Update(f func(Tx) error) error
+	// Watch calls f after the store is changed, including by other
+	// processes, until stop is called. Calls can be delayed and
+	// coalesced.
+	Watch(f func()) (stop func(), err error)
+	Close() error
+}
+
+// OpenFunc opens the store described by the backend-specific DSN, e.g. the
+// file path.
+type OpenFunc func(dsn string) (Store, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]OpenFunc{}
+)
+
+// Register makes the backend available to Open under the name. It panics if
+// the name is already registered.
+func Register(name string, open OpenFunc) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := backends[name]; ok {
+		panic("peerstore: backend registered twice: " + name)
+	}
+	backends[name] = open
+}
+
+// Backends returns names of registered backends, sorted.
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	res := make([]string, 0, len(backends))
+	for name := range backends {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Open opens the store using the named backend and upgrades its schema if
+// the backend is a Migrator.
+func Open(backend, dsn string) (Store, error) {
+	s, err := OpenUnmigrated(backend, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(s); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("peerstore: %v: %w", backend, err)
+	}
+	return s, nil
+}
+
+// OpenUnmigrated opens the store without changing its schema, e.g. to list
+// pending migrations. Stores with outdated schema should not be used
+// otherwise.
+func OpenUnmigrated(backend, dsn string) (Store, error) {
+	backendsLock.RLock()
+	open, ok := backends[backend]
+	backendsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("peerstore: unknown backend %v", backend)
+	}
+	s, err := open(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("peerstore: %v: %w", backend, err)
+	}
+	return s, nil
+}
+
+// pollInterval is how often backends without change notifications check the
+// store version in Watch.
+const pollInterval = 2 * time.Second
+
+// pollWatch implements Watch by calling f whenever the value returned by
+// version changes.
+func pollWatch(version func() (uint64, error), f func()) (stop func(), err error) {
+	last, err := version()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(pollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			v, err := version()
+			if err != nil || v == last {
+				continue
+			}
+			last = v
+			f()
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+// freeSlot returns the lowest slot starting from 1 not in used.
+func freeSlot(used map[string]uint64) uint64 {
+	taken := make(map[uint64]bool, len(used))
+	for _, slot := range used {
+		taken[slot] = true
+	}
+	slot := uint64(1)
+	for taken[slot] {
+		slot++
+	}
+	return slot
+}
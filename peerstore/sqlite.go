@@ -0,0 +1,287 @@
+package peerstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sqliteDriver is the database/sql driver name used by the sqlite backend. The
+// driver is linked only if built with the sqlite tag, see sqlite_driver.go.
+const sqliteDriver = "sqlite3"
+
+func init() {
+	Register("sqlite", OpenSQLite)
+}
+
+// sqliteMigrations is the schema history, the version reached is kept in
+// PRAGMA user_version. Released migrations should not be changed, add new
+// ones instead.
+var sqliteMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create peers, leases and meta tables",
+		// Databases created before migrations were introduced have the
+		// tables already.
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS peers (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				key TEXT NOT NULL UNIQUE,
+				settings BLOB,
+				added INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS leases (
+				pool TEXT NOT NULL,
+				key TEXT NOT NULL,
+				slot INTEGER NOT NULL,
+				PRIMARY KEY (pool, key),
+				UNIQUE (pool, slot)
+			)`,
+			`CREATE TABLE IF NOT EXISTS meta (
+				name TEXT PRIMARY KEY,
+				value INTEGER NOT NULL
+			)`,
+			`INSERT OR IGNORE INTO meta (name, value) VALUES ('version', 0)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "index leases by key",
+		Statements: []string{
+			`CREATE INDEX IF NOT EXISTS leases_key ON leases (key)`,
+		},
+	},
+}
+
+// sqliteStore keeps peers in the SQLite database. SQLite serializes writers
+// itself, the store version in the meta table is incremented by each update
+// for Watch.
+type sqliteStore struct {
+	db *sql.DB
+	// Serializes updates within the process to avoid SQLITE_BUSY.
+	lock sync.Mutex
+}
+
+// OpenSQLite opens the SQLite database at the DSN (the file path with
+// optional driver parameters). Tables are created by Migrate.
+func OpenSQLite(dsn string) (Store, error) {
+	if dsn == "" {
+		return nil, errors.New("database path is required")
+	}
+	db, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%w (the sqlite driver is linked only with the sqlite build tag)", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) SchemaVersion() (current, latest int, err error) {
+	latest = sqliteMigrations[len(sqliteMigrations)-1].Version
+	err = s.db.QueryRow(`PRAGMA user_version`).Scan(&current)
+	return current, latest, err
+}
+
+func (s *sqliteStore) Pending() ([]Migration, error) {
+	current, _, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(sqliteMigrations, current)
+}
+
+func (s *sqliteStore) Migrate() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Read within the transaction, another server sharing the database
+	// could have migrated it since Pending.
+	var current int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&current); err != nil {
+		return err
+	}
+	pending, err := pendingMigrations(sqliteMigrations, current)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		for _, stmt := range m.Statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("version %d: %w", m.Version, err)
+			}
+		}
+		// PRAGMA does not accept parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.Version)); err != nil {
+			return fmt.Errorf("version %d: %w", m.Version, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) View(f func(Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return f(&sqliteTx{tx: tx})
+}
+
+func (s *sqliteStore) Update(f func(Tx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stx := &sqliteTx{tx: tx, writable: true}
+	if err := f(stx); err != nil {
+		return err
+	}
+	if stx.changed {
+		if _, err := tx.Exec(`UPDATE meta SET value = value + 1 WHERE name = 'version'`); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Watch(f func()) (func(), error) {
+	return pollWatch(func() (uint64, error) {
+		var v uint64
+		err := s.db.QueryRow(`SELECT value FROM meta WHERE name = 'version'`).Scan(&v)
+		return v, err
+	}, f)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+type sqliteTx struct {
+	tx       *sql.Tx
+	writable bool
+	changed  bool
+}
+
+func (tx *sqliteTx) modify() error {
+	if !tx.writable {
+		return errReadOnly
+	}
+	tx.changed = true
+	return nil
+}
+
+func (tx *sqliteTx) Get(key string) (Peer, error) {
+	p := Peer{Key: key}
+	var added int64
+	err := tx.tx.QueryRow(`SELECT settings, added FROM peers WHERE key = ?`, key).Scan(&p.Settings, &added)
+	if err == sql.ErrNoRows {
+		return Peer{}, ErrNotFound
+	}
+	if err != nil {
+		return Peer{}, err
+	}
+	p.Added = time.Unix(added, 0)
+	return p, nil
+}
+
+func (tx *sqliteTx) List() ([]Peer, error) {
+	rows, err := tx.tx.Query(`SELECT key, settings, added FROM peers ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Peer
+	for rows.Next() {
+		var (
+			p     Peer
+			added int64
+		)
+		if err := rows.Scan(&p.Key, &p.Settings, &added); err != nil {
+			return nil, err
+		}
+		p.Added = time.Unix(added, 0)
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+func (tx *sqliteTx) Put(p Peer) error {
+	if err := tx.modify(); err != nil {
+		return err
+	}
+	// The row is updated in place so seq, and so the order of peers, is
+	// kept.
+	_, err := tx.tx.Exec(`INSERT INTO peers (key, settings, added) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET settings = excluded.settings, added = excluded.added`,
+		p.Key, p.Settings, p.Added.Unix())
+	return err
+}
+
+func (tx *sqliteTx) Delete(key string) error {
+	if err := tx.modify(); err != nil {
+		return err
+	}
+	if _, err := tx.tx.Exec(`DELETE FROM leases WHERE key = ?`, key); err != nil {
+		return err
+	}
+	_, err := tx.tx.Exec(`DELETE FROM peers WHERE key = ?`, key)
+	return err
+}
+
+func (tx *sqliteTx) Lease(pool, key string) (uint64, error) {
+	leases, err := tx.Leases(pool)
+	if err != nil {
+		return 0, err
+	}
+	if slot, ok := leases[key]; ok {
+		return slot, nil
+	}
+	if err := tx.modify(); err != nil {
+		return 0, err
+	}
+	slot := freeSlot(leases)
+	if _, err := tx.tx.Exec(`INSERT INTO leases (pool, key, slot) VALUES (?, ?, ?)`, pool, key, slot); err != nil {
+		return 0, err
+	}
+	return slot, nil
+}
+
+func (tx *sqliteTx) Leases(pool string) (map[string]uint64, error) {
+	rows, err := tx.tx.Query(`SELECT key, slot FROM leases WHERE pool = ?`, pool)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]uint64)
+	for rows.Next() {
+		var (
+			key  string
+			slot uint64
+		)
+		if err := rows.Scan(&key, &slot); err != nil {
+			return nil, err
+		}
+		res[key] = slot
+	}
+	return res, rows.Err()
+}
+
+func (tx *sqliteTx) Release(pool, key string) error {
+	if err := tx.modify(); err != nil {
+		return err
+	}
+	_, err := tx.tx.Exec(`DELETE FROM leases WHERE pool = ? AND key = ?`, pool, key)
+	return err
+}
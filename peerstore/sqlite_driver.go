@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package peerstore
+
+// The driver uses cgo and is not linked into default builds, build with
+// -tags sqlite to use the sqlite backend.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,107 @@
+// Package policy compiles CEL (https://github.com/google/cel-go) expressions
+// used by server policy rules. Expressions are evaluated against variables
+// describing the request and yield a boolean, e.g.
+//
+//	group == "contractors" && !(weekday in ["Sat", "Sun"])
+//	!("mesh" in caps) || inNet(source, "203.0.113.0/24")
+//
+// Variables are declared with their types, so Compile rejects unknown
+// variables and functions and type mismatches at configuration load. In
+// addition to the CEL standard library (e.g. startsWith, contains, exists),
+// inNet(ip, cidr) is available to all expressions.
+package policy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// Var declares the variable available to expressions.
+type Var struct {
+	Name string
+	Type *cel.Type
+}
+
+// Env lists variables and functions available to expressions.
+type Env struct {
+	Vars []Var
+	// Functions declared using cel.Function.
+	Funcs []cel.EnvOption
+}
+
+var inNet = cel.Function("inNet",
+	cel.Overload("inNet_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+		cel.BinaryBinding(func(ip, cidr ref.Val) ref.Val {
+			ipStr, ok := ip.Value().(string)
+			if !ok {
+				return types.MaybeNoSuchOverloadErr(ip)
+			}
+			cidrStr, ok := cidr.Value().(string)
+			if !ok {
+				return types.MaybeNoSuchOverloadErr(cidr)
+			}
+			_, n, err := net.ParseCIDR(cidrStr)
+			if err != nil {
+				return types.NewErr("inNet: %v", err)
+			}
+			parsed := net.ParseIP(ipStr)
+			return types.Bool(parsed != nil && n.Contains(parsed))
+		}),
+	),
+)
+
+// Expr is the compiled expression.
+type Expr struct {
+	src string
+	prg cel.Program
+}
+
+// Compile parses and type-checks the expression against env, it should yield
+// a boolean.
+func Compile(src string, env Env) (*Expr, error) {
+	opts := make([]cel.EnvOption, 0, len(env.Vars)+len(env.Funcs)+1)
+	for _, v := range env.Vars {
+		opts = append(opts, cel.Variable(v.Name, v.Type))
+	}
+	opts = append(opts, inNet)
+	opts = append(opts, env.Funcs...)
+	celEnv, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, iss := celEnv.Compile(src)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if !ast.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("expression yields %v, not bool", ast.OutputType())
+	}
+	prg, err := celEnv.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: src, prg: prg}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression with values of all variables of the
+// environment it was compiled with.
+func (e *Expr) Eval(vars map[string]interface{}) (bool, error) {
+	out, _, err := e.prg.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression yields %v, not bool", out.Type())
+	}
+	return b, nil
+}
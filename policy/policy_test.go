@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+)
+
+var testEnv = Env{
+	Vars: []Var{
+		{"group", cel.StringType},
+		{"hour", cel.IntType},
+		{"caps", cel.ListType(cel.StringType)},
+		{"source", cel.StringType},
+		{"flag", cel.BoolType},
+	},
+}
+
+var testVars = map[string]interface{}{
+	"group":  "contractors",
+	"hour":   int64(19),
+	"caps":   []string{"mesh", "hosts"},
+	"source": "203.0.113.7",
+	"flag":   true,
+}
+
+func TestEval(t *testing.T) {
+	cases := []struct {
+		src  string
+		want bool
+	}{
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!flag && true`, false},
+		{`!(hour < 18)`, true},
+
+		{`group == "contractors"`, true},
+		{`group != "contractors"`, false},
+		{`hour >= 18 && hour < 20`, true},
+		{`hour > 19 || hour <= 8`, false},
+		{`"mesh" in caps`, true},
+		{`"routes" in caps`, false},
+		{`group.contains("tract")`, true},
+		{`group in ["staff", "contractors"]`, true},
+		{`caps.exists(c, c.startsWith("ho"))`, true},
+		{`inNet(source, "203.0.113.0/24")`, true},
+		{`inNet(source, "2001:db8::/32")`, false},
+		{`inNet("garbage", "203.0.113.0/24")`, false},
+		{`group.startsWith("contr") && group.endsWith("ors")`, true},
+
+		// The right operand is not evaluated.
+		{`false && inNet(source, "bad")`, false},
+	}
+	for _, c := range cases {
+		e, err := Compile(c.src, testEnv)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", c.src, err)
+			continue
+		}
+		got, err := e.Eval(testVars)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", c.src, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Eval(%q) = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{``, "Syntax error"},
+		{`group ==`, "Syntax error"},
+		{`(group == "a"`, "Syntax error"},
+		{`nope == 1`, "undeclared reference to 'nope'"},
+		{`nope(group)`, "undeclared reference to 'nope'"},
+		{`hour`, "expression yields int, not bool"},
+		{`group`, "expression yields string, not bool"},
+		{`hour < "19"`, "no matching overload"},
+		{`hour && true`, "expected type 'bool' but found 'int'"},
+		{`inNet(hour, "10.0.0.0/8")`, "no matching overload"},
+		{`inNet(source)`, "no matching overload"},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.src, testEnv)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Compile(%q): error %v, want %q", c.src, err, c.err)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	e, err := Compile(`inNet(source, "bad")`, testEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(testVars); err == nil || !strings.Contains(err.Error(), "invalid CIDR") {
+		t.Errorf("Eval: error %v, want invalid CIDR", err)
+	}
+
+	e, err = Compile(`group == "a"`, testEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "group") {
+		t.Errorf("Eval: error %v, want missing variable", err)
+	}
+}
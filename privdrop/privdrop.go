@@ -0,0 +1,65 @@
+// Package privdrop switches the process to an unprivileged user once it is
+// initialized, keeping only the capabilities it still needs.
+package privdrop
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultCapabilities are kept if Config.Capabilities is empty: managing
+// interfaces, addresses, routes and WireGuard peers, and binding sockets for
+// tunnels added later.
+var DefaultCapabilities = []string{"CAP_NET_ADMIN", "CAP_NET_BIND_SERVICE"}
+
+// capNumbers lists capabilities that can be kept, numbers are from
+// linux/capability.h.
+var capNumbers = map[string]uint{
+	"CAP_NET_BIND_SERVICE": 10,
+	"CAP_NET_BROADCAST":    11,
+	"CAP_NET_ADMIN":        12,
+	"CAP_NET_RAW":          13,
+}
+
+type Config struct {
+	// User to switch to, privileges are not dropped if empty.
+	User string `toml:"user"`
+	// Group to switch to, the primary group of User if empty.
+	Group string `toml:"group"`
+	// Capabilities kept after switching, DefaultCapabilities if empty.
+	Capabilities []string `toml:"capabilities"`
+}
+
+func (c Config) Enabled() bool {
+	return c.User != ""
+}
+
+// Validate checks the configuration, field names in errors are relative to
+// the configuration section.
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		if c.Group != "" || len(c.Capabilities) != 0 {
+			return fmt.Errorf("user is required")
+		}
+		return nil
+	}
+	for _, name := range c.Capabilities {
+		if _, ok := capNumbers[strings.ToUpper(name)]; !ok {
+			return fmt.Errorf("capabilities: unknown or not allowed capability %v", name)
+		}
+	}
+	return nil
+}
+
+// capMask returns the bitmask of capabilities to keep.
+func (c Config) capMask() uint64 {
+	names := c.Capabilities
+	if len(names) == 0 {
+		names = DefaultCapabilities
+	}
+	var mask uint64
+	for _, name := range names {
+		mask |= 1 << capNumbers[strings.ToUpper(name)]
+	}
+	return mask
+}
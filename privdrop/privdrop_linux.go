@@ -0,0 +1,106 @@
+package privdrop
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// allThreads runs the syscall on all threads of the process, credentials
+// and capabilities are per-thread on Linux.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		return errors.New("not supported in cgo builds (e.g. with -tags sqlite)")
+	default:
+		return errno
+	}
+}
+
+func lookup(c Config) (uid, gid int, err error) {
+	u, err := user.Lookup(c.User)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c.Group != "" {
+		g, err := user.LookupGroup(c.Group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// Drop switches all threads of the process to the configured user and
+// group and reduces capabilities to the configured ones. They are also
+// raised in the ambient set so programs run by the process (e.g. nft) get
+// them too. Sockets and files opened before stay usable.
+func Drop(c Config) error {
+	uid, gid, err := lookup(c)
+	if err != nil {
+		return fmt.Errorf("privdrop: %w", err)
+	}
+	if uid == 0 {
+		return fmt.Errorf("privdrop: %s is root", c.User)
+	}
+	mask := c.capMask()
+
+	// Otherwise permitted capabilities are cleared when the UID changes.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("privdrop: keep capabilities: %w", err)
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("privdrop: setgroups: %w", err)
+	}
+	if err := syscall.Setresgid(gid, gid, gid); err != nil {
+		return fmt.Errorf("privdrop: setresgid: %w", err)
+	}
+	if err := syscall.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("privdrop: setresuid: %w", err)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for i := range data {
+		set := uint32(mask >> (32 * i))
+		data[i] = unix.CapUserData{Effective: set, Permitted: set, Inheritable: set}
+	}
+	if err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); err != nil {
+		return fmt.Errorf("privdrop: capset: %w", err)
+	}
+	for num := uint(0); num < 64; num++ {
+		if mask&(1<<num) == 0 {
+			continue
+		}
+		if err := allThreads(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(num)); err != nil {
+			return fmt.Errorf("privdrop: ambient capabilities: %w", err)
+		}
+	}
+
+	// Programs run later cannot gain privileges back via setuid binaries or
+	// file capabilities.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("privdrop: no new privileges: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package privdrop
+
+import (
+	"errors"
+)
+
+func Drop(c Config) error {
+	return errors.New("privdrop: not supported on this platform")
+}
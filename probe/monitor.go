@@ -0,0 +1,178 @@
+package probe
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type MonitorConfig struct {
+	// Interval between probe rounds.
+	Interval time.Duration
+	// Timeout for the single echo request.
+	Timeout time.Duration
+	// Number of last probes used to calculate the statistics.
+	Window int
+
+	// Thresholds to consider the target degraded. Zero disables the check.
+	MaxRTT  time.Duration
+	MaxLoss float64
+}
+
+type TargetStats struct {
+	Target   string        `json:"target"`
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Loss     float64       `json:"loss"`
+	LastRTT  time.Duration `json:"last-rtt"`
+	AvgRTT   time.Duration `json:"avg-rtt"`
+	MaxRTT   time.Duration `json:"max-rtt"`
+	Degraded string        `json:"degraded,omitempty"`
+}
+
+type target struct {
+	ip net.IP
+	// Ring buffer of the last probe results, negative value means the
+	// probe was lost.
+	window []time.Duration
+	next   int
+	filled bool
+	last   time.Duration
+}
+
+func (t *target) add(rtt time.Duration) {
+	t.window[t.next] = rtt
+	t.next = (t.next + 1) % len(t.window)
+	if t.next == 0 {
+		t.filled = true
+	}
+	if rtt >= 0 {
+		t.last = rtt
+	}
+}
+
+func (t *target) stats(cfg MonitorConfig) TargetStats {
+	s := TargetStats{Target: t.ip.String(), LastRTT: t.last}
+
+	count := t.next
+	if t.filled {
+		count = len(t.window)
+	}
+	var total time.Duration
+	for _, rtt := range t.window[:count] {
+		s.Sent++
+		if rtt < 0 {
+			continue
+		}
+		s.Received++
+		total += rtt
+		if rtt > s.MaxRTT {
+			s.MaxRTT = rtt
+		}
+	}
+	if s.Received != 0 {
+		s.AvgRTT = total / time.Duration(s.Received)
+	}
+	if s.Sent != 0 {
+		s.Loss = float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+
+	switch {
+	case s.Sent != 0 && s.Received == 0:
+		s.Degraded = "unreachable"
+	case cfg.MaxLoss != 0 && s.Loss > cfg.MaxLoss:
+		s.Degraded = fmt.Sprintf("loss %.0f%% above %.0f%%", s.Loss*100, cfg.MaxLoss*100)
+	case cfg.MaxRTT != 0 && s.AvgRTT > cfg.MaxRTT:
+		s.Degraded = fmt.Sprintf("average rtt %v above %v", s.AvgRTT, cfg.MaxRTT)
+	}
+	return s
+}
+
+// Monitor periodically probes the targets and keeps the latency and loss
+// statistics over the sliding window.
+type Monitor struct {
+	cfg     MonitorConfig
+	targets []*target
+
+	lock sync.Mutex
+
+	// Called after each probe round with the current statistics.
+	OnUpdate func([]TargetStats)
+
+	// Function used to send probes, Ping if nil.
+	Ping func(dst net.IP, timeout time.Duration) (time.Duration, error)
+
+	// Probe rounds are skipped while Paused returns true.
+	Paused func() bool
+}
+
+func NewMonitor(cfg MonitorConfig, targets []net.IP) *Monitor {
+	m := &Monitor{cfg: cfg}
+	for _, ip := range targets {
+		m.targets = append(m.targets, &target{
+			ip:     ip,
+			window: make([]time.Duration, cfg.Window),
+		})
+	}
+	return m
+}
+
+func (m *Monitor) Stats() []TargetStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := make([]TargetStats, 0, len(m.targets))
+	for _, t := range m.targets {
+		stats = append(stats, t.stats(m.cfg))
+	}
+	return stats
+}
+
+func (m *Monitor) round() {
+	ping := m.Ping
+	if ping == nil {
+		ping = Ping
+	}
+
+	var wg sync.WaitGroup
+	results := make([]time.Duration, len(m.targets))
+	for i, t := range m.targets {
+		i, t := i, t
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt, err := ping(t.ip, m.cfg.Timeout)
+			if err != nil {
+				rtt = -1
+			}
+			results[i] = rtt
+		}()
+	}
+	wg.Wait()
+
+	m.lock.Lock()
+	for i, t := range m.targets {
+		t.add(results[i])
+	}
+	m.lock.Unlock()
+
+	if m.OnUpdate != nil {
+		m.OnUpdate(m.Stats())
+	}
+}
+
+// Run probes targets until stop is closed.
+func (m *Monitor) Run(stop <-chan struct{}) {
+	tick := time.NewTicker(m.cfg.Interval)
+	defer tick.Stop()
+	for {
+		if m.Paused == nil || !m.Paused() {
+			m.round()
+		}
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+	}
+}
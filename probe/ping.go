@@ -0,0 +1,124 @@
+// Package probe implements ICMP echo probing used to verify that the tunnel
+// actually passes traffic.
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protoICMP   = 1
+	protoICMPv6 = 58
+)
+
+var (
+	ErrTimeout = errors.New("probe: timed out")
+
+	seq uint32
+)
+
+func listen(dst net.IP) (*icmp.PacketConn, bool, error) {
+	network, unprivNetwork, laddr := "ip4:icmp", "udp4", "0.0.0.0"
+	if dst.To4() == nil {
+		network, unprivNetwork, laddr = "ip6:ipv6-icmp", "udp6", "::"
+	}
+
+	c, err := icmp.ListenPacket(network, laddr)
+	if err == nil {
+		return c, false, nil
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		return nil, false, err
+	}
+
+	// Fallback to unprivileged ICMP sockets (net.ipv4.ping_group_range).
+	c, err = icmp.ListenPacket(unprivNetwork, laddr)
+	return c, true, err
+}
+
+// Ping sends a single ICMP echo request to dst and waits for the reply.
+// Round-trip time is returned on success.
+func Ping(dst net.IP, timeout time.Duration) (time.Duration, error) {
+	c, unpriv, err := listen(dst)
+	if err != nil {
+		return 0, fmt.Errorf("probe: %w", err)
+	}
+	defer c.Close()
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return 0, fmt.Errorf("probe: %w", err)
+	}
+
+	var (
+		reqType   icmp.Type = ipv4.ICMPTypeEcho
+		replyType icmp.Type = ipv4.ICMPTypeEchoReply
+		proto               = protoICMP
+	)
+	if dst.To4() == nil {
+		reqType, replyType, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, protoICMPv6
+	} else {
+		dst = dst.To4()
+	}
+
+	req, err := (&icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{
+			ID:   os.Getpid() & 0xffff,
+			Seq:  int(atomic.AddUint32(&seq, 1) & 0xffff),
+			Data: token,
+		},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, fmt.Errorf("probe: %w", err)
+	}
+
+	var addr net.Addr = &net.IPAddr{IP: dst}
+	if unpriv {
+		addr = &net.UDPAddr{IP: dst}
+	}
+
+	start := time.Now()
+	if _, err := c.WriteTo(req, addr); err != nil {
+		return 0, fmt.Errorf("probe: %w", err)
+	}
+	if err := c.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, fmt.Errorf("probe: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, ErrTimeout
+			}
+			return 0, fmt.Errorf("probe: %w", err)
+		}
+		rtt := time.Since(start)
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != replyType {
+			continue
+		}
+		// Raw sockets receive all ICMP traffic, use the random payload to
+		// find our reply.
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || !bytes.Equal(echo.Data, token) {
+			continue
+		}
+		return rtt, nil
+	}
+}
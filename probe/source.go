@@ -0,0 +1,84 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+// Source pins probes to the address and the interface they are sent from.
+// Routing would otherwise pick the source by the destination, e.g. the
+// uplink if it has a more specific route than the tunnel.
+type Source struct {
+	// Address of the same family as the destination, the address of the
+	// interface picked by routing is used if nil.
+	Addr net.IP
+	// Interface name, not restricted if empty.
+	Dev string
+}
+
+// Hop is the router or the destination that answered the probe with the
+// specific TTL.
+type Hop struct {
+	TTL int `json:"ttl"`
+	// nil if nothing answered within the timeout.
+	Addr net.IP        `json:"addr,omitempty"`
+	RTT  time.Duration `json:"rtt,omitempty"`
+	// ICMP error that ends the path, e.g. "destination unreachable".
+	Error string `json:"error,omitempty"`
+}
+
+// PingFrom is Ping sending the request from src. It requires raw sockets
+// (CAP_NET_RAW).
+func PingFrom(src Source, dst net.IP, timeout time.Duration) (time.Duration, error) {
+	hop, _, err := sendProbe(src, dst, 0, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if hop.Addr == nil {
+		return 0, ErrTimeout
+	}
+	if hop.Error != "" {
+		return 0, fmt.Errorf("probe: %s from %v", hop.Error, hop.Addr)
+	}
+	return hop.RTT, nil
+}
+
+// Trace sends echo requests from src with increasing TTL and calls f for
+// each hop until dst answers, the path ends with an error or maxHops is
+// reached. It requires raw sockets (CAP_NET_RAW).
+func Trace(src Source, dst net.IP, maxHops int, timeout time.Duration, f func(Hop) error) error {
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		hop, done, err := sendProbe(src, dst, ttl, timeout)
+		if err != nil {
+			return err
+		}
+		if err := f(hop); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// matchQuoted checks whether the datagram quoted in the ICMP error is the
+// echo request with id and seq.
+func matchQuoted(data []byte, v4 bool, id, seq int) bool {
+	hdrLen := ipv6.HeaderLen
+	if v4 {
+		if len(data) == 0 {
+			return false
+		}
+		hdrLen = int(data[0]&0x0f) << 2
+	}
+	if len(data) < hdrLen+8 {
+		return false
+	}
+	echo := data[hdrLen:]
+	return int(binary.BigEndian.Uint16(echo[4:])) == id && int(binary.BigEndian.Uint16(echo[6:])) == seq
+}
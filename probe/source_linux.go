@@ -0,0 +1,159 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// listenSource creates the raw ICMP socket bound to src. ttl is not changed
+// if zero.
+func listenSource(src Source, v4 bool, ttl int) (net.PacketConn, error) {
+	family, proto := unix.AF_INET6, unix.IPPROTO_ICMPV6
+	if v4 {
+		family, proto = unix.AF_INET, unix.IPPROTO_ICMP
+	}
+	fd, err := unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	// FilePacketConn duplicates the descriptor.
+	defer f.Close()
+
+	if src.Dev != "" {
+		if err := unix.BindToDevice(fd, src.Dev); err != nil {
+			return nil, fmt.Errorf("bind to %s: %w", src.Dev, err)
+		}
+	}
+	if ttl != 0 {
+		if v4 {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("set TTL: %w", err)
+		}
+	}
+	if src.Addr != nil {
+		var sa unix.Sockaddr
+		if v4 {
+			if src.Addr.To4() == nil {
+				return nil, fmt.Errorf("source %v is not an IPv4 address", src.Addr)
+			}
+			sa4 := &unix.SockaddrInet4{}
+			copy(sa4.Addr[:], src.Addr.To4())
+			sa = sa4
+		} else {
+			if src.Addr.To4() != nil {
+				return nil, fmt.Errorf("source %v is not an IPv6 address", src.Addr)
+			}
+			sa6 := &unix.SockaddrInet6{}
+			copy(sa6.Addr[:], src.Addr.To16())
+			sa = sa6
+		}
+		if err := unix.Bind(fd, sa); err != nil {
+			return nil, fmt.Errorf("bind to %v: %w", src.Addr, err)
+		}
+	}
+	return net.FilePacketConn(f)
+}
+
+// sendProbe sends the echo request with ttl and waits for the reply or the
+// ICMP error quoting it. done is true if the probe reached dst or the path
+// ends with an error. Hop.Addr is nil if nothing answered.
+func sendProbe(src Source, dst net.IP, ttl int, timeout time.Duration) (hop Hop, done bool, err error) {
+	hop.TTL = ttl
+	v4 := dst.To4() != nil
+	c, err := listenSource(src, v4, ttl)
+	if err != nil {
+		return hop, false, fmt.Errorf("probe: %w", err)
+	}
+	defer c.Close()
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return hop, false, fmt.Errorf("probe: %w", err)
+	}
+
+	var (
+		reqType   icmp.Type = ipv4.ICMPTypeEcho
+		replyType icmp.Type = ipv4.ICMPTypeEchoReply
+		proto               = protoICMP
+	)
+	if !v4 {
+		reqType, replyType, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, protoICMPv6
+	} else {
+		dst = dst.To4()
+	}
+
+	id := os.Getpid() & 0xffff
+	sq := int(atomic.AddUint32(&seq, 1) & 0xffff)
+	req, err := (&icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: id, Seq: sq, Data: token},
+	}).Marshal(nil)
+	if err != nil {
+		return hop, false, fmt.Errorf("probe: %w", err)
+	}
+
+	start := time.Now()
+	if _, err := c.WriteTo(req, &net.IPAddr{IP: dst}); err != nil {
+		return hop, false, fmt.Errorf("probe: %w", err)
+	}
+	if err := c.SetReadDeadline(start.Add(timeout)); err != nil {
+		return hop, false, fmt.Errorf("probe: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return hop, false, nil
+			}
+			return hop, false, fmt.Errorf("probe: %w", err)
+		}
+		rtt := time.Since(start)
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		// Raw sockets receive all ICMP traffic, replies are matched by the
+		// random payload and errors by the quoted echo header.
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type != replyType || !bytes.Equal(body.Data, token) {
+				continue
+			}
+		case *icmp.TimeExceeded:
+			if !matchQuoted(body.Data, v4, id, sq) {
+				continue
+			}
+		case *icmp.DstUnreach:
+			if !matchQuoted(body.Data, v4, id, sq) {
+				continue
+			}
+			hop.Error = "destination unreachable"
+		default:
+			continue
+		}
+		hop.Addr = from.(*net.IPAddr).IP
+		hop.RTT = rtt
+		_, exceeded := msg.Body.(*icmp.TimeExceeded)
+		return hop, !exceeded, nil
+	}
+}
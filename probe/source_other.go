@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package probe
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func sendProbe(Source, net.IP, int, time.Duration) (Hop, bool, error) {
+	return Hop{}, false, errors.New("probe: pinning the source is not supported on this platform")
+}
@@ -48,3 +48,39 @@ func (n *Net6) AsIPNet() net.IPNet {
 		Mask: net.CIDRMask(int(n.PrefixLen), 128),
 	}
 }
+
+func NewNet4(n net.IPNet) *Net4 {
+	prefixLen, _ := n.Mask.Size()
+	return &Net4{
+		Addr:      binary.BigEndian.Uint32(n.IP.To4()),
+		PrefixLen: int32(prefixLen),
+	}
+}
+
+func NewNet6(n net.IPNet) *Net6 {
+	prefixLen, _ := n.Mask.Size()
+	return &Net6{
+		Addr:      NewIPv6(n.IP),
+		PrefixLen: int32(prefixLen),
+	}
+}
+
+func NewEndpoint(addr *net.UDPAddr) *Endpoint {
+	e := &Endpoint{Port: uint32(addr.Port)}
+	if v4 := addr.IP.To4(); v4 != nil {
+		e.Addr4 = binary.BigEndian.Uint32(v4)
+	} else {
+		e.Addr6 = NewIPv6(addr.IP)
+	}
+	return e
+}
+
+func (e *Endpoint) AsUDPAddr() *net.UDPAddr {
+	addr := &net.UDPAddr{Port: int(e.GetPort())}
+	if e.GetAddr6() != nil {
+		addr.IP = e.GetAddr6().AsIP()
+	} else {
+		addr.IP = IPv4(e.GetAddr4())
+	}
+	return addr
+}
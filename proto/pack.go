@@ -3,8 +3,10 @@ package wboxproto
 import (
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
+	protov2 "google.golang.org/protobuf/proto"
 )
 
 //go:generate protoc --go_out=. protocol.proto
@@ -23,18 +25,59 @@ const (
 
 var (
 	ErrUnknownVersion = errors.New("proto: unknown protocol version")
+	ErrUnexpectedType = errors.New("proto: unexpected message type")
 )
 
-func Unpack(b []byte) (proto.Message, error) {
+// MaxDatagram is the size of buffers returned by GetBuffer, enough for any
+// valid message.
+const MaxDatagram = 1420
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, MaxDatagram)
+		return &b
+	},
+}
+
+// GetBuffer returns an empty buffer with MaxDatagram capacity from the pool.
+// It should be returned using PutBuffer once it is no longer used.
+func GetBuffer() *[]byte {
+	b := bufPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+func PutBuffer(b *[]byte) {
+	bufPool.Put(b)
+}
+
+func header(b []byte) (MsgType, error) {
 	if len(b) < 2 {
-		return nil, errors.New("proto: malformed datagram")
+		return 0, errors.New("proto: malformed datagram")
 	}
+	if b[0] != Version {
+		return 0, ErrUnknownVersion
+	}
+	return MsgType(b[1]), nil
+}
 
-	version := b[0]
-	msgType := MsgType(b[1])
+func typeOf(msg proto.Message) (MsgType, error) {
+	switch msg.(type) {
+	case *CfgSolict:
+		return MsgSolict, nil
+	case *Cfg:
+		return MsgCfg, nil
+	case *Nack:
+		return MsgNack, nil
+	default:
+		return 0, errors.New("proto: unknown message type")
+	}
+}
 
-	if version != Version {
-		return nil, ErrUnknownVersion
+func Unpack(b []byte) (proto.Message, error) {
+	msgType, err := header(b)
+	if err != nil {
+		return nil, err
 	}
 
 	var msg proto.Message
@@ -55,27 +98,45 @@ func Unpack(b []byte) (proto.Message, error) {
 	return msg, nil
 }
 
+// UnpackInto is similar to Unpack but decodes the datagram into the existing
+// message, which is reset first. ErrUnexpectedType is returned if the
+// datagram contains a message of a different type.
+func UnpackInto(b []byte, msg proto.Message) error {
+	msgType, err := header(b)
+	if err != nil {
+		return err
+	}
+	expected, err := typeOf(msg)
+	if err != nil {
+		return err
+	}
+	if msgType != expected {
+		return ErrUnexpectedType
+	}
+
+	if err := proto.Unmarshal(b[2:], msg); err != nil {
+		return fmt.Errorf("proto: unpack: %w", err)
+	}
+	return nil
+}
+
 func Pack(msg proto.Message) ([]byte, error) {
-	var msgType MsgType
-	switch msg.(type) {
-	case *CfgSolict:
-		msgType = MsgSolict
-	case *Cfg:
-		msgType = MsgCfg
-	case *Nack:
-		msgType = MsgNack
-	default:
-		return nil, errors.New("proto: unknown message type")
+	return PackTo(make([]byte, 0, 2+proto.Size(msg)), msg)
+}
+
+// PackTo appends the serialized message to dst and returns the extended
+// slice. No allocations are made if dst has enough capacity, e.g. if it is
+// obtained from GetBuffer.
+func PackTo(dst []byte, msg proto.Message) ([]byte, error) {
+	msgType, err := typeOf(msg)
+	if err != nil {
+		return nil, err
 	}
 
-	body, err := proto.Marshal(msg)
+	dst = append(dst, Version, byte(msgType))
+	dst, err = protov2.MarshalOptions{}.MarshalAppend(dst, proto.MessageV2(msg))
 	if err != nil {
 		return nil, fmt.Errorf("proto: pack: %w", err)
 	}
-
-	payload := make([]byte, 2, len(body)+2)
-	payload[0] = Version
-	payload[1] = byte(msgType)
-	payload = append(payload, body...)
-	return payload, nil
+	return dst, nil
 }
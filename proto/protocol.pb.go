@@ -20,6 +20,102 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+// Derivation scheme used for the client link-local address on the
+// configuration tunnel.
+type AddrScheme int32
+
+const (
+	// Public key truncated to 112 bits.
+	AddrScheme_TRUNCATED AddrScheme = 0
+	// SHA-256 of deployment-specific salt and public key truncated to 112
+	// bits.
+	AddrScheme_SALTED_SHA256 AddrScheme = 1
+)
+
+var AddrScheme_name = map[int32]string{
+	0: "TRUNCATED",
+	1: "SALTED_SHA256",
+}
+
+var AddrScheme_value = map[string]int32{
+	"TRUNCATED":     0,
+	"SALTED_SHA256": 1,
+}
+
+func (x AddrScheme) String() string {
+	return proto.EnumName(AddrScheme_name, int32(x))
+}
+
+func (AddrScheme) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{0}
+}
+
+type Nack_Code int32
+
+const (
+	// Unspecified error, description should be consulted.
+	Nack_UNKNOWN Nack_Code = 0
+	// Server has no configuration for the client public key.
+	Nack_NO_CONFIG Nack_Code = 1
+	// Solictation sender address does not match the public key.
+	Nack_ADDR_MISMATCH Nack_Code = 2
+	// Address derivation scheme used by the client is not accepted by
+	// the server.
+	Nack_ADDR_SCHEME_UNSUPPORTED Nack_Code = 3
+	// Client version or capabilities do not satisfy the server policy.
+	Nack_UPGRADE_REQUIRED Nack_Code = 4
+	// Access of the client is not permitted at this time by its
+	// schedule.
+	Nack_OUTSIDE_SCHEDULE Nack_Code = 5
+	// Client transferred more than its quota permits and is
+	// disconnected until the quota is reset.
+	Nack_QUOTA_EXCEEDED Nack_Code = 6
+	// Client should solict the configuration from the server specified
+	// by referral_endpoint and referral_key instead, e.g. after the
+	// server migration.
+	Nack_REDIRECT Nack_Code = 7
+	// Addresses of the client conflict with another client, e.g. its
+	// dynamic address is reserved for another one. The server
+	// administrator has to resolve the conflict.
+	Nack_CONFLICT Nack_Code = 8
+	// Configuration is refused by the server policy rules.
+	Nack_POLICY_DENIED Nack_Code = 9
+)
+
+var Nack_Code_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "NO_CONFIG",
+	2: "ADDR_MISMATCH",
+	3: "ADDR_SCHEME_UNSUPPORTED",
+	4: "UPGRADE_REQUIRED",
+	5: "OUTSIDE_SCHEDULE",
+	6: "QUOTA_EXCEEDED",
+	7: "REDIRECT",
+	8: "CONFLICT",
+	9: "POLICY_DENIED",
+}
+
+var Nack_Code_value = map[string]int32{
+	"UNKNOWN":                 0,
+	"NO_CONFIG":               1,
+	"ADDR_MISMATCH":           2,
+	"ADDR_SCHEME_UNSUPPORTED": 3,
+	"UPGRADE_REQUIRED":        4,
+	"OUTSIDE_SCHEDULE":        5,
+	"QUOTA_EXCEEDED":          6,
+	"REDIRECT":                7,
+	"CONFLICT":                8,
+	"POLICY_DENIED":           9,
+}
+
+func (x Nack_Code) String() string {
+	return proto.EnumName(Nack_Code_name, int32(x))
+}
+
+func (Nack_Code) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{11, 0}
+}
+
 type IPv6 struct {
 	High                 uint64   `protobuf:"fixed64,1,opt,name=high,proto3" json:"high,omitempty"`
 	Low                  uint64   `protobuf:"varint,2,opt,name=low,proto3" json:"low,omitempty"`
@@ -266,7 +362,30 @@ func (m *Route6) GetSrc() *IPv6 {
 // Message type byte: 1
 type CfgSolict struct {
 	// ed25519 public key of the client. MUST be 32 bytes.
-	PeerPubkey           []byte   `protobuf:"bytes,1,opt,name=peer_pubkey,json=peerPubkey,proto3" json:"peer_pubkey,omitempty"`
+	PeerPubkey []byte `protobuf:"bytes,1,opt,name=peer_pubkey,json=peerPubkey,proto3" json:"peer_pubkey,omitempty"`
+	// Scheme used to derive the solictation source address.
+	AddrScheme AddrScheme `protobuf:"varint,2,opt,name=addr_scheme,json=addrScheme,proto3,enum=AddrScheme" json:"addr_scheme,omitempty"`
+	// W3C traceparent value identifying the client trace, optional.
+	TraceParent string `protobuf:"bytes,3,opt,name=trace_parent,json=traceParent,proto3" json:"trace_parent,omitempty"`
+	// Client wants to form direct tunnels with other clients and permits
+	// the server to share its endpoint with them.
+	Mesh bool `protobuf:"varint,4,opt,name=mesh,proto3" json:"mesh,omitempty"`
+	// Endpoints the client discovered for its WireGuard socket (e.g. using
+	// STUN), shared with other clients together with the endpoint observed
+	// by the server.
+	Endpoints []*Endpoint `protobuf:"bytes,5,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+	// Local networks the client routes for (site-to-site). The server
+	// routes them via the client and announces them to other clients if
+	// permitted by its policy.
+	Subnets4 []*Net4 `protobuf:"bytes,6,rep,name=subnets4,proto3" json:"subnets4,omitempty"`
+	Subnets6 []*Net6 `protobuf:"bytes,7,rep,name=subnets6,proto3" json:"subnets6,omitempty"`
+	// Version of the client software and protocol features it supports,
+	// used by the server to refuse outdated clients.
+	Version      string   `protobuf:"bytes,8,opt,name=version,proto3" json:"version,omitempty"`
+	Capabilities []string `protobuf:"bytes,9,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	// Public keys of mesh peers the client cannot reach directly, the
+	// server sets up relays for them. MUST be 32 bytes each.
+	RelayPeers           [][]byte `protobuf:"bytes,10,rep,name=relay_peers,json=relayPeers,proto3" json:"relay_peers,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -304,6 +423,69 @@ func (m *CfgSolict) GetPeerPubkey() []byte {
 	return nil
 }
 
+func (m *CfgSolict) GetAddrScheme() AddrScheme {
+	if m != nil {
+		return m.AddrScheme
+	}
+	return AddrScheme_TRUNCATED
+}
+
+func (m *CfgSolict) GetTraceParent() string {
+	if m != nil {
+		return m.TraceParent
+	}
+	return ""
+}
+
+func (m *CfgSolict) GetMesh() bool {
+	if m != nil {
+		return m.Mesh
+	}
+	return false
+}
+
+func (m *CfgSolict) GetEndpoints() []*Endpoint {
+	if m != nil {
+		return m.Endpoints
+	}
+	return nil
+}
+
+func (m *CfgSolict) GetSubnets4() []*Net4 {
+	if m != nil {
+		return m.Subnets4
+	}
+	return nil
+}
+
+func (m *CfgSolict) GetSubnets6() []*Net6 {
+	if m != nil {
+		return m.Subnets6
+	}
+	return nil
+}
+
+func (m *CfgSolict) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *CfgSolict) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+func (m *CfgSolict) GetRelayPeers() [][]byte {
+	if m != nil {
+		return m.RelayPeers
+	}
+	return nil
+}
+
 // Message type byte: 2
 type Cfg struct {
 	// The UNIX timestamp the configuration is valid until.
@@ -323,9 +505,29 @@ type Cfg struct {
 	// (at least one should be non-empty)
 	//
 	// tun_port      - UDP port to use.
-	Tun6Endpoint         *IPv6    `protobuf:"bytes,5,opt,name=tun6_endpoint,json=tun6Endpoint,proto3" json:"tun6_endpoint,omitempty"`
-	Tun4Endpoint         uint32   `protobuf:"fixed32,18,opt,name=tun4_endpoint,json=tun4Endpoint,proto3" json:"tun4_endpoint,omitempty"`
-	TunPort              uint32   `protobuf:"varint,6,opt,name=tun_port,json=tunPort,proto3" json:"tun_port,omitempty"`
+	Tun6Endpoint *IPv6  `protobuf:"bytes,5,opt,name=tun6_endpoint,json=tun6Endpoint,proto3" json:"tun6_endpoint,omitempty"`
+	Tun4Endpoint uint32 `protobuf:"fixed32,18,opt,name=tun4_endpoint,json=tun4Endpoint,proto3" json:"tun4_endpoint,omitempty"`
+	TunPort      uint32 `protobuf:"varint,6,opt,name=tun_port,json=tunPort,proto3" json:"tun_port,omitempty"`
+	// Names of other peers to be added to the client hosts file, optional.
+	Hosts []*Host `protobuf:"bytes,19,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	// Other clients that requested direct tunnels (see CfgSolict.mesh).
+	Peers []*MeshPeer `protobuf:"bytes,20,rep,name=peers,proto3" json:"peers,omitempty"`
+	// UNIX timestamp in milliseconds both sides of the new direct tunnel
+	// should start sending packets at so NAT mappings are created
+	// simultaneously.
+	PunchAt uint64 `protobuf:"varint,21,opt,name=punch_at,json=punchAt,proto3" json:"punch_at,omitempty"`
+	// Version of the server configuration, changes each time the server
+	// configuration is reloaded. Configurations with the same serial are
+	// identical except for peers and punch_at.
+	Serial uint64 `protobuf:"varint,22,opt,name=serial,proto3" json:"serial,omitempty"`
+	// Candidate tunnel endpoints of the server (e.g. gateways of a fleet
+	// sharing the server key) with hints for the client to pick the nearest
+	// one. tun4_endpoint/tun6_endpoint are still set for clients that do not
+	// support hints.
+	TunEndpoints []*EndpointHint `protobuf:"bytes,23,rep,name=tun_endpoints,json=tunEndpoints,proto3" json:"tun_endpoints,omitempty"`
+	// Human-readable message from the operator, e.g. a maintenance notice,
+	// optional. Clients show it to the user, it is not interpreted.
+	Motd                 string   `protobuf:"bytes,24,opt,name=motd,proto3" json:"motd,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -426,20 +628,314 @@ func (m *Cfg) GetTunPort() uint32 {
 	return 0
 }
 
-// Message type byte: 3
-type Nack struct {
-	// Human-readable error description.
-	Description          []byte   `protobuf:"bytes,1,opt,name=description,proto3" json:"description,omitempty"`
+func (m *Cfg) GetHosts() []*Host {
+	if m != nil {
+		return m.Hosts
+	}
+	return nil
+}
+
+func (m *Cfg) GetPeers() []*MeshPeer {
+	if m != nil {
+		return m.Peers
+	}
+	return nil
+}
+
+func (m *Cfg) GetPunchAt() uint64 {
+	if m != nil {
+		return m.PunchAt
+	}
+	return 0
+}
+
+func (m *Cfg) GetSerial() uint64 {
+	if m != nil {
+		return m.Serial
+	}
+	return 0
+}
+
+func (m *Cfg) GetTunEndpoints() []*EndpointHint {
+	if m != nil {
+		return m.TunEndpoints
+	}
+	return nil
+}
+
+func (m *Cfg) GetMotd() string {
+	if m != nil {
+		return m.Motd
+	}
+	return ""
+}
+
+type EndpointHint struct {
+	// Port may be zero, tun_port is used then.
+	Endpoint *Endpoint `protobuf:"bytes,1,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	// Region of the endpoint, e.g. "eu-west".
+	Region string `protobuf:"bytes,2,opt,name=region,proto3" json:"region,omitempty"`
+	// Endpoints with lower priority are preferred if the region and the
+	// latency do not decide.
+	Priority             uint32   `protobuf:"varint,3,opt,name=priority,proto3" json:"priority,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
 
+func (m *EndpointHint) Reset()         { *m = EndpointHint{} }
+func (m *EndpointHint) String() string { return proto.CompactTextString(m) }
+func (*EndpointHint) ProtoMessage()    {}
+func (*EndpointHint) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{7}
+}
+
+func (m *EndpointHint) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EndpointHint.Unmarshal(m, b)
+}
+func (m *EndpointHint) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EndpointHint.Marshal(b, m, deterministic)
+}
+func (m *EndpointHint) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EndpointHint.Merge(m, src)
+}
+func (m *EndpointHint) XXX_Size() int {
+	return xxx_messageInfo_EndpointHint.Size(m)
+}
+func (m *EndpointHint) XXX_DiscardUnknown() {
+	xxx_messageInfo_EndpointHint.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EndpointHint proto.InternalMessageInfo
+
+func (m *EndpointHint) GetEndpoint() *Endpoint {
+	if m != nil {
+		return m.Endpoint
+	}
+	return nil
+}
+
+func (m *EndpointHint) GetRegion() string {
+	if m != nil {
+		return m.Region
+	}
+	return ""
+}
+
+func (m *EndpointHint) GetPriority() uint32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+type Endpoint struct {
+	// One of addr4 or addr6 is set.
+	Addr4                uint32   `protobuf:"fixed32,1,opt,name=addr4,proto3" json:"addr4,omitempty"`
+	Addr6                *IPv6    `protobuf:"bytes,2,opt,name=addr6,proto3" json:"addr6,omitempty"`
+	Port                 uint32   `protobuf:"varint,3,opt,name=port,proto3" json:"port,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Endpoint) Reset()         { *m = Endpoint{} }
+func (m *Endpoint) String() string { return proto.CompactTextString(m) }
+func (*Endpoint) ProtoMessage()    {}
+func (*Endpoint) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{8}
+}
+
+func (m *Endpoint) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Endpoint.Unmarshal(m, b)
+}
+func (m *Endpoint) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Endpoint.Marshal(b, m, deterministic)
+}
+func (m *Endpoint) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Endpoint.Merge(m, src)
+}
+func (m *Endpoint) XXX_Size() int {
+	return xxx_messageInfo_Endpoint.Size(m)
+}
+func (m *Endpoint) XXX_DiscardUnknown() {
+	xxx_messageInfo_Endpoint.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Endpoint proto.InternalMessageInfo
+
+func (m *Endpoint) GetAddr4() uint32 {
+	if m != nil {
+		return m.Addr4
+	}
+	return 0
+}
+
+func (m *Endpoint) GetAddr6() *IPv6 {
+	if m != nil {
+		return m.Addr6
+	}
+	return nil
+}
+
+func (m *Endpoint) GetPort() uint32 {
+	if m != nil {
+		return m.Port
+	}
+	return 0
+}
+
+type MeshPeer struct {
+	// WireGuard public key of the peer. MUST be 32 bytes.
+	Pubkey []byte `protobuf:"bytes,1,opt,name=pubkey,proto3" json:"pubkey,omitempty"`
+	// Candidate endpoints in the order of preference.
+	Endpoints []*Endpoint `protobuf:"bytes,2,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+	// Addresses assigned to the peer.
+	Addrs4 []uint32 `protobuf:"fixed32,3,rep,packed,name=addrs4,proto3" json:"addrs4,omitempty"`
+	Addrs6 []*IPv6  `protobuf:"bytes,4,rep,name=addrs6,proto3" json:"addrs6,omitempty"`
+	// Server address relaying WireGuard packets between the client and the
+	// peer, set once either of them asked for a relay.
+	Relay                *Endpoint `protobuf:"bytes,5,opt,name=relay,proto3" json:"relay,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *MeshPeer) Reset()         { *m = MeshPeer{} }
+func (m *MeshPeer) String() string { return proto.CompactTextString(m) }
+func (*MeshPeer) ProtoMessage()    {}
+func (*MeshPeer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{9}
+}
+
+func (m *MeshPeer) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MeshPeer.Unmarshal(m, b)
+}
+func (m *MeshPeer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MeshPeer.Marshal(b, m, deterministic)
+}
+func (m *MeshPeer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MeshPeer.Merge(m, src)
+}
+func (m *MeshPeer) XXX_Size() int {
+	return xxx_messageInfo_MeshPeer.Size(m)
+}
+func (m *MeshPeer) XXX_DiscardUnknown() {
+	xxx_messageInfo_MeshPeer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MeshPeer proto.InternalMessageInfo
+
+func (m *MeshPeer) GetPubkey() []byte {
+	if m != nil {
+		return m.Pubkey
+	}
+	return nil
+}
+
+func (m *MeshPeer) GetEndpoints() []*Endpoint {
+	if m != nil {
+		return m.Endpoints
+	}
+	return nil
+}
+
+func (m *MeshPeer) GetAddrs4() []uint32 {
+	if m != nil {
+		return m.Addrs4
+	}
+	return nil
+}
+
+func (m *MeshPeer) GetAddrs6() []*IPv6 {
+	if m != nil {
+		return m.Addrs6
+	}
+	return nil
+}
+
+func (m *MeshPeer) GetRelay() *Endpoint {
+	if m != nil {
+		return m.Relay
+	}
+	return nil
+}
+
+type Host struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Addrs4               []uint32 `protobuf:"fixed32,2,rep,packed,name=addrs4,proto3" json:"addrs4,omitempty"`
+	Addrs6               []*IPv6  `protobuf:"bytes,3,rep,name=addrs6,proto3" json:"addrs6,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Host) Reset()         { *m = Host{} }
+func (m *Host) String() string { return proto.CompactTextString(m) }
+func (*Host) ProtoMessage()    {}
+func (*Host) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{10}
+}
+
+func (m *Host) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Host.Unmarshal(m, b)
+}
+func (m *Host) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Host.Marshal(b, m, deterministic)
+}
+func (m *Host) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Host.Merge(m, src)
+}
+func (m *Host) XXX_Size() int {
+	return xxx_messageInfo_Host.Size(m)
+}
+func (m *Host) XXX_DiscardUnknown() {
+	xxx_messageInfo_Host.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Host proto.InternalMessageInfo
+
+func (m *Host) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Host) GetAddrs4() []uint32 {
+	if m != nil {
+		return m.Addrs4
+	}
+	return nil
+}
+
+func (m *Host) GetAddrs6() []*IPv6 {
+	if m != nil {
+		return m.Addrs6
+	}
+	return nil
+}
+
+// Message type byte: 3
+type Nack struct {
+	// Human-readable error description.
+	Description []byte `protobuf:"bytes,1,opt,name=description,proto3" json:"description,omitempty"`
+	// Machine-readable error code.
+	Code Nack_Code `protobuf:"varint,2,opt,name=code,proto3,enum=Nack_Code" json:"code,omitempty"`
+	// Configuration tunnel endpoint and the public key of the server to use
+	// instead, set with REDIRECT. The key MUST be 32 bytes.
+	ReferralEndpoint     *Endpoint `protobuf:"bytes,3,opt,name=referral_endpoint,json=referralEndpoint,proto3" json:"referral_endpoint,omitempty"`
+	ReferralKey          []byte    `protobuf:"bytes,4,opt,name=referral_key,json=referralKey,proto3" json:"referral_key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
 func (m *Nack) Reset()         { *m = Nack{} }
 func (m *Nack) String() string { return proto.CompactTextString(m) }
 func (*Nack) ProtoMessage()    {}
 func (*Nack) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2bc2336598a3f7e0, []int{7}
+	return fileDescriptor_2bc2336598a3f7e0, []int{11}
 }
 
 func (m *Nack) XXX_Unmarshal(b []byte) error {
@@ -467,7 +963,30 @@ func (m *Nack) GetDescription() []byte {
 	return nil
 }
 
+func (m *Nack) GetCode() Nack_Code {
+	if m != nil {
+		return m.Code
+	}
+	return Nack_UNKNOWN
+}
+
+func (m *Nack) GetReferralEndpoint() *Endpoint {
+	if m != nil {
+		return m.ReferralEndpoint
+	}
+	return nil
+}
+
+func (m *Nack) GetReferralKey() []byte {
+	if m != nil {
+		return m.ReferralKey
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("AddrScheme", AddrScheme_name, AddrScheme_value)
+	proto.RegisterEnum("Nack_Code", Nack_Code_name, Nack_Code_value)
 	proto.RegisterType((*IPv6)(nil), "IPv6")
 	proto.RegisterType((*Net4)(nil), "Net4")
 	proto.RegisterType((*Net6)(nil), "Net6")
@@ -475,6 +994,10 @@ func init() {
 	proto.RegisterType((*Route6)(nil), "Route6")
 	proto.RegisterType((*CfgSolict)(nil), "CfgSolict")
 	proto.RegisterType((*Cfg)(nil), "Cfg")
+	proto.RegisterType((*EndpointHint)(nil), "EndpointHint")
+	proto.RegisterType((*Endpoint)(nil), "Endpoint")
+	proto.RegisterType((*MeshPeer)(nil), "MeshPeer")
+	proto.RegisterType((*Host)(nil), "Host")
 	proto.RegisterType((*Nack)(nil), "Nack")
 }
 
@@ -483,32 +1006,72 @@ func init() {
 }
 
 var fileDescriptor_2bc2336598a3f7e0 = []byte{
-	// 431 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x92, 0xc1, 0x6f, 0xd3, 0x30,
-	0x14, 0xc6, 0xd5, 0x25, 0x6d, 0xd6, 0xd7, 0x0d, 0x0d, 0x5f, 0xf0, 0x0e, 0x68, 0x21, 0x5c, 0x2a,
-	0x34, 0xf5, 0x00, 0x96, 0x25, 0x24, 0x0e, 0x88, 0x89, 0x03, 0x12, 0x1a, 0x95, 0x11, 0x17, 0x2e,
-	0x51, 0x9a, 0xb8, 0x9d, 0xb5, 0xc8, 0x8e, 0x1c, 0xa7, 0xdd, 0xfe, 0x44, 0xfe, 0x2b, 0xf4, 0x5e,
-	0xd3, 0x36, 0x07, 0x0e, 0x9c, 0xf2, 0xfc, 0xbd, 0xef, 0xfd, 0xfc, 0xf9, 0x29, 0xf0, 0xa2, 0xf1,
-	0x2e, 0xb8, 0xd2, 0xd5, 0x0b, 0x2a, 0xb2, 0x5b, 0x88, 0xbf, 0x2d, 0xb7, 0x92, 0x31, 0x88, 0x1f,
-	0xcc, 0xe6, 0x81, 0x8f, 0xd2, 0xd1, 0x7c, 0xa2, 0xa8, 0x66, 0x57, 0x10, 0xd5, 0x6e, 0xc7, 0xcf,
-	0xd2, 0xd1, 0x3c, 0x56, 0x58, 0x66, 0x1f, 0x21, 0xbe, 0xd7, 0x41, 0xa0, 0xbb, 0xa8, 0x2a, 0x4f,
-	0xee, 0x44, 0x51, 0xcd, 0x5e, 0x03, 0x34, 0x5e, 0xaf, 0xcd, 0x53, 0x5e, 0x6b, 0x4b, 0x43, 0x63,
-	0x35, 0xdd, 0x2b, 0xdf, 0xb5, 0xcd, 0x3e, 0xd3, 0xa8, 0x64, 0xd7, 0x83, 0xd1, 0xd9, 0xfb, 0xf1,
-	0x02, 0x6f, 0xff, 0x3f, 0xc2, 0x0f, 0x98, 0x28, 0xd7, 0x05, 0x2d, 0x90, 0x51, 0xe9, 0x36, 0x1c,
-	0x19, 0x98, 0x49, 0x91, 0x84, 0x99, 0x5b, 0x5f, 0xd2, 0x70, 0xa2, 0xb0, 0x64, 0x1c, 0x92, 0x4d,
-	0x11, 0xf4, 0xae, 0x78, 0xe6, 0x11, 0xa9, 0x87, 0x63, 0xf6, 0xa9, 0x07, 0xca, 0x7f, 0x01, 0x65,
-	0x0f, 0x7c, 0x75, 0x02, 0x1e, 0xe3, 0xa2, 0x92, 0xdd, 0xc2, 0xf4, 0x6e, 0xbd, 0xf9, 0xe9, 0x6a,
-	0x53, 0x06, 0x76, 0x03, 0xb3, 0x46, 0x6b, 0x9f, 0x37, 0xdd, 0xea, 0x51, 0x3f, 0x13, 0xe7, 0x42,
-	0x01, 0x4a, 0x4b, 0x52, 0xb2, 0x3f, 0x67, 0x10, 0xdd, 0xad, 0x37, 0x68, 0xdc, 0x16, 0xb5, 0xa9,
-	0xf2, 0xce, 0x06, 0x53, 0xf7, 0xbb, 0x05, 0x92, 0x7e, 0xa1, 0xc2, 0x6e, 0x20, 0x69, 0xb5, 0xdf,
-	0x6a, 0x2f, 0x79, 0x32, 0xbc, 0xf3, 0xa0, 0x62, 0x56, 0xab, 0x83, 0xe4, 0x51, 0x1a, 0x0d, 0xb2,
-	0xa2, 0xc4, 0xde, 0x40, 0xe2, 0xf1, 0x41, 0xad, 0xe4, 0x31, 0x75, 0x93, 0xc5, 0xfe, 0x81, 0xea,
-	0xa0, 0xe3, 0x36, 0xf6, 0x20, 0xc1, 0xcf, 0xf7, 0xdb, 0xe8, 0x8f, 0x3d, 0x57, 0xf0, 0xab, 0x13,
-	0x57, 0x10, 0x57, 0x9c, 0xb8, 0x82, 0xbf, 0x1c, 0x72, 0xc5, 0x81, 0x2b, 0xd8, 0x3b, 0xb8, 0x0c,
-	0x9d, 0x95, 0xb9, 0xb6, 0x55, 0xe3, 0x8c, 0x0d, 0x7c, 0x3c, 0x0c, 0x7f, 0x81, 0xbd, 0xaf, 0x7d,
-	0x8b, 0xbd, 0x25, 0xaf, 0x38, 0x79, 0x19, 0x25, 0x41, 0x93, 0x38, 0x9a, 0xae, 0xe1, 0x3c, 0x74,
-	0x36, 0x6f, 0x9c, 0x0f, 0x7c, 0x92, 0x8e, 0xe6, 0x97, 0x2a, 0x09, 0x9d, 0x5d, 0x3a, 0x1f, 0xb2,
-	0x39, 0xc4, 0xf7, 0x45, 0xf9, 0xc8, 0x52, 0x98, 0x55, 0xba, 0x2d, 0xbd, 0x69, 0x82, 0x71, 0xb6,
-	0x5f, 0xfa, 0x50, 0xfa, 0x32, 0xfb, 0x3d, 0xdd, 0xad, 0xdc, 0x13, 0xfd, 0xea, 0xab, 0x09, 0x7d,
-	0x3e, 0xfc, 0x0d, 0x00, 0x00, 0xff, 0xff, 0xae, 0x03, 0x08, 0x6f, 0x03, 0x03, 0x00, 0x00,
+	// 1059 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x55, 0xdd, 0x8e, 0xda, 0x46,
+	0x14, 0x0e, 0x60, 0x30, 0x1c, 0x20, 0x72, 0xa6, 0x69, 0xe2, 0x34, 0x4a, 0x97, 0x75, 0x55, 0x15,
+	0x45, 0x11, 0x17, 0x5b, 0xd7, 0x52, 0xa5, 0x5e, 0x94, 0x62, 0x37, 0x8b, 0xb2, 0x0b, 0xec, 0x00,
+	0xea, 0xcf, 0x8d, 0xe5, 0x85, 0xd9, 0xc5, 0x0a, 0x6b, 0xa3, 0xf1, 0xb0, 0x9b, 0xbd, 0xed, 0xab,
+	0xf4, 0x49, 0xfa, 0x24, 0xbd, 0xec, 0x6b, 0x54, 0xe7, 0xf8, 0x07, 0x6f, 0x95, 0x56, 0xbd, 0xe2,
+	0x9c, 0xcf, 0x67, 0xbe, 0xf9, 0xe6, 0x9c, 0x6f, 0x06, 0x78, 0xbc, 0x93, 0xb1, 0x8a, 0x57, 0xf1,
+	0x76, 0x40, 0x81, 0xf5, 0x06, 0xb4, 0xf1, 0xec, 0xd6, 0x61, 0x0c, 0xb4, 0x4d, 0x78, 0xbd, 0x31,
+	0x2b, 0xbd, 0x4a, 0xbf, 0xc1, 0x29, 0x66, 0x06, 0xd4, 0xb6, 0xf1, 0x9d, 0x59, 0xed, 0x55, 0xfa,
+	0x1a, 0xc7, 0xd0, 0xfa, 0x16, 0xb4, 0x89, 0x50, 0x36, 0x56, 0x07, 0xeb, 0xb5, 0xa4, 0x6a, 0x9d,
+	0x53, 0xcc, 0x5e, 0x01, 0xec, 0xa4, 0xb8, 0x0a, 0x3f, 0xf8, 0x5b, 0x11, 0xd1, 0xa2, 0x3a, 0x6f,
+	0xa5, 0xc8, 0x99, 0x88, 0xac, 0xef, 0x69, 0xa9, 0xc3, 0x5e, 0x94, 0x96, 0xb6, 0x4f, 0xea, 0x03,
+	0xdc, 0xfd, 0xff, 0x31, 0x4c, 0xa1, 0xc1, 0xe3, 0xbd, 0x12, 0x36, 0x72, 0xac, 0x45, 0xa2, 0x0a,
+	0x0e, 0xd4, 0xc4, 0x09, 0x42, 0xcd, 0x89, 0x5c, 0xd1, 0x62, 0x9d, 0x63, 0xc8, 0x4c, 0xd0, 0xaf,
+	0x03, 0x25, 0xee, 0x82, 0x7b, 0xb3, 0x46, 0x68, 0x9e, 0x5a, 0xdf, 0x65, 0x84, 0xce, 0xc7, 0x08,
+	0x9d, 0x8c, 0xf0, 0xf9, 0x81, 0xb0, 0x90, 0x8b, 0x88, 0xf5, 0x67, 0x15, 0x5a, 0xa3, 0xab, 0xeb,
+	0x79, 0xbc, 0x0d, 0x57, 0x8a, 0x1d, 0x41, 0x7b, 0x27, 0x84, 0xf4, 0x77, 0xfb, 0xcb, 0xf7, 0xe2,
+	0x9e, 0x88, 0x3a, 0x1c, 0x10, 0x9a, 0x11, 0xc2, 0xde, 0x40, 0x1b, 0x0f, 0xe9, 0x27, 0xab, 0x8d,
+	0xb8, 0x11, 0xc4, 0xf7, 0xf8, 0xa4, 0x3d, 0x18, 0xae, 0xd7, 0x72, 0x4e, 0x10, 0x87, 0xa0, 0x88,
+	0xd9, 0x31, 0x74, 0x94, 0x0c, 0x56, 0xc2, 0xdf, 0x05, 0x52, 0x44, 0x8a, 0x94, 0xb7, 0x78, 0x9b,
+	0xb0, 0x19, 0x41, 0x38, 0x83, 0x1b, 0x91, 0x6c, 0x4c, 0xad, 0x57, 0xe9, 0x37, 0x39, 0xc5, 0xec,
+	0x2b, 0x68, 0x89, 0x68, 0xbd, 0x8b, 0xc3, 0x48, 0x25, 0x66, 0xbd, 0x57, 0xeb, 0xb7, 0x4f, 0x5a,
+	0x03, 0x2f, 0x43, 0xf8, 0xe1, 0x1b, 0x3b, 0x86, 0x66, 0xb2, 0xbf, 0x8c, 0x84, 0x4a, 0x6c, 0xb3,
+	0xd1, 0xab, 0xe5, 0x87, 0xb6, 0x79, 0x01, 0x97, 0x4a, 0x1c, 0x53, 0x3f, 0x94, 0x38, 0x45, 0x89,
+	0x83, 0xad, 0xbd, 0x15, 0x32, 0x09, 0xe3, 0xc8, 0x6c, 0x92, 0xc0, 0x3c, 0x65, 0x16, 0x74, 0x56,
+	0xc1, 0x2e, 0xb8, 0x0c, 0xb7, 0xa1, 0x0a, 0x45, 0x62, 0xb6, 0x7a, 0xb5, 0x7e, 0x8b, 0x3f, 0xc0,
+	0xb0, 0x65, 0x52, 0x6c, 0x83, 0x7b, 0x1f, 0xbb, 0x94, 0x98, 0xd0, 0xab, 0x61, 0xcb, 0x08, 0x9a,
+	0x21, 0x62, 0xfd, 0xa6, 0x41, 0x6d, 0x74, 0x75, 0x8d, 0x85, 0xb7, 0xc1, 0x36, 0x5c, 0xfb, 0xfb,
+	0x48, 0x85, 0xdb, 0xcc, 0x8f, 0x40, 0xd0, 0x12, 0x11, 0x76, 0x04, 0x7a, 0x22, 0xe4, 0xad, 0x90,
+	0xa8, 0xb4, 0x34, 0xa7, 0x1c, 0xc5, 0xf9, 0x46, 0x42, 0x39, 0x66, 0xad, 0x7c, 0x0e, 0x82, 0xd8,
+	0x31, 0xe8, 0x12, 0x4d, 0x90, 0x38, 0xa6, 0x46, 0x5f, 0xf5, 0x41, 0x6a, 0x0a, 0x9e, 0xe3, 0x78,
+	0xcc, 0x94, 0xc8, 0xa6, 0x63, 0xea, 0x39, 0xaf, 0x9d, 0xf1, 0xda, 0xa6, 0x51, 0x6e, 0x21, 0x41,
+	0x07, 0x5e, 0xdb, 0x7c, 0x52, 0xe6, 0xb5, 0x73, 0x5e, 0x9b, 0xbd, 0x86, 0xae, 0xda, 0x47, 0x8e,
+	0x9f, 0x8f, 0xc5, 0xac, 0x97, 0xc5, 0x77, 0xf0, 0x5b, 0x3e, 0x3b, 0xf6, 0x05, 0xd5, 0xda, 0x87,
+	0x5a, 0x46, 0x4a, 0xb0, 0xc8, 0x2e, 0x8a, 0x5e, 0x40, 0x53, 0xed, 0x23, 0x7f, 0x17, 0x4b, 0x65,
+	0x36, 0x7a, 0x95, 0x7e, 0x97, 0xeb, 0x6a, 0x1f, 0xcd, 0x62, 0xa9, 0xd8, 0x4b, 0xa8, 0x6f, 0xe2,
+	0x44, 0x25, 0xe6, 0x27, 0x99, 0xd4, 0xd3, 0x38, 0x51, 0x3c, 0xc5, 0xd8, 0x11, 0xd4, 0xd3, 0x19,
+	0x3c, 0xcd, 0x2c, 0x73, 0x2e, 0x92, 0x0d, 0xce, 0x80, 0xa7, 0x38, 0x12, 0xef, 0xf6, 0xd1, 0x6a,
+	0xe3, 0x07, 0xca, 0xfc, 0x94, 0xda, 0xaf, 0x53, 0x3e, 0x54, 0xec, 0x19, 0x34, 0x12, 0x21, 0xc3,
+	0x60, 0x6b, 0x3e, 0xa3, 0x0f, 0x59, 0xc6, 0x4e, 0x48, 0xb0, 0x7f, 0xb0, 0xe3, 0x73, 0xe2, 0xee,
+	0x16, 0x76, 0x3c, 0x45, 0x4b, 0xa2, 0x7e, 0xaf, 0x70, 0x25, 0x5a, 0x3a, 0x56, 0x6b, 0xd3, 0x24,
+	0x33, 0x51, 0x6c, 0x85, 0xd0, 0x29, 0xaf, 0x60, 0x5f, 0x42, 0xb3, 0xe8, 0x41, 0x7a, 0x5d, 0x4b,
+	0x0e, 0x2f, 0x3e, 0xa1, 0x2c, 0x29, 0xae, 0xd1, 0x99, 0x55, 0x22, 0xcb, 0x32, 0xf6, 0x19, 0x34,
+	0x77, 0x32, 0x8c, 0x65, 0xa8, 0xd2, 0xe7, 0xa0, 0xcb, 0x8b, 0xdc, 0xba, 0x80, 0x66, 0xd1, 0xca,
+	0xa7, 0x50, 0xc7, 0xeb, 0x68, 0x67, 0x4f, 0x5c, 0x9a, 0x60, 0x17, 0x31, 0x70, 0x1e, 0x3e, 0x07,
+	0x29, 0x86, 0xea, 0xa9, 0xf3, 0x29, 0x2d, 0xc5, 0xd6, 0xef, 0x15, 0x68, 0xe6, 0xcd, 0x44, 0x4d,
+	0x0f, 0x9e, 0x87, 0x2c, 0x7b, 0x78, 0x6b, 0xab, 0xff, 0x71, 0x6b, 0x9f, 0x41, 0x03, 0xb7, 0x4a,
+	0x6c, 0x32, 0xb2, 0xce, 0xb3, 0x8c, 0xbd, 0xca, 0xf0, 0xdc, 0xc2, 0x99, 0xae, 0x0c, 0xc4, 0xf1,
+	0xd2, 0xad, 0xca, 0xfc, 0x55, 0xe2, 0x4e, 0x71, 0xeb, 0x02, 0x34, 0xb4, 0x03, 0x9e, 0x20, 0x0a,
+	0x6e, 0x04, 0xc9, 0x6b, 0x71, 0x8a, 0x4b, 0x7b, 0x56, 0xff, 0x65, 0xcf, 0xda, 0x47, 0xf6, 0xb4,
+	0xfe, 0xaa, 0x82, 0x36, 0x09, 0x56, 0xef, 0x59, 0x0f, 0xda, 0x6b, 0x91, 0xac, 0x64, 0xb8, 0x53,
+	0x38, 0x8d, 0xf4, 0xe4, 0x65, 0x88, 0x7d, 0x0e, 0xda, 0x2a, 0x5e, 0xe7, 0x4f, 0x22, 0x0c, 0x70,
+	0xd9, 0x60, 0x14, 0xaf, 0x05, 0x27, 0x9c, 0x39, 0xf0, 0x44, 0x8a, 0x2b, 0x21, 0x65, 0xb0, 0x3d,
+	0xd8, 0xbf, 0xf6, 0xcf, 0xa3, 0x18, 0x79, 0x4d, 0x31, 0xc2, 0x63, 0xe8, 0x14, 0xeb, 0xb0, 0xe9,
+	0x5a, 0xba, 0x75, 0x8e, 0xbd, 0x13, 0xf7, 0xd6, 0x1f, 0x15, 0xd0, 0x70, 0x27, 0xd6, 0x06, 0x7d,
+	0x39, 0x79, 0x37, 0x99, 0xfe, 0x34, 0x31, 0x1e, 0xb1, 0x2e, 0xb4, 0x26, 0x53, 0x7f, 0x34, 0x9d,
+	0xfc, 0x38, 0x7e, 0x6b, 0x54, 0xd8, 0x13, 0xe8, 0x0e, 0x5d, 0x97, 0xfb, 0xe7, 0xe3, 0xf9, 0xf9,
+	0x70, 0x31, 0x3a, 0x35, 0xaa, 0xec, 0x25, 0x3c, 0x27, 0x68, 0x3e, 0x3a, 0xf5, 0xce, 0x3d, 0x7f,
+	0x39, 0x99, 0x2f, 0x67, 0xb3, 0x29, 0x5f, 0x78, 0xae, 0x51, 0x63, 0x4f, 0xc1, 0x58, 0xce, 0xde,
+	0xf2, 0xa1, 0xeb, 0xf9, 0xdc, 0xbb, 0x58, 0x8e, 0xb9, 0xe7, 0x1a, 0x1a, 0xa2, 0xd3, 0xe5, 0x62,
+	0x3e, 0x76, 0x3d, 0x5a, 0xe5, 0x2e, 0xcf, 0x3c, 0xa3, 0xce, 0x18, 0x3c, 0xbe, 0x58, 0x4e, 0x17,
+	0x43, 0xdf, 0xfb, 0x79, 0xe4, 0x79, 0xae, 0xe7, 0x1a, 0x0d, 0xd6, 0x81, 0x26, 0xf7, 0xdc, 0x31,
+	0xf7, 0x46, 0x0b, 0x43, 0xc7, 0x0c, 0x95, 0x9c, 0x8d, 0x47, 0x0b, 0xa3, 0x89, 0x5a, 0x66, 0xd3,
+	0xb3, 0xf1, 0xe8, 0x17, 0xdf, 0xf5, 0x26, 0x63, 0xcf, 0x35, 0x5a, 0xaf, 0x07, 0x00, 0x87, 0x3f,
+	0x11, 0xd4, 0xbe, 0xe0, 0xcb, 0xc9, 0x68, 0x88, 0x5a, 0x1e, 0x61, 0xfd, 0x7c, 0x78, 0xb6, 0xf0,
+	0x5c, 0x7f, 0x7e, 0x3a, 0x3c, 0xf9, 0xc6, 0x31, 0x2a, 0x3f, 0xb4, 0x7f, 0x6d, 0xdd, 0x5d, 0xc6,
+	0x1f, 0xe8, 0xef, 0xff, 0xb2, 0x41, 0x3f, 0x5f, 0xff, 0x3d, 0x00, 0xfa, 0x7b, 0x90, 0x27, 0x17,
+	0x08, 0x00, 0x00,
 }
@@ -0,0 +1,112 @@
+package prototest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/golang/protobuf/proto"
+)
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name string
+	// nil if the check passed.
+	Err error
+}
+
+// Suite runs all checks against this implementation of the protocol.
+func Suite() []Result {
+	var res []Result
+	add := func(name string, err error) {
+		res = append(res, Result{Name: name, Err: err})
+	}
+	for _, v := range Vectors {
+		add("decode/"+v.Name, CheckDecode(v, v.Bytes()))
+		add("encode/"+v.Name, checkEncode(v))
+		add("unknown-field/"+v.Name, checkUnknownField(v))
+		add("size/"+v.Name, checkSize(v))
+	}
+	add("unknown-version", checkRejected([]byte{2, byte(wboxproto.MsgSolict)}, wboxproto.ErrUnknownVersion))
+	add("unknown-type", checkRejected([]byte{wboxproto.Version, 0x7f}, nil))
+	add("truncated-header", checkRejected([]byte{wboxproto.Version}, nil))
+	add("truncated-message", checkRejected(truncate(Vectors[0].Bytes()), nil))
+	add("unexpected-type", checkUnexpectedType())
+	return res
+}
+
+// CheckDecode verifies that datagram b, e.g. produced by another
+// implementation for the vector v, carries the message of v.
+func CheckDecode(v Vector, b []byte) error {
+	msg, err := wboxproto.Unpack(b)
+	if err != nil {
+		return err
+	}
+	if !proto.Equal(msg, v.Msg()) {
+		return fmt.Errorf("decoded message differs: %v", msg)
+	}
+	return nil
+}
+
+// checkEncode verifies that the message of v is encoded to the vector bytes.
+func checkEncode(v Vector) error {
+	b, err := wboxproto.Pack(v.Msg())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, v.Bytes()) {
+		return fmt.Errorf("encoded as %x", b)
+	}
+	return nil
+}
+
+// checkUnknownField verifies that fields added by newer protocol versions
+// are ignored.
+func checkUnknownField(v Vector) error {
+	// Field 1000, varint 1.
+	b := append(v.Bytes(), 0xc0, 0x3e, 0x01)
+	msg, err := wboxproto.Unpack(b)
+	if err != nil {
+		return err
+	}
+	proto.DiscardUnknown(msg)
+	if !proto.Equal(msg, v.Msg()) {
+		return fmt.Errorf("decoded message differs: %v", msg)
+	}
+	return nil
+}
+
+func checkSize(v Vector) error {
+	if n := len(v.Bytes()); n > wboxproto.MaxDatagram {
+		return fmt.Errorf("%d bytes exceed the datagram limit", n)
+	}
+	return nil
+}
+
+// checkRejected verifies that the malformed datagram b is rejected with
+// expected or any error if expected is nil.
+func checkRejected(b []byte, expected error) error {
+	_, err := wboxproto.Unpack(b)
+	if err == nil {
+		return errors.New("malformed datagram is accepted")
+	}
+	if expected != nil && !errors.Is(err, expected) {
+		return fmt.Errorf("unexpected error: %w", err)
+	}
+	return nil
+}
+
+// truncate cuts b in the middle of the last field.
+func truncate(b []byte) []byte {
+	return b[:len(b)-1]
+}
+
+func checkUnexpectedType() error {
+	v := Find("cfg")
+	err := wboxproto.UnpackInto(v.Bytes(), &wboxproto.Nack{})
+	if !errors.Is(err, wboxproto.ErrUnexpectedType) {
+		return fmt.Errorf("Cfg datagram unpacked as Nack: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package prototest contains canonical WGDCP datagrams and checks that an
+// implementation decodes and encodes them as specified.
+//
+// Other implementations are not required to produce identical bytes since
+// Protocol Buffers permit different encodings of the same message, but
+// decoding each vector must yield the message it describes.
+package prototest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+// Vector is the datagram with the message it carries.
+type Vector struct {
+	Name string
+	Type wboxproto.MsgType
+	// Hex-encoded datagram including the version and type bytes, as
+	// produced by wboxproto.Pack.
+	Hex string
+	// Msg returns the expected message, a new one for each call.
+	Msg func() wboxproto.Message
+}
+
+// Bytes returns the decoded datagram.
+func (v Vector) Bytes() []byte {
+	b, err := hex.DecodeString(v.Hex)
+	if err != nil {
+		panic("prototest: malformed vector " + v.Name)
+	}
+	return b
+}
+
+// testKey is the public key used in vectors, bytes 1 to 32.
+func testKey() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i + 1)
+	}
+	return key
+}
+
+func net4(cidr string) *wboxproto.Net4 {
+	_, n, _ := net.ParseCIDR(cidr)
+	return wboxproto.NewNet4(*n)
+}
+
+func net6(cidr string) *wboxproto.Net6 {
+	ip, n, _ := net.ParseCIDR(cidr)
+	n.IP = ip
+	return wboxproto.NewNet6(*n)
+}
+
+func addr4(s string) uint32 {
+	return binary.BigEndian.Uint32(net.ParseIP(s).To4())
+}
+
+// Vectors lists canonical datagrams for each message type.
+var Vectors = []Vector{
+	{
+		Name: "solict-minimal",
+		Type: wboxproto.MsgSolict,
+		Hex:  "01010a200102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		Msg: func() wboxproto.Message {
+			return &wboxproto.CfgSolict{PeerPubkey: testKey()}
+		},
+	},
+	{
+		Name: "solict-full",
+		Type: wboxproto.MsgSolict,
+		Hex: "01010a200102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20" +
+			"10011a3730302d30616637363531393136636434336464383434386562323131633830" +
+			"333139632d623761643662373136393230333333312d303120012a090d057100cb18ec" +
+			"940332070d0000010a10103a0d0a090900000000010000fd10404205312e322e334a04" +
+			"6d6573684a077375626e657473",
+		Msg: func() wboxproto.Message {
+			return &wboxproto.CfgSolict{
+				PeerPubkey:  testKey(),
+				AddrScheme:  wboxproto.AddrScheme_SALTED_SHA256,
+				TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				Mesh:        true,
+				Endpoints: []*wboxproto.Endpoint{
+					{Addr4: addr4("203.0.113.5"), Port: 51820},
+				},
+				Subnets4:     []*wboxproto.Net4{net4("10.1.0.0/16")},
+				Subnets6:     []*wboxproto.Net6{net6("fd00:1::/64")},
+				Version:      "1.2.3",
+				Capabilities: []string{"mesh", "subnets"},
+			}
+		},
+	},
+	{
+		Name: "cfg",
+		Type: wboxproto.MsgCfg,
+		Hex: "01021080e2cfaa061a100a0b090100f4f5f4f4a6fd1002108001220f0a0d0a0909000000" +
+			"00000000fd10082a0b0900000000b80d0120100130e15d3a0b090000f4f5f4f4a6fd1001" +
+			"45010200c08201070d020200c010208a010e0a070d006433c610181d010200c0950101" +
+			"7100cbb0012a",
+		Msg: func() wboxproto.Message {
+			return &wboxproto.Cfg{
+				ValidUntil: 1700000000,
+				Server6:    wboxproto.NewIPv6(net.ParseIP("fda6:f4f4:f5f4::1")),
+				Net6:       []*wboxproto.Net6{net6("fda6:f4f4:f5f4:1::2/128")},
+				Routes6: []*wboxproto.Route6{
+					{Dest: net6("fd00::/8")},
+				},
+				Server4: addr4("192.0.2.1"),
+				Net4:    []*wboxproto.Net4{net4("192.0.2.2/32")},
+				Routes4: []*wboxproto.Route4{
+					{Dest: net4("198.51.100.0/24"), Gateway: addr4("192.0.2.1")},
+				},
+				Tun6Endpoint: wboxproto.NewIPv6(net.ParseIP("2001:db8::1")),
+				Tun4Endpoint: addr4("203.0.113.1"),
+				TunPort:      12001,
+				Serial:       42,
+			}
+		},
+	},
+	{
+		Name: "nack-no-config",
+		Type: wboxproto.MsgNack,
+		Hex:  "01030a1c6e6f20636f6e66696775726174696f6e20666f7220746865206b65791001",
+		Msg: func() wboxproto.Message {
+			return &wboxproto.Nack{
+				Description: []byte("no configuration for the key"),
+				Code:        wboxproto.Nack_NO_CONFIG,
+			}
+		},
+	},
+	{
+		Name: "nack-upgrade-required",
+		Type: wboxproto.MsgNack,
+		Hex:  "01030a24636c69656e742076657273696f6e20302e39206973206f6c646572207468616e20312e301004",
+		Msg: func() wboxproto.Message {
+			return &wboxproto.Nack{
+				Description: []byte("client version 0.9 is older than 1.0"),
+				Code:        wboxproto.Nack_UPGRADE_REQUIRED,
+			}
+		},
+	},
+}
+
+// Find returns the vector with the specified name or nil.
+func Find(name string) *Vector {
+	for i := range Vectors {
+		if Vectors[i].Name == name {
+			return &Vectors[i]
+		}
+	}
+	return nil
+}
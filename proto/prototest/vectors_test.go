@@ -0,0 +1,19 @@
+package prototest
+
+import (
+	"testing"
+)
+
+// TestSuite runs the conformance checks against the in-tree codec so vectors
+// stay in sync with it.
+func TestSuite(t *testing.T) {
+	results := Suite()
+	if len(results) == 0 {
+		t.Fatal("no checks")
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Name, r.Err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package wboxserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AdminAPIPrefix is the path prefix of admin API commands, the command name
+// follows it.
+const AdminAPIPrefix = "/v1/"
+
+// maxAdminArgs limits the size of command arguments sent in the request
+// body.
+const maxAdminArgs = 1 << 20
+
+type AdminAPIConfig struct {
+	// Address to serve HTTPS on, the admin API is disabled if empty.
+	Listen string `toml:"listen"`
+
+	// Certificate and key used unless acme is configured.
+	CertFile string `toml:"cert-file"`
+	KeyFile  string `toml:"key-file"`
+
+	// Obtain and renew the certificate automatically.
+	ACME ACMEConfig `toml:"acme"`
+
+	// PEM file with CA certificates client certificates are verified
+	// against. Clients without a valid certificate are rejected. Clients are
+	// not authenticated if empty.
+	ClientCA string `toml:"client-ca"`
+
+	// Clients identified by the certificate or the token and their roles.
+	Users []AdminUser `toml:"users"`
+	// Role of clients not matching any user, read-only if no users are
+	// configured and none otherwise. Required if neither client-ca nor users
+	// are set, since any client would get it.
+	DefaultRole *AdminRole `toml:"default-role"`
+}
+
+type ACMEConfig struct {
+	// Names to request the certificate for, ACME is disabled if empty.
+	Domains []string `toml:"domains"`
+	// Contact address for the CA, e.g. for expiration notices.
+	Email string `toml:"email"`
+	// Directory to keep the account key and certificates in,
+	// /var/lib/wirebox/acme by default.
+	CacheDir string `toml:"cache-dir"`
+	// ACME directory of the CA, Let's Encrypt by default. Use
+	// https://acme-staging-v02.api.letsencrypt.org/directory for tests.
+	DirectoryURL string `toml:"directory-url"`
+}
+
+// DefaultACMECacheDir is used if acme.cache-dir is not set.
+const DefaultACMECacheDir = "/var/lib/wirebox/acme"
+
+func (c AdminAPIConfig) Enabled() bool {
+	return c.Listen != ""
+}
+
+func (c ACMEConfig) Enabled() bool {
+	return len(c.Domains) != 0
+}
+
+// tlsConfig loads the certificate or sets up the ACME manager, and the CA
+// pool to verify client certificates.
+func (c AdminAPIConfig) tlsConfig() (*tls.Config, error) {
+	var cfg *tls.Config
+	if c.ACME.Enabled() {
+		cacheDir := c.ACME.CacheDir
+		if cacheDir == "" {
+			cacheDir = DefaultACMECacheDir
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.ACME.Domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      c.ACME.Email,
+		}
+		if c.ACME.DirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: c.ACME.DirectoryURL}
+		}
+		// Answers TLS-ALPN-01 challenges on the same listener.
+		cfg = m.TLSConfig()
+	} else {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	cfg.MinVersion = tls.VersionTLS12
+
+	if c.ClientCA != "" {
+		blob, err := ioutil.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("client-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, errors.New("client-ca: no certificates found")
+		}
+		strict := cfg.Clone()
+		strict.ClientCAs = pool
+		strict.ClientAuth = tls.RequireAndVerifyClientCert
+		if !c.ACME.Enabled() {
+			return strict, nil
+		}
+		cfg.GetConfigForClient = acmeConfigForClient(strict)
+	}
+	return cfg, nil
+}
+
+// acmeConfigForClient lets TLS-ALPN-01 validation through without a client
+// certificate, all other connections get the strict config. The CA offers
+// acme-tls/1 only and such connections just get the challenge certificate.
+// A client offering other protocols next to it could negotiate the API, so
+// it is not enough for acme-tls/1 to be present.
+func acmeConfigForClient(strict *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+			return nil, nil
+		}
+		return strict, nil
+	}
+}
+
+// handleAdmin executes control socket commands permitted by the role of the
+// client. GET requests run the command without arguments, POST requests
+// pass the JSON body as arguments. Responses use the control socket format.
+// Commands changing the server are recorded in the audit log.
+func (s *Server) handleAdmin(cfg AdminAPIConfig, handlers map[string]ctlsock.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reply := func(status int, resp ctlsock.Response) {
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				debugLog.Println("admin API:", err)
+			}
+		}
+
+		id, err := cfg.adminIdentity(r)
+		if err != nil {
+			log.Println("WARNING: admin API:", r.RemoteAddr+":", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			reply(http.StatusUnauthorized, ctlsock.Response{Error: err.Error()})
+			return
+		}
+
+		cmd := strings.TrimPrefix(r.URL.Path, AdminAPIPrefix)
+		h, ok := handlers[cmd]
+		if !ok {
+			reply(http.StatusNotFound, ctlsock.Response{Error: ctlsock.ErrUnknownCommand.Error()})
+			return
+		}
+
+		var args json.RawMessage
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			blob, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminArgs))
+			if err != nil {
+				reply(http.StatusBadRequest, ctlsock.Response{Error: err.Error()})
+				return
+			}
+			if len(blob) != 0 {
+				if !json.Valid(blob) {
+					reply(http.StatusBadRequest, ctlsock.Response{Error: "malformed JSON arguments"})
+					return
+				}
+				args = blob
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			reply(http.StatusMethodNotAllowed, ctlsock.Response{Error: "method not allowed"})
+			return
+		}
+
+		role := requiredRole(cmd, args)
+		if id.Role < role {
+			log.Printf("WARNING: admin API: %s (%v) is not permitted to run %s", id.Name, id.Role, cmd)
+			reply(http.StatusForbidden, ctlsock.Response{Error: fmt.Sprintf("%s requires the %v role", cmd, role)})
+			return
+		}
+
+		debugLog.Println("admin API:", id.Name, cmd)
+		if role > RoleReadOnly {
+			// Records are single lines.
+			var compact bytes.Buffer
+			if len(args) != 0 {
+				json.Compact(&compact, args)
+			}
+			log.Printf("admin API: %s (%v) runs %s", id.Name, id.Role, cmd)
+			audit.Record("admin-api", "%s (%v) from %s: %s %s", id.Name, id.Role, r.RemoteAddr, cmd, compact.String())
+		}
+		res, err := h(args)
+		if err != nil {
+			reply(http.StatusInternalServerError, ctlsock.Response{Error: err.Error()})
+			return
+		}
+		blob, err := json.Marshal(res)
+		if err != nil {
+			reply(http.StatusInternalServerError, ctlsock.Response{Error: err.Error()})
+			return
+		}
+		reply(http.StatusOK, ctlsock.Response{Result: blob})
+	}
+}
+
+// serveAdminAPI starts the HTTPS server exposing control socket commands.
+func (s *Server) serveAdminAPI(cfg AdminAPIConfig) (*http.Server, error) {
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("admin API: %w", err)
+	}
+	if cfg.ClientCA == "" && len(cfg.Users) == 0 {
+		log.Println("WARNING: admin API: client-ca and users are not set, clients are not authenticated")
+	}
+
+	handlers := s.controlHandlers()
+	for name, h := range s.storeHandlers() {
+		handlers[name] = h
+	}
+	mux := http.NewServeMux()
+	mux.Handle(AdminAPIPrefix, s.handleAdmin(cfg, handlers))
+	srv := &http.Server{
+		Handler:      mux,
+		TLSConfig:    tlsCfg,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("admin API: %w", err)
+	}
+	go func() {
+		if err := srv.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Println("error: admin API:", err)
+		}
+	}()
+	log.Println("admin API: listening on", l.Addr())
+	return srv, nil
+}
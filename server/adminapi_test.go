@@ -0,0 +1,113 @@
+package wboxserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "wirebox test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// handshake runs a TLS handshake between cfg and a client without a
+// certificate offering protos, and returns the error seen by the server.
+func handshake(t *testing.T, cfg *tls.Config, protos []string) error {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		errCh <- tls.Server(conn, cfg).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         protos,
+	})
+	if err == nil {
+		// With TLS 1.3 the server rejects the missing certificate after
+		// the client considers the handshake done.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	return <-errCh
+}
+
+func TestACMEConfigForClient(t *testing.T) {
+	cert, pool := testCert(t)
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+	strict := cfg.Clone()
+	strict.ClientCAs = pool
+	strict.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetConfigForClient = acmeConfigForClient(strict)
+
+	cases := []struct {
+		name   string
+		protos []string
+		ok     bool
+	}{
+		{"challenge", []string{acme.ALPNProto}, true},
+		{"challenge and http/1.1", []string{acme.ALPNProto, "http/1.1"}, false},
+		{"http/1.1 and challenge", []string{"http/1.1", acme.ALPNProto}, false},
+		{"http/1.1", []string{"http/1.1"}, false},
+		{"no ALPN", nil, false},
+	}
+	for _, c := range cases {
+		err := handshake(t, cfg, c.protos)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected handshake error: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: handshake without a client certificate succeeded", c.name)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package wboxserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/peerstore"
+	"github.com/foxcpp/wirebox/validate"
+)
+
+// AdminRole is the set of admin API commands a client may run. Each role
+// includes the commands of the previous ones.
+type AdminRole int
+
+const (
+	RoleNone AdminRole = iota
+	// Commands that only show the server state.
+	RoleReadOnly
+	// Removing clients from the peer store.
+	RoleOperator
+	// Granting access to clients.
+	RoleAdmin
+)
+
+var roleNames = map[AdminRole]string{
+	RoleNone:     "none",
+	RoleReadOnly: "read-only",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r AdminRole) String() string {
+	return roleNames[r]
+}
+
+func (r *AdminRole) UnmarshalText(text []byte) error {
+	for role, name := range roleNames {
+		if name == string(text) {
+			*r = role
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q, should be read-only, operator, admin or none", text)
+}
+
+func (r AdminRole) JSONSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "string",
+		"enum": []string{"none", "read-only", "operator", "admin"},
+	}
+}
+
+// commandRoles is the role required to run each admin API command.
+// Commands not listed require RoleAdmin.
+var commandRoles = map[string]AdminRole{
+	"state":     RoleReadOnly,
+	"peers":     RoleReadOnly,
+	"conflicts": RoleReadOnly,
+	"top":       RoleReadOnly,
+	"status":    RoleReadOnly,
+	"revoke":    RoleOperator,
+	"promote":   RoleOperator,
+	"demote":    RoleOperator,
+	"authorize": RoleAdmin,
+}
+
+func commandRole(cmd string) AdminRole {
+	if role, ok := commandRoles[cmd]; ok {
+		return role
+	}
+	return RoleAdmin
+}
+
+// requiredRole is the role required to run cmd with args. Key material is
+// revealed to RoleAdmin only, whatever the role of the command.
+func requiredRole(cmd string, args json.RawMessage) AdminRole {
+	if cmd == "status" && len(args) != 0 {
+		var status statusArgs
+		if err := json.Unmarshal(args, &status); err == nil && status.ShowKeys {
+			return RoleAdmin
+		}
+	}
+	return commandRole(cmd)
+}
+
+type AdminUser struct {
+	// Name recorded in logs and the audit log. Clients presenting a
+	// certificate with this common name are this user.
+	Name string    `toml:"name"`
+	Role AdminRole `toml:"role"`
+	// Hex SHA-256 of the token sent in "Authorization: Bearer TOKEN", only
+	// the certificate is used if empty.
+	TokenSHA256 string `toml:"token-sha256"`
+}
+
+func (u AdminUser) validate() error {
+	var errs validate.Errors
+	if u.Name == "" {
+		errs.Add("name", "is required")
+	}
+	if u.Role == RoleNone {
+		errs.Add("role", "is required")
+	}
+	if u.TokenSHA256 != "" {
+		if b, err := hex.DecodeString(u.TokenSHA256); err != nil || len(b) != sha256.Size {
+			errs.Add("token-sha256", "should be 64 hex digits")
+		}
+	}
+	return errs.Err()
+}
+
+// adminIdentity is the authenticated admin API client.
+type adminIdentity struct {
+	Name string
+	Role AdminRole
+}
+
+// adminIdentity authenticates the request by the bearer token or the client
+// certificate. Clients not matching any user get default-role, read-only if
+// no users are configured.
+func (c AdminAPIConfig) adminIdentity(r *http.Request) (adminIdentity, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth {
+			return adminIdentity{}, errors.New("unsupported authorization scheme")
+		}
+		sum := sha256.Sum256([]byte(token))
+		for _, u := range c.Users {
+			want, err := hex.DecodeString(u.TokenSHA256)
+			if err != nil || len(want) != sha256.Size {
+				continue
+			}
+			if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+				return adminIdentity{Name: u.Name, Role: u.Role}, nil
+			}
+		}
+		return adminIdentity{}, errors.New("invalid token")
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		for _, u := range c.Users {
+			if u.Name == cn {
+				return adminIdentity{Name: u.Name, Role: u.Role}, nil
+			}
+		}
+		return adminIdentity{Name: cn, Role: c.defaultRole()}, nil
+	}
+	return adminIdentity{Name: r.RemoteAddr, Role: c.defaultRole()}, nil
+}
+
+func (c AdminAPIConfig) defaultRole() AdminRole {
+	if c.DefaultRole != nil {
+		return *c.DefaultRole
+	}
+	if len(c.Users) == 0 {
+		return RoleReadOnly
+	}
+	return RoleNone
+}
+
+type peerKeyArgs struct {
+	Key string `json:"key"`
+}
+
+type authorizeArgs struct {
+	Key string `json:"key"`
+	// Client settings in the format of peers file entries (YAML).
+	Settings string `json:"settings"`
+}
+
+// storeHandlers returns admin API commands changing the peer store. The
+// running server applies the changes after the store notifies it.
+func (s *Server) storeHandlers() map[string]ctlsock.Handler {
+	store := func() (peerstore.Store, error) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		if s.Cfg.store == nil {
+			return nil, errors.New("peer-store is not configured")
+		}
+		return s.Cfg.store, nil
+	}
+
+	return map[string]ctlsock.Handler{
+		"revoke": func(raw json.RawMessage) (interface{}, error) {
+			var args peerKeyArgs
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return nil, err
+			}
+			if err := validate.Key(args.Key); err != nil {
+				return nil, err
+			}
+			st, err := store()
+			if err != nil {
+				return nil, err
+			}
+			return nil, st.Update(func(tx peerstore.Tx) error {
+				if _, err := tx.Get(args.Key); err != nil {
+					if errors.Is(err, peerstore.ErrNotFound) {
+						return fmt.Errorf("%v is not in the peer store", args.Key)
+					}
+					return err
+				}
+				return tx.Delete(args.Key)
+			})
+		},
+		"authorize": func(raw json.RawMessage) (interface{}, error) {
+			var args authorizeArgs
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return nil, err
+			}
+			if err := validate.Key(args.Key); err != nil {
+				return nil, err
+			}
+			p := peerstore.Peer{Key: args.Key, Settings: []byte(args.Settings), Added: time.Now()}
+			if _, err := parseStoreSettings(p.Settings); err != nil {
+				return nil, fmt.Errorf("settings: %w", err)
+			}
+			st, err := store()
+			if err != nil {
+				return nil, err
+			}
+			return nil, st.Update(func(tx peerstore.Tx) error {
+				// Keep the time the client was added first.
+				if prev, err := tx.Get(args.Key); err == nil {
+					p.Added = prev.Added
+				}
+				return tx.Put(p)
+			})
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package wboxserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/wirebox/ctlsock"
+)
+
+func tokenSum(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAdminRBAC(t *testing.T) {
+	cfg := AdminAPIConfig{
+		Users: []AdminUser{
+			{Name: "reader", Role: RoleReadOnly, TokenSHA256: tokenSum("reader-token")},
+			{Name: "operator", Role: RoleOperator, TokenSHA256: tokenSum("operator-token")},
+			{Name: "admin", Role: RoleAdmin, TokenSHA256: tokenSum("admin-token")},
+		},
+	}
+	called := map[string]int{}
+	stub := func(name string) ctlsock.Handler {
+		return func(json.RawMessage) (interface{}, error) {
+			called[name]++
+			return "ok", nil
+		}
+	}
+	handlers := map[string]ctlsock.Handler{
+		"status":    stub("status"),
+		"revoke":    stub("revoke"),
+		"authorize": stub("authorize"),
+	}
+	h := (&Server{}).handleAdmin(cfg, handlers)
+
+	cases := []struct {
+		token string
+		cmd   string
+		args  string
+		code  int
+	}{
+		{"reader-token", "status", "", http.StatusOK},
+		{"reader-token", "status", `{"format":"wg-dump"}`, http.StatusOK},
+		{"reader-token", "status", `{"format":"wg-dump","show-keys":false}`, http.StatusOK},
+		{"reader-token", "status", `{"format":"wg-dump","show-keys":true}`, http.StatusForbidden},
+		{"reader-token", "status", `{"show-keys":true}`, http.StatusForbidden},
+		{"operator-token", "status", `{"format":"wg-dump","show-keys":true}`, http.StatusForbidden},
+		{"admin-token", "status", `{"format":"wg-dump","show-keys":true}`, http.StatusOK},
+		{"reader-token", "revoke", `{"key":"x"}`, http.StatusForbidden},
+		{"operator-token", "revoke", `{"key":"x"}`, http.StatusOK},
+		{"operator-token", "authorize", `{"key":"x"}`, http.StatusForbidden},
+		{"admin-token", "authorize", `{"key":"x"}`, http.StatusOK},
+		{"wrong-token", "status", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		method := http.MethodGet
+		if c.args != "" {
+			method = http.MethodPost
+		}
+		before := called[c.cmd]
+		r := httptest.NewRequest(method, AdminAPIPrefix+c.cmd, strings.NewReader(c.args))
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%s %s %s: status %d, want %d: %s", c.token, c.cmd, c.args, w.Code, c.code, w.Body.String())
+		}
+		if ran := called[c.cmd] != before; ran != (c.code == http.StatusOK) {
+			t.Errorf("%s %s %s: handler ran = %v", c.token, c.cmd, c.args, ran)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package wboxserver
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// change is a single step of the plan produced by MakePlan.
+type change struct {
+	Op   byte // '+', '-' or '~'
+	Link string
+	Desc string
+
+	apply func(m linkmgr.Manager) error
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%c %v: %v", c.Op, c.Link, c.Desc)
+}
+
+// Plan lists changes needed to bring running interfaces to the state
+// described by the configuration with spec applied.
+type Plan []change
+
+func (p Plan) Print(w io.Writer) {
+	if len(p) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+	for _, c := range p {
+		fmt.Fprintln(w, c)
+	}
+}
+
+func (p Plan) Apply(m linkmgr.Manager) error {
+	for _, c := range p {
+		if err := c.apply(m); err != nil {
+			return fmt.Errorf("apply: %v: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// MakePlan compares running interfaces with the configuration cfg and the
+// spec applied to it. Interfaces created for clients no longer in the spec
+// are removed.
+func MakePlan(m linkmgr.Manager, cfg SrvConfig, spec PeerSpec) (Plan, error) {
+	current, err := linkSpecs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("plan: %w", err)
+	}
+
+	newCfg := cfg.withSpec(spec)
+	if err := newCfg.Validate(); err != nil {
+		return nil, fmt.Errorf("plan: %w", err)
+	}
+	desired, err := linkSpecs(newCfg)
+	if err != nil {
+		return nil, fmt.Errorf("plan: %w", err)
+	}
+
+	var plan Plan
+	wanted := make(map[string]bool, len(desired))
+	for _, spec := range desired {
+		wanted[spec.Name] = true
+		changes, err := planLink(m, spec)
+		if err != nil {
+			return nil, fmt.Errorf("plan: %w", err)
+		}
+		plan = append(plan, changes...)
+	}
+	for _, spec := range current {
+		if wanted[spec.Name] {
+			continue
+		}
+		l, err := m.GetLink(spec.Name)
+		if err != nil {
+			continue
+		}
+		plan = append(plan, change{
+			Op:   '-',
+			Link: spec.Name,
+			Desc: "delete interface",
+			apply: func(m linkmgr.Manager) error {
+				return m.DelLink(l.Index())
+			},
+		})
+	}
+	return plan, nil
+}
+
+func planLink(m linkmgr.Manager, spec linkSpec) (Plan, error) {
+	l, err := m.GetLink(spec.Name)
+	if err != nil {
+		return Plan{{
+			Op:   '+',
+			Link: spec.Name,
+			Desc: fmt.Sprintf("create interface with %d peers and %d addresses", len(spec.WG.Peers), len(spec.Addrs)),
+			apply: func(m linkmgr.Manager) error {
+				_, _, err := spec.create(m)
+				return err
+			},
+		}}, nil
+	}
+
+	dev, err := l.WGConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var plan Plan
+	if spec.WG.ListenPort != nil && *spec.WG.ListenPort != dev.ListenPort {
+		port := *spec.WG.ListenPort
+		plan = append(plan, change{
+			Op:   '~',
+			Link: spec.Name,
+			Desc: fmt.Sprintf("listen port %d -> %d", dev.ListenPort, port),
+			apply: func(linkmgr.Manager) error {
+				return l.ConfigureWG(wgtypes.Config{ListenPort: &port})
+			},
+		})
+	}
+
+	livePeers := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+	for _, p := range dev.Peers {
+		livePeers[p.PublicKey] = p
+	}
+	wantPeers := make(map[wgtypes.Key]bool, len(spec.WG.Peers))
+	for _, p := range spec.WG.Peers {
+		p := p
+		wantPeers[p.PublicKey] = true
+		p.ReplaceAllowedIPs = true
+
+		live, ok := livePeers[p.PublicKey]
+		switch {
+		case !ok:
+			plan = append(plan, change{
+				Op:   '+',
+				Link: spec.Name,
+				Desc: fmt.Sprintf("add peer %v allowed-ips %v", p.PublicKey, joinNets(p.AllowedIPs)),
+				apply: func(linkmgr.Manager) error {
+					return l.ConfigureWG(wgtypes.Config{Peers: []wgtypes.PeerConfig{p}})
+				},
+			})
+		case joinNets(p.AllowedIPs) != joinNets(live.AllowedIPs):
+			plan = append(plan, change{
+				Op:   '~',
+				Link: spec.Name,
+				Desc: fmt.Sprintf("peer %v allowed-ips %v -> %v", p.PublicKey, joinNets(live.AllowedIPs), joinNets(p.AllowedIPs)),
+				apply: func(linkmgr.Manager) error {
+					return l.ConfigureWG(wgtypes.Config{Peers: []wgtypes.PeerConfig{p}})
+				},
+			})
+		case p.Endpoint != nil && (live.Endpoint == nil || live.Endpoint.String() != p.Endpoint.String()):
+			plan = append(plan, change{
+				Op:   '~',
+				Link: spec.Name,
+				Desc: fmt.Sprintf("peer %v endpoint %v -> %v", p.PublicKey, live.Endpoint, p.Endpoint),
+				apply: func(linkmgr.Manager) error {
+					return l.ConfigureWG(wgtypes.Config{Peers: []wgtypes.PeerConfig{p}})
+				},
+			})
+		}
+	}
+	for _, p := range dev.Peers {
+		if wantPeers[p.PublicKey] {
+			continue
+		}
+		key := p.PublicKey
+		plan = append(plan, change{
+			Op:   '-',
+			Link: spec.Name,
+			Desc: fmt.Sprintf("remove peer %v", key),
+			apply: func(linkmgr.Manager) error {
+				return l.ConfigureWG(wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}}})
+			},
+		})
+	}
+
+	liveAddrs, err := l.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(liveAddrs))
+	for _, a := range liveAddrs {
+		have[addrKey(a)] = true
+	}
+	want := make(map[string]bool, len(spec.Addrs))
+	for _, a := range spec.Addrs {
+		a := a
+		want[addrKey(a)] = true
+		if have[addrKey(a)] {
+			continue
+		}
+		plan = append(plan, change{
+			Op:   '+',
+			Link: spec.Name,
+			Desc: "add address " + addrKey(a),
+			apply: func(linkmgr.Manager) error {
+				return l.AddAddr(a)
+			},
+		})
+	}
+	for _, a := range liveAddrs {
+		a := a
+		// Same rule as in pruneAddrs, addresses without peer are not
+		// managed per client.
+		if a.Peer == nil || want[addrKey(a)] {
+			continue
+		}
+		plan = append(plan, change{
+			Op:   '-',
+			Link: spec.Name,
+			Desc: "remove address " + addrKey(a),
+			apply: func(linkmgr.Manager) error {
+				return l.DelAddr(a)
+			},
+		})
+	}
+
+	return plan, nil
+}
+
+func addrKey(a linkmgr.Address) string {
+	if a.Peer == nil {
+		return a.IPNet.String()
+	}
+	return a.IPNet.String() + " peer " + a.Peer.String()
+}
+
+// joinNets formats the set of networks independently of their order.
+func joinNets(nets []net.IPNet) string {
+	parts := make([]string, 0, len(nets))
+	for _, n := range nets {
+		parts = append(parts, n.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func applyMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	specPath := fs.String("f", "", "peers spec file to apply (YAML, see peers.example.yaml)")
+	planOnly := fs.Bool("plan", false, "only print the plan")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd apply [options] -f peers.yaml")
+		fmt.Fprintln(fs.Output(), "If peers-file is set in the configuration, it is replaced with the")
+		fmt.Fprintln(fs.Output(), "applied spec so the running server picks up the change.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *specPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	blob, spec, err := readPeerSpec(*specPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	auditSink, err := audit.Setup(cfg.Audit, "wboxd")
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	defer auditSink.Close()
+
+	m, err := linkmgr.NewManager()
+	if err != nil {
+		log.Println("error: link mngr init:", err)
+		return 1
+	}
+	defer m.Close()
+
+	plan, err := MakePlan(m, cfg, spec)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	plan.Print(os.Stdout)
+	if *planOnly {
+		return 0
+	}
+
+	if err := plan.Apply(m); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if cfg.PeersFile != "" {
+		if err := writeFileAtomic(cfg.PeersFile, blob, 0644); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+	}
+	if len(plan) != 0 {
+		fmt.Println("Applied", len(plan), "changes.")
+	}
+	return 0
+}
+
+func writeFileAtomic(path string, blob []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
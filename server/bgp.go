@@ -0,0 +1,83 @@
+package wboxserver
+
+import (
+	"net"
+
+	"github.com/foxcpp/wirebox/bgp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// bgpRoutes returns client pools and networks routed by clients, announced
+// to BGP neighbors.
+func (s *Server) bgpRoutes() []net.IPNet {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// Traffic for clients should go to the primary.
+	if s.Cfg.standby {
+		return nil
+	}
+
+	var res []net.IPNet
+	for _, pool := range []IPNet{s.Cfg.Pool4, s.Cfg.Pool6} {
+		if pool.IP != nil {
+			res = append(res, pool.IPNet)
+		}
+	}
+	for _, r := range s.siteRoutes(wgtypes.Key{}) {
+		res = append(res, r.Dest.IPNet)
+	}
+	return res
+}
+
+// triggerBGP schedules the update of routes announced to BGP neighbors.
+func (s *Server) triggerBGP() {
+	if s.bgpTrigger == nil {
+		return
+	}
+	select {
+	case s.bgpTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// runBGP keeps announced routes in sync until stop is closed.
+func (s *Server) runBGP(sp *bgp.Speaker, stop <-chan struct{}) {
+	for {
+		sp.Announce(s.bgpRoutes())
+		select {
+		case <-stop:
+			return
+		case <-s.bgpTrigger:
+		}
+	}
+}
+
+// bgpImported is called when routes learned from BGP neighbors change, they
+// are pushed to clients with the next configuration.
+func (s *Server) bgpImported() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.serial++
+	s.cfgCache.reset()
+}
+
+// importedRoutes returns routes learned from BGP neighbors except ones
+// overlapping with networks routed by the client itself. The lock should be
+// held by the caller.
+func (s *Server) importedRoutes(self wgtypes.Key) []Route {
+	if s.bgp == nil {
+		return nil
+	}
+	var res []Route
+imported:
+	for _, n := range s.bgp.Imported() {
+		for _, own := range s.sites[self].accepted {
+			if netsOverlap(n, own) {
+				continue imported
+			}
+		}
+		res = append(res, Route{Dest: &IPNet{n}})
+	}
+	return res
+}
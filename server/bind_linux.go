@@ -0,0 +1,8 @@
+package wboxserver
+
+import "golang.org/x/sys/unix"
+
+// bindToDevice restricts the socket to packets received on the interface.
+func bindToDevice(fd uintptr, name string) error {
+	return unix.BindToDevice(int(fd), name)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package wboxserver
+
+import "errors"
+
+// bindToDevice is not implemented on this platform, so config-ipv4 cannot be
+// used.
+func bindToDevice(fd uintptr, name string) error {
+	return errors.New("binding sockets to interfaces is not supported on this platform")
+}
@@ -0,0 +1,300 @@
+package wboxserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/validate"
+)
+
+type BootstrapConfig struct {
+	// Address to serve HTTPS on, bootstrap is disabled if empty.
+	Listen   string `toml:"listen"`
+	CertFile string `toml:"cert-file"`
+	KeyFile  string `toml:"key-file"`
+
+	// Enrollment tokens. Keys of clients presenting one of them are added to
+	// authorized-keys.
+	Tokens []BootstrapToken `toml:"tokens"`
+
+	// Configuration tunnel endpoint (IP:port) reported to clients.
+	// advertised-endpoint4/6 and port-low are used if not set.
+	ConfigEndpoint string `toml:"config-endpoint"`
+}
+
+// BootstrapToken is an enrollment token issued to a single client.
+type BootstrapToken struct {
+	Token string `toml:"token"`
+	// Public key of the client the token is issued to. Requests enrolling
+	// any other key are rejected, so a leaked token cannot be used with a
+	// key of the attacker's choice.
+	Key string `toml:"key"`
+}
+
+func (t BootstrapToken) validate() error {
+	var errs validate.Errors
+	if len(t.Token) < 16 {
+		errs.Add("token", "should be at least 16 characters long")
+	}
+	errs.Check("key", validate.Key(t.Key))
+	return errs.Err()
+}
+
+// nonceLifetime is how long the client has to complete the enrollment after
+// requesting the challenge.
+const nonceLifetime = 5 * time.Minute
+
+// newNonce returns the nonce for the enrollment challenge. Nonces are not
+// stored, they contain the issue time authenticated using the server secret.
+func newNonce(secret []byte, now time.Time) string {
+	blob := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(blob, uint64(now.Unix()))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(blob)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(blob))
+}
+
+func validNonce(secret []byte, nonce string, now time.Time) bool {
+	blob, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(blob) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(blob[:8])
+	if !hmac.Equal(mac.Sum(nil), blob[8:]) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(blob[:8])), 0)
+	return now.Sub(issued) >= 0 && now.Sub(issued) < nonceLifetime
+}
+
+func (c BootstrapConfig) Enabled() bool {
+	return c.Listen != ""
+}
+
+// bootstrapInfo returns the information sent to enrolled clients.
+func (c SrvConfig) bootstrapInfo() (wirebox.BootstrapInfo, error) {
+	info := wirebox.BootstrapInfo{
+		ServerKey:      c.PrivateKey.PublicFromPrivate().Encoded,
+		ConfigEndpoint: c.Bootstrap.ConfigEndpoint,
+		AddrSalt:       c.AddrSalt,
+	}
+	if len(c.AddrSchemes) != 0 {
+		// The last scheme is assumed to be the one clients are migrated
+		// to.
+		info.AddrScheme = c.AddrSchemes[len(c.AddrSchemes)-1]
+	}
+	if info.ConfigEndpoint == "" {
+		switch {
+		case c.TunEndpoint4.IP != nil:
+			info.ConfigEndpoint = net.JoinHostPort(c.TunEndpoint4.IP.String(), strconv.Itoa(c.PortLow))
+		case c.TunEndpoint6.IP != nil:
+			info.ConfigEndpoint = net.JoinHostPort(c.TunEndpoint6.IP.String(), strconv.Itoa(c.PortLow))
+		default:
+			return info, errors.New("bootstrap: config-endpoint or advertised endpoint is required")
+		}
+	}
+	return info, nil
+}
+
+// tokenKey returns the key the token is issued to, false if the token is not
+// valid.
+func (c BootstrapConfig) tokenKey(token string) (wirebox.PeerKey, bool) {
+	var (
+		key   wirebox.PeerKey
+		valid bool
+	)
+	for _, t := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			k, err := wirebox.NewPeerKey(t.Key)
+			if err == nil {
+				key, valid = k, true
+			}
+		}
+	}
+	return key, valid
+}
+
+// authorizeLock serializes changes to the authorized-keys file and the peer
+// store.
+var authorizeLock sync.Mutex
+
+// authorizeKey appends the key to the authorized-keys file (or adds it to the
+// peer store if there is no such file) and reconciles the server if the key
+// is new.
+func (s *Server) authorizeKey(key wirebox.PeerKey) error {
+	authorizeLock.Lock()
+	defer authorizeLock.Unlock()
+
+	s.lock.RLock()
+	cfg := s.Cfg
+	s.lock.RUnlock()
+
+	if cfg.AuthFile == "" {
+		added, err := storePeer(cfg.store, key)
+		if err != nil || !added {
+			return err
+		}
+		log.Println("bootstrap: authorized", key, "in peer store")
+		cfg, err = cfg.reloadStore()
+		if err != nil {
+			return err
+		}
+		return s.Reconcile(cfg)
+	}
+
+	keys, err := readKeyList(cfg.AuthFile)
+	if err != nil {
+		return err
+	}
+	if containsKey(keys, key.Encoded) {
+		return nil
+	}
+
+	f, err := os.OpenFile(cfg.AuthFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, key.Encoded); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Println("bootstrap: authorized", key)
+
+	return s.Reconcile(cfg)
+}
+
+// bootstrapTarget returns the server (this one or one of overlays) the token
+// enrolls clients to and the key it is issued to, nil if the token is not
+// valid.
+func (s *Server) bootstrapTarget(token string) (*Server, wirebox.PeerKey) {
+	for _, srv := range append([]*Server{s}, s.overlays...) {
+		srv.lock.RLock()
+		key, valid := srv.Cfg.Bootstrap.tokenKey(token)
+		srv.lock.RUnlock()
+		if valid {
+			return srv, key
+		}
+	}
+	return nil, wirebox.PeerKey{}
+}
+
+func (s *Server) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	target, tokenKey := s.bootstrapTarget(token)
+	if target == nil {
+		log.Println("bootstrap: invalid token from", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	target.lock.RLock()
+	cfg := target.Cfg
+	target.lock.RUnlock()
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(wirebox.BootstrapChallenge{
+			ServerKey: cfg.PrivateKey.PublicFromPrivate().Encoded,
+			Nonce:     newNonce(s.nonceSecret, time.Now()),
+		})
+		if err != nil {
+			log.Println("error: bootstrap:", err)
+		}
+		return
+	}
+
+	var req wirebox.BootstrapRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+	key, err := wirebox.NewPeerKey(req.PublicKey)
+	if err != nil {
+		http.Error(w, "malformed public key", http.StatusBadRequest)
+		return
+	}
+	if !validNonce(s.nonceSecret, req.Nonce, time.Now()) {
+		http.Error(w, "invalid or expired nonce", http.StatusForbidden)
+		return
+	}
+	if key.Bytes != tokenKey.Bytes {
+		log.Println("bootstrap: rejected", key, "from", r.RemoteAddr+": token is issued to", tokenKey)
+		http.Error(w, "token is issued to another key", http.StatusForbidden)
+		return
+	}
+	proof, err := wirebox.EnrollProof(cfg.PrivateKey.Bytes, key.Bytes, token, key.Encoded, req.Nonce)
+	if err != nil || !hmac.Equal(proof, req.Proof) {
+		log.Println("bootstrap: invalid proof of possession for", key, "from", r.RemoteAddr)
+		http.Error(w, "invalid proof of possession", http.StatusForbidden)
+		return
+	}
+
+	info, err := cfg.bootstrapInfo()
+	if err != nil {
+		log.Println("error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := target.authorizeKey(key); err != nil {
+		log.Println("error: bootstrap:", key, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Println("error: bootstrap:", err)
+	}
+}
+
+// serveBootstrap starts the HTTPS enrollment endpoint.
+func (s *Server) serveBootstrap(cfg BootstrapConfig) (*http.Server, error) {
+	s.nonceSecret = make([]byte, 32)
+	if _, err := rand.Read(s.nonceSecret); err != nil {
+		return nil, fmt.Errorf("bootstrap: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(wirebox.BootstrapPath, s.handleBootstrap)
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap: %w", err)
+	}
+	go func() {
+		if err := srv.ServeTLS(l, cfg.CertFile, cfg.KeyFile); err != nil && err != http.ErrServerClosed {
+			log.Println("error: bootstrap:", err)
+		}
+	}()
+	log.Println("bootstrap: listening on", l.Addr())
+	return srv, nil
+}
@@ -0,0 +1,92 @@
+package wboxserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testKey(t *testing.T) (wgtypes.Key, wirebox.PeerKey) {
+	t.Helper()
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := wirebox.NewPeerKey(priv.PublicKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestBootstrapTokenKey(t *testing.T) {
+	serverPriv, _ := testKey(t)
+	_, issued := testKey(t)
+	attackerPriv, attacker := testKey(t)
+
+	const token = "0123456789abcdef0123"
+	s := &Server{
+		Cfg: SrvConfig{
+			PrivateKey: wirebox.PeerKey{Encoded: serverPriv.String(), Bytes: serverPriv},
+			Bootstrap: BootstrapConfig{
+				Tokens: []BootstrapToken{{Token: token, Key: issued.Encoded}},
+			},
+		},
+		nonceSecret: []byte("test secret"),
+	}
+
+	if _, ok := s.Cfg.Bootstrap.tokenKey("wrong token value"); ok {
+		t.Error("tokenKey accepted an unknown token")
+	}
+	if key, ok := s.Cfg.Bootstrap.tokenKey(token); !ok || key.Bytes != issued.Bytes {
+		t.Errorf("tokenKey = %v, %v; want %v, true", key, ok, issued)
+	}
+
+	// The attacker has the token and a valid proof of possession for its
+	// own key.
+	nonce := newNonce(s.nonceSecret, time.Now())
+	proof, err := wirebox.EnrollProof(attackerPriv, serverPriv.PublicKey(), token, attacker.Encoded, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(wirebox.BootstrapRequest{
+		PublicKey: attacker.Encoded,
+		Nonce:     nonce,
+		Proof:     proof,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, wirebox.BootstrapPath, bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.handleBootstrap(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "issued to another key") {
+		t.Errorf("enrollment of another key: status %d, want %d: %s", w.Code, http.StatusForbidden, w.Body.String())
+	}
+}
+
+func TestBootstrapTokenValidate(t *testing.T) {
+	_, key := testKey(t)
+	cases := []struct {
+		tok BootstrapToken
+		ok  bool
+	}{
+		{BootstrapToken{Token: "0123456789abcdef", Key: key.Encoded}, true},
+		{BootstrapToken{Token: "short", Key: key.Encoded}, false},
+		{BootstrapToken{Token: "0123456789abcdef"}, false},
+		{BootstrapToken{Token: "0123456789abcdef", Key: "not a key"}, false},
+	}
+	for _, c := range cases {
+		if err := c.tok.validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: validate() = %v", c.tok, err)
+		}
+	}
+}
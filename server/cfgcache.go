@@ -0,0 +1,48 @@
+package wboxserver
+
+import (
+	"sync"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type cachedCfg struct {
+	serial uint64
+	msg    *wboxproto.Cfg
+	dgram  []byte
+}
+
+// cfgCache keeps packed configuration messages sent to clients so repeated
+// solictations do not need to build and serialize them again. Entries are
+// valid only for the configuration serial they were built for.
+type cfgCache struct {
+	lock    sync.Mutex
+	entries map[wgtypes.Key]cachedCfg
+}
+
+func (cc *cfgCache) get(key wgtypes.Key, serial uint64) (cachedCfg, bool) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	c, ok := cc.entries[key]
+	if !ok || c.serial != serial {
+		return cachedCfg{}, false
+	}
+	return c, true
+}
+
+func (cc *cfgCache) put(key wgtypes.Key, c cachedCfg) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.entries == nil {
+		cc.entries = make(map[wgtypes.Key]cachedCfg)
+	}
+	cc.entries[key] = c
+}
+
+// reset drops all entries, including ones of removed clients.
+func (cc *cfgCache) reset() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.entries = nil
+}
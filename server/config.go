@@ -3,9 +3,24 @@ package wboxserver
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/bgp"
+	"github.com/foxcpp/wirebox/dnspub"
+	"github.com/foxcpp/wirebox/errreport"
+	"github.com/foxcpp/wirebox/logging"
+	"github.com/foxcpp/wirebox/peerstore"
+	"github.com/foxcpp/wirebox/privdrop"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/sysctl"
+	"github.com/foxcpp/wirebox/tracing"
+	"github.com/foxcpp/wirebox/validate"
 )
 
 type SrvConfig struct {
@@ -16,11 +31,19 @@ type SrvConfig struct {
 	Subnet6 IPNet `toml:"subnet6"`
 
 	PrivateKey wirebox.PeerKey `toml:"private-key"`
-	Server4    IPAddr          `toml:"server4"`
-	Server6    IPAddr          `toml:"server6"`
+	// What to do if the configuration file with the private key is
+	// accessible by other users: "strict" (default) refuses to start,
+	// "warn" logs a warning.
+	KeyPerms string `toml:"key-permissions"`
+
+	Server4 IPAddr `toml:"server4"`
+	Server6 IPAddr `toml:"server6"`
 
 	TunEndpoint4 IPAddr `toml:"advertised-endpoint4"`
 	TunEndpoint6 IPAddr `toml:"advertised-endpoint6"`
+	// Tunnel endpoint candidates with region and priority hints, clients
+	// supporting them pick the nearest one instead of advertised-endpoint4/6.
+	TunEndpoints []TunEndpoint `toml:"advertised-endpoints"`
 
 	PortLow  int `toml:"port-low"`
 	PortHigh int `toml:"port-high"`
@@ -34,84 +57,758 @@ type SrvConfig struct {
 
 	AuthFile string `toml:"authorized-keys"`
 
+	// Link-local address derivation schemes accepted from clients. Using
+	// multiple schemes permits migration between them.
+	AddrSchemes []string `toml:"config-addr-schemes"`
+	AddrSalt    string   `toml:"config-addr-salt"`
+	// Also accept solictations from clients with IPv6 disabled using IPv4
+	// link-local addresses (169.254.0.0/16).
+	ConfigIPv4 bool `toml:"config-ipv4"`
+
+	// Number of goroutines handling solictations (number of CPUs by default)
+	// and the number of solictations queued for each before new ones are
+	// dropped (128 by default).
+	SolictWorkers int `toml:"solict-workers"`
+	SolictQueue   int `toml:"solict-queue"`
+
 	// Overrides for static configuration.
 	Clients map[string]ClientOverrides `toml:"clients"`
+
+	// Declarative client list in YAML. The file is watched and changes are
+	// applied without restart.
+	PeersFile     string   `toml:"peers-file"`
+	PeersInterval Duration `toml:"peers-interval"`
+
+	// Persistent client list with pool leases, changed by bootstrap and
+	// "wboxd store" and applied without restart.
+	PeerStore PeerStoreConfig `toml:"peer-store"`
+
+	// Keys of clients from PeersFile and PeerStore in their order, clients
+	// from both and from the configuration file itself. Clients is the merge
+	// of them, see merged.
+	specKeys     []string
+	storeKeys    []string
+	specClients  map[string]ClientOverrides
+	storeClients map[string]ClientOverrides
+	fileClients  map[string]ClientOverrides
+	hasBase      bool
+	// Open peer store and pool slots leased from it by key.
+	store  peerstore.Store
+	leases map[string]uint64
+	// Whether the server is currently the warm standby, see StandbyConfig.
+	// Changed only by setStandby.
+	standby bool
+
+	// Unix socket for commands such as "status" and "peers" talking to the
+	// running server, /run/wirebox/wboxd.sock by default.
+	ControlSocket string `toml:"control-socket"`
+
+	Log            logging.Config   `toml:"log"`
+	Audit          audit.Config     `toml:"audit"`
+	Tracing        tracing.Config   `toml:"tracing"`
+	ErrorReporting errreport.Config `toml:"error-reporting"`
+	DNSPublish     dnspub.Config    `toml:"dns-publish"`
+	BGP            bgp.Config       `toml:"bgp"`
+
+	// Kernel parameters set for tunnel interfaces.
+	Sysctl sysctl.Config `toml:"sysctl"`
+
+	// Unprivileged user the server switches to once it is started.
+	Privileges privdrop.Config `toml:"privileges"`
+
+	// Start as the warm standby of another server sharing the peer store.
+	Standby StandbyConfig `toml:"standby"`
+
+	// Send hostnames and addresses of all clients to each client so they can
+	// be added to the hosts file.
+	PushHosts bool `toml:"push-hosts"`
+
+	// Share endpoints of clients that request it with each other so they can
+	// establish direct tunnels. Same as topology = "mesh".
+	Mesh bool `toml:"mesh"`
+
+	// Peers included in client configurations: "hub" (only the server, the
+	// default) or "mesh" (other clients of the same group that request
+	// direct tunnels).
+	Topology string `toml:"topology"`
+	// Per-group settings, clients are assigned to groups with the group
+	// option.
+	Groups map[string]GroupConfig `toml:"groups"`
+
+	// UDP ports the server relays WireGuard packets on between mesh clients
+	// that cannot reach each other directly, one port per pair of clients.
+	// Relays are disabled if not set.
+	RelayPortLow  int `toml:"relay-port-low"`
+	RelayPortHigh int `toml:"relay-port-high"`
+
+	// STUN servers (host:port) used to discover the public IPv4 address of
+	// the server if advertised endpoints are not set.
+	STUNServers []string `toml:"stun-servers"`
+
+	// Refuse configuration to clients older than this version or lacking
+	// any of these capabilities (see wirebox.Capabilities) with the
+	// upgrade-required NACK.
+	MinClientVersion     string   `toml:"min-client-version"`
+	RequiredCapabilities []string `toml:"required-capabilities"`
+
+	// Time zone client schedules are evaluated in (IANA name), local time
+	// zone by default.
+	TimeZone string `toml:"time-zone"`
+
+	// HTTPS endpoint for token-based enrollment of new clients.
+	Bootstrap BootstrapConfig `toml:"bootstrap"`
+
+	// HTTPS endpoint exposing control socket commands to remote tools.
+	AdminAPI AdminAPIConfig `toml:"admin-api"`
+
+	// TCP and UDP port answering in-tunnel throughput and latency tests
+	// ("wbox bench") of clients, disabled if 0.
+	BenchPort int `toml:"bench-port"`
+
+	// Message sent to clients with the configuration, e.g. a maintenance
+	// notice. Groups can override it.
+	Motd string `toml:"motd"`
+
+	// Refer clients to another server instead of configuring them. Groups
+	// can override it.
+	Redirect RedirectConfig `toml:"redirect"`
+	// Additional overlays served by this process: names mapped to paths of
+	// their configuration files (relative to this file). Each overlay has
+	// its own interfaces, pools, clients and control socket.
+	Overlays map[string]string `toml:"overlays"`
+	// Loaded configurations of Overlays.
+	overlays map[string]SrvConfig
+
+	// Rules evaluated for each solictation that can deny, modify or
+	// annotate the configuration, see PolicyRule.
+	Policy []PolicyRule `toml:"policy"`
+	// Compiled Policy.
+	policy []compiledRule
 }
 
+// maxMotd limits the message so the configuration still fits the datagram.
+const maxMotd = 256
+
 func (c SrvConfig) Validate() error {
-	if c.If == "" {
-		return errors.New("config: if is required")
-	}
-	if c.PtMP && len(c.If) > 15 {
-		return errors.New("config: if is too long (can be 15 octets at most)")
-	}
-	if !c.PtMP && len(c.If) > 12 {
-		return errors.New("config: if is too long (can be 15 octets at most, including client sequence number)")
+	var errs validate.Errors
+
+	if c.PtMP {
+		errs.Check("if", validate.IfName(c.If, 15))
+	} else {
+		// Leave space for the client sequence number.
+		errs.Check("if", validate.IfName(c.If, 12))
 	}
 
-	if c.PrivateKey.Encoded == "" {
-		return errors.New("config: private-key is required")
+	errs.Check("private-key", validate.Key(c.PrivateKey.Encoded))
+	if !wirebox.ValidKeyPerms(c.KeyPerms) {
+		errs.Add("key-permissions", "should be either strict or warn")
 	}
 	if c.Server4.IP == nil && c.Server6.IP == nil {
-		return errors.New("config: at least one of server4, server6 is required")
+		errs.Add("", "at least one of server4, server6 is required")
+	}
+	if c.Server4.IP != nil {
+		errs.Check("server4", validate.SameFamily(c.Server4.IP, true))
 	}
-	if (c.PortLow == 0 && c.PortHigh != 0) || (c.PortHigh != 0 && c.PortLow == 0) {
-		return errors.New("config: both or none of port-low and port-high should be specified")
+	if c.Server6.IP != nil {
+		errs.Check("server6", validate.SameFamily(c.Server6.IP, false))
+	}
+
+	if (c.PortLow == 0) != (c.PortHigh == 0) {
+		errs.Add("", "both or none of port-low and port-high should be specified")
 	}
 	if c.PortLow != 0 && c.PortHigh != 0 {
+		errs.Check("port-low", validate.Port(c.PortLow))
+		errs.Check("port-high", validate.Port(c.PortHigh))
 		if !c.PtMP && c.PortLow >= c.PortHigh {
-			return errors.New("config: port range should contain at least two ports")
+			errs.Add("port-high", "port range should contain at least two ports")
 		}
-		if c.PortLow < 0 || c.PortLow > 65535 {
-			return errors.New("config: invalid port-low")
+	}
+	if c.PtMP && c.PortHigh-c.PortLow != 0 {
+		errs.Add("port-high", "ports other than port-low are not used in PtMP mode")
+	}
+
+	if (c.RelayPortLow == 0) != (c.RelayPortHigh == 0) {
+		errs.Add("", "both or none of relay-port-low and relay-port-high should be specified")
+	}
+	if c.RelayPortLow != 0 && c.RelayPortHigh != 0 {
+		errs.Check("relay-port-low", validate.Port(c.RelayPortLow))
+		errs.Check("relay-port-high", validate.Port(c.RelayPortHigh))
+		if c.RelayPortLow > c.RelayPortHigh {
+			errs.Add("relay-port-high", "should not be lower than relay-port-low")
 		}
-		if c.PortHigh < 0 || c.PortHigh > 65535 {
-			return errors.New("config: invalid port-high")
+		if c.RelayPortLow <= c.PortHigh && c.PortLow <= c.RelayPortHigh {
+			errs.Add("relay-port-low", "relay ports should not overlap with port-low and port-high")
 		}
 	}
-	if c.PtMP && c.PortHigh-c.PortLow != 0 {
-		return errors.New("config: ports other than port-low are not used in PtMP mode")
+
+	for _, n := range []struct {
+		field    string
+		net      IPNet
+		v4       bool
+		subnet   IPNet
+		serverIP net.IP
+	}{
+		{"subnet4", c.Subnet4, true, IPNet{}, c.Server4.IP},
+		{"subnet6", c.Subnet6, false, IPNet{}, c.Server6.IP},
+		{"pool4", c.Pool4, true, c.Subnet4, c.Server4.IP},
+		{"pool6", c.Pool6, false, c.Subnet6, c.Server6.IP},
+	} {
+		if n.net.IP == nil {
+			continue
+		}
+		errs.Check(n.field, validate.CIDR(n.net.IPNet))
+		errs.Check(n.field, validate.SameFamily(n.net.IP, n.v4))
+		if n.subnet.IP != nil {
+			errs.Check(n.field, validate.Within(n.net.IPNet, n.subnet.IPNet))
+		}
+		if n.serverIP == nil {
+			errs.Add(n.field, "server%v is required if %v is used", n.field[len(n.field)-1:], n.field)
+		}
+	}
+	if c.Pool6.IP != nil {
+		if ones, _ := c.Pool6.Mask.Size(); ones > 64 {
+			errs.Add("pool6", "prefixes longer than /64 are not supported")
+		}
+	}
+
+	for i, r := range c.ClientRoutes {
+		field := validate.Field("client-routes", strconv.Itoa(i))
+		errs.Check(field, r.validate())
+	}
+
+	for i, name := range c.AddrSchemes {
+		scheme, err := wirebox.ParseAddrScheme(name)
+		errs.Check(validate.Field("config-addr-schemes", strconv.Itoa(i)), err)
+		if scheme == wboxproto.AddrScheme_SALTED_SHA256 && c.AddrSalt == "" {
+			errs.Add("config-addr-salt", "is required for salted scheme")
+		}
 	}
 
-	if (c.Pool6.IP != nil || c.Subnet6.IP == nil) && c.Server6.IP == nil {
-		return errors.New("config: server6 is required if pool6 or subnet6 is used")
+	if c.AuthFile == "" && len(c.Clients) == 0 && c.PeersFile == "" && !c.PeerStore.Enabled() {
+		errs.Add("", "at least one of authorized-keys, clients, peers-file, peer-store is required")
+	}
+	if c.PeerStore.Enabled() {
+		errs.Check(validate.Field("peer-store", "backend"), c.PeerStore.validate())
+	}
+	if c.SolictWorkers < 0 {
+		errs.Add("solict-workers", "should be positive")
 	}
-	if (c.Pool4.IP != nil || c.Subnet4.IP == nil) && c.Server4.IP == nil {
-		return errors.New("config: server4 is required if pool4 or subnet4 is used")
+	if c.SolictQueue < 0 {
+		errs.Add("solict-queue", "should be positive")
 	}
-	if c.AuthFile == "" && len(c.Clients) == 0 {
-		return errors.New("config: at least one of authorized-keys, clients is required")
+	if c.PeersInterval.Duration < 0 {
+		errs.Add("peers-interval", "should be positive")
 	}
 
 	for pubKey, clCfg := range c.Clients {
+		field := validate.Field("clients", pubKey)
+		errs.Check(field, validate.Key(pubKey))
 		if len(clCfg.Addrs) == 0 && (c.Pool6.IP == nil && c.Pool4.IP == nil) {
-			return errors.New("config: missing addresses for " + pubKey)
+			errs.Add(validate.Field(field, "addrs"), "missing addresses and no pool4 or pool6 to allocate them from")
 		}
 		if clCfg.TunPort == 0 && c.PortLow == 0 {
-			return errors.New("config: missing tunnel port (or shared port range) for " + pubKey)
+			errs.Add(validate.Field(field, "tun-port"), "missing tunnel port (or shared port range)")
 		}
-		if len(clCfg.If) > 15 {
-			return errors.New("config: too long interface name for " + pubKey)
+		if clCfg.TunPort != 0 {
+			errs.Check(validate.Field(field, "tun-port"), validate.Port(clCfg.TunPort))
+		}
+		if clCfg.If != "" {
+			errs.Check(validate.Field(field, "if"), validate.IfName(clCfg.If, 15))
+		}
+		for i, r := range clCfg.Routes {
+			errs.Check(validate.Field(field, "client_routes", strconv.Itoa(i)), r.validate())
+		}
+		for i, n := range clCfg.Subnets {
+			errs.Check(validate.Field(field, "subnets", strconv.Itoa(i)), validate.CIDR(n.IPNet))
+		}
+		if _, ok := c.Groups[clCfg.Group]; clCfg.Group != "" && !ok {
+			errs.Add(validate.Field(field, "group"), "unknown group %v", clCfg.Group)
+		}
+		_, err := ParseSchedule(clCfg.Schedule)
+		errs.Check(validate.Field(field, "schedule"), err)
+		errs.Check(validate.Field(field, "quota"), clCfg.Quota.validate(c.PtMP))
+		if clCfg.Endpoint != "" {
+			errs.Check(validate.Field(field, "endpoint"), validateEndpoint(clCfg.Endpoint))
+		} else if clCfg.Keepalive.Duration != 0 {
+			errs.Add(validate.Field(field, "keepalive"), "is used only with endpoint")
+		}
+		if clCfg.Keepalive.Duration < 0 || clCfg.Keepalive.Duration > math.MaxUint16*time.Second {
+			errs.Add(validate.Field(field, "keepalive"), "should be between 0 and %v", math.MaxUint16*time.Second)
 		}
 	}
 
-	return nil
+	if !validTopology(c.Topology) {
+		errs.Add("topology", "should be either hub or mesh")
+	}
+	for name, g := range c.Groups {
+		if !validTopology(g.Topology) {
+			errs.Add(validate.Field("groups", name, "topology"), "should be either hub or mesh")
+		}
+		if g.Isolated && g.Topology == TopologyMesh {
+			errs.Add(validate.Field("groups", name, "topology"), "isolated clients cannot use mesh topology")
+		}
+		_, err := ParseSchedule(g.Schedule)
+		errs.Check(validate.Field("groups", name, "schedule"), err)
+		errs.Check(validate.Field("groups", name, "quota"), g.Quota.validate(c.PtMP))
+		if len(g.Motd) > maxMotd {
+			errs.Add(validate.Field("groups", name, "motd"), "should not be longer than %d bytes", maxMotd)
+		}
+		if g.Redirect.Enabled() {
+			errs.Check(validate.Field("groups", name, "redirect"), g.Redirect.validate(c.PrivateKey))
+		}
+	}
+	if _, err := c.location(); err != nil {
+		errs.Check("time-zone", err)
+	}
+	for i, r := range c.Policy {
+		_, err := r.compile()
+		errs.Check(validate.Field("policy", strconv.Itoa(i)), err)
+	}
+
+	if c.Bootstrap.Enabled() {
+		if c.Bootstrap.CertFile == "" || c.Bootstrap.KeyFile == "" {
+			errs.Add(validate.Field("bootstrap", "cert-file"), "cert-file and key-file are required")
+		}
+		if len(c.Bootstrap.Tokens) == 0 && len(c.Overlays) == 0 {
+			errs.Add(validate.Field("bootstrap", "tokens"), "is required")
+		}
+		for i, t := range c.Bootstrap.Tokens {
+			errs.Check(validate.Field("bootstrap", "tokens", strconv.Itoa(i)), t.validate())
+		}
+		if c.AuthFile == "" && !c.PeerStore.Enabled() && len(c.Bootstrap.Tokens) != 0 {
+			errs.Add(validate.Field("bootstrap", "listen"), "authorized-keys or peer-store is required to store enrolled keys")
+		}
+		if c.Bootstrap.ConfigEndpoint != "" {
+			host, _, err := net.SplitHostPort(c.Bootstrap.ConfigEndpoint)
+			if err == nil && net.ParseIP(host) == nil {
+				err = errors.New("malformed IP")
+			}
+			errs.Check(validate.Field("bootstrap", "config-endpoint"), err)
+		}
+	}
+
+	if c.AdminAPI.Enabled() {
+		if !c.AdminAPI.ACME.Enabled() && (c.AdminAPI.CertFile == "" || c.AdminAPI.KeyFile == "") {
+			errs.Add(validate.Field("admin-api", "cert-file"), "cert-file and key-file or acme.domains are required")
+		}
+		if c.AdminAPI.ACME.Enabled() && c.AdminAPI.CertFile != "" {
+			errs.Add(validate.Field("admin-api", "acme"), "cannot be used with cert-file")
+		}
+		if _, _, err := net.SplitHostPort(c.AdminAPI.Listen); err != nil {
+			errs.Check(validate.Field("admin-api", "listen"), err)
+		}
+		if c.AdminAPI.ClientCA == "" && len(c.AdminAPI.Users) == 0 && c.AdminAPI.DefaultRole == nil {
+			errs.Add(validate.Field("admin-api", "client-ca"), "client-ca or users are required, set default-role to allow unauthenticated clients")
+		}
+		names := make(map[string]bool, len(c.AdminAPI.Users))
+		tokens := make(map[string]bool, len(c.AdminAPI.Users))
+		for i, u := range c.AdminAPI.Users {
+			field := validate.Field("admin-api", "users", strconv.Itoa(i))
+			errs.Check(field, u.validate())
+			if names[u.Name] {
+				errs.Add(validate.Field(field, "name"), "duplicate user %v", u.Name)
+			}
+			names[u.Name] = true
+			if u.TokenSHA256 != "" && tokens[strings.ToLower(u.TokenSHA256)] {
+				errs.Add(validate.Field(field, "token-sha256"), "used by another user")
+			}
+			tokens[strings.ToLower(u.TokenSHA256)] = true
+		}
+	}
+
+	if c.BenchPort != 0 {
+		errs.Check("bench-port", validate.Port(c.BenchPort))
+	}
+	if len(c.Motd) > maxMotd {
+		errs.Add("motd", "should not be longer than %d bytes", maxMotd)
+	}
+	if c.Redirect.Enabled() {
+		errs.Check("redirect", c.Redirect.validate(c.PrivateKey))
+	}
+
+	for i, e := range c.TunEndpoints {
+		_, err := e.udpAddr()
+		errs.Check(validate.Field("advertised-endpoints", strconv.Itoa(i), "addr"), err)
+	}
+
+	if c.MinClientVersion != "" {
+		errs.Check("min-client-version", wirebox.ValidVersion(c.MinClientVersion))
+	}
+	for i, capability := range c.RequiredCapabilities {
+		if !wirebox.KnownCapability(capability) {
+			errs.Add(validate.Field("required-capabilities", strconv.Itoa(i)), "unknown capability %v", capability)
+		}
+	}
+
+	errs.Check("sysctl", c.Sysctl.Validate())
+	errs.Check("privileges", c.Privileges.Validate())
+	if c.Standby.Enable {
+		errs.Check("standby", c.Standby.validate())
+	}
+	if c.Privileges.Enabled() && c.Sysctl.Enabled() {
+		// Interfaces added later would need root to write to /proc/sys.
+		errs.Add("sysctl", "cannot be used with privileges, set the parameters at boot (e.g. in /etc/sysctl.d)")
+	}
+
+	if c.BGP.Enabled() {
+		errs.Check("bgp", c.BGP.Validate())
+		if c.BGP.RouterID == nil && c.Server4.IP == nil {
+			errs.Add(validate.Field("bgp", "router-id"), "is required without server4")
+		}
+	}
+
+	switch c.DNSPublish.Provider {
+	case "":
+	case "rfc2136", "cloudflare":
+		if c.DNSPublish.Zone == "" {
+			errs.Add(validate.Field("dns-publish", "zone"), "is required")
+		}
+	default:
+		errs.Add(validate.Field("dns-publish", "provider"), "should be either rfc2136 or cloudflare")
+	}
+
+	return errs.Err()
+}
+
+// peersInterval returns how often the peers file is checked for changes.
+func (c SrvConfig) peersInterval() time.Duration {
+	if c.PeersInterval.Duration == 0 {
+		return 10 * time.Second
+	}
+	return c.PeersInterval.Duration
+}
+
+func (c SrvConfig) addrSchemes() []wboxproto.AddrScheme {
+	if len(c.AddrSchemes) == 0 {
+		return []wboxproto.AddrScheme{wboxproto.AddrScheme_TRUNCATED}
+	}
+	res := make([]wboxproto.AddrScheme, 0, len(c.AddrSchemes))
+	for _, name := range c.AddrSchemes {
+		scheme, _ := wirebox.ParseAddrScheme(name)
+		res = append(res, scheme)
+	}
+	return res
+}
+
+func (c SrvConfig) acceptsScheme(scheme wboxproto.AddrScheme) bool {
+	for _, s := range c.addrSchemes() {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
 }
 
 type ClientOverrides struct {
-	TunPort      int    `toml:"tun-port"`
-	TunEndpoint4 IPAddr `toml:"tun-endpoint4"`
-	TunEndpoint6 IPAddr `toml:"tun-endpoint6"`
+	TunPort      int    `toml:"tun-port" yaml:"tun-port"`
+	TunEndpoint4 IPAddr `toml:"tun-endpoint4" yaml:"tun-endpoint4"`
+	TunEndpoint6 IPAddr `toml:"tun-endpoint6" yaml:"tun-endpoint6"`
+
+	If string `toml:"if" yaml:"if"`
+
+	// Name to publish in DNS, relative to dns-publish.zone unless it ends
+	// with a dot.
+	Hostname string `toml:"hostname" yaml:"hostname"`
+
+	Addrs  []IPAddr `toml:"addrs" yaml:"addrs"`
+	Routes []Route  `toml:"client_routes" yaml:"client-routes"`
+
+	// Group the client belongs to, see SrvConfig.Groups.
+	Group string `toml:"group" yaml:"group"`
+
+	// Networks the client may route for (site-to-site). Networks reported
+	// by the client are accepted if they are within one of these.
+	Subnets []IPNet `toml:"subnets" yaml:"subnets"`
+
+	// Time windows the client access is permitted in, see ParseSchedule.
+	// Overrides the schedule of the group.
+	Schedule []string `toml:"schedule" yaml:"schedule"`
+
+	// Transfer quota of the client, overrides the quota of the group.
+	Quota QuotaConfig `toml:"quota" yaml:"quota"`
+
+	// Address (host:port) the client tunnel listens on. The server sets it
+	// as the peer endpoint and initiates the handshake itself instead of
+	// waiting for the client to dial in, e.g. for site routers with fixed
+	// addresses.
+	Endpoint string `toml:"endpoint" yaml:"endpoint"`
+	// Persistent keepalive interval for the client with the endpoint, 25s
+	// by default.
+	Keepalive Duration `toml:"keepalive" yaml:"keepalive"`
+}
+
+type GroupConfig struct {
+	// Overrides the server topology for clients of the group.
+	Topology string `toml:"topology"`
+	// Time windows access of clients of the group is permitted in.
+	Schedule []string `toml:"schedule"`
+	// Transfer quota of each client of the group.
+	Quota QuotaConfig `toml:"quota"`
+	// Overrides motd for clients of the group.
+	Motd string `toml:"motd"`
+	// Refer clients of the group to another server, e.g. the regional one.
+	Redirect RedirectConfig `toml:"redirect"`
+	// Keep clients of the group from reaching other clients (including each
+	// other) through the server, e.g. for guest devices. Routes to other
+	// clients and mesh peers are not sent and forwarded traffic between
+	// them is dropped using nftables.
+	Isolated bool `toml:"isolated"`
+	// Serve clients of the group by the overlay with this name, they are
+	// redirected to its configuration endpoint.
+	Overlay string `toml:"overlay"`
+}
+
+const (
+	QuotaWarn       = "warn"
+	QuotaThrottle   = "throttle"
+	QuotaDisconnect = "disconnect"
+)
+
+type QuotaConfig struct {
+	// Bytes the client may send and receive in total per period, no quota
+	// if zero.
+	Limit ByteSize `toml:"limit" yaml:"limit"`
+	// What to do once the limit is reached: warn (default), throttle or
+	// disconnect.
+	Action string `toml:"action" yaml:"action"`
+	// Rate traffic to the client is limited to by the throttle action, in
+	// tc(8) format, e.g. "1mbit".
+	Rate string `toml:"rate" yaml:"rate"`
+	// Start a new period daily, weekly (on Monday) or monthly. The usage is
+	// never reset if empty.
+	Reset string `toml:"reset" yaml:"reset"`
+}
 
-	If string `toml:"if"`
+func (q QuotaConfig) validate(ptmp bool) error {
+	switch q.Action {
+	case "", QuotaWarn, QuotaDisconnect:
+	case QuotaThrottle:
+		if q.Rate == "" {
+			return errors.New("rate is required for the throttle action")
+		}
+		if ptmp {
+			return errors.New("throttle action requires per-client interfaces (ptmp = false)")
+		}
+	default:
+		return errors.New("action should be one of warn, throttle, disconnect")
+	}
+	switch q.Reset {
+	case "", "daily", "weekly", "monthly":
+	default:
+		return errors.New("reset should be one of daily, weekly, monthly")
+	}
+	return nil
+}
 
-	Addrs  []IPAddr `toml:"addrs"`
-	Routes []Route  `toml:"client_routes"`
+const (
+	TopologyHub  = "hub"
+	TopologyMesh = "mesh"
+)
+
+func validTopology(t string) bool {
+	return t == "" || t == TopologyHub || t == TopologyMesh
+}
+
+// redirect returns the server clients of group are referred to.
+func (c SrvConfig) redirect(group string) (RedirectConfig, bool) {
+	if g, ok := c.Groups[group]; ok && g.Redirect.Enabled() {
+		return g.Redirect, true
+	}
+	return c.Redirect, c.Redirect.Enabled()
+}
+
+// motd returns the message sent to clients of group.
+func (c SrvConfig) motd(group string) string {
+	if g, ok := c.Groups[group]; ok && g.Motd != "" {
+		return g.Motd
+	}
+	return c.Motd
+}
+
+// isolated reports whether clients of group are isolated from other
+// clients.
+func (c SrvConfig) isolated(group string) bool {
+	return c.Groups[group].Isolated
+}
+
+// topology returns the topology used for clients of group. Isolated groups
+// always use the hub topology.
+func (c SrvConfig) topology(group string) string {
+	g, ok := c.Groups[group]
+	if ok && g.Isolated {
+		return TopologyHub
+	}
+	if ok && g.Topology != "" {
+		return g.Topology
+	}
+	if c.Topology != "" {
+		return c.Topology
+	}
+	if c.Mesh {
+		return TopologyMesh
+	}
+	return TopologyHub
 }
 
 type Route struct {
-	Src  *IPNet `toml:"src"`
-	Dest *IPNet `toml:"dest"`
+	Src  *IPNet `toml:"src" yaml:"src"`
+	Dest *IPNet `toml:"dest" yaml:"dest"`
+}
+
+func (r Route) validate() error {
+	if r.Dest == nil {
+		return errors.New("dest is required")
+	}
+	if err := validate.CIDR(r.Dest.IPNet); err != nil {
+		return fmt.Errorf("dest: %w", err)
+	}
+	if r.Src != nil {
+		if err := validate.SameFamily(r.Src.IP, r.Dest.IP.To4() != nil); err != nil {
+			return fmt.Errorf("src: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateEndpoint(endpoint string) error {
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("malformed port: %w", err)
+	}
+	return validate.Port(portNum)
+}
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type TunEndpoint struct {
+	// IP address, optionally with the port ("[IP]:port"). The tunnel port of
+	// the client is used if not specified.
+	Addr     string `toml:"addr"`
+	Region   string `toml:"region"`
+	Priority uint32 `toml:"priority"`
+}
+
+func (e TunEndpoint) udpAddr() (*net.UDPAddr, error) {
+	if ip := net.ParseIP(e.Addr); ip != nil {
+		return &net.UDPAddr{IP: ip}, nil
+	}
+	host, port, err := net.SplitHostPort(e.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("malformed IP")
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("malformed port")
+	}
+	return &net.UDPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+// RedirectConfig refers clients to another server, e.g. after the migration.
+// Clients follow the redirect only for the current run, so the server should
+// keep redirecting until their configuration files are updated.
+type RedirectConfig struct {
+	// Configuration tunnel endpoint ("IP:port") and the public key of the
+	// server.
+	ConfigEndpoint string          `toml:"config-endpoint"`
+	ServerKey      wirebox.PeerKey `toml:"server-key"`
+}
+
+func (r RedirectConfig) Enabled() bool {
+	return r.ConfigEndpoint != ""
+}
+
+func (r RedirectConfig) udpAddr() (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(r.ConfigEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("malformed IP")
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portNum == 0 {
+		return nil, errors.New("malformed port")
+	}
+	return &net.UDPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+func (r RedirectConfig) validate(self wirebox.PeerKey) error {
+	if _, err := r.udpAddr(); err != nil {
+		return fmt.Errorf("config-endpoint: %w", err)
+	}
+	if err := validate.Key(r.ServerKey.Encoded); err != nil {
+		return fmt.Errorf("server-key: %w", err)
+	}
+	if r.ServerKey.Bytes == self.PublicFromPrivate().Bytes {
+		return errors.New("server-key: clients would be redirected to this server")
+	}
+	return nil
+}
+
+// ByteSize is the amount of bytes with an optional unit suffix: KB, MB, GB,
+// TB (powers of 1000) or KiB, MiB, GiB, TiB (powers of 1024).
+type ByteSize uint64
+
+var byteUnits = []struct {
+	suffix string
+	mult   uint64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	mult := uint64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	val, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed size: %v", string(text))
+	}
+	if val > math.MaxUint64/mult {
+		return fmt.Errorf("size out of range: %v", string(text))
+	}
+	*b = ByteSize(val * mult)
+	return nil
+}
+
+func (b ByteSize) String() string {
+	switch {
+	case b < 1<<10:
+		return fmt.Sprintf("%d B", uint64(b))
+	case b < 1<<20:
+		return fmt.Sprintf("%.2f KiB", float64(b)/(1<<10))
+	case b < 1<<30:
+		return fmt.Sprintf("%.2f MiB", float64(b)/(1<<20))
+	case b < 1<<40:
+		return fmt.Sprintf("%.2f GiB", float64(b)/(1<<30))
+	default:
+		return fmt.Sprintf("%.2f TiB", float64(b)/(1<<40))
+	}
 }
 
 type IPAddr struct {
@@ -0,0 +1,72 @@
+package wboxserver
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/foxcpp/wirebox/cfgfile"
+)
+
+// ConfigSchema returns the JSON Schema of the server configuration file.
+func ConfigSchema() map[string]interface{} {
+	return cfgfile.Schema(SrvConfig{}, "wboxd configuration")
+}
+
+// CheckConfigFile validates the configuration file together with the peers
+// file, the peer store and overlays it refers to.
+func CheckConfigFile(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.store != nil {
+		cfg.store.Close()
+	}
+	return nil
+}
+
+func configMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd config schema")
+		fmt.Fprintln(fs.Output(), "       wboxd config validate [FILE...]")
+		fmt.Fprintln(fs.Output(), "Prints the JSON Schema of the configuration file or validates files")
+		fmt.Fprintln(fs.Output(), "(the -config file by default). Exits with status 2 if any file is")
+		fmt.Fprintln(fs.Output(), "invalid.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch cmd, args := fs.Arg(0), fs.Args(); {
+	case cmd == "schema" && len(args) == 1:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ConfigSchema()); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		return 0
+	case cmd == "validate":
+		paths := args[1:]
+		if len(paths) == 0 {
+			paths = []string{cfgPath}
+		}
+		code := 0
+		for _, path := range paths {
+			if err := CheckConfigFile(path); err != nil {
+				fmt.Println(err)
+				code = 2
+				continue
+			}
+			fmt.Printf("%s: OK\n", path)
+		}
+		return code
+	}
+	fs.Usage()
+	return 2
+}
@@ -0,0 +1,369 @@
+package wboxserver
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/debugsrv"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// The same key is listed several times or is used by several devices
+	// at once.
+	ConflictDuplicateKey = "duplicate-key"
+	// Static addresses of clients overlap, or the network the client may
+	// route for contains the address of another client.
+	ConflictAddrOverlap = "addr-overlap"
+	// The address allocated from the pool is reserved for another client.
+	ConflictLeaseCollision = "lease-collision"
+)
+
+const (
+	// flapWindow and flapThreshold define how many times the endpoint of
+	// the client should return to the previous one within the window to
+	// consider the key used by several devices. Roaming clients rarely go
+	// back and forth that often.
+	flapWindow    = 10 * time.Minute
+	flapThreshold = 3
+)
+
+// Conflict is the configuration or the behavior of clients that makes
+// traffic to some of them silently go elsewhere.
+type Conflict struct {
+	Kind  string   `json:"kind"`
+	Peers []string `json:"peers"`
+	// Conflicting address or network, empty for duplicate-key.
+	Addr        string `json:"addr,omitempty"`
+	Description string `json:"description"`
+	// Refused clients get the CONFLICT NACK and lose their allowed IPs.
+	Refused []string `json:"refused,omitempty"`
+
+	peers []wgtypes.Key
+}
+
+func (c Conflict) String() string {
+	return c.Kind + " " + c.Addr + " " + strings.Join(c.Peers, ",")
+}
+
+func newConflict(kind, addr, desc string, peers []wgtypes.Key, refused []wgtypes.Key) Conflict {
+	sort.Slice(peers, func(i, j int) bool {
+		return string(peers[i][:]) < string(peers[j][:])
+	})
+	c := Conflict{Kind: kind, Addr: addr, Description: desc, peers: peers}
+	for _, key := range peers {
+		c.Peers = append(c.Peers, key.String())
+	}
+	for _, key := range refused {
+		c.Refused = append(c.Refused, key.String())
+	}
+	sort.Strings(c.Refused)
+	return c
+}
+
+// findConflicts checks the client list and client configurations for
+// duplicate keys and overlapping addresses. Clients with leased addresses
+// reserved for other clients and clients with the same static addresses are
+// refused.
+func findConflicts(keys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg) ([]Conflict, map[wgtypes.Key]bool) {
+	var (
+		res     []Conflict
+		refused = make(map[wgtypes.Key]bool)
+	)
+
+	count := make(map[wgtypes.Key]int, len(keys))
+	for _, k := range keys {
+		count[k.Bytes]++
+		if count[k.Bytes] == 2 {
+			res = append(res, newConflict(ConflictDuplicateKey, "",
+				"key is listed more than once in the client list", []wgtypes.Key{k.Bytes}, nil))
+		}
+	}
+
+	owners := make(map[string][]wgtypes.Key)
+	for key, clCfg := range clientCfgs {
+		for _, a := range clCfg.Addrs {
+			ip := string(normalizeIP(a.IP))
+			owners[ip] = append(owners[ip], key)
+		}
+	}
+	for ip, keys := range owners {
+		if len(keys) < 2 {
+			continue
+		}
+		var leased, static []wgtypes.Key
+		for _, key := range keys {
+			if clientCfgs[key].Leased {
+				leased = append(leased, key)
+			} else {
+				static = append(static, key)
+			}
+		}
+		addr := net.IP(ip).String()
+		if len(static) != 0 && len(leased) != 0 {
+			for _, key := range leased {
+				refused[key] = true
+			}
+			res = append(res, newConflict(ConflictLeaseCollision, addr,
+				"address allocated from the pool is reserved for another client, set pool offset", keys, leased))
+			continue
+		}
+		for _, key := range keys {
+			refused[key] = true
+		}
+		res = append(res, newConflict(ConflictAddrOverlap, addr,
+			"address is assigned to several clients", keys, keys))
+	}
+
+	for key, clCfg := range clientCfgs {
+		for _, n := range clCfg.Subnets {
+			for ip, others := range owners {
+				if !n.Contains(net.IP(ip)) {
+					continue
+				}
+				for _, other := range others {
+					if other == key {
+						continue
+					}
+					res = append(res, newConflict(ConflictAddrOverlap, n.String(),
+						fmt.Sprintf("site network contains the address %v of another client", net.IP(ip)), []wgtypes.Key{key, other}, nil))
+				}
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].String() < res[j].String() })
+	return res, refused
+}
+
+// setConflicts replaces detected configuration conflicts, new ones are
+// logged and emitted as events. The lock should be held by the caller.
+func (s *Server) setConflicts(conflicts []Conflict, refused map[wgtypes.Key]bool) {
+	known := make(map[string]bool, len(s.conflicts))
+	for _, c := range s.conflicts {
+		known[c.String()] = true
+	}
+	for _, c := range conflicts {
+		if !known[c.String()] {
+			s.reportConflict(c)
+		}
+	}
+	s.conflicts = conflicts
+	s.conflictRefused = refused
+}
+
+func (s *Server) reportConflict(c Conflict) {
+	msg := fmt.Sprintf("WARNING: conflict: %v: %v (%v)", c.Kind, c.Description, strings.Join(c.Peers, ", "))
+	if c.Addr != "" {
+		msg += " at " + c.Addr
+	}
+	if len(c.Refused) != 0 {
+		msg += ", refused: " + strings.Join(c.Refused, ", ")
+	}
+	log.Println(msg)
+	s.Events.Emit(wirebox.PeerConflict{
+		Kind:        c.Kind,
+		Peers:       c.Peers,
+		Addr:        c.Addr,
+		Description: c.Description,
+	})
+}
+
+// restoreConflicting reinstalls allowed IPs of permitted clients sharing
+// addresses with the refused client key, since the kernel moves the address
+// to the peer configured last. The lock should be held by the caller.
+func (s *Server) restoreConflicting(key wgtypes.Key) {
+	for _, c := range s.conflicts {
+		involved := false
+		for _, p := range c.peers {
+			involved = involved || p == key
+		}
+		if !involved {
+			continue
+		}
+		for _, p := range c.peers {
+			clCfg, ok := s.ClientCfgs[p]
+			if p == key || !ok || s.blocked[p] {
+				continue
+			}
+			if err := s.peerAccess(p, clCfg, true); err != nil {
+				log.Printf("error: conflict: %v: %v", p, err)
+			}
+		}
+	}
+}
+
+type endpointHistory struct {
+	last, prev string
+	// Times the endpoint returned to the previous one.
+	flaps []time.Time
+}
+
+func flapConflict(key wgtypes.Key, h *endpointHistory) Conflict {
+	return newConflict(ConflictDuplicateKey, "",
+		fmt.Sprintf("endpoint flaps between %v and %v, key is likely used by several devices", h.prev, h.last),
+		[]wgtypes.Key{key}, nil)
+}
+
+// updateEndpoints records WireGuard endpoints of clients and reports keys
+// whose endpoint keeps flapping between addresses, which happens when
+// several devices use the same key. The lock should be held by the caller.
+func (s *Server) updateEndpoints() {
+	now := time.Now()
+	links := make(map[string]bool)
+	for _, clCfg := range s.ClientCfgs {
+		links[clCfg.ServerIf] = true
+	}
+	if s.endpoints == nil {
+		s.endpoints = make(map[wgtypes.Key]*endpointHistory)
+	}
+
+	seen := make(map[wgtypes.Key]bool, len(s.ClientCfgs))
+	for link := range links {
+		l, err := s.m.GetLink(link)
+		if err != nil {
+			continue
+		}
+		dev, err := l.WGConfig()
+		if err != nil {
+			debugLog.Println("conflict:", link, err)
+			continue
+		}
+		for _, p := range dev.Peers {
+			if _, ok := s.ClientCfgs[p.PublicKey]; !ok || p.Endpoint == nil {
+				continue
+			}
+			seen[p.PublicKey] = true
+			h := s.endpoints[p.PublicKey]
+			if h == nil {
+				h = &endpointHistory{}
+				s.endpoints[p.PublicKey] = h
+			}
+			endpoint := p.Endpoint.String()
+			if endpoint != h.last {
+				if endpoint == h.prev {
+					h.flaps = append(h.flaps, now)
+				}
+				h.prev, h.last = h.last, endpoint
+			}
+			for len(h.flaps) != 0 && now.Sub(h.flaps[0]) > flapWindow {
+				h.flaps = h.flaps[1:]
+			}
+
+			flapping := len(h.flaps) >= flapThreshold
+			if flapping && !s.flapping[p.PublicKey] {
+				s.reportConflict(flapConflict(p.PublicKey, h))
+			}
+			if flapping {
+				if s.flapping == nil {
+					s.flapping = make(map[wgtypes.Key]bool)
+				}
+				s.flapping[p.PublicKey] = true
+			} else {
+				delete(s.flapping, p.PublicKey)
+			}
+		}
+	}
+	for key := range s.endpoints {
+		if !seen[key] {
+			delete(s.endpoints, key)
+			delete(s.flapping, key)
+		}
+	}
+}
+
+// Conflicts returns detected configuration conflicts and clients currently
+// suspected to share the key.
+func (s *Server) Conflicts() []Conflict {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := make([]Conflict, 0, len(s.conflicts)+len(s.flapping))
+	res = append(res, s.conflicts...)
+	for key := range s.flapping {
+		res = append(res, flapConflict(key, s.endpoints[key]))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].String() < res[j].String() })
+	return res
+}
+
+func conflictMetrics(conflicts []Conflict) []debugsrv.Metric {
+	counts := map[string]int{
+		ConflictDuplicateKey:   0,
+		ConflictAddrOverlap:    0,
+		ConflictLeaseCollision: 0,
+	}
+	for _, c := range conflicts {
+		counts[c.Kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	res := make([]debugsrv.Metric, 0, len(kinds))
+	for _, kind := range kinds {
+		res = append(res, debugsrv.Metric{
+			Name:   "wirebox_peer_conflicts",
+			Help:   "Number of detected conflicts between clients.",
+			Labels: map[string]string{"kind": kind},
+			Value:  float64(counts[kind]),
+		})
+	}
+	return res
+}
+
+func conflictsMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd conflicts")
+		fmt.Fprintln(fs.Output(), "Lists duplicate keys and overlapping addresses detected by the running")
+		fmt.Fprintln(fs.Output(), "server. Exits with status 1 if there are any.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+
+	var conflicts []Conflict
+	if err := ctlsock.Call(cfg.controlSocket(), "conflicts", nil, &conflicts); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts.")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tADDRESS\tPEERS\tREFUSED\tDESCRIPTION")
+	for _, c := range conflicts {
+		addr := c.Addr
+		if addr == "" {
+			addr = "-"
+		}
+		refused := strings.Join(c.Refused, ",")
+		if refused == "" {
+			refused = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Kind, addr, strings.Join(c.Peers, ","), refused, c.Description)
+	}
+	tw.Flush()
+	return 1
+}
@@ -0,0 +1,131 @@
+package wboxserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/foxcpp/wirebox/cli"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/top"
+	"github.com/foxcpp/wirebox/wgfmt"
+)
+
+// DefaultControlSocket is used if control-socket is not set.
+const DefaultControlSocket = "/run/wirebox/wboxd.sock"
+
+// eventLogSize is the number of recent events shown by the top command.
+const eventLogSize = 50
+
+func (cfg SrvConfig) controlSocket() string {
+	if cfg.ControlSocket == "" {
+		return DefaultControlSocket
+	}
+	return cfg.ControlSocket
+}
+
+type statusArgs struct {
+	Format string `json:"format"`
+	// Include private and preshared keys in wg-dump output. Requires
+	// RoleAdmin over the admin API.
+	ShowKeys bool `json:"show-keys"`
+}
+
+// writeStatus writes the status of named links in the specified wgfmt
+// format.
+func writeStatus(w io.Writer, m linkmgr.Manager, names []string, format string, showKeys bool) error {
+	for i, name := range names {
+		l, err := m.GetLink(name)
+		if err != nil {
+			return err
+		}
+		dev, err := l.WGConfig()
+		if err != nil {
+			return err
+		}
+		if i != 0 && format == "wg-show" {
+			io.WriteString(w, "\n")
+		}
+		if err := wgfmt.WriteStatus(w, format, l.Name(), dev, showKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) linkNames() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := []string{s.MasterLink.Name()}
+	for _, l := range s.Tunnels {
+		if l.Name() != names[0] {
+			names = append(names, l.Name())
+		}
+	}
+	return names
+}
+
+func (s *Server) controlHandlers() map[string]ctlsock.Handler {
+	return map[string]ctlsock.Handler{
+		"state": func(json.RawMessage) (interface{}, error) {
+			return s.DebugState(), nil
+		},
+		"peers": func(json.RawMessage) (interface{}, error) {
+			peers := s.DebugState().(debugState).Peers
+			sort.Slice(peers, func(i, j int) bool {
+				if peers[i].ServerIf != peers[j].ServerIf {
+					return peers[i].ServerIf < peers[j].ServerIf
+				}
+				return peers[i].PublicKey < peers[j].PublicKey
+			})
+			return peers, nil
+		},
+		"conflicts": func(json.RawMessage) (interface{}, error) {
+			return s.Conflicts(), nil
+		},
+		"promote": func(json.RawMessage) (interface{}, error) {
+			return nil, s.setStandby(false, "manual")
+		},
+		"demote": func(json.RawMessage) (interface{}, error) {
+			return nil, s.setStandby(true, "manual")
+		},
+		"top": func(json.RawMessage) (interface{}, error) {
+			return top.Collect(s.m, s.linkNames(), s.eventLog), nil
+		},
+		"status": func(raw json.RawMessage) (interface{}, error) {
+			args := statusArgs{Format: "wg-show"}
+			if len(raw) != 0 {
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return nil, err
+				}
+			}
+			var buf bytes.Buffer
+			if err := writeStatus(&buf, s.m, s.linkNames(), args.Format, args.ShowKeys); err != nil {
+				return nil, err
+			}
+			return buf.String(), nil
+		},
+	}
+}
+
+func logsMain(cfgPath string, args []string) int {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	return cli.Logs(cfg.controlSocket(), args)
+}
+
+func topMain(cfgPath string, args []string) int {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	return top.Run(cfg.controlSocket(), "wboxd", args)
+}
@@ -0,0 +1,131 @@
+package wboxserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type solictInfo struct {
+	Time   time.Time `json:"time"`
+	Sender string    `json:"sender"`
+	Result string    `json:"result"`
+}
+
+// solictLog keeps the last solictation received from each peer.
+type solictLog struct {
+	lock sync.Mutex
+	last map[wgtypes.Key]solictInfo
+}
+
+func (sl *solictLog) record(key wgtypes.Key, sender net.IP, result string) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if sl.last == nil {
+		sl.last = make(map[wgtypes.Key]solictInfo)
+	}
+	sl.last[key] = solictInfo{
+		Time:   time.Now(),
+		Sender: sender.String(),
+		Result: result,
+	}
+}
+
+func (sl *solictLog) get(key wgtypes.Key) (solictInfo, bool) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	info, ok := sl.last[key]
+	return info, ok
+}
+
+func solictResult(reply wboxproto.Message, err error) string {
+	switch reply := reply.(type) {
+	case *wboxproto.Cfg:
+		return "cfg"
+	case *wboxproto.Nack:
+		return fmt.Sprintf("nack: %v", reply.GetCode())
+	}
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return "no reply"
+}
+
+type debugPeer struct {
+	PublicKey    string      `json:"public-key"`
+	ServerIf     string      `json:"server-if"`
+	TunEndpoint4 net.IP      `json:"tun-endpoint4,omitempty"`
+	TunEndpoint6 net.IP      `json:"tun-endpoint6,omitempty"`
+	TunPort      int         `json:"tun-port,omitempty"`
+	Addrs        []string    `json:"addrs"`
+	Routes       []string    `json:"routes"`
+	LastSolict   *solictInfo `json:"last-solict,omitempty"`
+	Blocked      bool        `json:"blocked,omitempty"`
+	Quota        *debugQuota `json:"quota,omitempty"`
+}
+
+type debugQuota struct {
+	Used     uint64 `json:"used"`
+	Limit    uint64 `json:"limit"`
+	Exceeded bool   `json:"exceeded,omitempty"`
+}
+
+type debugState struct {
+	MasterLink string      `json:"master-link"`
+	Tunnels    []string    `json:"tunnels"`
+	PtMP       bool        `json:"ptmp"`
+	Standby    bool        `json:"standby,omitempty"`
+	Peers      []debugPeer `json:"peers"`
+}
+
+// DebugState returns the snapshot of the server state for the debug
+// server.
+func (s *Server) DebugState() interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	state := debugState{
+		MasterLink: s.MasterLink.Name(),
+		Tunnels:    make([]string, 0, len(s.Tunnels)),
+		PtMP:       s.Cfg.PtMP,
+		Standby:    s.Cfg.standby,
+		Peers:      make([]debugPeer, 0, len(s.ClientCfgs)),
+	}
+	for _, l := range s.Tunnels {
+		state.Tunnels = append(state.Tunnels, l.Name())
+	}
+	for key, cfg := range s.ClientCfgs {
+		peer := debugPeer{
+			PublicKey:    key.String(),
+			ServerIf:     cfg.ServerIf,
+			TunEndpoint4: cfg.TunEndpoint4,
+			TunEndpoint6: cfg.TunEndpoint6,
+			TunPort:      cfg.TunPort,
+			Addrs:        make([]string, 0, len(cfg.Addrs)),
+			Routes:       make([]string, 0, len(cfg.Routes)),
+		}
+		for _, a := range cfg.Addrs {
+			peer.Addrs = append(peer.Addrs, a.String())
+		}
+		for _, r := range cfg.Routes {
+			route := r.Dest.String()
+			if r.Src != nil {
+				route += " from " + r.Src.String()
+			}
+			peer.Routes = append(peer.Routes, route)
+		}
+		if info, ok := s.solicts.get(key); ok {
+			peer.LastSolict = &info
+		}
+		peer.Blocked = s.blocked[key]
+		if u := s.quotas[key]; u != nil {
+			peer.Quota = &debugQuota{Used: u.used, Limit: uint64(cfg.Quota.Limit), Exceeded: u.exceeded}
+		}
+		state.Peers = append(state.Peers, peer)
+	}
+	return state
+}
@@ -0,0 +1,54 @@
+package wboxserver
+
+import (
+	"time"
+
+	"github.com/foxcpp/wirebox/dnspub"
+)
+
+// dnsResync is how often records are re-published to retry failed updates.
+const dnsResync = 5 * time.Minute
+
+func (s *Server) dnsRecords() []dnspub.Record {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := make([]dnspub.Record, 0, len(s.ClientCfgs))
+	for _, clCfg := range s.ClientCfgs {
+		if clCfg.Hostname == "" {
+			continue
+		}
+		r := dnspub.Record{Name: s.Cfg.DNSPublish.FQDN(clCfg.Hostname)}
+		for _, a := range clCfg.Addrs {
+			r.Addrs = append(r.Addrs, a.IP)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// triggerDNS schedules the update of published DNS records.
+func (s *Server) triggerDNS() {
+	if s.dnsTrigger == nil {
+		return
+	}
+	select {
+	case s.dnsTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// runDNSPublish keeps DNS records of clients in sync until stop is closed.
+func (s *Server) runDNSPublish(pub *dnspub.Publisher, stop <-chan struct{}) {
+	t := time.NewTicker(dnsResync)
+	defer t.Stop()
+	for {
+		pub.Sync(s.dnsRecords())
+		select {
+		case <-stop:
+			return
+		case <-s.dnsTrigger:
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package wboxserver
+
+import (
+	"net"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/doctor"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Doctor checks the server host and configuration for problems that cause
+// clients to fail configuration or get their traffic blackholed.
+func Doctor(cfgPath string) doctor.Report {
+	var r doctor.Report
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		r.Fail("config", "fix the configuration file", "%v", err)
+		return r
+	}
+	r.OK("config", "%v is valid", cfgPath)
+
+	doctor.CheckWireGuard(&r)
+	doctor.CheckPrivileges(&r)
+	doctor.CheckClock(&r)
+	doctor.CheckForwarding(&r, cfg.Server4.IP != nil, cfg.Server6.IP != nil)
+
+	keys, err := clientKeys(cfg)
+	if err != nil {
+		r.Fail("clients", "add client keys to the configuration or authorized-keys file", "%v", err)
+		return r
+	}
+	clientCfgs, err := buildClientConfigs(cfg, keys)
+	if err != nil {
+		r.Fail("clients", "", "%v", err)
+		return r
+	}
+	checkClientCfgs(&r, cfg, keys, clientCfgs)
+
+	checkEndpoints(&r, cfg)
+
+	m, err := linkmgr.NewManager()
+	if err != nil {
+		r.Fail("links", "", "cannot access network interfaces: %v", err)
+		return r
+	}
+	defer m.Close()
+	checkPeers(&r, m, cfg, keys, clientCfgs)
+
+	return r
+}
+
+func checkClientCfgs(r *doctor.Report, cfg SrvConfig, keys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg) {
+	if missing := len(keys) - len(clientCfgs); missing != 0 {
+		r.Fail("clients", "extend the port range or address pools, see the log above for details",
+			"%v of %v clients have no configuration", missing, len(keys))
+	} else {
+		r.OK("clients", "configuration is available for all %v clients", len(keys))
+	}
+
+	for _, pool := range []IPNet{cfg.Pool4, cfg.Pool6} {
+		if pool.IP == nil {
+			continue
+		}
+		for _, srv := range []net.IP{cfg.Server4.IP, cfg.Server6.IP} {
+			if srv != nil && pool.Contains(srv) {
+				r.Warn("pools", "exclude the server address using pool offset",
+					"server address %v is within the pool %v", srv, pool)
+			}
+		}
+	}
+
+	owners := make(map[string]wgtypes.Key)
+	conflicts := false
+	for key, clCfg := range clientCfgs {
+		for _, a := range clCfg.Addrs {
+			if a.IP.Equal(cfg.Server4.IP) || a.IP.Equal(cfg.Server6.IP) {
+				conflicts = true
+				r.Fail("addresses", "change the client address or the pool offset",
+					"%v is assigned to %v and is the server address", a.IP, key)
+			}
+
+			owner, ok := owners[a.IP.String()]
+			if ok && owner != key {
+				conflicts = true
+				r.Fail("addresses", "change the static address or the pool offset",
+					"%v is assigned to both %v and %v", a.IP, owner, key)
+				continue
+			}
+			owners[a.IP.String()] = key
+		}
+	}
+	if !conflicts {
+		r.OK("addresses", "no conflicting address assignments")
+	}
+}
+
+func checkEndpoints(r *doctor.Report, cfg SrvConfig) {
+	if cfg.PortLow == 0 {
+		return
+	}
+	for _, endp := range []net.IP{cfg.TunEndpoint4.IP, cfg.TunEndpoint6.IP} {
+		if endp == nil {
+			continue
+		}
+		doctor.CheckUDP(r, "endpoint", &net.UDPAddr{IP: endp, Port: cfg.PortLow})
+	}
+}
+
+func checkPeers(r *doctor.Report, m linkmgr.Manager, cfg SrvConfig, keys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg) {
+	expected := make(map[string][]wgtypes.Key)
+	for _, key := range keys {
+		expected[cfg.If] = append(expected[cfg.If], key.Bytes)
+	}
+	if !cfg.PtMP {
+		for key, clCfg := range clientCfgs {
+			expected[clCfg.ServerIf] = append(expected[clCfg.ServerIf], key)
+		}
+	}
+
+	for ifName, keys := range expected {
+		if _, err := net.InterfaceByName(ifName); err != nil {
+			r.Warn("peers", "start wboxd to create it", "%v does not exist", ifName)
+			continue
+		}
+		l, err := m.GetLink(ifName)
+		if err != nil {
+			r.Warn("peers", "", "cannot check %v: %v", ifName, err)
+			continue
+		}
+		dev, err := l.WGConfig()
+		if err != nil {
+			r.Fail("peers", "remove the interface or change 'if' in the configuration",
+				"%v is not a WireGuard interface", ifName)
+			continue
+		}
+		checkDevice(r, ifName, dev, keys)
+	}
+}
+
+func checkDevice(r *doctor.Report, ifName string, dev *wgtypes.Device, keys []wgtypes.Key) {
+	want := make(map[wgtypes.Key]bool, len(keys))
+	for _, k := range keys {
+		want[k] = true
+	}
+	have := make(map[wgtypes.Key]bool, len(dev.Peers))
+	for _, p := range dev.Peers {
+		have[p.PublicKey] = true
+	}
+
+	ok := true
+	for k := range want {
+		if !have[k] {
+			ok = false
+			r.Fail("peers", "restart wboxd to resynchronize peers", "%v is missing peer %v", ifName, k)
+		}
+	}
+	for k := range have {
+		if !want[k] {
+			ok = false
+			r.Warn("peers", "remove the peer or add it to the configuration", "%v has unknown peer %v", ifName, k)
+		}
+	}
+	if ok {
+		r.OK("peers", "%v peers match the configuration", ifName)
+	}
+}
@@ -0,0 +1,140 @@
+package wboxserver
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/wgfmt"
+)
+
+// linkSpecs returns the desired configuration of all interfaces managed by
+// the server.
+func linkSpecs(cfg SrvConfig) ([]linkSpec, error) {
+	keys, err := clientKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	clientCfgs, err := buildClientConfigs(cfg, keys)
+	if err != nil {
+		return nil, err
+	}
+	cfgAddrs := configAddrs(cfg, keys)
+
+	if cfg.PtMP {
+		return []linkSpec{multipointLinkSpec(cfg, keys, clientCfgs, cfgAddrs)}, nil
+	}
+
+	specs := []linkSpec{confLinkSpec(cfg, keys, cfgAddrs)}
+	for _, pubKey := range keys {
+		clCfg, ok := clientCfgs[pubKey.Bytes]
+		if !ok {
+			continue
+		}
+		specs = append(specs, peerTunSpec(cfg, pubKey, clCfg, cfgAddrs[pubKey.Bytes]))
+	}
+	return specs, nil
+}
+
+func quickAddrs(addrs []linkmgr.Address) []net.IPNet {
+	seen := make(map[string]bool)
+	res := make([]net.IPNet, 0, len(addrs))
+	for _, a := range addrs {
+		if seen[a.IPNet.String()] {
+			continue
+		}
+		seen[a.IPNet.String()] = true
+		res = append(res, a.IPNet)
+	}
+	return res
+}
+
+// Export writes configuration of all server interfaces in the format
+// understood by stock WireGuard tools. format is either "wg-conf" (wg-quick
+// configuration including addresses) or "wg-showconf" (wg setconf input).
+//
+// If m is not nil, configuration is read from the running interfaces instead
+// of the configuration file.
+func Export(w io.Writer, cfg SrvConfig, format string, m linkmgr.Manager) error {
+	specs, err := linkSpecs(cfg)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	for i, spec := range specs {
+		if m != nil {
+			l, err := m.GetLink(spec.Name)
+			if err != nil {
+				return fmt.Errorf("export: %w", err)
+			}
+			dev, err := l.WGConfig()
+			if err != nil {
+				return fmt.Errorf("export: %v: %w", spec.Name, err)
+			}
+			spec.WG = wgfmt.DeviceConfig(dev)
+			spec.Addrs, err = l.Addrs()
+			if err != nil {
+				return fmt.Errorf("export: %v: %w", spec.Name, err)
+			}
+		}
+
+		if len(specs) > 1 {
+			if i != 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "# Interface %v\n", spec.Name)
+		}
+		switch format {
+		case "wg-conf":
+			err = wgfmt.WriteQuickConf(w, spec.WG, quickAddrs(spec.Addrs))
+		case "wg-showconf":
+			err = wgfmt.WriteShowConf(w, spec.WG)
+		default:
+			return fmt.Errorf("export: unknown format: %v", format)
+		}
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+	}
+	return nil
+}
+
+func exportMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "wg-conf", "output format: wg-conf or wg-showconf")
+	live := fs.Bool("live", false, "read configuration from running interfaces")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd export [options]")
+		fmt.Fprintln(fs.Output(), "Output contains private keys, keep it secret.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+
+	var m linkmgr.Manager
+	if *live {
+		m, err = linkmgr.NewManager()
+		if err != nil {
+			log.Println("error: link mngr init:", err)
+			return 1
+		}
+		defer m.Close()
+	}
+
+	if err := Export(os.Stdout, cfg, *format, m); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,321 @@
+package wboxserver
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/wirebox/peerstore"
+	"github.com/foxcpp/wirebox/validate"
+	"gopkg.in/yaml.v2"
+)
+
+// importPeer is one record of the peer import file.
+type importPeer struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Group string `json:"group"`
+	// Addresses reserved for the client, allocated from the pools if empty.
+	Reservation []string `json:"reservation"`
+}
+
+// importSettings is the subset of ClientOverrides set by the import, kept
+// in the peer store.
+type importSettings struct {
+	Hostname string   `yaml:"hostname,omitempty"`
+	Group    string   `yaml:"group,omitempty"`
+	Addrs    []string `yaml:"addrs,omitempty"`
+}
+
+var importColumns = []string{"key", "name", "group", "reservation"}
+
+// readImportCSV reads peers from CSV with the header naming the columns.
+// Columns other than key are optional, reservation lists addresses
+// separated by spaces.
+func readImportCSV(r io.Reader) ([]importPeer, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, c := range importColumns {
+			known = known || c == name
+		}
+		if !known {
+			return nil, fmt.Errorf("header: unknown column %q, expected %v", name, strings.Join(importColumns, ","))
+		}
+		if _, ok := cols[name]; ok {
+			return nil, fmt.Errorf("header: duplicate column %q", name)
+		}
+		cols[name] = i
+	}
+	if _, ok := cols["key"]; !ok {
+		return nil, errors.New("header: key column is required")
+	}
+
+	var peers []importPeer
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return peers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		peers = append(peers, importPeer{
+			Key:         field("key"),
+			Name:        field("name"),
+			Group:       field("group"),
+			Reservation: strings.Fields(field("reservation")),
+		})
+	}
+}
+
+// readImportJSON reads peers from the JSON array of objects with the same
+// fields as the CSV columns.
+func readImportJSON(r io.Reader) ([]importPeer, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var peers []importPeer
+	if err := dec.Decode(&peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// checkImport validates the imported peers against each other and the
+// clients already configured. Entries are identified by their position in
+// the file.
+func checkImport(cfg SrvConfig, peers []importPeer) error {
+	var errs validate.Errors
+
+	seen := make(map[string]int, len(peers))
+	owners := make(map[string]string)
+	for key, cl := range cfg.Clients {
+		for _, a := range cl.Addrs {
+			owners[string(normalizeIP(a.IP))] = key
+		}
+	}
+	for i, p := range peers {
+		field := validate.Field("peers", strconv.Itoa(i+1))
+		if err := validate.Key(p.Key); err != nil {
+			errs.Check(validate.Field(field, "key"), err)
+			continue
+		}
+		if prev, ok := seen[p.Key]; ok {
+			errs.Add(validate.Field(field, "key"), "duplicate of entry %d", prev+1)
+			continue
+		}
+		seen[p.Key] = i
+
+		if strings.ContainsAny(p.Name, " \t,") {
+			errs.Add(validate.Field(field, "name"), "should not contain spaces or commas")
+		}
+		if _, ok := cfg.Groups[p.Group]; p.Group != "" && !ok {
+			errs.Add(validate.Field(field, "group"), "unknown group %v", p.Group)
+		}
+		if len(p.Reservation) == 0 && cfg.Pool4.IP == nil && cfg.Pool6.IP == nil {
+			errs.Add(validate.Field(field, "reservation"), "missing addresses and no pool4 or pool6 to allocate them from")
+		}
+		for _, addr := range p.Reservation {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				errs.Add(validate.Field(field, "reservation"), "malformed IP %v", addr)
+				continue
+			}
+			subnet := cfg.Subnet6.IPNet
+			if ip.To4() != nil {
+				subnet = cfg.Subnet4.IPNet
+			}
+			if subnet.IP != nil && !subnet.Contains(ip) {
+				errs.Add(validate.Field(field, "reservation"), "%v is outside of the subnet %v", addr, &subnet)
+			}
+			owner, ok := owners[string(normalizeIP(ip))]
+			if ok && owner != p.Key {
+				errs.Add(validate.Field(field, "reservation"), "%v is already assigned to %v", addr, owner)
+				continue
+			}
+			owners[string(normalizeIP(ip))] = p.Key
+		}
+	}
+	return errs.Err()
+}
+
+func (p importPeer) settings() ([]byte, error) {
+	blob, err := yaml.Marshal(importSettings{
+		Hostname: p.Name,
+		Group:    p.Group,
+		Addrs:    p.Reservation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Stored settings are parsed by the server the same way.
+	if _, err := parseStoreSettings(blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func peersImportMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("peers import", flag.ExitOnError)
+	format := fs.String("format", "", "input format, csv or json (by default, from the file extension)")
+	dryRun := fs.Bool("dry-run", false, "validate the file and show changes without making them")
+	replace := fs.Bool("replace", false, "replace settings of clients already in the peer store instead of skipping them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd peers import [options] FILE")
+		fmt.Fprintln(fs.Output(), "Adds clients from CSV or JSON to the peer store. CSV should start with")
+		fmt.Fprintln(fs.Output(), "the header naming the columns: key (required), name, group and")
+		fmt.Fprintln(fs.Output(), "reservation (addresses separated by spaces). JSON should be an array")
+		fmt.Fprintln(fs.Output(), "of objects with the same fields, reservation is an array. Nothing is")
+		fmt.Fprintln(fs.Output(), "imported if any entry is invalid. \"-\" reads stdin.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	if cfg.store == nil {
+		log.Println("error: peer-store is not configured")
+		return 2
+	}
+	defer cfg.store.Close()
+
+	in := os.Stdin
+	if path != "-" {
+		in, err = os.Open(path)
+		if err != nil {
+			log.Println("error:", err)
+			return 2
+		}
+		defer in.Close()
+	}
+	var peers []importPeer
+	switch *format {
+	case "csv":
+		peers, err = readImportCSV(in)
+	case "json":
+		peers, err = readImportJSON(in)
+	default:
+		log.Println("error: unknown format, use -format csv or -format json")
+		return 2
+	}
+	if err != nil {
+		log.Println("error:", path+":", err)
+		return 2
+	}
+	if err := checkImport(cfg, peers); err != nil {
+		log.Println("error:", path+":", err)
+		return 2
+	}
+
+	stored := make(map[string]bool)
+	err = cfg.store.View(func(tx peerstore.Tx) error {
+		list, err := tx.List()
+		for _, p := range list {
+			stored[p.Key] = true
+		}
+		return err
+	})
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tNAME\tGROUP\tRESERVATION\tACTION")
+	var (
+		puts    []peerstore.Peer
+		skipped int
+		now     = time.Now()
+	)
+	for _, p := range peers {
+		action := "add"
+		switch {
+		case stored[p.Key] && *replace:
+			action = "replace"
+		case stored[p.Key]:
+			action = "skip (in store)"
+			skipped++
+		}
+		if _, ok := cfg.specClients[p.Key]; ok {
+			// Spec entries take precedence over the store.
+			action += ", overridden by peers-file"
+		} else if _, ok := cfg.fileClients[p.Key]; ok {
+			action += ", overrides clients entry"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Key, dash(p.Name), dash(p.Group), dash(strings.Join(p.Reservation, " ")), action)
+		if stored[p.Key] && !*replace {
+			continue
+		}
+		settings, err := p.settings()
+		if err != nil {
+			log.Println("error:", p.Key+":", err)
+			return 1
+		}
+		puts = append(puts, peerstore.Peer{Key: p.Key, Settings: settings, Added: now})
+	}
+	tw.Flush()
+
+	if *dryRun {
+		fmt.Printf("Dry run, %d clients would be imported, %d skipped.\n", len(puts), skipped)
+		return 0
+	}
+	err = cfg.store.Update(func(tx peerstore.Tx) error {
+		for _, p := range puts {
+			if err := tx.Put(p); err != nil {
+				return fmt.Errorf("%v: %w", p.Key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	fmt.Printf("Imported %d clients, %d skipped.\n", len(puts), skipped)
+	return 0
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package wboxserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/wirebox/audit"
+)
+
+// isolationTable returns the name of the nftables table holding isolation
+// rules for the server.
+func isolationTable(cfg SrvConfig) string {
+	return "wirebox_isolation_" + strings.NewReplacer("-", "_", ".", "_").Replace(cfg.If)
+}
+
+// isolationSets returns addresses and networks of isolated clients and of all
+// clients, both sorted. The lock should be held by the caller.
+func (s *Server) isolationSets() (isolated, all []string) {
+	for _, clCfg := range s.ClientCfgs {
+		nets := make([]string, 0, len(clCfg.Addrs)+len(clCfg.Subnets))
+		for _, a := range clCfg.Addrs {
+			nets = append(nets, normalizeIP(a.IP).String())
+		}
+		for _, n := range clCfg.Subnets {
+			nets = append(nets, n.String())
+		}
+		all = append(all, nets...)
+		if s.Cfg.isolated(clCfg.Group) {
+			isolated = append(isolated, nets...)
+		}
+	}
+	sort.Strings(isolated)
+	sort.Strings(all)
+	return isolated, all
+}
+
+// isolationRuleset returns the nft script replacing the isolation table with
+// the one dropping forwarded traffic between isolated clients and other
+// clients in both directions.
+func isolationRuleset(table string, isolated, all []string) string {
+	var b strings.Builder
+	// Declaring the table first makes the deletion succeed if it does not
+	// exist yet, the script is applied atomically.
+	fmt.Fprintf(&b, "table inet %s {}\n", table)
+	fmt.Fprintf(&b, "delete table inet %s\n", table)
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	for _, family := range []string{"ip", "ip6"} {
+		var isolatedFam, allFam []string
+		for _, n := range isolated {
+			if isV4(n) == (family == "ip") {
+				isolatedFam = append(isolatedFam, n)
+			}
+		}
+		for _, n := range all {
+			if isV4(n) == (family == "ip") {
+				allFam = append(allFam, n)
+			}
+		}
+		typ := "ipv4_addr"
+		if family == "ip6" {
+			typ = "ipv6_addr"
+		}
+		writeSet(&b, "isolated_"+family, typ, isolatedFam)
+		writeSet(&b, "clients_"+family, typ, allFam)
+	}
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	for _, family := range []string{"ip", "ip6"} {
+		fmt.Fprintf(&b, "\t\t%s saddr @isolated_%s %s daddr @clients_%s drop\n", family, family, family, family)
+		fmt.Fprintf(&b, "\t\t%s saddr @clients_%s %s daddr @isolated_%s drop\n", family, family, family, family)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeSet(b *strings.Builder, name, typ string, elems []string) {
+	fmt.Fprintf(b, "\tset %s {\n", name)
+	fmt.Fprintf(b, "\t\ttype %s; flags interval; auto-merge;\n", typ)
+	if len(elems) != 0 {
+		fmt.Fprintf(b, "\t\telements = { %s }\n", strings.Join(elems, ", "))
+	}
+	b.WriteString("\t}\n")
+}
+
+func isV4(n string) bool {
+	ip, _, err := net.ParseCIDR(n)
+	if err != nil {
+		ip = net.ParseIP(n)
+	}
+	return ip.To4() != nil
+}
+
+// applyIsolation installs firewall rules for isolated groups or removes them
+// if no group is isolated anymore. The lock should be held by the caller.
+func (s *Server) applyIsolation() error {
+	isolated, all := s.isolationSets()
+	if len(isolated) == 0 {
+		return s.removeIsolation()
+	}
+	if err := nft(isolationRuleset(isolationTable(s.Cfg), isolated, all)); err != nil {
+		return fmt.Errorf("isolation: %w", err)
+	}
+	s.isolationApplied = true
+	return nil
+}
+
+// removeIsolation deletes firewall rules installed by applyIsolation. The
+// lock should be held by the caller.
+func (s *Server) removeIsolation() error {
+	if !s.isolationApplied {
+		return nil
+	}
+	table := isolationTable(s.Cfg)
+	if err := nft(fmt.Sprintf("table inet %s {}\ndelete table inet %s\n", table, table)); err != nil {
+		return fmt.Errorf("isolation: %w", err)
+	}
+	s.isolationApplied = false
+	return nil
+}
+
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	// Records are single lines, the script is flattened.
+	audit.Record("exec", "nft -f - (stdin: %s)", strings.Join(strings.Fields(script), " "))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -8,11 +8,29 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func createMultipointLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg) (linkmgr.Link, bool, error) {
+// linkSpec is the desired state of the WireGuard interface managed by the
+// server.
+type linkSpec struct {
+	Name  string
+	WG    wgtypes.Config
+	Addrs []linkmgr.Address
+}
+
+func (s linkSpec) create(m linkmgr.Manager) (linkmgr.Link, bool, error) {
+	// Replacing all peers of a large interface is slow and resets sessions
+	// of all clients, change only the peers that differ if the interface
+	// already exists.
+	return wirebox.CreateWG(m, s.Name, s.WG, s.Addrs, wirebox.CreateOpts{SyncPeers: true})
+}
+
+func createMultipointLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg, cfgAddrs map[wgtypes.Key][]net.IP) (linkmgr.Link, bool, error) {
+	return multipointLinkSpec(scfg, clientKeys, clientCfgs, cfgAddrs).create(m)
+}
+
+func multipointLinkSpec(scfg SrvConfig, clientKeys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg, cfgAddrs map[wgtypes.Key][]net.IP) linkSpec {
 	cfg := wgtypes.Config{
-		PrivateKey:   &scfg.PrivateKey.Bytes,
-		ListenPort:   &scfg.PortLow,
-		ReplacePeers: true,
+		PrivateKey: &scfg.PrivateKey.Bytes,
+		ListenPort: &scfg.PortLow,
 	}
 
 	// Here we configure only one interface with one address/subnet at the
@@ -22,15 +40,7 @@ func createMultipointLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebo
 	// IP multicast will *not* work at all in this configuration.
 
 	// Add link-local address for configuration renewal.
-	linkAddrs := []linkmgr.Address{
-		{
-			IPNet: net.IPNet{
-				IP:   wirebox.SolictIPv6,
-				Mask: net.CIDRMask(8, 128),
-			},
-			Scope: linkmgr.ScopeLink,
-		},
-	}
+	linkAddrs := solictAddrs(cfgAddrs)
 
 	// If we have subnet specified - we can just assign it to the interface at
 	// the server and be done with it.
@@ -56,13 +66,8 @@ func createMultipointLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebo
 	for _, pubKey := range clientKeys {
 		clCfg := clientCfgs[pubKey.Bytes]
 
-		clientLL := wirebox.IPv6LLForClient(pubKey)
-		allowedIPs := []net.IPNet{
-			{ // Permit link-local communication over configuration interface.
-				IP:   clientLL,
-				Mask: net.CIDRMask(128, 128),
-			},
-		}
+		// Permit link-local communication over configuration interface.
+		allowedIPs := configAllowedIPs(cfgAddrs[pubKey.Bytes])
 
 		for _, clAddr := range clCfg.Addrs {
 			if v4 := clAddr.IP.To4(); v4 != nil {
@@ -102,47 +107,90 @@ func createMultipointLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebo
 			})
 		}
 
-		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{
+		cfg.Peers = append(cfg.Peers, clCfg.withEndpoint(wgtypes.PeerConfig{
 			PublicKey:         pubKey.Bytes,
 			ReplaceAllowedIPs: true,
 			AllowedIPs:        allowedIPs,
+		}))
+	}
+
+	return scfg.standbySpec(linkSpec{Name: scfg.If, WG: cfg, Addrs: linkAddrs})
+}
+
+// solictAddrs returns link-local addresses for the interface shared by
+// clients.
+//
+// IPv4 addresses are assigned with the client address as the peer so the
+// route for the whole 169.254.0.0/16 (which may contain e.g. the cloud
+// metadata service) is not added.
+func solictAddrs(cfgAddrs map[wgtypes.Key][]net.IP) []linkmgr.Address {
+	addrs := []linkmgr.Address{
+		{
+			IPNet: net.IPNet{
+				IP:   wirebox.SolictIPv6,
+				Mask: net.CIDRMask(8, 128),
+			},
+			Scope: linkmgr.ScopeLink,
+		},
+	}
+	for _, clAddrs := range cfgAddrs {
+		for _, addr := range clAddrs {
+			if addr.To4() == nil {
+				continue
+			}
+			addrs = append(addrs, linkmgr.Address{
+				IPNet: net.IPNet{
+					IP:   wirebox.SolictIPv4,
+					Mask: net.CIDRMask(32, 32),
+				},
+				Peer: &net.IPNet{
+					IP:   addr,
+					Mask: net.CIDRMask(32, 32),
+				},
+				Scope: linkmgr.ScopeLink,
+			})
+		}
+	}
+	return addrs
+}
+
+func configAllowedIPs(cfgAddrs []net.IP) []net.IPNet {
+	res := make([]net.IPNet, 0, len(cfgAddrs))
+	for _, addr := range cfgAddrs {
+		bits := 128
+		if addr.To4() != nil {
+			bits = 32
+		}
+		res = append(res, net.IPNet{
+			IP:   addr,
+			Mask: net.CIDRMask(bits, bits),
 		})
 	}
+	return res
+}
 
-	return wirebox.CreateWG(m, scfg.If, cfg, linkAddrs)
+func createConfLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebox.PeerKey, cfgAddrs map[wgtypes.Key][]net.IP) (linkmgr.Link, bool, error) {
+	return confLinkSpec(scfg, clientKeys, cfgAddrs).create(m)
 }
 
-func createConfLink(m linkmgr.Manager, scfg SrvConfig, clientKeys []wirebox.PeerKey) (linkmgr.Link, bool, error) {
+func confLinkSpec(scfg SrvConfig, clientKeys []wirebox.PeerKey, cfgAddrs map[wgtypes.Key][]net.IP) linkSpec {
 	cfg := wgtypes.Config{
-		PrivateKey:   &scfg.PrivateKey.Bytes,
-		ListenPort:   &scfg.PortLow,
-		ReplacePeers: true,
+		PrivateKey: &scfg.PrivateKey.Bytes,
+		ListenPort: &scfg.PortLow,
 	}
 
 	for _, pubKey := range clientKeys {
-		clientLL := wirebox.IPv6LLForClient(pubKey)
-		debugLog.Printf("IPv6LL for %v: %v", pubKey, clientLL)
-
 		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{
 			PublicKey:         pubKey.Bytes,
 			ReplaceAllowedIPs: true,
-			AllowedIPs: []net.IPNet{
-				// Permit link-local communication over configuration interface.
-				{
-					IP:   clientLL,
-					Mask: net.CIDRMask(128, 128),
-				},
-			},
+			// Permit link-local communication over configuration interface.
+			AllowedIPs: configAllowedIPs(cfgAddrs[pubKey.Bytes]),
 		})
 	}
 
-	return wirebox.CreateWG(m, scfg.If, cfg, []linkmgr.Address{
-		{
-			IPNet: net.IPNet{
-				IP:   wirebox.SolictIPv6,
-				Mask: net.CIDRMask(8, 128),
-			},
-			Scope: linkmgr.ScopeLink,
-		},
+	return scfg.standbySpec(linkSpec{
+		Name:  scfg.If,
+		WG:    cfg,
+		Addrs: solictAddrs(cfgAddrs),
 	})
 }
@@ -0,0 +1,298 @@
+package wboxserver
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// loadConn delivers replies to simulated clients by their configuration
+// addresses instead of sending them over the network.
+type loadConn struct {
+	clients map[string]chan []byte
+}
+
+func (c *loadConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	ch, ok := c.clients[addr.IP.String()]
+	if !ok {
+		return 0, fmt.Errorf("loadtest: no client with address %v", addr.IP)
+	}
+	// b can be the pooled buffer reused once WriteToUDP returns.
+	reply := append([]byte(nil), b...)
+	select {
+	case ch <- reply:
+	default:
+		// The client gave up on the previous solictation and has not
+		// drained its reply yet.
+	}
+	return len(b), nil
+}
+
+// loadStats accumulates results of all simulated clients.
+type loadStats struct {
+	lock      sync.Mutex
+	sent      int
+	cfgs      int
+	nacks     map[wboxproto.Nack_Code]int
+	timeouts  int
+	dropped   int
+	malformed int
+	latencies []time.Duration
+}
+
+func (st *loadStats) add(reply []byte, latency time.Duration) {
+	msg, err := wboxproto.Unpack(reply)
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.latencies = append(st.latencies, latency)
+	switch msg := msg.(type) {
+	case *wboxproto.Cfg:
+		st.cfgs++
+	case *wboxproto.Nack:
+		if st.nacks == nil {
+			st.nacks = make(map[wboxproto.Nack_Code]int)
+		}
+		st.nacks[msg.GetCode()]++
+	default:
+		debugLog.Println("loadtest: malformed reply:", err)
+		st.malformed++
+	}
+}
+
+func (st *loadStats) count(n *int) {
+	st.lock.Lock()
+	*n++
+	st.lock.Unlock()
+}
+
+// percentile returns the latency below which the fraction p of sorted
+// latencies falls.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func (st *loadStats) print(elapsed time.Duration) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+	failed := st.timeouts + st.dropped + st.malformed
+	for _, n := range st.nacks {
+		failed += n
+	}
+
+	fmt.Printf("solictations: %d (%.1f/s)\n", st.sent, float64(st.sent)/elapsed.Seconds())
+	fmt.Printf("replies:      %d cfg, %d malformed\n", st.cfgs, st.malformed)
+	codes := make([]wboxproto.Nack_Code, 0, len(st.nacks))
+	for code := range st.nacks {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		fmt.Printf("              %d nack %v\n", st.nacks[code], code)
+	}
+	fmt.Printf("timeouts:     %d\n", st.timeouts)
+	fmt.Printf("dropped:      %d (workers busy)\n", st.dropped)
+	if st.sent != 0 {
+		fmt.Printf("error rate:   %.2f%%\n", 100*float64(failed)/float64(st.sent))
+	}
+	fmt.Printf("latency:      p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(st.latencies, 0.5), percentile(st.latencies, 0.9),
+		percentile(st.latencies, 0.99), percentile(st.latencies, 1))
+}
+
+// loadClient is the simulated client sending solictations periodically.
+type loadClient struct {
+	addr    net.IP
+	dgram   []byte
+	replies chan []byte
+}
+
+func (lc *loadClient) run(pool *workerPool, conn *loadConn, interval, timeout time.Duration, st *loadStats, stop <-chan struct{}) {
+	// Spread first solictations over the interval, clients do not start
+	// at the same time.
+	select {
+	case <-stop:
+		return
+	case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+	}
+
+	sender := &net.UDPAddr{IP: lc.addr, Port: wirebox.SolictPort}
+	for {
+		select {
+		case <-lc.replies:
+		default:
+		}
+
+		start := time.Now()
+		// Unpacked the same way as by serve so decoding is measured too.
+		msg := solictMsgs.Get().(*wboxproto.CfgSolict)
+		if err := wboxproto.UnpackInto(lc.dgram, msg); err != nil {
+			solictMsgs.Put(msg)
+			log.Println("error: loadtest:", err)
+			return
+		}
+		st.count(&st.sent)
+		if pool.submit(solictJob{c: conn, link: "loadtest", sender: sender, msg: msg}) {
+			select {
+			case reply := <-lc.replies:
+				st.add(reply, time.Since(start))
+			case <-time.After(timeout):
+				st.count(&st.timeouts)
+			case <-stop:
+				return
+			}
+		} else {
+			solictMsgs.Put(msg)
+			st.count(&st.dropped)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval - time.Since(start)):
+		}
+	}
+}
+
+func loadtestMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	clients := fs.Int("clients", 100, "number of simulated clients")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run the test")
+	interval := fs.Duration("interval", time.Second, "delay between solictations of each client")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for the reply before counting it as lost")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd loadtest [options]")
+		fmt.Fprintln(fs.Output(), "Simulates clients requesting configurations from the server with its")
+		fmt.Fprintln(fs.Output(), "configuration and reports latency and error rates. Requests are handled")
+		fmt.Fprintln(fs.Output(), "by the same worker pool in this process, no interfaces are created and")
+		fmt.Fprintln(fs.Output(), "WireGuard encryption is not included in measurements.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *clients <= 0 || *interval <= 0 || *duration <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	// Simulated clients share the tunnel port, the port range could not
+	// fit them otherwise.
+	cfg.PtMP = true
+	if cfg.Pool4.IP == nil && cfg.Pool6.IP == nil {
+		log.Println("error: pool4 or pool6 is required to assign addresses to simulated clients")
+		return 2
+	}
+
+	keys := make([]wirebox.PeerKey, 0, *clients)
+	for i := 0; i < *clients; i++ {
+		priv, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		pub := priv.PublicKey()
+		keys = append(keys, wirebox.PeerKey{Encoded: pub.String(), Bytes: pub})
+	}
+	clientCfgs, err := buildClientConfigs(cfg, keys)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if len(clientCfgs) < len(keys) {
+		log.Printf("WARNING: only %d of %d simulated clients got addresses, others will receive NACKs", len(clientCfgs), len(keys))
+	}
+
+	s := &Server{
+		Cfg:        cfg,
+		ClientCfgs: clientCfgs,
+		addrOwners: indexAddrs(clientCfgs),
+		serial:     uint64(time.Now().Unix()),
+	}
+	workers := cfg.SolictWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	queue := cfg.SolictQueue
+	if queue == 0 {
+		queue = 128
+	}
+	pool := newWorkerPool(workers, queue, s.handleSolict)
+
+	scheme := cfg.addrSchemes()[0]
+	conn := &loadConn{clients: make(map[string]chan []byte, len(keys))}
+	simulated := make([]*loadClient, 0, len(keys))
+	for _, key := range keys {
+		dgram, err := wboxproto.Pack(&wboxproto.CfgSolict{
+			PeerPubkey:   key.Bytes[:],
+			AddrScheme:   scheme,
+			Version:      wirebox.Version,
+			Capabilities: wirebox.Capabilities,
+		})
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		lc := &loadClient{
+			addr:    wirebox.ConfigAddr(key, scheme, []byte(cfg.AddrSalt)),
+			dgram:   dgram,
+			replies: make(chan []byte, 1),
+		}
+		conn.clients[lc.addr.String()] = lc.replies
+		simulated = append(simulated, lc)
+	}
+
+	fmt.Printf("%d clients, %d workers, solictation every %v for %v\n", len(simulated), workers, *interval, *duration)
+
+	// The server logs each solictation, that would flood the output.
+	logOut := log.Writer()
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		st    loadStats
+		wg    sync.WaitGroup
+		stop  = make(chan struct{})
+		start = time.Now()
+	)
+	for _, lc := range simulated {
+		wg.Add(1)
+		go func(lc *loadClient) {
+			defer wg.Done()
+			lc.run(pool, conn, *interval, *timeout, &st, stop)
+		}(lc)
+	}
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+	pool.stop()
+	elapsed := time.Since(start)
+	log.SetOutput(logOut)
+
+	st.print(elapsed)
+	if st.sent == 0 {
+		log.Println("error: no solictations were sent, increase -duration")
+		return 1
+	}
+	return 0
+}
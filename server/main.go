@@ -9,19 +9,35 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/audit"
+	"github.com/foxcpp/wirebox/bench"
+	"github.com/foxcpp/wirebox/bgp"
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/cli"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/debugsrv"
+	"github.com/foxcpp/wirebox/dnspub"
+	"github.com/foxcpp/wirebox/errreport"
 	"github.com/foxcpp/wirebox/linkmgr"
-	"golang.org/x/sys/unix"
+	"github.com/foxcpp/wirebox/logging"
+	"github.com/foxcpp/wirebox/privdrop"
+	"github.com/foxcpp/wirebox/stun"
+	"github.com/foxcpp/wirebox/sysctl"
+	"github.com/foxcpp/wirebox/tracing"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var (
 	debugLog = log.New(os.Stderr, "debug: ", log.LstdFlags)
+	reporter *errreport.Reporter
 )
 
 func logErr(err error) {
@@ -61,18 +77,46 @@ func readKeyList(path string) ([]wirebox.PeerKey, error) {
 }
 
 func loadConfig(path string) (SrvConfig, error) {
-	cfgF, err := os.Open(path)
+	var cfg SrvConfig
+	md, err := cfgfile.DecodeFile(path, &cfg)
 	if err != nil {
 		return SrvConfig{}, fmt.Errorf("config load: %w", err)
 	}
-	var cfg SrvConfig
-	if _, err := toml.DecodeReader(cfgF, &cfg); err != nil {
-		return SrvConfig{}, fmt.Errorf("config load: %w", err)
+	if keyFile := md.DefinedIn("private-key"); keyFile != "" {
+		if err := wirebox.CheckKeyPerms(keyFile, cfg.KeyPerms); err != nil {
+			return SrvConfig{}, fmt.Errorf("config load: %w", err)
+		}
+	}
+	if cfg.PeersFile != "" {
+		_, spec, err := readPeerSpec(cfg.PeersFile)
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("config load: %w", err)
+		}
+		cfg = cfg.withSpec(spec)
+	}
+	if cfg.PeerStore.Enabled() {
+		cfg, err = cfg.openStore()
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("config load: %w", err)
+		}
+	}
+	if len(cfg.Overlays) != 0 {
+		overlays, err := loadOverlays(path, cfg)
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("config load: %w", err)
+		}
+		cfg, err = cfg.withOverlays(overlays)
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("config load: %w", err)
+		}
 	}
 	if err := cfg.Validate(); err != nil {
 		return SrvConfig{}, fmt.Errorf("config load: %w", err)
 	}
-	log.Println("server public key:", cfg.PrivateKey.PublicFromPrivate())
+	cfg, err = cfg.withPolicy()
+	if err != nil {
+		return SrvConfig{}, fmt.Errorf("config load: %w", err)
+	}
 	return cfg, nil
 }
 
@@ -87,12 +131,47 @@ func clientKeys(cfg SrvConfig) ([]wirebox.PeerKey, error) {
 			return nil, fmt.Errorf("client keys: %w", err)
 		}
 	} else {
+		// Sort keys so allocation of ports and addresses does not change
+		// between restarts.
+		merged := make(map[string]bool, len(cfg.specKeys)+len(cfg.storeKeys))
+		for _, keys := range [][]string{cfg.specKeys, cfg.storeKeys} {
+			for _, encoded := range keys {
+				merged[encoded] = true
+			}
+		}
+		encodedKeys := make([]string, 0, len(cfg.Clients))
 		for encoded := range cfg.Clients {
+			if !merged[encoded] {
+				encodedKeys = append(encodedKeys, encoded)
+			}
+		}
+		sort.Strings(encodedKeys)
+
+		for _, encoded := range encodedKeys {
+			pubKey, err := wirebox.NewPeerKey(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("client keys: %w", err)
+			}
+			clientKeys = append(clientKeys, pubKey)
+		}
+	}
+	// Clients from the peers file and the peer store are always authorized.
+	// Store clients follow spec ones so both keep their order.
+	authorized := make(map[string]bool, len(clientKeys))
+	for _, k := range clientKeys {
+		authorized[k.Encoded] = true
+	}
+	for _, keys := range [][]string{cfg.specKeys, cfg.storeKeys} {
+		for _, encoded := range keys {
+			if authorized[encoded] {
+				continue
+			}
 			pubKey, err := wirebox.NewPeerKey(encoded)
 			if err != nil {
 				return nil, fmt.Errorf("client keys: %w", err)
 			}
 			clientKeys = append(clientKeys, pubKey)
+			authorized[encoded] = true
 		}
 	}
 	if len(clientKeys) == 0 {
@@ -102,6 +181,15 @@ func clientKeys(cfg SrvConfig) ([]wirebox.PeerKey, error) {
 	return clientKeys, nil
 }
 
+func containsKey(keys []wirebox.PeerKey, encoded string) bool {
+	for _, k := range keys {
+		if k.Encoded == encoded {
+			return true
+		}
+	}
+	return false
+}
+
 type Server struct {
 	m linkmgr.Manager
 
@@ -121,15 +209,82 @@ type Server struct {
 
 	ClientCfgs  map[wgtypes.Key]ClientCfg
 	SolictConns []*net.UDPConn
+	// Names of links solictation sockets are bound to.
+	connLinks map[*net.UDPConn]string
+
+	// Owners of addresses in ClientCfgs, see ClientByAddr.
+	addrOwners map[string]wgtypes.Key
+
+	// Lifecycle events for all server interfaces. Can be nil.
+	Events *wirebox.EventBus
+	// Records spans of solictation handling. Can be nil.
+	Tracer *tracing.Tracer
+
+	// lock protects Cfg, ClientCfgs, addrOwners, Tunnels, NewTunnels,
+	// SolictConns and connLinks which are changed by Reconcile while serving.
+	lock sync.RWMutex
+
+	// Stop channels for serve goroutines, nil if not serving.
+	serveStops map[*net.UDPConn]chan struct{}
+	serveWg    sync.WaitGroup
+	// Workers handling solictations read by serve goroutines.
+	pool *workerPool
+
+	// Signals runDNSPublish that clients changed, nil if DNS publishing is
+	// disabled.
+	dnsTrigger chan struct{}
+
+	// serial is the version of Cfg and ClientCfgs sent to clients.
+	serial   uint64
+	cfgCache cfgCache
+
+	// Secret authenticating enrollment nonces, set by serveBootstrap.
+	nonceSecret []byte
+
+	solicts solictLog
+	mesh    meshLog
+	relays  relayTable
+
+	// Networks routed by clients, protected by lock.
+	sites map[wgtypes.Key]site
+
+	// BGP speaker and the channel signaling runBGP that announced routes
+	// changed, nil if BGP is disabled. bgp is protected by lock.
+	bgp        *bgp.Speaker
+	bgpTrigger chan struct{}
+
+	// Clients blocked outside of their schedules or over quotas, protected
+	// by lock.
+	blocked map[wgtypes.Key]bool
+	// Transfer accounting for clients with quotas, protected by lock.
+	quotas map[wgtypes.Key]*quotaUsage
+
+	// Recent events for the top command, can be nil.
+	eventLog *wirebox.EventLog
+
+	// Whether firewall rules for isolated groups are installed, protected
+	// by lock.
+	isolationApplied bool
+	// Detected configuration conflicts and clients refused because of
+	// them, protected by lock.
+	conflicts       []Conflict
+	conflictRefused map[wgtypes.Key]bool
+	// WireGuard endpoints of clients and keys used by several devices,
+	// protected by lock.
+	endpoints map[wgtypes.Key]*endpointHistory
+	flapping  map[wgtypes.Key]bool
+
+	// Servers of overlays, enrollment tokens of them are accepted by the
+	// bootstrap endpoint of this one. Set by run before it is started.
+	overlays []*Server
 }
 
-func initialize(m linkmgr.Manager, cfgPath string) (*Server, error) {
-	cfg, err := loadConfig(cfgPath)
+func initialize(m linkmgr.Manager, cfg SrvConfig, events *wirebox.EventBus) (*Server, error) {
+	clientKeys, err := clientKeys(cfg)
 	if err != nil {
 		return nil, err
 	}
-
-	clientKeys, err := clientKeys(cfg)
+	cfg, err = leaseAddrs(cfg, clientKeys)
 	if err != nil {
 		return nil, err
 	}
@@ -144,20 +299,18 @@ func initialize(m linkmgr.Manager, cfgPath string) (*Server, error) {
 		masterLink linkmgr.Link
 	)
 
+	cfgAddrs := configAddrs(cfg, clientKeys)
+
 	if cfg.PtMP {
-		masterLink, created, err = createMultipointLink(m, cfg, clientKeys, clientCfgs)
+		masterLink, created, err = createMultipointLink(m, cfg, clientKeys, clientCfgs, cfgAddrs)
 	} else {
-		masterLink, created, err = createConfLink(m, cfg, clientKeys)
+		masterLink, created, err = createConfLink(m, cfg, clientKeys, cfgAddrs)
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	mainSolictConn, err := net.ListenUDP("udp6", &net.UDPAddr{
-		IP:   wirebox.SolictIPv6,
-		Port: wirebox.SolictPort,
-		Zone: strconv.Itoa(masterLink.Index()),
-	})
+	mainSolictConns, err := listenSolict(cfg, masterLink)
 	if err != nil {
 		if err := m.DelLink(masterLink.Index()); err != nil {
 			log.Println("failed to delete link:", err)
@@ -171,7 +324,7 @@ func initialize(m linkmgr.Manager, cfgPath string) (*Server, error) {
 	)
 
 	if !cfg.PtMP {
-		clientLinks, newLinks, err = configurePeerTuns(m, cfg, clientKeys, clientCfgs)
+		clientLinks, newLinks, err = configurePeerTuns(m, cfg, clientKeys, clientCfgs, cfgAddrs)
 		if err != nil {
 			if err := m.DelLink(masterLink.Index()); err != nil {
 				log.Println("failed to delete link:", err)
@@ -181,13 +334,10 @@ func initialize(m linkmgr.Manager, cfgPath string) (*Server, error) {
 	}
 
 	solictConns := make([]*net.UDPConn, 0, len(clientLinks)+1)
+	connLinks := make(map[*net.UDPConn]string, len(clientLinks)+1)
 
 	for _, l := range clientLinks {
-		c, err := net.ListenUDP("udp6", &net.UDPAddr{
-			IP:   wirebox.SolictIPv6,
-			Port: wirebox.SolictPort,
-			Zone: strconv.Itoa(l.Index()),
-		})
+		conns, err := listenSolict(cfg, l)
 		if err != nil {
 			for _, sc := range solictConns {
 				sc.Close()
@@ -202,11 +352,24 @@ func initialize(m linkmgr.Manager, cfgPath string) (*Server, error) {
 			}
 			return nil, err
 		}
+		for _, c := range conns {
+			solictConns = append(solictConns, c)
+			connLinks[c] = l.Name()
+		}
+	}
+	for _, c := range mainSolictConns {
 		solictConns = append(solictConns, c)
+		connLinks[c] = masterLink.Name()
+	}
+
+	if created {
+		events.Emit(wirebox.LinkCreated{Link: masterLink.Name()})
+	}
+	for _, l := range newLinks {
+		events.Emit(wirebox.LinkCreated{Link: l.Name()})
 	}
-	solictConns = append(solictConns, mainSolictConn)
 
-	return &Server{
+	srv := &Server{
 		m:             m,
 		Cfg:           cfg,
 		MasterLink:    masterLink,
@@ -214,76 +377,420 @@ func initialize(m linkmgr.Manager, cfgPath string) (*Server, error) {
 		Tunnels:       clientLinks,
 		NewTunnels:    newLinks,
 		ClientCfgs:    clientCfgs,
+		addrOwners:    indexAddrs(clientCfgs),
 		SolictConns:   solictConns,
-	}, nil
+		connLinks:     connLinks,
+		Events:        events,
+		serial:        uint64(time.Now().Unix()),
+	}
+	srv.setConflicts(findConflicts(clientKeys, clientCfgs))
+	return srv, nil
 }
 
 func (s *Server) GoServe() (stop func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	log.Println("serving configurations for", len(s.ClientCfgs), "clients")
 
-	wg := sync.WaitGroup{}
-	stopServe := make(chan struct{}, 1)
+	workers := s.Cfg.SolictWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	queue := s.Cfg.SolictQueue
+	if queue == 0 {
+		queue = 128
+	}
+	s.pool = newWorkerPool(workers, queue, s.handleSolict)
 
+	s.serveStops = make(map[*net.UDPConn]chan struct{}, len(s.SolictConns))
 	for _, sc := range s.SolictConns {
-		sc := sc
-
-		wg.Add(1)
-		go func() {
-			serve(stopServe, sc, s.Cfg, s.ClientCfgs)
-			wg.Done()
-		}()
+		s.goServeConn(sc)
 	}
 
 	return func() {
-		close(stopServe)
-		for _, sc := range s.SolictConns {
-			sc.Close()
+		s.lock.Lock()
+		for sc := range s.serveStops {
+			s.stopServeConn(sc)
 		}
-		wg.Wait()
+		s.serveStops = nil
+		pool := s.pool
+		s.lock.Unlock()
+		s.serveWg.Wait()
+
+		// Readers are stopped, nothing submits jobs anymore.
+		pool.stop()
+		s.lock.Lock()
+		s.pool = nil
+		s.lock.Unlock()
+	}
+}
+
+func (s *Server) goServeConn(sc *net.UDPConn) {
+	stop := make(chan struct{})
+	s.serveStops[sc] = stop
+
+	pool := s.pool
+	link := s.connLinks[sc]
+	s.serveWg.Add(1)
+	go func() {
+		s.serve(stop, sc, link, pool)
+		s.serveWg.Done()
+	}()
+}
+
+func (s *Server) stopServeConn(sc *net.UDPConn) {
+	if stop, ok := s.serveStops[sc]; ok {
+		close(stop)
+		delete(s.serveStops, sc)
 	}
+	sc.Close()
 }
 
 func (s *Server) Close() error {
+	s.relays.closeAll()
+	s.lock.Lock()
+	if err := s.removeIsolation(); err != nil {
+		log.Println("error:", err)
+	}
+	s.lock.Unlock()
+	if err := sysctl.Restore(sysctl.StatePath(s.Cfg.If)); err != nil {
+		log.Println("error:", err)
+	}
 	for _, l := range s.NewTunnels {
-		if err := s.m.DelLink(l.Index()); err != nil {
-			log.Println("error: failed to delete link:", err)
-		}
+		s.delLink(l)
 	}
 	if s.DelMasterLink {
-		if err := s.m.DelLink(s.MasterLink.Index()); err != nil {
-			log.Println("error: failed to delete link:", err)
+		s.delLink(s.MasterLink)
+	}
+	if s.Cfg.store != nil {
+		if err := s.Cfg.store.Close(); err != nil {
+			log.Println("error:", err)
 		}
 	}
 	return nil
 }
 
+// applySysctl sets kernel parameters of the tunnel interface, previous values
+// are restored by Server.Close.
+func applySysctl(cfg SrvConfig, l linkmgr.Link) error {
+	if !cfg.Sysctl.Enabled() {
+		return nil
+	}
+	return sysctl.Apply(sysctl.StatePath(cfg.If), cfg.Sysctl.Settings(l.Name()))
+}
+
+func (s *Server) delLink(l linkmgr.Link) {
+	if err := s.m.DelLink(l.Index()); err != nil {
+		log.Println("error: failed to delete link:", err)
+		return
+	}
+	s.Events.Emit(wirebox.Teardown{Link: l.Name()})
+}
+
+// stunTimeout limits public address discovery using each STUN server.
+const stunTimeout = 3 * time.Second
+
 func Main() int {
-	// Read configuration and command line flags.
-	cfgPath := flag.String("config", "wboxd.toml", "path to configuration file")
-	debug := flag.Bool("debug", false, "enable debug log")
-	flag.Parse()
-	if !*debug {
-		debugLog = log.New(ioutil.Discard, "", 0)
+	return Run("wboxd", os.Args[1:])
+}
+
+// Run executes the server command line, prog is the program name for usage
+// messages. The server is started if no command is specified.
+func Run(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ExitOnError)
+	cfgPath := fs.String("config", "wboxd.toml", "path to configuration file")
+	debug := fs.Bool("debug", false, "enable debug log")
+	debugAddr := fs.String("debug-addr", "", "serve pprof and state dump on this loopback address (e.g. 127.0.0.1:6060)")
+	fs.BoolVar(&cfgfile.Lax, "lax", false, "ignore unknown options in the configuration file")
+
+	withCfg := func(f func(cfgPath string, args []string) int) func([]string) int {
+		return func(args []string) int {
+			if !*debug {
+				debugLog = log.New(ioutil.Discard, "", 0)
+			}
+			return f(*cfgPath, args)
+		}
+	}
+	cmds := []cli.Command{
+		{Name: "run", Help: "run the server (default)", Run: func(args []string) int {
+			// Options are also accepted after the command name.
+			if err := fs.Parse(args); err != nil {
+				return 2
+			}
+			if fs.NArg() != 0 {
+				fs.Usage()
+				return 2
+			}
+			return run(*cfgPath, *debug, *debugAddr)
+		}},
+		{Name: "apply", Help: "apply the declarative peers spec", Run: withCfg(applyMain)},
+		{Name: "export", Help: "export configuration in wg-quick format", Run: withCfg(exportMain)},
+		{Name: "status", Help: "show state of server interfaces", Run: withCfg(statusMain)},
+		{Name: "peers", Help: "list clients known to the running server, import clients", Run: withCfg(peersMain)},
+		{Name: "conflicts", Help: "list duplicate keys and overlapping addresses", Run: withCfg(conflictsMain)},
+		{Name: "store", Help: "list, add and remove clients in the peer store", Run: withCfg(storeMain)},
+		{Name: "migrate", Help: "upgrade the peer store schema", Run: withCfg(migrateMain)},
+		{Name: "promote", Help: "make the running standby serve clients", Run: withCfg(promoteMain)},
+		{Name: "demote", Help: "make the running server the standby", Run: withCfg(demoteMain)},
+		{Name: "logs", Help: "print log messages of the running server", Run: withCfg(logsMain)},
+		{Name: "top", Help: "show live dashboard of the running server", Run: withCfg(topMain)},
+		{Name: "doctor", Help: "check the configuration and the system", Run: withCfg(doctorMain)},
+		{Name: "config", Help: "print the configuration schema or validate configuration files", Run: withCfg(configMain)},
+		{Name: "loadtest", Help: "measure solictation handling with simulated clients", Run: withCfg(loadtestMain)},
 	}
+	cli.Usage(fs, prog, cmds)
+	return cli.Dispatch(fs, cmds, "run", args)
+}
 
+func doctorMain(cfgPath string, _ []string) int {
+	r := Doctor(cfgPath)
+	r.Print(os.Stdout)
+	if r.Failed() {
+		return 1
+	}
+	return 0
+}
+
+func run(cfgPath string, debug bool, debugAddr string) int {
 	m, err := linkmgr.NewManager()
 	if err != nil {
 		log.Println("error: link mngr init:", err)
 		return 1
 	}
 
-	srv, err := initialize(m, *cfgPath)
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		// The configuration is not available, SENTRY_DSN is still used
+		// if set.
+		if r, _ := errreport.New(errreport.Config{}, "wboxd", wirebox.Version); r != nil {
+			r.Error(err)
+		}
+		return 1
+	}
+
+	reporter, err = errreport.New(cfg.ErrorReporting, "wboxd", wirebox.Version)
+	if err != nil {
+		log.Println("error: config load:", err)
+		return 1
+	}
+	defer reporter.Recover()
+
+	logSink, err := logging.Setup(cfg.Log, "wboxd")
+	if err != nil {
+		log.Println("error: config load:", err)
+		reporter.Error(err)
+		return 1
+	}
+	defer logSink.Close()
+
+	auditSink, err := audit.Setup(cfg.Audit, "wboxd")
+	if err != nil {
+		log.Println("error: config load:", err)
+		reporter.Error(err)
+		return 1
+	}
+	defer auditSink.Close()
+
+	if debug {
+		debugLog = log.New(log.Writer(), "debug: ", log.Flags())
+	} else {
+		debugLog = log.New(ioutil.Discard, "", 0)
+	}
+
+	log.Println("server public key:", cfg.PrivateKey.PublicFromPrivate())
+
+	tracer, err := tracing.New(cfg.Tracing, "wboxd")
+	if err != nil {
+		log.Println("error: config load:", err)
+		reporter.Error(err)
+		return 1
+	}
+	defer tracer.Close()
+
+	if len(cfg.STUNServers) != 0 && cfg.TunEndpoint4.IP == nil && cfg.TunEndpoint6.IP == nil {
+		addr, err := stun.Discover(cfg.STUNServers, stunTimeout)
+		if err != nil {
+			log.Println("WARNING: public address discovery failed:", err)
+		} else if v4 := addr.IP.To4(); v4 != nil {
+			log.Println("advertising public address discovered via STUN:", v4)
+			cfg.TunEndpoint4.IP = v4
+		}
+	}
+
+	if cfg.Standby.Enable {
+		log.Println("starting as standby, peers are configured once promoted")
+		cfg.standby = true
+	}
+
+	events := &wirebox.EventBus{}
+	eventLog := wirebox.NewEventLog(eventLogSize)
+	events.Subscribe(eventLog)
+
+	srv, err := initialize(m, cfg, events)
 	if err != nil {
 		log.Println("error: initialization failed:", err)
 		return 1
 	}
 	defer srv.Close()
+	srv.eventLog = eventLog
+	srv.Tracer = tracer
+
+	srv.lock.Lock()
+	err = srv.applyIsolation()
+	srv.lock.Unlock()
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	for _, l := range append([]linkmgr.Link{srv.MasterLink}, srv.Tunnels...) {
+		if err := applySysctl(cfg, l); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+	}
+
+	if debugAddr != "" {
+		dbgSrv, err := debugsrv.Listen(debugAddr, srv.DebugState, srv.Metrics)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer dbgSrv.Close()
+	}
+
+	ctl, err := ctlsock.Listen(cfg.controlSocket(), srv.controlHandlers(), map[string]ctlsock.StreamHandler{
+		"logs": logging.Logs.Stream,
+	})
+	if err != nil {
+		log.Println("WARNING:", err)
+	} else {
+		defer ctl.Close()
+	}
+
+	if cfg.DNSPublish.Enabled() {
+		pub, err := dnspub.NewPublisher(cfg.DNSPublish)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		srv.dnsTrigger = make(chan struct{}, 1)
+		stopDNS := make(chan struct{})
+		defer close(stopDNS)
+		go srv.runDNSPublish(pub, stopDNS)
+	}
+
+	if cfg.BGP.Enabled() {
+		bgpCfg := cfg.BGP
+		if bgpCfg.RouterID == nil {
+			bgpCfg.RouterID = cfg.Server4.IP
+		}
+		sp, err := bgp.Start(bgpCfg, srv.bgpImported)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer sp.Close()
+		srv.lock.Lock()
+		srv.bgp = sp
+		srv.lock.Unlock()
+		srv.bgpTrigger = make(chan struct{}, 1)
+		stopBGP := make(chan struct{})
+		defer close(stopBGP)
+		go srv.runBGP(sp, stopBGP)
+	}
+
+	stopAccess := make(chan struct{})
+	defer close(stopAccess)
+	go srv.runAccess(stopAccess)
+
+	if cfg.Standby.Enable && cfg.Standby.CheckURL != "" {
+		client, err := cfg.Standby.checkClient()
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		stopCheck := make(chan struct{})
+		defer close(stopCheck)
+		go srv.runStandbyCheck(client, cfg.Standby, stopCheck)
+	}
+
+	names := make([]string, 0, len(cfg.overlays))
+	for name := range cfg.overlays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, stopOverlay, err := startOverlay(m, name, cfg.overlays[name], events, eventLog, tracer)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer stopOverlay()
+		srv.overlays = append(srv.overlays, o)
+	}
+
+	if cfg.Bootstrap.Enabled() {
+		bootSrv, err := srv.serveBootstrap(cfg.Bootstrap)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer bootSrv.Close()
+	}
+
+	if cfg.AdminAPI.Enabled() {
+		apiSrv, err := srv.serveAdminAPI(cfg.AdminAPI)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer apiSrv.Close()
+	}
+
+	if cfg.BenchPort != 0 {
+		benchSrv, err := bench.Listen(cfg.BenchPort, func(ip net.IP) bool {
+			_, _, ok := srv.ClientByAddr(ip)
+			return ok
+		})
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer benchSrv.Close()
+	}
+
+	// Everything needing root is set up, solicitations are served as the
+	// unprivileged user.
+	if cfg.Privileges.Enabled() {
+		if err := privdrop.Drop(cfg.Privileges); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		log.Println("dropped privileges, running as", cfg.Privileges.User)
+	}
 
 	stop := srv.GoServe()
 	defer stop()
 
+	if cfg.PeersFile != "" {
+		stopWatch := make(chan struct{})
+		defer close(stopWatch)
+		go srv.watchPeers(cfg, cfg.peersInterval(), stopWatch)
+	}
+	if cfg.store != nil {
+		stopStore, err := srv.watchStore()
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer stopStore()
+	}
+
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, unix.SIGINT, unix.SIGHUP, unix.SIGTERM)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
 
 	sig := <-ch
 	log.Println("received signal:", sig)
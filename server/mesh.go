@@ -0,0 +1,192 @@
+package wboxserver
+
+import (
+	"encoding/binary"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/golang/protobuf/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// meshTTL is how long the client is offered to other clients after its
+	// last solictation with mesh set. Clients poll more often than that.
+	meshTTL = 2 * time.Minute
+
+	// punchSlot aligns the time clients start probing new peers so both
+	// sides send packets at roughly the same moment.
+	punchSlot = 5 * time.Second
+)
+
+type meshClient struct {
+	seen time.Time
+	// Endpoints reported by the client itself.
+	endpoints []*wboxproto.Endpoint
+}
+
+// meshLog tracks clients that requested direct tunnels.
+type meshLog struct {
+	lock sync.Mutex
+	seen map[wgtypes.Key]meshClient
+}
+
+func (ml *meshLog) record(key wgtypes.Key, endpoints []*wboxproto.Endpoint) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if ml.seen == nil {
+		ml.seen = make(map[wgtypes.Key]meshClient)
+	}
+	ml.seen[key] = meshClient{seen: time.Now(), endpoints: endpoints}
+}
+
+func (ml *meshLog) endpoints(key wgtypes.Key) []*wboxproto.Endpoint {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	return ml.seen[key].endpoints
+}
+
+func (ml *meshLog) active() []wgtypes.Key {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	res := make([]wgtypes.Key, 0, len(ml.seen))
+	for key, c := range ml.seen {
+		if time.Since(c.seen) > meshTTL {
+			delete(ml.seen, key)
+			continue
+		}
+		res = append(res, key)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return string(res[i][:]) < string(res[j][:])
+	})
+	return res
+}
+
+// meshRelay returns the endpoint of the relay between self and peer for self,
+// the relay is opened if open is set. nil is returned if there is no relay.
+func (s *Server) meshRelay(self, peer wgtypes.Key, selfCfg ClientCfg, selfEndpoint *wboxproto.Endpoint, open bool) *wboxproto.Endpoint {
+	// Do not open the relay if the client cannot reach it anyway.
+	if relayEndpoint(selfCfg, selfEndpoint, s.Cfg.RelayPortLow) == nil {
+		return nil
+	}
+	port, err := s.relays.port(self, peer, s.Cfg.RelayPortLow, s.Cfg.RelayPortHigh, open)
+	if err != nil {
+		log.Println("error: mesh:", err)
+		return nil
+	}
+	if port == 0 {
+		return nil
+	}
+	return relayEndpoint(selfCfg, selfEndpoint, port)
+}
+
+func punchTime(now time.Time) time.Time {
+	return now.Add(2 * time.Second).Truncate(punchSlot).Add(punchSlot)
+}
+
+// observedEndpoint returns the address WireGuard packets from the client come
+// from, as seen by the server.
+func (s *Server) observedEndpoint(key wgtypes.Key, clCfg ClientCfg) (*wboxproto.Endpoint, error) {
+	l, err := s.m.GetLink(clCfg.ServerIf)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := l.WGConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey == key && p.Endpoint != nil {
+			return wboxproto.NewEndpoint(p.Endpoint), nil
+		}
+	}
+	return nil, nil
+}
+
+// addMeshPeers adds other mesh clients of the group of selfCfg to protoCfg as
+// long as the message fits in a datagram. Relays are opened for peers listed
+// in relayReq and included for peers that already have one. The lock should
+// be held by the caller.
+func (s *Server) addMeshPeers(protoCfg *wboxproto.Cfg, self wgtypes.Key, selfCfg ClientCfg, reported []*wboxproto.Endpoint, relayReq [][]byte) {
+	s.mesh.record(self, reported)
+	protoCfg.PunchAt = uint64(punchTime(time.Now()).UnixNano() / int64(time.Millisecond))
+
+	relayTo := make(map[wgtypes.Key]bool, len(relayReq))
+	for _, k := range relayReq {
+		key, err := wgtypes.NewKey(k)
+		if err != nil {
+			debugLog.Println("mesh: malformed relay peer key from", self, err)
+			continue
+		}
+		relayTo[key] = true
+	}
+	var selfEndpoint *wboxproto.Endpoint
+	if s.Cfg.RelayPortLow != 0 {
+		var err error
+		selfEndpoint, err = s.observedEndpoint(self, selfCfg)
+		if err != nil {
+			debugLog.Println("mesh: endpoint of", self, err)
+		}
+	}
+	group := selfCfg.Group
+
+	for _, key := range s.mesh.active() {
+		if key == self {
+			continue
+		}
+		clCfg, ok := s.ClientCfgs[key]
+		if !ok {
+			continue
+		}
+		// The topology of the peer may have changed since it was recorded.
+		if clCfg.Group != group || s.Cfg.topology(clCfg.Group) != TopologyMesh {
+			continue
+		}
+		endpoint, err := s.observedEndpoint(key, clCfg)
+		if err != nil {
+			debugLog.Println("mesh: endpoint of", key, err)
+			continue
+		}
+		var endpoints []*wboxproto.Endpoint
+		if endpoint != nil {
+			endpoints = append(endpoints, endpoint)
+		}
+		// Observed endpoint goes first, it is known to work at least for
+		// the server.
+		for _, e := range s.mesh.endpoints(key) {
+			if endpoint == nil || e.AsUDPAddr().String() != endpoint.AsUDPAddr().String() {
+				endpoints = append(endpoints, e)
+			}
+		}
+		if len(endpoints) == 0 {
+			continue
+		}
+
+		key := key
+		peer := &wboxproto.MeshPeer{
+			Pubkey:    key[:],
+			Endpoints: endpoints,
+		}
+		for _, addr := range clCfg.Addrs {
+			if v4 := addr.IP.To4(); v4 != nil {
+				peer.Addrs4 = append(peer.Addrs4, binary.BigEndian.Uint32(v4))
+			} else {
+				peer.Addrs6 = append(peer.Addrs6, wboxproto.NewIPv6(addr.IP))
+			}
+		}
+		if s.Cfg.RelayPortLow != 0 {
+			peer.Relay = s.meshRelay(self, key, selfCfg, selfEndpoint, relayTo[key])
+		}
+
+		protoCfg.Peers = append(protoCfg.Peers, peer)
+		if proto.Size(protoCfg)+2 > maxPayload {
+			protoCfg.Peers = protoCfg.Peers[:len(protoCfg.Peers)-1]
+			log.Println("WARNING: mesh: peer list does not fit in the configuration message, truncated for", self)
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package wboxserver
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/foxcpp/wirebox/cfgfile"
+	"github.com/foxcpp/wirebox/peerstore"
+)
+
+func migrateMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "show pending migrations and their statements without applying them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd migrate [options]")
+		fmt.Fprintln(fs.Output(), "Upgrades the schema of the peer store. The server does it on start")
+		fmt.Fprintln(fs.Output(), "too, use this to check or upgrade the store in advance.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	// loadConfig opens the store and so migrates it, only the peer store
+	// options are needed.
+	var cfg SrvConfig
+	if _, err := cfgfile.DecodeFile(cfgPath, &cfg); err != nil {
+		log.Println("error: config load:", err)
+		return 2
+	}
+	if !cfg.PeerStore.Enabled() {
+		log.Println("error: peer-store is not configured")
+		return 2
+	}
+	if err := cfg.PeerStore.validate(); err != nil {
+		log.Println("error: peer store:", err)
+		return 2
+	}
+	store, err := peerstore.OpenUnmigrated(cfg.PeerStore.Backend, cfg.PeerStore.DSN)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	defer store.Close()
+
+	m, ok := store.(peerstore.Migrator)
+	if !ok {
+		fmt.Printf("The %s backend has no schema to migrate.\n", cfg.PeerStore.Backend)
+		return 0
+	}
+	current, latest, err := m.SchemaVersion()
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	fmt.Printf("Schema version %d, latest %d.\n", current, latest)
+	if len(pending) == 0 {
+		fmt.Println("Up to date.")
+		return 0
+	}
+	for _, mig := range pending {
+		fmt.Printf("%d: %s\n", mig.Version, mig.Description)
+		if *dryRun {
+			for _, stmt := range mig.Statements {
+				fmt.Printf("\t%s;\n", strings.Join(strings.Fields(stmt), " "))
+			}
+		}
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, %d migrations would be applied.\n", len(pending))
+		return 0
+	}
+	if err := m.Migrate(); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	fmt.Printf("Upgraded to version %d.\n", latest)
+	return 0
+}
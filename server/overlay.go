@@ -0,0 +1,195 @@
+package wboxserver
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/logging"
+	"github.com/foxcpp/wirebox/tracing"
+	"github.com/foxcpp/wirebox/validate"
+)
+
+// loadOverlays loads configurations of overlays listed in cfg. Paths are
+// relative to the directory of the main configuration file.
+func loadOverlays(cfgPath string, cfg SrvConfig) (map[string]SrvConfig, error) {
+	res := make(map[string]SrvConfig, len(cfg.Overlays))
+	for name, path := range cfg.Overlays {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(cfgPath), path)
+		}
+		ocfg, err := loadConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("overlay %v: %w", name, err)
+		}
+		res[name] = ocfg
+	}
+	return res, validateOverlays(cfg, res)
+}
+
+func portsOverlap(a, b SrvConfig) bool {
+	return a.PortLow != 0 && b.PortLow != 0 && a.PortLow <= b.PortHigh && b.PortLow <= a.PortHigh
+}
+
+// validateOverlays checks that overlays do not conflict with the main server
+// and each other.
+func validateOverlays(cfg SrvConfig, overlays map[string]SrvConfig) error {
+	var errs validate.Errors
+
+	names := make([]string, 0, len(overlays))
+	for name := range overlays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		o := overlays[name]
+		field := validate.Field("overlays", name)
+		if len(o.Overlays) != 0 {
+			errs.Add(field, "overlays cannot be nested")
+		}
+		if o.Bootstrap.Enabled() {
+			errs.Add(field, "bootstrap.listen is not used, tokens are accepted by the main server")
+		}
+		if o.AdminAPI.Enabled() {
+			errs.Add(field, "admin-api is not used, use the control socket of the overlay")
+		}
+		if len(o.Bootstrap.Tokens) != 0 && o.AuthFile == "" && !o.PeerStore.Enabled() {
+			errs.Add(field, "authorized-keys or peer-store is required to store enrolled keys")
+		}
+		if o.DNSPublish.Enabled() || o.BGP.Enabled() || o.BenchPort != 0 {
+			errs.Add(field, "dns-publish, bgp and bench-port are only supported in the main configuration")
+		}
+
+		others := []struct {
+			name string
+			cfg  SrvConfig
+		}{{"the main server", cfg}}
+		for _, other := range names[:i] {
+			others = append(others, struct {
+				name string
+				cfg  SrvConfig
+			}{"overlay " + other, overlays[other]})
+		}
+		for _, other := range others {
+			if o.If == other.cfg.If {
+				errs.Add(field, "interface %v is also used by %v", o.If, other.name)
+			}
+			if o.controlSocket() == other.cfg.controlSocket() {
+				errs.Add(field, "control socket %v is also used by %v, set control-socket", o.controlSocket(), other.name)
+			}
+			if portsOverlap(o, other.cfg) {
+				errs.Add(field, "port range overlaps with %v", other.name)
+			}
+			if o.PeerStore.Enabled() && o.PeerStore == other.cfg.PeerStore {
+				errs.Add(field, "peer store is also used by %v", other.name)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// withOverlays returns cfg with groups assigned to overlays redirected to
+// them.
+func (c SrvConfig) withOverlays(overlays map[string]SrvConfig) (SrvConfig, error) {
+	var errs validate.Errors
+	groups := make(map[string]GroupConfig, len(c.Groups))
+	for name, g := range c.Groups {
+		groups[name] = g
+		if g.Overlay == "" {
+			continue
+		}
+		field := validate.Field("groups", name, "overlay")
+		o, ok := overlays[g.Overlay]
+		if !ok {
+			errs.Add(field, "unknown overlay %v", g.Overlay)
+			continue
+		}
+		if g.Redirect.Enabled() {
+			errs.Add(field, "overlay and redirect are mutually exclusive")
+			continue
+		}
+		info, err := o.bootstrapInfo()
+		if err != nil {
+			errs.Check(field, err)
+			continue
+		}
+		g.Redirect = RedirectConfig{
+			ConfigEndpoint: info.ConfigEndpoint,
+			ServerKey:      o.PrivateKey.PublicFromPrivate(),
+		}
+		groups[name] = g
+	}
+	c.Groups = groups
+	c.overlays = overlays
+	return c, errs.Err()
+}
+
+// startOverlay creates interfaces of the overlay and starts serving its
+// clients. stop undoes it.
+func startOverlay(m linkmgr.Manager, name string, cfg SrvConfig, events *wirebox.EventBus, eventLog *wirebox.EventLog, tracer *tracing.Tracer) (srv *Server, stop func(), err error) {
+	srv, err = initialize(m, cfg, events)
+	if err != nil {
+		return nil, nil, fmt.Errorf("overlay %v: %w", name, err)
+	}
+	srv.eventLog = eventLog
+	srv.Tracer = tracer
+
+	var cleanup []func()
+	stop = func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+	cleanup = append(cleanup, func() { srv.Close() })
+
+	for _, l := range append([]linkmgr.Link{srv.MasterLink}, srv.Tunnels...) {
+		if err := applySysctl(cfg, l); err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("overlay %v: %w", name, err)
+		}
+	}
+	srv.lock.Lock()
+	err = srv.applyIsolation()
+	srv.lock.Unlock()
+	if err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("overlay %v: %w", name, err)
+	}
+
+	cleanup = append(cleanup, srv.GoServe())
+
+	ctl, err := ctlsock.Listen(cfg.controlSocket(), srv.controlHandlers(), map[string]ctlsock.StreamHandler{
+		"logs": logging.Logs.Stream,
+	})
+	if err != nil {
+		log.Println("WARNING: overlay", name+":", err)
+	} else {
+		cleanup = append(cleanup, func() { ctl.Close() })
+	}
+
+	stopAccess := make(chan struct{})
+	cleanup = append(cleanup, func() { close(stopAccess) })
+	go srv.runAccess(stopAccess)
+
+	if cfg.PeersFile != "" {
+		stopWatch := make(chan struct{})
+		cleanup = append(cleanup, func() { close(stopWatch) })
+		go srv.watchPeers(cfg, cfg.peersInterval(), stopWatch)
+	}
+	if cfg.store != nil {
+		stopStore, err := srv.watchStore()
+		if err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("overlay %v: %w", name, err)
+		}
+		cleanup = append(cleanup, stopStore)
+	}
+
+	log.Println("overlay", name, "is served on", cfg.If)
+	return srv, stop, nil
+}
@@ -2,12 +2,12 @@ package wboxserver
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/foxcpp/wirebox"
 	"github.com/foxcpp/wirebox/linkmgr"
@@ -16,15 +16,36 @@ import (
 
 type ClientCfg struct {
 	ServerIf string
+	Hostname string
 
 	TunEndpoint4 net.IP
 	TunEndpoint6 net.IP
 	TunPort      int
 
-	Addrs  []net.IPNet
+	Addrs []net.IPNet
+	// Addresses were allocated from pool4/pool6 rather than reserved
+	// statically.
+	Leased bool
 	Routes []Route
+
+	Group string
+	// Networks the client may route for.
+	Subnets []net.IPNet
+	// Time windows the client access is permitted in, nil if not
+	// restricted.
+	Schedule Schedule
+	Quota    QuotaConfig
+
+	// Endpoint the server initiates the handshake to, nil if the client
+	// dials in.
+	Endpoint  *net.UDPAddr
+	Keepalive time.Duration
 }
 
+// defaultKeepalive is the persistent keepalive interval for clients with
+// static endpoints, it keeps NAT mappings on the way to them open.
+const defaultKeepalive = 25 * time.Second
+
 func allocateDynamicIP(poolNet *net.IPNet, poolOffset uint64, ipCounter uint64) (net.IP, error) {
 	_, bits := poolNet.Mask.Size()
 	ipLen := bits / 8
@@ -37,7 +58,7 @@ func allocateDynamicIP(poolNet *net.IPNet, poolOffset uint64, ipCounter uint64)
 	counterBytes := make([]byte, ipLen)
 	if ipLen == 4 {
 		if ipCounter >= math.MaxUint32 {
-			return nil, errors.New("allocate dynamic: too many IPs for IPv4")
+			return nil, fmt.Errorf("allocate dynamic: too many IPs for IPv4: %w", wirebox.ErrPoolExhausted)
 		}
 		binary.BigEndian.PutUint32(counterBytes, uint32(ipCounter))
 	} else {
@@ -55,11 +76,11 @@ func allocateDynamicIP(poolNet *net.IPNet, poolOffset uint64, ipCounter uint64)
 	if !poolNet.Contains(ip) {
 		// ORing ipCounter changed the network prefix part of IP. We used up
 		// entire allocation pool.
-		return nil, errors.New("not enough IPs in a pool subnet")
+		return nil, fmt.Errorf("allocate dynamic: %w", wirebox.ErrPoolExhausted)
 	}
 	if ipLen == 4 && ip[len(ip)-1] == 255 {
 		// We cannot allocate the IPv4 broadcast address.
-		return nil, errors.New("not enough IPs in a pool subnet")
+		return nil, fmt.Errorf("allocate dynamic: %w", wirebox.ErrPoolExhausted)
 	}
 
 	return ip, nil
@@ -69,15 +90,57 @@ func buildClientConfigs(cfg SrvConfig, clientKeys []wirebox.PeerKey) (map[wgtype
 	var (
 		staticIPs  = len(cfg.Clients)
 		dynamicIPs uint64
+		lastSlot   uint64
 	)
 
+	// Slots leased from the peer store are used where present, clients
+	// without them get ones after the highest leased slot.
+	for _, slot := range cfg.leases {
+		if slot > lastSlot {
+			lastSlot = slot
+		}
+	}
+
 	res := map[wgtypes.Key]ClientCfg{}
 	for i, pubKey := range clientKeys {
 		overrides := cfg.Clients[pubKey.Encoded]
 		clCfg := ClientCfg{
+			Hostname:     overrides.Hostname,
 			TunEndpoint4: overrides.TunEndpoint4.IP,
 			TunEndpoint6: overrides.TunEndpoint6.IP,
 			TunPort:      overrides.TunPort,
+			Group:        overrides.Group,
+		}
+		for _, n := range overrides.Subnets {
+			clCfg.Subnets = append(clCfg.Subnets, n.IPNet)
+		}
+		schedule := overrides.Schedule
+		if schedule == nil {
+			schedule = cfg.Groups[overrides.Group].Schedule
+		}
+		sched, err := ParseSchedule(schedule)
+		if err != nil {
+			return nil, fmt.Errorf("client %v: schedule: %w", pubKey, err)
+		}
+		clCfg.Schedule = sched
+		clCfg.Quota = overrides.Quota
+		if clCfg.Quota.Limit == 0 {
+			clCfg.Quota = cfg.Groups[overrides.Group].Quota
+		}
+
+		if overrides.Endpoint != "" {
+			// Names are resolved on each reconfiguration, failures are not
+			// fatal since the client can still dial in.
+			ep, err := net.ResolveUDPAddr("udp", overrides.Endpoint)
+			if err != nil {
+				log.Printf("WARNING: endpoint of %v not set: %v", pubKey, err)
+			} else {
+				clCfg.Endpoint = ep
+				clCfg.Keepalive = overrides.Keepalive.Duration
+				if clCfg.Keepalive == 0 {
+					clCfg.Keepalive = defaultKeepalive
+				}
+			}
 		}
 
 		// Set interface name to be used on the server side. If we are creating
@@ -89,8 +152,10 @@ func buildClientConfigs(cfg SrvConfig, clientKeys []wirebox.PeerKey) (map[wgtype
 			// port numbers used (PortLow is used for configuration tunnel,
 			// PortLow+1 for first client, etc).
 			clCfg.ServerIf = cfg.If + "-c" + strconv.Itoa(i+1)
+		} else {
+			clCfg.ServerIf = overrides.If
 		}
-		debugLog.Printf("using interface %v for %v", overrides.If, pubKey)
+		debugLog.Printf("using interface %v for %v", clCfg.ServerIf, pubKey)
 
 		// Override tunnel UDP endpoint to be used by the client. Aka "tunnel
 		// redirect".
@@ -115,9 +180,15 @@ func buildClientConfigs(cfg SrvConfig, clientKeys []wirebox.PeerKey) (map[wgtype
 		// If we have no static IPs for the client - assign some dynamically.
 		if len(overrides.Addrs) == 0 {
 			dynamicIPs++
+			slot, ok := cfg.leases[pubKey.Encoded]
+			if !ok {
+				lastSlot++
+				slot = lastSlot
+			}
+			clCfg.Leased = true
 
 			if cfg.Pool4.IP != nil {
-				ipv4, err := allocateDynamicIP(&cfg.Pool4.IPNet, cfg.Pool4Offset, dynamicIPs)
+				ipv4, err := allocateDynamicIP(&cfg.Pool4.IPNet, cfg.Pool4Offset, slot)
 				if err != nil {
 					log.Printf("ran out of dynamic IPv4s! cannot allocate one for %v: %v", pubKey, err)
 				} else {
@@ -126,7 +197,7 @@ func buildClientConfigs(cfg SrvConfig, clientKeys []wirebox.PeerKey) (map[wgtype
 				debugLog.Printf("dynamic IPv4 for %v: %v", pubKey, ipv4)
 			}
 			if cfg.Pool6.IP != nil {
-				ipv6, err := allocateDynamicIP(&cfg.Pool6.IPNet, cfg.Pool6Offset, dynamicIPs)
+				ipv6, err := allocateDynamicIP(&cfg.Pool6.IPNet, cfg.Pool6Offset, slot)
 				if err != nil {
 					log.Printf("ran out of dynamic IPv6s! cannot allocate one for %v: %v", pubKey, err)
 				} else {
@@ -181,80 +252,128 @@ func buildClientConfigs(cfg SrvConfig, clientKeys []wirebox.PeerKey) (map[wgtype
 	return res, nil
 }
 
-func configurePeerTuns(m linkmgr.Manager, cfg SrvConfig, clientKeys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg) (allIfs, links []linkmgr.Link, err error) {
-	allIfs = make([]linkmgr.Link, 0, len(clientKeys))
-	links = make([]linkmgr.Link, 0, len(clientKeys))
-
-	for _, pubKey := range clientKeys {
-		clCfg, ok := clientCfgs[pubKey.Bytes]
-		if !ok {
-			continue
+// indexAddrs maps addresses assigned to clients to their keys.
+func indexAddrs(clientCfgs map[wgtypes.Key]ClientCfg) map[string]wgtypes.Key {
+	res := make(map[string]wgtypes.Key, len(clientCfgs))
+	for key, clCfg := range clientCfgs {
+		for _, a := range clCfg.Addrs {
+			res[string(normalizeIP(a.IP))] = key
 		}
+	}
+	return res
+}
 
-		// Prepare addresses assignments for per-client interfaces. For PtP
-		// interface mode, this is always "local SERVER peer CLIENT/128".
-		addrs := []linkmgr.Address{}
-		for _, addr := range clCfg.Addrs {
-			server := cfg.Server6.IP
-			if to4 := addr.IP.To4(); to4 != nil {
-				addr.IP = to4
-				server = cfg.Server4.To4()
-			}
-			_, maskLen := addr.Mask.Size()
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
 
-			addrs = append(addrs, linkmgr.Address{
-				IPNet: net.IPNet{
-					IP:   server,
-					Mask: net.CIDRMask(maskLen, maskLen),
-				},
-				Peer: &net.IPNet{
-					IP:   addr.IP,
-					Mask: net.CIDRMask(maskLen, maskLen),
-				},
-				Scope: linkmgr.ScopeGlobal,
-			})
-		}
+// ClientByAddr returns the key and the configuration of the client the
+// address is assigned to.
+func (s *Server) ClientByAddr(ip net.IP) (wgtypes.Key, ClientCfg, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-		// Assign link-local address for configuration updates.
-		clientIPv6ll := wirebox.IPv6LLForClient(pubKey)
-		addrs = append(addrs, linkmgr.Address{
-			IPNet: net.IPNet{
-				IP:   wirebox.SolictIPv6,
-				Mask: net.CIDRMask(128, 128),
+	key, ok := s.addrOwners[string(normalizeIP(ip))]
+	if !ok {
+		return wgtypes.Key{}, ClientCfg{}, false
+	}
+	return key, s.ClientCfgs[key], true
+}
+
+type addrDerivation struct {
+	name string
+	addr func(wirebox.PeerKey) net.IP
+}
+
+// addrDerivations returns functions deriving configuration addresses for
+// all accepted schemes and IPv4 if enabled.
+func (c SrvConfig) addrDerivations() []addrDerivation {
+	var res []addrDerivation
+	for _, scheme := range c.addrSchemes() {
+		scheme := scheme
+		res = append(res, addrDerivation{
+			name: scheme.String() + " scheme",
+			addr: func(pubKey wirebox.PeerKey) net.IP {
+				return wirebox.ConfigAddr(pubKey, scheme, []byte(c.AddrSalt))
 			},
-			Peer: &net.IPNet{
-				IP:   clientIPv6ll,
-				Mask: net.CIDRMask(128, 128),
+		})
+	}
+	if c.ConfigIPv4 {
+		res = append(res, addrDerivation{
+			name: "IPv4",
+			addr: func(pubKey wirebox.PeerKey) net.IP {
+				return wirebox.ConfigAddr4(pubKey, []byte(c.AddrSalt))
 			},
-			Scope: linkmgr.ScopeLink,
 		})
+	}
+	return res
+}
 
-		// Add all assigned peer addresses to the cryptokey router config so
-		// Wireguard will let it through.
-		allowedIPs := make([]net.IPNet, 0, len(clCfg.Addrs))
-		for _, addr := range clCfg.Addrs {
-			_, maskLen := addr.Mask.Size()
-			allowedIPs = append(allowedIPs, net.IPNet{
-				IP:   addr.IP,
-				Mask: net.CIDRMask(maskLen, maskLen),
-			})
+// maxConfigIPv4Clients is the number of clients above which IPv4
+// configuration address collisions become likely (over 7%).
+const maxConfigIPv4Clients = 100
+
+// configAddrs derives the configuration tunnel link-local addresses for all
+// clients using all accepted schemes.
+//
+// Addresses that collide between different clients are not used for any of
+// them since Allowed IPs cannot contain the same address for multiple peers.
+func configAddrs(cfg SrvConfig, clientKeys []wirebox.PeerKey) map[wgtypes.Key][]net.IP {
+	if n := len(clientKeys); cfg.ConfigIPv4 && n > maxConfigIPv4Clients {
+		expected := float64(n) * float64(n-1) / 2 / wirebox.ConfigAddrs4
+		log.Printf("WARNING: config-ipv4: %d clients share %d IPv4 configuration addresses, about %.1f collisions are expected", n, wirebox.ConfigAddrs4, expected)
+	}
+
+	var (
+		owners     = map[string]wirebox.PeerKey{}
+		collisions = map[string]bool{}
+	)
+	for _, d := range cfg.addrDerivations() {
+		for _, pubKey := range clientKeys {
+			addr := d.addr(pubKey)
+			owner, ok := owners[string(addr)]
+			if ok && owner.Bytes != pubKey.Bytes {
+				log.Printf("WARNING: configuration address %v (%v) collides for %v and %v, it will not be used", addr, d.name, owner, pubKey)
+				collisions[string(addr)] = true
+				continue
+			}
+			owners[string(addr)] = pubKey
 		}
-		allowedIPs = append(allowedIPs, net.IPNet{
-			IP:   clientIPv6ll,
-			Mask: net.CIDRMask(128, 128),
-		})
+	}
 
-		iface, created, err := wirebox.CreateWG(m, clCfg.ServerIf, wgtypes.Config{
-			PrivateKey:   &pubKey.Bytes,
-			ReplacePeers: true,
-			ListenPort:   &clCfg.TunPort,
-			Peers: []wgtypes.PeerConfig{
-				{
-					PublicKey:  pubKey.Bytes,
-					AllowedIPs: allowedIPs,
-				},
-			},
-		}, addrs)
+	res := make(map[wgtypes.Key][]net.IP, len(clientKeys))
+	for _, d := range cfg.addrDerivations() {
+		for _, pubKey := range clientKeys {
+			addr := d.addr(pubKey)
+			if collisions[string(addr)] {
+				continue
+			}
+			res[pubKey.Bytes] = append(res[pubKey.Bytes], addr)
+			debugLog.Printf("configuration address for %v (%v): %v", pubKey, d.name, addr)
+		}
+	}
+	for _, pubKey := range clientKeys {
+		if len(res[pubKey.Bytes]) == 0 {
+			log.Printf("no usable configuration address for %v, it will be unable to request configuration", pubKey)
+		}
+	}
+	return res
+}
+
+func configurePeerTuns(m linkmgr.Manager, cfg SrvConfig, clientKeys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg, cfgAddrs map[wgtypes.Key][]net.IP) (allIfs, links []linkmgr.Link, err error) {
+	allIfs = make([]linkmgr.Link, 0, len(clientKeys))
+	links = make([]linkmgr.Link, 0, len(clientKeys))
+
+	for _, pubKey := range clientKeys {
+		clCfg, ok := clientCfgs[pubKey.Bytes]
+		if !ok {
+			continue
+		}
+
+		iface, created, err := peerTunSpec(cfg, pubKey, clCfg, cfgAddrs[pubKey.Bytes]).create(m)
 		if err != nil {
 			for _, iface := range links {
 				if err := m.DelLink(iface.Index()); err != nil {
@@ -277,3 +396,94 @@ func configurePeerTuns(m linkmgr.Manager, cfg SrvConfig, clientKeys []wirebox.Pe
 
 	return allIfs, links, nil
 }
+
+// withEndpoint sets the endpoint and keepalive of the client with the static
+// endpoint so WireGuard initiates the handshake.
+func (c ClientCfg) withEndpoint(p wgtypes.PeerConfig) wgtypes.PeerConfig {
+	if c.Endpoint == nil {
+		return p
+	}
+	keepalive := c.Keepalive
+	p.Endpoint = c.Endpoint
+	p.PersistentKeepaliveInterval = &keepalive
+	return p
+}
+
+// peerTunSpec returns the configuration of the per-client interface used in
+// point-to-point mode.
+func peerTunSpec(cfg SrvConfig, pubKey wirebox.PeerKey, clCfg ClientCfg, cfgAddrs []net.IP) linkSpec {
+	// Prepare addresses assignments for per-client interfaces. For PtP
+	// interface mode, this is always "local SERVER peer CLIENT/128".
+	addrs := []linkmgr.Address{}
+	for _, addr := range clCfg.Addrs {
+		server := cfg.Server6.IP
+		if to4 := addr.IP.To4(); to4 != nil {
+			addr.IP = to4
+			server = cfg.Server4.To4()
+		}
+		_, maskLen := addr.Mask.Size()
+
+		addrs = append(addrs, linkmgr.Address{
+			IPNet: net.IPNet{
+				IP:   server,
+				Mask: net.CIDRMask(maskLen, maskLen),
+			},
+			Peer: &net.IPNet{
+				IP:   addr.IP,
+				Mask: net.CIDRMask(maskLen, maskLen),
+			},
+			Scope: linkmgr.ScopeGlobal,
+		})
+	}
+
+	// Assign link-local address for configuration updates.
+	for _, clientLL := range cfgAddrs {
+		solictIP, bits := wirebox.SolictIPv6, 128
+		if clientLL.To4() != nil {
+			solictIP, bits = wirebox.SolictIPv4, 32
+		}
+		addrs = append(addrs, linkmgr.Address{
+			IPNet: net.IPNet{
+				IP:   solictIP,
+				Mask: net.CIDRMask(bits, bits),
+			},
+			Peer: &net.IPNet{
+				IP:   clientLL,
+				Mask: net.CIDRMask(bits, bits),
+			},
+			Scope: linkmgr.ScopeLink,
+		})
+	}
+
+	// Add all assigned peer addresses to the cryptokey router config so
+	// Wireguard will let it through.
+	allowedIPs := make([]net.IPNet, 0, len(clCfg.Addrs))
+	for _, addr := range clCfg.Addrs {
+		_, maskLen := addr.Mask.Size()
+		allowedIPs = append(allowedIPs, net.IPNet{
+			IP:   addr.IP,
+			Mask: net.CIDRMask(maskLen, maskLen),
+		})
+	}
+	for _, clientIPv6ll := range cfgAddrs {
+		allowedIPs = append(allowedIPs, net.IPNet{
+			IP:   clientIPv6ll,
+			Mask: net.CIDRMask(128, 128),
+		})
+	}
+
+	return cfg.standbySpec(linkSpec{
+		Name: clCfg.ServerIf,
+		WG: wgtypes.Config{
+			PrivateKey: &pubKey.Bytes,
+			ListenPort: &clCfg.TunPort,
+			Peers: []wgtypes.PeerConfig{
+				clCfg.withEndpoint(wgtypes.PeerConfig{
+					PublicKey:  pubKey.Bytes,
+					AllowedIPs: allowedIPs,
+				}),
+			},
+		},
+		Addrs: addrs,
+	})
+}
@@ -0,0 +1,240 @@
+package wboxserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/policy"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/validate"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+const (
+	PolicyDeny   = "deny"
+	PolicyAllow  = "allow"
+	PolicyModify = "modify"
+)
+
+// PolicyRule is evaluated for each solictation of a configured client. Rules
+// are evaluated in order until one denies or allows the configuration,
+// modifying rules apply their changes and evaluation continues.
+type PolicyRule struct {
+	// Name of the rule used in logs.
+	Name string `toml:"name"`
+	// CEL expression selecting solictations the rule applies to (see
+	// policyVars), the rule applies to all of them if empty.
+	When string `toml:"when"`
+	// "deny", "allow" or "modify" (the default).
+	Action string `toml:"action"`
+	// Sent to the client with the policy-denied NACK.
+	Reason string `toml:"reason"`
+
+	// Replaces the message sent with the configuration. This and the options
+	// below apply to "allow" and "modify" rules, "deny" rules cannot set them.
+	Motd string `toml:"motd"`
+	// Do not send routes, mesh peers or hosts to the client.
+	NoRoutes bool `toml:"no-routes"`
+	NoMesh   bool `toml:"no-mesh"`
+	NoHosts  bool `toml:"no-hosts"`
+	// Labels added to the log message about the configuration.
+	Annotations map[string]string `toml:"annotations"`
+}
+
+// policyVars are variables available to PolicyRule.When.
+var policyVars = []policy.Var{
+	// Client public key, group and hostname.
+	{Name: "key", Type: cel.StringType},
+	{Name: "group", Type: cel.StringType},
+	{Name: "hostname", Type: cel.StringType},
+	// Version and capabilities reported by the client.
+	{Name: "version", Type: cel.StringType},
+	{Name: "caps", Type: cel.ListType(cel.StringType)},
+	// Client tunnel addresses, the address the client tunnel is connected
+	// from (empty if unknown) and whether the server dials the client.
+	{Name: "addrs", Type: cel.ListType(cel.StringType)},
+	{Name: "source", Type: cel.StringType},
+	{Name: "static", Type: cel.BoolType},
+	// Time in time-zone: weekday ("Mon"), hour and minute.
+	{Name: "weekday", Type: cel.StringType},
+	{Name: "hour", Type: cel.IntType},
+	{Name: "minute", Type: cel.IntType},
+}
+
+var policyEnv = policy.Env{
+	Vars: policyVars,
+	Funcs: []cel.EnvOption{
+		// versionAtLeast(version, "1.2.0") is false for development builds
+		// and clients not reporting the version.
+		cel.Function("versionAtLeast",
+			cel.Overload("versionAtLeast_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(func(version, min ref.Val) ref.Val {
+					v, _ := version.Value().(string)
+					m, ok := min.Value().(string)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(min)
+					}
+					cmp, err := wirebox.CompareVersions(v, m)
+					return types.Bool(err == nil && cmp >= 0)
+				}),
+			),
+		),
+	},
+}
+
+type compiledRule struct {
+	PolicyRule
+	when *policy.Expr
+}
+
+func (r PolicyRule) compile() (compiledRule, error) {
+	c := compiledRule{PolicyRule: r}
+	switch r.Action {
+	case PolicyDeny, PolicyAllow, PolicyModify, "":
+	default:
+		return c, fmt.Errorf("unknown action %v", r.Action)
+	}
+	if r.When != "" {
+		var err error
+		c.when, err = policy.Compile(r.When, policyEnv)
+		if err != nil {
+			return c, fmt.Errorf("when: %w", err)
+		}
+	}
+	if r.Action == PolicyDeny && (r.Motd != "" || r.NoRoutes || r.NoMesh || r.NoHosts) {
+		return c, errors.New("motd, no-routes, no-mesh and no-hosts cannot be used with deny")
+	}
+	if len(r.Motd) > maxMotd {
+		return c, fmt.Errorf("motd should not be longer than %d bytes", maxMotd)
+	}
+	return c, nil
+}
+
+// withPolicy returns the copy of the configuration with policy rules
+// compiled. Rules are checked by Validate.
+func (c SrvConfig) withPolicy() (SrvConfig, error) {
+	c.policy = make([]compiledRule, 0, len(c.Policy))
+	for i, r := range c.Policy {
+		compiled, err := r.compile()
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("%v: %w", validate.Field("policy", strconv.Itoa(i)), err)
+		}
+		c.policy = append(c.policy, compiled)
+	}
+	return c, nil
+}
+
+// policyDecision is the result of policy evaluation for one solictation.
+type policyDecision struct {
+	Denied bool
+	// Name (or index) of the rule that denied the configuration.
+	Rule   string
+	Reason string
+
+	Motd        string
+	NoRoutes    bool
+	NoMesh      bool
+	NoHosts     bool
+	Annotations map[string]string
+}
+
+func (d policyDecision) String() string {
+	keys := make([]string, 0, len(d.Annotations))
+	for k := range d.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+d.Annotations[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// evalPolicy evaluates policy rules for the solictation. Rules failing to
+// evaluate deny the configuration. The lock should be held by the caller.
+func (s *Server) evalPolicy(key wirebox.PeerKey, clCfg ClientCfg, msg *wboxproto.CfgSolict) policyDecision {
+	var d policyDecision
+	if len(s.Cfg.policy) == 0 {
+		return d
+	}
+
+	now := s.Cfg.now()
+	addrs := make([]string, 0, len(clCfg.Addrs))
+	for _, a := range clCfg.Addrs {
+		addrs = append(addrs, a.IP.String())
+	}
+	source := ""
+	if h := s.endpoints[key.Bytes]; h != nil {
+		if host, _, err := net.SplitHostPort(h.last); err == nil {
+			source = host
+		}
+	}
+	vars := map[string]interface{}{
+		"key":      key.Encoded,
+		"group":    clCfg.Group,
+		"hostname": clCfg.Hostname,
+		"version":  msg.GetVersion(),
+		"caps":     msg.GetCapabilities(),
+		"addrs":    addrs,
+		"source":   source,
+		"static":   clCfg.Endpoint != nil,
+		"weekday":  now.Weekday().String()[:3],
+		"hour":     int64(now.Hour()),
+		"minute":   int64(now.Minute()),
+	}
+
+	for i, r := range s.Cfg.policy {
+		name := r.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+		if r.when != nil {
+			match, err := r.when.Eval(vars)
+			if err != nil {
+				d.Denied = true
+				d.Rule = name
+				d.Reason = "policy evaluation failed"
+				d.Annotations = map[string]string{"error": err.Error()}
+				return d
+			}
+			if !match {
+				continue
+			}
+		}
+
+		for k, v := range r.Annotations {
+			if d.Annotations == nil {
+				d.Annotations = make(map[string]string)
+			}
+			d.Annotations[k] = v
+		}
+		switch r.Action {
+		case PolicyDeny:
+			d.Denied = true
+			d.Rule = name
+			d.Reason = r.Reason
+			if d.Reason == "" {
+				d.Reason = "access is denied by the server policy"
+			}
+			return d
+		}
+		if r.Motd != "" {
+			d.Motd = r.Motd
+		}
+		d.NoRoutes = d.NoRoutes || r.NoRoutes
+		d.NoMesh = d.NoMesh || r.NoMesh
+		d.NoHosts = d.NoHosts || r.NoHosts
+		if r.Action == PolicyAllow {
+			return d
+		}
+	}
+	return d
+}
@@ -0,0 +1,79 @@
+package wboxserver
+
+import (
+	"net"
+	"testing"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestEvalPolicy(t *testing.T) {
+	_, key := testKey(t)
+	cfg, err := SrvConfig{Policy: []PolicyRule{
+		{
+			Name:   "no-contractors-outside",
+			When:   `group == "contractors" && !inNet(source, "198.51.100.0/24")`,
+			Action: PolicyDeny,
+			Reason: "use the office network",
+		},
+		{
+			When:        `!versionAtLeast(version, "1.4.0") || !("mesh" in caps)`,
+			Motd:        "Your client is outdated, please upgrade.",
+			NoMesh:      true,
+			Annotations: map[string]string{"outdated": "true"},
+		},
+		{
+			When:   `addrs.exists(a, inNet(a, "10.0.0.0/8"))`,
+			Action: PolicyAllow,
+		},
+		{
+			Action:   PolicyModify,
+			NoRoutes: true,
+		},
+	}}.withPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Cfg:       cfg,
+		endpoints: map[wgtypes.Key]*endpointHistory{key.Bytes: {last: "203.0.113.1:51820"}},
+	}
+	addr := func(ip string) net.IPNet {
+		return net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(32, 32)}
+	}
+
+	d := s.evalPolicy(key, ClientCfg{Group: "contractors"}, &wboxproto.CfgSolict{})
+	if !d.Denied || d.Rule != "no-contractors-outside" || d.Reason != "use the office network" {
+		t.Errorf("contractor outside of the office: %+v", d)
+	}
+
+	// Old client without capabilities, allowed by the address.
+	d = s.evalPolicy(key, ClientCfg{Addrs: []net.IPNet{addr("10.1.2.3")}}, &wboxproto.CfgSolict{Version: "1.2.0"})
+	if d.Denied || !d.NoMesh || d.NoRoutes || d.Motd == "" || d.Annotations["outdated"] != "true" {
+		t.Errorf("outdated client: %+v", d)
+	}
+
+	d = s.evalPolicy(key, ClientCfg{Addrs: []net.IPNet{addr("192.0.2.3")}}, &wboxproto.CfgSolict{
+		Version:      "1.5.0",
+		Capabilities: []string{"mesh"},
+	})
+	if d.Denied || d.NoMesh || !d.NoRoutes || d.Annotations != nil {
+		t.Errorf("current client: %+v", d)
+	}
+}
+
+func TestPolicyCompileErrors(t *testing.T) {
+	for _, r := range []PolicyRule{
+		{When: `group == 1`},
+		{When: `versionAtLeast(version)`},
+		{When: `hour`},
+		{When: `nope`},
+		{Action: "maybe"},
+		{Action: PolicyDeny, Motd: "hi"},
+	} {
+		if _, err := r.compile(); err == nil {
+			t.Errorf("%+v: compile succeeded", r)
+		}
+	}
+}
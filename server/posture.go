@@ -0,0 +1,38 @@
+package wboxserver
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/wirebox"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+// checkPosture returns the reason to refuse the client if its version or
+// capabilities reported in the solictation do not satisfy the policy, empty
+// string otherwise.
+func (c SrvConfig) checkPosture(msg *wboxproto.CfgSolict) string {
+	if c.MinClientVersion != "" {
+		version := msg.GetVersion()
+		if version == "" {
+			return "client version is not reported, upgrade to " + c.MinClientVersion + " or newer"
+		}
+		cmp, err := wirebox.CompareVersions(version, c.MinClientVersion)
+		if err != nil {
+			return fmt.Sprintf("client version %q is not a release, %v or newer is required", version, c.MinClientVersion)
+		}
+		if cmp < 0 {
+			return fmt.Sprintf("client version %v is older than required %v", version, c.MinClientVersion)
+		}
+	}
+
+	have := make(map[string]bool, len(msg.GetCapabilities()))
+	for _, capability := range msg.GetCapabilities() {
+		have[capability] = true
+	}
+	for _, capability := range c.RequiredCapabilities {
+		if !have[capability] {
+			return fmt.Sprintf("client does not support %v, upgrade is required", capability)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package wboxserver
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/audit"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// quotaUsage is the transfer accounting of the client in the current quota
+// period. Usage is kept in memory only, after a restart it starts from
+// counters of peers on existing interfaces.
+type quotaUsage struct {
+	// Start of the current period, zero if the quota is never reset.
+	period time.Time
+	used   uint64
+	// Peer counters at the last check, counters are reset when the peer is
+	// recreated.
+	lastRx, lastTx int64
+
+	exceeded  bool
+	throttled bool
+}
+
+// periodStart returns the start of the quota period containing now.
+func periodStart(now time.Time, reset string) time.Time {
+	y, m, d := now.Date()
+	switch reset {
+	case "daily":
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	case "weekly":
+		return time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, now.Location())
+	case "monthly":
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Time{}
+}
+
+func counterDelta(cur, last int64) uint64 {
+	if cur < last {
+		// Peer was recreated.
+		return uint64(cur)
+	}
+	return uint64(cur - last)
+}
+
+// quotaTC is the tc change decided by updateQuotas, it is run without the
+// lock.
+type quotaTC struct {
+	key  wgtypes.Key
+	link string
+	// Rate to throttle the client to, the qdisc is removed if empty.
+	rate string
+}
+
+// peerCounters are transfer counters of the client peer.
+type peerCounters struct {
+	rx, tx int64
+	// The peer is not on the interface.
+	missing bool
+}
+
+// readQuotaCounters reads counters of peers of clients from their server
+// interfaces. Clients whose interface cannot be read are missing from the
+// result.
+func (s *Server) readQuotaCounters(clients map[wgtypes.Key]ClientCfg) map[wgtypes.Key]peerCounters {
+	devs := map[string]*wgtypes.Device{}
+	res := make(map[wgtypes.Key]peerCounters, len(clients))
+	for key, clCfg := range clients {
+		dev, ok := devs[clCfg.ServerIf]
+		if !ok {
+			l, err := s.m.GetLink(clCfg.ServerIf)
+			if err == nil {
+				dev, err = l.WGConfig()
+			}
+			if err != nil {
+				log.Println("error: quota:", err)
+			}
+			devs[clCfg.ServerIf] = dev
+		}
+		if dev == nil {
+			continue
+		}
+		c := peerCounters{missing: true}
+		for _, p := range dev.Peers {
+			if p.PublicKey == key {
+				c = peerCounters{rx: p.ReceiveBytes, tx: p.TransmitBytes}
+			}
+		}
+		res[key] = c
+	}
+	return res
+}
+
+// updateQuotas adds traffic of clients with quotas since the last call to
+// their usage, starts new periods and applies quota actions except
+// disconnect, which is applied by enforceAccess. Counters are read and tc is
+// run without the lock, it is held only to update usage.
+func (s *Server) updateQuotas() {
+	s.lock.RLock()
+	now := s.Cfg.now()
+	clients := make(map[wgtypes.Key]ClientCfg)
+	for key, clCfg := range s.ClientCfgs {
+		if clCfg.Quota.Limit != 0 {
+			clients[key] = clCfg
+		}
+	}
+	s.lock.RUnlock()
+
+	counters := s.readQuotaCounters(clients)
+
+	var changes []quotaTC
+	s.lock.Lock()
+	for key, u := range s.quotas {
+		if clCfg, ok := s.ClientCfgs[key]; !ok || clCfg.Quota.Limit == 0 {
+			// Interfaces of removed clients are deleted together with the
+			// qdisc.
+			if ok && u.throttled {
+				changes = append(changes, quotaTC{key: key, link: clCfg.ServerIf})
+			}
+			delete(s.quotas, key)
+		}
+	}
+	for key, c := range counters {
+		clCfg, ok := s.ClientCfgs[key]
+		if !ok || clCfg.Quota.Limit == 0 {
+			// Removed while counters were read.
+			continue
+		}
+
+		u := s.quotas[key]
+		if u == nil {
+			u = &quotaUsage{period: periodStart(now, clCfg.Quota.Reset)}
+			if s.quotas == nil {
+				s.quotas = make(map[wgtypes.Key]*quotaUsage)
+			}
+			s.quotas[key] = u
+		}
+		if !c.missing {
+			u.used += counterDelta(c.rx, u.lastRx) + counterDelta(c.tx, u.lastTx)
+			u.lastRx, u.lastTx = c.rx, c.tx
+		}
+
+		if start := periodStart(now, clCfg.Quota.Reset); !start.Equal(u.period) {
+			log.Printf("quota: %v used %v in the last period, reset", key, ByteSize(u.used))
+			u.period = start
+			u.used = 0
+			u.exceeded = false
+			if u.throttled {
+				changes = append(changes, quotaTC{key: key, link: clCfg.ServerIf})
+			}
+		}
+
+		if u.exceeded || u.used < uint64(clCfg.Quota.Limit) {
+			continue
+		}
+		u.exceeded = true
+		action := clCfg.Quota.Action
+		if action == "" {
+			action = QuotaWarn
+		}
+		log.Printf("WARNING: quota: %v used %v of %v, action: %v", key, ByteSize(u.used), clCfg.Quota.Limit, action)
+		s.Events.Emit(wirebox.QuotaExceeded{
+			Link:   clCfg.ServerIf,
+			Peer:   key.String(),
+			Used:   u.used,
+			Limit:  uint64(clCfg.Quota.Limit),
+			Action: action,
+		})
+		if action == QuotaThrottle {
+			changes = append(changes, quotaTC{key: key, link: clCfg.ServerIf, rate: clCfg.Quota.Rate})
+		}
+	}
+	s.lock.Unlock()
+
+	for _, c := range changes {
+		var err error
+		if c.rate != "" {
+			err = tc("qdisc", "replace", "dev", c.link, "root", "tbf",
+				"rate", c.rate, "burst", "32kbit", "latency", "400ms")
+		} else {
+			err = tc("qdisc", "del", "dev", c.link, "root")
+		}
+		if err != nil {
+			log.Println("error: quota:", err)
+			continue
+		}
+
+		s.lock.Lock()
+		if u := s.quotas[c.key]; u != nil {
+			u.throttled = c.rate != ""
+		}
+		s.lock.Unlock()
+	}
+}
+
+func tc(args ...string) error {
+	cmd := exec.Command("tc", args...)
+	audit.Command(cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %v: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
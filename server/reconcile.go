@@ -0,0 +1,266 @@
+package wboxserver
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reconcile changes the running server to match cfg. Only the set of clients
+// and their settings are updated, changes to server interface settings
+// require a restart.
+func (s *Server) Reconcile(cfg SrvConfig) error {
+	// The standby must not change leases, see leaseAddrs.
+	s.lock.RLock()
+	cfg.standby = s.Cfg.standby
+	s.lock.RUnlock()
+
+	keys, err := clientKeys(cfg)
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+	cfg, err = leaseAddrs(cfg, keys)
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+	clientCfgs, err := buildClientConfigs(cfg, keys)
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+	cfgAddrs := configAddrs(cfg, keys)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// cfg can be copied before the role changed.
+	cfg.standby = s.Cfg.standby
+
+	if cfg.PtMP {
+		spec := multipointLinkSpec(cfg, keys, clientCfgs, cfgAddrs)
+		if _, _, err := spec.create(s.m); err != nil {
+			return fmt.Errorf("reconcile: %w", err)
+		}
+		if err := pruneAddrs(s.MasterLink, spec.Addrs); err != nil {
+			return fmt.Errorf("reconcile: %w", err)
+		}
+	} else {
+		if err := s.reconcilePeerTuns(cfg, keys, clientCfgs, cfgAddrs); err != nil {
+			return fmt.Errorf("reconcile: %w", err)
+		}
+	}
+
+	s.Cfg = cfg
+	s.ClientCfgs = clientCfgs
+	s.addrOwners = indexAddrs(clientCfgs)
+	s.serial++
+	s.cfgCache.reset()
+	s.reapplySites()
+	if err := s.applyIsolation(); err != nil {
+		log.Println("error:", err)
+	}
+	s.setConflicts(findConflicts(keys, clientCfgs))
+	if !cfg.standby {
+		s.enforceAccess(true)
+	}
+	s.triggerDNS()
+	s.triggerBGP()
+	return nil
+}
+
+func (s *Server) reconcilePeerTuns(cfg SrvConfig, keys []wirebox.PeerKey, clientCfgs map[wgtypes.Key]ClientCfg, cfgAddrs map[wgtypes.Key][]net.IP) error {
+	// Update the configuration interface first so removed clients cannot
+	// request configuration anymore.
+	confSpec := confLinkSpec(cfg, keys, cfgAddrs)
+	if _, _, err := confSpec.create(s.m); err != nil {
+		return err
+	}
+	if err := pruneAddrs(s.MasterLink, confSpec.Addrs); err != nil {
+		return err
+	}
+
+	specs := make([]linkSpec, 0, len(keys))
+	wanted := make(map[string]bool, len(keys))
+	for _, pubKey := range keys {
+		clCfg, ok := clientCfgs[pubKey.Bytes]
+		if !ok {
+			continue
+		}
+		spec := peerTunSpec(cfg, pubKey, clCfg, cfgAddrs[pubKey.Bytes])
+		specs = append(specs, spec)
+		wanted[spec.Name] = true
+	}
+
+	existing := make(map[string]bool, len(s.Tunnels))
+	tunnels := make([]linkmgr.Link, 0, len(specs))
+	for _, l := range s.Tunnels {
+		if wanted[l.Name()] {
+			existing[l.Name()] = true
+			tunnels = append(tunnels, l)
+			continue
+		}
+		for _, sc := range s.linkConns(l) {
+			s.stopServeConn(sc)
+			s.SolictConns = removeConn(s.SolictConns, sc)
+			delete(s.connLinks, sc)
+		}
+		s.NewTunnels = removeLink(s.NewTunnels, l)
+		log.Println("removing link", l.Name())
+		s.delLink(l)
+	}
+
+	for _, spec := range specs {
+		l, created, err := spec.create(s.m)
+		if err != nil {
+			s.Tunnels = tunnels
+			return err
+		}
+		if err := pruneAddrs(l, spec.Addrs); err != nil {
+			s.Tunnels = tunnels
+			return err
+		}
+		if existing[spec.Name] {
+			continue
+		}
+
+		conns, err := listenSolict(cfg, l)
+		if err != nil {
+			if created {
+				s.delLink(l)
+			}
+			s.Tunnels = tunnels
+			return err
+		}
+		for _, sc := range conns {
+			s.SolictConns = append(s.SolictConns, sc)
+			s.connLinks[sc] = l.Name()
+			if s.serveStops != nil {
+				s.goServeConn(sc)
+			}
+		}
+
+		if err := applySysctl(cfg, l); err != nil {
+			log.Println("error:", err)
+		}
+
+		tunnels = append(tunnels, l)
+		if created {
+			log.Println("created link", l.Name())
+			s.NewTunnels = append(s.NewTunnels, l)
+			s.Events.Emit(wirebox.LinkCreated{Link: l.Name()})
+		} else {
+			log.Println("using existing link", l.Name())
+		}
+	}
+
+	s.Tunnels = tunnels
+	return nil
+}
+
+// linkConns returns solictation sockets bound to the interface.
+func (s *Server) linkConns(l linkmgr.Link) []*net.UDPConn {
+	var res []*net.UDPConn
+	for _, sc := range s.SolictConns {
+		if s.connLinks[sc] == l.Name() {
+			res = append(res, sc)
+		}
+	}
+	return res
+}
+
+func removeConn(conns []*net.UDPConn, c *net.UDPConn) []*net.UDPConn {
+	res := conns[:0]
+	for _, sc := range conns {
+		if sc != c {
+			res = append(res, sc)
+		}
+	}
+	return res
+}
+
+func removeLink(links []linkmgr.Link, l linkmgr.Link) []linkmgr.Link {
+	res := links[:0]
+	for _, link := range links {
+		if link.Index() != l.Index() {
+			res = append(res, link)
+		}
+	}
+	return res
+}
+
+// pruneAddrs removes peer addresses that are not in the spec anymore.
+// Addresses without peer are assigned to the interface as a whole and left
+// as is.
+func pruneAddrs(l linkmgr.Link, want []linkmgr.Address) error {
+	current, err := l.Addrs()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(want))
+	for _, a := range want {
+		if a.Peer != nil {
+			wanted[a.IPNet.String()+" peer "+a.Peer.String()] = true
+		}
+	}
+	for _, a := range current {
+		if a.Peer == nil || wanted[a.IPNet.String()+" peer "+a.Peer.String()] {
+			continue
+		}
+		debugLog.Printf("removing address %v peer %v from %v", a.IPNet.String(), a.Peer, l.Name())
+		if err := l.DelAddr(a); err != nil {
+			return fmt.Errorf("del addr %v: %w", a.IPNet.String(), err)
+		}
+	}
+	return nil
+}
+
+// watchPeers polls the peers file and reconciles the server when its
+// contents change. Polling is used instead of inotify since Kubernetes
+// updates mounted ConfigMaps by swapping symlinks.
+func (s *Server) watchPeers(baseCfg SrvConfig, interval time.Duration, stop <-chan struct{}) {
+	last, _, err := readPeerSpec(baseCfg.PeersFile)
+	if err != nil {
+		log.Println("error:", err)
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		blob, spec, err := readPeerSpec(baseCfg.PeersFile)
+		if bytes.Equal(blob, last) {
+			continue
+		}
+		last = blob
+		if err != nil {
+			log.Println("error: peers file not applied:", err)
+			continue
+		}
+
+		// The current configuration is used so clients loaded from the
+		// peer store since the start are kept.
+		s.lock.RLock()
+		cfg := s.Cfg.withSpec(spec)
+		s.lock.RUnlock()
+		if err := cfg.Validate(); err != nil {
+			log.Println("error: peers file not applied:", err)
+			continue
+		}
+		if err := s.Reconcile(cfg); err != nil {
+			log.Println("error: peers file:", err)
+			continue
+		}
+		log.Println("applied peers file,", len(spec.Clients), "clients in spec")
+	}
+}
@@ -0,0 +1,255 @@
+package wboxserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.org/x/crypto/blake2s"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WireGuard message types and lengths, see the Protocol & Cryptography
+// section of the WireGuard whitepaper.
+const (
+	wgInitiation  = 1
+	wgResponse    = 2
+	wgCookieReply = 3
+	wgData        = 4
+
+	wgInitiationLen  = 148
+	wgResponseLen    = 92
+	wgCookieReplyLen = 64
+	// Header and the authentication tag of an empty (keepalive) packet.
+	wgMinDataLen = 32
+
+	// Offsets of mac1 in handshake messages, it covers everything before
+	// it.
+	wgInitiationMAC1 = 116
+	wgResponseMAC1   = 60
+)
+
+// relayIdle is how long the relay is kept without forwarded packets. Peers
+// using it send keepalives much more often.
+const relayIdle = 5 * time.Minute
+
+// relayPair identifies the relay by the keys of both clients, the lower key
+// goes first.
+type relayPair [2]wgtypes.Key
+
+func newRelayPair(a, b wgtypes.Key) relayPair {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return relayPair{a, b}
+}
+
+// relay forwards WireGuard packets between two clients that cannot reach
+// each other directly. The traffic stays encrypted end-to-end, the server
+// only learns addresses of both sides from their handshake messages.
+type relay struct {
+	pair relayPair
+	conn *net.UDPConn
+	port int
+
+	// Keys handshake messages for each side are authenticated with.
+	mac1Keys [2][blake2s.Size]byte
+	// Addresses of each side, only accessed by the serve goroutine.
+	addrs [2]*net.UDPAddr
+}
+
+func mac1Key(key wgtypes.Key) [blake2s.Size]byte {
+	return blake2s.Sum256(append([]byte("mac1----"), key[:]...))
+}
+
+func validMAC1(key [blake2s.Size]byte, msg []byte, offset int) bool {
+	h, err := blake2s.New128(key[:])
+	if err != nil {
+		return false
+	}
+	h.Write(msg[:offset])
+	return bytes.Equal(h.Sum(nil), msg[offset:offset+blake2s.Size128])
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// route returns the address msg received from src should be forwarded to,
+// nil if it should be dropped.
+//
+// Handshake messages carry mac1 keyed with the public key of the receiver,
+// so the sender is the other side of the pair and its address is updated,
+// which also follows clients whose NAT mappings change. mac1 only proves the
+// sender knows the public key, but the worst a third party can do is to
+// divert packets it cannot decrypt until the next handshake.
+func (r *relay) route(msg []byte, src *net.UDPAddr) *net.UDPAddr {
+	if len(msg) < 4 || msg[1] != 0 || msg[2] != 0 || msg[3] != 0 {
+		return nil
+	}
+	var offset int
+	switch msg[0] {
+	case wgInitiation:
+		if len(msg) != wgInitiationLen {
+			return nil
+		}
+		offset = wgInitiationMAC1
+	case wgResponse:
+		if len(msg) != wgResponseLen {
+			return nil
+		}
+		offset = wgResponseMAC1
+	case wgCookieReply:
+		if len(msg) != wgCookieReplyLen {
+			return nil
+		}
+		return r.peerOf(src)
+	case wgData:
+		if len(msg) < wgMinDataLen {
+			return nil
+		}
+		return r.peerOf(src)
+	default:
+		return nil
+	}
+
+	for to, key := range r.mac1Keys {
+		if validMAC1(key, msg, offset) {
+			r.addrs[1-to] = src
+			return r.addrs[to]
+		}
+	}
+	return nil
+}
+
+// peerOf returns the address of the side src is not, nil if src is neither.
+func (r *relay) peerOf(src *net.UDPAddr) *net.UDPAddr {
+	switch {
+	case sameAddr(r.addrs[0], src):
+		return r.addrs[1]
+	case sameAddr(r.addrs[1], src):
+		return r.addrs[0]
+	}
+	return nil
+}
+
+// relayTable holds relays opened for pairs of mesh clients.
+type relayTable struct {
+	lock   sync.Mutex
+	relays map[relayPair]*relay
+	closed bool
+}
+
+// port returns the port of the relay between a and b. If there is none, it
+// is opened on a free port in [low, high] if open is set, 0 is returned
+// otherwise.
+func (rt *relayTable) port(a, b wgtypes.Key, low, high int, open bool) (int, error) {
+	pair := newRelayPair(a, b)
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if r, ok := rt.relays[pair]; ok {
+		return r.port, nil
+	}
+	if !open || rt.closed {
+		return 0, nil
+	}
+
+	used := make(map[int]bool, len(rt.relays))
+	for _, r := range rt.relays {
+		used[r.port] = true
+	}
+	for port := low; port <= high; port++ {
+		if used[port] {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			// Likely used by another process.
+			debugLog.Println("relay: port", port, err)
+			continue
+		}
+		r := &relay{
+			pair:     pair,
+			conn:     conn,
+			port:     port,
+			mac1Keys: [2][blake2s.Size]byte{mac1Key(pair[0]), mac1Key(pair[1])},
+		}
+		if rt.relays == nil {
+			rt.relays = make(map[relayPair]*relay)
+		}
+		rt.relays[pair] = r
+		go rt.serve(r)
+		log.Println("relay: opened port", port, "for", pair[0], "and", pair[1])
+		return port, nil
+	}
+	return 0, fmt.Errorf("relay: no free ports in %d-%d", low, high)
+}
+
+func (rt *relayTable) serve(r *relay) {
+	defer rt.remove(r)
+
+	buf := make([]byte, 65535)
+	lastForward := time.Now()
+	for {
+		if err := r.conn.SetReadDeadline(lastForward.Add(relayIdle)); err != nil {
+			log.Println("error: relay:", err)
+			return
+		}
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Println("relay: closing idle port", r.port)
+			}
+			return
+		}
+		dst := r.route(buf[:n], src)
+		if dst == nil {
+			continue
+		}
+		if _, err := r.conn.WriteToUDP(buf[:n], dst); err != nil {
+			debugLog.Println("relay:", err)
+			continue
+		}
+		lastForward = time.Now()
+	}
+}
+
+func (rt *relayTable) remove(r *relay) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if rt.relays[r.pair] == r {
+		delete(rt.relays, r.pair)
+	}
+	r.conn.Close()
+}
+
+// closeAll closes all relays and prevents new ones from being opened.
+func (rt *relayTable) closeAll() {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.closed = true
+	for _, r := range rt.relays {
+		r.conn.Close()
+	}
+}
+
+// relayEndpoint returns the address the client reaches the relay port at,
+// the advertised endpoint of the same family as the one the client tunnel
+// uses. nil is returned if there is no such endpoint.
+func relayEndpoint(clCfg ClientCfg, observed *wboxproto.Endpoint, port int) *wboxproto.Endpoint {
+	ip := clCfg.TunEndpoint4
+	if clCfg.TunEndpoint6 != nil && (ip == nil || (observed != nil && observed.GetAddr6() != nil)) {
+		ip = clCfg.TunEndpoint6
+	}
+	if ip == nil {
+		return nil
+	}
+	return wboxproto.NewEndpoint(&net.UDPAddr{IP: ip, Port: port})
+}
@@ -0,0 +1,173 @@
+package wboxserver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// handshakeMsg returns a WireGuard handshake message of type typ with valid
+// mac1 for the receiver.
+func handshakeMsg(t *testing.T, typ byte, receiver wgtypes.Key) []byte {
+	t.Helper()
+	length, offset := wgInitiationLen, wgInitiationMAC1
+	if typ == wgResponse {
+		length, offset = wgResponseLen, wgResponseMAC1
+	}
+	msg := make([]byte, length)
+	msg[0] = typ
+	for i := 4; i < offset; i++ {
+		msg[i] = byte(i)
+	}
+	key := mac1Key(receiver)
+	h, err := blake2s.New128(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(msg[:offset])
+	copy(msg[offset:], h.Sum(nil))
+	return msg
+}
+
+func dataMsg() []byte {
+	msg := make([]byte, wgMinDataLen)
+	msg[0] = wgData
+	return msg
+}
+
+func TestRelayRoute(t *testing.T) {
+	_, a := testKey(t)
+	_, b := testKey(t)
+	pair := newRelayPair(a.Bytes, b.Bytes)
+	r := &relay{
+		pair:     pair,
+		mac1Keys: [2][blake2s.Size]byte{mac1Key(pair[0]), mac1Key(pair[1])},
+	}
+
+	addrA := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	addrB := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 2000}
+	stranger := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 3000}
+
+	// Nothing is known about b yet.
+	if dst := r.route(handshakeMsg(t, wgInitiation, b.Bytes), addrA); dst != nil {
+		t.Fatalf("initiation forwarded to unknown peer: %v", dst)
+	}
+	if dst := r.route(handshakeMsg(t, wgResponse, a.Bytes), addrB); !sameAddr(dst, addrA) {
+		t.Fatalf("response from b forwarded to %v, want %v", dst, addrA)
+	}
+	if dst := r.route(dataMsg(), addrA); !sameAddr(dst, addrB) {
+		t.Fatalf("data from a forwarded to %v, want %v", dst, addrB)
+	}
+	if dst := r.route(dataMsg(), addrB); !sameAddr(dst, addrA) {
+		t.Fatalf("data from b forwarded to %v, want %v", dst, addrA)
+	}
+	if dst := r.route(dataMsg(), stranger); dst != nil {
+		t.Fatalf("data from unknown address forwarded to %v", dst)
+	}
+
+	// Handshakes for keys outside of the pair and corrupted ones are
+	// dropped and do not change learned addresses.
+	_, c := testKey(t)
+	if dst := r.route(handshakeMsg(t, wgInitiation, c.Bytes), stranger); dst != nil {
+		t.Fatalf("initiation for another key forwarded to %v", dst)
+	}
+	bad := handshakeMsg(t, wgInitiation, a.Bytes)
+	bad[10] ^= 1
+	if dst := r.route(bad, stranger); dst != nil {
+		t.Fatalf("initiation with invalid mac1 forwarded to %v", dst)
+	}
+	if dst := r.route(dataMsg()[:wgMinDataLen-1], addrA); dst != nil {
+		t.Fatalf("truncated data forwarded to %v", dst)
+	}
+	if dst := r.route(dataMsg(), addrA); !sameAddr(dst, addrB) {
+		t.Fatalf("data from a forwarded to %v after bad handshakes, want %v", dst, addrB)
+	}
+
+	// b roamed.
+	if dst := r.route(handshakeMsg(t, wgInitiation, a.Bytes), stranger); !sameAddr(dst, addrA) {
+		t.Fatalf("initiation from b forwarded to %v, want %v", dst, addrA)
+	}
+	if dst := r.route(dataMsg(), addrA); !sameAddr(dst, stranger) {
+		t.Fatalf("data from a forwarded to %v, want new address of b %v", dst, stranger)
+	}
+}
+
+func TestRelayForward(t *testing.T) {
+	_, a := testKey(t)
+	_, b := testKey(t)
+
+	var rt relayTable
+	defer rt.closeAll()
+	if port, err := rt.port(a.Bytes, b.Bytes, 0, 0, false); err != nil || port != 0 {
+		t.Fatalf("port without open = %v, %v; want 0", port, err)
+	}
+
+	// Find a free range.
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	low := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	port, err := rt.port(a.Bytes, b.Bytes, low, low, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := rt.port(b.Bytes, a.Bytes, low, low, false); err != nil || again != port {
+		t.Fatalf("port of existing relay = %v, %v; want %v", again, err, port)
+	}
+	if _, err := rt.port(a.Bytes, a.Bytes, low, low, true); err == nil {
+		t.Fatal("relay opened on a port already in use")
+	}
+
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	connA, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connA.Close()
+	connB, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connB.Close()
+
+	recv := func(c *net.UDPConn) []byte {
+		t.Helper()
+		buf := make([]byte, 1500)
+		if err := c.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	// Both sides announce themselves with handshakes, the first one is
+	// dropped as the address of b is not known yet.
+	if _, err := connA.WriteToUDP(handshakeMsg(t, wgInitiation, b.Bytes), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	init := handshakeMsg(t, wgInitiation, a.Bytes)
+	if _, err := connB.WriteToUDP(init, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := recv(connA); !bytes.Equal(got, init) {
+		t.Fatal("initiation from b was not forwarded to a")
+	}
+	data := dataMsg()
+	data[20] = 42
+	if _, err := connA.WriteToUDP(data, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := recv(connB); !bytes.Equal(got, data) {
+		t.Fatal("data from a was not forwarded to b")
+	}
+}
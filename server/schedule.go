@@ -0,0 +1,322 @@
+package wboxserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// accessInterval is how often access of clients is rechecked against their
+// schedules and quotas. Windows have the minute granularity.
+const accessInterval = 30 * time.Second
+
+// accessWindow is a single schedule entry, e.g. "Mon-Fri 08:00-18:00".
+type accessWindow struct {
+	days [7]bool
+	// Minutes since midnight, end is not included. Windows with end before
+	// start last until end on the next day.
+	start, end int
+}
+
+// Schedule is the set of time windows the client access is permitted in. Nil
+// Schedule permits access at any time.
+type Schedule []accessWindow
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedule parses windows in the "[DAYS] HH:MM-HH:MM" format. DAYS is a
+// comma-separated list of weekdays or their ranges (e.g. "Mon-Fri,Sun"),
+// every day if omitted.
+func ParseSchedule(windows []string) (Schedule, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	res := make(Schedule, 0, len(windows))
+	for _, s := range windows {
+		w, err := parseWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		res = append(res, w)
+	}
+	return res, nil
+}
+
+func parseWindow(s string) (accessWindow, error) {
+	var w accessWindow
+
+	fields := strings.Fields(s)
+	var hours string
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+		hours = fields[0]
+	case 2:
+		if err := parseDays(fields[0], &w.days); err != nil {
+			return w, err
+		}
+		hours = fields[1]
+	default:
+		return w, errors.New("expected [DAYS] HH:MM-HH:MM")
+	}
+
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return w, errors.New("malformed time range")
+	}
+	var err error
+	if w.start, err = parseClock(parts[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(parts[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, errors.New("empty time range")
+	}
+	return w, nil
+}
+
+func parseDays(s string, days *[7]bool) error {
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(strings.ToLower(part), "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("malformed days range: %v", part)
+		}
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("unknown weekday: %v", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("unknown weekday: %v", bounds[1])
+			}
+		}
+		// Ranges may wrap around the week end, e.g. Fri-Mon.
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes since midnight, 24:00 is accepted as
+// the end of the day.
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("malformed time: %v", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("malformed time: %v", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("malformed time: %v", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("time out of range: %v", s)
+	}
+	return h*60 + m, nil
+}
+
+// Permits reports whether access is permitted at t, in the time zone of the
+// schedule.
+func (s Schedule) Permits(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	now := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s {
+		if w.start < w.end {
+			if w.days[today] && now >= w.start && now < w.end {
+				return true
+			}
+			continue
+		}
+		if (w.days[today] && now >= w.start) || (w.days[yesterday] && now < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// location returns the time zone schedules are evaluated in.
+func (c SrvConfig) location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.TimeZone)
+}
+
+// now returns the current time in the time zone of schedules.
+func (c SrvConfig) now() time.Time {
+	loc, err := c.location()
+	if err != nil {
+		// Checked by Validate.
+		loc = time.Local
+	}
+	return time.Now().In(loc)
+}
+
+// runAccess blocks and unblocks clients according to their schedules and
+// quotas until stop is closed.
+func (s *Server) runAccess(stop <-chan struct{}) {
+	t := time.NewTicker(accessInterval)
+	defer t.Stop()
+	for {
+		// The standby has no peers to account and block.
+		if !s.IsStandby() {
+			s.updateQuotas()
+
+			s.lock.Lock()
+			s.updateEndpoints()
+			s.enforceAccess(false)
+			s.lock.Unlock()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// accessDenied returns the NACK code if the client is not permitted to access
+// the network at now: its addresses conflict with another client, it is
+// outside of its schedule or over its quota with the disconnect action. The
+// lock should be held by the caller.
+func (s *Server) accessDenied(key wgtypes.Key, clCfg ClientCfg, now time.Time) (wboxproto.Nack_Code, bool) {
+	if s.conflictRefused[key] {
+		return wboxproto.Nack_CONFLICT, true
+	}
+	if !clCfg.Schedule.Permits(now) {
+		return wboxproto.Nack_OUTSIDE_SCHEDULE, true
+	}
+	if u := s.quotas[key]; u != nil && u.exceeded && clCfg.Quota.Action == QuotaDisconnect {
+		return wboxproto.Nack_QUOTA_EXCEEDED, true
+	}
+	return 0, false
+}
+
+// enforceAccess removes allowed IPs of clients denied access by accessDenied
+// and restores them for clients permitted again. If force is set, allowed IPs
+// of blocked clients are removed even if they were blocked before, e.g. after
+// peers are recreated. The lock should be held by the caller.
+func (s *Server) enforceAccess(force bool) {
+	now := s.Cfg.now()
+	for key := range s.blocked {
+		if _, ok := s.ClientCfgs[key]; !ok {
+			delete(s.blocked, key)
+		}
+	}
+	for key, clCfg := range s.ClientCfgs {
+		code, blocked := s.accessDenied(key, clCfg, now)
+		if blocked == s.blocked[key] && !(force && blocked) {
+			continue
+		}
+		if err := s.peerAccess(key, clCfg, !blocked); err != nil {
+			log.Printf("error: access: %v: %v", key, err)
+			continue
+		}
+		if blocked != s.blocked[key] {
+			ev := wirebox.PeerAccessChanged{
+				Link:      clCfg.ServerIf,
+				Peer:      key.String(),
+				Permitted: !blocked,
+			}
+			if blocked {
+				ev.Reason = strings.ToLower(strings.ReplaceAll(code.String(), "_", "-"))
+				log.Printf("access: %v blocked (%v)", key, ev.Reason)
+				if code == wboxproto.Nack_CONFLICT {
+					s.restoreConflicting(key)
+				}
+			} else {
+				log.Printf("access: %v permitted", key)
+			}
+			s.Events.Emit(ev)
+		}
+
+		if blocked {
+			if s.blocked == nil {
+				s.blocked = make(map[wgtypes.Key]bool)
+			}
+			s.blocked[key] = true
+		} else {
+			delete(s.blocked, key)
+		}
+	}
+}
+
+// peerAccess replaces allowed IPs of the client peer with only link-local
+// addresses if permitted is false, so the client can still solict
+// configuration and learn it is refused, or restores them. The lock should be
+// held by the caller.
+func (s *Server) peerAccess(key wgtypes.Key, clCfg ClientCfg, permitted bool) error {
+	l, err := s.m.GetLink(clCfg.ServerIf)
+	if err != nil {
+		return err
+	}
+	dev, err := l.WGConfig()
+	if err != nil {
+		return err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey != key {
+			continue
+		}
+
+		var allowed []net.IPNet
+		for _, n := range p.AllowedIPs {
+			if n.IP.IsLinkLocalUnicast() {
+				allowed = append(allowed, n)
+			}
+		}
+		if permitted {
+			for _, addr := range clCfg.Addrs {
+				_, bits := addr.Mask.Size()
+				allowed = append(allowed, net.IPNet{
+					IP:   addr.IP,
+					Mask: net.CIDRMask(bits, bits),
+				})
+			}
+			allowed = append(allowed, s.sites[key].accepted...)
+		}
+
+		return l.ConfigureWG(wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:         key,
+				UpdateOnly:        true,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        allowed,
+			}},
+		})
+	}
+	return fmt.Errorf("no peer on %v", clCfg.ServerIf)
+}
@@ -0,0 +1,274 @@
+package wboxserver
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"syscall"
+
+	"github.com/foxcpp/wirebox/linkmgr"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/foxcpp/wirebox/validate"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// site is the set of local networks a client routes for (site-to-site).
+type site struct {
+	// Link the client is connected to, routes to accepted networks go via
+	// it.
+	link string
+	// Networks reported in the last solictation.
+	reported []net.IPNet
+	// Networks permitted by the policy and installed.
+	accepted []net.IPNet
+}
+
+// solictSubnets returns networks reported in the solictation, malformed ones
+// are skipped.
+func solictSubnets(msg *wboxproto.CfgSolict) []net.IPNet {
+	var res []net.IPNet
+	for _, n := range msg.GetSubnets4() {
+		if n.PrefixLen < 0 || n.PrefixLen > 32 {
+			continue
+		}
+		ipNet := n.AsIPNet()
+		ipNet.IP = ipNet.IP.To4().Mask(ipNet.Mask)
+		res = append(res, ipNet)
+	}
+	for _, n := range msg.GetSubnets6() {
+		if n.GetAddr() == nil || n.PrefixLen < 0 || n.PrefixLen > 128 {
+			continue
+		}
+		ipNet := n.AsIPNet()
+		ipNet.IP = ipNet.IP.Mask(ipNet.Mask)
+		res = append(res, ipNet)
+	}
+	return res
+}
+
+func netsOverlap(a, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// acceptSubnets returns networks from reported the client is permitted to
+// route for. Networks should be within the client subnets option and should
+// not overlap with networks of other clients. The lock should be held by the
+// caller.
+func (s *Server) acceptSubnets(key wgtypes.Key, clCfg ClientCfg, reported []net.IPNet) []net.IPNet {
+	var res []net.IPNet
+reported:
+	for _, n := range reported {
+		permitted := false
+		for _, allowed := range clCfg.Subnets {
+			if validate.Within(n, allowed) == nil {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			log.Printf("WARNING: site: %v is not permitted for %v, ignored", n.String(), key)
+			continue
+		}
+		for other, st := range s.sites {
+			if other == key {
+				continue
+			}
+			for _, o := range st.accepted {
+				if netsOverlap(n, o) {
+					log.Printf("WARNING: site: %v of %v overlaps with %v of %v, ignored", n.String(), key, o.String(), other)
+					continue reported
+				}
+			}
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// updateSite applies networks reported in the solictation of the
+// authenticated client.
+func (s *Server) updateSite(key wgtypes.Key, msg *wboxproto.CfgSolict) {
+	reported := solictSubnets(msg)
+
+	s.lock.RLock()
+	unchanged := joinNets(s.sites[key].reported) == joinNets(reported)
+	s.lock.RUnlock()
+	if unchanged {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clCfg, ok := s.ClientCfgs[key]
+	if !ok {
+		return
+	}
+	accepted := s.acceptSubnets(key, clCfg, reported)
+	if joinNets(s.sites[key].accepted) != joinNets(accepted) {
+		log.Printf("site: %v routes for [%v]", key, joinNets(accepted))
+	}
+	s.setSite(key, site{link: clCfg.ServerIf, reported: reported, accepted: accepted}, false)
+}
+
+// reapplySites checks networks of clients against the new configuration and
+// installs them again, since recreated peers lose extra allowed IPs. The lock
+// should be held by the caller.
+func (s *Server) reapplySites() {
+	keys := make([]wgtypes.Key, 0, len(s.sites))
+	for key := range s.sites {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		st := s.sites[key]
+		clCfg, ok := s.ClientCfgs[key]
+		if !ok {
+			s.setSite(key, site{link: st.link}, true)
+			continue
+		}
+		st.link = clCfg.ServerIf
+		st.accepted = s.acceptSubnets(key, clCfg, st.reported)
+		s.setSite(key, st, true)
+	}
+}
+
+// setSite replaces the allowed IPs of the client peer and routes for its
+// old networks with ones for st. If force is set, routes and allowed IPs are
+// installed even if networks did not change. The lock should be held by the
+// caller.
+func (s *Server) setSite(key wgtypes.Key, st site, force bool) {
+	old := s.sites[key]
+	moved := old.link != st.link
+	oldNets := make(map[string]bool, len(old.accepted))
+	for _, n := range old.accepted {
+		oldNets[n.String()] = true
+	}
+	newNets := make(map[string]bool, len(st.accepted))
+	for _, n := range st.accepted {
+		newNets[n.String()] = true
+	}
+
+	var del, add []net.IPNet
+	for _, n := range old.accepted {
+		if moved || !newNets[n.String()] {
+			del = append(del, n)
+		}
+	}
+	for _, n := range st.accepted {
+		if force || moved || !oldNets[n.String()] {
+			add = append(add, n)
+		}
+	}
+
+	if len(del) != 0 {
+		if l, err := s.m.GetLink(old.link); err == nil {
+			for _, n := range del {
+				err := l.DelRoute(linkmgr.Route{Dest: n})
+				if err != nil && !errors.Is(err, syscall.ESRCH) {
+					log.Printf("error: site: route del %v: %v", n.String(), err)
+				}
+			}
+		}
+	}
+	// Allowed IPs of blocked clients are restored by enforceAccess.
+	if (len(add) != 0 || len(del) != 0) && !s.blocked[key] {
+		if err := s.siteAllowedIPs(key, st.link, old.accepted, st.accepted); err != nil {
+			log.Println("error: site:", err)
+		}
+	}
+	if len(add) != 0 {
+		l, err := s.m.GetLink(st.link)
+		if err != nil {
+			log.Println("error: site:", err)
+		} else {
+			for _, n := range add {
+				err := l.AddRoute(linkmgr.Route{Dest: n})
+				if err != nil && !errors.Is(err, syscall.EEXIST) {
+					log.Printf("error: site: route add %v: %v", n.String(), err)
+				}
+			}
+		}
+	}
+
+	if len(st.reported) == 0 {
+		delete(s.sites, key)
+	} else {
+		if s.sites == nil {
+			s.sites = make(map[wgtypes.Key]site)
+		}
+		s.sites[key] = st
+	}
+	if joinNets(old.accepted) != joinNets(st.accepted) {
+		// Routes redistributed to other clients changed.
+		s.serial++
+		s.cfgCache.reset()
+		s.triggerBGP()
+	}
+}
+
+// siteAllowedIPs replaces old networks in the allowed IPs of the client peer
+// with new ones.
+func (s *Server) siteAllowedIPs(key wgtypes.Key, link string, old, new []net.IPNet) error {
+	l, err := s.m.GetLink(link)
+	if err != nil {
+		return err
+	}
+	dev, err := l.WGConfig()
+	if err != nil {
+		return err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey != key {
+			continue
+		}
+
+		drop := make(map[string]bool, len(old)+len(new))
+		for _, n := range old {
+			drop[n.String()] = true
+		}
+		for _, n := range new {
+			drop[n.String()] = true
+		}
+		allowed := make([]net.IPNet, 0, len(p.AllowedIPs)+len(new))
+		for _, n := range p.AllowedIPs {
+			if !drop[n.String()] {
+				allowed = append(allowed, n)
+			}
+		}
+		allowed = append(allowed, new...)
+
+		return l.ConfigureWG(wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:         key,
+				UpdateOnly:        true,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        allowed,
+			}},
+		})
+	}
+	// The peer is removed together with its networks.
+	return nil
+}
+
+// siteRoutes returns routes to networks of clients other than self. The lock
+// should be held by the caller.
+func (s *Server) siteRoutes(self wgtypes.Key) []Route {
+	keys := make([]wgtypes.Key, 0, len(s.sites))
+	for key := range s.sites {
+		// Networks of isolated clients are not reachable by others.
+		if key != self && !s.Cfg.isolated(s.ClientCfgs[key].Group) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return string(keys[i][:]) < string(keys[j][:])
+	})
+
+	var res []Route
+	for _, key := range keys {
+		for _, n := range s.sites[key].accepted {
+			res = append(res, Route{Dest: &IPNet{n}})
+		}
+	}
+	return res
+}
@@ -1,20 +1,75 @@
 package wboxserver
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
 	wboxproto "github.com/foxcpp/wirebox/proto"
+	"github.com/golang/protobuf/proto"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func serve(stop <-chan struct{}, c *net.UDPConn, scfg SrvConfig, clCfgs map[wgtypes.Key]ClientCfg) {
-	const maxMsg = 1420
-	buffer := make([]byte, maxMsg)
+// maxPayload is the datagram payload size limit from the protocol
+// specification.
+const maxPayload = 1380
+
+// solictMsgs holds unpacked solictations for reuse once they are handled.
+var solictMsgs = sync.Pool{
+	New: func() interface{} { return new(wboxproto.CfgSolict) },
+}
+
+// listenSolict opens solictation sockets on the link, the IPv4 one only if
+// config-ipv4 is enabled.
+func listenSolict(cfg SrvConfig, l linkmgr.Link) ([]*net.UDPConn, error) {
+	c6, err := net.ListenUDP("udp6", &net.UDPAddr{
+		IP:   wirebox.SolictIPv6,
+		Port: wirebox.SolictPort,
+		Zone: strconv.Itoa(l.Index()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.ConfigIPv4 {
+		return []*net.UDPConn{c6}, nil
+	}
+
+	// IPv4 has no zones, the socket is bound to the interface instead. The
+	// same address is used on all interfaces.
+	lc := net.ListenConfig{
+		Control: func(_, _ string, rc syscall.RawConn) error {
+			var sockErr error
+			err := rc.Control(func(fd uintptr) {
+				sockErr = bindToDevice(fd, l.Name())
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	c4, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(wirebox.SolictIPv4.String(), strconv.Itoa(wirebox.SolictPort)))
+	if err != nil {
+		c6.Close()
+		return nil, err
+	}
+	return []*net.UDPConn{c6, c4.(*net.UDPConn)}, nil
+}
+
+// serve reads solictations from c and passes them to the worker pool.
+func (s *Server) serve(stop <-chan struct{}, c *net.UDPConn, link string, pool *workerPool) {
+	buffer := make([]byte, wboxproto.MaxDatagram)
 
 	for {
 		readBytes, sender, err := c.ReadFromUDP(buffer)
@@ -28,67 +83,172 @@ func serve(stop <-chan struct{}, c *net.UDPConn, scfg SrvConfig, clCfgs map[wgty
 			debugLog.Println(err)
 			continue
 		}
-		msg, err := wboxproto.Unpack(buffer[:readBytes])
-		if err != nil {
-			debugLog.Println(err)
+		msg := solictMsgs.Get().(*wboxproto.CfgSolict)
+		if err := wboxproto.UnpackInto(buffer[:readBytes], msg); err != nil {
+			solictMsgs.Put(msg)
+			debugLog.Println(err, "from", sender)
 			continue
 		}
 
-		var reply wboxproto.Message
-		switch msg := msg.(type) {
-		case *wboxproto.CfgSolict:
-			reply, err = sendConfig(msg, sender, scfg, clCfgs)
-		default:
-			debugLog.Printf("unexpected message type %T from %v", msg, sender)
-			continue
+		if !pool.submit(solictJob{c: c, link: link, sender: sender, msg: msg}) {
+			solictMsgs.Put(msg)
+			debugLog.Println("workers are busy, dropped solictation from", sender.IP)
 		}
-		if err != nil {
-			debugLog.Println(err)
-		}
-		if reply == nil {
-			continue
+	}
+}
+
+func (s *Server) handleSolict(job solictJob) {
+	msg, sender := job.msg, job.sender
+	defer solictMsgs.Put(msg)
+
+	span := s.Tracer.StartRemote("handle-solict", msg.GetTraceParent())
+	span.SetAttr("sender", sender.IP)
+	reply, replyDgram, err := s.sendConfig(msg, sender, job.link)
+	if key, keyErr := wgtypes.NewKey(msg.GetPeerPubkey()); keyErr == nil {
+		s.solicts.record(key, sender.IP, solictResult(reply, err))
+		if _, ok := reply.(*wboxproto.Cfg); ok {
+			// The sender is authenticated by the configuration tunnel.
+			s.updateSite(key, msg)
 		}
+	}
+	if err != nil {
+		debugLog.Println(err)
+	}
+	if reply == nil {
+		span.Finish(err)
+		return
+	}
+	span.SetAttr("reply", fmt.Sprintf("%T", reply))
+	span.Finish(err)
 
-		replyDgram, err := wboxproto.Pack(reply)
+	if replyDgram == nil {
+		buf := wboxproto.GetBuffer()
+		defer wboxproto.PutBuffer(buf)
+		replyDgram, err = wboxproto.PackTo(*buf, reply)
 		if err != nil {
 			log.Println("failed to serialize reply", err)
-			continue
+			return
 		}
+	}
+	if debugLog.Writer() != ioutil.Discard {
+		// Formatting the whole configuration is costly, skip it if the log
+		// is discarded anyway.
 		debugLog.Println("sending", reply.String(), "to", sender.IP)
+	}
 
-		if _, err := c.WriteToUDP(replyDgram, sender); err != nil {
-			log.Println(err)
-		}
+	if _, err := job.c.WriteToUDP(replyDgram, sender); err != nil {
+		log.Println(err)
 	}
 }
 
-func sendConfig(msg *wboxproto.CfgSolict, sender *net.UDPAddr, scfg SrvConfig, clCfgs map[wgtypes.Key]ClientCfg) (wboxproto.Message, error) {
+// sendConfig returns the reply for the solictation. The serialized reply is
+// returned too if it is cached, nil otherwise.
+func (s *Server) sendConfig(msg *wboxproto.CfgSolict, sender *net.UDPAddr, link string) (wboxproto.Message, []byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	scfg := s.Cfg
+
 	clKey := wirebox.PeerKey{
 		Encoded: base64.StdEncoding.EncodeToString(msg.GetPeerPubkey()),
 	}
 	var err error
 	clKey.Bytes, err = wgtypes.NewKey(msg.GetPeerPubkey())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if !scfg.acceptsScheme(msg.GetAddrScheme()) {
+		return &wboxproto.Nack{
+			Description: []byte("address derivation scheme is not accepted"),
+			Code:        wboxproto.Nack_ADDR_SCHEME_UNSUPPORTED,
+		}, nil, fmt.Errorf("send config: %v used unsupported address scheme %v", clKey, msg.GetAddrScheme())
 	}
 
-	expectedSender := wirebox.IPv6LLForClient(clKey)
+	expectedSender := wirebox.ConfigAddr(clKey, msg.GetAddrScheme(), []byte(scfg.AddrSalt))
+	if sender.IP.To4() != nil {
+		expectedSender = wirebox.ConfigAddr4(clKey, []byte(scfg.AddrSalt))
+	}
 	if !sender.IP.Equal(expectedSender) {
 		return &wboxproto.Nack{
-			Description: []byte("mismatched IPv6LL and public key in solictation"),
-		}, fmt.Errorf("send config: public key (%v) - link-local IPv6 (%v) mismatch", clKey, sender.IP)
+			Description: []byte("mismatched link-local address and public key in solictation"),
+			Code:        wboxproto.Nack_ADDR_MISMATCH,
+		}, nil, fmt.Errorf("send config: public key (%v) - link-local address (%v) mismatch", clKey, sender.IP)
+	}
+	// Clients are redirected even if they are not configured here, e.g.
+	// after they were moved to the new server.
+	if r, ok := scfg.redirect(s.ClientCfgs[clKey.Bytes].Group); ok {
+		// Checked by Validate.
+		addr, _ := r.udpAddr()
+		return &wboxproto.Nack{
+			Description:      []byte("configuration is served by another server"),
+			Code:             wboxproto.Nack_REDIRECT,
+			ReferralEndpoint: wboxproto.NewEndpoint(addr),
+			ReferralKey:      r.ServerKey.Bytes[:],
+		}, nil, fmt.Errorf("send config: %v redirected to %v: %w", clKey, addr, wirebox.ErrRedirected)
+	}
+	if reason := scfg.checkPosture(msg); reason != "" {
+		return &wboxproto.Nack{
+			Description: []byte(reason),
+			Code:        wboxproto.Nack_UPGRADE_REQUIRED,
+		}, nil, fmt.Errorf("send config: %v refused: %v: %w", clKey, reason, wirebox.ErrUpgradeRequired)
+	}
+	if code, denied := s.accessDenied(clKey.Bytes, s.ClientCfgs[clKey.Bytes], scfg.now()); denied {
+		switch code {
+		case wboxproto.Nack_QUOTA_EXCEEDED:
+			return &wboxproto.Nack{
+				Description: []byte("transfer quota exceeded"),
+				Code:        code,
+			}, nil, fmt.Errorf("send config: %v refused: %w", clKey, wirebox.ErrQuotaExceeded)
+		case wboxproto.Nack_CONFLICT:
+			return &wboxproto.Nack{
+				Description: []byte("addresses conflict with another client"),
+				Code:        code,
+			}, nil, fmt.Errorf("send config: %v refused: %w", clKey, wirebox.ErrConflict)
+		}
+		return &wboxproto.Nack{
+			Description: []byte("access is not permitted at this time"),
+			Code:        code,
+		}, nil, fmt.Errorf("send config: %v refused: %w", clKey, wirebox.ErrOutsideSchedule)
 	}
 	log.Println("configuration for", clKey, "solicted by", sender.IP)
 
-	cfg, ok := clCfgs[clKey.Bytes]
+	cfg, ok := s.ClientCfgs[clKey.Bytes]
 	if !ok {
 		return &wboxproto.Nack{
 			Description: []byte("no config"),
-		}, fmt.Errorf("send config: unknown key %v requested by %v", clKey, sender.IP)
+			Code:        wboxproto.Nack_NO_CONFIG,
+		}, nil, fmt.Errorf("send config: key %v requested by %v: %w", clKey, sender.IP, wirebox.ErrNoConfig)
+	}
+
+	decision := s.evalPolicy(clKey, cfg, msg)
+	if decision.Denied {
+		return &wboxproto.Nack{
+			Description: []byte(decision.Reason),
+			Code:        wboxproto.Nack_POLICY_DENIED,
+		}, nil, fmt.Errorf("send config: %v refused by policy rule %v %v: %w", clKey, decision.Rule, decision, wirebox.ErrPolicyDenied)
+	}
+	if len(decision.Annotations) != 0 {
+		log.Printf("policy: %v: %v", clKey, decision)
+	}
+	s.Events.Emit(wirebox.HandshakeEstablished{Link: link, Peer: clKey})
+
+	// Mesh peers are different for each solictation. Policy decisions
+	// depend on the time and the client.
+	meshReq := scfg.topology(cfg.Group) == TopologyMesh && msg.GetMesh() && !decision.NoMesh
+	cacheable := !meshReq && len(scfg.policy) == 0
+	if cacheable {
+		if c, ok := s.cfgCache.get(clKey.Bytes, s.serial); ok {
+			return c.msg, c.dgram, nil
+		}
 	}
 
 	protoCfg := &wboxproto.Cfg{
 		TunPort: uint32(cfg.TunPort),
+		Serial:  s.serial,
+		Motd:    scfg.motd(cfg.Group),
+	}
+	if decision.Motd != "" {
+		protoCfg.Motd = decision.Motd
 	}
 	if scfg.Server4.IP != nil {
 		protoCfg.Server4 = binary.BigEndian.Uint32(scfg.Server4.IP.To4())
@@ -102,6 +262,18 @@ func sendConfig(msg *wboxproto.CfgSolict, sender *net.UDPAddr, scfg SrvConfig, c
 	if cfg.TunEndpoint6 != nil {
 		protoCfg.Tun6Endpoint = wboxproto.NewIPv6(cfg.TunEndpoint6)
 	}
+	for _, e := range scfg.TunEndpoints {
+		addr, err := e.udpAddr()
+		if err != nil {
+			// Checked by Validate.
+			continue
+		}
+		protoCfg.TunEndpoints = append(protoCfg.TunEndpoints, &wboxproto.EndpointHint{
+			Endpoint: wboxproto.NewEndpoint(addr),
+			Region:   e.Region,
+			Priority: e.Priority,
+		})
+	}
 	for _, addr := range cfg.Addrs {
 		prefixLen, ipLen := addr.Mask.Size()
 		if ipLen == 32 /* IPv4 */ {
@@ -116,7 +288,16 @@ func sendConfig(msg *wboxproto.CfgSolict, sender *net.UDPAddr, scfg SrvConfig, c
 			})
 		}
 	}
-	for _, route := range cfg.Routes {
+	isolated := scfg.isolated(cfg.Group)
+	routes := cfg.Routes[:len(cfg.Routes):len(cfg.Routes)]
+	if !isolated {
+		routes = append(routes, s.siteRoutes(clKey.Bytes)...)
+	}
+	routes = append(routes, s.importedRoutes(clKey.Bytes)...)
+	if decision.NoRoutes {
+		routes = nil
+	}
+	for _, route := range routes {
 		prefixLen, ipLen := route.Dest.Mask.Size()
 		// Use IP from Net object as it is "normalized", all bits
 		// not in prefix are set to 0.
@@ -145,5 +326,46 @@ func sendConfig(msg *wboxproto.CfgSolict, sender *net.UDPAddr, scfg SrvConfig, c
 		}
 	}
 
-	return protoCfg, nil
+	if meshReq {
+		s.addMeshPeers(protoCfg, clKey.Bytes, cfg, msg.GetEndpoints(), msg.GetRelayPeers())
+	}
+	if scfg.PushHosts && !isolated && !decision.NoHosts {
+		protoCfg.Hosts = s.hostEntries()
+		if size := proto.Size(protoCfg) + 2; size > maxPayload {
+			log.Printf("WARNING: hosts list does not fit in the configuration message (%d bytes), not sent to %v", size, clKey)
+			protoCfg.Hosts = nil
+		}
+	}
+
+	if !cacheable {
+		return protoCfg, nil, nil
+	}
+	dgram, err := wboxproto.Pack(protoCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("send config: %w", err)
+	}
+	s.cfgCache.put(clKey.Bytes, cachedCfg{serial: s.serial, msg: protoCfg, dgram: dgram})
+	return protoCfg, dgram, nil
+}
+
+// hostEntries returns names of clients with hostname set, sorted by name.
+// The lock should be held by the caller.
+func (s *Server) hostEntries() []*wboxproto.Host {
+	hosts := make([]*wboxproto.Host, 0, len(s.ClientCfgs))
+	for _, clCfg := range s.ClientCfgs {
+		if clCfg.Hostname == "" {
+			continue
+		}
+		h := &wboxproto.Host{Name: strings.TrimSuffix(clCfg.Hostname, ".")}
+		for _, addr := range clCfg.Addrs {
+			if v4 := addr.IP.To4(); v4 != nil {
+				h.Addrs4 = append(h.Addrs4, binary.BigEndian.Uint32(v4))
+			} else {
+				h.Addrs6 = append(h.Addrs6, wboxproto.NewIPv6(addr.IP))
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
 }
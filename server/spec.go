@@ -0,0 +1,91 @@
+package wboxserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PeerSpec is the declarative list of clients managed outside of the main
+// configuration file, e.g. by a GitOps pipeline or a Kubernetes ConfigMap.
+type PeerSpec struct {
+	Clients []SpecClient `yaml:"clients"`
+}
+
+type SpecClient struct {
+	Key string `yaml:"key"`
+
+	ClientOverrides `yaml:",inline"`
+}
+
+func parsePeerSpec(blob []byte) (PeerSpec, error) {
+	var spec PeerSpec
+	dec := yaml.NewDecoder(bytes.NewReader(blob))
+	dec.SetStrict(true)
+	if err := dec.Decode(&spec); err != nil {
+		return PeerSpec{}, fmt.Errorf("peer spec: %w", err)
+	}
+
+	seen := make(map[string]bool, len(spec.Clients))
+	for i, cl := range spec.Clients {
+		if cl.Key == "" {
+			return PeerSpec{}, fmt.Errorf("peer spec: clients[%d]: key is required", i)
+		}
+		if seen[cl.Key] {
+			return PeerSpec{}, fmt.Errorf("peer spec: clients[%d]: duplicate key %v", i, cl.Key)
+		}
+		seen[cl.Key] = true
+	}
+	return spec, nil
+}
+
+func readPeerSpec(path string) ([]byte, PeerSpec, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, PeerSpec{}, fmt.Errorf("peer spec: %w", err)
+	}
+	spec, err := parsePeerSpec(blob)
+	return blob, spec, err
+}
+
+// withSpec returns the copy of the configuration with clients from the spec
+// added. Spec entries replace entries for the same key in the configuration
+// file. Clients from the previously applied spec are not kept.
+//
+// Clients are kept in the spec order so appending new clients to the end
+// does not change ports and addresses allocated to existing ones.
+func (c SrvConfig) withSpec(spec PeerSpec) SrvConfig {
+	c = c.withBase()
+	c.specKeys = make([]string, 0, len(spec.Clients))
+	c.specClients = make(map[string]ClientOverrides, len(spec.Clients))
+	for _, cl := range spec.Clients {
+		c.specClients[cl.Key] = cl.ClientOverrides
+		c.specKeys = append(c.specKeys, cl.Key)
+	}
+	return c.merged()
+}
+
+// withBase remembers clients of the configuration file itself before the
+// first merge.
+func (c SrvConfig) withBase() SrvConfig {
+	if !c.hasBase {
+		c.fileClients = c.Clients
+		c.hasBase = true
+	}
+	return c
+}
+
+// merged rebuilds Clients from the configuration file, the peer store and the
+// spec, in the order of increasing precedence.
+func (c SrvConfig) merged() SrvConfig {
+	clients := make(map[string]ClientOverrides, len(c.fileClients)+len(c.specClients)+len(c.storeClients))
+	for _, src := range []map[string]ClientOverrides{c.fileClients, c.storeClients, c.specClients} {
+		for key, cl := range src {
+			clients[key] = cl
+		}
+	}
+	c.Clients = clients
+	return c
+}
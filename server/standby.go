@@ -0,0 +1,245 @@
+package wboxserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/ctlsock"
+)
+
+// StandbyConfig makes the server a warm standby for another one sharing the
+// peer store. The standby creates interfaces and tracks clients but keeps
+// WireGuard peers unconfigured until it is promoted, so it does not take
+// traffic away from the primary.
+type StandbyConfig struct {
+	Enable bool `toml:"enable"`
+	// URL of the primary checked periodically, the standby is promoted after
+	// Failures checks in a row get no HTTP reply at all. Any status counts as
+	// alive, so checking e.g. the admin API with authentication enabled does
+	// not promote the standby while the primary runs. Promotion is manual
+	// only if empty.
+	CheckURL string `toml:"check-url"`
+	// Sent as the Bearer token with checks, e.g. of an admin API user.
+	CheckToken string `toml:"check-token"`
+	// Client certificate and key presented to the primary if its admin API
+	// requires them (client-ca).
+	CheckCert string `toml:"check-cert"`
+	CheckKey  string `toml:"check-key"`
+
+	CheckInterval Duration `toml:"check-interval"`
+	CheckTimeout  Duration `toml:"check-timeout"`
+	Failures      int      `toml:"failures"`
+}
+
+func (c StandbyConfig) validate() error {
+	if c.CheckURL != "" {
+		u, err := url.Parse(c.CheckURL)
+		if err != nil {
+			return fmt.Errorf("check-url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("check-url: should be a http or https URL")
+		}
+	}
+	if (c.CheckCert == "") != (c.CheckKey == "") {
+		return errors.New("check-cert and check-key should be set together")
+	}
+	if c.CheckInterval.Duration < 0 {
+		return errors.New("check-interval: should not be negative")
+	}
+	if c.CheckTimeout.Duration < 0 {
+		return errors.New("check-timeout: should not be negative")
+	}
+	if c.Failures < 0 {
+		return errors.New("failures: should not be negative")
+	}
+	return nil
+}
+
+func (c StandbyConfig) checkInterval() time.Duration {
+	if c.CheckInterval.Duration == 0 {
+		return 5 * time.Second
+	}
+	return c.CheckInterval.Duration
+}
+
+func (c StandbyConfig) checkTimeout() time.Duration {
+	if c.CheckTimeout.Duration == 0 {
+		return 2 * time.Second
+	}
+	return c.CheckTimeout.Duration
+}
+
+func (c StandbyConfig) failures() int {
+	if c.Failures == 0 {
+		return 3
+	}
+	return c.Failures
+}
+
+// standbySpec removes peers from the spec while the server is the standby.
+// Peers left by the previous role are removed by CreateWG.
+func (c SrvConfig) standbySpec(spec linkSpec) linkSpec {
+	if c.standby {
+		spec.WG.Peers = nil
+	}
+	return spec
+}
+
+// IsStandby reports whether the server is the warm standby.
+func (s *Server) IsStandby() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Cfg.standby
+}
+
+// setStandby promotes the standby (standby is false) or demotes the server
+// and reconfigures interfaces accordingly.
+func (s *Server) setStandby(standby bool, reason string) error {
+	s.lock.Lock()
+	if s.Cfg.standby == standby {
+		s.lock.Unlock()
+		return nil
+	}
+	s.Cfg.standby = standby
+	cfg := s.Cfg
+	s.lock.Unlock()
+
+	if standby {
+		log.Printf("demoting to standby (%s)", reason)
+	} else {
+		log.Printf("promoting to primary (%s)", reason)
+	}
+	// The role is kept if this fails, the next reconciliation (e.g. on the
+	// peer store change) retries.
+	if err := s.Reconcile(cfg); err != nil {
+		return err
+	}
+	s.Events.Emit(wirebox.RoleChanged{Standby: standby, Reason: reason})
+	return nil
+}
+
+// checkClient returns the HTTP client used for health checks.
+func (c StandbyConfig) checkClient() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CheckCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.CheckCert, c.CheckKey)
+		if err != nil {
+			return nil, fmt.Errorf("standby: %w", err)
+		}
+		tr.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return &http.Client{Transport: tr, Timeout: c.checkTimeout()}, nil
+}
+
+// checkPrimary reports whether the primary replies to the health check. Any
+// HTTP status means it runs, only failing to get a reply counts as down.
+func checkPrimary(client *http.Client, cfg StandbyConfig) error {
+	req, err := http.NewRequest(http.MethodGet, cfg.CheckURL, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.CheckToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.CheckToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		debugLog.Println("standby: primary replied with", resp.Status)
+	}
+	return nil
+}
+
+// runStandbyCheck promotes the standby once the primary fails the health
+// check enough times in a row, until stop is closed. The server is not
+// demoted automatically when the primary recovers, so clients are not moved
+// back and forth.
+func (s *Server) runStandbyCheck(client *http.Client, cfg StandbyConfig, stop <-chan struct{}) {
+	t := time.NewTicker(cfg.checkInterval())
+	defer t.Stop()
+
+	failed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if !s.IsStandby() {
+			failed = 0
+			continue
+		}
+
+		err := checkPrimary(client, cfg)
+		if err == nil {
+			if failed != 0 {
+				log.Println("primary recovered")
+			}
+			failed = 0
+			continue
+		}
+		failed++
+		log.Printf("WARNING: primary health check failed (%d/%d): %v", failed, cfg.failures(), err)
+		if failed < cfg.failures() {
+			continue
+		}
+		if err := s.setStandby(false, "health-check"); err != nil {
+			log.Println("error: promotion:", err)
+		}
+	}
+}
+
+func roleMain(cfgPath string, args []string, standby bool) int {
+	name := "promote"
+	if standby {
+		name = "demote"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wboxd %s\n", name)
+		if standby {
+			fmt.Fprintln(fs.Output(), "Makes the running server the warm standby: WireGuard peers are")
+			fmt.Fprintln(fs.Output(), "removed until it is promoted again.")
+		} else {
+			fmt.Fprintln(fs.Output(), "Promotes the running warm standby: WireGuard peers of all clients")
+			fmt.Fprintln(fs.Output(), "are configured and it starts serving them.")
+		}
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	if err := ctlsock.Call(cfg.controlSocket(), name, nil, nil); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
+
+func promoteMain(cfgPath string, args []string) int {
+	return roleMain(cfgPath, args, false)
+}
+
+func demoteMain(cfgPath string, args []string) int {
+	return roleMain(cfgPath, args, true)
+}
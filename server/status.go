@@ -0,0 +1,125 @@
+package wboxserver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/wirebox/ctlsock"
+	"github.com/foxcpp/wirebox/linkmgr"
+)
+
+func statusMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	format := fs.String("format", "wg-show", "output format: wg-show, wg-dump or json (server state, requires running server)")
+	showKeys := fs.Bool("show-keys", false, "include private and preshared keys in wg-dump output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd status [options]")
+		fmt.Fprintln(fs.Output(), "The running server is asked via the control socket, interfaces are")
+		fmt.Fprintln(fs.Output(), "read directly if it is not running.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+
+	if *format == "json" {
+		var state json.RawMessage
+		if err := ctlsock.Call(cfg.controlSocket(), "state", nil, &state); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(state)
+		return 0
+	}
+
+	var out string
+	err = ctlsock.Call(cfg.controlSocket(), "status", statusArgs{Format: *format, ShowKeys: *showKeys}, &out)
+	if err == nil {
+		fmt.Print(out)
+		return 0
+	}
+	if !errors.Is(err, ctlsock.ErrNotRunning) {
+		log.Println("error:", err)
+		return 1
+	}
+
+	specs, err := linkSpecs(cfg)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.Name
+	}
+
+	m, err := linkmgr.NewManager()
+	if err != nil {
+		log.Println("error: link mngr init:", err)
+		return 1
+	}
+	defer m.Close()
+
+	if err := writeStatus(os.Stdout, m, names, *format, *showKeys); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	return 0
+}
+
+func peersMain(cfgPath string, args []string) int {
+	if len(args) != 0 && args[0] == "import" {
+		return peersImportMain(cfgPath, args[1:])
+	}
+
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd peers")
+		fmt.Fprintln(fs.Output(), "       wboxd peers import [options] FILE")
+		fmt.Fprintln(fs.Output(), "Lists clients known to the running server or imports clients into the")
+		fmt.Fprintln(fs.Output(), "peer store (see wboxd peers import -h).")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+
+	var peers []debugPeer
+	if err := ctlsock.Call(cfg.controlSocket(), "peers", nil, &peers); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PUBLIC KEY\tINTERFACE\tADDRESSES\tLAST SOLICTATION")
+	for _, p := range peers {
+		last := "never"
+		if p.LastSolict != nil {
+			last = fmt.Sprintf("%v ago from %s (%s)", time.Since(p.LastSolict.Time).Round(time.Second), p.LastSolict.Sender, p.LastSolict.Result)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.PublicKey, p.ServerIf, strings.Join(p.Addrs, ","), last)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,298 @@
+package wboxserver
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/peerstore"
+	"github.com/foxcpp/wirebox/validate"
+	"gopkg.in/yaml.v2"
+)
+
+// addrPool is the name of the peer store pool slots of pool4 and pool6
+// addresses are leased from. The same slot is used for both pools.
+const addrPool = "addrs"
+
+type PeerStoreConfig struct {
+	// Backend name, "file" or "sqlite" unless others are linked in. The peer
+	// store is disabled if empty.
+	Backend string `toml:"backend"`
+	// Backend-specific location of the store, the file path for file and
+	// sqlite.
+	DSN string `toml:"dsn"`
+}
+
+func (c PeerStoreConfig) Enabled() bool {
+	return c.Backend != ""
+}
+
+func (c PeerStoreConfig) validate() error {
+	for _, name := range peerstore.Backends() {
+		if name == c.Backend {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown backend %v, available: %v", c.Backend, peerstore.Backends())
+}
+
+// openStore opens the peer store and loads clients and leases from it.
+func (c SrvConfig) openStore() (SrvConfig, error) {
+	if err := c.PeerStore.validate(); err != nil {
+		return SrvConfig{}, fmt.Errorf("peer store: %w", err)
+	}
+	store, err := peerstore.Open(c.PeerStore.Backend, c.PeerStore.DSN)
+	if err != nil {
+		return SrvConfig{}, err
+	}
+	c.store = store
+	c, err = c.reloadStore()
+	if err != nil {
+		store.Close()
+		return SrvConfig{}, err
+	}
+	return c, nil
+}
+
+func parseStoreSettings(blob []byte) (ClientOverrides, error) {
+	var o ClientOverrides
+	if len(blob) == 0 {
+		return o, nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(blob))
+	dec.SetStrict(true)
+	if err := dec.Decode(&o); err != nil {
+		return ClientOverrides{}, err
+	}
+	return o, nil
+}
+
+// reloadStore returns the copy of the configuration with clients and leases
+// from the peer store replacing the previously loaded ones.
+func (c SrvConfig) reloadStore() (SrvConfig, error) {
+	var (
+		peers  []peerstore.Peer
+		leases map[string]uint64
+	)
+	err := c.store.View(func(tx peerstore.Tx) error {
+		var err error
+		peers, err = tx.List()
+		if err != nil {
+			return err
+		}
+		leases, err = tx.Leases(addrPool)
+		return err
+	})
+	if err != nil {
+		return SrvConfig{}, fmt.Errorf("peer store: %w", err)
+	}
+
+	c = c.withBase()
+	c.storeKeys = make([]string, 0, len(peers))
+	c.storeClients = make(map[string]ClientOverrides, len(peers))
+	for _, p := range peers {
+		o, err := parseStoreSettings(p.Settings)
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("peer store: %v: %w", p.Key, err)
+		}
+		c.storeKeys = append(c.storeKeys, p.Key)
+		c.storeClients[p.Key] = o
+	}
+	c.leases = leases
+	return c.merged(), nil
+}
+
+// leaseAddrs makes sure each client using pool addresses has the slot leased
+// in the peer store and releases slots of removed clients. Unlike the
+// counter used without the store, leases keep addresses of clients when
+// other clients are removed.
+//
+// The standby only reads leases, they are managed by the primary sharing
+// the store and the client set of the standby can differ.
+func leaseAddrs(cfg SrvConfig, keys []wirebox.PeerKey) (SrvConfig, error) {
+	if cfg.store == nil || (cfg.Pool4.IP == nil && cfg.Pool6.IP == nil) {
+		return cfg, nil
+	}
+
+	var leases map[string]uint64
+	if cfg.standby {
+		err := cfg.store.View(func(tx peerstore.Tx) error {
+			var err error
+			leases, err = tx.Leases(addrPool)
+			return err
+		})
+		if err != nil {
+			return SrvConfig{}, fmt.Errorf("peer store: leases: %w", err)
+		}
+		cfg.leases = leases
+		return cfg, nil
+	}
+
+	err := cfg.store.Update(func(tx peerstore.Tx) error {
+		wanted := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			if len(cfg.Clients[k.Encoded].Addrs) != 0 {
+				continue
+			}
+			wanted[k.Encoded] = true
+			if _, err := tx.Lease(addrPool, k.Encoded); err != nil {
+				return err
+			}
+		}
+		current, err := tx.Leases(addrPool)
+		if err != nil {
+			return err
+		}
+		for key := range current {
+			if wanted[key] {
+				continue
+			}
+			if err := tx.Release(addrPool, key); err != nil {
+				return err
+			}
+			delete(current, key)
+		}
+		leases = current
+		return nil
+	})
+	if err != nil {
+		return SrvConfig{}, fmt.Errorf("peer store: lease: %w", err)
+	}
+	cfg.leases = leases
+	return cfg, nil
+}
+
+// storePeer adds the client with default settings to the peer store unless it
+// is already there.
+func storePeer(store peerstore.Store, key wirebox.PeerKey) (added bool, err error) {
+	err = store.Update(func(tx peerstore.Tx) error {
+		_, err := tx.Get(key.Encoded)
+		if err == nil || !errors.Is(err, peerstore.ErrNotFound) {
+			return err
+		}
+		added = true
+		return tx.Put(peerstore.Peer{Key: key.Encoded, Added: time.Now()})
+	})
+	return added, err
+}
+
+// watchStore reconciles the server when the peer store is changed, e.g. by
+// "wboxd store" or another server sharing it.
+func (s *Server) watchStore() (stop func(), err error) {
+	s.lock.RLock()
+	store := s.Cfg.store
+	s.lock.RUnlock()
+
+	return store.Watch(func() {
+		s.lock.RLock()
+		cfg := s.Cfg
+		s.lock.RUnlock()
+
+		cfg, err := cfg.reloadStore()
+		if err != nil {
+			log.Println("error: peer store not applied:", err)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			log.Println("error: peer store not applied:", err)
+			return
+		}
+		if err := s.Reconcile(cfg); err != nil {
+			log.Println("error: peer store:", err)
+			return
+		}
+		log.Println("applied peer store,", len(cfg.storeKeys), "clients in store")
+	})
+}
+
+func storeMain(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("store", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wboxd store list")
+		fmt.Fprintln(fs.Output(), "       wboxd store add KEY [SETTINGS-FILE]")
+		fmt.Fprintln(fs.Output(), "       wboxd store remove KEY")
+		fmt.Fprintln(fs.Output(), "Manages clients in the peer store. Settings are in the format of")
+		fmt.Fprintln(fs.Output(), "peers file entries (YAML). The running server applies changes itself.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("error:", err)
+		return 2
+	}
+	if cfg.store == nil {
+		log.Println("error: peer-store is not configured")
+		return 2
+	}
+	defer cfg.store.Close()
+
+	switch cmd, args := fs.Arg(0), fs.Args()[1:]; {
+	case cmd == "list" && len(args) == 0:
+		var peers []peerstore.Peer
+		err := cfg.store.View(func(tx peerstore.Tx) error {
+			var err error
+			peers, err = tx.List()
+			return err
+		})
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tADDED\tPOOL SLOT")
+		for _, p := range peers {
+			slot := "-"
+			if s, ok := cfg.leases[p.Key]; ok {
+				slot = fmt.Sprint(s)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Key, p.Added.Format(time.RFC3339), slot)
+		}
+		tw.Flush()
+	case cmd == "add" && (len(args) == 1 || len(args) == 2):
+		if err := validate.Key(args[0]); err != nil {
+			log.Println("error:", err)
+			return 2
+		}
+		p := peerstore.Peer{Key: args[0], Added: time.Now()}
+		if len(args) == 2 {
+			p.Settings, err = ioutil.ReadFile(args[1])
+			if err != nil {
+				log.Println("error:", err)
+				return 2
+			}
+			if _, err := parseStoreSettings(p.Settings); err != nil {
+				log.Println("error:", args[1]+":", err)
+				return 2
+			}
+		}
+		if err := cfg.store.Update(func(tx peerstore.Tx) error { return tx.Put(p) }); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+	case cmd == "remove" && len(args) == 1:
+		if err := cfg.store.Update(func(tx peerstore.Tx) error { return tx.Delete(args[0]) }); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
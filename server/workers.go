@@ -0,0 +1,108 @@
+package wboxserver
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/foxcpp/wirebox/debugsrv"
+	wboxproto "github.com/foxcpp/wirebox/proto"
+)
+
+// replyWriter sends replies to solictations, implemented by *net.UDPConn.
+type replyWriter interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+type solictJob struct {
+	c      replyWriter
+	link   string
+	sender *net.UDPAddr
+	msg    *wboxproto.CfgSolict
+}
+
+// workerPool handles solictations concurrently. Jobs are sharded between
+// workers by the client key so solictations from the same client are
+// processed in order and a single client cannot occupy all workers.
+type workerPool struct {
+	// Number of solictations dropped because the queue was full. First
+	// field to keep it 64-bit aligned for atomic operations.
+	dropped uint64
+
+	queues []chan solictJob
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(workers, queue int, handle func(solictJob)) *workerPool {
+	p := &workerPool{queues: make([]chan solictJob, workers)}
+	for i := range p.queues {
+		q := make(chan solictJob, queue)
+		p.queues[i] = q
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			// Panics in goroutines do not reach the recovery in run.
+			defer reporter.Recover()
+			for job := range q {
+				handle(job)
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues the job without blocking. The job is dropped if the worker
+// is busy, the client repeats the solictation after the timeout anyway and
+// the reader keeps draining the socket.
+func (p *workerPool) submit(job solictJob) bool {
+	h := fnv.New32a()
+	h.Write(job.msg.GetPeerPubkey())
+	select {
+	case p.queues[h.Sum32()%uint32(len(p.queues))] <- job:
+		return true
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+		return false
+	}
+}
+
+// stop waits for queued jobs to complete. submit should not be called after
+// stop.
+func (p *workerPool) stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+func (p *workerPool) queued() int {
+	n := 0
+	for _, q := range p.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Metrics returns solictation handling metrics for the debug server.
+func (s *Server) Metrics() []debugsrv.Metric {
+	s.lock.RLock()
+	pool := s.pool
+	s.lock.RUnlock()
+	metrics := conflictMetrics(s.Conflicts())
+	if pool == nil {
+		return metrics
+	}
+	return append(metrics, []debugsrv.Metric{
+		{
+			Name:  "wirebox_solict_queue_length",
+			Help:  "Number of solictations waiting for a worker.",
+			Value: float64(pool.queued()),
+		},
+		{
+			Name:  "wirebox_solict_dropped_total",
+			Help:  "Number of solictations dropped because workers were busy.",
+			Value: float64(atomic.LoadUint64(&pool.dropped)),
+		},
+	}...)
+}
@@ -0,0 +1,274 @@
+// Package splitdns implements the DNS forwarder used for domain-based split
+// tunneling.
+//
+// Queries for configured domains are sent to the resolver reachable via the
+// tunnel, other queries go to the upstream resolver. Addresses from answers
+// for configured domains are reported so routes for them can be installed
+// before the response reaches the application.
+package splitdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxMsgSize = 65535
+
+type Forwarder struct {
+	// Domains routed via the tunnel. "example.org" matches the name itself
+	// and all names under it, "*.example.org" matches only names under it.
+	Domains []string
+	// Resolver addresses (host:port) for matching and other queries.
+	Tunnel   string
+	Upstream string
+	// Timeout for each forwarded query.
+	Timeout time.Duration
+
+	// Resolved is called with addresses from the answer to the query for a
+	// matching domain and the lowest TTL of them. The response is sent to
+	// the client after Resolved returns.
+	Resolved func(name string, addrs []net.IP, ttl time.Duration)
+
+	udp *net.UDPConn
+	tcp *net.TCPListener
+	wg  sync.WaitGroup
+}
+
+// Match reports whether name matches any of domains.
+func Match(domains []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if strings.HasPrefix(d, "*.") {
+			if strings.HasSuffix(name, d[1:]) {
+				return true
+			}
+			continue
+		}
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen starts serving queries on UDP and TCP address addr.
+func (f *Forwarder) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("splitdns: %w", err)
+	}
+	f.udp, err = net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("splitdns: %w", err)
+	}
+	// The port is taken from the UDP socket in case addr has port 0.
+	bound := f.udp.LocalAddr().(*net.UDPAddr)
+	f.tcp, err = net.ListenTCP("tcp", &net.TCPAddr{IP: bound.IP, Port: bound.Port, Zone: bound.Zone})
+	if err != nil {
+		f.udp.Close()
+		return fmt.Errorf("splitdns: %w", err)
+	}
+
+	f.wg.Add(2)
+	go f.serveUDP()
+	go f.serveTCP()
+	return nil
+}
+
+// Close stops serving queries and waits for ones in progress.
+func (f *Forwarder) Close() error {
+	f.udp.Close()
+	err := f.tcp.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *Forwarder) serveUDP() {
+	defer f.wg.Done()
+	for {
+		buf := make([]byte, maxMsgSize)
+		n, addr, err := f.udp.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			resp, err := f.handle("udp", buf[:n])
+			if err != nil {
+				log.Println("error: splitdns:", err)
+				return
+			}
+			f.udp.WriteToUDP(resp, addr)
+		}()
+	}
+}
+
+func (f *Forwarder) serveTCP() {
+	defer f.wg.Done()
+	for {
+		c, err := f.tcp.AcceptTCP()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(f.Timeout))
+			query, err := readTCPMsg(c)
+			if err != nil {
+				return
+			}
+			resp, err := f.handle("tcp", query)
+			if err != nil {
+				log.Println("error: splitdns:", err)
+				return
+			}
+			writeTCPMsg(c, resp)
+		}()
+	}
+}
+
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// handle forwards the query to the resolver selected by the question name
+// and returns the response.
+func (f *Forwarder) handle(network string, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	name := q.Name.String()
+	tunnel := Match(f.Domains, name)
+	server := f.Upstream
+	if tunnel {
+		server = f.Tunnel
+	}
+
+	resp, err := exchange(network, server, query, f.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if tunnel && f.Resolved != nil {
+		if addrs, ttl := answerAddrs(resp); len(addrs) != 0 {
+			f.Resolved(name, addrs, ttl)
+		}
+	}
+	return resp, nil
+}
+
+func exchange(network, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	c, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	if network == "tcp" {
+		if err := writeTCPMsg(c, query); err != nil {
+			return nil, err
+		}
+		return readTCPMsg(c)
+	}
+
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMsgSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// answerAddrs returns A and AAAA records from the answer section, including
+// ones for CNAME targets, and the lowest TTL of them.
+func answerAddrs(resp []byte) ([]net.IP, time.Duration) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		return nil, 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0
+	}
+
+	var (
+		addrs  []net.IP
+		minTTL uint32
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		var ip net.IP
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return addrs, time.Duration(minTTL) * time.Second
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return addrs, time.Duration(minTTL) * time.Second
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return addrs, time.Duration(minTTL) * time.Second
+			}
+			continue
+		}
+		if len(addrs) == 0 || h.TTL < minTTL {
+			minTTL = h.TTL
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs, time.Duration(minTTL) * time.Second
+}
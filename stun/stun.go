@@ -0,0 +1,183 @@
+// Package stun implements the client side of the STUN Binding request
+// (RFC 5389) used to discover the public address behind NAT.
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	magicCookie = 0x2112A442
+
+	bindingRequest  = 0x0001
+	bindingResponse = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrXORMappedAddress = 0x0020
+
+	headerLen = 20
+)
+
+var ErrNoAddress = errors.New("stun: no mapped address in response")
+
+func request() ([]byte, []byte, error) {
+	msg := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(msg[0:2], bindingRequest)
+	binary.BigEndian.PutUint16(msg[2:4], 0)
+	binary.BigEndian.PutUint32(msg[4:8], magicCookie)
+	if _, err := rand.Read(msg[8:20]); err != nil {
+		return nil, nil, err
+	}
+	return msg, msg[8:20], nil
+}
+
+func parseAddr(value []byte, xor bool, txID []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, errors.New("stun: malformed address attribute")
+	}
+	family := value[1]
+	port := binary.BigEndian.Uint16(value[2:4])
+
+	var ipLen int
+	switch family {
+	case 1:
+		ipLen = 4
+	case 2:
+		ipLen = 16
+	default:
+		return nil, fmt.Errorf("stun: unknown address family %d", family)
+	}
+	if len(value) < 4+ipLen {
+		return nil, errors.New("stun: malformed address attribute")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, value[4:4+ipLen])
+
+	if xor {
+		port ^= magicCookie >> 16
+		var key [16]byte
+		binary.BigEndian.PutUint32(key[0:4], magicCookie)
+		copy(key[4:], txID)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func parseResponse(b []byte, txID []byte) (*net.UDPAddr, error) {
+	if len(b) < headerLen {
+		return nil, errors.New("stun: short response")
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != bindingResponse {
+		return nil, fmt.Errorf("stun: unexpected message type %#x", binary.BigEndian.Uint16(b[0:2]))
+	}
+	if binary.BigEndian.Uint32(b[4:8]) != magicCookie || string(b[8:20]) != string(txID) {
+		return nil, errors.New("stun: transaction mismatch")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < headerLen+length {
+		return nil, errors.New("stun: truncated response")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := b[headerLen : headerLen+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return nil, errors.New("stun: truncated attribute")
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch typ {
+		case attrXORMappedAddress:
+			return parseAddr(value, true, txID)
+		case attrMappedAddress:
+			var err error
+			mapped, err = parseAddr(value, false, txID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Attributes are padded to 4 bytes.
+		padded := (attrLen + 3) &^ 3
+		if len(attrs) < 4+padded {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+	if mapped == nil {
+		return nil, ErrNoAddress
+	}
+	return mapped, nil
+}
+
+// Query sends the Binding request to server (host:port) and returns the
+// address the request came from as seen by the server.
+func Query(server string, timeout time.Duration) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("stun: %w", err)
+	}
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("stun: %w", err)
+	}
+	defer c.Close()
+
+	req, txID, err := request()
+	if err != nil {
+		return nil, fmt.Errorf("stun: %w", err)
+	}
+	buffer := make([]byte, 1500)
+	// Retransmit a few times within the timeout, UDP packets get lost.
+	for attempt := 0; ; attempt++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, fmt.Errorf("stun: %w", err)
+		}
+		if err := c.SetReadDeadline(time.Now().Add(timeout / 3)); err != nil {
+			return nil, fmt.Errorf("stun: %w", err)
+		}
+		n, err := c.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if attempt < 2 && errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, fmt.Errorf("stun: %v: %w", server, err)
+		}
+		addr, err := parseResponse(buffer[:n], txID)
+		if err != nil {
+			// Stray or malformed packet, wait for the next one.
+			if attempt < 2 {
+				continue
+			}
+			return nil, err
+		}
+		return addr, nil
+	}
+}
+
+// Discover queries servers in order and returns the first discovered
+// address.
+func Discover(servers []string, timeout time.Duration) (*net.UDPAddr, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("stun: no servers configured")
+	}
+	var lastErr error
+	for _, s := range servers {
+		addr, err := Query(s, timeout)
+		if err == nil {
+			return addr, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,199 @@
+// Package sysctl changes kernel network parameters of tunnel interfaces and
+// restores their previous values on teardown.
+//
+// Previous values are saved to the state file, so they are restored even if
+// the tunnel is removed by another invocation (e.g. wbox down) or after a
+// crash.
+package sysctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/foxcpp/wirebox/audit"
+)
+
+// DefaultDir is the directory state files are kept in.
+const DefaultDir = "/run/wirebox"
+
+// Config lists parameters set for tunnel interfaces, empty values are left
+// unchanged.
+type Config struct {
+	// net.ipv6.conf.IF.accept_ra
+	AcceptRA string `toml:"accept-ra"`
+	// net.ipv6.conf.IF.disable_ipv6
+	DisableIPv6 string `toml:"disable-ipv6"`
+	// net.ipv4.conf.IF.rp_filter, note the kernel uses the maximum of it and
+	// net.ipv4.conf.all.rp_filter.
+	RPFilter string `toml:"rp-filter"`
+	// net.ipv4.conf.IF.forwarding and net.ipv6.conf.IF.forwarding
+	Forwarding string `toml:"forwarding"`
+	// net.ipv4.ip_forward and net.ipv6.conf.all.forwarding, global for the
+	// network namespace.
+	IPForward string `toml:"ip-forward"`
+}
+
+func (c Config) Enabled() bool {
+	return c != Config{}
+}
+
+// Validate checks the configuration, field names in errors are relative to
+// the configuration section.
+func (c Config) Validate() error {
+	for _, f := range []struct {
+		name, val string
+	}{
+		{"accept-ra", c.AcceptRA},
+		{"disable-ipv6", c.DisableIPv6},
+		{"rp-filter", c.RPFilter},
+		{"forwarding", c.Forwarding},
+		{"ip-forward", c.IPForward},
+	} {
+		if f.val == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(f.val); err != nil || n < 0 {
+			return fmt.Errorf("%v should be a non-negative integer", f.name)
+		}
+	}
+	return nil
+}
+
+// Setting is the value of the parameter at Path, relative to /proc/sys (e.g.
+// net/ipv4/ip_forward). Paths are used instead of dotted names since
+// interface names can contain dots.
+type Setting struct {
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// Settings returns parameters to set for the interface link.
+func (c Config) Settings(link string) []Setting {
+	var res []Setting
+	add := func(val string, paths ...string) {
+		if val == "" {
+			return
+		}
+		for _, p := range paths {
+			res = append(res, Setting{Path: p, Value: val})
+		}
+	}
+	// Global forwarding first, setting it resets per-interface values.
+	add(c.IPForward, "net/ipv4/ip_forward", "net/ipv6/conf/all/forwarding")
+	add(c.DisableIPv6, "net/ipv6/conf/"+link+"/disable_ipv6")
+	add(c.AcceptRA, "net/ipv6/conf/"+link+"/accept_ra")
+	add(c.RPFilter, "net/ipv4/conf/"+link+"/rp_filter")
+	add(c.Forwarding, "net/ipv4/conf/"+link+"/forwarding", "net/ipv6/conf/"+link+"/forwarding")
+	return res
+}
+
+// StatePath returns the path of the state file for the owner name, e.g. the
+// tunnel interface.
+func StatePath(name string) string {
+	return filepath.Join(DefaultDir, "sysctl-"+name+".json")
+}
+
+func loadState(path string) ([]Setting, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var prev []Setting
+	if err := json.Unmarshal(blob, &prev); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return prev, nil
+}
+
+func saveState(path string, prev []Setting) error {
+	blob, err := json.Marshal(prev)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, blob, 0644)
+}
+
+// Apply sets parameters and adds their previous values to the state file.
+// Values already saved there are kept, so repeated calls do not overwrite the
+// original ones.
+func Apply(statePath string, settings []Setting) error {
+	prev, err := loadState(statePath)
+	if err != nil {
+		return fmt.Errorf("sysctl: %w", err)
+	}
+	saved := make(map[string]bool, len(prev))
+	for _, s := range prev {
+		saved[s.Path] = true
+	}
+
+	var changed []Setting
+	for _, s := range settings {
+		cur, err := read(s.Path)
+		if err != nil {
+			return fmt.Errorf("sysctl: %v: %w", s.Path, err)
+		}
+		if cur == s.Value {
+			continue
+		}
+		if !saved[s.Path] {
+			prev = append(prev, Setting{Path: s.Path, Value: cur})
+			saved[s.Path] = true
+		}
+		changed = append(changed, s)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	// Saved before any change so values are restored even if writing some
+	// of them fails.
+	if err := saveState(statePath, prev); err != nil {
+		return fmt.Errorf("sysctl: %w", err)
+	}
+	for _, s := range changed {
+		audit.Record("sysctl", "%s = %s", s.Path, s.Value)
+		if err := write(s.Path, s.Value); err != nil {
+			return fmt.Errorf("sysctl: %v: %w", s.Path, err)
+		}
+	}
+	return nil
+}
+
+// Restore sets parameters back to values saved in the state file by Apply
+// and removes the file. Parameters of removed interfaces are skipped.
+func Restore(statePath string) error {
+	prev, err := loadState(statePath)
+	if err != nil {
+		return fmt.Errorf("sysctl: %w", err)
+	}
+	if prev == nil {
+		return nil
+	}
+
+	var firstErr error
+	for i := len(prev) - 1; i >= 0; i-- {
+		s := prev[i]
+		audit.Record("sysctl", "%s = %s", s.Path, s.Value)
+		if err := write(s.Path, s.Value); err != nil && !errors.Is(err, os.ErrNotExist) && firstErr == nil {
+			firstErr = fmt.Errorf("sysctl: %v: %w", s.Path, err)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := os.Remove(statePath); err != nil {
+		return fmt.Errorf("sysctl: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package sysctl
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const procSys = "/proc/sys"
+
+func read(path string) (string, error) {
+	val, err := ioutil.ReadFile(filepath.Join(procSys, path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(val)), nil
+}
+
+func write(path, val string) error {
+	return ioutil.WriteFile(filepath.Join(procSys, path), []byte(val+"\n"), 0644)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package sysctl
+
+import (
+	"errors"
+)
+
+var errUnsupported = errors.New("not supported on this platform")
+
+func read(string) (string, error) {
+	return "", errUnsupported
+}
+
+func write(string, string) error {
+	return errUnsupported
+}
@@ -0,0 +1,74 @@
+// Package top implements the live status dashboard of running wirebox
+// daemons.
+//
+// Daemons serve Snapshot via the control socket, the dashboard polls it and
+// computes throughput from the differences between snapshots.
+package top
+
+import (
+	"time"
+
+	"github.com/foxcpp/wirebox"
+	"github.com/foxcpp/wirebox/linkmgr"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type Peer struct {
+	PublicKey     string    `json:"public-key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	LastHandshake time.Time `json:"last-handshake"`
+	RxBytes       int64     `json:"rx-bytes"`
+	TxBytes       int64     `json:"tx-bytes"`
+}
+
+type Link struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+	Peers []Peer `json:"peers"`
+}
+
+type Snapshot struct {
+	Time   time.Time             `json:"time"`
+	Links  []Link                `json:"links"`
+	Events []wirebox.EventRecord `json:"events"`
+}
+
+// Collect reads the state of named links. Errors for separate links are
+// reported in Link.Error. events can be nil.
+func Collect(m linkmgr.Manager, names []string, events *wirebox.EventLog) Snapshot {
+	snap := Snapshot{Time: time.Now()}
+	for _, name := range names {
+		link := Link{Name: name, Peers: []Peer{}}
+		dev, err := wgDevice(m, name)
+		if err != nil {
+			link.Error = err.Error()
+			snap.Links = append(snap.Links, link)
+			continue
+		}
+		for _, p := range dev.Peers {
+			peer := Peer{
+				PublicKey:     p.PublicKey.String(),
+				LastHandshake: p.LastHandshakeTime,
+				RxBytes:       p.ReceiveBytes,
+				TxBytes:       p.TransmitBytes,
+			}
+			if p.Endpoint != nil {
+				peer.Endpoint = p.Endpoint.String()
+			}
+			link.Peers = append(link.Peers, peer)
+		}
+		snap.Links = append(snap.Links, link)
+	}
+	if events != nil {
+		snap.Events = events.Recent()
+	}
+	return snap
+}
+
+func wgDevice(m linkmgr.Manager, name string) (*wgtypes.Device, error) {
+	l, err := m.GetLink(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.WGConfig()
+}
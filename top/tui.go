@@ -0,0 +1,278 @@
+package top
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/foxcpp/wirebox/ctlsock"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// historyLen is the number of throughput samples shown in sparklines.
+const historyLen = 30
+
+type peerRate struct {
+	rx, tx float64
+}
+
+// dashboard keeps the state needed to compute rates between snapshots.
+type dashboard struct {
+	snap    Snapshot
+	history map[string][]float64
+	rates   map[string]peerRate
+}
+
+func peerID(link, key string) string {
+	return link + "/" + key
+}
+
+func (d *dashboard) update(snap Snapshot) {
+	rates := map[string]peerRate{}
+	var elapsed float64
+	hasPrev := !d.snap.Time.IsZero()
+	prevPeers := map[string]Peer{}
+	if hasPrev {
+		elapsed = snap.Time.Sub(d.snap.Time).Seconds()
+		for _, l := range d.snap.Links {
+			for _, p := range l.Peers {
+				prevPeers[peerID(l.Name, p.PublicKey)] = p
+			}
+		}
+	}
+
+	for _, l := range snap.Links {
+		var total float64
+		for _, p := range l.Peers {
+			id := peerID(l.Name, p.PublicKey)
+			prev, ok := prevPeers[id]
+			// Counters are reset if the peer is re-added.
+			if !ok || elapsed <= 0 || p.RxBytes < prev.RxBytes || p.TxBytes < prev.TxBytes {
+				continue
+			}
+			r := peerRate{
+				rx: float64(p.RxBytes-prev.RxBytes) / elapsed,
+				tx: float64(p.TxBytes-prev.TxBytes) / elapsed,
+			}
+			rates[id] = r
+			total += r.rx + r.tx
+		}
+		if hasPrev {
+			h := append(d.history[l.Name], total)
+			if len(h) > historyLen {
+				h = h[len(h)-historyLen:]
+			}
+			d.history[l.Name] = h
+		}
+	}
+
+	d.rates = rates
+	d.snap = snap
+}
+
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+func sparkline(samples []float64) string {
+	var max float64
+	for _, s := range samples {
+		if s > max {
+			max = s
+		}
+	}
+	var b strings.Builder
+	for i := len(samples); i < historyLen; i++ {
+		b.WriteRune(' ')
+	}
+	for _, s := range samples {
+		i := 0
+		if max > 0 {
+			i = int(s / max * float64(len(sparkChars)-1))
+		}
+		b.WriteRune(sparkChars[i])
+	}
+	return b.String()
+}
+
+func formatRate(bps float64) string {
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	i := 0
+	for bps >= 1024 && i < len(units)-1 {
+		bps /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", bps, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", bps, units[i])
+}
+
+func formatAge(now, t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
+
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width])
+}
+
+// render formats the dashboard using at most width columns and height rows.
+func (d *dashboard) render(title string, width, height int) []string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, truncate(fmt.Sprintf(format, args...), width))
+	}
+
+	now := d.snap.Time
+	add("%s - %s (q to quit)", title, now.Format("2006-01-02 15:04:05"))
+	for _, l := range d.snap.Links {
+		add("")
+		if l.Error != "" {
+			add("%s  error: %s", l.Name, l.Error)
+			continue
+		}
+		h := d.history[l.Name]
+		var cur float64
+		if len(h) != 0 {
+			cur = h[len(h)-1]
+		}
+		add("%s  %s  %s", l.Name, sparkline(h), formatRate(cur))
+		add("  %-44s  %-22s  %-12s  %-11s  %-11s", "PEER", "ENDPOINT", "HANDSHAKE", "RX", "TX")
+
+		peers := append([]Peer(nil), l.Peers...)
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i].LastHandshake.After(peers[j].LastHandshake)
+		})
+		for _, p := range peers {
+			r := d.rates[peerID(l.Name, p.PublicKey)]
+			add("  %-44s  %-22s  %-12s  %-11s  %-11s", p.PublicKey, p.Endpoint,
+				formatAge(now, p.LastHandshake), formatRate(r.rx), formatRate(r.tx))
+		}
+	}
+
+	add("")
+	add("Recent events")
+	events := d.snap.Events
+	if room := height - len(lines); room < len(events) {
+		if room < 0 {
+			room = 0
+		}
+		events = events[len(events)-room:]
+	}
+	for _, e := range events {
+		add("  %s  %-22s %s", e.Time.Format("15:04:05"), e.Name, e.Data)
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+// Run implements the top command showing the dashboard for the daemon
+// listening on the control socket. title is shown in the first line.
+func Run(socket, title string, args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: top [options]")
+		fmt.Fprintln(fs.Output(), "Shows interfaces, peers, throughput and recent events of the running")
+		fmt.Fprintln(fs.Output(), "daemon. Only a single frame is printed if stdout is not a terminal.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	d := &dashboard{history: map[string][]float64{}}
+	poll := func() error {
+		var snap Snapshot
+		if err := ctlsock.Call(socket, "top", nil, &snap); err != nil {
+			return err
+		}
+		d.update(snap)
+		return nil
+	}
+
+	if err := poll(); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	outFd := int(os.Stdout.Fd())
+	if !terminal.IsTerminal(outFd) {
+		for _, l := range d.render(title, 1<<16, 1<<16) {
+			fmt.Println(l)
+		}
+		return 0
+	}
+
+	quit := make(chan struct{}, 1)
+	inFd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(inFd) {
+		state, err := terminal.MakeRaw(inFd)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		defer terminal.Restore(inFd, state)
+		go func() {
+			buf := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(buf); err != nil {
+					return
+				}
+				// q or Ctrl-C, the latter does not send SIGINT in raw mode.
+				if buf[0] == 'q' || buf[0] == 3 {
+					quit <- struct{}{}
+					return
+				}
+			}
+		}()
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	// Use the alternate screen so the dashboard does not clobber the
+	// scrollback, restore it and the cursor on exit.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		width, height, err := terminal.GetSize(outFd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		lines := d.render(title, width, height)
+		if lastErr != nil {
+			lines[len(lines)-1] = truncate("error: "+lastErr.Error(), width)
+		}
+		// Clear the screen and move the cursor to the top-left corner, \r is
+		// needed since the terminal is in raw mode.
+		fmt.Print("\x1b[H\x1b[2J" + strings.Join(lines, "\r\n"))
+
+		select {
+		case <-quit:
+			return 0
+		case <-sig:
+			return 0
+		case <-ticker.C:
+			lastErr = poll()
+		}
+	}
+}
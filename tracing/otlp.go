@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLPExporter sends spans to the OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding.
+type OTLPExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpKindInternal = 1
+
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	scopeSpans := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/foxcpp/wirebox"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+
+	for _, s := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if s.ParentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != nil {
+			out.Status = otlpStatus{Code: otlpStatusError, Message: s.Err.Error()}
+		}
+
+		keys := make([]string, 0, len(s.Attrs))
+		for k := range s.Attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out.Attributes = append(out.Attributes, otlpAttr{Key: k, Value: otlpValue{s.Attrs[k]}})
+		}
+
+		scopeSpans.Spans = append(scopeSpans.Spans, out)
+	}
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttr{{Key: "service.name", Value: otlpValue{service}}},
+				},
+				ScopeSpans: []otlpScopeSpans{scopeSpans},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: unexpected response status: %v", resp.Status)
+	}
+	return nil
+}
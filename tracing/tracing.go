@@ -0,0 +1,275 @@
+// Package tracing implements minimal OpenTelemetry-compatible tracing for the
+// configuration pipeline.
+//
+// Spans are exported in batches using OTLP/HTTP JSON encoding so any
+// OpenTelemetry collector can receive them. Trace context is propagated
+// between client and server using W3C traceparent format.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Exporter to use, "otlp" or "log". Tracing is disabled if empty.
+	Exporter string `toml:"exporter"`
+	// OTLP/HTTP traces endpoint, e.g. http://127.0.0.1:4318/v1/traces.
+	Endpoint string `toml:"endpoint"`
+}
+
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+
+	Name  string
+	Start time.Time
+	End   time.Time
+	Attrs map[string]string
+	Err   error
+
+	tracer *Tracer
+}
+
+// SetAttr sets the span attribute. It is no-op for nil span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]string)
+	}
+	s.Attrs[key] = fmt.Sprint(value)
+}
+
+// Finish records the span end time and queues it for export. err is the
+// outcome of the traced operation, it can be nil.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.queue(s)
+}
+
+// TraceParent returns the W3C traceparent value for the span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-01"
+}
+
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// Tracer creates spans and exports them in background.
+//
+// nil *Tracer is valid and produces nil spans that are no-op.
+type Tracer struct {
+	service  string
+	exporter Exporter
+
+	lock    sync.Mutex
+	pending []*Span
+	// Spans dropped since the last export because batches were full.
+	dropped int
+
+	// Full batches handed to flushLoop, so finishing spans never waits for
+	// the exporter.
+	batches chan []*Span
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+const (
+	batchSize     = 64
+	flushInterval = 5 * time.Second
+	// maxBatches limits full batches waiting for export, spans are dropped
+	// if the exporter falls behind.
+	maxBatches = 4
+)
+
+// New creates the Tracer using the exporter specified in the configuration.
+//
+// nil Tracer is returned if tracing is disabled.
+func New(cfg Config, service string) (*Tracer, error) {
+	var exp Exporter
+	switch cfg.Exporter {
+	case "":
+		return nil, nil
+	case "log":
+		exp = logExporter{}
+	case "otlp":
+		if cfg.Endpoint == "" {
+			return nil, errors.New("tracing: endpoint is required for otlp exporter")
+		}
+		exp = NewOTLPExporter(cfg.Endpoint)
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter: %v", cfg.Exporter)
+	}
+	return NewTracer(service, exp), nil
+}
+
+func NewTracer(service string, exp Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exp,
+		batches:  make(chan []*Span, maxBatches),
+		stop:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.flushLoop()
+	return t
+}
+
+// Start creates a new span. If parent is nil, the span starts a new trace.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		Name:   name,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else if _, err := rand.Read(s.TraceID[:]); err != nil {
+		log.Println("tracing: cannot generate trace ID:", err)
+	}
+	if _, err := rand.Read(s.SpanID[:]); err != nil {
+		log.Println("tracing: cannot generate span ID:", err)
+	}
+	return s
+}
+
+// StartRemote creates a new span continuing the trace identified by W3C
+// traceparent value. New trace is started if traceParent is empty or
+// malformed.
+func (t *Tracer) StartRemote(name string, traceParent string) *Span {
+	if t == nil {
+		return nil
+	}
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return t.Start(name, nil)
+	}
+	var parent Span
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(parent.TraceID) {
+		return t.Start(name, nil)
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(parent.SpanID) {
+		return t.Start(name, nil)
+	}
+	copy(parent.TraceID[:], traceID)
+	copy(parent.SpanID[:], spanID)
+	return t.Start(name, &parent)
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.lock.Lock()
+	t.pending = append(t.pending, s)
+	if len(t.pending) < batchSize {
+		t.lock.Unlock()
+		return
+	}
+	batch := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+
+	select {
+	case t.batches <- batch:
+	default:
+		t.lock.Lock()
+		t.dropped += len(batch)
+		t.lock.Unlock()
+	}
+}
+
+func (t *Tracer) export(spans []*Span) {
+	t.lock.Lock()
+	dropped := t.dropped
+	t.dropped = 0
+	t.lock.Unlock()
+	if dropped != 0 {
+		log.Println("tracing: exporter is too slow, dropped", dropped, "spans")
+	}
+
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.Export(t.service, spans); err != nil {
+		log.Println("tracing: export failed:", err)
+	}
+}
+
+func (t *Tracer) flush() {
+	t.lock.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+
+	t.export(spans)
+}
+
+func (t *Tracer) flushLoop() {
+	defer t.wg.Done()
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case batch := <-t.batches:
+			t.export(batch)
+		case <-tick.C:
+			t.flush()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Close exports all pending spans and stops the background export.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	t.wg.Wait()
+	for {
+		select {
+		case batch := <-t.batches:
+			t.export(batch)
+			continue
+		default:
+		}
+		break
+	}
+	t.flush()
+	return nil
+}
+
+type logExporter struct{}
+
+func (logExporter) Export(service string, spans []*Span) error {
+	for _, s := range spans {
+		status := "ok"
+		if s.Err != nil {
+			status = s.Err.Error()
+		}
+		log.Printf("trace: %s %x/%x %s %v %v %s", service, s.TraceID, s.SpanID, s.Name, s.End.Sub(s.Start), s.Attrs, status)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Package validate implements checks shared by the client and server
+// configuration validation.
+//
+// All checks report problems using Error values that carry the location
+// (dot-separated path of the configuration key) of the offending value.
+package validate
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Error describes a problem with a single configuration value.
+type Error struct {
+	// Dot-separated path to the configuration key, e.g. "clients.AAAA.if".
+	Field string
+	Msg   string
+}
+
+func (err Error) Error() string {
+	if err.Field == "" {
+		return "config: " + err.Msg
+	}
+	return "config: " + err.Field + ": " + err.Msg
+}
+
+// Errors collects all problems found in the configuration so they can be
+// reported at once.
+type Errors []Error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Add records the problem with the field value.
+func (errs *Errors) Add(field, format string, args ...interface{}) {
+	*errs = append(*errs, Error{
+		Field: field,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+// Check records the error returned by one of check functions, if any.
+func (errs *Errors) Check(field string, err error) {
+	if err == nil {
+		return
+	}
+	errs.Add(field, "%v", err)
+}
+
+// Err returns nil if no problems were recorded and errs otherwise.
+func (errs Errors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Field joins the configuration key path components.
+func Field(path ...string) string {
+	return strings.Join(path, ".")
+}
+
+// KeyPattern matches base64-encoded WireGuard keys, for use in JSON Schema.
+const KeyPattern = `^[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=$`
+
+// Key checks whether encoded is a valid base64-encoded WireGuard key.
+func Key(encoded string) error {
+	if encoded == "" {
+		return fmt.Errorf("is required")
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("malformed key: %v", err)
+	}
+	if len(b) != 32 {
+		return fmt.Errorf("key should be 32 bytes, got %v", len(b))
+	}
+	return nil
+}
+
+// Port checks whether p is a valid UDP port number.
+func Port(p int) error {
+	if p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid port number: %v", p)
+	}
+	return nil
+}
+
+// IfName checks whether name can be used as a network interface name of at
+// most maxLen octets.
+func IfName(name string, maxLen int) error {
+	if name == "" {
+		return fmt.Errorf("is required")
+	}
+	if len(name) > maxLen {
+		return fmt.Errorf("is too long (can be %v octets at most)", maxLen)
+	}
+	if strings.ContainsAny(name, "/ \t\n:") {
+		return fmt.Errorf("contains characters not allowed in the interface name")
+	}
+	return nil
+}
+
+// CIDR checks whether n is a valid network prefix with no host bits set.
+func CIDR(n net.IPNet) error {
+	if n.IP == nil {
+		return fmt.Errorf("is required")
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 0 {
+		return fmt.Errorf("non-canonical network mask")
+	}
+	if !n.IP.Mask(n.Mask).Equal(n.IP) {
+		return fmt.Errorf("host bits are set in %v/%v", n.IP, ones)
+	}
+	return nil
+}
+
+// Within checks whether inner network is completely contained in outer.
+func Within(inner, outer net.IPNet) error {
+	innerOnes, innerBits := inner.Mask.Size()
+	outerOnes, outerBits := outer.Mask.Size()
+	if innerBits != outerBits || innerOnes < outerOnes || !outer.Contains(inner.IP) {
+		return fmt.Errorf("%v is not within %v", inner.String(), outer.String())
+	}
+	return nil
+}
+
+// SameFamily checks whether ip belongs to the IPv4 family if v4 is true and to
+// the IPv6 family otherwise.
+func SameFamily(ip net.IP, v4 bool) error {
+	if (ip.To4() != nil) != v4 {
+		if v4 {
+			return fmt.Errorf("%v is not an IPv4 address", ip)
+		}
+		return fmt.Errorf("%v is not an IPv6 address", ip)
+	}
+	return nil
+}
+
+// Exclusive checks that at most one of the named fields is set.
+func Exclusive(set map[string]bool) error {
+	var names []string
+	for name, isSet := range set {
+		if isSet {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 1 {
+		sort.Strings(names)
+		return fmt.Errorf("mutually exclusive options are used together: %v", strings.Join(names, ", "))
+	}
+	return nil
+}
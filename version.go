@@ -0,0 +1,91 @@
+package wirebox
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Version of the wirebox build, set by the linker:
+//
+//	go build -ldflags "-X github.com/foxcpp/wirebox.Version=1.2.3"
+var Version = "dev"
+
+// Capabilities lists protocol features supported by this build. The client
+// reports them in the solictation so the server can refuse clients lacking
+// features it relies on.
+var Capabilities = []string{
+	// Direct tunnels between clients (CfgSolict.mesh, Cfg.peers).
+	"mesh",
+	// Configuration serials (Cfg.serial).
+	"serial",
+	// IPv4 link-local configuration addresses.
+	"config-ipv4",
+	// Site-to-site networks (CfgSolict.subnets4, subnets6).
+	"subnets",
+	// Selection among tunnel endpoint candidates (Cfg.tun_endpoints).
+	"endpoint-hints",
+}
+
+// KnownCapability reports whether capability is listed in Capabilities.
+func KnownCapability(capability string) bool {
+	for _, c := range Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([]int, error) {
+	v = strings.TrimPrefix(v, "v")
+	// Pre-release and build suffixes are ignored.
+	if i := strings.IndexAny(v, "-+"); i != -1 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	res := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, errors.New("malformed version")
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// ValidVersion checks whether v is a dotted version number, such as 1.2 or
+// v1.2.3-rc1.
+func ValidVersion(v string) error {
+	_, err := parseVersion(v)
+	return err
+}
+
+// CompareVersions returns -1 if version a is older than b, 1 if it is newer
+// and 0 if they are the same. Missing components are treated as zeroes.
+func CompareVersions(a, b string) (int, error) {
+	av, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bv, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for len(av) < len(bv) {
+		av = append(av, 0)
+	}
+	for len(bv) < len(av) {
+		bv = append(bv, 0)
+	}
+	for i := range av {
+		switch {
+		case av[i] < bv[i]:
+			return -1, nil
+		case av[i] > bv[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
@@ -9,10 +9,20 @@ import (
 	"syscall"
 
 	"github.com/foxcpp/wirebox/linkmgr"
+	"github.com/foxcpp/wirebox/validate"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func CreateWG(m linkmgr.Manager, name string, cfg wgtypes.Config, addrs []linkmgr.Address) (link linkmgr.Link, created bool, err error) {
+// CreateOpts changes how CreateWG configures the link.
+type CreateOpts struct {
+	// Treat peers in the configuration as the complete set: only changed
+	// peers are updated and peers that are not listed are removed. Unlike
+	// ReplacePeers, sessions of unchanged peers are kept. Peers are removed
+	// only from links created by wirebox (see linkmgr.OwnedLink).
+	SyncPeers bool
+}
+
+func CreateWG(m linkmgr.Manager, name string, cfg wgtypes.Config, addrs []linkmgr.Address, opts CreateOpts) (link linkmgr.Link, created bool, err error) {
 	link, err = m.GetLink(name)
 	if err != nil {
 		created = true
@@ -20,6 +30,12 @@ func CreateWG(m linkmgr.Manager, name string, cfg wgtypes.Config, addrs []linkmg
 		if err != nil {
 			return nil, false, fmt.Errorf("wg create: %w", err)
 		}
+	} else if opts.SyncPeers {
+		dev, err := link.WGConfig()
+		if err != nil {
+			return nil, false, fmt.Errorf("wg create: %w", err)
+		}
+		cfg = peerUpdates(dev, cfg, linkOwned(link))
 	}
 
 	if err := link.ConfigureWG(cfg); err != nil {
@@ -47,6 +63,80 @@ func CreateWG(m linkmgr.Manager, name string, cfg wgtypes.Config, addrs []linkmg
 	return link, created, nil
 }
 
+// linkOwned reports whether the link is tagged as created by wirebox.
+func linkOwned(l linkmgr.Link) bool {
+	ol, ok := l.(linkmgr.OwnedLink)
+	if !ok {
+		return false
+	}
+	owned, err := ol.Owned()
+	if err != nil {
+		log.Println("error:", err)
+		return false
+	}
+	return owned
+}
+
+// peerUpdates converts cfg into the configuration that adds or updates
+// changed peers of dev and, if removeStale is set, removes peers not listed
+// in cfg.
+func peerUpdates(dev *wgtypes.Device, cfg wgtypes.Config, removeStale bool) wgtypes.Config {
+	current := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+	for _, p := range dev.Peers {
+		current[p.PublicKey] = p
+	}
+
+	res := cfg
+	res.ReplacePeers = false
+	res.Peers = nil
+	for _, want := range cfg.Peers {
+		have, ok := current[want.PublicKey]
+		delete(current, want.PublicKey)
+		if ok && peerMatches(have, want) {
+			continue
+		}
+		want.ReplaceAllowedIPs = true
+		res.Peers = append(res.Peers, want)
+	}
+	if !removeStale {
+		if len(current) != 0 {
+			log.Printf("WARNING: wg create: %v: keeping %d peers that are not configured, the link is not tagged as created by wirebox (alias %q)",
+				dev.Name, len(current), linkmgr.LinkAlias)
+		}
+		return res
+	}
+	for key := range current {
+		res.Peers = append(res.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+	return res
+}
+
+// peerMatches reports whether the peer has all settings specified in want.
+func peerMatches(have wgtypes.Peer, want wgtypes.PeerConfig) bool {
+	if want.PresharedKey != nil && have.PresharedKey != *want.PresharedKey {
+		return false
+	}
+	if want.Endpoint != nil && (have.Endpoint == nil || have.Endpoint.String() != want.Endpoint.String()) {
+		return false
+	}
+	if want.PersistentKeepaliveInterval != nil && have.PersistentKeepaliveInterval != *want.PersistentKeepaliveInterval {
+		return false
+	}
+	if len(have.AllowedIPs) != len(want.AllowedIPs) {
+		return false
+	}
+	allowed := make(map[string]bool, len(have.AllowedIPs))
+	for _, n := range have.AllowedIPs {
+		allowed[n.String()] = true
+	}
+	for _, n := range want.AllowedIPs {
+		if !allowed[n.String()] {
+			return false
+		}
+	}
+	return true
+}
+
 type PeerKey struct {
 	Encoded string
 	Bytes   wgtypes.Key
@@ -95,3 +185,8 @@ func (k *PeerKey) UnmarshalText(text []byte) error {
 	*k, err = NewPeerKey(k.Encoded)
 	return err
 }
+
+// JSONSchema describes keys in configuration files, see cfgfile.Schema.
+func (PeerKey) JSONSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "pattern": validate.KeyPattern}
+}
@@ -0,0 +1,279 @@
+// Package wgfmt formats WireGuard configuration and state using the formats
+// of the stock WireGuard tools.
+package wgfmt
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func joinNets(nets []net.IPNet) string {
+	parts := make([]string, 0, len(nets))
+	for _, n := range nets {
+		parts = append(parts, n.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DeviceConfig converts the device state into the configuration that
+// reproduces it.
+func DeviceConfig(dev *wgtypes.Device) wgtypes.Config {
+	cfg := wgtypes.Config{
+		PrivateKey: &dev.PrivateKey,
+		ListenPort: &dev.ListenPort,
+	}
+	if dev.FirewallMark != 0 {
+		cfg.FirewallMark = &dev.FirewallMark
+	}
+	for _, p := range dev.Peers {
+		p := p
+		pc := wgtypes.PeerConfig{
+			PublicKey:  p.PublicKey,
+			Endpoint:   p.Endpoint,
+			AllowedIPs: p.AllowedIPs,
+		}
+		if p.PresharedKey != (wgtypes.Key{}) {
+			pc.PresharedKey = &p.PresharedKey
+		}
+		if p.PersistentKeepaliveInterval != 0 {
+			pc.PersistentKeepaliveInterval = &p.PersistentKeepaliveInterval
+		}
+		cfg.Peers = append(cfg.Peers, pc)
+	}
+	return cfg
+}
+
+// WriteShowConf writes the configuration in the format of `wg showconf`,
+// suitable for `wg setconf`.
+func WriteShowConf(w io.Writer, cfg wgtypes.Config) error {
+	return writeConf(w, cfg, nil)
+}
+
+// WriteQuickConf writes the configuration in the format of wg-quick(8)
+// including interface addresses.
+func WriteQuickConf(w io.Writer, cfg wgtypes.Config, addrs []net.IPNet) error {
+	if addrs == nil {
+		addrs = []net.IPNet{}
+	}
+	return writeConf(w, cfg, addrs)
+}
+
+func writeConf(w io.Writer, cfg wgtypes.Config, addrs []net.IPNet) error {
+	var b strings.Builder
+
+	b.WriteString("[Interface]\n")
+	if len(addrs) != 0 {
+		fmt.Fprintf(&b, "Address = %s\n", joinNets(addrs))
+	}
+	if cfg.ListenPort != nil && *cfg.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", *cfg.ListenPort)
+	}
+	if cfg.FirewallMark != nil && *cfg.FirewallMark != 0 {
+		fmt.Fprintf(&b, "FwMark = 0x%x\n", *cfg.FirewallMark)
+	}
+	if cfg.PrivateKey != nil {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", cfg.PrivateKey)
+	}
+
+	for _, p := range cfg.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&b, "PresharedKey = %s\n", p.PresharedKey)
+		}
+		if len(p.AllowedIPs) != 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", joinNets(p.AllowedIPs))
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint)
+		}
+		if p.PersistentKeepaliveInterval != nil && *p.PersistentKeepaliveInterval != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", int(p.PersistentKeepaliveInterval.Seconds()))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+func formatAgo(d time.Duration) string {
+	secs := int64(d / time.Second)
+	if secs <= 0 {
+		return "Now"
+	}
+	var parts []string
+	for _, u := range []struct {
+		name string
+		secs int64
+	}{
+		{"year", 365 * 24 * 3600},
+		{"day", 24 * 3600},
+		{"hour", 3600},
+		{"minute", 60},
+		{"second", 1},
+	} {
+		if secs >= u.secs {
+			parts = append(parts, plural(secs/u.secs, u.name))
+			secs %= u.secs
+		}
+	}
+	return strings.Join(parts, ", ") + " ago"
+}
+
+func formatBytes(b int64) string {
+	switch {
+	case b < 1024:
+		return fmt.Sprintf("%d B", b)
+	case b < 1024*1024:
+		return fmt.Sprintf("%.2f KiB", float64(b)/1024)
+	case b < 1024*1024*1024:
+		return fmt.Sprintf("%.2f MiB", float64(b)/(1024*1024))
+	case b < 1024*1024*1024*1024:
+		return fmt.Sprintf("%.2f GiB", float64(b)/(1024*1024*1024))
+	default:
+		return fmt.Sprintf("%.2f TiB", float64(b)/(1024*1024*1024*1024))
+	}
+}
+
+// hasHandshake reports whether the handshake with the peer happened. Kernel
+// reports zero Unix time if it did not.
+func hasHandshake(p wgtypes.Peer) bool {
+	return !p.LastHandshakeTime.IsZero() && p.LastHandshakeTime.Unix() != 0
+}
+
+func sortedPeers(dev *wgtypes.Device) []wgtypes.Peer {
+	peers := make([]wgtypes.Peer, len(dev.Peers))
+	copy(peers, dev.Peers)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].LastHandshakeTime.After(peers[j].LastHandshakeTime)
+	})
+	return peers
+}
+
+// WriteShow writes the device state in the human-readable format of
+// `wg show`.
+func WriteShow(w io.Writer, name string, dev *wgtypes.Device) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "interface: %s\n", name)
+	if dev.PublicKey != (wgtypes.Key{}) {
+		fmt.Fprintf(&b, "  public key: %s\n", dev.PublicKey)
+	}
+	if dev.PrivateKey != (wgtypes.Key{}) {
+		b.WriteString("  private key: (hidden)\n")
+	}
+	if dev.ListenPort != 0 {
+		fmt.Fprintf(&b, "  listening port: %d\n", dev.ListenPort)
+	}
+	if dev.FirewallMark != 0 {
+		fmt.Fprintf(&b, "  fwmark: 0x%x\n", dev.FirewallMark)
+	}
+
+	for _, p := range sortedPeers(dev) {
+		fmt.Fprintf(&b, "\npeer: %s\n", p.PublicKey)
+		if p.PresharedKey != (wgtypes.Key{}) {
+			b.WriteString("  preshared key: (hidden)\n")
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&b, "  endpoint: %s\n", p.Endpoint)
+		}
+		allowedIPs := "(none)"
+		if len(p.AllowedIPs) != 0 {
+			allowedIPs = joinNets(p.AllowedIPs)
+		}
+		fmt.Fprintf(&b, "  allowed ips: %s\n", allowedIPs)
+		if hasHandshake(p) {
+			fmt.Fprintf(&b, "  latest handshake: %s\n", formatAgo(time.Since(p.LastHandshakeTime)))
+		}
+		if p.ReceiveBytes != 0 || p.TransmitBytes != 0 {
+			fmt.Fprintf(&b, "  transfer: %s received, %s sent\n", formatBytes(p.ReceiveBytes), formatBytes(p.TransmitBytes))
+		}
+		if p.PersistentKeepaliveInterval != 0 {
+			fmt.Fprintf(&b, "  persistent keepalive: every %s\n", plural(int64(p.PersistentKeepaliveInterval/time.Second), "second"))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func keyOrNone(k wgtypes.Key) string {
+	if k == (wgtypes.Key{}) {
+		return "(none)"
+	}
+	return k.String()
+}
+
+// secretOrNone is keyOrNone for private and preshared keys, which are
+// shown as "(hidden)" unless showKeys is set.
+func secretOrNone(k wgtypes.Key, showKeys bool) string {
+	if k != (wgtypes.Key{}) && !showKeys {
+		return "(hidden)"
+	}
+	return keyOrNone(k)
+}
+
+// WriteDump writes the device state in the tab-separated format of
+// `wg show all dump`. Private and preshared keys are replaced with
+// "(hidden)" unless showKeys is set.
+func WriteDump(w io.Writer, name string, dev *wgtypes.Device, showKeys bool) error {
+	var b strings.Builder
+
+	fwmark := "off"
+	if dev.FirewallMark != 0 {
+		fwmark = fmt.Sprintf("0x%x", dev.FirewallMark)
+	}
+	fmt.Fprintf(&b, "%s\t%s\t%s\t%d\t%s\n", name, secretOrNone(dev.PrivateKey, showKeys), keyOrNone(dev.PublicKey), dev.ListenPort, fwmark)
+
+	for _, p := range dev.Peers {
+		endpoint := "(none)"
+		if p.Endpoint != nil {
+			endpoint = p.Endpoint.String()
+		}
+		allowedIPs := "(none)"
+		if len(p.AllowedIPs) != 0 {
+			allowedIPs = strings.Replace(joinNets(p.AllowedIPs), ", ", ",", -1)
+		}
+		var handshake int64
+		if hasHandshake(p) {
+			handshake = p.LastHandshakeTime.Unix()
+		}
+		keepalive := "off"
+		if p.PersistentKeepaliveInterval != 0 {
+			keepalive = strconv.Itoa(int(p.PersistentKeepaliveInterval / time.Second))
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			name, p.PublicKey, secretOrNone(p.PresharedKey, showKeys), endpoint, allowedIPs,
+			handshake, p.ReceiveBytes, p.TransmitBytes, keepalive)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteStatus writes the device state using the named format, "wg-show"
+// or "wg-dump". showKeys is passed to WriteDump.
+func WriteStatus(w io.Writer, format, name string, dev *wgtypes.Device, showKeys bool) error {
+	switch format {
+	case "wg-show":
+		return WriteShow(w, name, dev)
+	case "wg-dump":
+		return WriteDump(w, name, dev, showKeys)
+	default:
+		return fmt.Errorf("unknown format: %v", format)
+	}
+}
@@ -0,0 +1,49 @@
+package wgfmt
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestWriteDumpKeys(t *testing.T) {
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &wgtypes.Device{
+		PrivateKey: priv,
+		PublicKey:  priv.PublicKey(),
+		Peers: []wgtypes.Peer{
+			{PublicKey: peer.PublicKey(), PresharedKey: psk},
+		},
+	}
+
+	for _, showKeys := range []bool{false, true} {
+		var b strings.Builder
+		if err := WriteDump(&b, "wg0", dev, showKeys); err != nil {
+			t.Fatal(err)
+		}
+		out := b.String()
+		for _, secret := range []wgtypes.Key{priv, psk} {
+			if strings.Contains(out, secret.String()) != showKeys {
+				t.Errorf("showKeys=%v: secret key presence mismatch in:\n%s", showKeys, out)
+			}
+		}
+		if !strings.Contains(out, priv.PublicKey().String()) || !strings.Contains(out, peer.PublicKey().String()) {
+			t.Errorf("showKeys=%v: public keys are missing in:\n%s", showKeys, out)
+		}
+		if !showKeys && strings.Count(out, "(hidden)") != 2 {
+			t.Errorf("showKeys=false: want 2 hidden keys in:\n%s", out)
+		}
+	}
+}
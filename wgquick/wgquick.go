@@ -0,0 +1,198 @@
+// Package wgquick parses wg-quick(8) configuration files.
+package wgquick
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type Interface struct {
+	PrivateKey wgtypes.Key
+	Addresses  []net.IPNet
+	ListenPort int
+	DNS        []string
+	MTU        int
+	Table      string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+}
+
+type Peer struct {
+	PublicKey           wgtypes.Key
+	PresharedKey        *wgtypes.Key
+	AllowedIPs          []net.IPNet
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+type Config struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+func splitList(value string) []string {
+	parts := strings.Split(value, ",")
+	res := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func parseNets(value string) ([]net.IPNet, error) {
+	var res []net.IPNet
+	for _, part := range splitList(value) {
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("malformed address: %v", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			res = append(res, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		ip, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		res = append(res, net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+	return res, nil
+}
+
+func (i *Interface) set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "privatekey":
+		i.PrivateKey, err = wgtypes.ParseKey(value)
+	case "address":
+		var addrs []net.IPNet
+		addrs, err = parseNets(value)
+		i.Addresses = append(i.Addresses, addrs...)
+	case "listenport":
+		i.ListenPort, err = strconv.Atoi(value)
+	case "dns":
+		i.DNS = append(i.DNS, splitList(value)...)
+	case "mtu":
+		i.MTU, err = strconv.Atoi(value)
+	case "table":
+		i.Table = value
+	case "preup":
+		i.PreUp = append(i.PreUp, value)
+	case "postup":
+		i.PostUp = append(i.PostUp, value)
+	case "predown":
+		i.PreDown = append(i.PreDown, value)
+	case "postdown":
+		i.PostDown = append(i.PostDown, value)
+	case "saveconfig":
+		i.SaveConfig, err = strconv.ParseBool(value)
+	case "fwmark":
+		// Not relevant for conversion.
+	default:
+		return fmt.Errorf("unknown Interface key: %v", key)
+	}
+	return err
+}
+
+func (p *Peer) set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "publickey":
+		p.PublicKey, err = wgtypes.ParseKey(value)
+	case "presharedkey":
+		var psk wgtypes.Key
+		psk, err = wgtypes.ParseKey(value)
+		p.PresharedKey = &psk
+	case "allowedips":
+		var nets []net.IPNet
+		nets, err = parseNets(value)
+		p.AllowedIPs = append(p.AllowedIPs, nets...)
+	case "endpoint":
+		p.Endpoint = value
+	case "persistentkeepalive":
+		if value == "off" {
+			return nil
+		}
+		p.PersistentKeepalive, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown Peer key: %v", key)
+	}
+	return err
+}
+
+// Parse reads the wg-quick configuration.
+func Parse(r io.Reader) (*Config, error) {
+	var (
+		cfg     Config
+		section string
+		lineNum int
+	)
+
+	scnr := bufio.NewScanner(r)
+	for scnr.Scan() {
+		lineNum++
+		line := scnr.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				cfg.Peers = append(cfg.Peers, Peer{})
+			default:
+				return nil, fmt.Errorf("wgquick: line %d: unknown section: %v", lineNum, line)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("wgquick: line %d: expected key = value", lineNum)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch section {
+		case "interface":
+			err = cfg.Interface.set(key, value)
+		case "peer":
+			err = cfg.Peers[len(cfg.Peers)-1].set(key, value)
+		default:
+			err = fmt.Errorf("key outside of section")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("wgquick: line %d: %w", lineNum, err)
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, fmt.Errorf("wgquick: %w", err)
+	}
+	return &cfg, nil
+}